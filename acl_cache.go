@@ -0,0 +1,93 @@
+package gemdrive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Every request checks the ACLs of each directory above the path, and
+// ranged media requests come in by the hundred during playback. Parsed
+// acl.json files are kept in memory, and only re-read when their mtime or
+// size changes, so edits still take effect straight away while a request
+// costs a stat per directory rather than a read and parse.
+//
+// Timestamps are only so fine, so an edit keeping the size soon after the
+// file was cached could leave both unchanged. Until a file's mtime is
+// aclRacyWindow older than when it was last checked, its content is
+// compared too.
+
+const aclRacyWindow = 2 * time.Second
+
+type cachedAcl struct {
+	entries   Acl
+	inherit   bool
+	exists    bool
+	modTime   time.Time
+	size      int64
+	content   []byte
+	checkedAt time.Time
+}
+
+type aclCache struct {
+	acls map[string]*cachedAcl
+	mut  *sync.RWMutex
+}
+
+func newAclCache() *aclCache {
+	return &aclCache{
+		acls: make(map[string]*cachedAcl),
+		mut:  &sync.RWMutex{},
+	}
+}
+
+func (c *aclCache) read(aclPath string) (Acl, bool, bool) {
+	info, err := os.Stat(aclPath)
+	if err != nil {
+		return nil, false, false
+	}
+
+	c.mut.RLock()
+	cached, exists := c.acls[aclPath]
+	c.mut.RUnlock()
+
+	unchanged := exists && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size()
+	if unchanged && cached.checkedAt.Sub(cached.modTime) >= aclRacyWindow {
+		return cached.entries, cached.inherit, cached.exists
+	}
+
+	now := time.Now()
+
+	content, err := ioutil.ReadFile(aclPath)
+	if err != nil {
+		return nil, false, false
+	}
+
+	if unchanged && bytes.Equal(content, cached.content) {
+		checked := *cached
+		checked.checkedAt = now
+		cached = &checked
+	} else {
+		entries, inherit, err := parseAcl(content)
+
+		// Unparseable files are treated as missing, like before caching,
+		// until they change again.
+		cached = &cachedAcl{
+			entries:   entries,
+			inherit:   inherit,
+			exists:    err == nil,
+			modTime:   info.ModTime(),
+			size:      info.Size(),
+			content:   content,
+			checkedAt: now,
+		}
+	}
+
+	c.mut.Lock()
+	c.acls[aclPath] = cached
+	c.mut.Unlock()
+
+	return cached.entries, cached.inherit, cached.exists
+}
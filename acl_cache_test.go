@@ -0,0 +1,159 @@
+package gemdrive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const benchAclPath = "/files/music/artist/album/track.mp3"
+
+func newBenchAuth(tb testing.TB) (*Auth, string) {
+	dir := tb.TempDir()
+
+	auth, err := NewAuth(dir, &Config{AdminEmail: "owner@example.com"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// An inheriting ACL partway down, so checks read more than one file
+	err = os.MkdirAll(filepath.Join(dir, "files", "music", "gemdrive"), 0755)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	acl := &aclFile{
+		Entries: []*AclEntry{{IdType: "email", Id: "reader@example.com", Perm: "read"}},
+	}
+	aclPath := filepath.Join(dir, "files", "music", "gemdrive", "acl.json")
+	err = saveJson(acl, aclPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// Like most ACLs, not edited recently
+	lastEdited := time.Now().Add(-time.Hour)
+	err = os.Chtimes(aclPath, lastEdited, lastEdited)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	token, err := auth.AddEphemeralKeyring([]*Key{
+		{IdType: "email", Id: "reader@example.com", Perm: "read", Path: "/files/music"},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return auth, token
+}
+
+func TestAclCacheSeesEdits(t *testing.T) {
+	auth, token := newBenchAuth(t)
+
+	if !auth.CanRead(token, benchAclPath) {
+		t.Fatal("reader can't read")
+	}
+
+	acl := &aclFile{
+		Entries: []*AclEntry{{IdType: "email", Id: "someone-else@example.com", Perm: "read"}},
+	}
+	err := saveJson(acl, filepath.Join(auth.dataDir, "files", "music", "gemdrive", "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth.CanRead(token, benchAclPath) {
+		t.Error("reader can still read after being removed from the ACL")
+	}
+}
+
+// Edits keeping the size and landing within the same timestamp tick look
+// unchanged to stat.
+func TestAclCacheSeesSameSizeEdits(t *testing.T) {
+	auth, token := newBenchAuth(t)
+
+	aclPath := filepath.Join(auth.dataDir, "files", "music", "gemdrive", "acl.json")
+	tick := time.Now().Truncate(time.Second)
+	err := os.Chtimes(aclPath, tick, tick)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(aclPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !auth.CanRead(token, benchAclPath) {
+		t.Fatal("reader can't read")
+	}
+
+	acl := &aclFile{
+		Entries: []*AclEntry{{IdType: "email", Id: "readex@example.com", Perm: "read"}},
+	}
+	err = saveJson(acl, aclPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(aclPath, tick, tick)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if edited, _ := os.Stat(aclPath); edited.Size() != info.Size() {
+		t.Fatalf("edit changed the size from %d to %d", info.Size(), edited.Size())
+	}
+
+	if auth.CanRead(token, benchAclPath) {
+		t.Error("reader can still read after being removed from the ACL")
+	}
+}
+
+func TestTokenLookupCacheSeesRevocation(t *testing.T) {
+	auth, _ := newBenchAuth(t)
+
+	token, serviceToken, err := auth.CreateServiceToken("backups", "read", "/files/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := auth.getKeyring(token); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = auth.RevokeServiceToken(serviceToken.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.getKeyring(token); err == nil {
+		t.Error("revoked token still has a keyring")
+	}
+}
+
+func BenchmarkCan(b *testing.B) {
+	auth, token := newBenchAuth(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !auth.CanRead(token, benchAclPath) {
+			b.Fatal("reader can't read")
+		}
+	}
+}
+
+// Reading and parsing every acl.json each time, as before the cache.
+func BenchmarkCanUncached(b *testing.B) {
+	auth, token := newBenchAuth(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		auth.acls = newAclCache()
+		if !auth.CanRead(token, benchAclPath) {
+			b.Fatal("reader can't read")
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package gemdrive
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Routes gemdrive/admin/* requests. Each handler is responsible for
+// checking that the requester is an admin.
+func (s *Server) handleAdminRequest(w http.ResponseWriter, r *http.Request, adminReq string) {
+	parts := strings.SplitN(adminReq, "/", 2)
+
+	rest := ""
+	if len(parts) == 2 {
+		rest = parts[1]
+	}
+
+	switch parts[0] {
+	case "service-tokens":
+		s.handleServiceTokens(w, r, rest)
+	case "transfers":
+		s.handleTransfers(w, r, rest, true)
+	case "deletes":
+		s.handleDeleteJobs(w, r, rest, true)
+	case "lockouts":
+		s.handleLockouts(w, r, rest)
+	case "backends":
+		s.handleBackendMetrics(w, r, "json")
+	case "metrics":
+		s.handleBackendMetrics(w, r, "prometheus")
+	case "bandwidth":
+		s.handleBandwidth(w, r)
+	case "tasks":
+		s.handleTasks(w, r, rest)
+	case "approvals":
+		s.handleApprovals(w, r, rest)
+	case "holds":
+		s.handleLegalHolds(w, r, rest)
+	default:
+		w.WriteHeader(404)
+		io.WriteString(w, "Unknown endpoint")
+	}
+}
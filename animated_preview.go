@@ -0,0 +1,177 @@
+package gemdrive
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// With animated previews enabled, GIF thumbnails keep their animation and
+// videos get a short looping GIF made by ffmpeg. Both cost far more CPU than
+// still thumbnails, so they're off by default.
+
+const videoPreviewSeconds = 3
+
+func isVideoName(name string) bool {
+	return strings.HasPrefix(mime.TypeByExtension(filepath.Ext(name)), "video/")
+}
+
+func isGifName(name string) bool {
+	return strings.ToLower(filepath.Ext(name)) == ".gif"
+}
+
+// Content type of a thumbnail, where it differs from that of its source.
+func thumbnailContentType(name string) string {
+	if isRawName(name) {
+		return "image/jpeg"
+	}
+	if isVideoName(name) {
+		return "image/gif"
+	}
+	return ""
+}
+
+func (fs *FileSystemBackend) getAnimatedImage(fsPath string, size int, thumbPath string) (io.Reader, int64, error) {
+
+	if thumbnailStale(thumbPath, fsPath) {
+		err := os.MkdirAll(filepath.Dir(thumbPath), 0755)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if isVideoName(fsPath) {
+			err = fs.images.run(func() error {
+				return makeVideoPreview(fsPath, size, thumbPath)
+			})
+		} else {
+			err = fs.images.run(func() error {
+				return resizeGifFile(fsPath, size, thumbPath, fs.images)
+			})
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	data, err := ioutil.ReadFile(thumbPath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+func makeVideoPreview(fsPath string, size int, outPath string) error {
+	// Fit within a size x size box, keeping dimensions even as some
+	// encoders require
+	scale := fmt.Sprintf("scale='if(gt(iw,ih),%d,-2)':'if(gt(iw,ih),-2,%d)':flags=lanczos", size, size)
+	filter := "fps=8," + scale + ",split[a][b];[a]palettegen[p];[b][p]paletteuse"
+
+	tmpPath := outPath + ".tmp.gif"
+
+	cmd := exec.Command("ffmpeg", "-v", "error", "-t", fmt.Sprintf("%d", videoPreviewSeconds),
+		"-i", fsPath, "-vf", filter, "-loop", "0", "-y", tmpPath)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ffmpeg failed: %s %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return os.Rename(tmpPath, outPath)
+}
+
+func resizeGifFile(fsPath string, size int, outPath string, pool *ImagePool) error {
+	file, err := os.Open(fsPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = pool.checkSource(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	src, err := gif.DecodeAll(file)
+	if err != nil {
+		return err
+	}
+
+	resized := resizeGif(src, size)
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return gif.EncodeAll(out, resized)
+}
+
+// Frames in a GIF may only cover part of the image and rely on what earlier
+// frames left behind, so each is composited onto a full canvas before being
+// resized. The output frames are all full size.
+func resizeGif(src *gif.GIF, size int) *gif.GIF {
+	bounds := image.Rect(0, 0, src.Config.Width, src.Config.Height)
+
+	resizeWidth := uint(size)
+	resizeHeight := uint(size)
+	if bounds.Dx() > bounds.Dy() {
+		resizeHeight = 0
+	} else {
+		resizeWidth = 0
+	}
+
+	canvas := image.NewRGBA(bounds)
+
+	out := &gif.GIF{
+		LoopCount: src.LoopCount,
+	}
+
+	for i, frame := range src.Image {
+		var previous *image.RGBA
+		if src.Disposal != nil && src.Disposal[i] == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, image.ZP, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		scaled := resize.Resize(resizeWidth, resizeHeight, canvas, resize.Lanczos3)
+
+		paletted := image.NewPaletted(scaled.Bounds(), frame.Palette)
+		draw.FloydSteinberg.Draw(paletted, scaled.Bounds(), scaled, image.ZP)
+
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, src.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+
+		if src.Disposal != nil {
+			switch src.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+	}
+
+	return out
+}
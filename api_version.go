@@ -0,0 +1,129 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Every gemdrive/ endpoint is also reachable under a versioned prefix, ie
+// gemdrive/v1/meta.json. Unprefixed requests get the oldest behavior still
+// supported, so a breaking change to a response format or the upload
+// protocol can ship as v2 while existing clients carry on as before.
+// Clients discover what a server speaks from gemdrive/version.json.
+
+const ServerName = "gemdrive-go"
+
+// Supported API versions, oldest first
+var apiVersions = []int{1}
+
+type VersionManifest struct {
+	Server      string   `json:"server"`
+	ApiVersions []int    `json:"apiVersions"`
+	Features    []string `json:"features"`
+}
+
+// Strips any version prefix from gemReq. The returned version is 0 for
+// unprefixed requests. Requests for versions the server doesn't speak get a
+// 404.
+func parseApiVersion(gemReq string) (string, int, error) {
+	if !strings.HasPrefix(gemReq, "v") {
+		return gemReq, 0, nil
+	}
+
+	parts := strings.SplitN(gemReq[1:], "/", 2)
+
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		// Not a version prefix
+		return gemReq, 0, nil
+	}
+
+	for _, supported := range apiVersions {
+		if supported == version {
+			rest := ""
+			if len(parts) == 2 {
+				rest = parts[1]
+			}
+			return rest, version, nil
+		}
+	}
+
+	return "", 0, &Error{
+		HttpCode: 404,
+		Message:  "Unsupported API version",
+	}
+}
+
+func (s *Server) features() []string {
+	features := []string{
+		"attrs",
+		"checksums",
+		"chunkedUploads",
+		"deleteJobs",
+		"dropShares",
+		"encryptionMetadata",
+		"legalHolds",
+		"listingChanges",
+		"listingNegotiation",
+		"listingPages",
+		"move",
+		"permissions",
+		"rangedUploads",
+		"refreshTokens",
+		"shares",
+		"snapshots",
+		"transfers",
+		"uploadOwners",
+	}
+
+	if _, ok := s.backend.(ImageServer); ok {
+		features = append(features, "images")
+	}
+
+	if _, ok := s.backend.(MediaMetaServer); ok {
+		features = append(features, "gallery", "music")
+	}
+
+	if s.dlna != nil {
+		features = append(features, "dlna")
+	}
+
+	if s.indexer != nil {
+		features = append(features, "index")
+	}
+
+	if s.config.NinepAddr != "" {
+		features = append(features, "9p")
+	}
+
+	if s.approvals != nil {
+		features = append(features, "twoPersonApproval")
+	}
+
+	sort.Strings(features)
+
+	return features
+}
+
+// Handles gemdrive/version.json
+func (s *Server) serveVersion(w http.ResponseWriter, r *http.Request) {
+	manifest := &VersionManifest{
+		Server:      ServerName,
+		ApiVersions: apiVersions,
+		Features:    s.features(),
+	}
+
+	jsonBody, err := json.Marshal(manifest)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
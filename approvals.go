@@ -0,0 +1,338 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With twoPersonApproval set, destructive admin actions don't happen when
+// they're requested. The request gets a 202 with a pending approval
+// instead, and the action only runs once an owner with a different identity
+// POSTs to gemdrive/admin/approvals/<id>. Pending approvals are listed at
+// gemdrive/admin/approvals, and either owner can DELETE one to call it off.
+// They're kept in the data dir, and expire if nobody approves them in time.
+//
+// The actions covered are recursive deletes of an export root and lifting
+// legal holds. Revoking a service token isn't one, so a leaked token can be
+// cut off immediately.
+
+const approvalExpiry = 24 * time.Hour
+
+const (
+	approvalDeleteExport = "deleteExport"
+	// No longer requested, but may still be pending
+	approvalRevokeServiceToken = "revokeServiceToken"
+	approvalLiftLegalHold      = "liftLegalHold"
+)
+
+type PendingApproval struct {
+	Id     string `json:"id"`
+	Action string `json:"action"`
+	// The path or token id acted on
+	Target      string   `json:"target"`
+	RequestedBy []string `json:"requestedBy"`
+	RequestedAt string   `json:"requestedAt"`
+	ExpiresAt   string   `json:"expiresAt"`
+}
+
+type approvalQueue struct {
+	pending map[string]*PendingApproval
+	path    string
+	mut     *sync.Mutex
+}
+
+func newApprovalQueue(dataDir string) *approvalQueue {
+	q := &approvalQueue{
+		pending: make(map[string]*PendingApproval),
+		path:    filepath.Join(dataDir, "gemdrive_approvals.json"),
+		mut:     &sync.Mutex{},
+	}
+
+	approvalsJson, err := ioutil.ReadFile(q.path)
+	if err != nil {
+		return q
+	}
+
+	var saved []*PendingApproval
+	err = json.Unmarshal(approvalsJson, &saved)
+	if err != nil {
+		fmt.Println("Ignoring invalid pending approvals:", err)
+		return q
+	}
+
+	for _, approval := range saved {
+		q.pending[approval.Id] = approval
+	}
+
+	return q
+}
+
+// Queues action on target, or returns the same action already waiting.
+func (q *approvalQueue) request(action, target string, requestedBy []string) (*PendingApproval, error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	q.expire()
+
+	for _, approval := range q.pending {
+		if approval.Action == action && approval.Target == target {
+			return approval, nil
+		}
+	}
+
+	id, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	approval := &PendingApproval{
+		Id:          id,
+		Action:      action,
+		Target:      target,
+		RequestedBy: requestedBy,
+		RequestedAt: now.Format(time.RFC3339),
+		ExpiresAt:   now.Add(approvalExpiry).Format(time.RFC3339),
+	}
+
+	q.pending[id] = approval
+	q.persist()
+
+	fmt.Println("Approval needed to", action, target, "requested by", strings.Join(requestedBy, ","))
+
+	return approval, nil
+}
+
+func (q *approvalQueue) list() []*PendingApproval {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	q.expire()
+
+	approvals := []*PendingApproval{}
+	for _, approval := range q.pending {
+		approvals = append(approvals, approval)
+	}
+
+	sort.Slice(approvals, func(i, j int) bool {
+		return approvals[i].RequestedAt < approvals[j].RequestedAt
+	})
+
+	return approvals
+}
+
+// Removes and returns the approval, so it can only be acted on once. The
+// approver must not share an identity with whoever requested it.
+func (q *approvalQueue) approve(id string, approvedBy []string) (*PendingApproval, error) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	q.expire()
+
+	approval, exists := q.pending[id]
+	if !exists {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "No such approval",
+		}
+	}
+
+	for _, requester := range approval.RequestedBy {
+		for _, approver := range approvedBy {
+			if requester == approver {
+				return nil, &Error{
+					HttpCode: 403,
+					Message:  "Approval must come from a different owner",
+				}
+			}
+		}
+	}
+
+	delete(q.pending, id)
+	q.persist()
+
+	fmt.Println("Approved", approval.Action, approval.Target, "by", strings.Join(approvedBy, ","))
+
+	return approval, nil
+}
+
+func (q *approvalQueue) cancel(id string) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if _, exists := q.pending[id]; !exists {
+		return false
+	}
+
+	delete(q.pending, id)
+	q.persist()
+
+	return true
+}
+
+// Must be called with the lock held.
+func (q *approvalQueue) expire() {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	expired := false
+	for id, approval := range q.pending {
+		if approval.ExpiresAt < now {
+			delete(q.pending, id)
+			expired = true
+		}
+	}
+
+	if expired {
+		q.persist()
+	}
+}
+
+// Must be called with the lock held.
+func (q *approvalQueue) persist() {
+	saved := []*PendingApproval{}
+	for _, approval := range q.pending {
+		saved = append(saved, approval)
+	}
+
+	err := saveJson(saved, q.path)
+	if err != nil {
+		fmt.Println("Failed to save pending approvals:", err)
+	}
+}
+
+// Export roots are the first level of paths, ie /files/
+func isExportRoot(reqPath string) bool {
+	return strings.Count(reqPath, "/") <= 2 && strings.HasSuffix(reqPath, "/")
+}
+
+// Queues the action if approval is required, responding with the pending
+// approval, and returns whether it did.
+func (s *Server) deferForApproval(w http.ResponseWriter, r *http.Request, action, target string) bool {
+	if s.approvals == nil {
+		return false
+	}
+
+	token, _ := extractToken(r)
+
+	approval, err := s.approvals.request(action, target, s.auth.Principals(token))
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return true
+	}
+
+	jsonBody, err := json.Marshal(approval)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(202)
+	w.Write(jsonBody)
+
+	return true
+}
+
+// Carries out an approved action, returning anything worth reporting.
+func (s *Server) runApproved(approval *PendingApproval) (interface{}, error) {
+	switch approval.Action {
+	case approvalDeleteExport:
+		job, err := s.deleteJobs.start(approval.Target, strings.Join(approval.RequestedBy, ","))
+		if err != nil {
+			return nil, err
+		}
+		return s.deleteJobs.get(job.Id, "", true)
+	case approvalRevokeServiceToken:
+		err := s.auth.RevokeServiceToken(approval.Target)
+		if err != nil {
+			return nil, &Error{
+				HttpCode: 404,
+				Message:  err.Error(),
+			}
+		}
+		return nil, nil
+	case approvalLiftLegalHold:
+		return nil, s.holds.lift(approval.Target, approval.RequestedBy)
+	default:
+		return nil, fmt.Errorf("Unknown action %s", approval.Action)
+	}
+}
+
+// Handles gemdrive/admin/approvals[/<id>]
+func (s *Server) handleApprovals(w http.ResponseWriter, r *http.Request, id string) {
+
+	token, _ := extractToken(r)
+
+	if !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	if s.approvals == nil {
+		w.WriteHeader(404)
+		io.WriteString(w, "Two-person approval not enabled")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		jsonBody, err := json.Marshal(s.approvals.list())
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "POST":
+		approval, err := s.approvals.approve(id, s.auth.Principals(token))
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		}
+
+		result, err := s.runApproved(approval)
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if result == nil {
+			return
+		}
+
+		jsonBody, err := json.Marshal(result)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "DELETE":
+		if !s.approvals.cancel(id) {
+			w.WriteHeader(404)
+			io.WriteString(w, "Not found")
+			return
+		}
+	default:
+		w.WriteHeader(405)
+	}
+}
@@ -0,0 +1,381 @@
+package gemdrive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Zip and tar files can be browsed as if they were directories, ie
+// /backups/photos.zip/2020/img.jpg. Stored zip entries and all tar entries
+// support true ranged reads. Compressed zip entries have to be inflated
+// from the start, but nothing is ever extracted to disk. Indexes are kept,
+// along with the open file, until the archive's mtime or size changes, so
+// ranged reads don't rescan it every time.
+
+// Most archives kept open at once
+const maxCachedArchives = 16
+
+type archive struct {
+	file    *os.File
+	entries map[string]*archiveEntry
+	modTime time.Time
+	size    int64
+	cache   *archiveCache
+	// Guarded by the cache's lock
+	refs     int
+	evicted  bool
+	lastUsed time.Time
+}
+
+type archiveEntry struct {
+	size         int64
+	modTime      time.Time
+	isDir        bool
+	isExecutable bool
+	open         func(offset, length int64) (io.ReadCloser, error)
+}
+
+type archiveCache struct {
+	archives map[string]*archive
+	mut      *sync.Mutex
+}
+
+func newArchiveCache() *archiveCache {
+	return &archiveCache{
+		archives: make(map[string]*archive),
+		mut:      &sync.Mutex{},
+	}
+}
+
+func isArchiveName(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".zip" || ext == ".tar"
+}
+
+// The returned archive must be closed when done with.
+func (c *archiveCache) open(fsPath string) (*archive, error) {
+	notFound := &Error{
+		HttpCode: 404,
+		Message:  "Not found",
+	}
+
+	stat, err := os.Stat(fsPath)
+	if err != nil {
+		return nil, notFound
+	}
+
+	c.mut.Lock()
+	cached, exists := c.archives[fsPath]
+	if exists && cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size() {
+		cached.refs++
+		cached.lastUsed = time.Now()
+		c.mut.Unlock()
+		return cached, nil
+	}
+	c.mut.Unlock()
+
+	file, err := os.Open(fsPath)
+	if err != nil {
+		return nil, notFound
+	}
+
+	a, err := indexArchive(file, fsPath)
+	if err != nil {
+		file.Close()
+		return nil, &Error{
+			HttpCode: 500,
+			Message:  "Error reading archive: " + err.Error(),
+		}
+	}
+	a.cache = c
+	a.refs = 1
+	a.lastUsed = time.Now()
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if old, exists := c.archives[fsPath]; exists {
+		c.evict(fsPath, old)
+	}
+	c.archives[fsPath] = a
+
+	if len(c.archives) > maxCachedArchives {
+		oldestPath := ""
+		var oldest *archive
+		for p, other := range c.archives {
+			if oldest == nil || other.lastUsed.Before(oldest.lastUsed) {
+				oldestPath = p
+				oldest = other
+			}
+		}
+		c.evict(oldestPath, oldest)
+	}
+
+	return a, nil
+}
+
+// Must be called with the lock held. Archives still being read are closed
+// once they're done with.
+func (c *archiveCache) evict(fsPath string, a *archive) {
+	delete(c.archives, fsPath)
+	a.evicted = true
+	if a.refs == 0 {
+		a.file.Close()
+	}
+}
+
+func indexArchive(file *os.File, fsPath string) (*archive, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &archive{
+		file:    file,
+		entries: make(map[string]*archiveEntry),
+		modTime: stat.ModTime(),
+		size:    stat.Size(),
+	}
+
+	if strings.ToLower(path.Ext(fsPath)) == ".zip" {
+		err = a.indexZip()
+	} else {
+		err = a.indexTar()
+	}
+
+	return a, err
+}
+
+// Releases the archive, which stays cached.
+func (a *archive) Close() error {
+	a.cache.mut.Lock()
+	defer a.cache.mut.Unlock()
+
+	a.refs--
+	if a.evicted && a.refs == 0 {
+		return a.file.Close()
+	}
+	return nil
+}
+
+func (a *archive) indexZip() error {
+	zr, err := zip.NewReader(a.file, a.size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		f := f
+
+		if strings.HasSuffix(f.Name, "/") {
+			a.addEntry(f.Name, &archiveEntry{
+				modTime: f.Modified,
+				isDir:   true,
+			})
+			continue
+		}
+
+		entry := &archiveEntry{
+			size:         int64(f.UncompressedSize64),
+			modTime:      f.Modified,
+			isExecutable: f.Mode()&0111 != 0,
+		}
+
+		if f.Method == zip.Store {
+			dataOffset, err := f.DataOffset()
+			if err != nil {
+				return err
+			}
+			entry.open = func(offset, length int64) (io.ReadCloser, error) {
+				return ioutil.NopCloser(io.NewSectionReader(a.file, dataOffset+offset, length)), nil
+			}
+		} else {
+			entry.open = func(offset, length int64) (io.ReadCloser, error) {
+				rc, err := f.Open()
+				if err != nil {
+					return nil, err
+				}
+				_, err = io.CopyN(ioutil.Discard, rc, offset)
+				if err != nil {
+					rc.Close()
+					return nil, err
+				}
+				return &limitedReadCloser{io.LimitReader(rc, length), rc}, nil
+			}
+		}
+
+		a.addEntry(f.Name, entry)
+	}
+
+	return nil
+}
+
+func (a *archive) indexTar() error {
+	tr := tar.NewReader(a.file)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			a.addEntry(hdr.Name, &archiveEntry{
+				modTime: hdr.ModTime,
+				isDir:   true,
+			})
+		case tar.TypeReg:
+			// After Next the file is positioned at the start of the entry's
+			// data, so we can record where it lives and seek there later.
+			dataOffset, err := a.file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			a.addEntry(hdr.Name, &archiveEntry{
+				size:         hdr.Size,
+				modTime:      hdr.ModTime,
+				isExecutable: hdr.Mode&0111 != 0,
+				open: func(offset, length int64) (io.ReadCloser, error) {
+					return ioutil.NopCloser(io.NewSectionReader(a.file, dataOffset+offset, length)), nil
+				},
+			})
+		}
+	}
+
+	return nil
+}
+
+// Entries are keyed by their cleaned path within the archive, with a
+// trailing slash for directories. Parent directories are added implicitly
+// since archives aren't required to contain them.
+func (a *archive) addEntry(name string, entry *archiveEntry) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return
+	}
+
+	if entry.isDir {
+		a.entries[name+"/"] = entry
+	} else {
+		a.entries[name] = entry
+	}
+
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if _, exists := a.entries[dir+"/"]; exists {
+			break
+		}
+		a.entries[dir+"/"] = &archiveEntry{
+			modTime: entry.modTime,
+			isDir:   true,
+		}
+	}
+}
+
+func (a *archive) List(dirPath string, depth int) (*Item, error) {
+	if dirPath != "" {
+		if _, exists := a.entries[dirPath]; !exists {
+			return nil, &Error{
+				HttpCode: 404,
+				Message:  "Not found",
+			}
+		}
+	}
+
+	item := &Item{}
+
+	for name, entry := range a.entries {
+		if !strings.HasPrefix(name, dirPath) || name == dirPath {
+			continue
+		}
+
+		childName := strings.TrimPrefix(name, dirPath)
+		slashIdx := strings.Index(childName, "/")
+		if slashIdx != -1 && slashIdx != len(childName)-1 {
+			continue
+		}
+
+		if item.Children == nil {
+			item.Children = make(map[string]*Item)
+		}
+
+		child := &Item{
+			Size:         entry.size,
+			ModTime:      entry.modTime.UTC().Format(time.RFC3339),
+			IsExecutable: entry.isExecutable,
+		}
+
+		if entry.isDir && depth != 1 {
+			childDepth := 0
+			if depth > 1 {
+				childDepth = depth - 1
+			}
+
+			subItem, err := a.List(name, childDepth)
+			if err != nil {
+				return nil, err
+			}
+			child.Children = subItem.Children
+		}
+
+		item.Children[childName] = child
+	}
+
+	return item, nil
+}
+
+// The returned reader is only valid until the archive is closed.
+func (a *archive) Read(filePath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	entry, exists := a.entries[filePath]
+	if !exists {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if offset > entry.size {
+		return nil, nil, &Error{
+			HttpCode: 416,
+			Message:  "Invalid offset",
+		}
+	}
+
+	copyLength := length
+	if length == 0 || offset+length > entry.size {
+		copyLength = entry.size - offset
+	}
+
+	reader, err := entry.open(offset, copyLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	item := &Item{
+		Size:         entry.size,
+		ModTime:      entry.modTime.UTC().Format(time.RFC3339),
+		IsExecutable: entry.isExecutable,
+	}
+
+	return item, reader, nil
+}
+
+type archiveReadCloser struct {
+	io.ReadCloser
+	archive *archive
+}
+
+func (r *archiveReadCloser) Close() error {
+	r.ReadCloser.Close()
+	return r.archive.Close()
+}
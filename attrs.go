@@ -0,0 +1,383 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Files can carry small string attributes, kept in the data dir like upload
+// records, ie DataDir/<dir>/gemdrive/attrs.json, so they follow the file
+// when it's moved and go when it's deleted. Anyone who can list a directory
+// can read them, at <dir>/gemdrive/attrs.json for all its files or
+// <dir>/gemdrive/attrs/<name> for one, and anyone who can modify a file can
+// PUT a new set for it, or DELETE them all.
+//
+// Backends that can keep attributes with the files themselves, like local
+// exports with xattrs enabled, are used instead of the data dir.
+
+const maxAttrKeyLength = 256
+
+// Across all of a file's attributes
+const maxAttrsSize = 64 * 1024
+
+// Backends which store attributes natively. They return errNoNativeAttrs
+// for paths they can't store them on.
+type AttrBackend interface {
+	GetAttrs(path string) (map[string]string, error)
+	SetAttrs(path string, attrs map[string]string) error
+	ListAttrs(dirPath string) (map[string]map[string]string, error)
+}
+
+var errNoNativeAttrs = errors.New("Attributes not stored by backend")
+
+type attrStore struct {
+	dataDir string
+	native  AttrBackend
+	mut     *sync.Mutex
+	cluster *cluster
+}
+
+func newAttrStore(dataDir string, backend Backend, cluster *cluster) *attrStore {
+	native, _ := backend.(AttrBackend)
+
+	return &attrStore{
+		dataDir: dataDir,
+		native:  native,
+		mut:     &sync.Mutex{},
+		cluster: cluster,
+	}
+}
+
+func (a *attrStore) recordsPath(dirPath string) string {
+	return filepath.Join(a.dataDir, dirPath, "gemdrive", "attrs.json")
+}
+
+func (a *attrStore) readRecords(dirPath string) map[string]map[string]string {
+	records := make(map[string]map[string]string)
+
+	recordsJson, err := ioutil.ReadFile(a.recordsPath(dirPath))
+	if err != nil {
+		return records
+	}
+
+	err = json.Unmarshal(recordsJson, &records)
+	if err != nil {
+		fmt.Println("Ignoring invalid attributes in", dirPath, err)
+		return make(map[string]map[string]string)
+	}
+
+	return records
+}
+
+func (a *attrStore) writeRecords(dirPath string, records map[string]map[string]string) error {
+	recordsPath := a.recordsPath(dirPath)
+
+	if len(records) == 0 {
+		err := os.Remove(recordsPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(recordsPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return saveJson(records, recordsPath)
+}
+
+func validateAttrs(attrs map[string]string) error {
+	size := 0
+	for key, value := range attrs {
+		if key == "" || len(key) > maxAttrKeyLength {
+			return &Error{
+				HttpCode: 400,
+				Message:  fmt.Sprintf("Attribute names must be 1 to %d bytes", maxAttrKeyLength),
+			}
+		}
+		size += len(key) + len(value)
+	}
+
+	if size > maxAttrsSize {
+		return &Error{
+			HttpCode: 413,
+			Message:  "Attributes too large",
+		}
+	}
+
+	return nil
+}
+
+func (a *attrStore) get(reqPath string) map[string]string {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	if a.native != nil {
+		attrs, err := a.native.GetAttrs(reqPath)
+		if err == nil {
+			return attrs
+		} else if err != errNoNativeAttrs {
+			if !os.IsNotExist(err) {
+				fmt.Println("Failed to read attributes of", reqPath, err)
+			}
+			return make(map[string]string)
+		}
+	}
+
+	dirPath, name := splitItemPath(reqPath)
+
+	attrs := a.readRecords(dirPath)[name]
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+
+	return attrs
+}
+
+func (a *attrStore) list(dirPath string) map[string]map[string]string {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	records := a.readRecords(dirPath)
+
+	if a.native != nil {
+		nativeRecords, err := a.native.ListAttrs(dirPath)
+		if err != nil && err != errNoNativeAttrs {
+			fmt.Println("Failed to read attributes in", dirPath, err)
+		}
+		for name, attrs := range nativeRecords {
+			records[name] = attrs
+		}
+	}
+
+	return records
+}
+
+// Replaces all of reqPath's attributes.
+func (a *attrStore) set(reqPath string, attrs map[string]string) error {
+	return a.update(reqPath, func(map[string]string) map[string]string {
+		return attrs
+	})
+}
+
+// Changes reqPath's attributes with fn, which may modify and return the
+// map it's given.
+func (a *attrStore) update(reqPath string, fn func(attrs map[string]string) map[string]string) error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	defer a.cluster.lock("attrs")()
+
+	if a.native != nil {
+		attrs, err := a.native.GetAttrs(reqPath)
+		if err == nil {
+			attrs = fn(attrs)
+
+			err = validateAttrs(attrs)
+			if err != nil {
+				return err
+			}
+
+			return a.native.SetAttrs(reqPath, attrs)
+		} else if err != errNoNativeAttrs {
+			return err
+		}
+	}
+
+	dirPath, name := splitItemPath(reqPath)
+
+	records := a.readRecords(dirPath)
+
+	attrs := records[name]
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+
+	attrs = fn(attrs)
+
+	err := validateAttrs(attrs)
+	if err != nil {
+		return err
+	}
+
+	if len(attrs) == 0 {
+		if _, exists := records[name]; !exists {
+			return nil
+		}
+		delete(records, name)
+	} else {
+		records[name] = attrs
+	}
+
+	return a.writeRecords(dirPath, records)
+}
+
+// Forgets reqPath's attributes, and for directories everything beneath it.
+func (a *attrStore) remove(reqPath string) error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	defer a.cluster.lock("attrs")()
+
+	if strings.HasSuffix(reqPath, "/") {
+		err := walkRecordDirs(a.dataDir, reqPath, "attrs.json", func(subDir string) error {
+			err := os.Remove(a.recordsPath(subDir))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	dirPath, name := splitItemPath(reqPath)
+
+	records := a.readRecords(dirPath)
+	if _, exists := records[name]; !exists {
+		return nil
+	}
+	delete(records, name)
+
+	return a.writeRecords(dirPath, records)
+}
+
+// Carries attributes along with a moved file or directory.
+func (a *attrStore) move(srcPath, dstPath string) error {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	defer a.cluster.lock("attrs")()
+
+	if strings.HasSuffix(srcPath, "/") {
+		err := walkRecordDirs(a.dataDir, srcPath, "attrs.json", func(subDir string) error {
+			dstDir := dstPath + strings.TrimPrefix(subDir, srcPath)
+
+			err := os.MkdirAll(filepath.Dir(a.recordsPath(dstDir)), 0755)
+			if err != nil {
+				return err
+			}
+
+			return os.Rename(a.recordsPath(subDir), a.recordsPath(dstDir))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	srcDir, srcName := splitItemPath(srcPath)
+
+	srcRecords := a.readRecords(srcDir)
+	attrs, exists := srcRecords[srcName]
+	if !exists {
+		return nil
+	}
+	delete(srcRecords, srcName)
+
+	err := a.writeRecords(srcDir, srcRecords)
+	if err != nil {
+		return err
+	}
+
+	dstDir, dstName := splitItemPath(dstPath)
+
+	dstRecords := a.readRecords(dstDir)
+	dstRecords[dstName] = attrs
+
+	return a.writeRecords(dstDir, dstRecords)
+}
+
+// Handles <dir>/gemdrive/attrs.json and <dir>/gemdrive/attrs/<name>
+func (s *Server) handleAttrs(w http.ResponseWriter, r *http.Request, dirPath, name string) {
+
+	token, _ := extractToken(r)
+
+	// Uploaders can label their own files without being able to list
+	if r.Method == "GET" && !s.auth.CanList(token, dirPath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	var result interface{}
+
+	if name == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(405)
+			return
+		}
+		result = s.attrs.list(dirPath)
+	} else {
+		filePath := dirPath + name
+
+		switch r.Method {
+		case "GET":
+			result = s.attrs.get(filePath)
+		case "PUT", "DELETE":
+			if !s.canModify(token, filePath) {
+				s.sendLoginPage(w, r)
+				return
+			}
+
+			if err := s.holds.check(filePath); err != nil {
+				w.WriteHeader(errLegalHold.HttpCode)
+				io.WriteString(w, errLegalHold.Message)
+				return
+			}
+
+			exists, err := s.itemExists(filePath)
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+			if !exists {
+				w.WriteHeader(404)
+				io.WriteString(w, "Not found")
+				return
+			}
+
+			attrs := make(map[string]string)
+			if r.Method == "PUT" {
+				err = json.NewDecoder(io.LimitReader(r.Body, 2*maxAttrsSize)).Decode(&attrs)
+				if err != nil {
+					w.WriteHeader(400)
+					io.WriteString(w, "Expected a JSON object of strings")
+					return
+				}
+			}
+
+			err = s.attrs.set(filePath, attrs)
+			if e, ok := err.(*Error); ok {
+				w.WriteHeader(e.HttpCode)
+				io.WriteString(w, e.Message)
+				return
+			} else if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+
+			result = attrs
+		default:
+			w.WriteHeader(405)
+			return
+		}
+	}
+
+	jsonBody, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
@@ -0,0 +1,493 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Just enough tag parsing to browse a music collection: ID3 for MP3s, and
+// Vorbis comments for FLAC, Ogg Vorbis and Opus files.
+
+type AudioTags struct {
+	Title       string `json:"title,omitempty"`
+	Artist      string `json:"artist,omitempty"`
+	AlbumArtist string `json:"albumArtist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	Track       int    `json:"track,omitempty"`
+	Disc        int    `json:"disc,omitempty"`
+	Year        int    `json:"year,omitempty"`
+	Genre       string `json:"genre,omitempty"`
+}
+
+// Comments, and Ogg pages, can hold cover art, which isn't needed
+const maxAudioTagSize = 4 * 1024 * 1024
+
+func isAudioName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp3", ".flac", ".ogg", ".oga", ".opus":
+		return true
+	}
+	return false
+}
+
+func readAudioTags(file io.ReadSeeker, name string) (*AudioTags, error) {
+	tags := &AudioTags{}
+
+	var err error
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp3":
+		readId3v2(file, tags)
+		if !tags.complete() {
+			readId3v1(file, tags)
+		}
+		if tags.empty() {
+			return nil, errors.New("No ID3 tags")
+		}
+		return tags, nil
+	case ".flac":
+		err = readFlacTags(file, tags)
+	default:
+		err = readOggTags(file, tags)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (tags *AudioTags) empty() bool {
+	return *tags == AudioTags{}
+}
+
+func (tags *AudioTags) complete() bool {
+	return tags.Title != "" && tags.Artist != "" && tags.Album != ""
+}
+
+// Reads the number from "3" or "3/12".
+func parseTagNumber(value string) int {
+	value = strings.TrimSpace(strings.Split(value, "/")[0])
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+// Reads the year from a date, which may be more precise.
+func parseTagYear(value string) int {
+	value = strings.TrimSpace(value)
+	if len(value) < 4 {
+		return 0
+	}
+	year, _ := strconv.Atoi(value[:4])
+	return year
+}
+
+func syncsafeInt(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func readId3v2(file io.ReadSeeker, tags *AudioTags) error {
+	var header [10]byte
+	_, err := io.ReadFull(file, header[:])
+	if err != nil {
+		return err
+	}
+
+	if string(header[0:3]) != "ID3" {
+		return errors.New("No ID3v2 tag")
+	}
+
+	version := header[3]
+	flags := header[5]
+	size := syncsafeInt(header[6:10])
+
+	if version < 2 || version > 4 {
+		return errors.New("Unsupported ID3v2 version")
+	}
+	if size > maxAudioTagSize {
+		size = maxAudioTagSize
+	}
+
+	body := make([]byte, size)
+	n, err := io.ReadFull(file, body)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	body = body[:n]
+
+	if flags&0x80 != 0 {
+		body = bytes.ReplaceAll(body, []byte{0xff, 0x00}, []byte{0xff})
+	}
+
+	pos := 0
+	if flags&0x40 != 0 && version >= 3 && len(body) >= 4 {
+		if version == 3 {
+			pos = int(binary.BigEndian.Uint32(body[0:4])) + 4
+		} else {
+			pos = syncsafeInt(body[0:4])
+		}
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+
+	for pos+headerLen <= len(body) {
+		id := string(body[pos : pos+idLen])
+		if id[0] == 0 {
+			// Padding
+			break
+		}
+
+		var frameSize int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int(body[pos+3])<<16 | int(body[pos+4])<<8 | int(body[pos+5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(body[pos+4 : pos+8]))
+			frameFlags = binary.BigEndian.Uint16(body[pos+8 : pos+10])
+		case 4:
+			frameSize = syncsafeInt(body[pos+4 : pos+8])
+			frameFlags = binary.BigEndian.Uint16(body[pos+8 : pos+10])
+		}
+
+		pos += headerLen
+		if frameSize < 0 || pos+frameSize > len(body) {
+			break
+		}
+		frame := body[pos : pos+frameSize]
+		pos += frameSize
+
+		// Compressed or encrypted
+		if version == 3 && frameFlags&0x00c0 != 0 || version == 4 && frameFlags&0x000c != 0 {
+			continue
+		}
+		if version == 4 {
+			if frameFlags&0x0001 != 0 && len(frame) >= 4 {
+				frame = frame[4:]
+			}
+			if frameFlags&0x0002 != 0 {
+				frame = bytes.ReplaceAll(frame, []byte{0xff, 0x00}, []byte{0xff})
+			}
+		}
+
+		if len(id) == 0 || id[0] != 'T' {
+			continue
+		}
+
+		value := decodeId3Text(frame)
+
+		switch id {
+		case "TIT2", "TT2":
+			tags.Title = value
+		case "TPE1", "TP1":
+			tags.Artist = value
+		case "TPE2", "TP2":
+			tags.AlbumArtist = value
+		case "TALB", "TAL":
+			tags.Album = value
+		case "TRCK", "TRK":
+			tags.Track = parseTagNumber(value)
+		case "TPOS", "TPA":
+			tags.Disc = parseTagNumber(value)
+		case "TYER", "TYE", "TDRC":
+			tags.Year = parseTagYear(value)
+		case "TCON", "TCO":
+			tags.Genre = id3Genre(value)
+		}
+	}
+
+	return nil
+}
+
+// Decodes the first value of a text frame.
+func decodeId3Text(frame []byte) string {
+	if len(frame) == 0 {
+		return ""
+	}
+
+	encoding, data := frame[0], frame[1:]
+
+	var text string
+	switch encoding {
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+			bigEndian = true
+			data = data[2:]
+		} else if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+			bigEndian = false
+			data = data[2:]
+		}
+
+		units := []uint16{}
+		for i := 0; i+1 < len(data); i += 2 {
+			var unit uint16
+			if bigEndian {
+				unit = binary.BigEndian.Uint16(data[i:])
+			} else {
+				unit = binary.LittleEndian.Uint16(data[i:])
+			}
+			if unit == 0 {
+				break
+			}
+			units = append(units, unit)
+		}
+		text = string(utf16.Decode(units))
+	case 3:
+		text = strings.Split(string(data), "\x00")[0]
+	default:
+		text = latin1(bytes.Split(data, []byte{0})[0])
+	}
+
+	return strings.TrimSpace(text)
+}
+
+func latin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// Genres can be given as ID3v1 genre numbers, ie "(17)" or "17".
+func id3Genre(value string) string {
+	number := value
+	if strings.HasPrefix(number, "(") && strings.HasSuffix(number, ")") {
+		number = number[1 : len(number)-1]
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return value
+	}
+	if n >= 0 && n < len(id3v1Genres) {
+		return id3v1Genres[n]
+	}
+	return ""
+}
+
+// Fills in anything missing from the ID3v1 tag at the end of the file.
+func readId3v1(file io.ReadSeeker, tags *AudioTags) {
+	_, err := file.Seek(-128, io.SeekEnd)
+	if err != nil {
+		return
+	}
+
+	var tag [128]byte
+	_, err = io.ReadFull(file, tag[:])
+	if err != nil || string(tag[0:3]) != "TAG" {
+		return
+	}
+
+	field := func(b []byte) string {
+		return strings.TrimSpace(latin1(bytes.Split(b, []byte{0})[0]))
+	}
+
+	if tags.Title == "" {
+		tags.Title = field(tag[3:33])
+	}
+	if tags.Artist == "" {
+		tags.Artist = field(tag[33:63])
+	}
+	if tags.Album == "" {
+		tags.Album = field(tag[63:93])
+	}
+	if tags.Year == 0 {
+		tags.Year = parseTagYear(field(tag[93:97]))
+	}
+	// ID3v1.1 keeps the track number at the end of the comment
+	if tags.Track == 0 && tag[125] == 0 && tag[126] != 0 {
+		tags.Track = int(tag[126])
+	}
+	if tags.Genre == "" && int(tag[127]) < len(id3v1Genres) {
+		tags.Genre = id3v1Genres[tag[127]]
+	}
+}
+
+func readFlacTags(file io.ReadSeeker, tags *AudioTags) error {
+	var magic [4]byte
+	_, err := io.ReadFull(file, magic[:])
+	if err != nil {
+		return err
+	}
+	if string(magic[:]) != "fLaC" {
+		return errors.New("Not a FLAC file")
+	}
+
+	for {
+		var header [4]byte
+		_, err := io.ReadFull(file, header[:])
+		if err != nil {
+			return err
+		}
+
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		blockLen := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+
+		if blockType == 4 {
+			block := make([]byte, blockLen)
+			_, err := io.ReadFull(file, block)
+			if err != nil {
+				return err
+			}
+			parseVorbisComments(block, tags)
+			return nil
+		}
+
+		if last {
+			return errors.New("No Vorbis comments")
+		}
+
+		_, err = file.Seek(blockLen, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The comment header is the second packet of the stream.
+func readOggTags(file io.ReadSeeker, tags *AudioTags) error {
+	packets := [][]byte{}
+	var packet []byte
+	var total int
+
+pages:
+	for len(packets) < 2 {
+		var header [27]byte
+		_, err := io.ReadFull(file, header[:])
+		if err != nil {
+			return err
+		}
+		if string(header[0:4]) != "OggS" {
+			return errors.New("Not an Ogg file")
+		}
+
+		segmentTable := make([]byte, header[26])
+		_, err = io.ReadFull(file, segmentTable)
+		if err != nil {
+			return err
+		}
+
+		for _, lacing := range segmentTable {
+			segment := make([]byte, lacing)
+			_, err := io.ReadFull(file, segment)
+			if err != nil {
+				return err
+			}
+
+			total += int(lacing)
+			if total > maxAudioTagSize {
+				// Whatever fits is enough, since cover art comes last
+				packets = append(packets, packet)
+				break pages
+			}
+
+			packet = append(packet, segment...)
+			if lacing < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+	}
+
+	if len(packets) < 2 {
+		return errors.New("No Vorbis comments")
+	}
+
+	comments := packets[1]
+	switch {
+	case bytes.HasPrefix(comments, []byte("\x03vorbis")):
+		comments = comments[7:]
+	case bytes.HasPrefix(comments, []byte("OpusTags")):
+		comments = comments[8:]
+	default:
+		return errors.New("No Vorbis comments")
+	}
+
+	parseVorbisComments(comments, tags)
+	return nil
+}
+
+// Parses as many comments as there are, since they may have been cut short.
+func parseVorbisComments(data []byte, tags *AudioTags) {
+	readLen := func() (int, bool) {
+		if len(data) < 4 {
+			return 0, false
+		}
+		n := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		return n, n >= 0
+	}
+
+	vendorLen, ok := readLen()
+	if !ok || vendorLen > len(data) {
+		return
+	}
+	data = data[vendorLen:]
+
+	count, ok := readLen()
+	if !ok {
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		commentLen, ok := readLen()
+		if !ok || commentLen > len(data) {
+			return
+		}
+		comment := string(data[:commentLen])
+		data = data[commentLen:]
+
+		parts := strings.SplitN(comment, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+
+		switch strings.ToUpper(parts[0]) {
+		case "TITLE":
+			tags.Title = value
+		case "ARTIST":
+			tags.Artist = value
+		case "ALBUMARTIST", "ALBUM ARTIST":
+			tags.AlbumArtist = value
+		case "ALBUM":
+			tags.Album = value
+		case "TRACKNUMBER":
+			tags.Track = parseTagNumber(value)
+		case "DISCNUMBER":
+			tags.Disc = parseTagNumber(value)
+		case "DATE", "YEAR":
+			tags.Year = parseTagYear(value)
+		case "GENRE":
+			tags.Genre = value
+		}
+	}
+}
+
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic", "Darkwave",
+	"Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap",
+	"Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal",
+	"Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll",
+	"Hard Rock",
+}
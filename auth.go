@@ -8,11 +8,12 @@ import (
 	"io/ioutil"
 	"log"
 	"math/big"
-	"net/smtp"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,8 +21,12 @@ type Auth struct {
 	dataDir             string
 	db                  *Database
 	config              *Config
+	codeSender          CodeSender
 	pendingAuthRequests map[string]*AuthRequest
+	ephemeralKeyrings   map[string][]*Key
 	mut                 *sync.Mutex
+	acls                *aclCache
+	shared              *redisClient
 }
 
 type AuthRequest struct {
@@ -29,23 +34,30 @@ type AuthRequest struct {
 	keyring []*Key
 }
 
+// How pending logins are stored in Redis
+type sharedAuthRequest struct {
+	Code    string `json:"code"`
+	Keyring []*Key `json:"keyring"`
+}
+
+const authRequestTimeout = 60 * time.Second
+
 type Acl []*AclEntry
 
-func (a Acl) CanRead(id string) bool {
+// Deny entries win over any entry allowing the same action.
+func (a Acl) Allows(id, action string) bool {
+	allowed := false
 	for _, entry := range a {
-		if entry.Id == id && permCanRead(entry.Perm) {
-			return true
+		if entry.Id != id || !permAllows(entry.Perm, action) {
+			continue
 		}
-	}
-	return false
-}
-func (a Acl) CanWrite(id string) bool {
-	for _, entry := range a {
-		if entry.Id == id && permCanWrite(entry.Perm) {
-			return true
+
+		if entry.Deny {
+			return false
 		}
+		allowed = true
 	}
-	return false
+	return allowed
 }
 
 // TODO: Replace with Key?
@@ -53,6 +65,17 @@ type AclEntry struct {
 	IdType string `json:"idType"`
 	Id     string `json:"id"`
 	Perm   string `json:"perm"`
+	Deny   bool   `json:"deny,omitempty"`
+}
+
+// acl.json files are either a plain list of entries, which replaces the
+// ACLs of parent directories, or an object whose entries are added to its
+// parents' unless noInherit is set:
+//
+//	{"entries": [{"idType": "public", "id": "public", "perm": "read", "deny": true}]}
+type aclFile struct {
+	Entries   []*AclEntry `json:"entries"`
+	NoInherit bool        `json:"noInherit,omitempty"`
 }
 
 type Key struct {
@@ -62,21 +85,50 @@ type Key struct {
 	Path   string `json:"path"`
 }
 
-func (k Key) CanRead(pathStr string) bool {
-	isSubpath := strings.HasPrefix(pathStr, k.Path)
-	return isSubpath && permCanRead(k.Perm)
-}
-func (k Key) CanWrite(pathStr string) bool {
+func (k Key) Allows(pathStr, action string) bool {
 	isSubpath := strings.HasPrefix(pathStr, k.Path)
-	return isSubpath && permCanWrite(k.Perm)
+	return isSubpath && permAllows(k.Perm, action)
 }
 
 type Database struct {
-	Keys map[string][]*Key `json:"keys"`
-	mut  *sync.Mutex
-	path string
+	Keys          map[string][]*Key        `json:"keys"`
+	ServiceTokens map[string]*ServiceToken `json:"serviceTokens,omitempty"`
+	Shares        map[string]*Share        `json:"shares,omitempty"`
+	Sessions      map[string]*Session      `json:"sessions,omitempty"`
+	Expiries      map[string]int64         `json:"expiries,omitempty"`
+	Bindings      map[string]*TokenBinding `json:"bindings,omitempty"`
+	TokenSalt     string                   `json:"tokenSalt,omitempty"`
+	mut           *sync.Mutex
+	path          string
+	// Set when the database lives in Redis
+	shared       *redisClient
+	revision     string
+	unlockShared func()
+	// Keyrings by unhashed token, so lookups skip hashing. Emptied
+	// whenever the database might change.
+	lookups map[string]*cachedKeyring
+	// Set while other instances' changes are announced to us, and when
+	// one has been since the last sync
+	watching int32
+	stale    int32
+	syncedAt time.Time
+}
+
+// Instances announce changes to the shared database here, so reads only
+// go to Redis after one, or while the announcements can't be heard. In case
+// an announcement is lost anyway, reads still check every so often.
+const authDbChannel = "auth_db_changes"
+const authDbMaxStale = 10 * time.Second
+
+type cachedKeyring struct {
+	keyring   []*Key
+	expiresAt int64
 }
 
+// Lookups cached before they're all dropped, so made up tokens can't grow
+// the cache forever
+const maxCachedLookups = 10000
+
 func NewDatabase(dir string) *Database {
 
 	dbPath := path.Join(dir, "gemdrive_auth_db.json")
@@ -89,44 +141,318 @@ func NewDatabase(dir string) *Database {
 	var db *Database
 
 	err = json.Unmarshal(dbJson, &db)
-	if err != nil {
-		db = &Database{
-			Keys: make(map[string][]*Key),
+	if err != nil || db == nil {
+		db = &Database{}
+	}
+
+	db.fillMaps()
+
+	if db.TokenSalt == "" {
+		err := db.hashStoredTokens()
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
 
 	db.path = dbPath
 
 	db.mut = &sync.Mutex{}
+	db.lookups = make(map[string]*cachedKeyring)
 
 	db.persist()
 
 	return db
 }
 
-func (db *Database) GetKeyring(token string) ([]*Key, error) {
+func (db *Database) fillMaps() {
+	if db.Keys == nil {
+		db.Keys = make(map[string][]*Key)
+	}
+
+	if db.ServiceTokens == nil {
+		db.ServiceTokens = make(map[string]*ServiceToken)
+	}
+
+	if db.Shares == nil {
+		db.Shares = make(map[string]*Share)
+	}
+
+	if db.Sessions == nil {
+		db.Sessions = make(map[string]*Session)
+	}
+
+	if db.Expiries == nil {
+		db.Expiries = make(map[string]int64)
+	}
+
+	if db.Bindings == nil {
+		db.Bindings = make(map[string]*TokenBinding)
+	}
+}
+
+// Moves the database into Redis, unless another instance already has, in
+// which case that copy is used instead.
+func (db *Database) share(shared *redisClient) error {
+	unlock, err := shared.lock("auth_db")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	db.mut.Lock()
 	defer db.mut.Unlock()
 
-	key, exists := db.Keys[token]
+	db.shared = shared
+
+	go db.watch()
+
+	_, exists, err := shared.get("auth_db")
+	if err != nil {
+		return err
+	}
+
 	if !exists {
-		return nil, errors.New("Does not exist")
+		return db.store()
 	}
 
-	return key, nil
+	return db.sync()
 }
 
-func (db *Database) SetKeyring(token string, keyring []*Key) {
+// Takes the lock for a change. When shared that's Redis's lock too, and
+// changes other instances made are loaded first.
+func (db *Database) lock() {
 	db.mut.Lock()
-	defer db.mut.Unlock()
 
-	db.Keys[token] = keyring
+	db.lookups = make(map[string]*cachedKeyring)
+
+	if db.shared == nil {
+		return
+	}
+
+	unlock, err := db.shared.lock("auth_db")
+	if err != nil {
+		fmt.Println("Failed to lock auth database in Redis:", err)
+		return
+	}
+	db.unlockShared = unlock
+
+	err = db.sync()
+	if err != nil {
+		fmt.Println("Failed to load auth database from Redis:", err)
+	}
+}
+
+// Takes the lock for reading, which only needs other instances' changes,
+// and only once they've announced some.
+func (db *Database) lockRead() {
+	db.mut.Lock()
+
+	if db.shared == nil {
+		return
+	}
+
+	fresh := time.Since(db.syncedAt) < authDbMaxStale
+	if atomic.LoadInt32(&db.watching) == 1 && atomic.SwapInt32(&db.stale, 0) == 0 && fresh {
+		return
+	}
+
+	err := db.sync()
+	if err != nil {
+		atomic.StoreInt32(&db.stale, 1)
+		fmt.Println("Failed to load auth database from Redis:", err)
+	}
+}
+
+// Listens for other instances' changes. Whatever was missed while not
+// listening is loaded by the next read.
+func (db *Database) watch() {
+	for {
+		err := db.shared.subscribe(authDbChannel, func() {
+			atomic.StoreInt32(&db.stale, 1)
+			atomic.StoreInt32(&db.watching, 1)
+		}, func(string) {
+			atomic.StoreInt32(&db.stale, 1)
+		})
+
+		atomic.StoreInt32(&db.watching, 0)
+
+		fmt.Println("Lost auth database changes from Redis, reconnecting:", err)
+
+		time.Sleep(time.Second)
+	}
+}
+
+func (db *Database) unlock() {
+	if db.unlockShared != nil {
+		db.unlockShared()
+		db.unlockShared = nil
+	}
+
+	db.mut.Unlock()
+}
+
+// Loads the shared database if it's changed. Must be called with the lock
+// held.
+func (db *Database) sync() error {
+	revision, _, err := db.shared.get("auth_db_revision")
+	if err != nil {
+		return err
+	}
+
+	db.syncedAt = time.Now()
+
+	if revision == db.revision {
+		return nil
+	}
+
+	var loaded *Database
+	exists, err := db.shared.getJson("auth_db", &loaded)
+	if err != nil {
+		return err
+	}
+	if !exists || loaded == nil {
+		return errors.New("Auth database missing from Redis")
+	}
+
+	loaded.fillMaps()
+
+	// Tokens handed out within the refresh grace period are only kept here
+	for id, session := range loaded.Sessions {
+		if current, exists := db.Sessions[id]; exists && current.RefreshToken == session.RefreshToken {
+			session.tokens = current.tokens
+		}
+	}
+
+	db.Keys = loaded.Keys
+	db.ServiceTokens = loaded.ServiceTokens
+	db.Shares = loaded.Shares
+	db.Sessions = loaded.Sessions
+	db.Expiries = loaded.Expiries
+	db.Bindings = loaded.Bindings
+	db.TokenSalt = loaded.TokenSalt
+	db.revision = revision
+	db.lookups = make(map[string]*cachedKeyring)
+
+	return nil
+}
+
+// Must be called with the lock held.
+func (db *Database) store() error {
+	err := db.shared.setJson("auth_db", db, 0)
+	if err != nil {
+		return err
+	}
+
+	revision, err := db.shared.incr("auth_db_revision")
+	if err != nil {
+		return err
+	}
+
+	db.revision = strconv.FormatInt(revision, 10)
+
+	err = db.shared.publish(authDbChannel, db.revision)
+	if err != nil {
+		fmt.Println("Failed to announce auth database change:", err)
+	}
+
+	return nil
+}
+
+func (db *Database) GetKeyring(token string) ([]*Key, error) {
+	db.lockRead()
+	defer db.unlock()
+
+	cached, exists := db.lookups[token]
+	if !exists {
+		tokenHash := db.hashToken(token)
+
+		keyring, exists := db.Keys[tokenHash]
+		if !exists {
+			return nil, errors.New("Does not exist")
+		}
+
+		if len(db.lookups) >= maxCachedLookups {
+			db.lookups = make(map[string]*cachedKeyring)
+		}
+
+		cached = &cachedKeyring{
+			keyring:   keyring,
+			expiresAt: db.Expiries[tokenHash],
+		}
+		db.lookups[token] = cached
+	}
+
+	if cached.expiresAt != 0 && cached.expiresAt < time.Now().Unix() {
+		return nil, errors.New("Expired")
+	}
+
+	return cached.keyring, nil
+}
+
+func (db *Database) SetKeyring(token string, keyring []*Key) {
+	db.lock()
+	defer db.unlock()
+
+	db.Keys[db.hashToken(token)] = keyring
+
+	db.persist()
+}
+
+func (db *Database) AddServiceToken(token string, serviceToken *ServiceToken) {
+	db.lock()
+	defer db.unlock()
+
+	tokenHash := db.hashToken(token)
+
+	stored := *serviceToken
+	stored.Token = tokenHash
+
+	db.Keys[tokenHash] = []*Key{serviceToken.Key}
+	db.ServiceTokens[serviceToken.Id] = &stored
+	serviceToken.Token = token
+
+	db.persist()
+}
+
+func (db *Database) GetServiceTokens() []*ServiceToken {
+	db.lockRead()
+	defer db.unlock()
+
+	serviceTokens := []*ServiceToken{}
+	for _, serviceToken := range db.ServiceTokens {
+		serviceTokens = append(serviceTokens, serviceToken)
+	}
+
+	return serviceTokens
+}
+
+func (db *Database) RevokeServiceToken(id string) error {
+	db.lock()
+	defer db.unlock()
+
+	serviceToken, exists := db.ServiceTokens[id]
+	if !exists {
+		return errors.New("Does not exist")
+	}
+
+	delete(db.Keys, serviceToken.Token)
+	delete(db.ServiceTokens, id)
 
 	db.persist()
+
+	return nil
 }
 
 func (db *Database) persist() {
-	saveJson(db, db.path)
+	if db.shared == nil {
+		saveJson(db, db.path)
+		return
+	}
+
+	err := db.store()
+	if err != nil {
+		fmt.Println("Failed to store auth database in Redis:", err)
+	}
 }
 
 func NewAuth(dataDir string, config *Config) (*Auth, error) {
@@ -153,12 +479,31 @@ func NewAuth(dataDir string, config *Config) (*Auth, error) {
 		}
 	}
 
+	codeSender, err := newCodeSender(config)
+	if err != nil {
+		return nil, err
+	}
+
 	db := NewDatabase(dataDir)
 
+	var shared *redisClient
+	if config.Redis != nil {
+		shared, err = newRedisClient(config.Redis)
+		if err != nil {
+			return nil, err
+		}
+
+		err = db.share(shared)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	pendingAuthRequests := make(map[string]*AuthRequest)
+	ephemeralKeyrings := make(map[string][]*Key)
 	mut := &sync.Mutex{}
 
-	return &Auth{dataDir, db, config, pendingAuthRequests, mut}, nil
+	return &Auth{dataDir, db, config, codeSender, pendingAuthRequests, ephemeralKeyrings, mut, newAclCache(), shared}, nil
 }
 
 func (a *Auth) Authorize(key Key) (string, error) {
@@ -173,27 +518,22 @@ func (a *Auth) Authorize(key Key) (string, error) {
 		return "", err
 	}
 
-	bodyTemplate := "From: %s <%s>\r\n" +
-		"To: %s\r\n" +
-		"Subject: Email Verification\r\n" +
-		"\r\n" +
-		"An application wants to access your data. Use the following code to complete authorization:\r\n" +
-		"\r\n" +
-		"%s\r\n"
-
-	fromText := "GemDrive email verifier"
-	fromEmail := a.config.Smtp.Sender
-	email := key.Id
-	emailBody := fmt.Sprintf(bodyTemplate, fromText, fromEmail, email, code)
-
-	emailAuth := smtp.PlainAuth("", a.config.Smtp.Username, a.config.Smtp.Password, a.config.Smtp.Server)
-	srv := fmt.Sprintf("%s:%d", a.config.Smtp.Server, a.config.Smtp.Port)
-	msg := []byte(emailBody)
-	err = smtp.SendMail(srv, emailAuth, fromEmail, []string{email}, msg)
+	err = a.codeSender.SendCode(key, code)
 	if err != nil {
 		return "", err
 	}
 
+	if a.shared != nil {
+		err = a.shared.setJson("login:"+requestId, &sharedAuthRequest{
+			Code:    code,
+			Keyring: []*Key{&key},
+		}, authRequestTimeout)
+		if err != nil {
+			return "", err
+		}
+		return requestId, nil
+	}
+
 	a.mut.Lock()
 	a.pendingAuthRequests[requestId] = &AuthRequest{
 		code:    code,
@@ -203,7 +543,7 @@ func (a *Auth) Authorize(key Key) (string, error) {
 
 	// Requests expire after a certain time
 	go func() {
-		time.Sleep(60 * time.Second)
+		time.Sleep(authRequestTimeout)
 		a.mut.Lock()
 		delete(a.pendingAuthRequests, requestId)
 		a.mut.Unlock()
@@ -212,40 +552,80 @@ func (a *Auth) Authorize(key Key) (string, error) {
 	return requestId, nil
 }
 
-func (a *Auth) CompleteAuth(requestId, code string) (string, error) {
+// The principal a pending login is for, or "" if there's no such login.
+func (a *Auth) PendingIdentity(requestId string) string {
+	req, exists := a.pendingRequest(requestId, false)
+	if !exists || len(req.keyring) == 0 {
+		return ""
+	}
 
-	a.mut.Lock()
-	req, exists := a.pendingAuthRequests[requestId]
-	delete(a.pendingAuthRequests, requestId)
-	a.mut.Unlock()
+	return req.keyring[0].IdType + ":" + req.keyring[0].Id
+}
+
+func (a *Auth) CompleteAuth(requestId, code string, binding *TokenBinding) (*SessionTokens, error) {
+
+	req, exists := a.pendingRequest(requestId, true)
 
 	if exists && req.code == code {
-		token, err := genRandomKey()
-		if err != nil {
-			return "", err
+		return a.db.CreateSession(req.keyring, binding)
+	}
+
+	return nil, errors.New("Invalid code")
+}
+
+// Looks up a pending login, optionally removing it so it can only be
+// completed once.
+func (a *Auth) pendingRequest(requestId string, remove bool) (*AuthRequest, bool) {
+	if a.shared == nil {
+		a.mut.Lock()
+		defer a.mut.Unlock()
+
+		req, exists := a.pendingAuthRequests[requestId]
+		if remove {
+			delete(a.pendingAuthRequests, requestId)
 		}
-		a.db.SetKeyring(token, req.keyring)
-		return token, nil
+		return req, exists
+	}
+
+	var req *sharedAuthRequest
+	exists, err := a.shared.getJson("login:"+requestId, &req)
+	if err == nil && exists && remove {
+		// Whoever deletes it gets to use it
+		exists, err = a.shared.del("login:" + requestId)
+	}
+	if err != nil {
+		fmt.Println("Failed to look up pending login in Redis:", err)
+		return nil, false
+	}
+
+	if !exists || req == nil {
+		return nil, false
 	}
 
-	return "", nil
+	return &AuthRequest{
+		code:    req.Code,
+		keyring: req.Keyring,
+	}, true
 }
 
-func (a *Auth) CanRead(token, pathStr string) bool {
+// Whether token may do action at pathStr. Both one of the token's keys and
+// the ACL covering the path have to allow it. Listing and reading can also
+// be granted to everyone with a "public" ACL entry.
+func (a *Auth) Can(token, pathStr, action string) bool {
 
 	acl := a.GetAcl(pathStr)
 
-	if acl.CanRead("public") {
+	if (action == actList || action == actRead) && acl.Allows("public", action) {
 		return true
 	}
 
-	keyring, err := a.db.GetKeyring(token)
+	keyring, err := a.getKeyring(token)
 	if err != nil {
 		return false
 	}
 
 	for _, key := range keyring {
-		if key.CanRead(pathStr) && acl.CanRead(key.Id) {
+		if key.Allows(pathStr, action) && acl.Allows(key.Id, action) {
 			return true
 		}
 	}
@@ -253,54 +633,141 @@ func (a *Auth) CanRead(token, pathStr string) bool {
 	return false
 }
 
-func (a *Auth) CanWrite(token, pathStr string) bool {
+func (a *Auth) CanList(token, pathStr string) bool {
+	return a.Can(token, pathStr, actList)
+}
 
-	acl := a.GetAcl(pathStr)
+func (a *Auth) CanRead(token, pathStr string) bool {
+	return a.Can(token, pathStr, actRead)
+}
+
+func (a *Auth) CanCreate(token, pathStr string) bool {
+	return a.Can(token, pathStr, actCreate)
+}
+
+func (a *Auth) CanModify(token, pathStr string) bool {
+	return a.Can(token, pathStr, actModify)
+}
+
+func (a *Auth) CanDelete(token, pathStr string) bool {
+	return a.Can(token, pathStr, actDelete)
+}
+
+func (a *Auth) CanShare(token, pathStr string) bool {
+	return a.Can(token, pathStr, actShare)
+}
+
+func (a *Auth) CanOwn(token, pathStr string) bool {
+	return a.Can(token, pathStr, actAdmin)
+}
+
+// Returns the ids of all keys held by a token.
+func (a *Auth) Identities(token string) []string {
+	ids := []string{}
 
-	keyring, err := a.db.GetKeyring(token)
+	keyring, err := a.getKeyring(token)
 	if err != nil {
-		return false
+		return ids
 	}
 
 	for _, key := range keyring {
-		if key.CanWrite(pathStr) && acl.CanWrite(key.Id) {
-			return true
-		}
+		ids = append(ids, key.Id)
 	}
 
-	return false
+	return ids
+}
+
+// Describes who holds a token, ie for logging. Service accounts and users
+// are distinguished by their id type.
+func (a *Auth) Principals(token string) []string {
+	principals := []string{}
+
+	keyring, err := a.getKeyring(token)
+	if err != nil {
+		return principals
+	}
+
+	for _, key := range keyring {
+		principals = append(principals, key.IdType+":"+key.Id)
+	}
+
+	return principals
+}
+
+// Ephemeral keyrings live in memory only, ie for the duration of a single
+// federated request.
+func (a *Auth) AddEphemeralKeyring(keyring []*Key) (string, error) {
+	token, err := genRandomKey()
+	if err != nil {
+		return "", err
+	}
+
+	a.mut.Lock()
+	a.ephemeralKeyrings[token] = keyring
+	a.mut.Unlock()
+
+	return token, nil
+}
+
+func (a *Auth) RemoveEphemeralKeyring(token string) {
+	a.mut.Lock()
+	delete(a.ephemeralKeyrings, token)
+	a.mut.Unlock()
+}
+
+func (a *Auth) getKeyring(token string) ([]*Key, error) {
+	a.mut.Lock()
+	keyring, exists := a.ephemeralKeyrings[token]
+	a.mut.Unlock()
+
+	if exists {
+		return keyring, nil
+	}
+
+	return a.db.GetKeyring(token)
 }
 
+// Gathers the ACL for pathStr from the nearest acl.json up, for as long as
+// they inherit.
 func (a *Auth) GetAcl(pathStr string) Acl {
 
 	parts := strings.Split(pathStr, "/")
 
+	acl := Acl{}
+
 	for i := len(parts) - 1; i > 0; i-- {
 		p := strings.Join(parts[:i], "/")
 		aclPath := path.Join(a.dataDir, p, "gemdrive", "acl.json")
 
-		acl, err := readAcl(aclPath)
-		if err == nil {
-			return acl
+		entries, inherit, exists := a.acls.read(aclPath)
+		if !exists {
+			continue
+		}
+
+		acl = append(acl, entries...)
+
+		if !inherit {
+			break
 		}
 	}
 
-	return Acl{}
+	return acl
 }
 
-func readAcl(pathStr string) (Acl, error) {
-	aclBytes, err := ioutil.ReadFile(pathStr)
-	if err != nil {
-		return nil, err
+func parseAcl(aclBytes []byte) (Acl, bool, error) {
+	var acl Acl
+	err := json.Unmarshal(aclBytes, &acl)
+	if err == nil {
+		return acl, false, nil
 	}
 
-	var acl Acl
-	err = json.Unmarshal(aclBytes, &acl)
+	var file aclFile
+	err = json.Unmarshal(aclBytes, &file)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	return acl, nil
+	return file.Entries, !file.NoInherit, nil
 }
 
 func saveJson(data interface{}, filePath string) error {
@@ -316,18 +783,6 @@ func saveJson(data interface{}, filePath string) error {
 	return nil
 }
 
-func permCanRead(perm string) bool {
-	return perm == "read" || permCanWrite(perm)
-}
-
-func permCanWrite(perm string) bool {
-	return perm == "write" || permCanOwn(perm)
-}
-
-func permCanOwn(perm string) bool {
-	return perm == "own"
-}
-
 func genCode() (string, error) {
 	const chars string = "0123456789"
 	id := ""
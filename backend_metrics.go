@@ -0,0 +1,234 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend operations are timed per mount as MultiBackend routes them, so
+// operators can find which export, and which directory in it, is slow.
+// Operations slower than the threshold are logged, and the slowest are kept
+// for gemdrive/admin/backends, with totals also served in Prometheus' text
+// format at gemdrive/admin/metrics. Reads are only timed until the data
+// starts flowing. Writes are timed until they're stored, which includes
+// however long the client takes to send the data.
+
+const defaultSlowOpThreshold = time.Second
+
+// Slowest operations kept per mount
+const maxSlowOps = 20
+
+type BackendOpStats struct {
+	Count   int64 `json:"count"`
+	Errors  int64 `json:"errors"`
+	TotalMs int64 `json:"totalMs"`
+	MaxMs   int64 `json:"maxMs"`
+}
+
+type SlowOp struct {
+	Op         string `json:"op"`
+	Path       string `json:"path"`
+	DurationMs int64  `json:"durationMs"`
+	At         string `json:"at"`
+}
+
+type MountStats struct {
+	Mount   string                     `json:"mount"`
+	Ops     map[string]*BackendOpStats `json:"ops"`
+	Slowest []*SlowOp                  `json:"slowest"`
+	// State of the mount's circuit breaker, if it has one
+	Circuit string `json:"circuit,omitempty"`
+}
+
+type backendMetrics struct {
+	slowThreshold time.Duration
+	mounts        map[string]*MountStats
+	mut           *sync.Mutex
+}
+
+func newBackendMetrics(slowOpMillis int) *backendMetrics {
+	slowThreshold := defaultSlowOpThreshold
+	if slowOpMillis > 0 {
+		slowThreshold = time.Duration(slowOpMillis) * time.Millisecond
+	}
+
+	return &backendMetrics{
+		slowThreshold: slowThreshold,
+		mounts:        make(map[string]*MountStats),
+		mut:           &sync.Mutex{},
+	}
+}
+
+// Times an operation. Call the returned func with its error once it's done.
+func (m *backendMetrics) start(mount, op, reqPath string) func(error) {
+	if m == nil {
+		return func(error) {}
+	}
+
+	start := time.Now()
+
+	return func(err error) {
+		m.record(mount, op, reqPath, time.Since(start), err)
+	}
+}
+
+func (m *backendMetrics) record(mount, op, reqPath string, duration time.Duration, err error) {
+	if duration >= m.slowThreshold {
+		fmt.Println("Slow backend operation:", op, "/"+mount+reqPath, "took", duration)
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	stats, exists := m.mounts[mount]
+	if !exists {
+		stats = &MountStats{
+			Mount: mount,
+			Ops:   make(map[string]*BackendOpStats),
+		}
+		m.mounts[mount] = stats
+	}
+
+	opStats, exists := stats.Ops[op]
+	if !exists {
+		opStats = &BackendOpStats{}
+		stats.Ops[op] = opStats
+	}
+
+	ms := duration.Milliseconds()
+
+	opStats.Count++
+	opStats.TotalMs += ms
+	if ms > opStats.MaxMs {
+		opStats.MaxMs = ms
+	}
+	if err != nil {
+		opStats.Errors++
+	}
+
+	if len(stats.Slowest) == maxSlowOps && ms <= stats.Slowest[len(stats.Slowest)-1].DurationMs {
+		return
+	}
+
+	stats.Slowest = append(stats.Slowest, &SlowOp{
+		Op:         op,
+		Path:       "/" + mount + reqPath,
+		DurationMs: ms,
+		At:         time.Now().UTC().Format(time.RFC3339),
+	})
+
+	sort.SliceStable(stats.Slowest, func(i, j int) bool {
+		return stats.Slowest[i].DurationMs > stats.Slowest[j].DurationMs
+	})
+
+	if len(stats.Slowest) > maxSlowOps {
+		stats.Slowest = stats.Slowest[:maxSlowOps]
+	}
+}
+
+func (m *backendMetrics) snapshot() []*MountStats {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	mounts := []*MountStats{}
+	for _, stats := range m.mounts {
+		ops := make(map[string]*BackendOpStats)
+		for op, opStats := range stats.Ops {
+			copied := *opStats
+			ops[op] = &copied
+		}
+
+		mounts = append(mounts, &MountStats{
+			Mount:   stats.Mount,
+			Ops:     ops,
+			Slowest: append([]*SlowOp{}, stats.Slowest...),
+		})
+	}
+
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Mount < mounts[j].Mount
+	})
+
+	return mounts
+}
+
+func (m *backendMetrics) writePrometheus(w io.Writer) {
+	mounts := m.snapshot()
+
+	metrics := []struct {
+		name  string
+		help  string
+		value func(*BackendOpStats) float64
+	}{
+		{"gemdrive_backend_ops_total", "Backend operations", func(s *BackendOpStats) float64 { return float64(s.Count) }},
+		{"gemdrive_backend_errors_total", "Backend operations which failed", func(s *BackendOpStats) float64 { return float64(s.Errors) }},
+		{"gemdrive_backend_seconds_total", "Time spent in backend operations", func(s *BackendOpStats) float64 { return float64(s.TotalMs) / 1000 }},
+		{"gemdrive_backend_max_seconds", "Slowest backend operation", func(s *BackendOpStats) float64 { return float64(s.MaxMs) / 1000 }},
+	}
+
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		if strings.HasSuffix(metric.name, "_total") {
+			fmt.Fprintf(w, "# TYPE %s counter\n", metric.name)
+		} else {
+			fmt.Fprintf(w, "# TYPE %s gauge\n", metric.name)
+		}
+
+		for _, stats := range mounts {
+			ops := []string{}
+			for op := range stats.Ops {
+				ops = append(ops, op)
+			}
+			sort.Strings(ops)
+
+			for _, op := range ops {
+				fmt.Fprintf(w, "%s{mount=%q,op=%q} %g\n", metric.name, stats.Mount, op, metric.value(stats.Ops[op]))
+			}
+		}
+	}
+}
+
+// Handles gemdrive/admin/backends and gemdrive/admin/metrics, which also
+// includes bandwidth counters
+func (s *Server) handleBackendMetrics(w http.ResponseWriter, r *http.Request, format string) {
+
+	token, _ := extractToken(r)
+
+	if !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+
+	if format == "prometheus" {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.metrics.writePrometheus(w)
+		s.bandwidth.writePrometheus(w)
+		return
+	}
+
+	mounts := s.metrics.snapshot()
+	for _, stats := range mounts {
+		stats.Circuit = s.guard.state(stats.Mount)
+	}
+
+	jsonBody, err := json.Marshal(mounts)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
@@ -0,0 +1,34 @@
+package gemdrive
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackendMetricsTimeWrites(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := NewFileSystemBackend(filepath.Join(dir, "files"), filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewMultiBackend()
+	err = backend.AddBackend("files", fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := newBackendMetrics(0)
+	backend.SetMetrics(metrics)
+
+	err = backend.Write("/files/a.txt", strings.NewReader("data"), 0, 4, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := metrics.mounts["files"]
+	if stats == nil || stats.Ops["write"] == nil || stats.Ops["write"].Count != 1 {
+		t.Errorf("write wasn't recorded: %+v", stats)
+	}
+}
@@ -0,0 +1,216 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Mounts are made by the factory registered for their type, so other
+// packages can add backends with RegisterBackend before calling NewServer:
+//
+//	gemdrive.RegisterBackend("s3", func(mount *gemdrive.MountConfig, env *gemdrive.BackendEnv) (gemdrive.Backend, error) {
+//		var options S3Options
+//		err := mount.DecodeOptions(&options)
+//		...
+//	})
+//
+// and configs can then have {"name": "photos", "type": "s3", "options": {...}}.
+// Built in are fs, git, rclone, exec, sql, mirror, shard and erasure, whose
+// options are the same as in their own config sections.
+
+// Makes the backend for a mount.
+type BackendFactory func(mount *MountConfig, env *BackendEnv) (Backend, error)
+
+// What backends share with the rest of the server.
+type BackendEnv struct {
+	Config *Config
+	Images *ImagePool
+}
+
+var backendFactories = make(map[string]BackendFactory)
+var backendFactoriesMut = &sync.Mutex{}
+
+// Registers the factory for a mount type. Panics if the type already has
+// one, like database/sql's Register.
+func RegisterBackend(typ string, factory BackendFactory) {
+	backendFactoriesMut.Lock()
+	defer backendFactoriesMut.Unlock()
+
+	if factory == nil {
+		panic("gemdrive: RegisterBackend factory is nil")
+	}
+
+	if _, exists := backendFactories[typ]; exists {
+		panic("gemdrive: RegisterBackend called twice for " + typ)
+	}
+
+	backendFactories[typ] = factory
+}
+
+func backendFactory(typ string) BackendFactory {
+	if typ == "" {
+		typ = mountTypeFs
+	}
+
+	backendFactoriesMut.Lock()
+	defer backendFactoriesMut.Unlock()
+
+	return backendFactories[typ]
+}
+
+// Names of the registered mount types, sorted.
+func BackendTypes() []string {
+	backendFactoriesMut.Lock()
+	defer backendFactoriesMut.Unlock()
+
+	types := []string{}
+	for typ := range backendFactories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	return types
+}
+
+// Decodes the mount's options into v, refusing fields v doesn't have.
+func (m *MountConfig) DecodeOptions(v interface{}) error {
+	if len(m.Options) == 0 {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(m.Options))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil {
+		return fmt.Errorf("Invalid options: %s", err)
+	}
+
+	return nil
+}
+
+func newMountBackend(mount *MountConfig, env *BackendEnv) (Backend, error) {
+	factory := backendFactory(mount.Type)
+	if factory == nil {
+		return nil, fmt.Errorf("Unknown type %s", mount.Type)
+	}
+
+	return factory(mount, env)
+}
+
+// The mount's own cache dir, or one for it under cacheDir.
+func (m *MountConfig) cacheDir(env *BackendEnv, subDirs ...string) string {
+	if m.CacheDir != "" {
+		return m.CacheDir
+	}
+	return filepath.Join(append(append([]string{env.Config.CacheDir}, subDirs...), m.Name)...)
+}
+
+var errNoMountPath = errors.New("No path")
+
+func init() {
+	RegisterBackend(mountTypeFs, newFsMount)
+
+	RegisterBackend(mountTypeGit, func(mount *MountConfig, env *BackendEnv) (Backend, error) {
+		if mount.Path == "" {
+			return nil, errNoMountPath
+		}
+		return NewGitBackend(mount.Path)
+	})
+
+	RegisterBackend("rclone", func(mount *MountConfig, env *BackendEnv) (Backend, error) {
+		return NewRcloneBackend(), nil
+	})
+
+	RegisterBackend("exec", func(mount *MountConfig, env *BackendEnv) (Backend, error) {
+		var options ExecBackendConfig
+		err := mount.DecodeOptions(&options)
+		if err != nil {
+			return nil, err
+		}
+		return NewExecBackend(&options)
+	})
+
+	RegisterBackend("sql", func(mount *MountConfig, env *BackendEnv) (Backend, error) {
+		var options SqlBackendConfig
+		err := mount.DecodeOptions(&options)
+		if err != nil {
+			return nil, err
+		}
+		return NewSqlBackend(&options)
+	})
+
+	RegisterBackend("mirror", func(mount *MountConfig, env *BackendEnv) (Backend, error) {
+		var options MirrorConfig
+		err := mount.DecodeOptions(&options)
+		if err != nil {
+			return nil, err
+		}
+		return newMirror(&options, mount.cacheDir(env, "mirrors"))
+	})
+
+	RegisterBackend("shard", func(mount *MountConfig, env *BackendEnv) (Backend, error) {
+		var options ShardBackendConfig
+		err := mount.DecodeOptions(&options)
+		if err != nil {
+			return nil, err
+		}
+		manifestDir := filepath.Join(env.Config.DataDir, "shards", mount.Name)
+		return NewShardBackend(&options, manifestDir, mount.cacheDir(env, "shards"))
+	})
+
+	RegisterBackend("erasure", func(mount *MountConfig, env *BackendEnv) (Backend, error) {
+		var options ErasureBackendConfig
+		err := mount.DecodeOptions(&options)
+		if err != nil {
+			return nil, err
+		}
+		manifestDir := filepath.Join(env.Config.DataDir, "erasure", mount.Name)
+		return NewErasureBackend(&options, manifestDir, mount.cacheDir(env, "erasure"))
+	})
+}
+
+func newFsMount(mount *MountConfig, env *BackendEnv) (Backend, error) {
+	if mount.Path == "" {
+		return nil, errNoMountPath
+	}
+
+	config := env.Config
+
+	fsBackend, err := NewFileSystemBackend(mount.Path, mount.cacheDir(env))
+	if err != nil {
+		return nil, err
+	}
+	if config.Preallocate {
+		fsBackend.EnablePreallocation()
+	}
+	if config.Xattrs {
+		fsBackend.EnableXattrs()
+	}
+	if config.Versioning {
+		err = fsBackend.EnableVersioning(filepath.Join(config.DataDir, "versions", mount.Name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	fsBackend.SetImagePool(env.Images)
+	if config.ListParallelism > 0 {
+		fsBackend.SetListParallelism(config.ListParallelism)
+	}
+	if config.ListingChunkSize > 0 {
+		fsBackend.SetListingChunkSize(config.ListingChunkSize)
+	}
+	if !mount.NoWatch {
+		err = fsBackend.Watch()
+		if err != nil {
+			fmt.Println("Not watching", mount.Path, "for changes:", err)
+		}
+	}
+
+	return fsBackend, nil
+}
@@ -0,0 +1,165 @@
+package gemdrive_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gemdrive "github.com/gemdrive/gemdrive-go"
+	"github.com/gemdrive/gemdrive-go/backendtest"
+)
+
+func TestFileSystemBackend(t *testing.T) {
+	backendtest.RunSuite(t, func(t *testing.T) gemdrive.Backend {
+		dir := t.TempDir()
+		backend, err := gemdrive.NewFileSystemBackend(filepath.Join(dir, "files"), filepath.Join(dir, "cache"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backend
+	})
+}
+
+// The exec program is this test binary, running TestExecBackendHelper,
+// which serves the protocol from a FileSystemBackend.
+func TestExecBackend(t *testing.T) {
+	backendtest.RunSuite(t, func(t *testing.T) gemdrive.Backend {
+		dir := t.TempDir()
+		backend, err := gemdrive.NewExecBackend(&gemdrive.ExecBackendConfig{
+			Command: []string{
+				os.Args[0], "-test.run=^TestExecBackendHelper$", "--",
+				filepath.Join(dir, "files"), filepath.Join(dir, "cache"),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backend
+	})
+}
+
+// Arguments after "--" are the files and cache dirs, then the operation.
+func TestExecBackendHelper(t *testing.T) {
+	var args []string
+	for i, arg := range os.Args {
+		if arg == "--" {
+			args = os.Args[i+1:]
+			break
+		}
+	}
+	if len(args) < 4 {
+		return
+	}
+
+	err := runExecOperation(args[0], args[1], args[2], args[3:])
+	if e, ok := err.(*gemdrive.Error); ok {
+		fmt.Fprintf(os.Stderr, "%d %s", e.HttpCode, e.Message)
+		os.Exit(1)
+	} else if os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "404 %s", err)
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprint(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func runExecOperation(filesDir, cacheDir, op string, args []string) error {
+	backend, err := gemdrive.NewFileSystemBackend(filesDir, cacheDir)
+	if err != nil {
+		return err
+	}
+
+	reqPath := args[0]
+	ints := []int64{}
+	bools := []bool{}
+	for _, arg := range args[1:] {
+		if n, err := strconv.ParseInt(arg, 10, 64); err == nil {
+			ints = append(ints, n)
+		} else if b, err := strconv.ParseBool(arg); err == nil {
+			bools = append(bools, b)
+		}
+	}
+
+	switch op {
+	case "list":
+		item, err := backend.List(reqPath, int(ints[0]))
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(os.Stdout).Encode(item)
+	case "read":
+		_, data, err := backend.Read(reqPath, ints[0], ints[1])
+		if err != nil {
+			return err
+		}
+		defer data.Close()
+		_, err = io.Copy(os.Stdout, data)
+		return err
+	case "write":
+		return backend.Write(reqPath, os.Stdin, ints[0], ints[1], bools[0], bools[1])
+	case "mkdir":
+		return backend.MakeDir(reqPath, bools[0])
+	case "delete":
+		return backend.Delete(reqPath, bools[0])
+	default:
+		return &gemdrive.Error{
+			HttpCode: 501,
+			Message:  "Unsupported operation " + op,
+		}
+	}
+}
+
+var sqlTestTables int64
+
+// Needs a database, ie GEMDRIVE_TEST_SQL_DRIVER=postgres and
+// GEMDRIVE_TEST_SQL_DSN=postgres://localhost/gemdrive_test, and the driver
+// built in with its tag, ie "go test -tags postgres". Each test gets its own
+// tables, which are dropped afterwards.
+func TestSqlBackend(t *testing.T) {
+	driver := os.Getenv("GEMDRIVE_TEST_SQL_DRIVER")
+	dsn := os.Getenv("GEMDRIVE_TEST_SQL_DSN")
+	if driver == "" || dsn == "" {
+		t.Skip("GEMDRIVE_TEST_SQL_DRIVER and GEMDRIVE_TEST_SQL_DSN aren't set")
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	backendtest.RunSuite(t, func(t *testing.T) gemdrive.Backend {
+		prefix := fmt.Sprintf("gemdrive_test_%d_%d", time.Now().Unix(), atomic.AddInt64(&sqlTestTables, 1))
+
+		// Small chunks, so reads and writes span several
+		backend, err := gemdrive.NewSqlBackend(&gemdrive.SqlBackendConfig{
+			Driver:      driver,
+			Dsn:         dsn,
+			TablePrefix: prefix,
+			ChunkSize:   4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			for _, table := range []string{prefix + "_chunks", prefix + "_items"} {
+				_, err := db.Exec("DROP TABLE " + table)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		})
+
+		return backend
+	})
+}
@@ -0,0 +1,414 @@
+// Package backendtest checks that a GemDrive backend behaves the way the
+// server expects, so new backends, in this repo or elsewhere, can be tested
+// the same way. From a backend's tests:
+//
+//	func TestConformance(t *testing.T) {
+//		backendtest.RunSuite(t, func(t *testing.T) gemdrive.Backend {
+//			backend, err := NewMyBackend(t.TempDir())
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return backend
+//		})
+//	}
+//
+// Each test gets a new, empty backend from the factory. Everything but the
+// listing of an empty root needs the backend to be a WritableBackend, to
+// make what's tested, and is skipped otherwise.
+package backendtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	gemdrive "github.com/gemdrive/gemdrive-go"
+)
+
+// Makes an empty backend for one test.
+type Factory func(t *testing.T) gemdrive.Backend
+
+func RunSuite(t *testing.T, factory Factory) {
+	t.Run("ListEmptyRoot", func(t *testing.T) { testListEmptyRoot(t, factory(t)) })
+	t.Run("WriteAndRead", func(t *testing.T) { testWriteAndRead(t, factory(t)) })
+	t.Run("RangedRead", func(t *testing.T) { testRangedRead(t, factory(t)) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, factory(t)) })
+	t.Run("Truncate", func(t *testing.T) { testTruncate(t, factory(t)) })
+	t.Run("FailedWrite", func(t *testing.T) { testFailedWrite(t, factory(t)) })
+	t.Run("ListDepth", func(t *testing.T) { testListDepth(t, factory(t)) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, factory(t)) })
+	t.Run("DeleteRecursive", func(t *testing.T) { testDeleteRecursive(t, factory(t)) })
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, factory(t)) })
+}
+
+// The server treats these, and only these, as missing paths.
+func isNotFound(err error) bool {
+	if e, ok := err.(*gemdrive.Error); ok {
+		return e.HttpCode == 404
+	}
+	return os.IsNotExist(err)
+}
+
+func writable(t *testing.T, backend gemdrive.Backend) gemdrive.WritableBackend {
+	t.Helper()
+
+	w, ok := backend.(gemdrive.WritableBackend)
+	if !ok {
+		t.Skip("Backend isn't writable")
+	}
+	return w
+}
+
+func write(t *testing.T, backend gemdrive.WritableBackend, reqPath, content string, offset int64, overwrite, truncate bool) error {
+	t.Helper()
+	return backend.Write(reqPath, strings.NewReader(content), offset, int64(len(content)), overwrite, truncate)
+}
+
+func mustWrite(t *testing.T, backend gemdrive.WritableBackend, reqPath, content string) {
+	t.Helper()
+
+	err := write(t, backend, reqPath, content, 0, false, true)
+	if err != nil {
+		t.Fatalf("Write %s: %s", reqPath, err)
+	}
+}
+
+func mustMakeDir(t *testing.T, backend gemdrive.WritableBackend, reqPath string) {
+	t.Helper()
+
+	err := backend.MakeDir(reqPath, false)
+	if err != nil {
+		t.Fatalf("MakeDir %s: %s", reqPath, err)
+	}
+}
+
+func read(t *testing.T, backend gemdrive.Backend, reqPath string, offset, length int64) (*gemdrive.Item, string) {
+	t.Helper()
+
+	item, data, err := backend.Read(reqPath, offset, length)
+	if err != nil {
+		t.Fatalf("Read %s: %s", reqPath, err)
+	}
+	defer data.Close()
+
+	content, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatalf("Read %s: %s", reqPath, err)
+	}
+
+	return item, string(content)
+}
+
+func expectContent(t *testing.T, backend gemdrive.Backend, reqPath, expected string) {
+	t.Helper()
+
+	item, content := read(t, backend, reqPath, 0, 0)
+	if content != expected {
+		t.Errorf("%s has %q, expected %q", reqPath, content, expected)
+	}
+	if item == nil || item.Size != int64(len(expected)) {
+		t.Errorf("%s has item %+v, expected size %d", reqPath, item, len(expected))
+	}
+}
+
+func list(t *testing.T, backend gemdrive.Backend, reqPath string, depth int) *gemdrive.Item {
+	t.Helper()
+
+	item, err := backend.List(reqPath, depth)
+	if err != nil {
+		t.Fatalf("List %s at depth %d: %s", reqPath, depth, err)
+	}
+	if item == nil {
+		t.Fatalf("List %s at depth %d gave no item", reqPath, depth)
+	}
+	return item
+}
+
+func testListEmptyRoot(t *testing.T, backend gemdrive.Backend) {
+	root := list(t, backend, "/", 1)
+	if len(root.Children) != 0 {
+		t.Errorf("New backend's root has children %v", childNames(root))
+	}
+}
+
+func testWriteAndRead(t *testing.T, backend gemdrive.Backend) {
+	w := writable(t, backend)
+
+	mustWrite(t, w, "/a.txt", "hello world")
+	expectContent(t, backend, "/a.txt", "hello world")
+
+	root := list(t, backend, "/", 1)
+	child, exists := root.Children["a.txt"]
+	if !exists || child == nil {
+		t.Fatalf("Root listing has %v, expected a.txt", childNames(root))
+	}
+	if child.Size != 11 {
+		t.Errorf("a.txt is listed with size %d, expected 11", child.Size)
+	}
+}
+
+func testRangedRead(t *testing.T, backend gemdrive.Backend) {
+	w := writable(t, backend)
+
+	mustWrite(t, w, "/a.txt", "hello world")
+
+	item, content := read(t, backend, "/a.txt", 6, 3)
+	if content != "wor" {
+		t.Errorf("Bytes 6-8 are %q, expected \"wor\"", content)
+	}
+	// Ranged reads still describe the whole file
+	if item == nil || item.Size != 11 {
+		t.Errorf("Ranged read gave item %+v, expected size 11", item)
+	}
+
+	_, content = read(t, backend, "/a.txt", 6, 0)
+	if content != "world" {
+		t.Errorf("Length 0 from 6 gave %q, expected the rest, \"world\"", content)
+	}
+
+	_, content = read(t, backend, "/a.txt", 0, 5)
+	if content != "hello" {
+		t.Errorf("Bytes 0-4 are %q, expected \"hello\"", content)
+	}
+}
+
+func testOverwrite(t *testing.T, backend gemdrive.Backend) {
+	w := writable(t, backend)
+
+	mustWrite(t, w, "/a.txt", "hello world")
+
+	err := write(t, w, "/a.txt", "bye", 0, false, true)
+	if err == nil {
+		t.Errorf("Write without overwrite replaced an existing file")
+	}
+	expectContent(t, backend, "/a.txt", "hello world")
+
+	// Without truncate, only the bytes written change
+	err = write(t, w, "/a.txt", "HELLO", 0, true, false)
+	if err != nil {
+		t.Fatalf("Overwrite: %s", err)
+	}
+	expectContent(t, backend, "/a.txt", "HELLO world")
+
+	err = write(t, w, "/a.txt", "!", 11, true, false)
+	if err != nil {
+		t.Fatalf("Write at the end: %s", err)
+	}
+	expectContent(t, backend, "/a.txt", "HELLO world!")
+}
+
+func testTruncate(t *testing.T, backend gemdrive.Backend) {
+	w := writable(t, backend)
+
+	mustWrite(t, w, "/a.txt", "hello world")
+
+	err := write(t, w, "/a.txt", "bye", 0, true, true)
+	if err != nil {
+		t.Fatalf("Overwrite with truncate: %s", err)
+	}
+	expectContent(t, backend, "/a.txt", "bye")
+
+	err = w.Write("/empty.txt", bytes.NewReader(nil), 0, 0, false, true)
+	if err != nil {
+		t.Fatalf("Write empty file: %s", err)
+	}
+	expectContent(t, backend, "/empty.txt", "")
+}
+
+type failingReader struct {
+	data io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, errors.New("Connection lost")
+	}
+	return n, err
+}
+
+// Whole files that fail to be written leave what was there before.
+func testFailedWrite(t *testing.T, backend gemdrive.Backend) {
+	w := writable(t, backend)
+
+	mustWrite(t, w, "/a.txt", "hello world")
+
+	err := w.Write("/a.txt", &failingReader{strings.NewReader("bye")}, 0, 11, true, true)
+	if err == nil {
+		t.Fatalf("Write from a failing reader succeeded")
+	}
+	expectContent(t, backend, "/a.txt", "hello world")
+
+	err = w.Write("/b.txt", &failingReader{strings.NewReader("bye")}, 0, 11, false, true)
+	if err == nil {
+		t.Fatalf("Write from a failing reader succeeded")
+	}
+
+	_, data, err := backend.Read("/b.txt", 0, 0)
+	if err == nil {
+		data.Close()
+	}
+	if !isNotFound(err) {
+		t.Errorf("Failed write of a new file left one behind")
+	}
+
+	expectChildren(t, "Root after failed writes", list(t, backend, "/", 1), "a.txt")
+}
+
+// Depth 1 lists a directory's children, each further level their children,
+// and 0 everything beneath it. Directories' names end in a slash.
+func testListDepth(t *testing.T, backend gemdrive.Backend) {
+	w := writable(t, backend)
+
+	mustMakeDir(t, w, "/d/")
+	mustMakeDir(t, w, "/d/sub/")
+	mustMakeDir(t, w, "/d/sub/deeper/")
+	mustWrite(t, w, "/d/f.txt", "f")
+	mustWrite(t, w, "/d/sub/g.txt", "gg")
+	mustWrite(t, w, "/d/sub/deeper/h.txt", "hhh")
+
+	d := list(t, backend, "/d/", 1)
+	expectChildren(t, "/d/ at depth 1", d, "f.txt", "sub/")
+	if sub := d.Children["sub/"]; sub != nil && len(sub.Children) != 0 {
+		t.Errorf("/d/ at depth 1 includes sub/'s children %v", childNames(sub))
+	}
+	if f := d.Children["f.txt"]; f != nil && f.Size != 1 {
+		t.Errorf("f.txt is listed with size %d, expected 1", f.Size)
+	}
+
+	d = list(t, backend, "/d/", 2)
+	expectChildren(t, "/d/ at depth 2", d, "f.txt", "sub/")
+	sub := d.Children["sub/"]
+	if sub == nil {
+		t.Fatalf("/d/ at depth 2 has no sub/")
+	}
+	expectChildren(t, "sub/ at depth 2", sub, "g.txt", "deeper/")
+	if deeper := sub.Children["deeper/"]; deeper != nil && len(deeper.Children) != 0 {
+		t.Errorf("/d/ at depth 2 includes deeper/'s children %v", childNames(deeper))
+	}
+
+	d = list(t, backend, "/d/", 0)
+	sub = d.Children["sub/"]
+	if sub == nil || sub.Children["deeper/"] == nil {
+		t.Fatalf("/d/ at depth 0 is missing sub/deeper/")
+	}
+	expectChildren(t, "deeper/ at depth 0", sub.Children["deeper/"], "h.txt")
+
+	sub = list(t, backend, "/d/sub/", 1)
+	expectChildren(t, "/d/sub/ at depth 1", sub, "g.txt", "deeper/")
+}
+
+func testDelete(t *testing.T, backend gemdrive.Backend) {
+	w := writable(t, backend)
+
+	mustWrite(t, w, "/a.txt", "a")
+	mustWrite(t, w, "/b.txt", "b")
+
+	err := w.Delete("/a.txt", false)
+	if err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+
+	_, _, err = backend.Read("/a.txt", 0, 0)
+	if !isNotFound(err) {
+		t.Errorf("Reading a deleted file gave %v, expected not found", err)
+	}
+
+	expectChildren(t, "Root after deleting a.txt", list(t, backend, "/", 1), "b.txt")
+
+	mustMakeDir(t, w, "/empty/")
+	err = w.Delete("/empty/", false)
+	if err != nil {
+		t.Errorf("Deleting an empty directory: %s", err)
+	}
+}
+
+func testDeleteRecursive(t *testing.T, backend gemdrive.Backend) {
+	w := writable(t, backend)
+
+	mustMakeDir(t, w, "/d/")
+	mustMakeDir(t, w, "/d/sub/")
+	mustWrite(t, w, "/d/sub/g.txt", "g")
+	mustWrite(t, w, "/keep.txt", "k")
+
+	err := w.Delete("/d/", false)
+	if err == nil {
+		t.Errorf("Non-recursive delete removed a non-empty directory")
+	}
+	expectContent(t, backend, "/d/sub/g.txt", "g")
+
+	err = w.Delete("/d/", true)
+	if err != nil {
+		t.Fatalf("Recursive delete: %s", err)
+	}
+
+	_, err = backend.List("/d/", 1)
+	if !isNotFound(err) {
+		t.Errorf("Listing a deleted directory gave %v, expected not found", err)
+	}
+
+	_, _, err = backend.Read("/d/sub/g.txt", 0, 0)
+	if !isNotFound(err) {
+		t.Errorf("Reading from a deleted directory gave %v, expected not found", err)
+	}
+
+	expectChildren(t, "Root after deleting d/", list(t, backend, "/", 1), "keep.txt")
+}
+
+// Missing paths must give a *gemdrive.Error with HttpCode 404, or an error
+// os.IsNotExist recognizes, which the server turns into 404s.
+func testNotFound(t *testing.T, backend gemdrive.Backend) {
+	_, data, err := backend.Read("/missing.txt", 0, 0)
+	if err == nil {
+		data.Close()
+	}
+	if !isNotFound(err) {
+		t.Errorf("Reading a missing file gave %v, expected not found", err)
+	}
+
+	_, err = backend.List("/missing/", 1)
+	if !isNotFound(err) {
+		t.Errorf("Listing a missing directory gave %v, expected not found", err)
+	}
+
+	if w, ok := backend.(gemdrive.WritableBackend); ok {
+		mustMakeDir(t, w, "/d/")
+
+		_, data, err = backend.Read("/d/missing.txt", 0, 0)
+		if err == nil {
+			io.Copy(ioutil.Discard, data)
+			data.Close()
+		}
+		if !isNotFound(err) {
+			t.Errorf("Reading a missing file in a directory gave %v, expected not found", err)
+		}
+	}
+}
+
+func childNames(item *gemdrive.Item) []string {
+	names := []string{}
+	for name := range item.Children {
+		names = append(names, name)
+	}
+	return names
+}
+
+func expectChildren(t *testing.T, what string, item *gemdrive.Item, expected ...string) {
+	t.Helper()
+
+	if len(item.Children) != len(expected) {
+		t.Errorf("%s has children %v, expected %v", what, childNames(item), expected)
+		return
+	}
+
+	for _, name := range expected {
+		if _, exists := item.Children[name]; !exists {
+			t.Errorf("%s has children %v, expected %v", what, childNames(item), expected)
+			return
+		}
+	}
+}
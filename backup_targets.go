@@ -0,0 +1,176 @@
+package gemdrive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Backup targets are directories files can only be added to, like the
+// append-only mode of restic's REST server, so a client holding the keys to
+// its backups still can't destroy them. Nothing in them can be overwritten,
+// moved or deleted, except what's in their deletable dirs, and files have
+// to be written whole, in one go.
+//
+// Files in content-addressed dirs have to be named for the SHA-256 of what's
+// in them, which is checked as they're written. The defaults fit a restic
+// repository, where everything but config is stored that way and only locks
+// are removed by clients which aren't pruning.
+
+var defaultContentAddressedDirs = []string{"data", "index", "keys", "locks", "snapshots"}
+var defaultDeletableDirs = []string{"locks"}
+
+type BackupTargetConfig struct {
+	Path string `json:"path"`
+	// Relative to path. Defaults to restic's.
+	ContentAddressed []string `json:"contentAddressed,omitempty"`
+	Deletable        []string `json:"deletable,omitempty"`
+}
+
+type backupTargets struct {
+	targets []*BackupTargetConfig
+}
+
+var errAppendOnly = &Error{
+	HttpCode: 403,
+	Message:  "Backup targets are append-only",
+}
+
+func newBackupTargets(configs []*BackupTargetConfig) (*backupTargets, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	targets := []*BackupTargetConfig{}
+	for _, config := range configs {
+		targetPath := path.Clean("/" + config.Path)
+		if strings.Count(targetPath, "/") < 2 {
+			return nil, fmt.Errorf("Backup target %s has to be within a mount", config.Path)
+		}
+
+		target := &BackupTargetConfig{
+			Path:             targetPath + "/",
+			ContentAddressed: config.ContentAddressed,
+			Deletable:        config.Deletable,
+		}
+		if target.ContentAddressed == nil {
+			target.ContentAddressed = defaultContentAddressedDirs
+		}
+		if target.Deletable == nil {
+			target.Deletable = defaultDeletableDirs
+		}
+
+		targets = append(targets, target)
+	}
+
+	return &backupTargets{targets: targets}, nil
+}
+
+// The target reqPath is in, and the path within it.
+func (t *backupTargets) find(reqPath string) (*BackupTargetConfig, string) {
+	if t == nil {
+		return nil, ""
+	}
+
+	for _, target := range t.targets {
+		if strings.HasPrefix(reqPath, target.Path) {
+			return target, strings.TrimPrefix(reqPath, target.Path)
+		}
+	}
+
+	return nil, ""
+}
+
+func inTargetDir(dirs []string, relPath string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(relPath, strings.Trim(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether reqPath takes a target with it when it's deleted or moved.
+func (t *backupTargets) contains(reqPath string) bool {
+	if t == nil {
+		return false
+	}
+
+	dirPath := strings.TrimSuffix(reqPath, "/") + "/"
+	for _, target := range t.targets {
+		if strings.HasPrefix(target.Path, dirPath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks a write, reporting whether the content has to be checked against
+// the file's name, and whether the write is in a target at all.
+func (t *backupTargets) checkWrite(reqPath string, offset int64, truncate bool) (bool, bool, error) {
+	target, relPath := t.find(reqPath)
+	if target == nil {
+		return false, false, nil
+	}
+
+	if offset != 0 || !truncate {
+		return false, true, &Error{
+			HttpCode: 403,
+			Message:  "Backup targets only take whole files",
+		}
+	}
+
+	return inTargetDir(target.ContentAddressed, relPath), true, nil
+}
+
+func (t *backupTargets) checkDelete(reqPath string) error {
+	if t.contains(reqPath) {
+		return errAppendOnly
+	}
+
+	target, relPath := t.find(reqPath)
+	if target == nil {
+		return nil
+	}
+
+	if strings.HasSuffix(relPath, "/") || !inTargetDir(target.Deletable, relPath) {
+		return errAppendOnly
+	}
+
+	return nil
+}
+
+func (t *backupTargets) checkMove(srcPath, dstPath string) error {
+	if t.contains(srcPath) {
+		return errAppendOnly
+	}
+
+	if target, _ := t.find(srcPath); target != nil {
+		return errAppendOnly
+	}
+
+	if target, _ := t.find(dstPath); target != nil {
+		return errAppendOnly
+	}
+
+	return nil
+}
+
+func (t *backupTargets) checkModify(reqPath string) error {
+	if target, _ := t.find(reqPath); target != nil {
+		return errAppendOnly
+	}
+	return nil
+}
+
+// Checks that content written to a content-addressed path was named for it.
+func checkContentAddress(reqPath string, sums *Checksums) error {
+	if sums.Sha256 != path.Base(reqPath) {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Content doesn't match its name",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package gemdrive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bytes served are counted per identity, per share link and per export,
+// with a total and a count for each day, so operators can see who is using
+// their data cap. Identities stand in for tokens, since session tokens
+// change every time they're refreshed; service tokens have an identity of
+// their own. Counters are saved in the data dir every minute, and served at
+// gemdrive/admin/bandwidth and as part of gemdrive/admin/metrics.
+
+// Daily counts older than this are dropped
+const bandwidthRetention = 90 * 24 * time.Hour
+
+const bandwidthSaveInterval = time.Minute
+
+type BandwidthUsage struct {
+	Total int64 `json:"total"`
+	// By UTC day, ie "2024-05-01"
+	Days map[string]int64 `json:"days"`
+}
+
+type BandwidthReport struct {
+	// When counting started
+	Since      string                     `json:"since"`
+	Identities map[string]*BandwidthUsage `json:"identities"`
+	Shares     map[string]*BandwidthUsage `json:"shares"`
+	Exports    map[string]*BandwidthUsage `json:"exports"`
+}
+
+type bandwidthAccounts struct {
+	path   string
+	report *BandwidthReport
+	dirty  bool
+	mut    *sync.Mutex
+}
+
+func newBandwidthAccounts(reportPath string) *bandwidthAccounts {
+	accounts := &bandwidthAccounts{
+		path: reportPath,
+		report: &BandwidthReport{
+			Since:      time.Now().UTC().Format(time.RFC3339),
+			Identities: make(map[string]*BandwidthUsage),
+			Shares:     make(map[string]*BandwidthUsage),
+			Exports:    make(map[string]*BandwidthUsage),
+		},
+		mut: &sync.Mutex{},
+	}
+
+	reportJson, err := ioutil.ReadFile(accounts.path)
+	if err == nil {
+		var report *BandwidthReport
+		err = json.Unmarshal(reportJson, &report)
+		if err != nil || report == nil || report.Identities == nil || report.Shares == nil || report.Exports == nil {
+			fmt.Println("Ignoring invalid bandwidth counters:", err)
+		} else {
+			accounts.report = report
+		}
+	}
+
+	return accounts
+}
+
+// Counts the bytes written through it
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Records what was served for a request once it's done.
+func (s *Server) recordBandwidth(token, identity, reqPath string, w *countingWriter) {
+	if w.written == 0 {
+		return
+	}
+
+	shareId := ""
+	if token != "" {
+		if share, err := s.auth.db.GetShareByToken(token); err == nil {
+			shareId = share.Id
+		}
+	}
+
+	export := ""
+	parts := strings.Split(reqPath, "/")
+	if len(parts) > 2 && parts[1] != "gemdrive" {
+		export = parts[1]
+	}
+
+	s.bandwidth.add(identity, shareId, export, w.written)
+}
+
+func (a *bandwidthAccounts) add(identity, shareId, export string, bytes int64) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	day := time.Now().UTC().Format("2006-01-02")
+
+	count := func(usages map[string]*BandwidthUsage, key string) {
+		usage, exists := usages[key]
+		if !exists {
+			usage = &BandwidthUsage{Days: make(map[string]int64)}
+			usages[key] = usage
+		}
+		usage.Total += bytes
+		usage.Days[day] += bytes
+	}
+
+	count(a.report.Identities, identity)
+	if shareId != "" {
+		count(a.report.Shares, shareId)
+	}
+	if export != "" {
+		count(a.report.Exports, export)
+	}
+
+	a.dirty = true
+}
+
+// Saves the counters periodically until ctx is done.
+func (a *bandwidthAccounts) run(ctx context.Context) {
+	ticker := time.NewTicker(bandwidthSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.save()
+		case <-ctx.Done():
+			a.save()
+			return
+		}
+	}
+}
+
+func (a *bandwidthAccounts) save() {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	if !a.dirty {
+		return
+	}
+
+	oldest := time.Now().UTC().Add(-bandwidthRetention).Format("2006-01-02")
+	for _, usages := range []map[string]*BandwidthUsage{a.report.Identities, a.report.Shares, a.report.Exports} {
+		for _, usage := range usages {
+			for day := range usage.Days {
+				if day < oldest {
+					delete(usage.Days, day)
+				}
+			}
+		}
+	}
+
+	err := saveJson(a.report, a.path)
+	if err != nil {
+		fmt.Println("Failed to save bandwidth counters:", err)
+		return
+	}
+
+	a.dirty = false
+}
+
+func (a *bandwidthAccounts) snapshot() *BandwidthReport {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	copyUsages := func(usages map[string]*BandwidthUsage) map[string]*BandwidthUsage {
+		copied := make(map[string]*BandwidthUsage)
+		for key, usage := range usages {
+			days := make(map[string]int64)
+			for day, bytes := range usage.Days {
+				days[day] = bytes
+			}
+			copied[key] = &BandwidthUsage{Total: usage.Total, Days: days}
+		}
+		return copied
+	}
+
+	return &BandwidthReport{
+		Since:      a.report.Since,
+		Identities: copyUsages(a.report.Identities),
+		Shares:     copyUsages(a.report.Shares),
+		Exports:    copyUsages(a.report.Exports),
+	}
+}
+
+func (a *bandwidthAccounts) writePrometheus(w io.Writer) {
+	report := a.snapshot()
+
+	fmt.Fprintln(w, "# HELP gemdrive_served_bytes_total Bytes served")
+	fmt.Fprintln(w, "# TYPE gemdrive_served_bytes_total counter")
+
+	kinds := []struct {
+		kind   string
+		usages map[string]*BandwidthUsage
+	}{
+		{"identity", report.Identities},
+		{"share", report.Shares},
+		{"export", report.Exports},
+	}
+
+	for _, kind := range kinds {
+		keys := []string{}
+		for key := range kind.usages {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fmt.Fprintf(w, "gemdrive_served_bytes_total{kind=%q,key=%q} %d\n", kind.kind, key, kind.usages[key].Total)
+		}
+	}
+}
+
+// Handles gemdrive/admin/bandwidth
+func (s *Server) handleBandwidth(w http.ResponseWriter, r *http.Request) {
+
+	token, _ := extractToken(r)
+
+	if !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+
+	jsonBody, err := json.Marshal(s.bandwidth.snapshot())
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
@@ -0,0 +1,200 @@
+package gemdrive
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+type Checksums struct {
+	Md5    string `json:"md5,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// Backends which can remember checksums computed while a file was uploaded,
+// so they don't need to be recomputed by reading the file back.
+type ChecksumStore interface {
+	SetChecksums(path string, sums *Checksums) error
+	GetChecksums(path string) (*Checksums, error)
+}
+
+// Like the media metadata cache, stored checksums are only valid as long as
+// the file's size and modification time haven't changed.
+type checksumCacheEntry struct {
+	Size      int64      `json:"size"`
+	ModTime   string     `json:"modTime"`
+	Checksums *Checksums `json:"checksums"`
+}
+
+// Hashes everything read through it.
+type checksumReader struct {
+	reader     io.Reader
+	md5Hash    hash.Hash
+	sha256Hash hash.Hash
+	verify     func(sums *Checksums) error
+}
+
+func newChecksumReader(reader io.Reader) *checksumReader {
+	r := &checksumReader{
+		md5Hash:    md5.New(),
+		sha256Hash: sha256.New(),
+	}
+	r.reader = io.TeeReader(reader, io.MultiWriter(r.md5Hash, r.sha256Hash))
+	return r
+}
+
+// Fails at the end, rather than returning io.EOF, if verify rejects what
+// was read, so backends don't put the file in place.
+func newVerifyingReader(reader io.Reader, verify func(sums *Checksums) error) *checksumReader {
+	r := newChecksumReader(reader)
+	r.verify = verify
+	return r
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF && r.verify != nil {
+		verifyErr := r.verify(r.Checksums())
+		if verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+func (r *checksumReader) Checksums() *Checksums {
+	return &Checksums{
+		Md5:    hex.EncodeToString(r.md5Hash.Sum(nil)),
+		Sha256: hex.EncodeToString(r.sha256Hash.Sum(nil)),
+	}
+}
+
+// Parses the checksums a client expects an upload to have. Content-MD5 is
+// base64 per RFC 1864. X-Checksum-SHA256 may be either hex or base64.
+func parseExpectedChecksums(contentMd5, checksumSha256 string) (*Checksums, error) {
+	expected := &Checksums{}
+
+	if contentMd5 != "" {
+		sum, err := base64.StdEncoding.DecodeString(contentMd5)
+		if err != nil || len(sum) != md5.Size {
+			return nil, errors.New("Invalid Content-MD5")
+		}
+		expected.Md5 = hex.EncodeToString(sum)
+	}
+
+	if checksumSha256 != "" {
+		sum, err := hex.DecodeString(checksumSha256)
+		if err != nil {
+			sum, err = base64.StdEncoding.DecodeString(checksumSha256)
+		}
+		if err != nil || len(sum) != sha256.Size {
+			return nil, errors.New("Invalid X-Checksum-SHA256")
+		}
+		expected.Sha256 = hex.EncodeToString(sum)
+	}
+
+	return expected, nil
+}
+
+func (c *Checksums) Matches(expected *Checksums) bool {
+	if expected.Md5 != "" && expected.Md5 != c.Md5 {
+		return false
+	}
+	if expected.Sha256 != "" && expected.Sha256 != c.Sha256 {
+		return false
+	}
+	return true
+}
+
+func (fs *FileSystemBackend) SetChecksums(reqPath string, sums *Checksums) error {
+	fsPath, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(fsPath)
+	if err != nil {
+		return err
+	}
+
+	parentDir, filename := path.Split(reqPath)
+	cachePath := fs.cachePath(parentDir, "gemdrive", "checksums", filename+".json")
+
+	err = os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	entry := &checksumCacheEntry{
+		Size:      stat.Size(),
+		ModTime:   stat.ModTime().UTC().Format(time.RFC3339Nano),
+		Checksums: sums,
+	}
+
+	err = saveJson(entry, cachePath)
+	if err != nil {
+		return err
+	}
+
+	return fs.indexSha256(reqPath, sums.Sha256)
+}
+
+// Returns stored checksums, computing them from the file's contents if
+// there are none or they're out of date.
+func (fs *FileSystemBackend) GetChecksums(reqPath string) (*Checksums, error) {
+	fsPath, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(fsPath)
+	if err != nil {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	parentDir, filename := path.Split(reqPath)
+	cachePath := fs.cachePath(parentDir, "gemdrive", "checksums", filename+".json")
+
+	cacheJson, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		var entry checksumCacheEntry
+		err = json.Unmarshal(cacheJson, &entry)
+		if err == nil && entry.Size == stat.Size() && entry.ModTime == stat.ModTime().UTC().Format(time.RFC3339Nano) {
+			return entry.Checksums, nil
+		}
+	}
+
+	file, err := os.Open(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := newChecksumReader(file)
+	_, err = io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := reader.Checksums()
+
+	err = fs.SetChecksums(reqPath, sums)
+	if err != nil {
+		return nil, err
+	}
+
+	return sums, nil
+}
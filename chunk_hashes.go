@@ -0,0 +1,236 @@
+package gemdrive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Serves <dir>/gemdrive/chunks/<filename>, the SHA-256 of each chunk of a
+// file, so clients streaming it from mirrors they don't trust can check
+// each range as it arrives rather than only once they have all of it. The
+// chunk hashes are the leaves of a binary hash tree, and its root covers
+// the whole file. Each parent is the hash of its two children, and a node
+// without a sibling is carried up as it is.
+//
+// Chunks are 1MiB unless ?chunkSize= asks for another power of two.
+// Manifests are cached until the file changes.
+
+const defaultHashChunkSize = 1024 * 1024
+const minHashChunkSize = 64 * 1024
+const maxHashChunkSize = 64 * 1024 * 1024
+
+type ChunkManifest struct {
+	Size      int64    `json:"size"`
+	ModTime   string   `json:"modTime,omitempty"`
+	Algorithm string   `json:"algorithm"`
+	ChunkSize int64    `json:"chunkSize"`
+	Chunks    []string `json:"chunks"`
+	Root      string   `json:"root"`
+}
+
+type chunkHashes struct {
+	dir   string
+	locks [64]sync.Mutex
+}
+
+func newChunkHashes(cacheDir string) (*chunkHashes, error) {
+	dir := filepath.Join(cacheDir, "chunk-hashes")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkHashes{
+		dir: dir,
+	}, nil
+}
+
+func (c *chunkHashes) lock(key string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &c.locks[hash.Sum32()%uint32(len(c.locks))]
+}
+
+func parseHashChunkSize(value string) (int64, error) {
+	if value == "" {
+		return defaultHashChunkSize, nil
+	}
+
+	chunkSize, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || chunkSize < minHashChunkSize || chunkSize > maxHashChunkSize || chunkSize&(chunkSize-1) != 0 {
+		return 0, &Error{
+			HttpCode: 400,
+			Message:  fmt.Sprintf("chunkSize must be a power of two from %d to %d", minHashChunkSize, maxHashChunkSize),
+		}
+	}
+
+	return chunkSize, nil
+}
+
+func hashTreeRoot(chunks [][]byte) []byte {
+	if len(chunks) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+
+	level := chunks
+	for len(level) > 1 {
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+
+			hash := sha256.New()
+			hash.Write(level[i])
+			hash.Write(level[i+1])
+			next = append(next, hash.Sum(nil))
+		}
+		level = next
+	}
+
+	return level[0]
+}
+
+func (s *Server) serveChunkManifest(w http.ResponseWriter, r *http.Request, dirPath, filename string) {
+	token, _ := extractToken(r)
+
+	filePath := dirPath + filename
+
+	if filename == "" || strings.Contains(filename, "/") {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	if !s.auth.CanRead(token, filePath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	if !canReadRaw(s.config.Exports, s.auth, token, filePath) {
+		w.WriteHeader(errNoRawAccess.HttpCode)
+		io.WriteString(w, errNoRawAccess.Message)
+		return
+	}
+
+	chunkSize, err := parseHashChunkSize(r.URL.Query().Get("chunkSize"))
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	}
+
+	parent, err := s.backend.List(dirPath, 1)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	item, exists := parent.Children[filename]
+	if !exists {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	manifest, err := s.chunkManifest(r, filePath, item, chunkSize)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	jsonBody, err := json.Marshal(manifest)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	setValidators(w, item)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+func (s *Server) chunkManifest(r *http.Request, filePath string, item *Item, chunkSize int64) (*ChunkManifest, error) {
+	key := fmt.Sprintf("%s\n%d\n%s\n%d", filePath, item.Size, item.ModTime, chunkSize)
+	sum := sha256.Sum256([]byte(key))
+	cachePath := filepath.Join(s.chunkHashes.dir, hex.EncodeToString(sum[:])+".json")
+
+	lock := s.chunkHashes.lock(filePath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	cached, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		var manifest *ChunkManifest
+		if json.Unmarshal(cached, &manifest) == nil {
+			return manifest, nil
+		}
+	}
+
+	_, data, err := s.requestBackend(r).Read(filePath, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	chunks := [][]byte{}
+	chunk := make([]byte, chunkSize)
+	var total int64
+	for {
+		n, err := io.ReadFull(data, chunk)
+		if n > 0 {
+			hash := sha256.Sum256(chunk[:n])
+			chunks = append(chunks, hash[:])
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if total != item.Size {
+		return nil, errors.New("File changed while it was being hashed")
+	}
+
+	manifest := &ChunkManifest{
+		Size:      item.Size,
+		ModTime:   item.ModTime,
+		Algorithm: "sha256",
+		ChunkSize: chunkSize,
+		Chunks:    []string{},
+		Root:      hex.EncodeToString(hashTreeRoot(chunks)),
+	}
+	for _, hash := range chunks {
+		manifest.Chunks = append(manifest.Chunks, hex.EncodeToString(hash))
+	}
+
+	err = saveJson(manifest, cachePath)
+	if err != nil {
+		fmt.Println("Failed to cache chunk hashes:", err)
+	}
+
+	return manifest, nil
+}
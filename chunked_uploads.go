@@ -0,0 +1,627 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Browsers can't easily stream a large file in one request, or send the
+// offsets PATCH needs, so they can upload in numbered chunks instead:
+//
+//	POST   gemdrive/chunked-uploads                  {"path", "size", "chunkSize"}
+//	PUT    gemdrive/chunked-uploads/<id>/<index>      one chunk, any order, retries replace
+//	POST   gemdrive/chunked-uploads/<id>/finalize     with Content-MD5 or X-Checksum-SHA256
+//
+// Chunks are staged in the cache dir and only assembled into the file once
+// finalize has checked them against the whole file's checksum, so a failed
+// upload never leaves a partial file behind. GET on the session lists the
+// chunks received, for resuming, and DELETE abandons it. Sessions belong to
+// the identity that created them, and expire after a day without activity.
+
+const defaultChunkSize = 8 * 1024 * 1024
+
+const minChunkSize = 64 * 1024
+
+const maxChunkSize = 64 * 1024 * 1024
+
+const chunkedUploadTimeout = 24 * time.Hour
+
+type ChunkedUpload struct {
+	Id        string `json:"id"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunkSize"`
+	Chunks    int    `json:"chunks"`
+	// Indexes of the chunks received so far
+	Received  []int  `json:"received"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+type chunkedUploadRequest struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunkSize,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+}
+
+type chunkedUpload struct {
+	ChunkedUpload
+	owner      string
+	received   map[int]bool
+	lastActive time.Time
+	finalizing bool
+}
+
+// How sessions are stored in Redis
+type sharedChunkedUpload struct {
+	ChunkedUpload
+	Owner      string    `json:"owner"`
+	LastActive time.Time `json:"lastActive"`
+	Finalizing bool      `json:"finalizing,omitempty"`
+}
+
+type chunkedUploads struct {
+	dir      string
+	sessions map[string]*chunkedUpload
+	mut      *sync.Mutex
+	shared   *redisClient
+}
+
+// Sessions only live in memory, so chunks left over from before a restart
+// are thrown away. Shared sessions live in Redis instead, and other
+// instances may be using the chunks.
+func newChunkedUploads(cacheDir string, shared *redisClient) *chunkedUploads {
+	dir := filepath.Join(cacheDir, "chunked-uploads")
+	if shared == nil {
+		os.RemoveAll(dir)
+	}
+
+	return &chunkedUploads{
+		dir:      dir,
+		sessions: make(map[string]*chunkedUpload),
+		mut:      &sync.Mutex{},
+		shared:   shared,
+	}
+}
+
+// Takes the lock on session id, returning the function releasing it. When
+// shared, the session is loaded from Redis, held locked there, and stored
+// back afterwards, so it's only ever in memory while locked.
+func (u *chunkedUploads) lock(id string) func() {
+	u.mut.Lock()
+
+	if u.shared == nil {
+		return u.mut.Unlock
+	}
+
+	key := "chunked_upload:" + id
+
+	unlockShared, err := u.shared.lock(key)
+	if err != nil {
+		fmt.Println("Failed to lock chunked upload in Redis:", err)
+		return u.mut.Unlock
+	}
+
+	delete(u.sessions, id)
+
+	var stored *sharedChunkedUpload
+	exists, err := u.shared.getJson(key, &stored)
+	if err != nil {
+		fmt.Println("Failed to load chunked upload from Redis:", err)
+	} else if exists && stored != nil {
+		session := &chunkedUpload{
+			ChunkedUpload: stored.ChunkedUpload,
+			owner:         stored.Owner,
+			received:      make(map[int]bool),
+			lastActive:    stored.LastActive,
+			finalizing:    stored.Finalizing,
+		}
+		for _, index := range stored.Received {
+			session.received[index] = true
+		}
+		u.sessions[id] = session
+	}
+	loaded := err == nil
+
+	return func() {
+		defer u.mut.Unlock()
+		defer unlockShared()
+
+		session, exists := u.sessions[id]
+		delete(u.sessions, id)
+
+		if !loaded {
+			return
+		}
+
+		var err error
+		if !exists {
+			_, err = u.shared.del(key)
+		} else {
+			err = u.shared.setJson(key, &sharedChunkedUpload{
+				ChunkedUpload: *session.snapshot(),
+				Owner:         session.owner,
+				LastActive:    session.lastActive,
+				Finalizing:    session.finalizing,
+			}, chunkedUploadTimeout)
+		}
+		if err != nil {
+			fmt.Println("Failed to store chunked upload in Redis:", err)
+		}
+	}
+}
+
+func (u *chunkedUploads) create(req *chunkedUploadRequest, owner string) (*ChunkedUpload, error) {
+	chunkSize := req.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	if chunkSize < minChunkSize || chunkSize > maxChunkSize {
+		return nil, &Error{
+			HttpCode: 400,
+			Message:  fmt.Sprintf("chunkSize must be between %d and %d", minChunkSize, maxChunkSize),
+		}
+	}
+
+	id, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Join(u.dir, id), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &chunkedUpload{
+		ChunkedUpload: ChunkedUpload{
+			Id:        id,
+			Path:      req.Path,
+			Size:      req.Size,
+			ChunkSize: chunkSize,
+			Chunks:    int((req.Size + chunkSize - 1) / chunkSize),
+			Overwrite: req.Overwrite,
+		},
+		owner:      owner,
+		received:   make(map[int]bool),
+		lastActive: time.Now(),
+	}
+
+	defer u.lock(id)()
+
+	u.expire()
+	u.sessions[id] = session
+
+	return session.snapshot(), nil
+}
+
+// Must be called with the lock held.
+func (u *chunkedUploads) expire() {
+	now := time.Now()
+	for id, session := range u.sessions {
+		if now.Sub(session.lastActive) > chunkedUploadTimeout && !session.finalizing {
+			delete(u.sessions, id)
+			os.RemoveAll(filepath.Join(u.dir, id))
+		}
+	}
+
+	if u.shared == nil {
+		return
+	}
+
+	// Shared sessions expire in Redis, leaving their chunks behind
+	entries, err := ioutil.ReadDir(u.dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if now.Sub(entry.ModTime()) <= chunkedUploadTimeout {
+			continue
+		}
+
+		_, exists, err := u.shared.get("chunked_upload:" + entry.Name())
+		if err == nil && !exists {
+			os.RemoveAll(filepath.Join(u.dir, entry.Name()))
+		}
+	}
+}
+
+// Must be called with the lock held.
+func (u *chunkedUploads) get(id, owner string) (*chunkedUpload, error) {
+	session, exists := u.sessions[id]
+	if !exists || session.owner != owner {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "No such upload session",
+		}
+	}
+
+	if session.finalizing {
+		return nil, &Error{
+			HttpCode: 409,
+			Message:  "Upload is being finalized",
+		}
+	}
+
+	session.lastActive = time.Now()
+
+	return session, nil
+}
+
+// Must be called with the lock held.
+func (c *chunkedUpload) snapshot() *ChunkedUpload {
+	upload := c.ChunkedUpload
+	upload.Received = []int{}
+	for index := 0; index < c.Chunks; index++ {
+		if c.received[index] {
+			upload.Received = append(upload.Received, index)
+		}
+	}
+	upload.ExpiresAt = c.lastActive.Add(chunkedUploadTimeout).UTC().Format(time.RFC3339)
+	return &upload
+}
+
+func (c *chunkedUpload) chunkLength(index int) int64 {
+	if index == c.Chunks-1 {
+		return c.Size - int64(index)*c.ChunkSize
+	}
+	return c.ChunkSize
+}
+
+func (u *chunkedUploads) status(id, owner string) (*ChunkedUpload, error) {
+	defer u.lock(id)()
+
+	session, err := u.get(id, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	return session.snapshot(), nil
+}
+
+func (u *chunkedUploads) remove(id string) {
+	defer u.lock(id)()
+
+	delete(u.sessions, id)
+	os.RemoveAll(filepath.Join(u.dir, id))
+}
+
+// Handles gemdrive/chunked-uploads[/<id>[/<index>|/finalize]]
+func (s *Server) handleChunkedUploads(w http.ResponseWriter, r *http.Request, rest string) {
+
+	token, _ := extractToken(r)
+	owner := strings.Join(s.auth.Principals(token), ",")
+
+	if owner == "" {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	parts := strings.Split(rest, "/")
+	id := parts[0]
+
+	var result interface{}
+	var err error
+	status := 200
+
+	switch {
+	case id == "" && r.Method == "POST":
+		result, err = s.createChunkedUpload(r, token, owner)
+		status = 201
+	case id != "" && len(parts) == 1 && r.Method == "GET":
+		result, err = s.chunkSessions.status(id, owner)
+	case id != "" && len(parts) == 1 && r.Method == "DELETE":
+		_, err = s.chunkSessions.status(id, owner)
+		if err == nil {
+			s.chunkSessions.remove(id)
+			return
+		}
+	case len(parts) == 2 && parts[1] == "finalize" && r.Method == "POST":
+		err = s.finalizeChunkedUpload(r, token, id, owner)
+		if err == nil {
+			return
+		}
+	case len(parts) == 2 && r.Method == "PUT":
+		result, err = s.putChunk(w, r, id, parts[1], owner)
+		if err == nil && result == nil {
+			return
+		}
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	jsonBody, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBody)
+}
+
+// Whether token may write the whole file to reqPath.
+func (s *Server) checkChunkedUploadAllowed(token, reqPath string, overwrite bool) error {
+	exists, err := s.itemExists(reqPath)
+	if err != nil {
+		return err
+	}
+
+	if exists && !overwrite {
+		return &Error{HttpCode: 409, Message: "File exists"}
+	}
+
+	if exists && !s.canModify(token, reqPath) {
+		return &Error{HttpCode: 403, Message: "Not allowed to modify this file"}
+	}
+
+	if !exists && !s.auth.CanCreate(token, reqPath) {
+		return &Error{HttpCode: 403, Message: "Not allowed to create files here"}
+	}
+
+	return nil
+}
+
+func (s *Server) createChunkedUpload(r *http.Request, token, owner string) (*ChunkedUpload, error) {
+	var req *chunkedUploadRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req)
+	if err != nil || req == nil || !strings.HasPrefix(req.Path, "/") || strings.HasSuffix(req.Path, "/") || req.Size < 1 {
+		return nil, &Error{
+			HttpCode: 400,
+			Message:  "Expected a file path and a size of at least 1 byte",
+		}
+	}
+
+	if _, ok := s.backend.(WritableBackend); !ok {
+		return nil, &Error{HttpCode: 500, Message: "Backend does not support writing"}
+	}
+
+	req.Path, err = cleanPath(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Path, err = s.normalizePath(req.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Path, err = s.checkUploadPolicy(req.Path, req.Size, req.Overwrite)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkChunkedUploadAllowed(token, req.Path, req.Overwrite)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.MaxUploadSize != 0 && req.Size > s.config.MaxUploadSize {
+		return nil, &Error{HttpCode: 413, Message: "Upload exceeds maximum size"}
+	}
+
+	if !s.hasSpaceFor(req.Path, req.Size) {
+		return nil, &Error{HttpCode: 507, Message: "Insufficient storage"}
+	}
+
+	return s.chunkSessions.create(req, owner)
+}
+
+// Stages one chunk. Returns nil, nil if the response has already been sent.
+func (s *Server) putChunk(w http.ResponseWriter, r *http.Request, id, indexStr, owner string) (*ChunkedUpload, error) {
+	u := s.chunkSessions
+
+	unlock := u.lock(id)
+	session, err := u.get(id, owner)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := strconv.Atoi(indexStr)
+	if err != nil || index < 0 || index >= session.Chunks {
+		return nil, &Error{HttpCode: 400, Message: "Invalid chunk index"}
+	}
+
+	length := session.chunkLength(index)
+	if r.ContentLength != length {
+		return nil, &Error{
+			HttpCode: 400,
+			Message:  fmt.Sprintf("Chunk %d must be %d bytes", index, length),
+		}
+	}
+
+	expected, err := parseExpectedChecksums(r.Header.Get("Content-MD5"), r.Header.Get("X-Checksum-SHA256"))
+	if err != nil {
+		return nil, &Error{HttpCode: 400, Message: err.Error()}
+	}
+
+	release, ok := s.acquireStream(w, r)
+	if !ok {
+		return nil, nil
+	}
+	defer release()
+
+	transfer := s.startTransfer(r, "upload", session.Path, length, r.Body)
+	defer s.transfers.finish(transfer)
+
+	chunkDir := filepath.Join(u.dir, id)
+
+	tmpFile, err := ioutil.TempFile(chunkDir, ".chunk_tmp_")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	body := newChecksumReader(transfer)
+	n, err := io.Copy(tmpFile, io.LimitReader(body, length))
+	tmpFile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if n != length {
+		return nil, &Error{HttpCode: 400, Message: "Chunk is incomplete"}
+	}
+
+	if !body.Checksums().Matches(expected) {
+		return nil, &Error{HttpCode: 400, Message: "Checksum mismatch"}
+	}
+
+	defer u.lock(id)()
+
+	// It may have been finalized, cancelled or expired in the meantime
+	session, err = u.get(id, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Rename(tmpFile.Name(), blockPath(chunkDir, int64(index)))
+	if err != nil {
+		return nil, err
+	}
+
+	session.received[index] = true
+
+	return session.snapshot(), nil
+}
+
+func (s *Server) finalizeChunkedUpload(r *http.Request, token, id, owner string) error {
+	expected, err := parseExpectedChecksums(r.Header.Get("Content-MD5"), r.Header.Get("X-Checksum-SHA256"))
+	if err != nil {
+		return &Error{HttpCode: 400, Message: err.Error()}
+	}
+
+	if expected.Md5 == "" && expected.Sha256 == "" {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Finalizing requires a Content-MD5 or X-Checksum-SHA256 header",
+		}
+	}
+
+	encryption, err := parseEncryptionHeaders(r)
+	if err != nil {
+		return err
+	}
+
+	u := s.chunkSessions
+
+	unlock := u.lock(id)
+	session, err := u.get(id, owner)
+	if err == nil && len(session.received) != session.Chunks {
+		err = &Error{
+			HttpCode: 409,
+			Message:  fmt.Sprintf("Only %d of %d chunks received", len(session.received), session.Chunks),
+		}
+	}
+	if err != nil {
+		unlock()
+		return err
+	}
+	session.finalizing = true
+	unlock()
+
+	finished := false
+	defer func() {
+		if finished {
+			u.remove(id)
+			return
+		}
+		unlock := u.lock(id)
+		if current, exists := u.sessions[id]; exists {
+			current.finalizing = false
+			current.lastActive = time.Now()
+		}
+		unlock()
+	}()
+
+	chunkDir := filepath.Join(u.dir, id)
+
+	// Checked before anything is written, so a bad upload can be fixed by
+	// sending chunks again
+	chunks := openBlocks(chunkDir, session.ChunkSize, session.Size, 0, 0)
+	if chunks == nil {
+		return &Error{HttpCode: 500, Message: "Staged chunks are missing"}
+	}
+	sumReader := newChecksumReader(chunks)
+	_, err = io.Copy(ioutil.Discard, sumReader)
+	chunks.Close()
+	if err != nil {
+		return err
+	}
+
+	sums := sumReader.Checksums()
+	if !sums.Matches(expected) {
+		return &Error{HttpCode: 400, Message: "Checksum mismatch"}
+	}
+
+	// Permissions could have changed since the session was created
+	exists, err := s.itemExists(session.Path)
+	if err != nil {
+		return err
+	}
+	err = s.checkChunkedUploadAllowed(token, session.Path, session.Overwrite)
+	if err != nil {
+		return err
+	}
+
+	backend := s.backend.(WritableBackend)
+
+	chunks = openBlocks(chunkDir, session.ChunkSize, session.Size, 0, 0)
+	if chunks == nil {
+		return &Error{HttpCode: 500, Message: "Staged chunks are missing"}
+	}
+	defer chunks.Close()
+
+	// Whole writes leave what was there if they fail
+	err = backend.Write(session.Path, chunks, 0, session.Size, session.Overwrite, true)
+	if err != nil {
+		return err
+	}
+
+	finished = true
+
+	if store, ok := s.backend.(ChecksumStore); ok {
+		err := store.SetChecksums(session.Path, sums)
+		if err != nil {
+			fmt.Println("Failed to store checksums:", err.Error())
+		}
+	}
+
+	err = s.recordEncryption(session.Path, encryption)
+	if err != nil {
+		fmt.Println("Failed to record encryption metadata:", err)
+	}
+
+	if !exists {
+		s.recordUpload(token, session.Path)
+	}
+	s.notifyUpload(session.Path, owner, session.Size)
+	s.processUpload(session.Path)
+
+	return nil
+}
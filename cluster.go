@@ -0,0 +1,204 @@
+package gemdrive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// In cluster mode any number of instances serve one logical drive, behind
+// a load balancer with no need for sticky sessions. They share the data dir,
+// the cache dir and the exported dirs themselves, ie over NFS, and Redis for
+// everything in redis.go. On top of that:
+//
+// Changes are published to the other instances, so directory versions,
+// ETags and long-polling listings see them as soon as they're made. While
+// an instance is cut off from Redis it hands out no versions, and all of
+// them change once it's back.
+//
+// Writes to upload records and attributes in the data dir take a lock in
+// Redis, idempotency results are kept there, notifications are throttled
+// across the cluster, and each run of a scheduled task happens on one
+// instance only. Bandwidth counters, delete jobs and task history are kept
+// per instance, in files named after it. Two-person approval isn't
+// supported.
+
+type ClusterConfig struct {
+	// Names this instance, for the files it keeps to itself. Defaults to the
+	// hostname, and must be unique in the cluster.
+	Node string `json:"node,omitempty"`
+}
+
+const clusterEventsChannel = "events"
+
+type clusterEvent struct {
+	// The instance which made the change
+	Origin string `json:"origin"`
+	Mount  string `json:"mount"`
+	Path   string `json:"path"`
+	// Set when Path was moved there from here
+	MovedFrom string `json:"movedFrom,omitempty"`
+}
+
+type cluster struct {
+	node string
+	// Tells this run of the instance's own events apart
+	origin   string
+	shared   *redisClient
+	backends map[string]*FileSystemBackend
+}
+
+func newCluster(config *ClusterConfig, shared *redisClient, backends map[string]*FileSystemBackend) (*cluster, error) {
+	if shared == nil {
+		return nil, errors.New("Cluster mode needs Redis")
+	}
+
+	node := config.Node
+	if node == "" {
+		var err error
+		node, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if strings.ContainsAny(node, "/\\") {
+		return nil, fmt.Errorf("Invalid cluster node name %s", node)
+	}
+
+	origin, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cluster{
+		node:     node,
+		origin:   origin,
+		shared:   shared,
+		backends: backends,
+	}
+
+	for mount, fs := range backends {
+		mount := mount
+		fs.versions.setBlind(true)
+		fs.SetChangeHook(func(reqPath, movedFrom string) {
+			c.publish(mount, reqPath, movedFrom)
+		})
+	}
+
+	return c, nil
+}
+
+func (c *cluster) publish(mount, reqPath, movedFrom string) {
+	message, err := json.Marshal(&clusterEvent{
+		Origin:    c.origin,
+		Mount:     mount,
+		Path:      reqPath,
+		MovedFrom: movedFrom,
+	})
+	if err == nil {
+		err = c.shared.publish(clusterEventsChannel, string(message))
+	}
+	if err != nil {
+		fmt.Println("Failed to tell the cluster about", reqPath+":", err)
+	}
+}
+
+// Listens for other instances' changes until ctx is done.
+func (c *cluster) run(ctx context.Context) {
+	for {
+		err := c.shared.subscribe(clusterEventsChannel, func() {
+			c.setBlind(false)
+		}, c.handle)
+
+		c.setBlind(true)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		fmt.Println("Lost the cluster's events, reconnecting:", err)
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *cluster) setBlind(blind bool) {
+	for _, fs := range c.backends {
+		fs.versions.setBlind(blind)
+	}
+}
+
+func (c *cluster) handle(message string) {
+	var event *clusterEvent
+	err := json.Unmarshal([]byte(message), &event)
+	if err != nil || event == nil || event.Origin == c.origin {
+		return
+	}
+
+	fs, exists := c.backends[event.Mount]
+	if !exists {
+		return
+	}
+
+	// Whoever made the change cleared the shared caches
+	if event.MovedFrom != "" {
+		fs.versions.moved(event.MovedFrom, event.Path)
+		fs.invalidateListing(path.Dir(dirVersionKey(event.MovedFrom)))
+	} else {
+		fs.versions.changed(event.Path)
+	}
+	fs.invalidateListing(path.Dir(dirVersionKey(event.Path)))
+}
+
+// Takes the cluster-wide lock on name, returning the function releasing it.
+// Outside cluster mode there's nothing to do.
+func (c *cluster) lock(name string) func() {
+	if c == nil {
+		return func() {}
+	}
+
+	unlock, err := c.shared.lock(name)
+	if err != nil {
+		fmt.Println("Failed to take cluster lock", name+":", err)
+		return func() {}
+	}
+
+	return unlock
+}
+
+// Reports whether this instance is the first to claim name, which stays
+// claimed for ttl. Outside cluster mode it always is.
+func (c *cluster) claim(name string, ttl time.Duration) bool {
+	if c == nil {
+		return true
+	}
+
+	claimed, err := c.shared.setNX("claim:"+name, c.node, ttl)
+	if err != nil {
+		fmt.Println("Failed to claim", name+":", err)
+		return false
+	}
+
+	return claimed
+}
+
+// The path of a file in the data dir which each instance keeps its own of,
+// ie gemdrive_tasks.json becomes gemdrive_tasks.<node>.json.
+func (c *cluster) dataFile(dataDir, name string) string {
+	if c != nil {
+		ext := filepath.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "." + c.node + ext
+	}
+	return filepath.Join(dataDir, name)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"path/filepath"
@@ -18,6 +19,7 @@ func main() {
 	}
 
 	port := flag.Int("port", 0, "Port")
+	ninepAddr := flag.String("9p-addr", "", "Address to serve 9P2000 on, ie :5640")
 	var dirs arrayFlags
 	flag.Var(&dirs, "dir", "Directory to add")
 	configPath := flag.String("config", "", "Config path")
@@ -25,11 +27,15 @@ func main() {
 	dataDir := flag.String("database-dir", "", "Database directory")
 	cacheDir := flag.String("cache-dir", "", "Cache directory")
 	rclone := flag.String("rclone", "", "Enable rclone proxy")
+	var gitRepos arrayFlags
+	flag.Var(&gitRepos, "git-repo", "Git repository to add (read-only)")
+	createServiceToken := flag.String("create-service-token", "", "Mint a token for the named service account, print it, and exit")
+	serviceTokenPerm := flag.String("service-token-perm", "read", "Permission for -create-service-token")
+	serviceTokenPath := flag.String("service-token-path", "/", "Path prefix for -create-service-token")
 	flag.Parse()
 
 	config := &gemdrive.Config{
 		Port: 3838,
-		Dirs: []string{},
 	}
 
 	if *configPath == "" {
@@ -49,6 +55,10 @@ func main() {
 		config.Port = *port
 	}
 
+	if *ninepAddr != "" {
+		config.NinepAddr = *ninepAddr
+	}
+
 	if *dataDir != "" {
 		config.DataDir = filepath.Join(userDirs.GetDataDir(), "gemdrive")
 	}
@@ -62,7 +72,26 @@ func main() {
 	}
 
 	for _, dir := range dirs {
-		config.Dirs = append(config.Dirs, dir)
+		config.Mounts = append(config.Mounts, &gemdrive.MountConfig{Path: dir})
+	}
+
+	for _, repo := range gitRepos {
+		config.GitRepos = append(config.GitRepos, repo)
+	}
+
+	if *createServiceToken != "" {
+		auth, err := gemdrive.NewAuth(config.DataDir, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		token, _, err := auth.CreateServiceToken(*createServiceToken, *serviceTokenPerm, *serviceTokenPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(token)
+		return
 	}
 
 	server, err := gemdrive.NewServer(config)
@@ -70,7 +99,10 @@ func main() {
 		log.Fatal(err)
 	}
 
-	server.Run(context.Background())
+	err = server.Run(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 // Taken from https://stackoverflow.com/a/28323276/943814
@@ -0,0 +1,7 @@
+//go:build mysql
+// +build mysql
+
+package main
+
+// Registers the mysql driver for SQL backends
+import _ "github.com/go-sql-driver/mysql"
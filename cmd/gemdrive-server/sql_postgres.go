@@ -0,0 +1,7 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// Registers the postgres driver for SQL backends
+import _ "github.com/lib/pq"
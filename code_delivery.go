@@ -0,0 +1,134 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Login codes are delivered by a CodeSender, chosen with
+// codeDelivery.transport in the config:
+//
+//	smtp     emails the code, the default when smtp is configured
+//	webhook  POSTs a CodeDelivery to webhookUrl, ie to relay it over chat
+//	stdout   prints the code in the server log, for development and for
+//	         self-hosters without a mail server
+type CodeSender interface {
+	SendCode(key Key, code string) error
+}
+
+type CodeDeliveryConfig struct {
+	Transport  string `json:"transport,omitempty"`
+	WebhookUrl string `json:"webhookUrl,omitempty"`
+	// Sent as a bearer token so the webhook can tell codes are genuine
+	WebhookToken string `json:"webhookToken,omitempty"`
+}
+
+type CodeDelivery struct {
+	IdType string `json:"idType"`
+	Id     string `json:"id"`
+	Code   string `json:"code"`
+}
+
+const codeWebhookTimeout = 10 * time.Second
+
+func newCodeSender(config *Config) (CodeSender, error) {
+	deliveryConfig := config.CodeDelivery
+	if deliveryConfig == nil {
+		deliveryConfig = &CodeDeliveryConfig{}
+	}
+
+	transport := deliveryConfig.Transport
+	if transport == "" {
+		if newMailer(config.Smtp).configured() {
+			transport = "smtp"
+		} else {
+			fmt.Println("SMTP isn't configured, so login codes will be printed here")
+			transport = "stdout"
+		}
+	}
+
+	switch transport {
+	case "smtp":
+		if !newMailer(config.Smtp).configured() {
+			return nil, errors.New("Code delivery over SMTP requires smtp config")
+		}
+		return &smtpCodeSender{newMailer(config.Smtp)}, nil
+	case "webhook":
+		if deliveryConfig.WebhookUrl == "" {
+			return nil, errors.New("Code delivery over webhook requires webhookUrl")
+		}
+		return &webhookCodeSender{
+			url:   deliveryConfig.WebhookUrl,
+			token: deliveryConfig.WebhookToken,
+			client: &http.Client{
+				Timeout: codeWebhookTimeout,
+			},
+		}, nil
+	case "stdout":
+		return &stdoutCodeSender{}, nil
+	default:
+		return nil, errors.New("Unknown code delivery transport: " + transport)
+	}
+}
+
+type smtpCodeSender struct {
+	mailer *mailer
+}
+
+func (s *smtpCodeSender) SendCode(key Key, code string) error {
+	body := "An application wants to access your data. Use the following code to complete authorization:\n" +
+		"\n" +
+		code + "\n"
+
+	return s.mailer.send("GemDrive email verifier", []string{key.Id}, "Email Verification", body)
+}
+
+type webhookCodeSender struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (s *webhookCodeSender) SendCode(key Key, code string) error {
+	jsonBody, err := json.Marshal(&CodeDelivery{
+		IdType: key.IdType,
+		Id:     key.Id,
+		Code:   code,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(jsonBody))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return errors.New("Code webhook failed: " + res.Status)
+	}
+
+	return nil
+}
+
+type stdoutCodeSender struct{}
+
+func (s *stdoutCodeSender) SendCode(key Key, code string) error {
+	fmt.Println("Login code for", key.IdType+":"+key.Id, "is", code)
+	return nil
+}
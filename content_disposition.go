@@ -0,0 +1,45 @@
+package gemdrive
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Builds a Content-Disposition header naming the file, with the name in
+// both filename, made ASCII for old clients, and filename* (RFC 5987), which
+// browsers prefer and which keeps it as it is.
+func contentDisposition(disposition, filename string) string {
+	var fallback strings.Builder
+	var encoded strings.Builder
+
+	for _, c := range filename {
+		if c < 0x20 || c == 0x7f || c == '"' || c == '\\' || c >= utf8.RuneSelf {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(c)
+		}
+	}
+
+	for i := 0; i < len(filename); i++ {
+		b := filename[i]
+		if isRfc5987AttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	if fallback.String() == filename {
+		return fmt.Sprintf("%s; filename=\"%s\"", disposition, filename)
+	}
+
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback.String(), encoded.String())
+}
+
+func isRfc5987AttrChar(b byte) bool {
+	if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') {
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) != -1
+}
@@ -0,0 +1,56 @@
+package gemdrive
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Browsers attach cookies to requests other sites trigger, so writes
+// authenticated by cookie must come from a page on this server. Browsers
+// send Origin with every cross-origin write, and with same-origin ones other
+// than GET and HEAD, so it's checked against the host the request was sent
+// to, falling back to Referer. Requests carrying their token in a header or
+// query param can't be forged this way and aren't checked.
+
+var csrfMethods = map[string]bool{
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+	"MOVE":   true,
+}
+
+func cookieAuthenticated(r *http.Request) bool {
+	if r.URL.Query().Get("access_token") != "" || r.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	for _, name := range []string{"access_token", "refresh_token"} {
+		if _, err := r.Cookie(name); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) checkCsrf(r *http.Request, hostname string) error {
+	if !csrfMethods[r.Method] || !cookieAuthenticated(r) {
+		return nil
+	}
+
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Header.Get("Referer")
+	}
+
+	sourceUrl, err := url.Parse(source)
+	if source == "" || err != nil || sourceUrl.Host != hostname {
+		return &Error{
+			HttpCode: 403,
+			Message:  "Cross-site request rejected",
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Clients re-syncing a large file the server already has, ie one they moved
+// or renamed, can skip sending it. A PUT with an empty body and
+//
+//	X-GemDrive-Dedup: link
+//	X-Checksum-SHA256: <sha256 of the file>
+//
+// is filled in from a file with the same contents, which the uploader can
+// read, and otherwise goes as any other upload. If there's no such file, it
+// fails with 412 and the client sends the content after all.
+//
+// Local exports index files by the checksums stored for them, as they're
+// uploaded or indexed. The index can go stale, so candidates are checked
+// before they're used.
+
+// Most recent paths kept for each checksum
+const maxDedupPaths = 16
+
+// Backends which can find files by their contents.
+type DedupStore interface {
+	FindBySha256(sha256 string) ([]string, error)
+}
+
+func (fs *FileSystemBackend) dedupIndexPath(sha256 string) string {
+	return fs.cachePath("gemdrive", "dedup", sha256[:2], sha256+".json")
+}
+
+func (fs *FileSystemBackend) FindBySha256(sha256 string) ([]string, error) {
+	if len(sha256) != 64 {
+		return []string{}, nil
+	}
+
+	indexJson, err := ioutil.ReadFile(fs.dedupIndexPath(sha256))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	err = json.Unmarshal(indexJson, &paths)
+	if err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
+func (fs *FileSystemBackend) indexSha256(reqPath, sha256 string) error {
+	if len(sha256) != 64 {
+		return nil
+	}
+
+	fs.dedupMut.Lock()
+	defer fs.dedupMut.Unlock()
+
+	paths, err := fs.FindBySha256(sha256)
+	if err != nil {
+		paths = []string{}
+	}
+
+	updated := []string{reqPath}
+	for _, p := range paths {
+		if p != reqPath && len(updated) < maxDedupPaths {
+			updated = append(updated, p)
+		}
+	}
+
+	indexPath := fs.dedupIndexPath(sha256)
+	err = os.MkdirAll(filepath.Dir(indexPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return saveJson(updated, indexPath)
+}
+
+func (b *MultiBackend) FindBySha256(sha256 string) ([]string, error) {
+	names := []string{}
+	for name := range b.backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	paths := []string{}
+	for _, name := range names {
+		store, ok := b.backends[name].(DedupStore)
+		if !ok {
+			continue
+		}
+
+		subPaths, err := store.FindBySha256(sha256)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, subPath := range subPaths {
+			paths = append(paths, "/"+name+subPath)
+		}
+	}
+
+	return paths, nil
+}
+
+// Swaps the empty body of a dedup link upload for the contents of a file
+// that has them. Returns the new body, which the caller closes, or nil if
+// the response has been sent.
+func (s *Server) linkDedupContent(w http.ResponseWriter, r *http.Request, token, reqPath string) io.ReadCloser {
+	expected, err := parseExpectedChecksums("", r.Header.Get("X-Checksum-SHA256"))
+	if err != nil || expected.Sha256 == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "Dedup links need X-Checksum-SHA256")
+		return nil
+	}
+
+	dedup, isDedup := s.backend.(DedupStore)
+	checksums, isChecksums := s.backend.(ChecksumStore)
+
+	var candidates []string
+	if isDedup && isChecksums {
+		candidates, err = dedup.FindBySha256(expected.Sha256)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return nil
+		}
+	}
+
+	for _, candidate := range candidates {
+		if candidate == reqPath || !s.auth.CanRead(token, candidate) || !canReadRaw(s.config.Exports, s.auth, token, candidate) {
+			continue
+		}
+
+		sums, err := checksums.GetChecksums(candidate)
+		if err != nil || sums.Sha256 != expected.Sha256 {
+			continue
+		}
+
+		item, data, err := s.requestBackend(r).Read(candidate, 0, 0)
+		if err != nil {
+			continue
+		}
+
+		r.Header.Del("Content-Range")
+		r.ContentLength = item.Size
+		w.Header().Set("X-GemDrive-Dedup", "linked")
+
+		return data
+	}
+
+	w.WriteHeader(412)
+	io.WriteString(w, "No file with that content, send it instead")
+	return nil
+}
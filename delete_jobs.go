@@ -0,0 +1,397 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recursive deletes of directories run as background jobs, deleting one
+// entry at a time. The request waits a few seconds, so small trees are gone
+// by the time it returns; otherwise it gets a 202 with the job, which can be
+// followed and cancelled at gemdrive/deletes/<id>. Jobs are journaled in the
+// data dir and pick up where they left off after a restart, so a big delete
+// never stops halfway without anyone knowing.
+
+var errDeleteCancelled = errors.New("Delete cancelled")
+
+const deleteJobWait = 5 * time.Second
+
+// Finished jobs stay queryable for this long
+const deleteJobRetention = 24 * time.Hour
+
+type DeleteJob struct {
+	Id           string `json:"id"`
+	Path         string `json:"path"`
+	Owner        string `json:"owner,omitempty"`
+	State        string `json:"state"`
+	FilesDeleted int64  `json:"filesDeleted"`
+	DirsDeleted  int64  `json:"dirsDeleted"`
+	StartedAt    string `json:"startedAt"`
+	FinishedAt   string `json:"finishedAt,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type deleteJob struct {
+	DeleteJob
+	cancelled bool
+	done      chan struct{}
+}
+
+type deleteJobs struct {
+	backend      Backend
+	path         string
+	jobs         map[string]*deleteJob
+	mut          *sync.Mutex
+	onDirDeleted func(dirPath string)
+}
+
+func newDeleteJobs(journalPath string, backend Backend) *deleteJobs {
+	d := &deleteJobs{
+		backend: backend,
+		path:    journalPath,
+		jobs:    make(map[string]*deleteJob),
+		mut:     &sync.Mutex{},
+	}
+
+	journalJson, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return d
+	}
+
+	var saved []*DeleteJob
+	err = json.Unmarshal(journalJson, &saved)
+	if err != nil {
+		fmt.Println("Ignoring invalid delete journal:", err)
+		return d
+	}
+
+	for _, job := range saved {
+		d.jobs[job.Id] = &deleteJob{
+			DeleteJob: *job,
+			done:      make(chan struct{}),
+		}
+		if job.State != "running" {
+			close(d.jobs[job.Id].done)
+		}
+	}
+
+	return d
+}
+
+// Restarts jobs which were running when the server stopped.
+func (d *deleteJobs) resume() {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	for _, job := range d.jobs {
+		if job.State == "running" {
+			fmt.Println("Resuming delete of", job.Path)
+			go d.run(job)
+		}
+	}
+}
+
+// Starts deleting dirPath, or returns the job already doing so.
+func (d *deleteJobs) start(dirPath, owner string) (*deleteJob, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	for _, job := range d.jobs {
+		if job.State == "running" && job.Path == dirPath {
+			return job, nil
+		}
+	}
+
+	id, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &deleteJob{
+		DeleteJob: DeleteJob{
+			Id:        id,
+			Path:      dirPath,
+			Owner:     owner,
+			State:     "running",
+			StartedAt: time.Now().UTC().Format(time.RFC3339),
+		},
+		done: make(chan struct{}),
+	}
+
+	d.jobs[id] = job
+	d.persist()
+
+	go d.run(job)
+
+	return job, nil
+}
+
+func (d *deleteJobs) run(job *deleteJob) {
+	err := d.deleteTree(job, job.Path)
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	job.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if err == errDeleteCancelled {
+		job.State = "cancelled"
+	} else if err != nil {
+		job.State = "failed"
+		job.Error = err.Error()
+	} else {
+		job.State = "done"
+	}
+
+	d.persist()
+	close(job.done)
+}
+
+// Deletes children before their parents, so whatever is left after a
+// failure or cancellation is still a consistent tree.
+func (d *deleteJobs) deleteTree(job *deleteJob, dirPath string) error {
+	writable, ok := d.backend.(WritableBackend)
+	if !ok {
+		return errors.New("Backend does not support writing")
+	}
+
+	item, err := d.backend.List(dirPath, 1)
+	if isNotFound(err) {
+		// Already deleted before a restart
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for name := range item.Children {
+		d.mut.Lock()
+		cancelled := job.cancelled
+		d.mut.Unlock()
+
+		if cancelled {
+			return errDeleteCancelled
+		}
+
+		childPath := dirPath + name
+
+		if strings.HasSuffix(name, "/") {
+			err := d.deleteTree(job, childPath)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := writable.Delete(childPath, false)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+
+		d.mut.Lock()
+		job.FilesDeleted++
+		d.mut.Unlock()
+	}
+
+	err = writable.Delete(dirPath, false)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	if d.onDirDeleted != nil {
+		d.onDirDeleted(dirPath)
+	}
+
+	d.mut.Lock()
+	job.DirsDeleted++
+	d.persist()
+	d.mut.Unlock()
+
+	return nil
+}
+
+func isNotFound(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.HttpCode == 404
+	}
+	return os.IsNotExist(err)
+}
+
+// Lists jobs, or only those belonging to owner unless all is set.
+func (d *deleteJobs) list(owner string, all bool) []*DeleteJob {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	jobs := []*DeleteJob{}
+	for _, job := range d.jobs {
+		if all || (owner != "" && job.Owner == owner) {
+			jobCopy := job.DeleteJob
+			jobs = append(jobs, &jobCopy)
+		}
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt < jobs[j].StartedAt
+	})
+
+	return jobs
+}
+
+func (d *deleteJobs) get(id, owner string, all bool) (*DeleteJob, error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	job, exists := d.jobs[id]
+	if !exists || !(all || (owner != "" && job.Owner == owner)) {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Delete job not found",
+		}
+	}
+
+	jobCopy := job.DeleteJob
+	return &jobCopy, nil
+}
+
+// Jobs stop before the next entry. Anything already deleted stays deleted.
+func (d *deleteJobs) cancel(id, owner string, all bool) error {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	job, exists := d.jobs[id]
+	if !exists || !(all || (owner != "" && job.Owner == owner)) {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Delete job not found",
+		}
+	}
+
+	if job.State != "running" {
+		return &Error{
+			HttpCode: 409,
+			Message:  "Delete job already finished",
+		}
+	}
+
+	job.cancelled = true
+
+	return nil
+}
+
+// Must be called with the lock held.
+func (d *deleteJobs) persist() {
+	cutoff := time.Now().Add(-deleteJobRetention).UTC().Format(time.RFC3339)
+
+	saved := []*DeleteJob{}
+	for id, job := range d.jobs {
+		if job.State != "running" && job.FinishedAt < cutoff {
+			delete(d.jobs, id)
+			continue
+		}
+		saved = append(saved, &job.DeleteJob)
+	}
+
+	err := saveJson(saved, d.path)
+	if err != nil {
+		fmt.Println("Failed to save delete journal:", err)
+	}
+}
+
+func (s *Server) deleteRecursive(w http.ResponseWriter, r *http.Request, reqPath string) {
+	token, _ := extractToken(r)
+	owner := strings.Join(s.auth.Principals(token), ",")
+
+	job, err := s.deleteJobs.start(reqPath, owner)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	select {
+	case <-job.done:
+		status, err := s.deleteJobs.get(job.Id, "", true)
+		if err == nil && status.State == "failed" {
+			w.WriteHeader(500)
+			io.WriteString(w, status.Error)
+		}
+		return
+	case <-time.After(deleteJobWait):
+	}
+
+	status, err := s.deleteJobs.get(job.Id, "", true)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	jsonBody, err := json.Marshal(status)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/gemdrive/deletes/"+job.Id)
+	w.WriteHeader(202)
+	w.Write(jsonBody)
+}
+
+// Handles gemdrive/deletes[/<id>] for the requester's own jobs, and
+// gemdrive/admin/deletes[/<id>] for everyone's.
+func (s *Server) handleDeleteJobs(w http.ResponseWriter, r *http.Request, id string, all bool) {
+
+	token, _ := extractToken(r)
+
+	if all && !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	owner := strings.Join(s.auth.Principals(token), ",")
+
+	var result interface{}
+	var err error
+
+	switch r.Method {
+	case "GET":
+		if id == "" {
+			result = s.deleteJobs.list(owner, all)
+		} else {
+			result, err = s.deleteJobs.get(id, owner, all)
+		}
+	case "DELETE":
+		err = s.deleteJobs.cancel(id, owner, all)
+		if err == nil {
+			return
+		}
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	}
+
+	jsonBody, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
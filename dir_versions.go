@@ -0,0 +1,443 @@
+package gemdrive
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Polling clients refresh the same directory listing every few seconds, and
+// almost always get back what they already have. Directories on local
+// exports have a version, or generation, which changes whenever anything
+// beneath them does, so meta.json can send an ETag and answer If-None-Match
+// with a 304 without listing anything.
+//
+// Generations are counters bumped as changes are seen, and everything above
+// a changed item is bumped with it, so deep listings are covered too. Each
+// directory also remembers when each of its children last changed, so
+// meta.json?since=<generation> can return just those, waiting for one if
+// there aren't any yet.
+//
+// Children renamed or moved into a directory come with movedFrom, the path
+// they had before, so sync clients can move their copies rather than
+// download them again. Clients applying a delta should make those moves
+// before removing anything, since the source of a move shows up as removed,
+// and fall back to downloading when they don't have it.
+//
+// They only live in memory, prefixed with when the process started, and are
+// only handed out while the watcher is running, since otherwise changes made
+// outside GemDrive would go unnoticed.
+
+// Backends which can tell when a directory's listing last changed.
+type DirVersioner interface {
+	DirVersion(path string) (string, error)
+	// Names of children changed since the given version, and the current
+	// version. Waits until there are some or ctx is done.
+	DirChanges(ctx context.Context, path, since string) ([]string, string, error)
+}
+
+// Backends which can tell where changed children were moved from.
+type MoveTracker interface {
+	// Where each of the named children of path was moved from, for those
+	// whose last change was a move.
+	DirMoves(path string, names []string) (map[string]string, error)
+}
+
+var errNoDirVersion = errors.New("Directory versions not tracked by backend")
+
+var errStaleGeneration = &Error{
+	HttpCode: 410,
+	Message:  "Generation unknown or too old, list the directory again",
+}
+
+// Beyond this many changed children a directory forgets the oldest
+const maxDirChanges = 1000
+
+type dirVersions struct {
+	epoch  string
+	counts map[string]uint64
+	// The count at which each child last changed, by directory. Names of
+	// directories end in a slash, like in listings.
+	changes map[string]map[string]uint64
+	// Changes up to these counts have been forgotten
+	floors map[string]uint64
+	// Where children were moved from, by directory, while that's their last
+	// change
+	moves map[string]map[string]string
+	// Closed and replaced on every change
+	notify   chan struct{}
+	watching bool
+	// Set while changes made by other instances can't be seen
+	blind bool
+	mut   *sync.Mutex
+}
+
+func newDirVersions() *dirVersions {
+	v := &dirVersions{
+		mut: &sync.Mutex{},
+	}
+	v.clear()
+	return v
+}
+
+// Must be called with the lock held.
+func (v *dirVersions) clear() {
+	v.epoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+	v.counts = make(map[string]uint64)
+	v.changes = make(map[string]map[string]uint64)
+	v.floors = make(map[string]uint64)
+	v.moves = make(map[string]map[string]string)
+	if v.notify != nil {
+		close(v.notify)
+	}
+	v.notify = make(chan struct{})
+}
+
+func dirVersionKey(reqPath string) string {
+	return path.Clean("/" + reqPath)
+}
+
+func (v *dirVersions) setWatching(watching bool) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	v.watching = watching
+}
+
+// Versions aren't handed out while blind, and all change once it's over.
+func (v *dirVersions) setBlind(blind bool) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	if v.blind && !blind {
+		v.clear()
+	}
+	v.blind = blind
+}
+
+// Changes every version, for when changes may have been missed.
+func (v *dirVersions) reset() {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	v.clear()
+}
+
+// Records a change to reqPath, which ends in a slash for directories,
+// bumping the version of every directory above it.
+func (v *dirVersions) changed(reqPath string) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	v.bump(reqPath)
+	v.notifyAll()
+}
+
+// Records that from was moved to reqPath, as a change to both.
+func (v *dirVersions) moved(from, reqPath string) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	v.bump(from)
+	dir, name := v.bump(reqPath)
+
+	moves := v.moves[dir]
+	if moves == nil {
+		moves = make(map[string]string)
+		v.moves[dir] = moves
+	}
+	moves[name] = from
+
+	v.notifyAll()
+}
+
+// Returns the directory and name the change was recorded under. Must be
+// called with the lock held.
+func (v *dirVersions) bump(reqPath string) (string, string) {
+	key := dirVersionKey(reqPath)
+
+	name := path.Base(key)
+	if strings.HasSuffix(reqPath, "/") {
+		name += "/"
+	}
+
+	parentDir := path.Dir(key)
+	delete(v.moves[parentDir], name)
+	parentName := name
+
+	for key != "/" {
+		dir := path.Dir(key)
+		v.counts[dir]++
+		v.record(dir, name)
+
+		name = path.Base(dir) + "/"
+		key = dir
+	}
+
+	return parentDir, parentName
+}
+
+// Must be called with the lock held.
+func (v *dirVersions) notifyAll() {
+	close(v.notify)
+	v.notify = make(chan struct{})
+}
+
+// Must be called with the lock held.
+func (v *dirVersions) record(dir, name string) {
+	changes := v.changes[dir]
+	if changes == nil {
+		changes = make(map[string]uint64)
+		v.changes[dir] = changes
+	}
+
+	changes[name] = v.counts[dir]
+
+	if len(changes) <= maxDirChanges {
+		return
+	}
+
+	// Forget the older half, so this doesn't happen on every change
+	counts := make([]uint64, 0, len(changes))
+	for _, count := range changes {
+		counts = append(counts, count)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+	floor := counts[len(counts)/2]
+
+	for name, count := range changes {
+		if count <= floor {
+			delete(changes, name)
+			delete(v.moves[dir], name)
+		}
+	}
+	v.floors[dir] = floor
+}
+
+// Must be called with the lock held.
+func (v *dirVersions) format(count uint64) string {
+	return fmt.Sprintf("%s.%d", v.epoch, count)
+}
+
+func (v *dirVersions) get(dirPath string) (string, error) {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	if !v.watching || v.blind {
+		return "", errNoDirVersion
+	}
+
+	return v.format(v.counts[dirVersionKey(dirPath)]), nil
+}
+
+func (v *dirVersions) changesSince(ctx context.Context, dirPath, since string) ([]string, string, error) {
+	key := dirVersionKey(dirPath)
+
+	for {
+		v.mut.Lock()
+
+		if !v.watching || v.blind {
+			v.mut.Unlock()
+			return nil, "", errNoDirVersion
+		}
+
+		count := v.counts[key]
+		version := v.format(count)
+
+		prefix := v.epoch + "."
+		sinceCount, err := strconv.ParseUint(strings.TrimPrefix(since, prefix), 10, 64)
+		if err != nil || !strings.HasPrefix(since, prefix) || sinceCount > count || sinceCount < v.floors[key] {
+			v.mut.Unlock()
+			return nil, "", errStaleGeneration
+		}
+
+		if sinceCount < count {
+			names := []string{}
+			for name, changed := range v.changes[key] {
+				if changed > sinceCount {
+					names = append(names, name)
+				}
+			}
+			v.mut.Unlock()
+
+			sort.Strings(names)
+			return names, version, nil
+		}
+
+		notify := v.notify
+		v.mut.Unlock()
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return []string{}, version, nil
+		}
+	}
+}
+
+func (v *dirVersions) movesOf(dirPath string, names []string) map[string]string {
+	v.mut.Lock()
+	defer v.mut.Unlock()
+
+	moves := make(map[string]string)
+	for _, name := range names {
+		from, exists := v.moves[dirVersionKey(dirPath)][name]
+		if exists {
+			moves[name] = from
+		}
+	}
+
+	return moves
+}
+
+func (fs *FileSystemBackend) DirVersion(reqPath string) (string, error) {
+	// Archives change without their contents being invalidated
+	if _, _, ok := fs.splitArchivePath(reqPath); ok {
+		return "", errNoDirVersion
+	}
+	return fs.versions.get(reqPath)
+}
+
+func (fs *FileSystemBackend) DirChanges(ctx context.Context, reqPath, since string) ([]string, string, error) {
+	if _, _, ok := fs.splitArchivePath(reqPath); ok {
+		return nil, "", errNoDirVersion
+	}
+	return fs.versions.changesSince(ctx, reqPath, since)
+}
+
+func (fs *FileSystemBackend) DirMoves(reqPath string, names []string) (map[string]string, error) {
+	if _, _, ok := fs.splitArchivePath(reqPath); ok {
+		return nil, errNoDirVersion
+	}
+	return fs.versions.movesOf(reqPath, names), nil
+}
+
+// Records that reqPath changed, dropping its parent's cached listing.
+func (fs *FileSystemBackend) itemChanged(reqPath string) {
+	fs.recordChange(reqPath)
+	fs.invalidateListing(path.Dir(dirVersionKey(reqPath)))
+}
+
+// Records that from was moved to reqPath, dropping both parents' cached
+// listings.
+func (fs *FileSystemBackend) itemMoved(from, reqPath string) {
+	fs.versions.moved(from, reqPath)
+	if fs.onChange != nil {
+		fs.onChange(reqPath, from)
+	}
+	fs.invalidateListing(path.Dir(dirVersionKey(from)))
+	fs.invalidateListing(path.Dir(dirVersionKey(reqPath)))
+}
+
+func (fs *FileSystemBackend) recordChange(reqPath string) {
+	fs.versions.changed(reqPath)
+	if fs.onChange != nil {
+		fs.onChange(reqPath, "")
+	}
+}
+
+// The ETag for a meta.json response for the given version. Different
+// queries (depth, paging) get different tags.
+func metaETag(r *http.Request, version string) string {
+	query := r.URL.Query()
+	query.Del("access_token")
+	queryHash := sha256.Sum256([]byte(query.Encode()))
+
+	return fmt.Sprintf(`"%s.%x"`, version, queryHash[:4])
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+const defaultChangesWait = 25 * time.Second
+const maxChangesWait = 60 * time.Second
+
+// Lists the children of dirPath changed since the given generation, with
+// removed ones as nulls, waiting up to the wait param for any.
+func (s *Server) listChanges(r *http.Request, dirPath, since string) (*Item, string, error) {
+	versioner, ok := s.backend.(DirVersioner)
+	if !ok {
+		return nil, "", &Error{
+			HttpCode: 501,
+			Message:  "Changes aren't tracked for this directory",
+		}
+	}
+
+	wait := defaultChangesWait
+	waitParam := r.URL.Query().Get("wait")
+	if waitParam != "" {
+		seconds, err := strconv.Atoi(waitParam)
+		if err != nil || seconds < 0 {
+			return nil, "", &Error{
+				HttpCode: 400,
+				Message:  "Invalid wait param",
+			}
+		}
+		wait = time.Duration(seconds) * time.Second
+		if wait > maxChangesWait {
+			wait = maxChangesWait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	names, version, err := versioner.DirChanges(ctx, dirPath, since)
+	if err == errNoDirVersion {
+		return nil, "", &Error{
+			HttpCode: 501,
+			Message:  "Changes aren't tracked for this directory",
+		}
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	item, err := s.requestBackend(r).List(dirPath, 1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	delta := &Item{
+		Size:    item.Size,
+		ModTime: item.ModTime,
+	}
+
+	moves := map[string]string{}
+	if tracker, ok := s.backend.(MoveTracker); ok && len(names) > 0 {
+		moves, err = tracker.DirMoves(dirPath, names)
+		if err != nil {
+			moves = map[string]string{}
+		}
+	}
+
+	if len(names) > 0 {
+		delta.Children = make(map[string]*Item)
+		for _, name := range names {
+			child := item.Children[name]
+			if from, moved := moves[name]; moved && child != nil {
+				// Listings may be cached, so the child isn't changed in place
+				movedChild := *child
+				movedChild.MovedFrom = from
+				child = &movedChild
+			}
+			delta.Children[name] = child
+		}
+	}
+
+	return delta, version, nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package gemdrive
+
+import (
+	"errors"
+	"os"
+)
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("Free space not available on this platform")
+}
+
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
+
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
+
+func punchHole(file *os.File, offset, length int64) error {
+	return errors.New("Hole punching not supported on this platform")
+}
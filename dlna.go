@@ -0,0 +1,619 @@
+package gemdrive
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small UPnP MediaServer, advertised over SSDP, that lets smart TVs and
+// other DLNA renderers browse the configured directories. Media is streamed
+// through the regular GET path, so ranged reads and thumbnails work as usual.
+// Renderers can't log in, so it's only served to private and link-local
+// addresses, and media links carry a token that can only read the configured
+// directories. It's replaced daily and revoked when the server stops.
+
+const ssdpAddr = "239.255.255.250:1900"
+
+const dlnaDeviceType = "urn:schemas-upnp-org:device:MediaServer:1"
+const dlnaContentDirectory = "urn:schemas-upnp-org:service:ContentDirectory:1"
+const dlnaConnectionManager = "urn:schemas-upnp-org:service:ConnectionManager:1"
+
+// Links from before the last rotation keep working until the next one, so
+// renderers can finish what they're playing.
+const dlnaMediaTokenLifetime = 24 * time.Hour
+
+type dlnaServer struct {
+	config  *DlnaConfig
+	port    int
+	uuid    string
+	backend Backend
+	auth    *Auth
+	// Current and previous media tokens
+	mediaTokens     []string
+	mediaTokensMade time.Time
+	mut             *sync.Mutex
+}
+
+type dlnaBrowseEnvelope struct {
+	Body struct {
+		Browse struct {
+			ObjectID       string
+			BrowseFlag     string
+			StartingIndex  int
+			RequestedCount int
+		}
+	}
+}
+
+func newDlnaServer(config *DlnaConfig, port int, backend Backend, auth *Auth) *dlnaServer {
+	hostname, _ := os.Hostname()
+	sum := md5.Sum([]byte(hostname + config.Name))
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+
+	return &dlnaServer{
+		config:  config,
+		port:    port,
+		uuid:    "uuid:" + uuid,
+		backend: backend,
+		auth:    auth,
+		mut:     &sync.Mutex{},
+	}
+}
+
+func (d *dlnaServer) Run(ctx context.Context) error {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+		d.revokeMediaTokens()
+	}()
+
+	go func() {
+		for {
+			d.notify("ssdp:alive")
+			select {
+			case <-time.After(60 * time.Second):
+			case <-ctx.Done():
+				d.notify("ssdp:byebye")
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 2048)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, "M-SEARCH") {
+			continue
+		}
+
+		st := ssdpHeader(msg, "ST")
+		for _, target := range d.searchTargets() {
+			if st != "ssdp:all" && st != target {
+				continue
+			}
+
+			usn := d.uuid
+			if target != d.uuid {
+				usn += "::" + target
+			}
+
+			resp := "HTTP/1.1 200 OK\r\n" +
+				"CACHE-CONTROL: max-age=1800\r\n" +
+				"EXT:\r\n" +
+				"LOCATION: " + d.location(remote.IP) + "\r\n" +
+				"SERVER: GemDrive UPnP/1.0\r\n" +
+				"ST: " + target + "\r\n" +
+				"USN: " + usn + "\r\n" +
+				"\r\n"
+
+			replyConn, err := net.DialUDP("udp4", nil, remote)
+			if err != nil {
+				continue
+			}
+			replyConn.Write([]byte(resp))
+			replyConn.Close()
+		}
+	}
+}
+
+func (d *dlnaServer) searchTargets() []string {
+	return []string{"upnp:rootdevice", d.uuid, dlnaDeviceType, dlnaContentDirectory, dlnaConnectionManager}
+}
+
+func (d *dlnaServer) notify(nts string) {
+	addr, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return
+	}
+
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for _, target := range d.searchTargets() {
+		usn := d.uuid
+		if target != d.uuid {
+			usn += "::" + target
+		}
+
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + ssdpAddr + "\r\n" +
+			"CACHE-CONTROL: max-age=1800\r\n" +
+			"LOCATION: " + d.location(addr.IP) + "\r\n" +
+			"NT: " + target + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"SERVER: GemDrive UPnP/1.0\r\n" +
+			"USN: " + usn + "\r\n" +
+			"\r\n"
+
+		conn.Write([]byte(msg))
+	}
+}
+
+// Picks the local address the OS would use to reach dest, since that's the
+// one the renderer will be able to connect back to.
+func (d *dlnaServer) location(dest net.IP) string {
+	localIp := "127.0.0.1"
+
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: dest, Port: 1900})
+	if err == nil {
+		localIp = conn.LocalAddr().(*net.UDPAddr).IP.String()
+		conn.Close()
+	}
+
+	return fmt.Sprintf("http://%s:%d/gemdrive/dlna/device.xml", localIp, d.port)
+}
+
+func (d *dlnaServer) ServeHTTP(w http.ResponseWriter, r *http.Request, dlnaReq string) {
+	w.Header().Set("Content-Type", "text/xml; charset=\"utf-8\"")
+
+	switch dlnaReq {
+	case "device.xml":
+		io.WriteString(w, d.deviceDescription())
+	case "cds.xml":
+		io.WriteString(w, dlnaContentDirectoryScpd)
+	case "cms.xml":
+		io.WriteString(w, dlnaConnectionManagerScpd)
+	case "control/cds":
+		d.handleContentDirectory(w, r)
+	case "control/cms":
+		action := soapAction(r)
+		if action != "GetProtocolInfo" {
+			w.WriteHeader(401)
+			io.WriteString(w, soapResponse(dlnaConnectionManager, action, ""))
+			return
+		}
+		io.WriteString(w, soapResponse(dlnaConnectionManager, action,
+			"<Source>http-get:*:*:*</Source><Sink></Sink>"))
+	default:
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+	}
+}
+
+func (d *dlnaServer) deviceDescription() string {
+	return `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>` + dlnaDeviceType + `</deviceType>
+    <friendlyName>` + xmlEscape(d.config.Name) + `</friendlyName>
+    <manufacturer>GemDrive</manufacturer>
+    <modelName>GemDrive</modelName>
+    <UDN>` + d.uuid + `</UDN>
+    <serviceList>
+      <service>
+        <serviceType>` + dlnaContentDirectory + `</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/gemdrive/dlna/cds.xml</SCPDURL>
+        <controlURL>/gemdrive/dlna/control/cds</controlURL>
+        <eventSubURL></eventSubURL>
+      </service>
+      <service>
+        <serviceType>` + dlnaConnectionManager + `</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ConnectionManager</serviceId>
+        <SCPDURL>/gemdrive/dlna/cms.xml</SCPDURL>
+        <controlURL>/gemdrive/dlna/control/cms</controlURL>
+        <eventSubURL></eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>`
+}
+
+func (d *dlnaServer) handleContentDirectory(w http.ResponseWriter, r *http.Request) {
+	action := soapAction(r)
+
+	switch action {
+	case "GetSystemUpdateID":
+		io.WriteString(w, soapResponse(dlnaContentDirectory, action, "<Id>1</Id>"))
+	case "GetSortCapabilities":
+		io.WriteString(w, soapResponse(dlnaContentDirectory, action, "<SortCaps></SortCaps>"))
+	case "GetSearchCapabilities":
+		io.WriteString(w, soapResponse(dlnaContentDirectory, action, "<SearchCaps></SearchCaps>"))
+	case "Browse":
+		var env dlnaBrowseEnvelope
+		err := xml.NewDecoder(r.Body).Decode(&env)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		browse := env.Body.Browse
+
+		if browse.StartingIndex < 0 {
+			w.WriteHeader(400)
+			return
+		}
+
+		objects, err := d.browse(browse.ObjectID, browse.BrowseFlag == "BrowseMetadata", r.Host)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, soapResponse(dlnaContentDirectory, action, ""))
+			return
+		}
+
+		total := len(objects)
+		start := browse.StartingIndex
+		if start > total {
+			start = total
+		}
+		end := total
+		if browse.RequestedCount > 0 && start+browse.RequestedCount < total {
+			end = start + browse.RequestedCount
+		}
+		objects = objects[start:end]
+
+		didl := `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" ` +
+			`xmlns:dc="http://purl.org/dc/elements/1.1/" ` +
+			`xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+			strings.Join(objects, "") +
+			`</DIDL-Lite>`
+
+		body := fmt.Sprintf("<Result>%s</Result><NumberReturned>%d</NumberReturned>"+
+			"<TotalMatches>%d</TotalMatches><UpdateID>1</UpdateID>",
+			xmlEscape(didl), len(objects), total)
+
+		io.WriteString(w, soapResponse(dlnaContentDirectory, action, body))
+	default:
+		w.WriteHeader(401)
+		io.WriteString(w, soapResponse(dlnaContentDirectory, action, ""))
+	}
+}
+
+// Object IDs are GemDrive paths, except the root which is always "0" per
+// the spec. Returns DIDL-Lite fragments for each object.
+func (d *dlnaServer) browse(objectId string, metadataOnly bool, host string) ([]string, error) {
+	if objectId == "0" {
+		if metadataOnly {
+			return []string{dlnaContainer("0", "-1", d.config.Name, len(d.config.Dirs))}, nil
+		}
+
+		objects := []string{}
+		for _, dir := range d.config.Dirs {
+			dirPath := strings.TrimSuffix(dir, "/") + "/"
+			objects = append(objects, dlnaContainer(dirPath, "0", path.Base(dirPath), 0))
+		}
+		return objects, nil
+	}
+
+	objectId, err := cleanPath(objectId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.isExported(objectId) || !d.auth.CanRead(d.config.Token, objectId) {
+		return nil, &Error{
+			HttpCode: 403,
+			Message:  "Forbidden",
+		}
+	}
+
+	if metadataOnly {
+		return []string{dlnaContainer(objectId, d.parentId(objectId), path.Base(objectId), 0)}, nil
+	}
+
+	listing, err := d.backend.List(objectId, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range listing.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	objects := []string{}
+	for _, name := range names {
+		child := listing.Children[name]
+		childPath := objectId + name
+
+		if strings.HasSuffix(name, "/") {
+			objects = append(objects, dlnaContainer(childPath, objectId, strings.TrimSuffix(name, "/"), 0))
+			continue
+		}
+
+		mimeType := mime.TypeByExtension(path.Ext(name))
+		upnpClass := ""
+		switch strings.Split(mimeType, "/")[0] {
+		case "video":
+			upnpClass = "object.item.videoItem"
+		case "audio":
+			upnpClass = "object.item.audioItem.musicTrack"
+		case "image":
+			upnpClass = "object.item.imageItem.photo"
+		default:
+			continue
+		}
+
+		obj := fmt.Sprintf(`<item id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>%s</upnp:class>`,
+			xmlEscape(childPath), xmlEscape(objectId), xmlEscape(name), upnpClass)
+
+		if upnpClass == "object.item.imageItem.photo" {
+			thumbUrl := d.mediaUrl(host, objectId+"gemdrive/images/256/"+name)
+			obj += fmt.Sprintf(`<upnp:albumArtURI>%s</upnp:albumArtURI>`, xmlEscape(thumbUrl))
+		}
+
+		obj += fmt.Sprintf(`<res protocolInfo="http-get:*:%s:DLNA.ORG_OP=01" size="%d">%s</res></item>`,
+			mimeType, child.Size, xmlEscape(d.mediaUrl(host, childPath)))
+
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+func (d *dlnaServer) isExported(p string) bool {
+	for _, dir := range d.config.Dirs {
+		if strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dlnaServer) parentId(p string) string {
+	for _, dir := range d.config.Dirs {
+		if strings.TrimSuffix(dir, "/")+"/" == p {
+			return "0"
+		}
+	}
+	return path.Dir(strings.TrimSuffix(p, "/")) + "/"
+}
+
+func (d *dlnaServer) mediaUrl(host, p string) string {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   host,
+		Path:   p,
+	}
+	if token := d.mediaToken(); token != "" {
+		u.RawQuery = "access_token=" + url.QueryEscape(token)
+	}
+	return u.String()
+}
+
+// A token for media links, made from the configured token's keys but only
+// able to read the configured directories.
+func (d *dlnaServer) mediaToken() string {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if len(d.mediaTokens) > 0 && time.Since(d.mediaTokensMade) < dlnaMediaTokenLifetime {
+		return d.mediaTokens[0]
+	}
+
+	keyring, err := d.auth.getKeyring(d.config.Token)
+	if err != nil {
+		return ""
+	}
+
+	mediaKeyring := []*Key{}
+	for _, key := range keyring {
+		if !permAllows(key.Perm, actRead) {
+			continue
+		}
+
+		for _, dir := range d.config.Dirs {
+			dirPath := strings.TrimSuffix(dir, "/") + "/"
+			if strings.HasPrefix(dirPath, key.Path) {
+				mediaKeyring = append(mediaKeyring, &Key{IdType: key.IdType, Id: key.Id, Perm: "read", Path: dirPath})
+			} else if strings.HasPrefix(key.Path, dirPath) {
+				mediaKeyring = append(mediaKeyring, &Key{IdType: key.IdType, Id: key.Id, Perm: "read", Path: key.Path})
+			}
+		}
+	}
+
+	if len(mediaKeyring) == 0 {
+		return ""
+	}
+
+	token, err := d.auth.AddEphemeralKeyring(mediaKeyring)
+	if err != nil {
+		fmt.Println("Failed to make DLNA media token:", err)
+		return ""
+	}
+
+	if len(d.mediaTokens) > 1 {
+		d.auth.RemoveEphemeralKeyring(d.mediaTokens[1])
+	}
+	if len(d.mediaTokens) > 0 {
+		d.mediaTokens = []string{token, d.mediaTokens[0]}
+	} else {
+		d.mediaTokens = []string{token}
+	}
+	d.mediaTokensMade = time.Now()
+
+	return token
+}
+
+func (d *dlnaServer) revokeMediaTokens() {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	for _, token := range d.mediaTokens {
+		d.auth.RemoveEphemeralKeyring(token)
+	}
+	d.mediaTokens = nil
+}
+
+// Renderers are on the local network. Loopback isn't counted, since that's
+// where reverse proxies, not renderers, connect from.
+func isLanIp(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	if ip.IsLinkLocalUnicast() {
+		return true
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4[0] == 10 ||
+			(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+			(ip4[0] == 192 && ip4[1] == 168)
+	}
+
+	// Unique local addresses, fc00::/7
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+func dlnaContainer(id, parentId, title string, childCount int) string {
+	return fmt.Sprintf(`<container id="%s" parentID="%s" restricted="1" childCount="%d"><dc:title>%s</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+		xmlEscape(id), xmlEscape(parentId), childCount, xmlEscape(title))
+}
+
+// SOAPACTION looks like "urn:schemas-upnp-org:service:ContentDirectory:1#Browse"
+func soapAction(r *http.Request) string {
+	action := strings.Trim(r.Header.Get("SOAPACTION"), "\"")
+	parts := strings.Split(action, "#")
+	return parts[len(parts)-1]
+}
+
+func soapResponse(serviceType, action, body string) string {
+	return `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + `Response xmlns:u="` + serviceType + `">` +
+		body +
+		`</u:` + action + `Response></s:Body></s:Envelope>`
+}
+
+func ssdpHeader(msg, name string) string {
+	for _, line := range strings.Split(msg, "\r\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), name) {
+			return strings.TrimSpace(parts[1])
+		}
+	}
+	return ""
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+const dlnaContentDirectoryScpd = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>Browse</name>
+      <argumentList>
+        <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+        <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+        <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+        <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+        <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+        <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+        <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+        <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSystemUpdateID</name>
+      <argumentList>
+        <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSortCapabilities</name>
+      <argumentList>
+        <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+    <action>
+      <name>GetSearchCapabilities</name>
+      <argumentList>
+        <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>`
+
+const dlnaConnectionManagerScpd = `<?xml version="1.0"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action>
+      <name>GetProtocolInfo</name>
+      <argumentList>
+        <argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>
+        <argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>
+      </argumentList>
+    </action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>`
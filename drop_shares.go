@@ -0,0 +1,248 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Drop shares let people without accounts send files into a directory. The
+// link's token can only create new files directly inside the shared
+// directory, within the share's limits. It can't list, read or replace
+// anything, so senders never see each other's files. If the share has a
+// notifyUrl, each upload is POSTed to it as a DropNotification. Whoever
+// creates the share picks the URL, so it mustn't reach anything on the
+// server's own network: it's checked when the share is created, and the
+// address is checked again when connecting, which covers redirects and
+// hosts resolving differently later.
+
+type DropOptions struct {
+	MaxSize    int64    `json:"maxSize,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+	NotifyUrl  string   `json:"notifyUrl,omitempty"`
+}
+
+type DropNotification struct {
+	ShareId    string `json:"shareId"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	ReceivedAt string `json:"receivedAt"`
+}
+
+const dropNotifyTimeout = 10 * time.Second
+
+// Loopback, private, link-local and other addresses that aren't on the
+// internet
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func publicIp(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkNotifyUrl(rawUrl string) error {
+	notifyUrl, err := url.Parse(rawUrl)
+	if err != nil || (notifyUrl.Scheme != "http" && notifyUrl.Scheme != "https") {
+		return errors.New("Invalid notifyUrl")
+	}
+
+	ips, err := net.LookupIP(notifyUrl.Hostname())
+	if err != nil {
+		return errors.New("Failed to resolve notifyUrl")
+	}
+
+	for _, ip := range ips {
+		if !publicIp(ip) {
+			return errors.New("notifyUrl must be a public address")
+		}
+	}
+
+	return nil
+}
+
+// Refuses to connect to anything but public addresses
+func newNotifyClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: dropNotifyTimeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !publicIp(ip) {
+				return errors.New("Not a public address: " + host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: dropNotifyTimeout,
+		Transport: &http.Transport{
+			DialContext: dialer.DialContext,
+		},
+	}
+}
+
+func (a *Auth) CreateDropShare(token, dirPath string, opts *DropOptions) (*Share, error) {
+	if !strings.HasSuffix(dirPath, "/") {
+		return nil, errors.New("Drop shares must be directories")
+	}
+
+	if opts == nil {
+		opts = &DropOptions{}
+	}
+
+	if opts.MaxSize < 0 {
+		return nil, errors.New("Invalid maxSize")
+	}
+
+	if opts.NotifyUrl != "" {
+		err := checkNotifyUrl(opts.NotifyUrl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	extensions := []string{}
+	for _, ext := range opts.Extensions {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+
+	drop := &DropOptions{
+		MaxSize:    opts.MaxSize,
+		Extensions: extensions,
+		NotifyUrl:  opts.NotifyUrl,
+	}
+
+	return a.createShare(token, dirPath, "drop", []string{actCreate}, drop)
+}
+
+// Returns the drop share token belongs to, if it allows dropping a file at
+// reqPath. Drops stop working if the share's creator can no longer create
+// files there.
+func (a *Auth) DropShare(token, reqPath string) *Share {
+	share, err := a.db.GetShareByToken(token)
+	if err != nil || share.Drop == nil {
+		return nil
+	}
+
+	parentDir, _ := splitItemPath(reqPath)
+	if parentDir != share.Path {
+		return nil
+	}
+
+	keyring, err := a.getKeyring(token)
+	if err != nil {
+		return nil
+	}
+
+	acl := a.GetAcl(reqPath)
+
+	for _, key := range keyring {
+		if key.Perm == "drop" && strings.HasPrefix(reqPath, key.Path) && acl.Allows(key.Id, actCreate) {
+			return share
+		}
+	}
+
+	return nil
+}
+
+func checkDrop(r *http.Request, reqPath string, drop *DropOptions) error {
+	if strings.HasSuffix(reqPath, "/") {
+		return &Error{
+			HttpCode: 403,
+			Message:  "Drop links can only upload files",
+		}
+	}
+
+	if r.Header.Get("Content-Range") != "" {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Drop links don't support chunked uploads",
+		}
+	}
+
+	if drop.MaxSize != 0 && r.ContentLength > drop.MaxSize {
+		return &Error{
+			HttpCode: 413,
+			Message:  "Upload exceeds the drop link's maximum size",
+		}
+	}
+
+	if len(drop.Extensions) != 0 && !sharesString(drop.Extensions, []string{strings.ToLower(path.Ext(reqPath))}) {
+		return &Error{
+			HttpCode: 400,
+			Message:  "File type not accepted",
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) notifyDrop(share *Share, reqPath string, size int64) {
+	fmt.Println("Received", reqPath, "through drop share", share.Id)
+
+	if share.Drop.NotifyUrl == "" {
+		return
+	}
+
+	notification := &DropNotification{
+		ShareId:    share.Id,
+		Path:       reqPath,
+		Size:       size,
+		ReceivedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	go func() {
+		jsonBody, err := json.Marshal(notification)
+		if err != nil {
+			fmt.Println("Failed to encode drop notification:", err)
+			return
+		}
+
+		res, err := newNotifyClient().Post(share.Drop.NotifyUrl, "application/json", bytes.NewReader(jsonBody))
+		if err != nil {
+			fmt.Println("Failed to send drop notification:", err)
+			return
+		}
+		res.Body.Close()
+
+		if res.StatusCode >= 300 {
+			fmt.Println("Drop notification rejected:", res.Status)
+		}
+	}()
+}
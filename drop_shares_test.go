@@ -0,0 +1,57 @@
+package gemdrive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotifyUrlMustBePublic(t *testing.T) {
+	for _, notifyUrl := range []string{
+		"http://localhost/hook",
+		"http://127.0.0.1/hook",
+		"http://127.1.2.3:8080/hook",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+		"http://10.1.2.3/hook",
+		"http://172.16.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[fe80::1]/hook",
+		"http://[fd00::1]/hook",
+		"http://[::ffff:192.168.1.1]/hook",
+		"file:///etc/passwd",
+	} {
+		if err := checkNotifyUrl(notifyUrl); err == nil {
+			t.Errorf("%s accepted", notifyUrl)
+		}
+	}
+
+	for _, notifyUrl := range []string{
+		"https://93.184.216.34/hook",
+		"http://[2606:2800:220:1:248:1893:25c8:1946]/hook",
+	} {
+		if err := checkNotifyUrl(notifyUrl); err != nil {
+			t.Errorf("%s rejected: %s", notifyUrl, err)
+		}
+	}
+}
+
+// Names can resolve differently by the time a notification is sent, and
+// public servers can redirect, so connections are checked too.
+func TestNotifyClientOnlyConnectsToPublicAddresses(t *testing.T) {
+	requests := 0
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer internal.Close()
+
+	res, err := newNotifyClient().Post(internal.URL, "application/json", nil)
+	if err == nil {
+		res.Body.Close()
+		t.Error("connected to", internal.URL)
+	}
+	if requests != 0 {
+		t.Error("internal server received a notification")
+	}
+}
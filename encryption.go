@@ -0,0 +1,93 @@
+package gemdrive
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Clients that encrypt files before uploading them can declare how, so
+// other clients know how to decrypt them and what size they really are.
+// The server never sees keys or plaintext; it only keeps what's declared as
+// attributes of the file, and hands it back as headers on GET and HEAD:
+//
+//	X-GemDrive-Encryption: the scheme, ie "age-v1" or "aes-256-gcm-chunked"
+//	X-GemDrive-Plaintext-Size: size of the file before encryption
+//	X-GemDrive-Key-Wrap: the file key wrapped for its readers, opaque to the server
+//
+// Every full upload replaces the declaration, or clears it if the headers
+// are missing, since they describe the contents. For ranged uploads they're
+// taken from the chunk that completes the upload, and for chunked upload
+// sessions from the finalize request.
+
+var encryptionHeaders = map[string]string{
+	"X-GemDrive-Encryption":     "encryption.scheme",
+	"X-GemDrive-Plaintext-Size": "encryption.plaintextSize",
+	"X-GemDrive-Key-Wrap":       "encryption.keyWrap",
+}
+
+func parseEncryptionHeaders(r *http.Request) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for header, attr := range encryptionHeaders {
+		if value := r.Header.Get(header); value != "" {
+			attrs[attr] = value
+		}
+	}
+
+	if len(attrs) == 0 {
+		return attrs, nil
+	}
+
+	if attrs["encryption.scheme"] == "" {
+		return nil, &Error{
+			HttpCode: 400,
+			Message:  "X-GemDrive-Encryption is required with other encryption headers",
+		}
+	}
+
+	if sizeStr, exists := attrs["encryption.plaintextSize"]; exists {
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || size < 0 {
+			return nil, &Error{
+				HttpCode: 400,
+				Message:  "Invalid X-GemDrive-Plaintext-Size",
+			}
+		}
+	}
+
+	return attrs, validateAttrs(attrs)
+}
+
+// Replaces reqPath's encryption attributes with declared, which may be
+// empty.
+func (s *Server) recordEncryption(reqPath string, declared map[string]string) error {
+	return s.attrs.update(reqPath, func(attrs map[string]string) map[string]string {
+		for key := range attrs {
+			if strings.HasPrefix(key, "encryption.") {
+				delete(attrs, key)
+			}
+		}
+		for key, value := range declared {
+			attrs[key] = value
+		}
+		return attrs
+	})
+}
+
+func (s *Server) setEncryptionHeaders(w http.ResponseWriter, reqPath string) {
+	attrs := s.attrs.get(reqPath)
+
+	header := w.Header()
+	exposed := []string{}
+	for name, attr := range encryptionHeaders {
+		if value, exists := attrs[attr]; exists {
+			header.Set(name, value)
+			exposed = append(exposed, name)
+		}
+	}
+
+	// So browser clients can read them cross-origin
+	if len(exposed) > 0 {
+		header.Add("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+	}
+}
@@ -0,0 +1,951 @@
+package gemdrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Erasure backends keep every file on all of their shards, split into
+// stripes of one data block per shard but the parity ones, which hold
+// Reed-Solomon parity of the others. Any shards but parity of them are
+// enough to read a file, so the mount survives losing that many. Each shard
+// has a file at the same path, holding its block of every stripe in turn.
+//
+// Real sizes are kept in a manifest in the data dir, ie
+// DataDir/erasure/<mount>/<dir>/gemdrive/stripes.json, along with shards
+// which missed writes while unreachable. Those are left out of reads until
+// the repair task has rebuilt what they missed, along with files missing
+// from shards or cut short. Repairs can be scheduled like other tasks, or
+// run and followed through gemdrive/admin/tasks.
+
+const erasureBlockSize = 64 * 1024
+
+// Stripes read or written per call to a shard
+const erasureBatchStripes = 16
+
+type ErasureBackendConfig struct {
+	// Every file is spread across all of them. Weights don't apply.
+	Shards []*ShardConfig `json:"shards,omitempty"`
+	// How many shards can be lost without losing files. Defaults to 1.
+	Parity int `json:"parity,omitempty"`
+}
+
+type erasureEntry struct {
+	Size int64 `json:"size"`
+	// Shards which missed writes to the file
+	Stale []string `json:"stale,omitempty"`
+}
+
+type ErasureBackend struct {
+	shards      []*shard
+	rs          *reedSolomon
+	manifestDir string
+	mut         *sync.Mutex
+	fileLocks   [64]sync.Mutex
+}
+
+func NewErasureBackend(config *ErasureBackendConfig, manifestDir, cacheDir string) (*ErasureBackend, error) {
+	parity := config.Parity
+	if parity == 0 {
+		parity = 1
+	}
+
+	if len(config.Shards) <= parity {
+		return nil, fmt.Errorf("Erasure backends need more than %d shards", parity)
+	}
+
+	rs, err := newReedSolomon(len(config.Shards)-parity, parity)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &ErasureBackend{
+		rs:          rs,
+		manifestDir: manifestDir,
+		mut:         &sync.Mutex{},
+	}
+
+	names := make(map[string]bool)
+	for _, shardConfig := range config.Shards {
+		name := shardConfig.Name
+		if name == "" || strings.ContainsAny(name, "/\\") {
+			return nil, fmt.Errorf("Invalid shard name '%s'", name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("Duplicate shard %s", name)
+		}
+		names[name] = true
+
+		backend, err := shardConfig.backend(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := backend.(WritableBackend); !ok {
+			return nil, fmt.Errorf("Shard %s isn't writable", name)
+		}
+
+		b.shards = append(b.shards, &shard{
+			name:    name,
+			backend: backend,
+		})
+	}
+
+	return b, nil
+}
+
+func (b *ErasureBackend) stripeSize() int64 {
+	return int64(b.rs.dataCount) * erasureBlockSize
+}
+
+func (b *ErasureBackend) stripeCount(size int64) int64 {
+	return (size + b.stripeSize() - 1) / b.stripeSize()
+}
+
+// Writes to a file are serialized, without holding up others.
+func (b *ErasureBackend) fileLock(reqPath string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(reqPath))
+	return &b.fileLocks[hash.Sum32()%uint32(len(b.fileLocks))]
+}
+
+func (b *ErasureBackend) entriesPath(dirPath string) string {
+	return filepath.Join(b.manifestDir, dirPath, "gemdrive", "stripes.json")
+}
+
+func (b *ErasureBackend) readEntries(dirPath string) map[string]*erasureEntry {
+	entries := make(map[string]*erasureEntry)
+
+	entriesJson, err := ioutil.ReadFile(b.entriesPath(dirPath))
+	if err != nil {
+		return entries
+	}
+
+	err = json.Unmarshal(entriesJson, &entries)
+	if err != nil {
+		fmt.Println("Ignoring invalid erasure manifest in", dirPath, err)
+		return make(map[string]*erasureEntry)
+	}
+
+	return entries
+}
+
+func (b *ErasureBackend) getEntry(reqPath string) *erasureEntry {
+	dirPath, name := splitItemPath(reqPath)
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	return b.readEntries(dirPath)[name]
+}
+
+// Replaces the entry for reqPath, or removes it if entry is nil.
+func (b *ErasureBackend) setEntry(reqPath string, entry *erasureEntry) error {
+	dirPath, name := splitItemPath(reqPath)
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	entries := b.readEntries(dirPath)
+	if entry == nil {
+		if _, exists := entries[name]; !exists {
+			return nil
+		}
+		delete(entries, name)
+	} else {
+		entries[name] = entry
+	}
+
+	entriesPath := b.entriesPath(dirPath)
+
+	if len(entries) == 0 {
+		err := os.Remove(entriesPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(entriesPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return saveJson(entries, entriesPath)
+}
+
+// Reads count stripes from first on, returning each shard's blocks of them
+// back to back. Shards in skip, and those stale for the file, are rebuilt
+// from the rest.
+func (b *ErasureBackend) readBlocks(reqPath string, entry *erasureEntry, first, count int64, skip map[int]bool) ([][]byte, error) {
+	stale := make(map[string]bool)
+	for _, name := range entry.Stale {
+		stale[name] = true
+	}
+
+	blocks := make([][]byte, len(b.shards))
+	found := 0
+	var lastErr error
+
+	for i, s := range b.shards {
+		if found == b.rs.dataCount {
+			break
+		}
+		if skip[i] || stale[s.name] {
+			continue
+		}
+
+		span := make([]byte, count*erasureBlockSize)
+		_, data, err := s.backend.Read(reqPath, first*erasureBlockSize, int64(len(span)))
+		if err == nil {
+			_, err = io.ReadFull(data, span)
+			data.Close()
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		blocks[i] = span
+		found++
+	}
+
+	if found < b.rs.dataCount {
+		fmt.Println("Too few shards readable for", reqPath+":", lastErr)
+		return nil, &Error{
+			HttpCode: 503,
+			Message:  "Too many shards unavailable",
+		}
+	}
+
+	err := b.rs.reconstruct(blocks)
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+// Reads count stripes from first on, as the file's bytes.
+func (b *ErasureBackend) readStripes(reqPath string, entry *erasureEntry, first, count int64, skip map[int]bool) ([]byte, error) {
+	blocks, err := b.readBlocks(reqPath, entry, first, count, skip)
+	if err != nil {
+		return nil, err
+	}
+
+	stripeSize := b.stripeSize()
+	data := make([]byte, count*stripeSize)
+	for stripe := int64(0); stripe < count; stripe++ {
+		for i := 0; i < b.rs.dataCount; i++ {
+			block := blocks[i][stripe*erasureBlockSize : (stripe+1)*erasureBlockSize]
+			copy(data[stripe*stripeSize+int64(i)*erasureBlockSize:], block)
+		}
+	}
+
+	return data, nil
+}
+
+// Splits whole stripes of a file's bytes into each shard's blocks, parity
+// included.
+func (b *ErasureBackend) encodeStripes(data []byte) [][]byte {
+	stripeSize := b.stripeSize()
+	count := int64(len(data)) / stripeSize
+
+	blocks := make([][]byte, len(b.shards))
+	for i := range blocks {
+		blocks[i] = make([]byte, count*erasureBlockSize)
+	}
+
+	for stripe := int64(0); stripe < count; stripe++ {
+		for i := 0; i < b.rs.dataCount; i++ {
+			start := stripe*stripeSize + int64(i)*erasureBlockSize
+			copy(blocks[i][stripe*erasureBlockSize:], data[start:start+erasureBlockSize])
+		}
+	}
+
+	b.rs.encode(blocks)
+
+	return blocks
+}
+
+func (b *ErasureBackend) List(reqPath string, depth int) (*Item, error) {
+	items := make(map[string]*Item)
+	var lastErr error
+
+	for _, s := range b.shards {
+		item, err := s.backend.List(reqPath, depth)
+		if err != nil {
+			if !isNotFound(err) {
+				lastErr = err
+			}
+			continue
+		}
+		items[s.name] = item
+	}
+
+	if len(items) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	return b.mergeItems(strings.TrimSuffix(reqPath, "/")+"/", items), nil
+}
+
+// Merges the listings of a directory from each shard, by shard name, with
+// the sizes of files from the manifest. Files it doesn't have are still
+// being written, or weren't written here.
+func (b *ErasureBackend) mergeItems(dirPath string, items map[string]*Item) *Item {
+	merged := &Item{}
+
+	b.mut.Lock()
+	entries := b.readEntries(dirPath)
+	b.mut.Unlock()
+
+	subdirs := make(map[string]map[string]*Item)
+
+	for _, s := range b.shards {
+		item, exists := items[s.name]
+		if !exists {
+			continue
+		}
+
+		if item.ModTime > merged.ModTime {
+			merged.ModTime = item.ModTime
+		}
+
+		if item.Children == nil {
+			continue
+		}
+		if merged.Children == nil {
+			merged.Children = make(map[string]*Item)
+		}
+
+		for name, child := range item.Children {
+			if strings.HasSuffix(name, "/") {
+				if subdirs[name] == nil {
+					subdirs[name] = make(map[string]*Item)
+				}
+				subdirs[name][s.name] = child
+				continue
+			}
+
+			entry, exists := entries[name]
+			if !exists {
+				continue
+			}
+
+			if existing, exists := merged.Children[name]; exists && existing.ModTime >= child.ModTime {
+				continue
+			}
+			merged.Children[name] = &Item{
+				Size:         entry.Size,
+				ModTime:      child.ModTime,
+				IsExecutable: child.IsExecutable,
+			}
+		}
+	}
+
+	for name, subdirItems := range subdirs {
+		merged.Children[name] = b.mergeItems(dirPath+name, subdirItems)
+	}
+
+	return merged
+}
+
+func (b *ErasureBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	entry := b.getEntry(reqPath)
+	if entry == nil {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	end := entry.Size
+	if length > 0 && offset+length < end {
+		end = offset + length
+	}
+
+	reader := &erasureReader{
+		backend: b,
+		path:    reqPath,
+		entry:   entry,
+		pos:     offset,
+		end:     end,
+	}
+
+	return &Item{Size: entry.Size}, reader, nil
+}
+
+type erasureReader struct {
+	backend *ErasureBackend
+	path    string
+	entry   *erasureEntry
+	pos     int64
+	end     int64
+	buf     []byte
+}
+
+func (r *erasureReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.pos >= r.end {
+			return 0, io.EOF
+		}
+
+		stripeSize := r.backend.stripeSize()
+		first := r.pos / stripeSize
+		count := r.backend.stripeCount(r.end) - first
+		if count > erasureBatchStripes {
+			count = erasureBatchStripes
+		}
+
+		data, err := r.backend.readStripes(r.path, r.entry, first, count, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		start := first * stripeSize
+		to := int64(len(data))
+		if r.end-start < to {
+			to = r.end - start
+		}
+		r.buf = data[r.pos-start : to]
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.pos += int64(n)
+
+	return n, nil
+}
+
+func (r *erasureReader) Close() error {
+	return nil
+}
+
+// Runs op on every shard, returning the shards it failed on. It's an error
+// for more than parity of them to fail.
+func (b *ErasureBackend) eachShard(reqPath string, op func(backend WritableBackend) error) (map[int]bool, error) {
+	failed := make(map[int]bool)
+	var lastErr error
+
+	for i, s := range b.shards {
+		err := op(s.backend.(WritableBackend))
+		if err != nil {
+			fmt.Println("Shard", s.name, "failed for", reqPath+":", err)
+			failed[i] = true
+			lastErr = err
+		}
+	}
+
+	if len(failed) > b.rs.parityCount {
+		return failed, lastErr
+	}
+
+	return failed, nil
+}
+
+func (b *ErasureBackend) MakeDir(reqPath string, recursive bool) error {
+	dirPath := strings.TrimSuffix(reqPath, "/") + "/"
+
+	_, err := b.List(dirPath, 1)
+	if err == nil {
+		if recursive {
+			return nil
+		}
+		return errors.New("Directory exists")
+	}
+
+	if !recursive {
+		parent, _ := splitItemPath(dirPath)
+		_, err := b.List(parent, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = b.eachShard(dirPath, func(backend WritableBackend) error {
+		return backend.MakeDir(dirPath, true)
+	})
+	return err
+}
+
+func (b *ErasureBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
+	lock := b.fileLock(reqPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := b.getEntry(reqPath)
+	if entry != nil && !overwrite {
+		return &Error{
+			HttpCode: 409,
+			Message:  "File exists",
+		}
+	}
+
+	dirPath, _ := splitItemPath(reqPath)
+	_, err := b.List(dirPath, 1)
+	if err != nil {
+		return err
+	}
+
+	var oldSize int64
+	stale := make(map[string]bool)
+	if entry != nil && !truncate {
+		oldSize = entry.Size
+		for _, name := range entry.Stale {
+			stale[name] = true
+		}
+	}
+
+	end := offset + length
+	newSize := end
+	if oldSize > newSize {
+		newSize = oldSize
+	}
+
+	stripeSize := b.stripeSize()
+	first := offset / stripeSize
+	if truncate {
+		first = 0
+	}
+	last := b.stripeCount(end)
+
+	failed, err := b.eachShard(reqPath, func(backend WritableBackend) error {
+		return backend.MakeDir(dirPath, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	for batch := first; batch < last; batch += erasureBatchStripes {
+		count := last - batch
+		if count > erasureBatchStripes {
+			count = erasureBatchStripes
+		}
+
+		start := batch * stripeSize
+		buf := make([]byte, count*stripeSize)
+
+		// Stripes only partly written keep the rest of their bytes
+		partial := start < offset || start+int64(len(buf)) > end
+		if partial && start < oldSize {
+			oldCount := b.stripeCount(oldSize) - batch
+			if oldCount > count {
+				oldCount = count
+			}
+
+			old, err := b.readStripes(reqPath, entry, batch, oldCount, failed)
+			if err != nil {
+				return err
+			}
+			copy(buf, old)
+		}
+
+		from := offset - start
+		if from < 0 {
+			from = 0
+		}
+		to := end - start
+		if to > int64(len(buf)) {
+			to = int64(len(buf))
+		}
+
+		_, err := io.ReadFull(data, buf[from:to])
+		if err != nil {
+			return err
+		}
+
+		blocks := b.encodeStripes(buf)
+
+		for i, s := range b.shards {
+			if failed[i] {
+				continue
+			}
+
+			backend := s.backend.(WritableBackend)
+			err := backend.Write(reqPath, bytes.NewReader(blocks[i]), batch*erasureBlockSize, int64(len(blocks[i])), true, truncate && batch == first)
+			if err != nil {
+				fmt.Println("Shard", s.name, "failed for", reqPath+":", err)
+				failed[i] = true
+			}
+		}
+
+		if len(failed) > b.rs.parityCount {
+			return &Error{
+				HttpCode: 503,
+				Message:  "Too many shards unavailable",
+			}
+		}
+	}
+
+	for i := range failed {
+		stale[b.shards[i].name] = true
+	}
+
+	newEntry := &erasureEntry{
+		Size: newSize,
+	}
+	for name := range stale {
+		newEntry.Stale = append(newEntry.Stale, name)
+	}
+	sort.Strings(newEntry.Stale)
+
+	return b.setEntry(reqPath, newEntry)
+}
+
+func (b *ErasureBackend) Delete(reqPath string, recursive bool) error {
+	lock := b.fileLock(reqPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !strings.HasSuffix(reqPath, "/") {
+		if b.getEntry(reqPath) == nil {
+			return &Error{
+				HttpCode: 404,
+				Message:  "Not found",
+			}
+		}
+
+		_, err := b.eachShard(reqPath, func(backend WritableBackend) error {
+			err := backend.Delete(reqPath, false)
+			if isNotFound(err) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		return b.setEntry(reqPath, nil)
+	}
+
+	item, err := b.List(reqPath, 1)
+	if err != nil {
+		return err
+	}
+	if !recursive && len(item.Children) != 0 {
+		return errors.New("Directory not empty")
+	}
+
+	_, err = b.eachShard(reqPath, func(backend WritableBackend) error {
+		err := backend.Delete(reqPath, true)
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	return os.RemoveAll(filepath.Join(b.manifestDir, reqPath))
+}
+
+func (b *ErasureBackend) Move(srcPath, dstPath string) error {
+	srcIsDir := strings.HasSuffix(srcPath, "/")
+	srcPath = strings.TrimSuffix(srcPath, "/")
+	dstPath = strings.TrimSuffix(dstPath, "/")
+
+	var entry *erasureEntry
+	if srcIsDir {
+		_, err := b.List(srcPath+"/", 1)
+		if err != nil {
+			return err
+		}
+	} else {
+		entry = b.getEntry(srcPath)
+		if entry == nil {
+			return &Error{
+				HttpCode: 404,
+				Message:  "Not found",
+			}
+		}
+	}
+
+	_, err := b.List(dstPath+"/", 1)
+	if err == nil || b.getEntry(dstPath) != nil {
+		return &Error{
+			HttpCode: 409,
+			Message:  "Destination exists",
+		}
+	}
+
+	dstDir, _ := splitItemPath(dstPath)
+	_, err = b.List(dstDir, 1)
+	if err != nil {
+		return err
+	}
+
+	// Shards which miss the move are missing the file at its new path, for
+	// the repair task to rebuild
+	_, err = b.eachShard(srcPath, func(backend WritableBackend) error {
+		mover, ok := backend.(MovableBackend)
+		if !ok {
+			return errors.New("Shard does not support moving")
+		}
+
+		err := mover.Move(srcPath, dstPath)
+		if isNotFound(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if srcIsDir {
+		b.mut.Lock()
+		defer b.mut.Unlock()
+
+		srcManifest := filepath.Join(b.manifestDir, srcPath)
+		dstManifest := filepath.Join(b.manifestDir, dstPath)
+		if _, err := os.Stat(srcManifest); err == nil {
+			err := os.MkdirAll(filepath.Dir(dstManifest), 0755)
+			if err != nil {
+				return err
+			}
+			return os.Rename(srcManifest, dstManifest)
+		}
+		return nil
+	}
+
+	err = b.setEntry(dstPath, entry)
+	if err != nil {
+		return err
+	}
+	return b.setEntry(srcPath, nil)
+}
+
+// Files take a share of their size on every shard, so the fullest one
+// decides.
+func (b *ErasureBackend) FreeSpace(reqPath string) (int64, error) {
+	var least int64 = -1
+	for _, s := range b.shards {
+		reporter, ok := s.backend.(SpaceReporter)
+		if !ok {
+			return 0, errors.New("Shards do not report free space")
+		}
+
+		free, err := reporter.FreeSpace(reqPath)
+		if err != nil {
+			return 0, err
+		}
+		if least < 0 || free < least {
+			least = free
+		}
+	}
+
+	return least * int64(b.rs.dataCount), nil
+}
+
+func (b *ErasureBackend) LocalDirs() ([]string, []string) {
+	return shardLocalDirs(b.shards)
+}
+
+// Rebuilds the blocks of every file which shards are missing, or which went
+// stale while they were unreachable. Returns how many files were checked
+// and repaired, and those which couldn't be.
+func (b *ErasureBackend) Repair(ctx context.Context) (int, int, []string, error) {
+	checked := 0
+	repaired := 0
+	failures := []string{}
+
+	err := filepath.Walk(b.manifestDir, func(p string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() || info.Name() != "stripes.json" || filepath.Base(filepath.Dir(p)) != "gemdrive" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.manifestDir, filepath.Dir(filepath.Dir(p)))
+		if err != nil {
+			return err
+		}
+		dirPath := "/"
+		if rel != "." {
+			dirPath = "/" + filepath.ToSlash(rel) + "/"
+		}
+
+		b.mut.Lock()
+		entries := b.readEntries(dirPath)
+		b.mut.Unlock()
+
+		// Shards' listings, or nil for those which couldn't be listed
+		listings := make([]*Item, len(b.shards))
+		for i, s := range b.shards {
+			item, err := s.backend.List(dirPath, 1)
+			if err == nil {
+				listings[i] = item
+			} else if isNotFound(err) {
+				listings[i] = &Item{}
+			} else {
+				fmt.Println("Can't repair", dirPath, "on shard", s.name+":", err)
+			}
+		}
+
+		names := []string{}
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			checked++
+
+			ok, err := b.repairFile(dirPath+name, listings)
+			if err != nil {
+				fmt.Println("Failed to repair", dirPath+name+":", err)
+				failures = append(failures, dirPath+name)
+			} else if ok {
+				repaired++
+			}
+		}
+
+		return nil
+	})
+
+	return checked, repaired, failures, err
+}
+
+// Rebuilds what the shards are missing of one file, given their listings of
+// its directory, reporting whether anything was.
+func (b *ErasureBackend) repairFile(reqPath string, listings []*Item) (bool, error) {
+	lock := b.fileLock(reqPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := b.getEntry(reqPath)
+	if entry == nil {
+		return false, nil
+	}
+
+	stale := make(map[string]bool)
+	for _, name := range entry.Stale {
+		stale[name] = true
+	}
+
+	dirPath, name := splitItemPath(reqPath)
+	stripes := b.stripeCount(entry.Size)
+	shardSize := stripes * erasureBlockSize
+
+	broken := make(map[int]bool)
+	unreachable := []string{}
+	for i, s := range b.shards {
+		if listings[i] == nil {
+			unreachable = append(unreachable, s.name)
+			continue
+		}
+
+		child := listings[i].Children[name]
+		if stale[s.name] || child == nil || child.Size != shardSize {
+			broken[i] = true
+		}
+	}
+
+	if len(broken) == 0 {
+		if len(unreachable) > 0 {
+			return false, fmt.Errorf("Shards unreachable: %s", strings.Join(unreachable, ", "))
+		}
+		return false, nil
+	}
+
+	// Shards left out of reads, so nothing is rebuilt from stale blocks
+	skip := make(map[int]bool)
+	for i, listing := range listings {
+		if listing == nil || broken[i] {
+			skip[i] = true
+		}
+	}
+
+	for i := range broken {
+		err := b.shards[i].backend.(WritableBackend).MakeDir(dirPath, true)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	readEntry := &erasureEntry{Size: entry.Size}
+
+	for batch := int64(0); batch < stripes; batch += erasureBatchStripes {
+		count := stripes - batch
+		if count > erasureBatchStripes {
+			count = erasureBatchStripes
+		}
+
+		blocks, err := b.readBlocks(reqPath, readEntry, batch, count, skip)
+		if err != nil {
+			return false, err
+		}
+
+		for i := range broken {
+			backend := b.shards[i].backend.(WritableBackend)
+			err := backend.Write(reqPath, bytes.NewReader(blocks[i]), batch*erasureBlockSize, int64(len(blocks[i])), true, batch == 0)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	repairedEntry := &erasureEntry{
+		Size: entry.Size,
+	}
+	for _, s := range entry.Stale {
+		if !broken[b.shardIndex(s)] {
+			repairedEntry.Stale = append(repairedEntry.Stale, s)
+		}
+	}
+
+	err := b.setEntry(reqPath, repairedEntry)
+	if err != nil {
+		return false, err
+	}
+
+	if len(unreachable) > 0 {
+		return true, fmt.Errorf("Shards unreachable: %s", strings.Join(unreachable, ", "))
+	}
+
+	return true, nil
+}
+
+func (b *ErasureBackend) shardIndex(name string) int {
+	for i, s := range b.shards {
+		if s.name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,227 @@
+package gemdrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exec backends hand every operation to an external program, so storage
+// GemDrive knows nothing about can be bridged with a shell script. The
+// program is run once per operation, with the operation and its arguments
+// appended to the configured command:
+//
+//   list <path> <depth>     print the directory as meta.json would
+//   read <path> <offset> <length>
+//                           print the file's bytes. A length of 0 means to
+//                           the end.
+//   write <path> <offset> <length> <overwrite> <truncate>
+//                           store the bytes on stdin. Flags are true or
+//                           false.
+//   mkdir <path> <recursive>
+//   delete <path> <recursive>
+//
+// Paths are relative to the mount, and directories end in a slash. A
+// non-zero exit is a failure, with stderr as the message. Messages starting
+// with an HTTP status, ie "404 Not found", are returned with that status,
+// so programs can answer 501 for operations they don't support.
+
+const defaultExecTimeout = 30 * time.Second
+
+type ExecBackendConfig struct {
+	// Program and leading arguments
+	Command []string `json:"command,omitempty"`
+	// For everything but the data of reads and writes. Defaults to 30.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+type ExecBackend struct {
+	command []string
+	timeout time.Duration
+}
+
+func NewExecBackend(config *ExecBackendConfig) (*ExecBackend, error) {
+	if len(config.Command) == 0 {
+		return nil, errors.New("Exec backends need a command")
+	}
+
+	timeout := defaultExecTimeout
+	if config.TimeoutSeconds > 0 {
+		timeout = time.Duration(config.TimeoutSeconds) * time.Second
+	}
+
+	return &ExecBackend{
+		command: config.Command,
+		timeout: timeout,
+	}, nil
+}
+
+func (b *ExecBackend) cmd(ctx context.Context, args ...string) *exec.Cmd {
+	args = append(append([]string{}, b.command[1:]...), args...)
+	return exec.CommandContext(ctx, b.command[0], args...)
+}
+
+// Runs an operation to completion, returning its output.
+func (b *ExecBackend) run(stdin io.Reader, timeout bool, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+	}
+
+	cmd := b.cmd(ctx, args...)
+	cmd.Stdin = stdin
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, &Error{
+			HttpCode: 504,
+			Message:  args[0] + " timed out",
+		}
+	} else if err != nil {
+		return nil, execError(err, stderr.String())
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// Turns a failed run into an Error, taking the status from the start of
+// stderr if it has one.
+func execError(err error, stderr string) error {
+	message := strings.TrimSpace(stderr)
+	if message == "" {
+		message = err.Error()
+	}
+
+	code := 500
+	if len(message) >= 3 {
+		status, convErr := strconv.Atoi(message[:3])
+		if convErr == nil && status >= 400 && status < 600 && (len(message) == 3 || message[3] == ' ') {
+			code = status
+			message = strings.TrimSpace(message[3:])
+		}
+	}
+
+	return &Error{
+		HttpCode: code,
+		Message:  message,
+	}
+}
+
+func (b *ExecBackend) List(reqPath string, maxDepth int) (*Item, error) {
+	output, err := b.run(nil, true, "list", reqPath, strconv.Itoa(maxDepth))
+	if err != nil {
+		return nil, err
+	}
+
+	var item *Item
+	err = json.Unmarshal(output, &item)
+	if err != nil || item == nil {
+		return nil, errors.New("Exec backend returned an invalid listing")
+	}
+
+	return item, nil
+}
+
+func (b *ExecBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	parentDir, filename := path.Split(reqPath)
+
+	parent, err := b.List(parentDir, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	item, exists := parent.Children[filename]
+	if !exists {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cmd := b.cmd(ctx, "read", reqPath, strconv.FormatInt(offset, 10), strconv.FormatInt(length, 10))
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	return item, &execReader{
+		cmd:    cmd,
+		stdout: stdout,
+		stderr: stderr,
+		cancel: cancel,
+	}, nil
+}
+
+// Streams a read's output, turning a failed exit into an error rather than
+// a short file.
+type execReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr *bytes.Buffer
+	cancel context.CancelFunc
+	done   bool
+}
+
+func (r *execReader) Read(p []byte) (int, error) {
+	n, err := r.stdout.Read(p)
+	if err == io.EOF && !r.done {
+		r.done = true
+		waitErr := r.cmd.Wait()
+		if waitErr != nil {
+			return n, execError(waitErr, r.stderr.String())
+		}
+	}
+	return n, err
+}
+
+func (r *execReader) Close() error {
+	r.cancel()
+	if !r.done {
+		r.done = true
+		r.cmd.Wait()
+	}
+	return nil
+}
+
+func (b *ExecBackend) MakeDir(reqPath string, recursive bool) error {
+	_, err := b.run(nil, true, "mkdir", reqPath, strconv.FormatBool(recursive))
+	return err
+}
+
+func (b *ExecBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
+	_, err := b.run(data, false, "write", reqPath,
+		strconv.FormatInt(offset, 10), strconv.FormatInt(length, 10),
+		strconv.FormatBool(overwrite), strconv.FormatBool(truncate))
+	return err
+}
+
+func (b *ExecBackend) Delete(reqPath string, recursive bool) error {
+	_, err := b.run(nil, true, "delete", reqPath, strconv.FormatBool(recursive))
+	return err
+}
@@ -0,0 +1,204 @@
+package gemdrive
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Just enough of an EXIF parser to pull the capture date and orientation out
+// of JPEG files, without pulling in a dependency.
+
+type exifData struct {
+	DateTimeOriginal time.Time
+	Orientation      int
+}
+
+const (
+	exifTagOrientation      = 0x0112
+	exifTagExifIfdPointer   = 0x8769
+	exifTagDateTimeOriginal = 0x9003
+	exifTagDateTime         = 0x0132
+)
+
+func readExif(reader io.Reader) (*exifData, error) {
+	r := bufio.NewReader(reader)
+
+	var soi [2]byte
+	_, err := io.ReadFull(r, soi[:])
+	if err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, errors.New("Not a JPEG file")
+	}
+
+	for {
+		var marker [4]byte
+		_, err := io.ReadFull(r, marker[:])
+		if err != nil {
+			return nil, err
+		}
+
+		if marker[0] != 0xff {
+			return nil, errors.New("Invalid JPEG marker")
+		}
+
+		// Start of scan means we're past all the metadata segments
+		if marker[1] == 0xda {
+			return nil, errors.New("No EXIF data")
+		}
+
+		segmentLen := int(binary.BigEndian.Uint16(marker[2:4])) - 2
+		if segmentLen < 0 {
+			return nil, errors.New("Invalid JPEG segment")
+		}
+
+		if marker[1] != 0xe1 {
+			_, err = io.CopyN(ioutil.Discard, r, int64(segmentLen))
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		segment := make([]byte, segmentLen)
+		_, err = io.ReadFull(r, segment)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(segment) < 6 || string(segment[:6]) != "Exif\x00\x00" {
+			continue
+		}
+
+		return parseTiff(segment[6:])
+	}
+}
+
+func parseTiff(tiff []byte) (*exifData, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("Invalid TIFF header")
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("Invalid TIFF byte order")
+	}
+
+	data := &exifData{}
+
+	ifd0 := order.Uint32(tiff[4:8])
+	tags, err := readIfd(tiff, order, ifd0)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := tags[exifTagOrientation]; ok {
+		data.Orientation = int(v.uint16(order))
+	}
+
+	dateStr := ""
+	if v, ok := tags[exifTagDateTime]; ok {
+		dateStr = v.ascii()
+	}
+
+	if v, ok := tags[exifTagExifIfdPointer]; ok {
+		exifTags, err := readIfd(tiff, order, v.uint32(order))
+		if err == nil {
+			if v, ok := exifTags[exifTagDateTimeOriginal]; ok {
+				dateStr = v.ascii()
+			}
+		}
+	}
+
+	if dateStr != "" {
+		t, err := time.Parse("2006:01:02 15:04:05", dateStr)
+		if err == nil {
+			data.DateTimeOriginal = t
+		}
+	}
+
+	return data, nil
+}
+
+type tiffValue struct {
+	valueType uint16
+	raw       []byte
+}
+
+func (v tiffValue) uint16(order binary.ByteOrder) uint16 {
+	if len(v.raw) < 2 {
+		return 0
+	}
+	return order.Uint16(v.raw)
+}
+
+func (v tiffValue) uint32(order binary.ByteOrder) uint32 {
+	if len(v.raw) < 4 {
+		return 0
+	}
+	if v.valueType == 3 {
+		return uint32(order.Uint16(v.raw))
+	}
+	return order.Uint32(v.raw)
+}
+
+func (v tiffValue) ascii() string {
+	return strings.TrimRight(string(v.raw), "\x00 ")
+}
+
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8,
+}
+
+func readIfd(tiff []byte, order binary.ByteOrder, offset uint32) (map[uint16]tiffValue, error) {
+	if int(offset)+2 > len(tiff) {
+		return nil, errors.New("Invalid IFD offset")
+	}
+
+	count := int(order.Uint16(tiff[offset:]))
+	tags := make(map[uint16]tiffValue)
+
+	for i := 0; i < count; i++ {
+		entryOffset := int(offset) + 2 + i*12
+		if entryOffset+12 > len(tiff) {
+			return nil, errors.New("Truncated IFD")
+		}
+
+		entry := tiff[entryOffset : entryOffset+12]
+		tag := order.Uint16(entry[0:2])
+		valueType := order.Uint16(entry[2:4])
+		numValues := order.Uint32(entry[4:8])
+
+		typeSize, ok := tiffTypeSizes[valueType]
+		if !ok {
+			continue
+		}
+
+		size := typeSize * numValues
+		var raw []byte
+		if size <= 4 {
+			raw = entry[8 : 8+size]
+		} else {
+			valueOffset := order.Uint32(entry[8:12])
+			if uint64(valueOffset)+uint64(size) > uint64(len(tiff)) {
+				continue
+			}
+			raw = tiff[valueOffset : valueOffset+size]
+		}
+
+		tags[tag] = tiffValue{valueType, raw}
+	}
+
+	return tags, nil
+}
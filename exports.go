@@ -0,0 +1,50 @@
+package gemdrive
+
+import (
+	"strings"
+)
+
+// Per-export options, keyed by mount name, ie the base name of the dir:
+//
+//	"exports": {"site": {"noAutoIndex": true}, "private": {"noRawAccess": true}}
+//
+// They can be given in the mount's own entry in mounts instead.
+type ExportConfig struct {
+	// Don't serve a directory's index.html for the directory itself, for
+	// exports only used through the API
+	NoAutoIndex bool `json:"noAutoIndex,omitempty"`
+	// Only serve file contents through share links, never to the tokens of
+	// logged in users, even with read permission
+	NoRawAccess bool `json:"noRawAccess,omitempty"`
+	// How names of new files and directories are normalized: nfc, ascii,
+	// percent or raw. Defaults to nfc.
+	FileNames string `json:"fileNames,omitempty"`
+}
+
+func exportConfig(exports map[string]*ExportConfig, reqPath string) *ExportConfig {
+	parts := strings.Split(reqPath, "/")
+	if len(parts) < 2 {
+		return &ExportConfig{}
+	}
+
+	config, exists := exports[parts[1]]
+	if !exists || config == nil {
+		return &ExportConfig{}
+	}
+
+	return config
+}
+
+func canReadRaw(exports map[string]*ExportConfig, auth *Auth, token, reqPath string) bool {
+	if !exportConfig(exports, reqPath).NoRawAccess {
+		return true
+	}
+
+	_, err := auth.db.GetShareByToken(token)
+	return err == nil
+}
+
+var errNoRawAccess = &Error{
+	HttpCode: 403,
+	Message:  "Files here can only be downloaded through share links",
+}
@@ -0,0 +1,243 @@
+package gemdrive
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When one GemDrive server proxies another, requests are signed with a
+// per-peer shared key and carry the identities of the user on whose behalf
+// they're made. The upstream verifies the signature and applies its own ACLs
+// to those identities, as though the user had connected directly. The
+// signature covers a hash of the body and a nonce, which the upstream
+// remembers for as long as the signature is valid, so requests can't be
+// replayed or given another body.
+
+const peerSignatureMaxAge = 5 * time.Minute
+
+// Backends that proxy to other servers can forward the identity of the user
+// making the request.
+type IdentityForwarder interface {
+	WithIdentity(ids []string) Backend
+}
+
+// Requests need signing again for each attempt, since nonces are only
+// accepted once.
+func signPeerRequest(req *http.Request, peerName, peerKey string, ids []string) error {
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	user := strings.Join(ids, ",")
+
+	nonceBytes := make([]byte, 16)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+
+	bodyHash := sha256.New()
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(bodyHash, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	contentHash := hex.EncodeToString(bodyHash.Sum(nil))
+
+	req.Header.Set("X-GemDrive-Peer", peerName)
+	req.Header.Set("X-GemDrive-User", user)
+	req.Header.Set("X-GemDrive-Timestamp", timestamp)
+	req.Header.Set("X-GemDrive-Nonce", nonce)
+	req.Header.Set("X-GemDrive-Content-SHA256", contentHash)
+	req.Header.Set("X-GemDrive-Signature", peerSignature(peerKey, req.Method, req.URL.RequestURI(), timestamp, nonce, contentHash, user))
+
+	return nil
+}
+
+func peerSignature(peerKey, method, requestUri, timestamp, nonce, contentHash, user string) string {
+	mac := hmac.New(sha256.New, []byte(peerKey))
+	mac.Write([]byte(method + "\n" + requestUri + "\n" + timestamp + "\n" + nonce + "\n" + contentHash + "\n" + user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Nonces seen in signatures that are still valid
+type peerNonces struct {
+	seen map[string]time.Time
+	mut  *sync.Mutex
+	// Shared between instances in cluster mode
+	shared *redisClient
+}
+
+func newPeerNonces(cluster *cluster) *peerNonces {
+	n := &peerNonces{
+		seen: make(map[string]time.Time),
+		mut:  &sync.Mutex{},
+	}
+	if cluster != nil {
+		n.shared = cluster.shared
+	}
+	return n
+}
+
+// Reports whether nonce is new, remembering it if so. Timestamps are
+// accepted from either side of now, so nonces are kept for twice as long.
+func (n *peerNonces) use(peerName, nonce string) (bool, error) {
+	key := "peer_nonce:" + peerName + ":" + nonce
+
+	if n.shared != nil {
+		return n.shared.setNX(key, "1", 2*peerSignatureMaxAge)
+	}
+
+	n.mut.Lock()
+	defer n.mut.Unlock()
+
+	now := time.Now()
+	for k, seenAt := range n.seen {
+		if now.Sub(seenAt) > 2*peerSignatureMaxAge {
+			delete(n.seen, k)
+		}
+	}
+
+	if _, exists := n.seen[key]; exists {
+		return false, nil
+	}
+	n.seen[key] = now
+
+	return true, nil
+}
+
+// Verifies a signed peer request, and returns a token valid only for the
+// duration of the request which carries the forwarded identities.
+func (s *Server) verifyPeerRequest(r *http.Request) (string, error) {
+	peerName := r.Header.Get("X-GemDrive-Peer")
+
+	peer, exists := s.config.Peers[peerName]
+	if !exists {
+		return "", errors.New("Unknown peer")
+	}
+
+	timestamp := r.Header.Get("X-GemDrive-Timestamp")
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("Invalid peer timestamp")
+	}
+
+	age := time.Since(time.Unix(unixTime, 0))
+	if age > peerSignatureMaxAge || age < -peerSignatureMaxAge {
+		return "", errors.New("Peer signature expired")
+	}
+
+	nonce := r.Header.Get("X-GemDrive-Nonce")
+	if len(nonce) < 16 {
+		return "", errors.New("Invalid peer nonce")
+	}
+
+	contentHash := r.Header.Get("X-GemDrive-Content-SHA256")
+	if len(contentHash) != sha256.Size*2 {
+		return "", errors.New("Invalid peer content hash")
+	}
+
+	user := r.Header.Get("X-GemDrive-User")
+	expected := peerSignature(peer.Key, r.Method, r.URL.RequestURI(), timestamp, nonce, contentHash, user)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-GemDrive-Signature"))) {
+		return "", errors.New("Invalid peer signature")
+	}
+
+	fresh, err := s.peerNonces.use(peerName, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !fresh {
+		return "", errors.New("Peer request replayed")
+	}
+
+	// The body is checked as it's read, failing at the end rather than
+	// reaching io.EOF if it doesn't match
+	if r.Body != nil {
+		verified := newVerifyingReader(r.Body, func(sums *Checksums) error {
+			if sums.Sha256 != contentHash {
+				return &Error{
+					HttpCode: 400,
+					Message:  "Peer request body doesn't match its signature",
+				}
+			}
+			return nil
+		})
+		r.Body = &limitedReadCloser{verified, r.Body}
+	}
+
+	perm := peer.Perm
+	if perm == "" {
+		perm = "read"
+	}
+
+	keyring := []*Key{}
+	if user != "" {
+		for _, id := range strings.Split(user, ",") {
+			keyring = append(keyring, &Key{
+				IdType: "email",
+				Id:     id,
+				Perm:   perm,
+				Path:   "/",
+			})
+		}
+	}
+
+	return s.auth.AddEphemeralKeyring(keyring)
+}
+
+// Returns the backend to use for a request, with the requester's identity
+// attached for any backends that forward it upstream.
+func (s *Server) requestBackend(r *http.Request) Backend {
+	forwarder, ok := s.backend.(IdentityForwarder)
+	if !ok {
+		return s.backend
+	}
+
+	token, _ := extractToken(r)
+	return forwarder.WithIdentity(s.auth.Identities(token))
+}
+
+func loadClientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		caPem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("Invalid CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
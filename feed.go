@@ -0,0 +1,209 @@
+package gemdrive
+
+import (
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Serves gemdrive/feed.xml as an RSS 2.0 feed of the most recently modified
+// files in a directory. Audio and video files get enclosures, so a folder of
+// recordings can be subscribed to directly from a podcast app.
+
+const maxFeedItems = 100
+
+// Deepest a feed looks, before any configured meta limits
+const maxFeedDepth = 8
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title     string        `xml:"title"`
+	Link      string        `xml:"link"`
+	Guid      string        `xml:"guid"`
+	PubDate   string        `xml:"pubDate,omitempty"`
+	Enclosure *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssEnclosure struct {
+	Url    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type feedEntry struct {
+	relPath string
+	item    *Item
+	modTime time.Time
+}
+
+func (s *Server) serveFeed(w http.ResponseWriter, r *http.Request, gemPath string) {
+
+	depth := 1
+	depthParam := r.URL.Query().Get("depth")
+	if depthParam != "" {
+		var err error
+		depth, err = strconv.Atoi(depthParam)
+		if err != nil || depth < 0 {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid depth param"))
+			return
+		}
+	}
+
+	if depth == 0 || depth > maxFeedDepth {
+		depth = maxFeedDepth
+	}
+
+	listing, err := s.metaLimits().listClamped(s.requestBackend(r), gemPath, depth)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		w.Write([]byte(e.Message))
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	reqToken, _ := extractToken(r)
+	listing = s.pruneListing(reqToken, gemPath, listing, actList)
+
+	entries := []feedEntry{}
+	collectFeedEntries(listing, "", &entries)
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.After(entries[j].modTime)
+	})
+
+	if len(entries) > maxFeedItems {
+		entries = entries[:maxFeedItems]
+	}
+
+	// Links need to be built from the path the client actually requested,
+	// which may differ from gemPath when the domain is mapped.
+	publicDir := strings.Split(r.URL.Path, "gemdrive/")[0]
+	token := linkToken(r)
+
+	dirName := path.Base(gemPath)
+	if gemPath == "/" {
+		dirName = r.Host
+	}
+
+	channel := rssChannel{
+		Title:       dirName,
+		Link:        s.absoluteUrl(r, publicDir, ""),
+		Description: fmt.Sprintf("Recent files in %s", dirName),
+		Items:       []rssItem{},
+	}
+
+	if len(entries) > 0 {
+		channel.LastBuildDate = entries[0].modTime.Format(time.RFC1123Z)
+	}
+
+	for _, entry := range entries {
+		link := s.absoluteUrl(r, publicDir+entry.relPath, "")
+
+		feedItem := rssItem{
+			Title: path.Base(entry.relPath),
+			Link:  link,
+			Guid:  link,
+		}
+
+		if !entry.modTime.IsZero() {
+			feedItem.PubDate = entry.modTime.Format(time.RFC1123Z)
+		}
+
+		mimeType := mime.TypeByExtension(path.Ext(entry.relPath))
+		if strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/") {
+			// Podcast apps can't log in, so pass along the token in the
+			// feed's URL.
+			feedItem.Enclosure = &rssEnclosure{
+				Url:    s.absoluteUrl(r, publicDir+entry.relPath, token),
+				Length: entry.item.Size,
+				Type:   mimeType,
+			}
+		}
+
+		channel.Items = append(channel.Items, feedItem)
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: channel,
+	}
+
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
+
+func collectFeedEntries(item *Item, prefix string, entries *[]feedEntry) {
+	for name, child := range item.Children {
+		if strings.HasSuffix(name, "/") {
+			collectFeedEntries(child, prefix+name, entries)
+			continue
+		}
+
+		modTime, _ := time.Parse(time.RFC3339, child.ModTime)
+
+		*entries = append(*entries, feedEntry{
+			relPath: prefix + name,
+			item:    child,
+			modTime: modTime,
+		})
+	}
+}
+
+// Forwarded headers are only believed from trusted proxies.
+func (s *Server) absoluteUrl(r *http.Request, p, token string) string {
+	scheme := "http"
+	if s.isHttps(r) {
+		scheme = "https"
+	}
+
+	u := &url.URL{
+		Scheme: scheme,
+		Host:   s.requestHost(r),
+		Path:   p,
+	}
+
+	if token != "" {
+		u.RawQuery = "access_token=" + url.QueryEscape(token)
+	}
+
+	return u.String()
+}
+
+// The token to put in links for clients that can't log in. Only one given
+// in the URL is passed on, since that's already been handed out with it.
+// Cookies and headers carry sessions, which shouldn't leak into links.
+func linkToken(r *http.Request) string {
+	return r.URL.Query().Get("access_token")
+}
@@ -0,0 +1,130 @@
+package gemdrive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Names of files and directories created through GemDrive are normalized
+// before they're written, so the same name typed on macOS, which sends
+// decomposed accents, and elsewhere is the same file. Names with control
+// characters or that aren't valid UTF-8 are refused. Exports can go
+// further with fileNames:
+//
+//   nfc     - the default, Unicode NFC
+//   ascii   - accents are dropped, and other non-ASCII characters replaced
+//             with _, ie for exports synced to old systems
+//   percent - non-ASCII characters and those Windows doesn't allow are
+//             percent-encoded, so the original name can be recovered
+//   raw     - names are written as they arrive
+//
+// Only the name being created is changed, never the directories it's in.
+
+const (
+	fileNamesNfc     = "nfc"
+	fileNamesAscii   = "ascii"
+	fileNamesPercent = "percent"
+	fileNamesRaw     = "raw"
+)
+
+// Letters without a decomposition that still have a usual ASCII spelling
+var asciiSpellings = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'đ': "d", 'Đ': "D", 'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "Th", 'ð': "d",
+	'Ð': "D", 'ı': "i",
+}
+
+var errControlInName = &Error{
+	HttpCode: 400,
+	Message:  "Names can't contain control characters",
+}
+
+func validFileNames(mode string) bool {
+	switch mode {
+	case "", fileNamesNfc, fileNamesAscii, fileNamesPercent, fileNamesRaw:
+		return true
+	}
+	return false
+}
+
+func normalizeName(name, mode string) (string, error) {
+	if mode == fileNamesRaw {
+		return name, nil
+	}
+
+	if !utf8.ValidString(name) {
+		return "", &Error{
+			HttpCode: 400,
+			Message:  "Names must be UTF-8",
+		}
+	}
+
+	for _, c := range name {
+		if unicode.IsControl(c) {
+			return "", errControlInName
+		}
+	}
+
+	name = norm.NFC.String(name)
+
+	switch mode {
+	case fileNamesAscii:
+		stripMarks := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+		stripped, _, err := transform.String(stripMarks, name)
+		if err != nil {
+			return "", err
+		}
+
+		var ascii strings.Builder
+		for _, c := range stripped {
+			if c < utf8.RuneSelf {
+				ascii.WriteRune(c)
+			} else if spelling, exists := asciiSpellings[c]; exists {
+				ascii.WriteString(spelling)
+			} else {
+				ascii.WriteByte('_')
+			}
+		}
+		name = ascii.String()
+	case fileNamesPercent:
+		var encoded strings.Builder
+		for i := 0; i < len(name); i++ {
+			b := name[i]
+			if b >= utf8.RuneSelf || strings.IndexByte(`<>:"\|?*%`, b) != -1 {
+				fmt.Fprintf(&encoded, "%%%02X", b)
+			} else {
+				encoded.WriteByte(b)
+			}
+		}
+		name = encoded.String()
+	}
+
+	return name, nil
+}
+
+// Normalizes the last name in reqPath as its export asks.
+func (s *Server) normalizePath(reqPath string) (string, error) {
+	isDir := strings.HasSuffix(reqPath, "/")
+	parentDir, name := path.Split(strings.TrimSuffix(reqPath, "/"))
+	if name == "" {
+		return reqPath, nil
+	}
+
+	name, err := normalizeName(name, exportConfig(s.config.Exports, reqPath).FileNames)
+	if err != nil {
+		return "", err
+	}
+
+	if isDir {
+		name += "/"
+	}
+
+	return parentDir + name, nil
+}
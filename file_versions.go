@@ -0,0 +1,383 @@
+package gemdrive
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With versioning on, local exports keep files as they were before being
+// replaced, changed, moved away or deleted, so files can be read, and
+// directories listed, as they were at a time since, with ?at= on GET and
+// meta.json, ie for restores and audits:
+//
+//	GET /files/report.pdf?at=2024-05-01T12:00:00Z
+//	GET /files/gemdrive/meta.json?at=1714564800&depth=2
+//
+// Old versions are kept in the data dir under versions/<mount>, at their
+// path plus "~" and the time they stopped being current, in Unix
+// nanoseconds. Their modTimes say when they became current, and moved files,
+// which keep their modTimes, get an empty one at their new path that never
+// was. Changes made in place, like ranged uploads and 9P writes, only keep a
+// version if the file was last changed more than a minute before, so an
+// upload's chunks don't each make one. Directories are listed if they exist now or have versions
+// kept, even if they were empty at the time. Versions aren't pruned.
+
+// Backends keeping past versions of files.
+type VersionKeeper interface {
+	ListAt(reqPath string, depth int, at time.Time) (*Item, error)
+	ReadAt(reqPath string, at time.Time) (*Item, io.ReadCloser, error)
+}
+
+const versionCoalesceWindow = time.Minute
+
+// How a file stops being current
+type versionEnd int
+
+const (
+	// Replaced or deleted, so the file itself can be kept
+	versionRemoved versionEnd = iota
+	// Still current somewhere else, so it's copied
+	versionMoved
+	// About to be changed in place, so it's copied, unless it just was
+	versionChanged
+	// Just moved in, so it wasn't here before, whatever its modTime says.
+	// An empty version that became current after it stopped says so.
+	versionMovedIn
+)
+
+var errNoVersions = &Error{
+	HttpCode: 501,
+	Message:  "Past versions aren't kept for this mount",
+}
+
+func (fs *FileSystemBackend) EnableVersioning(historyDir string) error {
+	err := os.MkdirAll(historyDir, 0755)
+	if err != nil {
+		return err
+	}
+	fs.historyDir = historyDir
+	return nil
+}
+
+// Keeps what's at reqPath, a file or every file in a directory, as the
+// version that was current until now.
+func (fs *FileSystemBackend) keepVersion(reqPath string, end versionEnd) error {
+	if fs.historyDir == "" {
+		return nil
+	}
+
+	now := time.Now()
+	suffix := "~" + strconv.FormatInt(now.UnixNano(), 10)
+
+	return filepath.Walk(fs.localPath(reqPath), func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), fsUploadPrefix) {
+			return nil
+		}
+
+		if end == versionChanged && now.Sub(info.ModTime()) < versionCoalesceWindow {
+			return nil
+		}
+
+		rel, err := filepath.Rel(fs.rootDir, p)
+		if err != nil {
+			return err
+		}
+		versionPath := filepath.Join(fs.historyDir, rel) + suffix
+
+		err = os.MkdirAll(filepath.Dir(versionPath), 0755)
+		if err != nil {
+			return err
+		}
+
+		if end == versionMovedIn {
+			err = ioutil.WriteFile(versionPath, nil, 0644)
+			if err != nil {
+				return err
+			}
+			never := now.Add(time.Second)
+			return os.Chtimes(versionPath, never, never)
+		}
+
+		if end == versionRemoved && os.Link(p, versionPath) == nil {
+			return nil
+		}
+
+		err = copyVersion(p, versionPath, info)
+		if err != nil {
+			return fmt.Errorf("Failed to keep version of %s: %s", rel, err)
+		}
+		return nil
+	})
+}
+
+func copyVersion(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// When the version named name of the file named fileName stopped being
+// current, if it's one.
+func versionEndTime(name, fileName string) (int64, bool) {
+	if !strings.HasPrefix(name, fileName+"~") {
+		return 0, false
+	}
+	nanos, err := strconv.ParseInt(name[len(fileName)+1:], 10, 64)
+	return nanos, err == nil
+}
+
+// The version of the file at reqPath that was current at the time, on
+// disk, or "" if there wasn't one.
+func (fs *FileSystemBackend) fileAt(reqPath string, at time.Time) (string, os.FileInfo) {
+	historyDir, fileName := filepath.Split(joinLocal(fs.historyDir, reqPath))
+
+	// The first version to stop being current after the time, or the
+	// current file if none has
+	p := fs.localPath(reqPath)
+	var ended int64 = -1
+	names, _ := readDirNames(historyDir)
+	for _, name := range names {
+		nanos, ok := versionEndTime(name, fileName)
+		if ok && nanos > at.UnixNano() && (ended < 0 || nanos < ended) {
+			p = filepath.Join(historyDir, name)
+			ended = nanos
+		}
+	}
+
+	info, err := os.Stat(p)
+	if err != nil || !info.Mode().IsRegular() || info.ModTime().After(at) {
+		return "", nil
+	}
+
+	return p, info
+}
+
+func readDirNames(dirPath string) ([]string, error) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	return dir.Readdirnames(0)
+}
+
+func (fs *FileSystemBackend) ListAt(reqPath string, depth int, at time.Time) (*Item, error) {
+	if fs.historyDir == "" {
+		return nil, errNoVersions
+	}
+
+	if depth > 10 {
+		return nil, fmt.Errorf("max-depth is greater than allowed value (%d)", 10)
+	}
+
+	err := checkLocalPath(reqPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileNames := make(map[string]bool)
+	dirNames := make(map[string]bool)
+
+	current, currentErr := ReadDir(fs.localPath(reqPath))
+	for _, info := range current {
+		if info.IsDir() {
+			dirNames[info.Name()] = true
+		} else {
+			fileNames[info.Name()] = true
+		}
+	}
+
+	kept, keptErr := ReadDir(joinLocal(fs.historyDir, reqPath))
+	for _, info := range kept {
+		if info.IsDir() {
+			dirNames[info.Name()] = true
+		} else if i := strings.LastIndex(info.Name(), "~"); i > 0 {
+			fileNames[info.Name()[:i]] = true
+		}
+	}
+
+	if currentErr != nil && keptErr != nil {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	item := &Item{
+		Children: make(map[string]*Item),
+	}
+
+	for name := range fileNames {
+		p, info := fs.fileAt(path.Join(reqPath, name), at)
+		if p == "" {
+			continue
+		}
+		item.Children[name] = &Item{
+			Size:         info.Size(),
+			ModTime:      info.ModTime().UTC().Format(time.RFC3339),
+			IsExecutable: IsExecutable(info),
+		}
+	}
+
+	childDepth := 0
+	if depth > 1 {
+		childDepth = depth - 1
+	}
+
+	for name := range dirNames {
+		child := &Item{}
+		if depth != 1 {
+			child, err = fs.ListAt(path.Join(reqPath, name)+"/", childDepth, at)
+			if err != nil {
+				return nil, err
+			}
+		}
+		item.Children[name+"/"] = child
+	}
+
+	return item, nil
+}
+
+func (fs *FileSystemBackend) ReadAt(reqPath string, at time.Time) (*Item, io.ReadCloser, error) {
+	if fs.historyDir == "" {
+		return nil, nil, errNoVersions
+	}
+
+	err := checkLocalPath(reqPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, info := fs.fileAt(reqPath, at)
+	if p == "" {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	item := &Item{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC().Format(time.RFC3339),
+	}
+
+	return item, file, nil
+}
+
+// Accepts RFC 3339 times and Unix timestamps in seconds.
+func parseAtParam(r *http.Request) (time.Time, bool, error) {
+	values, exists := r.URL.Query()["at"]
+	if !exists {
+		return time.Time{}, false, nil
+	}
+
+	param := ""
+	if len(values) > 0 {
+		param = values[0]
+	}
+
+	if seconds, err := strconv.ParseInt(param, 10, 64); err == nil {
+		return time.Unix(seconds, 0), true, nil
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, param)
+	if err != nil {
+		return time.Time{}, true, &Error{
+			HttpCode: 400,
+			Message:  "Invalid at param",
+		}
+	}
+
+	return at, true, nil
+}
+
+// Only files and meta.json can be read as they were.
+func atSupported(reqPath string) bool {
+	if strings.Contains(reqPath, "gemdrive/") {
+		return strings.HasSuffix(reqPath, "gemdrive/meta.json")
+	}
+	return !strings.HasSuffix(reqPath, "/")
+}
+
+func listAt(backend Backend, dirPath string, depth int, at time.Time) (*Item, error) {
+	keeper, ok := backend.(VersionKeeper)
+	if !ok {
+		return nil, errNoVersions
+	}
+	return keeper.ListAt(dirPath, depth, at)
+}
+
+// Items in a listing, at every depth.
+func countItems(item *Item) int {
+	count := 0
+	for _, child := range item.Children {
+		count += 1 + countItems(child)
+	}
+	return count
+}
+
+func (s *Server) serveFileAt(w http.ResponseWriter, r *http.Request, reqPath string, at time.Time) {
+	keeper, ok := s.requestBackend(r).(VersionKeeper)
+	if !ok {
+		w.WriteHeader(errNoVersions.HttpCode)
+		io.WriteString(w, errNoVersions.Message)
+		return
+	}
+
+	item, data, err := keeper.ReadAt(reqPath, at)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+	defer data.Close()
+
+	header := w.Header()
+	header.Set("Content-Length", strconv.FormatInt(item.Size, 10))
+	if modTime, err := time.Parse(time.RFC3339, item.ModTime); err == nil {
+		header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	io.Copy(w, data)
+}
@@ -0,0 +1,210 @@
+package gemdrive
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newVersioningServer(t *testing.T, versioning bool) (*Server, string) {
+	dir := t.TempDir()
+
+	filesDir := filepath.Join(dir, "files")
+	err := os.MkdirAll(filesDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(&Config{
+		Dirs:       []string{filesDir},
+		DataDir:    filepath.Join(dir, "data"),
+		CacheDir:   filepath.Join(dir, "cache"),
+		AdminEmail: "owner@example.com",
+		Versioning: versioning,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := server.auth.AddEphemeralKeyring([]*Key{
+		{IdType: "email", Id: "owner@example.com", Perm: "own", Path: "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, token
+}
+
+func TestReadingPastVersions(t *testing.T) {
+	server, token := newVersioningServer(t, true)
+
+	do := func(method, reqPath, body string, headers ...string) (int, string) {
+		r := httptest.NewRequest(method, reqPath, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	// Times between changes, so each is clearly before or after
+	mark := func() string {
+		time.Sleep(20 * time.Millisecond)
+		at := time.Now().UTC().Format(time.RFC3339Nano)
+		time.Sleep(20 * time.Millisecond)
+		return url.QueryEscape(at)
+	}
+
+	change := func(method, reqPath, body string, headers ...string) {
+		if code, body := do(method, reqPath, body, headers...); code != 200 {
+			t.Fatalf("%s %s: got %d %s", method, reqPath, code, body)
+		}
+	}
+
+	beforeAll := mark()
+	change("PUT", "/files/a.txt", "one")
+	afterOne := mark()
+	change("PUT", "/files/a.txt?overwrite=true", "two")
+	change("PUT", "/files/docs/", "")
+	change("PUT", "/files/docs/b.txt", "bee")
+	afterTwo := mark()
+	change("MOVE", "/files/docs/b.txt", "", "Destination", "/files/docs/c.txt")
+	change("DELETE", "/files/a.txt", "")
+	afterDelete := mark()
+
+	if code, _ := do("GET", "/files/a.txt", ""); code != 404 {
+		t.Fatalf("a.txt wasn't deleted: %d", code)
+	}
+
+	reads := []struct {
+		path string
+		want string
+	}{
+		{"/files/a.txt?at=" + beforeAll, ""},
+		{"/files/a.txt?at=" + afterOne, "one"},
+		{"/files/a.txt?at=" + afterTwo, "two"},
+		{"/files/a.txt?at=" + afterDelete, ""},
+		{"/files/docs/b.txt?at=" + afterTwo, "bee"},
+		{"/files/docs/b.txt?at=" + afterDelete, ""},
+		{"/files/docs/c.txt?at=" + afterTwo, ""},
+		{"/files/docs/c.txt?at=" + afterDelete, "bee"},
+	}
+	for _, read := range reads {
+		code, body := do("GET", read.path, "")
+		if read.want == "" && code != 404 {
+			t.Errorf("%s: got %d %s, want 404", read.path, code, body)
+		} else if read.want != "" && (code != 200 || body != read.want) {
+			t.Errorf("%s: got %d %s, want %s", read.path, code, body, read.want)
+		}
+	}
+
+	listings := []struct {
+		at      string
+		want    []string
+		notWant []string
+	}{
+		{afterOne, []string{`"a.txt"`}, []string{"b.txt", "c.txt"}},
+		{afterTwo, []string{`"a.txt"`, `"b.txt"`}, []string{"c.txt"}},
+		{afterDelete, []string{`"c.txt"`}, []string{"a.txt", "b.txt"}},
+	}
+	for _, listing := range listings {
+		code, body := do("GET", "/files/gemdrive/meta.json?depth=2&at="+listing.at, "")
+		if code != 200 {
+			t.Errorf("listing at %s: got %d %s", listing.at, code, body)
+			continue
+		}
+		for _, name := range listing.want {
+			if !strings.Contains(body, name) {
+				t.Errorf("listing at %s is missing %s: %s", listing.at, name, body)
+			}
+		}
+		for _, name := range listing.notWant {
+			if strings.Contains(body, name) {
+				t.Errorf("listing at %s has %s: %s", listing.at, name, body)
+			}
+		}
+	}
+
+	for reqPath, want := range map[string]int{
+		"/files/a.txt?at=yesterday":                400,
+		"/files/gemdrive/feed.xml?at=" + afterOne:  400,
+		"/files/gemdrive/meta.json?at=1&limit=10":  400,
+		"/files/gemdrive/meta.json?at=" + afterOne: 200,
+	} {
+		if code, body := do("GET", reqPath, ""); code != want {
+			t.Errorf("%s: got %d %s, want %d", reqPath, code, body, want)
+		}
+	}
+}
+
+func TestPastVersionsNeedVersioning(t *testing.T) {
+	server, token := newVersioningServer(t, false)
+
+	ioutil.WriteFile(filepath.Join(server.config.Dirs[0], "a.txt"), []byte("now"), 0644)
+
+	for _, reqPath := range []string{"/files/a.txt?at=1", "/files/gemdrive/meta.json?at=1"} {
+		r := httptest.NewRequest("GET", reqPath, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != 501 {
+			t.Errorf("%s: got %d %s, want 501", reqPath, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Chunks written in place soon after each other make one version, of the
+// file as it was before the first.
+func TestInPlaceChangesKeepOneVersion(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := NewFileSystemBackend(filepath.Join(dir, "files"), filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.EnableVersioning(filepath.Join(dir, "versions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := filepath.Join(dir, "files", "a.txt")
+	err = ioutil.WriteFile(filePath, []byte("aaaa"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastEdited := time.Now().Add(-time.Hour)
+	err = os.Chtimes(filePath, lastEdited, lastEdited)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, chunk := range []string{"b", "c"} {
+		err = fs.Write("/a.txt", strings.NewReader(chunk), int64(i), 1, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, _ := readDirNames(filepath.Join(dir, "versions"))
+	if len(versions) != 1 {
+		t.Fatalf("got versions %v, want one", versions)
+	}
+
+	_, data, err := fs.ReadAt("/a.txt", lastEdited.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+	if content, _ := ioutil.ReadAll(data); string(content) != "aaaa" {
+		t.Errorf("got %s, want aaaa", content)
+	}
+}
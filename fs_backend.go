@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"github.com/nfnt/resize"
 	"image"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
@@ -14,15 +14,49 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+var errInsufficientStorage = &Error{
+	HttpCode: 507,
+	Message:  "Insufficient storage",
+}
+
+const defaultListParallelism = 8
+
+// Files being uploaded, which listings and the watcher skip
+const fsUploadPrefix = ".gemdrive-upload-"
+
 type FileSystemBackend struct {
-	rootDir string
-	gemDir  string
+	rootDir     string
+	gemDir      string
+	preallocate bool
+	xattrs      bool
+	// Bounds how many subdirectories deep listings read at once
+	listSlots chan struct{}
+	// Directories with more entries than this get a chunked listing index
+	listingChunkSize int
+	images           *ImagePool
+	versions         *dirVersions
+	archives         *archiveCache
+	// Told about every change, ie to pass it on to other instances
+	onChange func(reqPath, movedFrom string)
+	dedupMut sync.Mutex
+	// Where past versions of files are kept, if they are
+	historyDir string
 }
 
 func NewFileSystemBackend(dirPath, gemDir string) (*FileSystemBackend, error) {
+	dirPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	gemDir, err = filepath.Abs(gemDir)
+	if err != nil {
+		return nil, err
+	}
+
 	stat, err := os.Stat(dirPath)
 	if os.IsNotExist(err) {
 		err := os.MkdirAll(dirPath, 0755)
@@ -43,7 +77,51 @@ func NewFileSystemBackend(dirPath, gemDir string) (*FileSystemBackend, error) {
 		return nil, errors.New("Not a directory")
 	}
 
-	return &FileSystemBackend{rootDir: dirPath, gemDir: gemDir}, nil
+	return &FileSystemBackend{
+		rootDir:          dirPath,
+		gemDir:           gemDir,
+		listSlots:        make(chan struct{}, defaultListParallelism),
+		listingChunkSize: defaultListingChunkSize,
+		images:           NewImagePool(&ImageConfig{}),
+		versions:         newDirVersions(),
+		archives:         newArchiveCache(),
+	}, nil
+}
+
+// Backends sharing a pool share its limits.
+func (fs *FileSystemBackend) SetImagePool(pool *ImagePool) {
+	fs.images = pool
+}
+
+func (fs *FileSystemBackend) SetListParallelism(n int) {
+	fs.listSlots = make(chan struct{}, n)
+}
+
+func (fs *FileSystemBackend) EnablePreallocation() {
+	fs.preallocate = true
+}
+
+// Keeps file attributes in the files' own extended attributes.
+func (fs *FileSystemBackend) EnableXattrs() {
+	fs.xattrs = true
+}
+
+// Sets a function called with the path of every change recorded, which ends
+// in a slash for directories, and where it was moved from if it was.
+func (fs *FileSystemBackend) SetChangeHook(hook func(reqPath, movedFrom string)) {
+	fs.onChange = hook
+}
+
+func (fs *FileSystemBackend) FreeSpace(reqPath string) (int64, error) {
+	return freeSpace(fs.rootDir)
+}
+
+func (fs *FileSystemBackend) LocalDirs() ([]string, []string) {
+	writeDirs := []string{fs.rootDir, fs.gemDir}
+	if fs.historyDir != "" {
+		writeDirs = append(writeDirs, fs.historyDir)
+	}
+	return writeDirs, nil
 }
 
 func (fs *FileSystemBackend) List(reqPath string, depth int) (*Item, error) {
@@ -55,14 +133,24 @@ func (fs *FileSystemBackend) List(reqPath string, depth int) (*Item, error) {
 		return nil, errors.New(errMsg)
 	}
 
-	p := path.Join(fs.rootDir, reqPath)
-
-	files, err := ReadDir(p)
+	err := checkLocalPath(reqPath)
 	if err != nil {
 		return nil, err
 	}
 
-	item := DirToGemDrive(files)
+	if archivePath, innerPath, ok := fs.splitArchivePath(reqPath); ok {
+		a, err := fs.archives.open(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		defer a.Close()
+		return a.List(innerPath, depth)
+	}
+
+	item, err := fs.readDirItem(reqPath)
+	if err != nil {
+		return nil, err
+	}
 
 	if depth == 1 {
 		return item, nil
@@ -73,21 +161,58 @@ func (fs *FileSystemBackend) List(reqPath string, depth int) (*Item, error) {
 			childDepth = depth - 1
 		}
 
-		for _, file := range files {
+		var wg sync.WaitGroup
+		mut := &sync.Mutex{}
+		var listErr error
 
-			if !file.IsDir() {
-				continue
+		childNames := []string{}
+		for name := range item.Children {
+			if strings.HasSuffix(name, "/") {
+				childNames = append(childNames, strings.TrimSuffix(name, "/"))
 			}
+		}
 
-			childName := file.Name()
+		for _, childName := range childNames {
 
+			childName := childName
 			childPath := path.Join(reqPath, childName)
-			childItem, err := fs.List(childPath, childDepth)
-			if err != nil {
-				return nil, err
+
+			listChild := func() {
+				childItem, err := fs.List(childPath, childDepth)
+
+				mut.Lock()
+				defer mut.Unlock()
+
+				if err != nil {
+					if listErr == nil {
+						listErr = err
+					}
+					return
+				}
+
+				item.Children[childName+"/"] = childItem
+			}
+
+			// Subdirectories are listed on another goroutine when a slot
+			// is free, and otherwise inline. Never waiting for a slot
+			// means nested listings can't deadlock on each other.
+			select {
+			case fs.listSlots <- struct{}{}:
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-fs.listSlots }()
+					listChild()
+				}()
+			default:
+				listChild()
 			}
+		}
+
+		wg.Wait()
 
-			item.Children[childName+"/"] = childItem
+		if listErr != nil {
+			return nil, listErr
 		}
 
 		return item, nil
@@ -95,7 +220,25 @@ func (fs *FileSystemBackend) List(reqPath string, depth int) (*Item, error) {
 }
 
 func (fs *FileSystemBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
-	p := path.Join(fs.rootDir, reqPath)
+	if archivePath, innerPath, ok := fs.splitArchivePath(reqPath); ok {
+		a, err := fs.archives.open(archivePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		item, reader, err := a.Read(innerPath, offset, length)
+		if err != nil {
+			a.Close()
+			return nil, nil, err
+		}
+
+		return item, &archiveReadCloser{reader, a}, nil
+	}
+
+	p, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	file, err := os.Open(p)
 	if err != nil {
@@ -143,14 +286,41 @@ func (fs *FileSystemBackend) Read(reqPath string, offset, length int64) (*Item,
 	}()
 
 	item := &Item{
-		Size: stat.Size(),
+		Size:    stat.Size(),
+		ModTime: stat.ModTime().UTC().Format(time.RFC3339),
 	}
 
 	return item, reader, nil
 }
 
+// If reqPath passes through an archive file, returns the archive's location
+// on disk and the remaining path within it.
+func (fs *FileSystemBackend) splitArchivePath(reqPath string) (string, string, bool) {
+	parts := strings.Split(reqPath, "/")
+
+	for i := 0; i < len(parts)-1; i++ {
+		if !isArchiveName(parts[i]) {
+			continue
+		}
+
+		archivePath := fs.localPath(strings.Join(parts[:i+1], "/"))
+
+		stat, err := os.Stat(archivePath)
+		if err != nil || !stat.Mode().IsRegular() {
+			return "", "", false
+		}
+
+		return archivePath, strings.Join(parts[i+1:], "/"), true
+	}
+
+	return "", "", false
+}
+
 func (fs *FileSystemBackend) MakeDir(reqPath string, recursive bool) error {
-	fsPath := path.Join(fs.rootDir, reqPath)
+	fsPath, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return err
+	}
 
 	if recursive {
 		err := os.MkdirAll(fsPath, 0755)
@@ -171,12 +341,28 @@ func (fs *FileSystemBackend) MakeDir(reqPath string, recursive bool) error {
 		}
 	}
 
+	fs.itemChanged(strings.TrimSuffix(reqPath, "/") + "/")
+
 	return nil
 }
 
 func (fs *FileSystemBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
 
-	fsPath := path.Join(fs.rootDir, reqPath)
+	fsPath, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return err
+	}
+
+	if offset == 0 && truncate {
+		return fs.writeWhole(reqPath, fsPath, data, length, overwrite)
+	}
+
+	if overwrite {
+		err = fs.keepVersion(reqPath, versionChanged)
+		if err != nil {
+			return err
+		}
+	}
 
 	mask := os.O_WRONLY | os.O_CREATE
 
@@ -189,16 +375,32 @@ func (fs *FileSystemBackend) Write(reqPath string, data io.Reader, offset, lengt
 	}
 
 	file, err := os.OpenFile(fsPath, mask, 0666)
-	if err != nil {
+	if os.IsExist(err) {
+		return &Error{
+			HttpCode: 409,
+			Message:  "File exists",
+		}
+	} else if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	if fs.preallocate && truncate {
+		err = preallocate(file, offset+length)
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = file.Seek(offset, 0)
 	if err != nil {
 		return err
 	}
 
+	fs.itemChanged(reqPath)
+	// Again once written, in case it was listed in the middle
+	defer fs.recordChange(reqPath)
+
 	n, err := io.Copy(file, data)
 	if err != nil {
 		return err
@@ -211,9 +413,141 @@ func (fs *FileSystemBackend) Write(reqPath string, data io.Reader, offset, lengt
 	return nil
 }
 
+// Whole files are written beside where they go and only then put in place,
+// so failed uploads don't leave partial files, or destroy the one they were
+// replacing.
+func (fs *FileSystemBackend) writeWhole(reqPath, fsPath string, data io.Reader, length int64, overwrite bool) error {
+	stat, err := os.Stat(fsPath)
+	if err == nil && (stat.IsDir() || !overwrite) {
+		return &Error{
+			HttpCode: 409,
+			Message:  "File exists",
+		}
+	}
+
+	suffix, err := genRandomKey()
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(filepath.Dir(fsPath), fsUploadPrefix+suffix[:16])
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	err = fs.writeTemp(file, data, length)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// Replacements keep the old file's mode and attributes
+	if stat != nil {
+		os.Chmod(tmpPath, stat.Mode().Perm())
+
+		if fs.xattrs {
+			attrs, err := getXattrs(fsPath)
+			if err == nil && len(attrs) > 0 {
+				setXattrs(tmpPath, attrs)
+			}
+		}
+	}
+
+	if overwrite {
+		if stat != nil {
+			err = fs.keepVersion(reqPath, versionRemoved)
+			if err != nil {
+				return err
+			}
+		}
+		err = os.Rename(tmpPath, fsPath)
+	} else {
+		// Unlike a rename, a link fails if something was put there since
+		err = os.Link(tmpPath, fsPath)
+		if err != nil && !os.IsExist(err) {
+			// Not every filesystem has links
+			if _, statErr := os.Lstat(fsPath); os.IsNotExist(statErr) {
+				err = os.Rename(tmpPath, fsPath)
+			}
+		}
+		if os.IsExist(err) {
+			return &Error{
+				HttpCode: 409,
+				Message:  "File exists",
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fs.itemChanged(reqPath)
+
+	return nil
+}
+
+func (fs *FileSystemBackend) writeTemp(file *os.File, data io.Reader, length int64) error {
+	if fs.preallocate {
+		err := preallocate(file, length)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := io.Copy(file, data)
+	if err != nil {
+		return err
+	}
+
+	if n != length {
+		return errors.New("n did not match length")
+	}
+
+	return nil
+}
+
+func (fs *FileSystemBackend) PunchHole(reqPath string, offset, length int64) error {
+
+	fsPath, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fsPath, os.O_WRONLY, 0)
+	if err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+	defer file.Close()
+
+	err = fs.keepVersion(reqPath, versionChanged)
+	if err != nil {
+		return err
+	}
+
+	defer fs.recordChange(reqPath)
+
+	return punchHole(file, offset, length)
+}
+
 func (fs *FileSystemBackend) Delete(reqPath string, recursive bool) error {
 
-	fsPath := path.Join(fs.rootDir, reqPath)
+	fsPath, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return err
+	}
+
+	// Directories only go if they're empty otherwise
+	if info, err := os.Stat(fsPath); err == nil && (recursive || !info.IsDir()) {
+		err = fs.keepVersion(reqPath, versionRemoved)
+		if err != nil {
+			return err
+		}
+	}
 
 	if recursive {
 		err := os.RemoveAll(fsPath)
@@ -227,24 +561,90 @@ func (fs *FileSystemBackend) Delete(reqPath string, recursive bool) error {
 		}
 	}
 
+	fs.invalidateFile(reqPath, true)
+	fs.invalidateDir(reqPath)
+
 	return nil
 }
 
-func (fs *FileSystemBackend) GetImage(reqPath string, size int) (io.Reader, int64, error) {
+func (fs *FileSystemBackend) Move(srcPath, dstPath string) error {
 
-	p := path.Join(fs.rootDir, reqPath)
-	sizeStr := fmt.Sprintf("%d", size)
+	fsSrcPath, err := fs.checkedPath(srcPath)
+	if err != nil {
+		return err
+	}
+	fsDstPath, err := fs.checkedPath(dstPath)
+	if err != nil {
+		return err
+	}
+
+	srcStat, err := os.Stat(fsSrcPath)
+	if err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	_, err = os.Stat(fsDstPath)
+	if err == nil {
+		return &Error{
+			HttpCode: 409,
+			Message:  "Destination exists",
+		}
+	}
+
+	err = fs.keepVersion(srcPath, versionMoved)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(fsSrcPath, fsDstPath)
+	if err != nil {
+		return err
+	}
+
+	if srcStat.IsDir() {
+		srcPath = strings.TrimSuffix(srcPath, "/") + "/"
+		dstPath = strings.TrimSuffix(dstPath, "/") + "/"
+	}
+
+	fs.invalidateFile(srcPath, true)
+	fs.invalidateDir(srcPath)
+	fs.itemMoved(srcPath, dstPath)
+
+	err = fs.keepVersion(dstPath, versionMovedIn)
+	if err != nil {
+		fmt.Println("Failed to record move to", dstPath+":", err)
+	}
+
+	return nil
+}
+
+func (fs *FileSystemBackend) GetImage(reqPath string, opts *ImageOptions) (io.Reader, int64, error) {
+
+	p, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return nil, 0, err
+	}
 
 	pathParts := strings.Split(reqPath, "/")
 	parentDir := strings.Join(pathParts[:len(pathParts)-1], "/")
 	filename := pathParts[len(pathParts)-1]
 
-	imgDir := path.Join(fs.gemDir, parentDir, "gemdrive", "images", sizeStr)
+	imgDir := fs.cachePath(parentDir, "gemdrive", "images", opts.cacheKey())
 
-	gemPath := path.Join(imgDir, filename)
+	gemPath := filepath.Join(imgDir, filename)
 
-	_, err := os.Stat(gemPath)
-	if os.IsNotExist(err) {
+	if fs.images.animated && isGifName(filename) {
+		return fs.getAnimatedImage(p, opts.maxSize(), gemPath)
+	}
+
+	if fs.images.animated && isVideoName(filename) {
+		return fs.getAnimatedImage(p, opts.maxSize(), gemPath+".gif")
+	}
+
+	if thumbnailStale(gemPath, p) {
 
 		err := os.MkdirAll(imgDir, 0755)
 		if err != nil {
@@ -255,34 +655,71 @@ func (fs *FileSystemBackend) GetImage(reqPath string, size int) (io.Reader, int6
 		if err != nil {
 			return nil, 0, err
 		}
+		defer file.Close()
 
-		img, err := decodeImage(reqPath, file)
+		var source io.ReadSeeker = file
+		if isRawName(reqPath) {
+			stat, err := file.Stat()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			source, err = rawPreview(file, stat.Size())
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+
+		err = fs.images.checkSource(source)
 		if err != nil {
 			return nil, 0, err
 		}
-		file.Close()
-
-		bounds := img.Bounds()
-		width := bounds.Max.X
-		height := bounds.Max.Y
 
-		resizeWidth := uint(size)
-		resizeHeight := uint(size)
-		if width > height {
-			resizeHeight = 0
-		} else {
-			resizeWidth = 0
+		_, err = source.Seek(0, 0)
+		if err != nil {
+			return nil, 0, err
 		}
 
-		m := resize.Resize(resizeWidth, resizeHeight, img, resize.Lanczos3)
+		iccProfile := readIccProfile(source)
+
+		orientation := 0
+		if opts.AutoRotate {
+			if isRawName(reqPath) {
+				orientation = rawOrientation(file)
+			} else {
+				_, err = source.Seek(0, 0)
+				if err != nil {
+					return nil, 0, err
+				}
+
+				exif, err := readExif(source)
+				if err == nil {
+					orientation = exif.Orientation
+				}
+			}
+		}
 
-		out, err := os.Create(gemPath)
+		_, err = source.Seek(0, 0)
 		if err != nil {
 			return nil, 0, err
 		}
-		defer out.Close()
 
-		err = encodeImage(reqPath, out, m)
+		err = fs.images.run(func() error {
+			img, err := decodeImage(reqPath, source)
+			if err != nil {
+				return err
+			}
+
+			m := transformImage(img, orientation, opts)
+
+			var encoded bytes.Buffer
+			err = encodeImage(reqPath, &encoded, m, opts.Quality)
+			if err != nil {
+				return err
+			}
+
+			return ioutil.WriteFile(gemPath, addIccProfile(encoded.Bytes(), iccProfile), 0644)
+		})
 		if err != nil {
 			return nil, 0, err
 		}
@@ -297,31 +734,48 @@ func (fs *FileSystemBackend) GetImage(reqPath string, size int) (io.Reader, int6
 
 }
 
+// Thumbnails older than their source are made again, in case it changed
+// while it wasn't being watched.
+func thumbnailStale(thumbPath, sourcePath string) bool {
+	thumbInfo, err := os.Stat(thumbPath)
+	if err != nil {
+		return true
+	}
+
+	sourceInfo, err := os.Stat(sourcePath)
+	return err == nil && thumbInfo.ModTime().Before(sourceInfo.ModTime())
+}
+
 func decodeImage(filename string, reader io.Reader) (image.Image, error) {
 	ext := strings.ToLower(filepath.Ext(filename))
 
 	switch ext {
-	case ".jpg":
-		fallthrough
-	case ".jpeg":
+	case ".jpg", ".jpeg", ".cr2", ".nef", ".dng":
 		return jpeg.Decode(reader)
 	case ".png":
 		return png.Decode(reader)
+	case ".gif":
+		return gif.Decode(reader)
 	}
 
 	return nil, errors.New("Invalid image file type")
 }
 
-func encodeImage(filename string, writer io.Writer, img image.Image) error {
+// Quality only applies to JPEGs. 0 means the default.
+func encodeImage(filename string, writer io.Writer, img image.Image, quality int) error {
 	ext := strings.ToLower(filepath.Ext(filename))
 
 	switch ext {
-	case ".jpg":
-		fallthrough
-	case ".jpeg":
-		return jpeg.Encode(writer, img, nil)
+	case ".jpg", ".jpeg", ".cr2", ".nef", ".dng":
+		var options *jpeg.Options
+		if quality != 0 {
+			options = &jpeg.Options{Quality: quality}
+		}
+		return jpeg.Encode(writer, img, options)
 	case ".png":
 		return png.Encode(writer, img)
+	case ".gif":
+		return gif.Encode(writer, img, nil)
 	}
 
 	return nil
@@ -345,11 +799,19 @@ func DirToGemDrive(files []os.FileInfo) *Item {
 			isExecutable = IsExecutable(file)
 		}
 
-		item.Children[name] = &Item{
+		child := &Item{
 			Size:         file.Size(),
 			ModTime:      file.ModTime().UTC().Format(time.RFC3339),
 			IsExecutable: isExecutable,
 		}
+
+		if !file.IsDir() {
+			if allocated := allocatedSize(file); allocated < file.Size() {
+				child.AllocatedSize = allocated
+			}
+		}
+
+		item.Children[name] = child
 	}
 
 	return item
@@ -376,7 +838,11 @@ func ReadDir(dirPath string) ([]os.FileInfo, error) {
 	files := []os.FileInfo{}
 
 	for _, name := range names {
-		filePath := path.Join(dirPath, name)
+		if strings.HasPrefix(name, fsUploadPrefix) {
+			continue
+		}
+
+		filePath := filepath.Join(dirPath, name)
 		fileInfo, err := os.Stat(filePath)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,33 @@
+package gemdrive
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Drops cached data derived from a file. Thumbnails are always removed,
+// though they'd also be made again once older than the file. Metadata and
+// checksum entries carry the size and modification time they were computed
+// for, so they only need removing once the file is gone.
+func (fs *FileSystemBackend) invalidateFile(reqPath string, removed bool) {
+	parentDir, filename := path.Split(reqPath)
+	cacheDir := fs.cachePath(parentDir, "gemdrive")
+
+	thumbnails, _ := filepath.Glob(filepath.Join(cacheDir, "images", "*", filename))
+	videoPreviews, _ := filepath.Glob(filepath.Join(cacheDir, "images", "*", filename+".gif"))
+	for _, thumbnail := range append(thumbnails, videoPreviews...) {
+		os.Remove(thumbnail)
+	}
+
+	fs.itemChanged(reqPath)
+
+	if removed {
+		os.Remove(filepath.Join(cacheDir, "media", filename+".json"))
+		os.Remove(filepath.Join(cacheDir, "checksums", filename+".json"))
+	}
+}
+
+func (fs *FileSystemBackend) invalidateDir(reqPath string) {
+	os.RemoveAll(fs.cachePath(reqPath))
+}
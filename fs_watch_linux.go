@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package gemdrive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+type fsWatcher struct {
+	fd      int
+	backend *FileSystemBackend
+	dirs    map[int32]string
+	mut     *sync.Mutex
+	// The last IN_MOVED_FROM, which the IN_MOVED_TO with the same cookie
+	// follows when something is moved within the tree
+	moveCookie uint32
+	moveFrom   string
+}
+
+// Watches the backend's directory tree with inotify, so cached thumbnails
+// and metadata are invalidated when files change outside of GemDrive.
+func (fs *FileSystemBackend) Watch() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+
+	watcher := &fsWatcher{
+		fd:      fd,
+		backend: fs,
+		dirs:    make(map[int32]string),
+		mut:     &sync.Mutex{},
+	}
+
+	err = watcher.addRecursive("/")
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	fs.versions.setWatching(true)
+
+	go watcher.run()
+
+	return nil
+}
+
+func (w *fsWatcher) addRecursive(reqDir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, path.Join(w.backend.rootDir, reqDir), watchMask)
+	if err != nil {
+		return err
+	}
+
+	w.mut.Lock()
+	w.dirs[int32(wd)] = reqDir
+	w.mut.Unlock()
+
+	files, err := ReadDir(path.Join(w.backend.rootDir, reqDir))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			err := w.addRecursive(reqDir + file.Name() + "/")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Directories moved within the tree are watched again under their new path
+// when the IN_MOVED_TO event arrives.
+func (w *fsWatcher) removeRecursive(reqDir string) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	for wd, dir := range w.dirs {
+		if strings.HasPrefix(dir, reqDir) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+func (w *fsWatcher) run() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			fmt.Println("Stopped watching", w.backend.rootDir, err)
+			w.backend.versions.setWatching(false)
+			return
+		}
+
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+
+			w.handleEvent(event.Wd, event.Mask, event.Cookie, name)
+		}
+	}
+}
+
+func (w *fsWatcher) handleEvent(wd int32, mask, cookie uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		fmt.Println("Watch queue overflowed for", w.backend.rootDir)
+		w.backend.versions.reset()
+		return
+	}
+
+	w.mut.Lock()
+	reqDir, exists := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mut.Unlock()
+
+	if !exists || name == "" || strings.HasPrefix(name, fsUploadPrefix) {
+		return
+	}
+
+	reqPath := reqDir + name
+	removed := mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0
+
+	itemPath := reqPath
+	if mask&syscall.IN_ISDIR != 0 {
+		itemPath += "/"
+	}
+
+	movedFrom := ""
+	if mask&syscall.IN_MOVED_FROM != 0 {
+		w.moveCookie = cookie
+		w.moveFrom = itemPath
+	} else if mask&syscall.IN_MOVED_TO != 0 && cookie != 0 && cookie == w.moveCookie {
+		movedFrom = w.moveFrom
+		w.moveCookie = 0
+	}
+
+	if mask&syscall.IN_ISDIR != 0 {
+		if movedFrom != "" {
+			w.backend.itemMoved(movedFrom, itemPath)
+		} else {
+			w.backend.itemChanged(itemPath)
+		}
+		if removed {
+			w.removeRecursive(reqPath + "/")
+			w.backend.invalidateDir(reqPath)
+		} else if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			err := w.addRecursive(reqPath + "/")
+			if err != nil {
+				fmt.Println("Failed to watch", reqPath, err)
+			}
+		}
+		return
+	}
+
+	w.backend.invalidateFile(reqPath, removed)
+	if movedFrom != "" {
+		w.backend.itemMoved(movedFrom, reqPath)
+	}
+}
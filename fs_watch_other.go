@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package gemdrive
+
+import (
+	"errors"
+)
+
+func (fs *FileSystemBackend) Watch() error {
+	return errors.New("Watching for changes not supported on this platform")
+}
@@ -0,0 +1,180 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Gallery endpoints group the images under a directory by capture date, so
+// web gallery frontends don't each need to walk the tree and parse EXIF:
+//
+//   gemdrive/gallery/timeline.json - images grouped by day, newest first
+//   gemdrive/gallery/albums.json   - subdirectories containing images
+
+type GalleryImage struct {
+	Path    string `json:"path"`
+	TakenAt string `json:"takenAt,omitempty"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	// TakenAt parsed, since offsets make the strings sort wrong
+	takenAt time.Time
+}
+
+type GalleryDay struct {
+	Date   string          `json:"date"`
+	Images []*GalleryImage `json:"images"`
+}
+
+type GalleryAlbum struct {
+	Path  string `json:"path"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Cover string `json:"cover,omitempty"`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	end   time.Time
+}
+
+func (s *Server) serveGallery(w http.ResponseWriter, r *http.Request, gemPath, galleryReq string) {
+
+	metaServer, ok := s.backend.(MediaMetaServer)
+	if !ok {
+		w.WriteHeader(500)
+		w.Write([]byte("Backend does not support media metadata"))
+		return
+	}
+
+	listing, err := s.metaLimits().listClamped(s.requestBackend(r), gemPath, 0)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		w.Write([]byte(e.Message))
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	token, _ := extractToken(r)
+	listing = s.pruneListing(token, gemPath, listing, actRead)
+
+	images := []*GalleryImage{}
+	collectGalleryImages(listing, "", &images)
+
+	for _, img := range images {
+		meta, err := metaServer.GetMediaMeta(gemPath + img.Path)
+		if err != nil {
+			continue
+		}
+		img.Width = meta.Width
+		img.Height = meta.Height
+		if meta.TakenAt != "" {
+			img.TakenAt = meta.TakenAt
+		}
+	}
+
+	for _, img := range images {
+		img.takenAt, _ = time.Parse(time.RFC3339, img.TakenAt)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].takenAt.After(images[j].takenAt)
+	})
+
+	var result interface{}
+
+	switch galleryReq {
+	case "timeline.json":
+		result = galleryTimeline(images)
+	case "albums.json":
+		result = galleryAlbums(images)
+	default:
+		w.WriteHeader(404)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	jsonBody, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+// Images start out dated by modification time, which is replaced by the
+// EXIF capture date when one is available.
+func collectGalleryImages(item *Item, prefix string, images *[]*GalleryImage) {
+	for name, child := range item.Children {
+		if strings.HasSuffix(name, "/") {
+			collectGalleryImages(child, prefix+name, images)
+		} else if isImageName(name) {
+			*images = append(*images, &GalleryImage{
+				Path:    prefix + name,
+				TakenAt: child.ModTime,
+			})
+		}
+	}
+}
+
+func galleryTimeline(images []*GalleryImage) []*GalleryDay {
+	days := []*GalleryDay{}
+
+	for _, img := range images {
+		date := "unknown"
+		if !img.takenAt.IsZero() {
+			date = img.takenAt.Format("2006-01-02")
+		}
+
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, &GalleryDay{Date: date})
+		}
+
+		day := days[len(days)-1]
+		day.Images = append(day.Images, img)
+	}
+
+	return days
+}
+
+// Expects images sorted newest first.
+func galleryAlbums(images []*GalleryImage) []*GalleryAlbum {
+	albumMap := make(map[string]*GalleryAlbum)
+	albums := []*GalleryAlbum{}
+
+	for _, img := range images {
+		dir, _ := path.Split(img.Path)
+		if dir == "" {
+			continue
+		}
+
+		album, exists := albumMap[dir]
+		if !exists {
+			album = &GalleryAlbum{
+				Path:  dir,
+				Name:  path.Base(dir),
+				Cover: img.Path,
+				End:   img.TakenAt,
+				end:   img.takenAt,
+			}
+			albumMap[dir] = album
+			albums = append(albums, album)
+		}
+
+		album.Count++
+		album.Start = img.TakenAt
+	}
+
+	sort.Slice(albums, func(i, j int) bool {
+		return albums[i].end.After(albums[j].end)
+	})
+
+	return albums
+}
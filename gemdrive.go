@@ -10,6 +10,12 @@ type Item struct {
 	ModTime      string           `json:"modTime,omitempty"`
 	Children     map[string]*Item `json:"children,omitempty"`
 	IsExecutable bool             `json:"isExecutable,omitempty"`
+	// Only set for sparse files, where it's less than Size
+	AllocatedSize int64 `json:"allocatedSize,omitempty"`
+	// Only set for files in tiered exports
+	Tiering *TierState `json:"tiering,omitempty"`
+	// Only set in meta.json?since= deltas, for children moved there
+	MovedFrom string `json:"movedFrom,omitempty"`
 }
 
 type Backend interface {
@@ -19,12 +25,34 @@ type Backend interface {
 
 type WritableBackend interface {
 	MakeDir(path string, recursive bool) error
+	// Writes of whole files, from offset 0 with truncate, should leave
+	// what was at path before if they fail, so callers never have to
+	// clean up after them.
 	Write(path string, data io.Reader, offset, length int64, overwrite, truncate bool) error
 	Delete(path string, recursive bool) error
 }
 
+// Backends which can deallocate a range of a file, leaving a hole which
+// reads as zeros.
+type HolePuncher interface {
+	PunchHole(path string, offset, length int64) error
+}
+
+type MovableBackend interface {
+	Move(srcPath, dstPath string) error
+}
+
+// Backends which know how much space is left for writes.
+type SpaceReporter interface {
+	FreeSpace(path string) (int64, error)
+}
+
 type ImageServer interface {
-	GetImage(path string, size int) (io.Reader, int64, error)
+	GetImage(path string, opts *ImageOptions) (io.Reader, int64, error)
+}
+
+type MediaMetaServer interface {
+	GetMediaMeta(path string) (*MediaMeta, error)
 }
 
 type Error struct {
@@ -37,14 +65,132 @@ func (e *Error) Error() string {
 }
 
 type Config struct {
-	Port       int               `json:"port,omitempty"`
-	Dirs       []string          `json:"dirs,omitempty"`
-	AdminEmail string            `json:"adminEmail,omitempty"`
-	DataDir    string            `json:"dataDir,omitempty"`
-	CacheDir   string            `json:"cacheDir,omitempty"`
-	RcloneDir  string            `json:"rcloneDir,omitempty"`
-	Smtp       *SmtpConfig       `json:"smtp,omitempty"`
-	DomainMap  map[string]string `json:"domainMap,omitempty"`
+	Port       int                      `json:"port,omitempty"`
+	ServerName string                   `json:"serverName,omitempty"`
+	NinepAddr  string                   `json:"ninepAddr,omitempty"`
+	Dirs       []string                 `json:"dirs,omitempty"`
+	AdminEmail string                   `json:"adminEmail,omitempty"`
+	DataDir    string                   `json:"dataDir,omitempty"`
+	CacheDir   string                   `json:"cacheDir,omitempty"`
+	RcloneDir  string                   `json:"rcloneDir,omitempty"`
+	GitRepos   []string                 `json:"gitRepos,omitempty"`
+	Mirrors    map[string]*MirrorConfig `json:"mirrors,omitempty"`
+	Smtp       *SmtpConfig              `json:"smtp,omitempty"`
+	Dlna       *DlnaConfig              `json:"dlna,omitempty"`
+	DomainMap  map[string]string        `json:"domainMap,omitempty"`
+	Peers      map[string]*PeerConfig   `json:"peers,omitempty"`
+	Limits     *LimitsConfig            `json:"limits,omitempty"`
+	Index      *IndexConfig             `json:"index,omitempty"`
+	Images     *ImageConfig             `json:"images,omitempty"`
+	// Reverse proxies, as IPs or CIDRs, whose X-Forwarded-* headers are
+	// believed. Required behind a proxy, or every client appears to have
+	// the proxy's IP.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// Ties tokens issued at login to where they were issued
+	TokenBinding *TokenBindingConfig `json:"tokenBinding,omitempty"`
+	// How login codes reach users. Defaults to email when Smtp is set.
+	CodeDelivery *CodeDeliveryConfig `json:"codeDelivery,omitempty"`
+	// Emails sent when things happen under watched paths. Requires Smtp.
+	Notifications []*NotificationRule `json:"notifications,omitempty"`
+	// How many subdirectories deep listings read concurrently
+	ListParallelism int `json:"listParallelism,omitempty"`
+	// Directories with more entries than this get an on-disk listing
+	// index, split into chunks of this many entries
+	ListingChunkSize int `json:"listingChunkSize,omitempty"`
+	// Reserve the full size of uploaded files on disk before writing them
+	Preallocate bool `json:"preallocate,omitempty"`
+	// Largest single upload accepted, in bytes. 0 means no limit.
+	MaxUploadSize int64 `json:"maxUploadSize,omitempty"`
+	// Temporarily blocks clients after repeated failed auth attempts. Off
+	// unless enabled.
+	Lockouts *LockoutConfig `json:"lockouts,omitempty"`
+	// Backend operations slower than this are logged. Defaults to 1000.
+	SlowOpMillis int `json:"slowOpMillis,omitempty"`
+	// Retries and circuit breakers for flaky mounts
+	Resilience *ResilienceConfig `json:"resilience,omitempty"`
+	// Options for individual exports, by mount name
+	Exports map[string]*ExportConfig `json:"exports,omitempty"`
+	// Redirects and rewrites, tried in order
+	Rewrites []*RewriteRule `json:"rewrites,omitempty"`
+	// Refuse requests for hosts not in domainMap or allowedHosts
+	StrictHosts  bool     `json:"strictHosts,omitempty"`
+	AllowedHosts []string `json:"allowedHosts,omitempty"`
+	// Path served to requests for a bare IP, like a domainMap entry
+	IpRoot string `json:"ipRoot,omitempty"`
+	// Recurring maintenance tasks
+	Tasks []*ScheduledTask `json:"tasks,omitempty"`
+	// Make destructive admin actions wait for a second owner to approve them
+	TwoPersonApproval bool `json:"twoPersonApproval,omitempty"`
+	// Keep file attributes as user xattrs on local exports, so they're
+	// shared with other tools
+	Xattrs bool `json:"xattrs,omitempty"`
+	// Keep past versions of files in local exports, which can be read
+	// with ?at=
+	Versioning bool `json:"versioning,omitempty"`
+	// Switch user and confine the process once ports are bound
+	Sandbox *SandboxConfig `json:"sandbox,omitempty"`
+	// Caps on the depth and size of meta.json listings
+	MetaLimits *MetaLimitsConfig `json:"metaLimits,omitempty"`
+	// Run on uploaded files once they're complete
+	Processors []*ProcessorRule `json:"processors,omitempty"`
+	// Mounts served by external programs, by mount name
+	ExecBackends map[string]*ExecBackendConfig `json:"execBackends,omitempty"`
+	// Mounts stored in a SQL database, by mount name. The server has to be
+	// built with the postgres or mysql tag for its driver.
+	SqlBackends map[string]*SqlBackendConfig `json:"sqlBackends,omitempty"`
+	// Keeps auth and upload state in Redis, for running several instances
+	Redis *RedisConfig `json:"redis,omitempty"`
+	// Serve one drive from several instances. Needs Redis.
+	Cluster *ClusterConfig `json:"cluster,omitempty"`
+	// Mounts spread across several shards, by mount name
+	ShardBackends map[string]*ShardBackendConfig `json:"shardBackends,omitempty"`
+	// Mounts kept on several shards with parity, by mount name
+	ErasureBackends map[string]*ErasureBackendConfig `json:"erasureBackends,omitempty"`
+	// Move files that go unused from local exports to other mounts
+	Tiering []*TieringRule `json:"tiering,omitempty"`
+	// Append-only directories for backups, ie restic repositories
+	BackupTargets []*BackupTargetConfig `json:"backupTargets,omitempty"`
+	// Container registry served at /v2/
+	Registry *RegistryConfig `json:"registry,omitempty"`
+	// Serve large public files as torrents, with the server as web seed
+	Torrents *TorrentConfig `json:"torrents,omitempty"`
+	// Other servers with copies of directories, listed in metalinks
+	DownloadMirrors []*DownloadMirror `json:"downloadMirrors,omitempty"`
+	// Files computed from templates in every directory under a path
+	VirtualFiles []*VirtualFileConfig `json:"virtualFiles,omitempty"`
+	// Header the trusted proxies put the client's country in, ie CF-IPCountry
+	GeoHeader string `json:"geoHeader,omitempty"`
+	// What can be uploaded where, and how names are tidied up
+	UploadPolicies []*UploadPolicy `json:"uploadPolicies,omitempty"`
+	// Mounts and everything about each, like whether it's read-only. Dirs
+	// are mounts with just a path.
+	Mounts []*MountConfig `json:"mounts,omitempty"`
+}
+
+type MirrorConfig struct {
+	Origin     string `json:"origin,omitempty"`
+	Token      string `json:"token,omitempty"`
+	PeerName   string `json:"peerName,omitempty"`
+	PeerKey    string `json:"peerKey,omitempty"`
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
+	CaCert     string `json:"caCert,omitempty"`
+	// Connection pooling, timeouts and retries for requests to the origin
+	Http *RemoteHttpConfig `json:"http,omitempty"`
+	// Serve listings and file ranges from a local cache, with TTLs
+	Cache *MirrorCacheConfig `json:"cache,omitempty"`
+}
+
+// Servers allowed to make signed requests on behalf of their users
+type PeerConfig struct {
+	Key  string `json:"key,omitempty"`
+	Perm string `json:"perm,omitempty"`
+}
+
+type DlnaConfig struct {
+	Name  string   `json:"name,omitempty"`
+	Token string   `json:"token,omitempty"`
+	Dirs  []string `json:"dirs,omitempty"`
 }
 
 type SmtpConfig struct {
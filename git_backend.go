@@ -0,0 +1,292 @@
+package gemdrive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// GitBackend exposes the trees of a (usually bare) git repository read-only.
+// The first path segment selects a branch, tag, or commit, and the rest of
+// the path is resolved within that commit's tree, ie /main/src/main.go.
+type GitBackend struct {
+	repoDir string
+}
+
+type gitTreeEntry struct {
+	mode    string
+	objType string
+	size    int64
+	name    string
+}
+
+func NewGitBackend(repoDir string) (*GitBackend, error) {
+	_, err := runGit(repoDir, "rev-parse", "--git-dir")
+	if err != nil {
+		return nil, fmt.Errorf("Not a git repository: %s", repoDir)
+	}
+
+	return &GitBackend{repoDir: repoDir}, nil
+}
+
+func (b *GitBackend) LocalDirs() ([]string, []string) {
+	return nil, []string{b.repoDir}
+}
+
+func (b *GitBackend) List(reqPath string, depth int) (*Item, error) {
+	if reqPath == "/" {
+		return b.listRefs()
+	}
+
+	ref, treePath, err := parseGitPath(reqPath)
+	if err != nil {
+		return nil, err
+	}
+
+	modTime, err := b.commitTime(ref)
+	if err != nil {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	return b.listTree(ref, treePath, modTime, depth)
+}
+
+func (b *GitBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	ref, treePath, err := parseGitPath(reqPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	object := ref + ":" + treePath
+
+	sizeOut, err := runGit(b.repoDir, "cat-file", "-s", object)
+	if err != nil {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(sizeOut)), 10, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	modTime, err := b.commitTime(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command("git", "cat-file", "blob", object)
+	cmd.Dir = b.repoDir
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = io.CopyN(ioutil.Discard, stdout, offset)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, nil, &Error{
+			HttpCode: 416,
+			Message:  "Invalid offset",
+		}
+	}
+
+	copyLength := length
+	if length == 0 {
+		copyLength = size - offset
+	}
+
+	item := &Item{
+		Size:    size,
+		ModTime: modTime,
+	}
+
+	return item, &cmdReadCloser{io.LimitReader(stdout, copyLength), cmd}, nil
+}
+
+func (b *GitBackend) listRefs() (*Item, error) {
+	out, err := runGit(b.repoDir, "for-each-ref", "--format=%(refname:short)", "refs/heads", "refs/tags")
+	if err != nil {
+		return nil, err
+	}
+
+	rootItem := &Item{
+		Children: make(map[string]*Item),
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		// Refs containing slashes can't be represented as a single path
+		// segment. They're still reachable by commit hash.
+		if line == "" || strings.Contains(line, "/") {
+			continue
+		}
+		rootItem.Children[line+"/"] = &Item{}
+	}
+
+	return rootItem, nil
+}
+
+func (b *GitBackend) listTree(ref, treePath, modTime string, depth int) (*Item, error) {
+	entries, err := b.lsTree(ref, treePath)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &Item{}
+
+	if len(entries) > 0 {
+		item.Children = make(map[string]*Item)
+	}
+
+	for _, entry := range entries {
+		if entry.objType == "tree" {
+			item.Children[entry.name+"/"] = &Item{ModTime: modTime}
+		} else if entry.objType == "blob" {
+			item.Children[entry.name] = &Item{
+				Size:         entry.size,
+				ModTime:      modTime,
+				IsExecutable: entry.mode == "100755",
+			}
+		}
+	}
+
+	if depth == 1 {
+		return item, nil
+	}
+
+	childDepth := 0
+	if depth > 1 {
+		childDepth = depth - 1
+	}
+
+	for _, entry := range entries {
+		if entry.objType != "tree" {
+			continue
+		}
+
+		childItem, err := b.listTree(ref, treePath+entry.name+"/", modTime, childDepth)
+		if err != nil {
+			return nil, err
+		}
+
+		childItem.ModTime = modTime
+		item.Children[entry.name+"/"] = childItem
+	}
+
+	return item, nil
+}
+
+func (b *GitBackend) lsTree(ref, treePath string) ([]gitTreeEntry, error) {
+	object := ref
+	if treePath != "" {
+		object = ref + ":" + treePath
+	}
+
+	out, err := runGit(b.repoDir, "ls-tree", "-z", "-l", object)
+	if err != nil {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	entries := []gitTreeEntry{}
+
+	for _, record := range bytes.Split(out, []byte{0}) {
+		if len(record) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(string(record), "\t", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid ls-tree output")
+		}
+
+		fields := strings.Fields(parts[0])
+		if len(fields) != 4 {
+			return nil, errors.New("Invalid ls-tree output")
+		}
+
+		var size int64
+		if fields[3] != "-" {
+			size, err = strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		entries = append(entries, gitTreeEntry{
+			mode:    fields[0],
+			objType: fields[1],
+			size:    size,
+			name:    parts[1],
+		})
+	}
+
+	return entries, nil
+}
+
+func (b *GitBackend) commitTime(ref string) (string, error) {
+	out, err := runGit(b.repoDir, "log", "-1", "--format=%cI", ref, "--")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Splits /<ref>/some/path into the ref and the path within its tree. Paths
+// to directories keep their trailing slash, which is what git expects in
+// <ref>:<path> object names.
+func parseGitPath(reqPath string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(reqPath, "/"), "/", 2)
+
+	ref := parts[0]
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return "", "", &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	treePath := ""
+	if len(parts) == 2 {
+		treePath = parts[1]
+	}
+
+	return ref, treePath, nil
+}
+
+func runGit(repoDir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repoDir
+	return cmd.Output()
+}
+
+// Closes the underlying command's stdout and reaps the process.
+type cmdReadCloser struct {
+	io.Reader
+	cmd *exec.Cmd
+}
+
+func (r *cmdReadCloser) Close() error {
+	r.cmd.Process.Kill()
+	r.cmd.Wait()
+	return nil
+}
@@ -1,8 +1,11 @@
 module github.com/gemdrive/gemdrive-go
 
-go 1.15
+go 1.16
 
 require (
 	github.com/GeertJohan/go.rice v1.0.0
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/lib/pq v1.10.9
 	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	golang.org/x/text v0.13.0
 )
@@ -0,0 +1,56 @@
+package gemdrive
+
+import (
+	"net"
+)
+
+// By default every hostname pointed at the server gets all of its exports,
+// and domainMap only narrows the ones it lists. With strictHosts, requests
+// for hosts not in domainMap or allowedHosts are refused instead, so a
+// stray DNS record can't expose everything. ipRoot picks what's served to
+// requests addressed to a bare IP, which also makes them allowed.
+
+// The path a host's requests are served from, if it's mapped to one.
+func (s *Server) hostRoot(hostname string) (string, bool) {
+	if mapRoot, exists := s.config.DomainMap[hostname]; exists {
+		return mapRoot, true
+	}
+
+	if s.config.IpRoot != "" && isIpHost(hostname) {
+		return s.config.IpRoot, true
+	}
+
+	return "", false
+}
+
+func (s *Server) hostAllowed(hostname string) bool {
+	if !s.config.StrictHosts {
+		return true
+	}
+
+	if _, mapped := s.hostRoot(hostname); mapped {
+		return true
+	}
+
+	for _, allowed := range s.config.AllowedHosts {
+		if hostname == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isIpHost(hostname string) bool {
+	host, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host = hostname
+	}
+
+	// Brackets stay on IPv6 hosts without ports
+	if len(host) > 2 && host[0] == '[' && host[len(host)-1] == ']' {
+		host = host[1 : len(host)-1]
+	}
+
+	return net.ParseIP(host) != nil
+}
@@ -0,0 +1,43 @@
+package gemdrive
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestForwardedHostOnlyFromTrustedProxies(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &Config{
+		Dirs:         []string{filepath.Join(dir, "files")},
+		DataDir:      filepath.Join(dir, "data"),
+		CacheDir:     filepath.Join(dir, "cache"),
+		StrictHosts:  true,
+		AllowedHosts: []string{"good.example"},
+	}
+
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func() int {
+		r := httptest.NewRequest("GET", "/gemdrive/version.json", nil)
+		r.Host = "bad.example"
+		r.Header.Set("X-Forwarded-Host", "good.example")
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := status(); code != 421 {
+		t.Errorf("untrusted X-Forwarded-Host got %d, want 421", code)
+	}
+
+	config.TrustedProxies = []string{"192.0.2.0/24"}
+
+	if code := status(); code != 200 {
+		t.Errorf("X-Forwarded-Host from a trusted proxy got %d, want 200", code)
+	}
+}
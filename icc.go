@@ -0,0 +1,156 @@
+package gemdrive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+// The standard library encoders drop embedded ICC profiles, which makes
+// thumbnails of wide-gamut photos look washed out. The profile segments are
+// copied verbatim from the source into the encoded thumbnail instead.
+
+const maxIccProfileSize = 4 * 1024 * 1024
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Returns the raw profile segments (JPEG APP2) or chunk (PNG iCCP), or nil
+// if there aren't any.
+func readIccProfile(reader io.Reader) []byte {
+	r := bufio.NewReader(reader)
+
+	header, err := r.Peek(8)
+	if err != nil {
+		return nil
+	}
+
+	if header[0] == 0xff && header[1] == 0xd8 {
+		return readJpegIccProfile(r)
+	}
+
+	if bytes.Equal(header, pngSignature) {
+		return readPngIccProfile(r)
+	}
+
+	return nil
+}
+
+func readJpegIccProfile(r *bufio.Reader) []byte {
+	var soi [2]byte
+	_, err := io.ReadFull(r, soi[:])
+	if err != nil {
+		return nil
+	}
+
+	var profile []byte
+
+	for {
+		var marker [4]byte
+		_, err := io.ReadFull(r, marker[:])
+		if err != nil || marker[0] != 0xff {
+			return profile
+		}
+
+		// Profiles live in the header segments before the image data
+		if marker[1] == 0xda {
+			return profile
+		}
+
+		segmentLen := int(binary.BigEndian.Uint16(marker[2:4])) - 2
+		if segmentLen < 0 {
+			return profile
+		}
+
+		if marker[1] != 0xe2 {
+			_, err = io.CopyN(ioutil.Discard, r, int64(segmentLen))
+			if err != nil {
+				return profile
+			}
+			continue
+		}
+
+		segment := make([]byte, segmentLen)
+		_, err = io.ReadFull(r, segment)
+		if err != nil {
+			return profile
+		}
+
+		if bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")) && len(profile) < maxIccProfileSize {
+			profile = append(profile, marker[:]...)
+			profile = append(profile, segment...)
+		}
+	}
+}
+
+func readPngIccProfile(r *bufio.Reader) []byte {
+	_, err := r.Discard(len(pngSignature))
+	if err != nil {
+		return nil
+	}
+
+	for {
+		var header [8]byte
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			return nil
+		}
+
+		length := binary.BigEndian.Uint32(header[:4])
+		chunkType := string(header[4:8])
+
+		// iCCP must come before image data
+		if chunkType == "IDAT" || chunkType == "IEND" || length > maxIccProfileSize {
+			return nil
+		}
+
+		if chunkType != "iCCP" {
+			_, err = io.CopyN(ioutil.Discard, r, int64(length)+4)
+			if err != nil {
+				return nil
+			}
+			continue
+		}
+
+		// Data plus CRC, which stays valid since it covers only the
+		// chunk's type and data
+		rest := make([]byte, length+4)
+		_, err = io.ReadFull(r, rest)
+		if err != nil {
+			return nil
+		}
+
+		return append(header[:], rest...)
+	}
+}
+
+// Inserts a profile read by readIccProfile into a freshly encoded image of
+// the same format.
+func addIccProfile(encoded, profile []byte) []byte {
+	if len(profile) == 0 {
+		return encoded
+	}
+
+	var insertAt int
+
+	switch {
+	case len(encoded) > 2 && encoded[0] == 0xff && encoded[1] == 0xd8 && profile[0] == 0xff:
+		// Straight after SOI
+		insertAt = 2
+	case bytes.HasPrefix(encoded, pngSignature) && string(profile[4:8]) == "iCCP":
+		// After the IHDR chunk, which is always first
+		insertAt = len(pngSignature) + 8 + 13 + 4
+		if len(encoded) < insertAt {
+			return encoded
+		}
+	default:
+		return encoded
+	}
+
+	result := make([]byte, 0, len(encoded)+len(profile))
+	result = append(result, encoded[:insertAt]...)
+	result = append(result, profile...)
+	result = append(result, encoded[insertAt:]...)
+	return result
+}
@@ -0,0 +1,105 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// Not a real profile, but readers only care about the framing.
+var fakeIccProfile = bytes.Repeat([]byte("wide-gamut"), 50)
+
+func jpegIccSegment(profile []byte) []byte {
+	data := append([]byte("ICC_PROFILE\x00\x01\x01"), profile...)
+	segment := []byte{0xff, 0xe2, byte((len(data) + 2) >> 8), byte(len(data) + 2)}
+	return append(segment, data...)
+}
+
+func pngIccChunk(profile []byte) []byte {
+	data := append([]byte("sRGB-ish\x00\x00"), profile...)
+
+	chunk := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, "iCCP"...)
+	chunk = append(chunk, data...)
+
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+func TestJpegIccRoundTrip(t *testing.T) {
+	var source bytes.Buffer
+	err := jpeg.Encode(&source, image.NewRGBA(image.Rect(0, 0, 16, 16)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segment := jpegIccSegment(fakeIccProfile)
+	withProfile := addIccProfile(source.Bytes(), segment)
+
+	profile := readIccProfile(bytes.NewReader(withProfile))
+	if !bytes.Equal(profile, segment) {
+		t.Fatalf("read back %d bytes, want the %d byte segment", len(profile), len(segment))
+	}
+
+	// Thumbnails are encoded fresh and given the source's profile
+	var thumb bytes.Buffer
+	err = jpeg.Encode(&thumb, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbWithProfile := addIccProfile(thumb.Bytes(), profile)
+
+	if !bytes.Equal(readIccProfile(bytes.NewReader(thumbWithProfile)), segment) {
+		t.Error("thumbnail lost the profile")
+	}
+
+	_, err = jpeg.Decode(bytes.NewReader(thumbWithProfile))
+	if err != nil {
+		t.Errorf("thumbnail with profile doesn't decode: %v", err)
+	}
+}
+
+func TestPngIccRoundTrip(t *testing.T) {
+	var thumb bytes.Buffer
+	err := png.Encode(&thumb, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := pngIccChunk(fakeIccProfile)
+	withProfile := addIccProfile(thumb.Bytes(), chunk)
+
+	if !bytes.Equal(readIccProfile(bytes.NewReader(withProfile)), chunk) {
+		t.Error("profile wasn't read back")
+	}
+
+	_, err = png.Decode(bytes.NewReader(withProfile))
+	if err != nil {
+		t.Errorf("thumbnail with profile doesn't decode: %v", err)
+	}
+}
+
+func TestIccProfileAbsent(t *testing.T) {
+	var plain bytes.Buffer
+	err := jpeg.Encode(&plain, image.NewRGBA(image.Rect(0, 0, 4, 4)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if profile := readIccProfile(bytes.NewReader(plain.Bytes())); profile != nil {
+		t.Errorf("got a %d byte profile from an image without one", len(profile))
+	}
+
+	// Profiles of one format aren't put into another
+	var pngThumb bytes.Buffer
+	png.Encode(&pngThumb, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if !bytes.Equal(addIccProfile(pngThumb.Bytes(), jpegIccSegment(fakeIccProfile)), pngThumb.Bytes()) {
+		t.Error("JPEG profile was added to a PNG")
+	}
+}
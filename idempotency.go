@@ -0,0 +1,414 @@
+package gemdrive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Writes carrying an Idempotency-Key header are only applied once. Retries
+// with the same key, from the same client, get the original response
+// replayed instead of repeating the write, so a client that lost the
+// response to a DELETE or truncating PUT can safely try again. Only
+// successes of authenticated requests are recorded, leaving clients free
+// to retry anything else for real. Results are kept for a day, appended to
+// a log in the data dir so they survive restarts, and each client can only
+// have so many.
+
+const idempotencyWindow = 24 * time.Hour
+
+// Recorded bodies are only ever short messages
+const maxIdempotentBodySize = 4096
+
+// Past this, a client's keys are ignored until its older results expire
+const maxIdempotentResultsPerClient = 1000
+
+// The log is rewritten once it holds this many more lines than results
+const idempotencyLogSlack = 1000
+
+type idempotentResult struct {
+	// Only set in the log
+	Id        string `json:"id,omitempty"`
+	Client    string `json:"client"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Status    int    `json:"status"`
+	Body      string `json:"body,omitempty"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// How long a request holds its key in cluster mode, in case the instance
+// running it dies
+const idempotencyClaimTimeout = time.Hour
+
+type idempotencyStore struct {
+	path       string
+	results    map[string]*idempotentResult
+	inProgress map[string]bool
+	// Results by client
+	counts map[string]int
+	// Lines in the log
+	logged int
+	mut    *sync.Mutex
+	// Results are kept in Redis instead in cluster mode
+	shared *redisClient
+}
+
+func newIdempotencyStore(dataDir string, cluster *cluster) *idempotencyStore {
+	store := &idempotencyStore{
+		path:       filepath.Join(dataDir, "gemdrive_idempotency.log"),
+		results:    make(map[string]*idempotentResult),
+		inProgress: make(map[string]bool),
+		counts:     make(map[string]int),
+		mut:        &sync.Mutex{},
+	}
+
+	if cluster != nil {
+		store.shared = cluster.shared
+		return store
+	}
+
+	err := store.load()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Println("Failed to load idempotency state:", err)
+	}
+
+	return store
+}
+
+// Replays the log, one result per line. Later lines for an id win.
+func (st *idempotencyStore) load() error {
+	file, err := os.Open(st.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := time.Now().Unix()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		st.logged++
+
+		var result *idempotentResult
+		err := json.Unmarshal(scanner.Bytes(), &result)
+		if err != nil || result == nil || result.Id == "" {
+			fmt.Println("Ignoring invalid idempotency log line")
+			continue
+		}
+
+		if result.ExpiresAt < now {
+			continue
+		}
+
+		if old, exists := st.results[result.Id]; exists {
+			st.counts[old.Client]--
+		}
+		st.results[result.Id] = result
+		st.counts[result.Client]++
+	}
+
+	return scanner.Err()
+}
+
+// Keys are only meaningful to the client that chose them. Clients and keys
+// are stored hashed so the log doesn't hold tokens.
+func idempotencyId(r *http.Request, key string) string {
+	hash := sha256.Sum256([]byte(streamClient(r) + "\n" + key))
+	return hex.EncodeToString(hash[:])
+}
+
+func idempotencyClient(r *http.Request) string {
+	hash := sha256.Sum256([]byte(streamClient(r)))
+	return hex.EncodeToString(hash[:])
+}
+
+// Runs handle unless the request's idempotency key has been seen before, in
+// which case the earlier response is sent instead. Must only be used for
+// authenticated requests.
+func (st *idempotencyStore) serve(w http.ResponseWriter, r *http.Request, reqPath string, handle func(w http.ResponseWriter)) {
+	id := idempotencyId(r, r.Header.Get("Idempotency-Key"))
+
+	result, claimed, err := st.claim(id)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if result != nil {
+		if result.Method != r.Method || result.Path != reqPath {
+			w.WriteHeader(400)
+			io.WriteString(w, "Idempotency key was used for a different request")
+			return
+		}
+
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(result.Status)
+		io.WriteString(w, result.Body)
+		return
+	}
+
+	if !claimed {
+		w.WriteHeader(409)
+		io.WriteString(w, "A request with this idempotency key is in progress")
+		return
+	}
+
+	recorder := &responseRecorder{ResponseWriter: w}
+	handle(recorder)
+
+	status := recorder.status
+	if status == 0 {
+		status = 200
+	}
+
+	if status < 200 || status >= 300 {
+		st.release(id, nil)
+		return
+	}
+
+	st.release(id, &idempotentResult{
+		Client:    idempotencyClient(r),
+		Method:    r.Method,
+		Path:      reqPath,
+		Status:    status,
+		Body:      recorder.body.String(),
+		ExpiresAt: time.Now().Add(idempotencyWindow).Unix(),
+	})
+}
+
+// Returns the earlier result for id if there is one, or else whether id was
+// claimed for running the request, which fails if it's already running.
+func (st *idempotencyStore) claim(id string) (*idempotentResult, bool, error) {
+	if st.shared != nil {
+		var result *idempotentResult
+		exists, err := st.shared.getJson("idempotency:"+id, &result)
+		if err != nil || (exists && result != nil) {
+			return result, false, err
+		}
+
+		claimed, err := st.shared.setNX("idempotency_claim:"+id, "1", idempotencyClaimTimeout)
+		if err != nil || !claimed {
+			return nil, false, err
+		}
+
+		// It may have finished in between
+		exists, err = st.shared.getJson("idempotency:"+id, &result)
+		if err != nil || (exists && result != nil) {
+			st.shared.del("idempotency_claim:" + id)
+			return result, false, err
+		}
+
+		return nil, true, nil
+	}
+
+	st.mut.Lock()
+	defer st.mut.Unlock()
+
+	st.expire()
+
+	if result, exists := st.results[id]; exists {
+		return result, false, nil
+	}
+
+	if st.inProgress[id] {
+		return nil, false, nil
+	}
+
+	st.inProgress[id] = true
+
+	return nil, true, nil
+}
+
+// Ends the claim on id, recording result unless it's nil or its client
+// already has too many.
+func (st *idempotencyStore) release(id string, result *idempotentResult) {
+	if st.shared != nil {
+		var err error
+		if result != nil {
+			err = st.saveShared(id, result)
+		}
+		if err == nil {
+			_, err = st.shared.del("idempotency_claim:" + id)
+		}
+		if err != nil {
+			fmt.Println("Failed to save idempotency state:", err)
+		}
+		return
+	}
+
+	st.mut.Lock()
+	defer st.mut.Unlock()
+
+	delete(st.inProgress, id)
+
+	if result == nil || st.counts[result.Client] >= maxIdempotentResultsPerClient {
+		return
+	}
+
+	st.results[id] = result
+	st.counts[result.Client]++
+
+	err := st.append(id, result)
+	if err != nil {
+		fmt.Println("Failed to save idempotency state:", err)
+	}
+}
+
+// In Redis, results expire by themselves, so clients are limited in how
+// many they can record per window instead.
+func (st *idempotencyStore) saveShared(id string, result *idempotentResult) error {
+	countKey := "idempotency_count:" + result.Client
+
+	count, err := st.shared.incr(countKey)
+	if err != nil {
+		return err
+	}
+
+	if count == 1 {
+		err = st.shared.expire(countKey, idempotencyWindow)
+		if err != nil {
+			return err
+		}
+	}
+
+	if count > maxIdempotentResultsPerClient {
+		return nil
+	}
+
+	return st.shared.setJson("idempotency:"+id, result, idempotencyWindow)
+}
+
+// Must be called with the lock held.
+func (st *idempotencyStore) append(id string, result *idempotentResult) error {
+	if st.logged > len(st.results)+idempotencyLogSlack {
+		return st.compact()
+	}
+
+	entry := *result
+	entry.Id = id
+
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(st.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	st.logged++
+
+	return nil
+}
+
+// Rewrites the log with just the current results. Must be called with the
+// lock held.
+func (st *idempotencyStore) compact() error {
+	st.expire()
+
+	tmpPath := st.path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(file)
+	for id, result := range st.results {
+		entry := *result
+		entry.Id = id
+
+		line, err := json.Marshal(&entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(append(line, '\n'))
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, st.path)
+	if err != nil {
+		return err
+	}
+
+	st.logged = len(st.results)
+
+	return nil
+}
+
+func (st *idempotencyStore) expire() {
+	now := time.Now().Unix()
+	for id, result := range st.results {
+		if result.ExpiresAt < now {
+			delete(st.results, id)
+			st.counts[result.Client]--
+			if st.counts[result.Client] <= 0 {
+				delete(st.counts, result.Client)
+			}
+		}
+	}
+}
+
+// Passes a response through while keeping its status and the start of its
+// body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+
+	remaining := maxIdempotentBodySize - w.body.Len()
+	if remaining > 0 {
+		if len(p) > remaining {
+			w.body.Write(p[:remaining])
+		} else {
+			w.body.Write(p)
+		}
+	}
+
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,72 @@
+package gemdrive
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"runtime"
+)
+
+const defaultMaxSourcePixels = 100 * 1000 * 1000
+
+type ImageConfig struct {
+	// Images decoded and resized at once. Defaults to the number of CPUs.
+	Workers int `json:"workers,omitempty"`
+	// Largest source image accepted, in pixels. Decoding needs roughly 4
+	// bytes per pixel.
+	MaxSourcePixels int64 `json:"maxSourcePixels,omitempty"`
+	// Keep GIF animation when resizing, and make animated previews of
+	// videos with ffmpeg
+	AnimatedPreviews bool `json:"animatedPreviews,omitempty"`
+}
+
+// ImagePool bounds the memory used for generating thumbnails by limiting
+// how many images are decoded at once and how large they may be.
+type ImagePool struct {
+	slots     chan struct{}
+	maxPixels int64
+	animated  bool
+}
+
+func NewImagePool(config *ImageConfig) *ImagePool {
+	workers := config.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	maxPixels := config.MaxSourcePixels
+	if maxPixels < 1 {
+		maxPixels = defaultMaxSourcePixels
+	}
+
+	return &ImagePool{
+		slots:     make(chan struct{}, workers),
+		maxPixels: maxPixels,
+		animated:  config.AnimatedPreviews,
+	}
+}
+
+// Checks the image dimensions from its header, before anything large is
+// allocated.
+func (p *ImagePool) checkSource(reader io.Reader) error {
+	config, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return err
+	}
+
+	pixels := int64(config.Width) * int64(config.Height)
+	if pixels > p.maxPixels {
+		return &Error{
+			HttpCode: 413,
+			Message:  fmt.Sprintf("Source image too large (%dx%d)", config.Width, config.Height),
+		}
+	}
+
+	return nil
+}
+
+func (p *ImagePool) run(work func() error) error {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+	return work()
+}
@@ -0,0 +1,283 @@
+package gemdrive
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nfnt/resize"
+)
+
+// Thumbnails are requested as gemdrive/images/<size>/<filename>, where size
+// is either N for an N by N box or WxH. Query parameters adjust the result:
+//
+//   fit=contain|cover - scale to fit inside the box (default), or to fill it
+//                       and crop the overflow
+//   autoRotate=false  - ignore the EXIF orientation
+//   rotate=90|180|270 - rotate clockwise, after any auto rotation
+//   quality=1-100     - JPEG quality
+//
+// Thumbnails have an ETag and Last-Modified from their source file and
+// options, so clients that already have one get a 304 without it being read
+// or generated again.
+
+type ImageOptions struct {
+	Width      int
+	Height     int
+	Fit        string
+	AutoRotate bool
+	Rotate     int
+	Quality    int
+}
+
+func parseImageOptions(sizeStr string, query url.Values) (*ImageOptions, error) {
+	opts := &ImageOptions{
+		Fit:        "contain",
+		AutoRotate: true,
+	}
+
+	dims := strings.Split(sizeStr, "x")
+	if len(dims) > 2 {
+		return nil, errors.New("Invalid size")
+	}
+
+	var err error
+	opts.Width, err = strconv.Atoi(dims[0])
+	if err != nil || opts.Width < 1 {
+		return nil, errors.New("Invalid size")
+	}
+
+	opts.Height = opts.Width
+	if len(dims) == 2 {
+		opts.Height, err = strconv.Atoi(dims[1])
+		if err != nil || opts.Height < 1 {
+			return nil, errors.New("Invalid size")
+		}
+	}
+
+	if fit := query.Get("fit"); fit != "" {
+		if fit != "contain" && fit != "cover" {
+			return nil, errors.New("Invalid fit")
+		}
+		opts.Fit = fit
+	}
+
+	if query.Get("autoRotate") == "false" {
+		opts.AutoRotate = false
+	}
+
+	if rotate := query.Get("rotate"); rotate != "" {
+		opts.Rotate, err = strconv.Atoi(rotate)
+		if err != nil || (opts.Rotate != 0 && opts.Rotate != 90 && opts.Rotate != 180 && opts.Rotate != 270) {
+			return nil, errors.New("Invalid rotate")
+		}
+	}
+
+	if quality := query.Get("quality"); quality != "" {
+		opts.Quality, err = strconv.Atoi(quality)
+		if err != nil || opts.Quality < 1 || opts.Quality > 100 {
+			return nil, errors.New("Invalid quality")
+		}
+	}
+
+	return opts, nil
+}
+
+// Names the cache directory for images generated with these options. Plain
+// square thumbnails keep the original images/<size>/ layout.
+func (o *ImageOptions) cacheKey() string {
+	key := strconv.Itoa(o.Width)
+	if o.Height != o.Width {
+		key = fmt.Sprintf("%dx%d", o.Width, o.Height)
+	}
+
+	if o.Fit == "cover" {
+		key += "-cover"
+	}
+	if !o.AutoRotate {
+		key += "-noauto"
+	}
+	if o.Rotate != 0 {
+		key += fmt.Sprintf("-r%d", o.Rotate)
+	}
+	if o.Quality != 0 {
+		key += fmt.Sprintf("-q%d", o.Quality)
+	}
+
+	return key
+}
+
+// The longest side, for previews which only support square boxes.
+func (o *ImageOptions) maxSize() int {
+	if o.Width > o.Height {
+		return o.Width
+	}
+	return o.Height
+}
+
+// Orientation is the EXIF orientation of the source, or 0 if unknown.
+func transformImage(img image.Image, orientation int, opts *ImageOptions) image.Image {
+	if opts.AutoRotate && orientation > 1 {
+		img = orientImage(img, orientation)
+	}
+
+	switch opts.Rotate {
+	case 90:
+		img = orientImage(img, 6)
+	case 180:
+		img = orientImage(img, 3)
+	case 270:
+		img = orientImage(img, 8)
+	}
+
+	bounds := img.Bounds()
+	width := float64(bounds.Dx())
+	height := float64(bounds.Dy())
+
+	scaleX := float64(opts.Width) / width
+	scaleY := float64(opts.Height) / height
+
+	if opts.Fit != "cover" {
+		if scaleX < scaleY {
+			return resize.Resize(uint(opts.Width), 0, img, resize.Lanczos3)
+		}
+		return resize.Resize(0, uint(opts.Height), img, resize.Lanczos3)
+	}
+
+	var scaled image.Image
+	if scaleX > scaleY {
+		scaled = resize.Resize(uint(opts.Width), 0, img, resize.Lanczos3)
+	} else {
+		scaled = resize.Resize(0, uint(opts.Height), img, resize.Lanczos3)
+	}
+
+	// Crop the overflow equally from both sides
+	scaledBounds := scaled.Bounds()
+	x := scaledBounds.Min.X + (scaledBounds.Dx()-opts.Width)/2
+	y := scaledBounds.Min.Y + (scaledBounds.Dy()-opts.Height)/2
+
+	cropped := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	draw.Draw(cropped, cropped.Bounds(), scaled, image.Pt(x, y), draw.Src)
+
+	return cropped
+}
+
+// Applies one of the 8 EXIF orientations, mapping each source pixel to where
+// it belongs for the image to display upright.
+func orientImage(img image.Image, orientation int) image.Image {
+	bounds := img.Bounds()
+	w := bounds.Dx()
+	h := bounds.Dy()
+
+	var dest *image.RGBA
+	if orientation >= 5 {
+		dest = image.NewRGBA(image.Rect(0, 0, h, w))
+	} else {
+		dest = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			dest.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	return dest
+}
+
+// The ETag of a thumbnail of item made with opts.
+func imageETag(item *Item, opts *ImageOptions, animated bool) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%d %s %s %t", item.Size, item.ModTime, opts.cacheKey(), animated)))
+	return fmt.Sprintf(`"%x"`, hash[:16])
+}
+
+func (s *Server) serveImage(w http.ResponseWriter, r *http.Request, dirPath, sizeStr, filename string) {
+	b, ok := s.backend.(ImageServer)
+	if !ok {
+		return
+	}
+
+	opts, err := parseImageOptions(sizeStr, r.URL.Query())
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	header := w.Header()
+
+	// Backends that don't list the source just don't get validators
+	var modTime time.Time
+	if parent, err := s.backend.List(dirPath, 1); err == nil && parent.Children[filename] != nil {
+		item := parent.Children[filename]
+		animated := s.config.Images != nil && s.config.Images.AnimatedPreviews
+		etag := imageETag(item, opts, animated)
+		header.Set("ETag", etag)
+
+		modTime, err = time.Parse(time.RFC3339, item.ModTime)
+		if err == nil {
+			header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		}
+
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(304)
+			return
+		}
+	}
+
+	imagePath := path.Join(dirPath, filename)
+	img, _, err := b.GetImage(imagePath, opts)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		w.Write([]byte(e.Message))
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if contentType := thumbnailContentType(filename); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	// Cached thumbnails can be fetched in parts, and ServeContent handles
+	// If-Modified-Since and If-Range
+	if seeker, ok := img.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", modTime, seeker)
+		return
+	}
+
+	_, err = io.Copy(w, img)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,124 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// Each pixel's red and green are its own coordinates, so it's possible to
+// tell where every pixel ended up.
+func coordinateImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	return img
+}
+
+func TestOrientImage(t *testing.T) {
+	const w, h = 4, 3
+
+	// Where the source's top left pixel, and the one to its right, should
+	// end up for the image to display upright, per the EXIF spec
+	tests := []struct {
+		orientation int
+		topLeft     image.Point
+		nextRight   image.Point
+	}{
+		{1, image.Pt(0, 0), image.Pt(1, 0)},
+		{2, image.Pt(w-1, 0), image.Pt(w-2, 0)},
+		{3, image.Pt(w-1, h-1), image.Pt(w-2, h-1)},
+		{4, image.Pt(0, h-1), image.Pt(1, h-1)},
+		{5, image.Pt(0, 0), image.Pt(0, 1)},
+		{6, image.Pt(h-1, 0), image.Pt(h-1, 1)},
+		{7, image.Pt(h-1, w-1), image.Pt(h-1, w-2)},
+		{8, image.Pt(0, w-1), image.Pt(0, w-2)},
+	}
+
+	for _, test := range tests {
+		oriented := orientImage(coordinateImage(w, h), test.orientation)
+
+		bounds := oriented.Bounds()
+		wantW, wantH := w, h
+		if test.orientation >= 5 {
+			wantW, wantH = h, w
+		}
+		if bounds.Dx() != wantW || bounds.Dy() != wantH {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", test.orientation, bounds.Dx(), bounds.Dy(), wantW, wantH)
+			continue
+		}
+
+		for src, dest := range map[image.Point]image.Point{
+			image.Pt(0, 0): test.topLeft,
+			image.Pt(1, 0): test.nextRight,
+		} {
+			r, g, _, _ := oriented.At(dest.X, dest.Y).RGBA()
+			got := image.Pt(int(r>>8), int(g>>8))
+			if got != src {
+				t.Errorf("orientation %d: pixel at %v came from %v, want %v", test.orientation, dest, got, src)
+			}
+		}
+	}
+}
+
+func TestTransformImageAutoRotate(t *testing.T) {
+	img := coordinateImage(40, 20)
+
+	opts := &ImageOptions{Width: 10, Height: 10, Fit: "contain", AutoRotate: true}
+	bounds := transformImage(img, 6, opts).Bounds()
+	if bounds.Dx() != 5 || bounds.Dy() != 10 {
+		t.Errorf("got %dx%d, want a portrait 5x10", bounds.Dx(), bounds.Dy())
+	}
+
+	opts.AutoRotate = false
+	bounds = transformImage(img, 6, opts).Bounds()
+	if bounds.Dx() != 10 || bounds.Dy() != 5 {
+		t.Errorf("without autoRotate got %dx%d, want 10x5", bounds.Dx(), bounds.Dy())
+	}
+}
+
+// A JPEG with an APP1 segment holding just an orientation tag.
+func jpegWithOrientation(t *testing.T, orientation uint16) []byte {
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, coordinateImage(8, 8), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("II")
+	binary.Write(tiff, binary.LittleEndian, uint16(42))
+	binary.Write(tiff, binary.LittleEndian, uint32(8))
+	binary.Write(tiff, binary.LittleEndian, uint16(1))
+	binary.Write(tiff, binary.LittleEndian, uint16(exifTagOrientation))
+	binary.Write(tiff, binary.LittleEndian, uint16(3))
+	binary.Write(tiff, binary.LittleEndian, uint32(1))
+	binary.Write(tiff, binary.LittleEndian, orientation)
+	binary.Write(tiff, binary.LittleEndian, uint16(0))
+	binary.Write(tiff, binary.LittleEndian, uint32(0))
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+
+	out := []byte{0xff, 0xd8, 0xff, 0xe1}
+	out = append(out, byte((len(segment)+2)>>8), byte(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, encoded.Bytes()[2:]...)
+}
+
+func TestReadExifOrientation(t *testing.T) {
+	for _, orientation := range []uint16{1, 3, 6, 8} {
+		data, err := readExif(bytes.NewReader(jpegWithOrientation(t, orientation)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.Orientation != int(orientation) {
+			t.Errorf("got orientation %d, want %d", data.Orientation, orientation)
+		}
+	}
+}
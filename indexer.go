@@ -0,0 +1,288 @@
+package gemdrive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On a fresh cache, the indexer walks each local export in the background
+// computing checksums and media metadata, so the first requests for them
+// don't have to. It backs off while transfers are running, so serving
+// always takes priority. Exports which finished indexing aren't walked again
+// on later starts; from then on the caches are kept current as files change.
+
+type IndexConfig struct {
+	// Exports to skip
+	Disabled []string `json:"disabled,omitempty"`
+}
+
+type IndexStatus struct {
+	Export       string `json:"export"`
+	State        string `json:"state"`
+	DirsScanned  int    `json:"dirsScanned"`
+	FilesScanned int    `json:"filesScanned"`
+	BytesHashed  int64  `json:"bytesHashed"`
+	CurrentPath  string `json:"currentPath,omitempty"`
+	StartedAt    string `json:"startedAt,omitempty"`
+	FinishedAt   string `json:"finishedAt,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type indexer struct {
+	exports  map[string]*FileSystemBackend
+	statuses map[string]*IndexStatus
+	stateDir string
+	busy     func() bool
+	mut      *sync.Mutex
+}
+
+func newIndexer(config *IndexConfig, exports map[string]*FileSystemBackend, stateDir string, busy func() bool) *indexer {
+	statuses := make(map[string]*IndexStatus)
+
+	for name := range exports {
+		status := &IndexStatus{
+			Export: name,
+			State:  "pending",
+		}
+
+		for _, disabled := range config.Disabled {
+			if disabled == name {
+				status.State = "disabled"
+			}
+		}
+
+		statuses[name] = status
+	}
+
+	return &indexer{
+		exports:  exports,
+		statuses: statuses,
+		stateDir: stateDir,
+		busy:     busy,
+		mut:      &sync.Mutex{},
+	}
+}
+
+func (ix *indexer) Run(ctx context.Context) {
+	names := []string{}
+	for name := range ix.exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		status := ix.statuses[name]
+
+		if status.State == "disabled" || ix.loadFinished(name) {
+			continue
+		}
+
+		ix.runExport(ctx, name)
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Walks an export again, even if it's been indexed, to catch up on changes
+// made while the server wasn't running.
+func (ix *indexer) Reindex(ctx context.Context, name string) error {
+	ix.mut.Lock()
+	status, exists := ix.statuses[name]
+	if !exists || status.State == "disabled" {
+		ix.mut.Unlock()
+		return fmt.Errorf("Indexing not enabled for %s", name)
+	}
+	if status.State == "running" {
+		ix.mut.Unlock()
+		return fmt.Errorf("%s is already being indexed", name)
+	}
+	status.State = "running"
+	ix.mut.Unlock()
+
+	return ix.runExport(ctx, name)
+}
+
+func (ix *indexer) runExport(ctx context.Context, name string) error {
+	ix.update(name, func(status *IndexStatus) {
+		*status = IndexStatus{
+			Export:    name,
+			State:     "running",
+			StartedAt: time.Now().UTC().Format(time.RFC3339),
+		}
+	})
+
+	err := ix.indexExport(ctx, name)
+
+	ix.update(name, func(status *IndexStatus) {
+		status.CurrentPath = ""
+		if err != nil {
+			status.State = "failed"
+			status.Error = err.Error()
+		} else {
+			status.State = "done"
+			status.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	ix.mut.Lock()
+	err = saveJson(ix.statuses[name], ix.statePath(name))
+	ix.mut.Unlock()
+	if err != nil {
+		fmt.Println("Failed to save index state:", err)
+	}
+
+	return nil
+}
+
+func (ix *indexer) indexExport(ctx context.Context, name string) error {
+	backend := ix.exports[name]
+
+	// Breadth first, so the top of the tree is ready soonest
+	queue := []string{"/"}
+
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		ix.update(name, func(status *IndexStatus) {
+			status.CurrentPath = dir
+		})
+
+		item, err := backend.List(dir, 1)
+		if err != nil {
+			// Directories can vanish mid-walk
+			continue
+		}
+
+		for childName, child := range item.Children {
+			if strings.HasSuffix(childName, "/") {
+				queue = append(queue, dir+childName)
+				continue
+			}
+
+			err := ix.waitIdle(ctx)
+			if err != nil {
+				return err
+			}
+
+			childPath := dir + childName
+
+			_, err = backend.GetChecksums(childPath)
+			if err == nil && (isImageName(childName) || isAudioName(childName)) {
+				_, err = backend.GetMediaMeta(childPath)
+			}
+			if err != nil {
+				fmt.Println("Failed to index", childPath, err)
+			}
+
+			ix.update(name, func(status *IndexStatus) {
+				status.FilesScanned++
+				status.BytesHashed += child.Size
+			})
+		}
+
+		ix.update(name, func(status *IndexStatus) {
+			status.DirsScanned++
+		})
+	}
+
+	return nil
+}
+
+func (ix *indexer) waitIdle(ctx context.Context) error {
+	for ix.busy() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return ctx.Err()
+}
+
+func (ix *indexer) update(name string, change func(status *IndexStatus)) {
+	ix.mut.Lock()
+	defer ix.mut.Unlock()
+	change(ix.statuses[name])
+}
+
+func (ix *indexer) statePath(name string) string {
+	return filepath.Join(ix.stateDir, name+".json")
+}
+
+func (ix *indexer) loadFinished(name string) bool {
+	stateJson, err := ioutil.ReadFile(ix.statePath(name))
+	if err != nil {
+		return false
+	}
+
+	var saved IndexStatus
+	err = json.Unmarshal(stateJson, &saved)
+	if err != nil || saved.State != "done" {
+		return false
+	}
+
+	ix.update(name, func(status *IndexStatus) {
+		*status = saved
+	})
+
+	return true
+}
+
+func (ix *indexer) Status() []*IndexStatus {
+	ix.mut.Lock()
+	defer ix.mut.Unlock()
+
+	statuses := []*IndexStatus{}
+	for _, status := range ix.statuses {
+		statusCopy := *status
+		statuses = append(statuses, &statusCopy)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Export < statuses[j].Export
+	})
+
+	return statuses
+}
+
+// Handles gemdrive/index/status
+func (s *Server) serveIndexStatus(w http.ResponseWriter, r *http.Request) {
+	token, _ := extractToken(r)
+
+	if !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	if s.indexer == nil {
+		w.WriteHeader(404)
+		io.WriteString(w, "Indexing not enabled")
+		return
+	}
+
+	jsonBody, err := json.Marshal(s.indexer.Status())
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
@@ -0,0 +1,143 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Clients that send "Accept: application/json" get errors as
+//
+//   {"code": "not_found", "message": "Not found"}
+//
+// rather than a bare text body. The code is one of errorCodes and only
+// depends on the status, so clients can branch on it without parsing
+// messages. Handlers keep writing plain text errors, which are converted on
+// the way out.
+
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+var errorCodes = map[int]string{
+	400: "invalid_request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	405: "method_not_allowed",
+	409: "conflict",
+	410: "gone",
+	412: "precondition_failed",
+	413: "too_large",
+	416: "invalid_range",
+	422: "unprocessable",
+	429: "too_many_requests",
+	500: "internal_error",
+	501: "not_implemented",
+	502: "bad_gateway",
+	503: "unavailable",
+	507: "insufficient_storage",
+}
+
+// Messages longer than this are cut off
+const maxErrorMessageSize = 64 * 1024
+
+func errorCode(status int) string {
+	if code, exists := errorCodes[status]; exists {
+		return code
+	}
+
+	if status >= 500 {
+		return "server_error"
+	}
+
+	return "client_error"
+}
+
+// Every code a client can receive, for documentation.
+func allErrorCodes() []string {
+	codes := []string{"client_error", "server_error"}
+	for _, code := range errorCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+func wantsJsonErrors(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// Holds back error responses until the handler is done, then sends them as
+// JSON. Successful responses pass straight through.
+type jsonErrorWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	status      int
+	message     bytes.Buffer
+}
+
+func (w *jsonErrorWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	if status >= 400 {
+		w.status = status
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *jsonErrorWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+
+	if w.status == 0 {
+		return w.ResponseWriter.Write(p)
+	}
+
+	remaining := maxErrorMessageSize - w.message.Len()
+	if remaining > 0 {
+		if len(p) > remaining {
+			w.message.Write(p[:remaining])
+		} else {
+			w.message.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *jsonErrorWriter) finish() {
+	if w.status == 0 {
+		return
+	}
+
+	message := strings.TrimSpace(w.message.String())
+	if message == "" {
+		message = http.StatusText(w.status)
+	}
+
+	jsonBody, err := json.Marshal(&ErrorResponse{
+		Code:    errorCode(w.status),
+		Message: message,
+	})
+	if err != nil {
+		w.ResponseWriter.WriteHeader(500)
+		return
+	}
+
+	header := w.ResponseWriter.Header()
+	header.Set("Content-Type", "application/json")
+	header.Del("Content-Length")
+	header.Del("Content-Disposition")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(jsonBody)
+}
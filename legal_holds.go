@@ -0,0 +1,316 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Legal holds stop anything at or under a path from being written, moved or
+// deleted, whatever the ACLs allow, until they're lifted. Owners of the
+// whole drive place them with a POST to gemdrive/admin/holds and lift them
+// with a DELETE to gemdrive/admin/holds/<id>, which needs a second owner
+// with two-person approval. Who placed or lifted each hold is logged.
+//
+// Holds are kept in the data dir, and read again whenever the file changes,
+// so every instance of a cluster sees them.
+
+type LegalHold struct {
+	Id       string   `json:"id"`
+	Path     string   `json:"path"`
+	Reason   string   `json:"reason,omitempty"`
+	PlacedBy []string `json:"placedBy"`
+	PlacedAt string   `json:"placedAt"`
+}
+
+var errLegalHold = &Error{
+	HttpCode: 403,
+	Message:  "Under legal hold",
+}
+
+type legalHolds struct {
+	holds   []*LegalHold
+	path    string
+	modTime time.Time
+	cluster *cluster
+	mut     *sync.Mutex
+}
+
+func newLegalHolds(dataDir string, cluster *cluster) *legalHolds {
+	return &legalHolds{
+		holds:   []*LegalHold{},
+		path:    filepath.Join(dataDir, "gemdrive_legal_holds.json"),
+		cluster: cluster,
+		mut:     &sync.Mutex{},
+	}
+}
+
+// Must be called with the lock held.
+func (h *legalHolds) reload() {
+	info, err := os.Stat(h.path)
+	if os.IsNotExist(err) {
+		h.holds = []*LegalHold{}
+		h.modTime = time.Time{}
+		return
+	} else if err != nil || info.ModTime().Equal(h.modTime) {
+		return
+	}
+
+	holdsJson, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		fmt.Println("Failed to read legal holds:", err)
+		return
+	}
+
+	var holds []*LegalHold
+	err = json.Unmarshal(holdsJson, &holds)
+	if err != nil {
+		// Keep enforcing the holds already known
+		fmt.Println("Ignoring invalid legal holds:", err)
+		return
+	}
+
+	h.holds = holds
+	h.modTime = info.ModTime()
+}
+
+// Must be called with the lock held.
+func (h *legalHolds) persist() error {
+	err := saveJson(h.holds, h.path)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(h.path)
+	if err == nil {
+		h.modTime = info.ModTime()
+	}
+
+	return nil
+}
+
+func (h *legalHolds) list() []*LegalHold {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	h.reload()
+
+	holds := append([]*LegalHold{}, h.holds...)
+	sort.Slice(holds, func(i, j int) bool {
+		return holds[i].PlacedAt < holds[j].PlacedAt
+	})
+
+	return holds
+}
+
+// Paths of directories end in a slash, like everywhere else.
+func (h *legalHolds) place(reqPath, reason string, placedBy []string) (*LegalHold, error) {
+	if !strings.HasPrefix(reqPath, "/") || reqPath == "/" || path.Clean(reqPath) != strings.TrimSuffix(reqPath, "/") {
+		return nil, &Error{
+			HttpCode: 400,
+			Message:  "Invalid path",
+		}
+	}
+
+	id, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	defer h.cluster.lock("legalHolds")()
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	h.reload()
+
+	hold := &LegalHold{
+		Id:       id,
+		Path:     reqPath,
+		Reason:   reason,
+		PlacedBy: placedBy,
+		PlacedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	h.holds = append(h.holds, hold)
+
+	err = h.persist()
+	if err != nil {
+		h.holds = h.holds[:len(h.holds)-1]
+		return nil, err
+	}
+
+	fmt.Println("Legal hold", id, "placed on", reqPath, "by", strings.Join(placedBy, ","))
+
+	return hold, nil
+}
+
+func (h *legalHolds) lift(id string, liftedBy []string) error {
+	defer h.cluster.lock("legalHolds")()
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	h.reload()
+
+	for i, hold := range h.holds {
+		if hold.Id != id {
+			continue
+		}
+
+		remaining := append(append([]*LegalHold{}, h.holds[:i]...), h.holds[i+1:]...)
+		previous := h.holds
+		h.holds = remaining
+
+		err := h.persist()
+		if err != nil {
+			h.holds = previous
+			return err
+		}
+
+		fmt.Println("Legal hold", id, "on", hold.Path, "lifted by", strings.Join(liftedBy, ","))
+
+		return nil
+	}
+
+	return &Error{
+		HttpCode: 404,
+		Message:  "No such hold",
+	}
+}
+
+func (h *legalHolds) get(id string) *LegalHold {
+	for _, hold := range h.list() {
+		if hold.Id == id {
+			return hold
+		}
+	}
+	return nil
+}
+
+func heldBy(hold *LegalHold, reqPath string) bool {
+	if strings.HasSuffix(hold.Path, "/") {
+		return strings.HasPrefix(reqPath, hold.Path) || reqPath == strings.TrimSuffix(hold.Path, "/")
+	}
+	return reqPath == hold.Path || reqPath == hold.Path+"/"
+}
+
+// Checks that reqPath isn't held.
+func (h *legalHolds) check(reqPath string) error {
+	if h == nil {
+		return nil
+	}
+
+	for _, hold := range h.list() {
+		if heldBy(hold, reqPath) {
+			return errLegalHold
+		}
+	}
+
+	return nil
+}
+
+// Checks that neither reqPath nor anything under it is held, for deleting
+// or moving it.
+func (h *legalHolds) checkTree(reqPath string) error {
+	if h == nil {
+		return nil
+	}
+
+	dirPath := strings.TrimSuffix(reqPath, "/") + "/"
+	for _, hold := range h.list() {
+		if heldBy(hold, reqPath) || strings.HasPrefix(hold.Path, dirPath) {
+			return errLegalHold
+		}
+	}
+
+	return nil
+}
+
+type placeHoldRequest struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Handles gemdrive/admin/holds[/<id>]
+func (s *Server) handleLegalHolds(w http.ResponseWriter, r *http.Request, id string) {
+
+	token, _ := extractToken(r)
+
+	if !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		jsonBody, err := json.Marshal(s.holds.list())
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "POST":
+		var req placeHoldRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		hold, err := s.holds.place(req.Path, req.Reason, s.auth.Principals(token))
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		jsonBody, err := json.Marshal(hold)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "DELETE":
+		if s.holds.get(id) == nil {
+			w.WriteHeader(404)
+			io.WriteString(w, "Not found")
+			return
+		}
+
+		if s.deferForApproval(w, r, approvalLiftLegalHold, id) {
+			return
+		}
+
+		err := s.holds.lift(id, s.auth.Principals(token))
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+	default:
+		w.WriteHeader(405)
+	}
+}
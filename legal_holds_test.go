@@ -0,0 +1,62 @@
+package gemdrive
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLegalHoldBlocksOtherSpellings(t *testing.T) {
+	dir := t.TempDir()
+
+	filesDir := filepath.Join(dir, "files")
+	err := os.MkdirAll(filesDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(filesDir, "held.txt"), []byte("evidence"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(&Config{
+		Dirs:       []string{filesDir},
+		DataDir:    filepath.Join(dir, "data"),
+		CacheDir:   filepath.Join(dir, "cache"),
+		AdminEmail: "owner@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := server.auth.AddEphemeralKeyring([]*Key{
+		{IdType: "email", Id: "owner@example.com", Perm: "own", Path: "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.holds.place("/files/held.txt", "Litigation", []string{"owner@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reqPath := range []string{"/files/held.txt", "/files//held.txt", "/files/./held.txt"} {
+		r := httptest.NewRequest("PUT", reqPath+"?overwrite=true", strings.NewReader("tampered"))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != 403 {
+			t.Errorf("PUT %s got %d, want 403", reqPath, w.Code)
+		}
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(filesDir, "held.txt"))
+	if err != nil || string(content) != "evidence" {
+		t.Errorf("held file was changed to %q", content)
+	}
+}
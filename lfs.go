@@ -0,0 +1,246 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The Git LFS batch API, with the basic transfer adapter, served for any
+// directory at <dir>/gemdrive/lfs, so it can be used as LFS storage with
+//
+//   git config lfs.url https://example.com/lfs/myrepo/gemdrive/lfs
+//
+// Objects are stored as git stores them locally, under the first two pairs
+// of hex digits of their OIDs. Git's credential helpers provide tokens as
+// basic auth passwords.
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers,omitempty"`
+	Objects   []*lfsObject `json:"objects"`
+	HashAlgo  string       `json:"hash_algo,omitempty"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string       `json:"transfer"`
+	Objects  []*lfsObject `json:"objects"`
+	HashAlgo string       `json:"hash_algo"`
+}
+
+type lfsObject struct {
+	Oid           string                `json:"oid"`
+	Size          int64                 `json:"size"`
+	Authenticated bool                  `json:"authenticated,omitempty"`
+	Actions       map[string]*lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError       `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func validLfsOid(oid string) bool {
+	if len(oid) != 64 {
+		return false
+	}
+	for _, c := range oid {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func lfsObjectPath(storePath, oid string) string {
+	return storePath + oid[0:2] + "/" + oid[2:4] + "/" + oid
+}
+
+func sendLfsError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(code)
+	jsonBody, _ := json.Marshal(map[string]string{"message": message})
+	w.Write(jsonBody)
+}
+
+func (s *Server) handleLfs(w http.ResponseWriter, r *http.Request, storePath, lfsReq string) {
+
+	if lfsReq == "objects/batch" {
+		if r.Method != "POST" {
+			sendLfsError(w, 405, "Method not allowed")
+			return
+		}
+		s.handleLfsBatch(w, r, storePath)
+		return
+	}
+
+	oid := strings.TrimPrefix(lfsReq, "objects/")
+	if !strings.HasPrefix(lfsReq, "objects/") || !validLfsOid(oid) {
+		sendLfsError(w, 404, "Not found")
+		return
+	}
+
+	objectPath := lfsObjectPath(storePath, oid)
+
+	switch r.Method {
+	case "GET":
+		s.serveItem(w, r, objectPath)
+	case "PUT":
+		s.putLfsObject(w, r, objectPath, oid)
+	default:
+		sendLfsError(w, 405, "Method not allowed")
+	}
+}
+
+func (s *Server) handleLfsBatch(w http.ResponseWriter, r *http.Request, storePath string) {
+	token, _ := extractToken(r)
+
+	var req lfsBatchRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		sendLfsError(w, 422, "Invalid batch request")
+		return
+	}
+
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		sendLfsError(w, 409, "Unsupported hash algorithm")
+		return
+	}
+
+	if len(req.Transfers) > 0 && !containsString(req.Transfers, "basic") {
+		sendLfsError(w, 422, "Only the basic transfer adapter is supported")
+		return
+	}
+
+	var allowed bool
+	switch req.Operation {
+	case "download":
+		allowed = s.auth.CanRead(token, storePath)
+	case "upload":
+		allowed = s.auth.CanCreate(token, storePath)
+	default:
+		sendLfsError(w, 422, "Invalid operation")
+		return
+	}
+
+	if !allowed {
+		// Git only asks for credentials after a 401
+		if token == "" {
+			w.Header().Set("LFS-Authenticate", "Basic realm=\"GemDrive\"")
+			sendLfsError(w, 401, "Credentials needed")
+		} else {
+			sendLfsError(w, 403, "Not allowed")
+		}
+		return
+	}
+
+	var header map[string]string
+	if token != "" {
+		header = map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	objectsUrl := strings.TrimSuffix(r.URL.Path, "batch")
+
+	res := &lfsBatchResponse{
+		Transfer: "basic",
+		Objects:  []*lfsObject{},
+		HashAlgo: "sha256",
+	}
+
+	for _, reqObj := range req.Objects {
+		obj := &lfsObject{
+			Oid:           reqObj.Oid,
+			Size:          reqObj.Size,
+			Authenticated: true,
+		}
+		res.Objects = append(res.Objects, obj)
+
+		if !validLfsOid(reqObj.Oid) || reqObj.Size < 0 {
+			obj.Error = &lfsObjectError{Code: 422, Message: "Invalid object"}
+			continue
+		}
+
+		size, exists, err := s.itemSize(lfsObjectPath(storePath, reqObj.Oid))
+		if err != nil {
+			obj.Error = &lfsObjectError{Code: 500, Message: err.Error()}
+			continue
+		}
+
+		action := &lfsAction{
+			Href:   s.absoluteUrl(r, objectsUrl+reqObj.Oid, ""),
+			Header: header,
+		}
+
+		if req.Operation == "download" {
+			if !exists {
+				obj.Error = &lfsObjectError{Code: 404, Message: "Object does not exist"}
+				continue
+			}
+			obj.Size = size
+			obj.Actions = map[string]*lfsAction{"download": action}
+		} else if !exists {
+			// Objects that are already stored are left out of uploads
+			obj.Actions = map[string]*lfsAction{"upload": action}
+		}
+	}
+
+	jsonBody, err := json.Marshal(res)
+	if err != nil {
+		sendLfsError(w, 500, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.Write(jsonBody)
+}
+
+// Uploads are regular PUTs, checked against the OID.
+func (s *Server) putLfsObject(w http.ResponseWriter, r *http.Request, objectPath, oid string) {
+	token, _ := extractToken(r)
+
+	if !s.auth.CanCreate(token, objectPath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "Backend does not support writing")
+		return
+	}
+
+	// Objects never change, so uploading one twice is fine
+	_, exists, err := s.itemSize(objectPath)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if exists {
+		return
+	}
+
+	parentDir, _ := splitItemPath(objectPath)
+
+	err = backend.MakeDir(parentDir, true)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	r.Header.Del("Content-Range")
+	r.Header.Set("X-Checksum-SHA256", oid)
+
+	s.handlePut(w, r, objectPath)
+}
@@ -0,0 +1,177 @@
+package gemdrive
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Limits how many file streams (downloads and uploads) run at once. Each
+// client, identified by token or else IP address, may only have a fixed
+// number open, and beyond that requests are refused. Once the server-wide
+// limit is reached new streams queue, and freed slots are handed out
+// round-robin between clients so one busy client can't starve the rest.
+
+type LimitsConfig struct {
+	MaxStreams          int `json:"maxStreams,omitempty"`
+	MaxStreamsPerClient int `json:"maxStreamsPerClient,omitempty"`
+}
+
+type streamLimiter struct {
+	maxTotal     int
+	maxPerClient int
+	total        int
+	active       map[string]int
+	queues       map[string][]chan struct{}
+	// Clients with queued streams, in the order they'll next be served
+	ring []string
+	mut  *sync.Mutex
+}
+
+func newStreamLimiter(config *LimitsConfig) *streamLimiter {
+	return &streamLimiter{
+		maxTotal:     config.MaxStreams,
+		maxPerClient: config.MaxStreamsPerClient,
+		active:       make(map[string]int),
+		queues:       make(map[string][]chan struct{}),
+		mut:          &sync.Mutex{},
+	}
+}
+
+func (l *streamLimiter) acquire(ctx context.Context, client string) error {
+	l.mut.Lock()
+
+	if l.maxPerClient != 0 && l.active[client]+len(l.queues[client]) >= l.maxPerClient {
+		l.mut.Unlock()
+		return &Error{
+			HttpCode: 429,
+			Message:  "Too many simultaneous streams",
+		}
+	}
+
+	if l.maxTotal == 0 || l.total < l.maxTotal {
+		l.active[client]++
+		l.total++
+		l.mut.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	if len(l.queues[client]) == 0 {
+		l.ring = append(l.ring, client)
+	}
+	l.queues[client] = append(l.queues[client], ready)
+
+	l.mut.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		l.mut.Lock()
+		defer l.mut.Unlock()
+
+		select {
+		case <-ready:
+			// Granted while giving up, so hand the slot on
+			l.releaseLocked(client)
+		default:
+			l.dequeueLocked(client, ready)
+		}
+
+		return ctx.Err()
+	}
+}
+
+func (l *streamLimiter) release(client string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.releaseLocked(client)
+}
+
+func (l *streamLimiter) releaseLocked(client string) {
+	l.active[client]--
+	if l.active[client] == 0 {
+		delete(l.active, client)
+	}
+	l.total--
+
+	if len(l.ring) == 0 {
+		return
+	}
+
+	next := l.ring[0]
+	l.ring = l.ring[1:]
+
+	queue := l.queues[next]
+	ready := queue[0]
+	if len(queue) == 1 {
+		delete(l.queues, next)
+	} else {
+		l.queues[next] = queue[1:]
+		l.ring = append(l.ring, next)
+	}
+
+	l.active[next]++
+	l.total++
+	close(ready)
+}
+
+func (l *streamLimiter) dequeueLocked(client string, ready chan struct{}) {
+	queue := l.queues[client]
+	for i, ch := range queue {
+		if ch == ready {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+
+	if len(queue) > 0 {
+		l.queues[client] = queue
+		return
+	}
+
+	delete(l.queues, client)
+	for i, c := range l.ring {
+		if c == client {
+			l.ring = append(l.ring[:i], l.ring[i+1:]...)
+			break
+		}
+	}
+}
+
+func streamClient(r *http.Request) string {
+	if token, err := extractToken(r); err == nil && token != "" {
+		return "token:" + token
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Waits for a free stream slot. On failure the response has already been
+// written.
+func (s *Server) acquireStream(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if s.streamLimiter == nil {
+		return func() {}, true
+	}
+
+	client := streamClient(r)
+
+	err := s.streamLimiter.acquire(r.Context(), client)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return nil, false
+	} else if err != nil {
+		// The client went away while queued
+		return nil, false
+	}
+
+	return func() { s.streamLimiter.release(client) }, true
+}
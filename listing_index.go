@@ -0,0 +1,329 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Listing a huge directory means a stat for every entry, and serving it as
+// one JSON object means clients parse the whole thing before seeing any of
+// it. Directories with more than a chunk's worth of entries get an on-disk
+// index instead, split into chunks of sorted children, which meta.json can
+// page through with ?limit=N&after=<name>.
+//
+// The index is rebuilt when the directory's modification time changes, and
+// dropped along with the other caches when the watcher sees a change inside
+// it.
+
+const defaultListingChunkSize = 10000
+
+// Backends which can return part of a directory's children without
+// listing all of them.
+type PagedLister interface {
+	ListPage(path string, after string, limit int) (*Item, string, error)
+}
+
+type listingIndex struct {
+	DirModTime int64                `json:"dirModTime"`
+	Count      int                  `json:"count"`
+	Chunks     []*listingChunkRange `json:"chunks"`
+}
+
+type listingChunkRange struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Count int    `json:"count"`
+}
+
+// Returns up to limit children of reqPath named after the given name, and
+// the name to continue from, which is empty once there are no more.
+func listPage(backend Backend, reqPath, after string, limit int) (*Item, string, error) {
+	if lister, ok := backend.(PagedLister); ok {
+		return lister.ListPage(reqPath, after, limit)
+	}
+
+	item, err := backend.List(reqPath, 1)
+	if err != nil {
+		return nil, "", err
+	}
+
+	page, next := pageItem(item, after, limit)
+	return page, next, nil
+}
+
+func pageItem(item *Item, after string, limit int) (*Item, string) {
+	names := []string{}
+	for name := range item.Children {
+		if name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	next := ""
+	if len(names) > limit {
+		names = names[:limit]
+		next = names[limit-1]
+	}
+
+	page := &Item{
+		Size:    item.Size,
+		ModTime: item.ModTime,
+	}
+
+	if len(names) > 0 {
+		page.Children = make(map[string]*Item)
+		for _, name := range names {
+			page.Children[name] = item.Children[name]
+		}
+	}
+
+	return page, next
+}
+
+func (fs *FileSystemBackend) SetListingChunkSize(n int) {
+	fs.listingChunkSize = n
+}
+
+func (fs *FileSystemBackend) ListPage(reqPath, after string, limit int) (*Item, string, error) {
+	err := checkLocalPath(reqPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, _, ok := fs.splitArchivePath(reqPath); ok {
+		item, err := fs.List(reqPath, 1)
+		if err != nil {
+			return nil, "", err
+		}
+		page, next := pageItem(item, after, limit)
+		return page, next, nil
+	}
+
+	index, err := fs.listingIndex(reqPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if index == nil {
+		item, err := fs.readDirItem(reqPath)
+		if err != nil {
+			return nil, "", err
+		}
+		page, next := pageItem(item, after, limit)
+		return page, next, nil
+	}
+
+	page := &Item{
+		Children: make(map[string]*Item),
+	}
+
+	for i, chunk := range index.Chunks {
+		if chunk.Last <= after {
+			continue
+		}
+
+		children, err := fs.readListingChunk(reqPath, i)
+		if err != nil {
+			return nil, "", err
+		}
+
+		chunkPage, next := pageItem(&Item{Children: children}, after, limit-len(page.Children))
+		for name, child := range chunkPage.Children {
+			page.Children[name] = child
+		}
+
+		if next != "" {
+			return page, next, nil
+		}
+
+		if len(page.Children) == limit {
+			// Only continue if there's anything left
+			if i < len(index.Chunks)-1 {
+				return page, chunk.Last, nil
+			}
+			break
+		}
+	}
+
+	if len(page.Children) == 0 {
+		page.Children = nil
+	}
+
+	return page, "", nil
+}
+
+// Lists the immediate children of a directory, from the chunked index if
+// it has one.
+func (fs *FileSystemBackend) readDirItem(reqPath string) (*Item, error) {
+	index, err := fs.listingIndex(reqPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if index != nil {
+		item := &Item{
+			Children: make(map[string]*Item, index.Count),
+		}
+
+		for i := range index.Chunks {
+			children, err := fs.readListingChunk(reqPath, i)
+			if err != nil {
+				return nil, err
+			}
+
+			for name, child := range children {
+				item.Children[name] = child
+			}
+		}
+
+		return item, nil
+	}
+
+	p := fs.localPath(reqPath)
+
+	stat, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ReadDir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	item := DirToGemDrive(files)
+
+	if len(item.Children) > fs.listingChunkSize {
+		err := fs.writeListingIndex(reqPath, item, stat.ModTime().UnixNano())
+		if err != nil {
+			fmt.Println("Failed to write listing index for", reqPath, err)
+		}
+	}
+
+	return item, nil
+}
+
+func (fs *FileSystemBackend) listingDir(reqPath string) string {
+	return fs.cachePath(reqPath, "gemdrive", "listing")
+}
+
+// Returns the directory's index, or nil if it doesn't have a current one.
+func (fs *FileSystemBackend) listingIndex(reqPath string) (*listingIndex, error) {
+	stat, err := os.Stat(fs.localPath(reqPath))
+	if err != nil {
+		return nil, err
+	}
+
+	indexJson, err := ioutil.ReadFile(filepath.Join(fs.listingDir(reqPath), "index.json"))
+	if err != nil {
+		return nil, nil
+	}
+
+	var index *listingIndex
+	err = json.Unmarshal(indexJson, &index)
+	if err != nil || index.DirModTime != stat.ModTime().UnixNano() {
+		return nil, nil
+	}
+
+	return index, nil
+}
+
+func (fs *FileSystemBackend) readListingChunk(reqPath string, i int) (map[string]*Item, error) {
+	chunkPath := filepath.Join(fs.listingDir(reqPath), fmt.Sprintf("%d.json", i))
+
+	chunkJson, err := ioutil.ReadFile(chunkPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var children map[string]*Item
+	err = json.Unmarshal(chunkJson, &children)
+	if err != nil {
+		return nil, err
+	}
+
+	return children, nil
+}
+
+// Chunks are written to a fresh directory which then replaces the old
+// index, so readers never see a mix of two builds.
+func (fs *FileSystemBackend) writeListingIndex(reqPath string, item *Item, dirModTime int64) error {
+	listingDir := fs.listingDir(reqPath)
+
+	err := os.MkdirAll(filepath.Dir(listingDir), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := ioutil.TempDir(filepath.Dir(listingDir), ".listing_tmp_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	names := make([]string, 0, len(item.Children))
+	for name := range item.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	index := &listingIndex{
+		DirModTime: dirModTime,
+		Count:      len(names),
+	}
+
+	for start := 0; start < len(names); start += fs.listingChunkSize {
+		end := start + fs.listingChunkSize
+		if end > len(names) {
+			end = len(names)
+		}
+
+		children := make(map[string]*Item, end-start)
+		for _, name := range names[start:end] {
+			children[name] = item.Children[name]
+		}
+
+		chunkJson, err := json.Marshal(children)
+		if err != nil {
+			return err
+		}
+
+		chunkPath := filepath.Join(tmpDir, fmt.Sprintf("%d.json", len(index.Chunks)))
+		err = ioutil.WriteFile(chunkPath, chunkJson, 0644)
+		if err != nil {
+			return err
+		}
+
+		index.Chunks = append(index.Chunks, &listingChunkRange{
+			First: names[start],
+			Last:  names[end-1],
+			Count: end - start,
+		})
+	}
+
+	err = saveJson(index, filepath.Join(tmpDir, "index.json"))
+	if err != nil {
+		return err
+	}
+
+	// Renaming over a non-empty directory fails, so the old index is
+	// moved aside first.
+	oldDir := tmpDir + "_old"
+	err = os.Rename(listingDir, oldDir)
+	if err == nil {
+		defer os.RemoveAll(oldDir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Rename(tmpDir, listingDir)
+}
+
+func (fs *FileSystemBackend) invalidateListing(dirPath string) {
+	os.RemoveAll(fs.listingDir(dirPath))
+}
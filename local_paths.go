@@ -0,0 +1,100 @@
+package gemdrive
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Request paths always use forward slashes. On Windows they're translated
+// to backslashes before touching the disk, and names Windows would
+// reinterpret, like "CON", "a:stream" or "name. ", are refused rather than
+// silently aliasing some other file. Export roots can be drive paths or UNC
+// shares, ie \\server\share\photos, and are made absolute so paths beyond
+// MAX_PATH work too.
+
+// Maps a request path to the export's directory on disk.
+func (fs *FileSystemBackend) localPath(reqPath string) string {
+	return joinLocal(fs.rootDir, reqPath)
+}
+
+// Maps slash separated elements to the export's cache directory on disk.
+func (fs *FileSystemBackend) cachePath(elems ...string) string {
+	return joinLocal(fs.gemDir, path.Join(elems...))
+}
+
+// Like localPath, but for paths from requests, which might not be safe to
+// use on this platform.
+func (fs *FileSystemBackend) checkedPath(reqPath string) (string, error) {
+	err := checkLocalPath(reqPath)
+	if err != nil {
+		return "", err
+	}
+	return fs.localPath(reqPath), nil
+}
+
+func joinLocal(root, reqPath string) string {
+	return filepath.Join(root, filepath.FromSlash(path.Clean("/"+reqPath)))
+}
+
+var reservedWindowsNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// The Windows checks are built everywhere, so they're tested everywhere,
+// but only used on Windows.
+func checkWindowsPath(reqPath string) error {
+	for _, name := range strings.Split(reqPath, "/") {
+		if name == "" || name == "." || name == ".." {
+			continue
+		}
+
+		if !validWindowsName(name) {
+			return &Error{
+				HttpCode: 400,
+				Message:  "Invalid file name on this server: " + name,
+			}
+		}
+	}
+
+	return nil
+}
+
+func validWindowsName(name string) bool {
+	for _, c := range name {
+		if c < 0x20 || strings.ContainsRune(`\:*?"<>|`, c) {
+			return false
+		}
+	}
+
+	// Windows strips these, so "a." would be "a"
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return false
+	}
+
+	// Device names are reserved with any extension, ie "nul.txt"
+	base := strings.SplitN(name, ".", 2)[0]
+	return !reservedWindowsNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// Exports are named after the last element of their directory, or for the
+// root of a drive or share, ie \\server\share, its letter or share name.
+func windowsExportName(dir string) string {
+	dir = strings.ReplaceAll(dir, "/", `\`)
+
+	// Long path prefixes, ie \\?\C:\photos or \\?\UNC\server\share
+	if strings.HasPrefix(dir, `\\?\`) {
+		dir = strings.TrimPrefix(dir, `\\?\`)
+		if strings.HasPrefix(strings.ToUpper(dir), `UNC\`) {
+			dir = `\\` + dir[len(`UNC\`):]
+		}
+	}
+
+	trimmed := strings.TrimRight(dir, `\`)
+	name := trimmed[strings.LastIndex(trimmed, `\`)+1:]
+	return strings.TrimSuffix(name, ":")
+}
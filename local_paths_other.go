@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package gemdrive
+
+import (
+	"path/filepath"
+)
+
+func checkLocalPath(reqPath string) error {
+	return nil
+}
+
+// Exports are named after the last element of their directory.
+func exportName(dir string) string {
+	return filepath.Base(dir)
+}
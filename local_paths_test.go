@@ -0,0 +1,82 @@
+package gemdrive
+
+import (
+	"testing"
+)
+
+func TestValidWindowsName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"photo.jpg", true},
+		{".hidden", true},
+		{"CONSOLE", true},
+		{"COM10", true},
+		{"nullable.txt", true},
+		{"CON", false},
+		{"con", false},
+		{"NUL.txt", false},
+		{"nul.tar.gz", false},
+		{"LPT1 .txt", false},
+		{"file.txt:stream", false},
+		{"file.txt::$DATA", false},
+		{"C:", false},
+		{"name.", false},
+		{"name ", false},
+		{"name. ", false},
+		{"...", false},
+		{"a?b", false},
+		{"a*b", false},
+		{`a\b`, false},
+		{"tab\there", false},
+	}
+
+	for _, test := range tests {
+		if valid := validWindowsName(test.name); valid != test.valid {
+			t.Errorf("validWindowsName(%q) = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}
+
+func TestCheckWindowsPath(t *testing.T) {
+	for _, reqPath := range []string{"/files/a.txt", "/files/dir/", "/files/./a.txt"} {
+		if err := checkWindowsPath(reqPath); err != nil {
+			t.Errorf("%s: %v", reqPath, err)
+		}
+	}
+
+	for _, reqPath := range []string{"/files/CON/a.txt", "/files/a.txt:secret", "/files/dir./a.txt", "/files/aux"} {
+		err := checkWindowsPath(reqPath)
+		if e, ok := err.(*Error); !ok || e.HttpCode != 400 {
+			t.Errorf("%s: got %v, want a 400", reqPath, err)
+		}
+	}
+}
+
+func TestWindowsExportName(t *testing.T) {
+	tests := []struct {
+		dir  string
+		name string
+	}{
+		{`C:\photos`, "photos"},
+		{`C:\photos\`, "photos"},
+		{`C:\Users\me\Music`, "Music"},
+		{`C:/Users/me/Music`, "Music"},
+		{`C:\`, "C"},
+		{`D:`, "D"},
+		{`\\server\share`, "share"},
+		{`\\server\share\`, "share"},
+		{`\\server\share\photos`, "photos"},
+		{`\\?\C:\photos`, "photos"},
+		{`\\?\C:\`, "C"},
+		{`\\?\UNC\server\share`, "share"},
+		{`\\?\UNC\server\share\photos`, "photos"},
+	}
+
+	for _, test := range tests {
+		if name := windowsExportName(test.dir); name != test.name {
+			t.Errorf("windowsExportName(%q) = %q, want %q", test.dir, name, test.name)
+		}
+	}
+}
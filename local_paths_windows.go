@@ -0,0 +1,12 @@
+//go:build windows
+// +build windows
+
+package gemdrive
+
+func checkLocalPath(reqPath string) error {
+	return checkWindowsPath(reqPath)
+}
+
+func exportName(dir string) string {
+	return windowsExportName(dir)
+}
@@ -0,0 +1,361 @@
+package gemdrive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clients making too many failed auth attempts are locked out for a while,
+// like fail2ban does. Attempts are counted per IP, for unknown tokens,
+// refresh tokens and login codes, and per identity, for login codes. Only
+// distinct attempts count, so a browser repeating one stale cookie isn't
+// mistaken for someone guessing. Each lockout lasts twice as long as the
+// last, and locked out IPs can't make any requests, while locked out
+// identities can't log in. Admins can see and lift lockouts at
+// gemdrive/admin/lockouts.
+//
+// Lockouts are off unless enabled. Behind a reverse proxy, trustedProxies
+// has to be set first, or every client has the proxy's IP and one lockout
+// blocks everyone.
+
+type LockoutConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Distinct failed attempts allowed within lockoutWindow. Defaults to 10.
+	MaxFailures int `json:"maxFailures,omitempty"`
+}
+
+type Lockout struct {
+	// ie "ip:203.0.113.7" or "email:someone@example.com"
+	Key         string `json:"key"`
+	Failures    int    `json:"failures"`
+	Lockouts    int    `json:"lockouts"`
+	LockedUntil string `json:"lockedUntil,omitempty"`
+}
+
+const lockoutWindow = 15 * time.Minute
+
+const firstLockout = time.Minute
+
+const maxLockout = 24 * time.Hour
+
+// Offenders are forgiven after this long without failures
+const lockoutMemory = 24 * time.Hour
+
+type lockoutEntry struct {
+	// When each distinct attempt, by hash, last failed
+	attempts    map[[32]byte]time.Time
+	lockouts    int
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+// How entries are stored in Redis
+type sharedLockoutEntry struct {
+	// By hex hash
+	Attempts    map[string]time.Time `json:"attempts,omitempty"`
+	Lockouts    int                  `json:"lockouts,omitempty"`
+	LockedUntil time.Time            `json:"lockedUntil"`
+	LastFailure time.Time            `json:"lastFailure"`
+}
+
+type lockoutTracker struct {
+	disabled    bool
+	maxFailures int
+	entries     map[string]*lockoutEntry
+	mut         *sync.Mutex
+	shared      *redisClient
+}
+
+func newLockoutTracker(config *LockoutConfig, shared *redisClient) *lockoutTracker {
+	if config == nil {
+		config = &LockoutConfig{}
+	}
+
+	maxFailures := config.MaxFailures
+	if maxFailures <= 0 {
+		maxFailures = 10
+	}
+
+	return &lockoutTracker{
+		disabled:    !config.Enabled,
+		maxFailures: maxFailures,
+		entries:     make(map[string]*lockoutEntry),
+		mut:         &sync.Mutex{},
+		shared:      shared,
+	}
+}
+
+// Takes the lock, returning the function releasing it. When shared, the
+// entries are loaded from Redis first, and if they're being changed, held
+// locked there and stored back.
+func (l *lockoutTracker) lock(change bool) func() {
+	l.mut.Lock()
+
+	if l.shared == nil {
+		return l.mut.Unlock
+	}
+
+	unlockShared := func() {}
+	if change {
+		unlock, err := l.shared.lock("lockouts")
+		if err != nil {
+			fmt.Println("Failed to lock lockouts in Redis:", err)
+			change = false
+		} else {
+			unlockShared = unlock
+		}
+	}
+
+	err := l.load()
+	if err != nil {
+		fmt.Println("Failed to load lockouts from Redis:", err)
+		// Storing what failed to load would lose other instances' entries
+		change = false
+	}
+
+	return func() {
+		if change {
+			err := l.store()
+			if err != nil {
+				fmt.Println("Failed to store lockouts in Redis:", err)
+			}
+		}
+		unlockShared()
+		l.mut.Unlock()
+	}
+}
+
+func (l *lockoutTracker) load() error {
+	shared := make(map[string]*sharedLockoutEntry)
+	_, err := l.shared.getJson("lockouts", &shared)
+	if err != nil {
+		return err
+	}
+
+	l.entries = make(map[string]*lockoutEntry)
+	for key, stored := range shared {
+		entry := &lockoutEntry{
+			attempts:    make(map[[32]byte]time.Time),
+			lockouts:    stored.Lockouts,
+			lockedUntil: stored.LockedUntil,
+			lastFailure: stored.LastFailure,
+		}
+		for hexHash, failedAt := range stored.Attempts {
+			var hash [32]byte
+			decoded, err := hex.DecodeString(hexHash)
+			if err == nil && len(decoded) == len(hash) {
+				copy(hash[:], decoded)
+				entry.attempts[hash] = failedAt
+			}
+		}
+		l.entries[key] = entry
+	}
+
+	return nil
+}
+
+func (l *lockoutTracker) store() error {
+	shared := make(map[string]*sharedLockoutEntry)
+	for key, entry := range l.entries {
+		stored := &sharedLockoutEntry{
+			Attempts:    make(map[string]time.Time),
+			Lockouts:    entry.lockouts,
+			LockedUntil: entry.lockedUntil,
+			LastFailure: entry.lastFailure,
+		}
+		for hash, failedAt := range entry.attempts {
+			stored.Attempts[hex.EncodeToString(hash[:])] = failedAt
+		}
+		shared[key] = stored
+	}
+
+	return l.shared.setJson("lockouts", shared, 0)
+}
+
+// How much longer key is locked out for, if it is.
+func (l *lockoutTracker) lockedFor(key string) time.Duration {
+	if l.disabled {
+		return 0
+	}
+
+	defer l.lock(false)()
+
+	entry, exists := l.entries[key]
+	if !exists {
+		return 0
+	}
+
+	remaining := time.Until(entry.lockedUntil)
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
+
+func (l *lockoutTracker) fail(key, attempt string) {
+	if l.disabled {
+		return
+	}
+
+	defer l.lock(true)()
+
+	now := time.Now()
+
+	l.forget(now)
+
+	entry, exists := l.entries[key]
+	if !exists {
+		entry = &lockoutEntry{
+			attempts: make(map[[32]byte]time.Time),
+		}
+		l.entries[key] = entry
+	}
+
+	entry.lastFailure = now
+	entry.attempts[sha256.Sum256([]byte(attempt))] = now
+
+	for hash, failedAt := range entry.attempts {
+		if now.Sub(failedAt) > lockoutWindow {
+			delete(entry.attempts, hash)
+		}
+	}
+
+	if len(entry.attempts) < l.maxFailures {
+		return
+	}
+
+	duration := firstLockout
+	for i := 0; i < entry.lockouts && duration < maxLockout; i++ {
+		duration *= 2
+	}
+	if duration > maxLockout {
+		duration = maxLockout
+	}
+
+	entry.lockouts++
+	entry.lockedUntil = now.Add(duration)
+	entry.attempts = make(map[[32]byte]time.Time)
+
+	fmt.Println("Locked out", key, "for", duration, "after", l.maxFailures, "failed auth attempts")
+}
+
+// Clears key's failed attempts, but not its lockout history.
+func (l *lockoutTracker) succeed(key string) {
+	defer l.lock(true)()
+
+	if entry, exists := l.entries[key]; exists {
+		entry.attempts = make(map[[32]byte]time.Time)
+	}
+}
+
+func (l *lockoutTracker) lift(key string) bool {
+	defer l.lock(true)()
+
+	_, exists := l.entries[key]
+	delete(l.entries, key)
+
+	if exists {
+		fmt.Println("Lockout of", key, "lifted")
+	}
+
+	return exists
+}
+
+func (l *lockoutTracker) list() []*Lockout {
+	defer l.lock(true)()
+
+	now := time.Now()
+
+	l.forget(now)
+
+	lockouts := []*Lockout{}
+	for key, entry := range l.entries {
+		lockout := &Lockout{
+			Key:      key,
+			Failures: len(entry.attempts),
+			Lockouts: entry.lockouts,
+		}
+		if entry.lockedUntil.After(now) {
+			lockout.LockedUntil = entry.lockedUntil.UTC().Format(time.RFC3339)
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].Key < lockouts[j].Key
+	})
+
+	return lockouts
+}
+
+// Must be called with the lock held.
+func (l *lockoutTracker) forget(now time.Time) {
+	for key, entry := range l.entries {
+		if now.Sub(entry.lastFailure) > lockoutMemory && now.After(entry.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+func (s *Server) ipLockoutKey(r *http.Request) string {
+	ip := s.clientIp(r)
+	if ip == nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + ip.String()
+}
+
+// Responds with a 429 and returns true if key is locked out.
+func (s *Server) sendIfLockedOut(w http.ResponseWriter, key string) bool {
+	remaining := s.lockouts.lockedFor(key)
+	if remaining == 0 {
+		return false
+	}
+
+	seconds := int(remaining.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(429)
+	io.WriteString(w, "Too many failed attempts. Try again later.")
+
+	return true
+}
+
+// Handles gemdrive/admin/lockouts[/<key>]
+func (s *Server) handleLockouts(w http.ResponseWriter, r *http.Request, key string) {
+
+	token, _ := extractToken(r)
+
+	if !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		jsonBody, err := json.Marshal(s.lockouts.list())
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "DELETE":
+		if !s.lockouts.lift(key) {
+			w.WriteHeader(404)
+			io.WriteString(w, "Not found")
+			return
+		}
+	default:
+		w.WriteHeader(405)
+	}
+}
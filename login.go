@@ -0,0 +1,87 @@
+package gemdrive
+
+import (
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/GeertJohan/go.rice"
+)
+
+// Operators can replace the embedded login page by putting their own
+// login.html in <dataDir>/gemdrive/, and serve branding assets (logos,
+// stylesheets) from <dataDir>/gemdrive/assets/ at /gemdrive/assets/. The
+// login page is a html/template, with the fields of loginPageData available.
+
+type loginPageData struct {
+	ServerName string
+	ReturnUrl  string
+}
+
+func (s *Server) loginTemplate() (*template.Template, error) {
+	customPath := filepath.Join(s.config.DataDir, "gemdrive", "login.html")
+
+	loginHtml, err := ioutil.ReadFile(customPath)
+	if os.IsNotExist(err) {
+		box, err := rice.FindBox("files")
+		if err != nil {
+			return nil, err
+		}
+
+		loginHtml, err = box.Bytes("login.html")
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return template.New("login").Parse(string(loginHtml))
+}
+
+// Serves the embedded file manager. It browses relative to the directory
+// it's served under, ie /photos/gemdrive/app/ starts in /photos/.
+func (s *Server) serveApp(w http.ResponseWriter, r *http.Request) {
+	box, err := rice.FindBox("files")
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	appHtml, err := box.Bytes("app.html")
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(appHtml)
+}
+
+func (s *Server) serveAsset(w http.ResponseWriter, r *http.Request, assetPath string) {
+	cleanPath := path.Clean("/" + assetPath)
+	if strings.HasSuffix(assetPath, "/") || cleanPath == "/" {
+		w.WriteHeader(404)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	fsPath := filepath.Join(s.config.DataDir, "gemdrive", "assets", filepath.FromSlash(cleanPath))
+
+	data, err := ioutil.ReadFile(fsPath)
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(cleanPath)))
+	w.Write(data)
+}
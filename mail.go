@@ -0,0 +1,45 @@
+package gemdrive
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+type mailer struct {
+	config *SmtpConfig
+}
+
+func newMailer(config *SmtpConfig) *mailer {
+	return &mailer{config}
+}
+
+func (m *mailer) configured() bool {
+	return m.config != nil && m.config.Server != ""
+}
+
+// Sends a plain text email. Bodies use \n line endings, which are converted
+// for SMTP.
+func (m *mailer) send(fromName string, to []string, subject, body string) error {
+	if !m.configured() {
+		return errors.New("SMTP is not configured")
+	}
+
+	for _, header := range append([]string{fromName, subject}, to...) {
+		if strings.ContainsAny(header, "\r\n") {
+			return errors.New("Invalid email header")
+		}
+	}
+
+	msg := fmt.Sprintf("From: %s <%s>\r\n", fromName, m.config.Sender) +
+		fmt.Sprintf("To: %s\r\n", strings.Join(to, ", ")) +
+		fmt.Sprintf("Subject: %s\r\n", subject) +
+		"\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+
+	emailAuth := smtp.PlainAuth("", m.config.Username, m.config.Password, m.config.Server)
+	srv := fmt.Sprintf("%s:%d", m.config.Server, m.config.Port)
+
+	return smtp.SendMail(srv, emailAuth, m.config.Sender, to, []byte(msg))
+}
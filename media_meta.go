@@ -0,0 +1,140 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"image"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type MediaMeta struct {
+	TakenAt     string `json:"takenAt,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Orientation int    `json:"orientation,omitempty"`
+	// Only set for audio files
+	Audio *AudioTags `json:"audio,omitempty"`
+}
+
+// Bumped when more metadata is extracted, so older entries are redone
+const mediaMetaVersion = 1
+
+// Cached metadata is only valid as long as the source file's size and
+// modification time haven't changed.
+type mediaMetaCacheEntry struct {
+	Version int        `json:"version,omitempty"`
+	Size    int64      `json:"size"`
+	ModTime string     `json:"modTime"`
+	Meta    *MediaMeta `json:"meta"`
+}
+
+func isImageName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".png"
+}
+
+func (fs *FileSystemBackend) GetMediaMeta(reqPath string) (*MediaMeta, error) {
+	p, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(p)
+	if err != nil {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	modTime := stat.ModTime().UTC().Format(time.RFC3339Nano)
+
+	parentDir, filename := path.Split(reqPath)
+	cachePath := fs.cachePath(parentDir, "gemdrive", "media", filename+".json")
+
+	cacheJson, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		var entry mediaMetaCacheEntry
+		err = json.Unmarshal(cacheJson, &entry)
+		if err == nil && entry.Version == mediaMetaVersion && entry.Size == stat.Size() && entry.ModTime == modTime {
+			return entry.Meta, nil
+		}
+	}
+
+	meta, err := extractMediaMeta(p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &mediaMetaCacheEntry{
+		Version: mediaMetaVersion,
+		Size:    stat.Size(),
+		ModTime: modTime,
+		Meta:    meta,
+	}
+
+	err = saveJson(entry, cachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func extractMediaMeta(fsPath string) (*MediaMeta, error) {
+	meta := &MediaMeta{}
+
+	if isAudioName(fsPath) {
+		file, err := os.Open(fsPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		tags, err := readAudioTags(file, fsPath)
+		if err == nil {
+			meta.Audio = tags
+		}
+		return meta, nil
+	}
+
+	if !isImageName(fsPath) {
+		return meta, nil
+	}
+
+	file, err := os.Open(fsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err == nil {
+		meta.Width = config.Width
+		meta.Height = config.Height
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	exif, err := readExif(file)
+	if err == nil {
+		meta.Orientation = exif.Orientation
+		if !exif.DateTimeOriginal.IsZero() {
+			meta.TakenAt = exif.DateTimeOriginal.Format(time.RFC3339)
+		}
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,123 @@
+package gemdrive
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Writes an Item as JSON a piece at a time, producing the same output as
+// json.Marshal without building the whole document in memory, which for
+// deep listings of large trees can be hundreds of MB.
+func writeItemJson(w io.Writer, item *Item) error {
+	bw := bufio.NewWriter(w)
+
+	err := encodeItem(bw, item)
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func encodeItem(w *bufio.Writer, item *Item) error {
+	if item == nil {
+		_, err := w.WriteString("null")
+		return err
+	}
+
+	w.WriteByte('{')
+
+	first := true
+	field := func(name string) {
+		if !first {
+			w.WriteByte(',')
+		}
+		first = false
+		w.WriteString(`"` + name + `":`)
+	}
+
+	if item.Size != 0 {
+		field("size")
+		w.WriteString(strconv.FormatInt(item.Size, 10))
+	}
+
+	if item.ModTime != "" {
+		field("modTime")
+		err := encodeString(w, item.ModTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(item.Children) > 0 {
+		field("children")
+
+		names := make([]string, 0, len(item.Children))
+		for name := range item.Children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+
+			err := encodeString(w, name)
+			if err != nil {
+				return err
+			}
+			w.WriteByte(':')
+
+			err = encodeItem(w, item.Children[name])
+			if err != nil {
+				return err
+			}
+		}
+		w.WriteByte('}')
+	}
+
+	if item.IsExecutable {
+		field("isExecutable")
+		w.WriteString("true")
+	}
+
+	if item.AllocatedSize != 0 {
+		field("allocatedSize")
+		w.WriteString(strconv.FormatInt(item.AllocatedSize, 10))
+	}
+
+	if item.Tiering != nil {
+		field("tiering")
+		encoded, err := json.Marshal(item.Tiering)
+		if err != nil {
+			return err
+		}
+		w.Write(encoded)
+	}
+
+	if item.MovedFrom != "" {
+		field("movedFrom")
+		err := encodeString(w, item.MovedFrom)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Errors from the underlying writer stick, so checking once at the
+	// end of each item is enough.
+	return w.WriteByte('}')
+}
+
+func encodeString(w *bufio.Writer, s string) error {
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
+}
@@ -0,0 +1,141 @@
+package gemdrive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Caps on how much a single meta.json request can ask for, so nobody can
+// walk an entire large tree in one go. Asking for more depth than allowed is
+// refused with a 422 up front, and listings that turn out to have too many
+// items or bytes with a 413, in which case clients need a smaller depth or
+// limit paging. Zero means no cap.
+
+type MetaLimitsConfig struct {
+	// Deepest listing allowed. With a cap, depth=0 (unlimited) is refused.
+	MaxDepth int `json:"maxDepth,omitempty"`
+	// Most items in a listing, counting every level
+	MaxItems int `json:"maxItems,omitempty"`
+	// Largest JSON response
+	MaxBytes int `json:"maxBytes,omitempty"`
+}
+
+func (c *MetaLimitsConfig) checkDepth(depth int) error {
+	if c.MaxDepth == 0 || (depth != 0 && depth <= c.MaxDepth) {
+		return nil
+	}
+
+	return &Error{
+		HttpCode: 422,
+		Message:  fmt.Sprintf("depth must be between 1 and %d", c.MaxDepth),
+	}
+}
+
+func (c *MetaLimitsConfig) tooManyItems() error {
+	return &Error{
+		HttpCode: 413,
+		Message:  fmt.Sprintf("Listing has more than %d items. Use a smaller depth, or limit to page through it.", c.MaxItems),
+	}
+}
+
+// Lists dirPath a level at a time, so it can give up as soon as there are
+// more than MaxItems items rather than after reading the whole tree.
+func (c *MetaLimitsConfig) list(backend Backend, dirPath string, depth int) (*Item, error) {
+	root, err := backend.List(dirPath, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	count := len(root.Children)
+	if c.MaxItems > 0 && count > c.MaxItems {
+		return nil, c.tooManyItems()
+	}
+
+	type level struct {
+		item  *Item
+		path  string
+		depth int
+	}
+
+	queue := []level{{root, dirPath, 1}}
+
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		if depth != 0 && dir.depth >= depth {
+			continue
+		}
+
+		names := []string{}
+		for name := range dir.item.Children {
+			if strings.HasSuffix(name, "/") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			childPath := dir.path + name
+
+			child, err := backend.List(childPath, 1)
+			if err != nil {
+				return nil, err
+			}
+
+			dir.item.Children[name] = child
+
+			count += len(child.Children)
+			if c.MaxItems > 0 && count > c.MaxItems {
+				return nil, c.tooManyItems()
+			}
+
+			queue = append(queue, level{child, childPath, dir.depth + 1})
+		}
+	}
+
+	return root, nil
+}
+
+// Lists dirPath with depth clamped to MaxDepth rather than refused, for
+// listings made on the way to something else, like feeds.
+func (c *MetaLimitsConfig) listClamped(backend Backend, dirPath string, depth int) (*Item, error) {
+	if c.MaxDepth > 0 && (depth == 0 || depth > c.MaxDepth) {
+		depth = c.MaxDepth
+	}
+
+	if c.MaxItems > 0 && depth != 1 {
+		return c.list(backend, dirPath, depth)
+	}
+
+	item, err := backend.List(dirPath, depth)
+	if err == nil && c.MaxItems > 0 && len(item.Children) > c.MaxItems {
+		return nil, c.tooManyItems()
+	}
+	return item, err
+}
+
+func (s *Server) metaLimits() *MetaLimitsConfig {
+	if s.config.MetaLimits == nil {
+		return &MetaLimitsConfig{}
+	}
+	return s.config.MetaLimits
+}
+
+var errResponseTooLarge = errors.New("Response too large")
+
+// Buffers at most max bytes, failing writes beyond that.
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, errResponseTooLarge
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,156 @@
+package gemdrive
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Metalinks (RFC 5854) describe a file for download managers, with its
+// checksums and every URL it can be fetched from, so downloads can be split
+// across mirrors and checked once they're done. They're served for any file
+// at <dir>/gemdrive/metalink/<filename>, and for files of snapshots published
+// with sidecars, at <file>.meta4 next to <file>.sha256.
+
+const metalinkNamespace = "urn:ietf:params:xml:ns:metalink"
+
+type DownloadMirror struct {
+	// Directory the mirror has a copy of
+	Path string `json:"path"`
+	// Where the copy is
+	Url string `json:"url"`
+	// ISO 3166-1 country code, for download managers to pick nearby mirrors
+	Location string `json:"location,omitempty"`
+}
+
+type metalink struct {
+	XMLName   xml.Name        `xml:"metalink"`
+	Xmlns     string          `xml:"xmlns,attr"`
+	Generator string          `xml:"generator"`
+	Published string          `xml:"published,omitempty"`
+	Files     []*metalinkFile `xml:"file"`
+}
+
+type metalinkFile struct {
+	Name   string          `xml:"name,attr"`
+	Size   int64           `xml:"size"`
+	Hashes []*metalinkHash `xml:"hash"`
+	Urls   []*metalinkUrl  `xml:"url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkUrl struct {
+	Location string `xml:"location,attr,omitempty"`
+	Priority int    `xml:"priority,attr"`
+	Value    string `xml:",chardata"`
+}
+
+func sendMetalink(w http.ResponseWriter, file *metalinkFile, published time.Time) {
+	doc := &metalink{
+		Xmlns:     metalinkNamespace,
+		Generator: "GemDrive",
+		Files:     []*metalinkFile{file},
+	}
+	if !published.IsZero() {
+		doc.Published = published.UTC().Format(time.RFC3339)
+	}
+
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/metalink4+xml")
+	header.Set("Content-Disposition", contentDisposition("attachment", file.Name+".meta4"))
+
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+	io.WriteString(w, "\n")
+}
+
+func (s *Server) serveMetalink(w http.ResponseWriter, r *http.Request, dirPath, filename string) {
+	token, _ := extractToken(r)
+
+	filePath := dirPath + filename
+
+	if filename == "" || strings.Contains(filename, "/") {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	if !s.auth.CanRead(token, filePath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	parent, err := s.backend.List(dirPath, 1)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	item, exists := parent.Children[filename]
+	if !exists {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	file := &metalinkFile{
+		Name: filename,
+		Size: item.Size,
+	}
+
+	if store, ok := s.backend.(ChecksumStore); ok {
+		sums, err := store.GetChecksums(filePath)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		file.Hashes = []*metalinkHash{
+			{Type: "sha-256", Value: sums.Sha256},
+			{Type: "md5", Value: sums.Md5},
+		}
+	}
+
+	dirUrl := strings.Split(r.URL.Path, "gemdrive/")[0]
+
+	file.Urls = append(file.Urls, &metalinkUrl{
+		Priority: 1,
+		Value:    s.absoluteUrl(r, dirUrl+filename, ""),
+	})
+
+	for _, mirror := range s.config.DownloadMirrors {
+		mirrorDir := strings.TrimSuffix(mirror.Path, "/") + "/"
+		if !strings.HasPrefix(filePath, mirrorDir) {
+			continue
+		}
+
+		file.Urls = append(file.Urls, &metalinkUrl{
+			Location: mirror.Location,
+			Priority: 2,
+			Value:    strings.TrimSuffix(mirror.Url, "/") + "/" + escapePath(strings.TrimPrefix(filePath, mirrorDir)),
+		})
+	}
+
+	modTime, _ := time.Parse(time.RFC3339, item.ModTime)
+
+	sendMetalink(w, file, modTime)
+}
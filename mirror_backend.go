@@ -0,0 +1,243 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// MirrorBackend serves a read-only view of an origin backend, keeping a
+// local copy of every listing and fully-read file. When the origin can't be
+// reached the local copy is served instead, which makes it suitable for edge
+// and offline deployments.
+type MirrorBackend struct {
+	origin   Backend
+	cacheDir string
+	cache    *MirrorCacheConfig
+}
+
+func NewMirrorBackend(origin Backend, cacheDir string) (*MirrorBackend, error) {
+	err := os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MirrorBackend{origin: origin, cacheDir: cacheDir}, nil
+}
+
+// Mirrors the origin in config.
+func newMirror(config *MirrorConfig, cacheDir string) (*MirrorBackend, error) {
+	origin := NewRemoteBackend(config.Origin, config.Token)
+	if config.PeerKey != "" {
+		origin.EnablePeerSigning(config.PeerName, config.PeerKey)
+	}
+	if config.ClientCert != "" || config.CaCert != "" {
+		tlsConfig, err := loadClientTLSConfig(config.ClientCert, config.ClientKey, config.CaCert)
+		if err != nil {
+			return nil, err
+		}
+		origin.SetTLSConfig(tlsConfig)
+	}
+	if config.Http != nil {
+		origin.SetHttpConfig(config.Http)
+	}
+
+	mirrorBackend, err := NewMirrorBackend(origin, cacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if config.Cache != nil {
+		mirrorBackend.EnableCaching(config.Cache)
+	}
+
+	return mirrorBackend, nil
+}
+
+func (b *MirrorBackend) WithIdentity(ids []string) Backend {
+	// The cache is shared, so can't be filled on behalf of individual users
+	if b.cache != nil {
+		return b
+	}
+
+	if forwarder, ok := b.origin.(IdentityForwarder); ok {
+		return &MirrorBackend{
+			origin:   forwarder.WithIdentity(ids),
+			cacheDir: b.cacheDir,
+		}
+	}
+	return b
+}
+
+func (b *MirrorBackend) LocalDirs() ([]string, []string) {
+	return []string{b.cacheDir}, nil
+}
+
+func (b *MirrorBackend) List(reqPath string, depth int) (*Item, error) {
+	metaPath := path.Join(b.cacheDir, "meta", reqPath, fmt.Sprintf("depth_%d.json", depth))
+
+	if b.cache != nil {
+		if item := b.freshListing(metaPath); item != nil {
+			return item, nil
+		}
+	}
+
+	item, err := b.origin.List(reqPath, depth)
+	if err == nil {
+		err := os.MkdirAll(path.Dir(metaPath), 0755)
+		if err == nil {
+			saveJson(item, metaPath)
+		}
+		return item, nil
+	}
+
+	if !isOriginUnreachable(err) {
+		return nil, err
+	}
+
+	metaJson, readErr := ioutil.ReadFile(metaPath)
+	if readErr != nil {
+		return nil, &Error{
+			HttpCode: 503,
+			Message:  "Origin unreachable and listing not cached",
+		}
+	}
+
+	var cachedItem *Item
+	err = json.Unmarshal(metaJson, &cachedItem)
+	if err != nil {
+		return nil, err
+	}
+
+	return cachedItem, nil
+}
+
+func (b *MirrorBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	if b.cache != nil {
+		return b.readCached(reqPath, offset, length)
+	}
+
+	filePath := path.Join(b.cacheDir, "files", reqPath)
+
+	item, data, err := b.origin.Read(reqPath, offset, length)
+	if err == nil {
+		// Only complete reads can populate the cache. Ranged reads pass
+		// straight through.
+		if offset == 0 && length == 0 {
+			data = b.newCacheWriter(data, filePath, item.Size)
+		}
+		return item, data, nil
+	}
+
+	if !isOriginUnreachable(err) {
+		return nil, nil, err
+	}
+
+	file, openErr := os.Open(filePath)
+	if openErr != nil {
+		return nil, nil, &Error{
+			HttpCode: 503,
+			Message:  "Origin unreachable and file not cached",
+		}
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	_, err = file.Seek(offset, 0)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	copyLength := length
+	if length == 0 {
+		copyLength = stat.Size() - offset
+	}
+
+	cachedItem := &Item{
+		Size: stat.Size(),
+	}
+
+	return cachedItem, &limitedReadCloser{io.LimitReader(file, copyLength), file}, nil
+}
+
+// Origin errors that carry an HTTP code mean the origin answered, so they're
+// passed through rather than papered over with cached data.
+func isOriginUnreachable(err error) bool {
+	_, ok := err.(*Error)
+	return !ok
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *limitedReadCloser) Close() error {
+	return r.closer.Close()
+}
+
+// Copies everything read through it into a temporary file, which replaces
+// the cached copy once the expected number of bytes has been seen.
+type cacheWriter struct {
+	data     io.ReadCloser
+	tmpFile  *os.File
+	destPath string
+	expected int64
+	written  int64
+}
+
+func (b *MirrorBackend) newCacheWriter(data io.ReadCloser, destPath string, expected int64) io.ReadCloser {
+	err := os.MkdirAll(path.Dir(destPath), 0755)
+	if err != nil {
+		return data
+	}
+
+	tmpFile, err := ioutil.TempFile(path.Dir(destPath), ".mirror_tmp_")
+	if err != nil {
+		return data
+	}
+
+	return &cacheWriter{
+		data:     data,
+		tmpFile:  tmpFile,
+		destPath: destPath,
+		expected: expected,
+	}
+}
+
+func (w *cacheWriter) Read(p []byte) (int, error) {
+	n, err := w.data.Read(p)
+	if n > 0 && w.tmpFile != nil {
+		_, writeErr := w.tmpFile.Write(p[:n])
+		if writeErr != nil {
+			w.abort()
+		}
+		w.written += int64(n)
+	}
+	return n, err
+}
+
+func (w *cacheWriter) Close() error {
+	if w.tmpFile != nil {
+		if w.written == w.expected {
+			w.tmpFile.Close()
+			os.Rename(w.tmpFile.Name(), w.destPath)
+		} else {
+			w.abort()
+		}
+	}
+	return w.data.Close()
+}
+
+func (w *cacheWriter) abort() {
+	w.tmpFile.Close()
+	os.Remove(w.tmpFile.Name())
+	w.tmpFile = nil
+}
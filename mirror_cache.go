@@ -0,0 +1,339 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// With caching enabled a mirror becomes a caching proxy, like a LAN cache of
+// a remote media library. Listings are served from the cache until their TTL
+// runs out, and files are fetched from the origin in fixed size blocks,
+// so seeking around a large video only pulls the parts that are watched.
+// Blocks are trusted until their file's TTL runs out, after which the next
+// read revalidates against the origin and throws the blocks away if the
+// file has changed. Everything is fetched with the mirror's own credentials
+// and shared between all local clients, so caching is meant for public
+// content.
+type MirrorCacheConfig struct {
+	// Defaults to 60
+	ListingTtlSeconds int `json:"listingTtlSeconds,omitempty"`
+	// Defaults to 3600
+	FileTtlSeconds int `json:"fileTtlSeconds,omitempty"`
+	// Defaults to 1024
+	BlockSizeKiB int `json:"blockSizeKiB,omitempty"`
+}
+
+type mirrorBlockInfo struct {
+	Size    int64  `json:"size"`
+	ModTime string `json:"modTime,omitempty"`
+}
+
+func (b *MirrorBackend) EnableCaching(config *MirrorCacheConfig) {
+	b.cache = config
+}
+
+func (b *MirrorBackend) blockSize() int64 {
+	return int64(intOrDefault(b.cache.BlockSizeKiB, 1024)) * 1024
+}
+
+// Returns the cached listing at metaPath, if it's younger than the TTL.
+func (b *MirrorBackend) freshListing(metaPath string) *Item {
+	stat, err := os.Stat(metaPath)
+	if err != nil || time.Since(stat.ModTime()) > secondsOrDefault(b.cache.ListingTtlSeconds, 60) {
+		return nil
+	}
+
+	metaJson, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return nil
+	}
+
+	var item *Item
+	err = json.Unmarshal(metaJson, &item)
+	if err != nil {
+		return nil
+	}
+
+	return item
+}
+
+func (b *MirrorBackend) readCached(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	blockDir := path.Join(b.cacheDir, "blocks", reqPath)
+	infoPath := path.Join(blockDir, "info.json")
+	blockSize := b.blockSize()
+
+	info, infoAge := readBlockInfo(infoPath)
+	fresh := info != nil && infoAge <= secondsOrDefault(b.cache.FileTtlSeconds, 3600)
+
+	if fresh {
+		if reader := openBlocks(blockDir, blockSize, info.Size, offset, length); reader != nil {
+			return &Item{Size: info.Size, ModTime: info.ModTime}, reader, nil
+		}
+	}
+
+	// Fetch whole blocks, so they can all be cached
+	alignedOffset := offset / blockSize * blockSize
+	alignedLength := int64(0)
+	if length != 0 {
+		alignedEnd := (offset + length + blockSize - 1) / blockSize * blockSize
+		if info != nil && alignedEnd > info.Size {
+			alignedEnd = info.Size
+		}
+		alignedLength = alignedEnd - alignedOffset
+	}
+
+	item, data, err := b.origin.Read(reqPath, alignedOffset, alignedLength)
+	if err != nil {
+		if !isOriginUnreachable(err) {
+			return nil, nil, err
+		}
+
+		if info != nil {
+			if reader := openBlocks(blockDir, blockSize, info.Size, offset, length); reader != nil {
+				return &Item{Size: info.Size, ModTime: info.ModTime}, reader, nil
+			}
+		}
+
+		return nil, nil, &Error{
+			HttpCode: 503,
+			Message:  "Origin unreachable and file not cached",
+		}
+	}
+
+	// Without a modification time there's no telling whether expired blocks
+	// are from the same version of the file.
+	changed := info == nil || info.Size != item.Size || info.ModTime != item.ModTime || (!fresh && item.ModTime == "")
+	if changed {
+		os.RemoveAll(blockDir)
+	}
+
+	err = os.MkdirAll(blockDir, 0755)
+	if err == nil && (changed || !fresh) {
+		err = saveJson(&mirrorBlockInfo{Size: item.Size, ModTime: item.ModTime}, infoPath)
+	}
+	if err != nil {
+		fmt.Println("Failed to cache", reqPath, err)
+	}
+
+	writer := &blockCacheWriter{
+		data:      data,
+		dir:       blockDir,
+		blockSize: blockSize,
+		size:      item.Size,
+		pos:       alignedOffset,
+		failed:    err != nil,
+	}
+	if alignedLength != 0 {
+		writer.end = alignedOffset + alignedLength
+	}
+
+	_, err = io.CopyN(ioutil.Discard, writer, offset-alignedOffset)
+	if err != nil {
+		writer.Close()
+		return nil, nil, err
+	}
+
+	var reader io.ReadCloser = writer
+	if length != 0 {
+		reader = &limitedReadCloser{io.LimitReader(writer, length), writer}
+	}
+
+	return &Item{Size: item.Size, ModTime: item.ModTime}, reader, nil
+}
+
+// Returns the info, and how long ago it was saved.
+func readBlockInfo(infoPath string) (*mirrorBlockInfo, time.Duration) {
+	stat, err := os.Stat(infoPath)
+	if err != nil {
+		return nil, 0
+	}
+
+	infoJson, err := ioutil.ReadFile(infoPath)
+	if err != nil {
+		return nil, 0
+	}
+
+	var info *mirrorBlockInfo
+	err = json.Unmarshal(infoJson, &info)
+	if err != nil || info == nil {
+		return nil, 0
+	}
+
+	return info, time.Since(stat.ModTime())
+}
+
+func blockPath(dir string, index int64) string {
+	return path.Join(dir, fmt.Sprintf("%d", index))
+}
+
+// Returns a reader for the range, if every block it covers is cached.
+func openBlocks(dir string, blockSize, size, offset, length int64) io.ReadCloser {
+	end := size
+	if length != 0 && offset+length < size {
+		end = offset + length
+	}
+
+	if offset > end {
+		return nil
+	}
+
+	for pos := offset / blockSize * blockSize; pos < end; pos += blockSize {
+		_, err := os.Stat(blockPath(dir, pos/blockSize))
+		if err != nil {
+			return nil
+		}
+	}
+
+	return &blockReader{
+		dir:       dir,
+		blockSize: blockSize,
+		pos:       offset,
+		end:       end,
+	}
+}
+
+// Reads a range from cached blocks, opening each as it's reached.
+type blockReader struct {
+	dir       string
+	blockSize int64
+	pos       int64
+	end       int64
+	file      *os.File
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	for {
+		if r.pos >= r.end {
+			return 0, io.EOF
+		}
+
+		if r.file == nil {
+			index := r.pos / r.blockSize
+
+			file, err := os.Open(blockPath(r.dir, index))
+			if err != nil {
+				return 0, err
+			}
+
+			_, err = file.Seek(r.pos-index*r.blockSize, 0)
+			if err != nil {
+				file.Close()
+				return 0, err
+			}
+
+			r.file = file
+		}
+
+		if int64(len(p)) > r.end-r.pos {
+			p = p[:r.end-r.pos]
+		}
+
+		n, err := r.file.Read(p)
+		r.pos += int64(n)
+
+		if err == io.EOF {
+			r.file.Close()
+			r.file = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (r *blockReader) Close() error {
+	if r.file != nil {
+		return r.file.Close()
+	}
+	return nil
+}
+
+// Saves each complete block read through it from the origin. Reads start
+// on a block boundary, and partial blocks are thrown away.
+type blockCacheWriter struct {
+	data      io.ReadCloser
+	dir       string
+	blockSize int64
+	size      int64
+	pos       int64
+	// 0 when reading to the end of the file
+	end     int64
+	tmpFile *os.File
+	failed  bool
+}
+
+func (w *blockCacheWriter) Read(p []byte) (int, error) {
+	n, err := w.data.Read(p)
+	if n > 0 {
+		w.store(p[:n])
+	}
+	return n, err
+}
+
+func (w *blockCacheWriter) store(buf []byte) {
+	for len(buf) > 0 && w.pos < w.size {
+		index := w.pos / w.blockSize
+		blockEnd := (index + 1) * w.blockSize
+		if blockEnd > w.size {
+			blockEnd = w.size
+		}
+
+		chunk := int64(len(buf))
+		if chunk > blockEnd-w.pos {
+			chunk = blockEnd - w.pos
+		}
+
+		if !w.failed && w.tmpFile == nil {
+			tmpFile, err := ioutil.TempFile(w.dir, ".block_tmp_")
+			if err != nil {
+				w.failed = true
+			}
+			w.tmpFile = tmpFile
+		}
+
+		if !w.failed {
+			_, err := w.tmpFile.Write(buf[:chunk])
+			if err != nil {
+				w.abort()
+			}
+		}
+
+		w.pos += chunk
+		buf = buf[chunk:]
+
+		if w.pos == blockEnd && w.tmpFile != nil {
+			w.tmpFile.Close()
+			os.Rename(w.tmpFile.Name(), blockPath(w.dir, index))
+			w.tmpFile = nil
+		}
+	}
+}
+
+func (w *blockCacheWriter) Close() error {
+	// Clients usually stop partway through the last block. Finish reading
+	// it so it can be cached too.
+	if !w.failed && w.end != 0 && w.end-w.pos <= w.blockSize {
+		io.Copy(ioutil.Discard, w)
+	}
+
+	if w.tmpFile != nil {
+		w.abort()
+	}
+
+	return w.data.Close()
+}
+
+func (w *blockCacheWriter) abort() {
+	w.tmpFile.Close()
+	os.Remove(w.tmpFile.Name())
+	w.tmpFile = nil
+	w.failed = true
+}
@@ -0,0 +1,308 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mounts are configured one object each, with everything about a mount in
+// one place:
+//
+//	"mounts": [
+//	  {"path": "/srv/site", "website": true, "readOnly": true},
+//	  {"name": "media", "path": "/mnt/media", "quota": 500000000000,
+//	   "hidden": [".*", "*.tmp"], "noRawAccess": true}
+//	]
+//
+// The options exports has can be given in the mount instead. Dirs still
+// works, as mounts with just a path, and so do the sections for each type
+// that came before mounts, ie execBackends, as mounts of that type.
+
+type MountConfig struct {
+	// Defaults to the base name of the path
+	Name string `json:"name,omitempty"`
+	// fs, the default, git for a repository's trees, or any other type
+	// registered with RegisterBackend
+	Type string `json:"type,omitempty"`
+	// For fs and git mounts
+	Path string `json:"path,omitempty"`
+	// Options for the type, ie an exec mount's ExecBackendConfig
+	Options json.RawMessage `json:"options,omitempty"`
+	// Refuse every change
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Serve it like a static site. Missing files get its 404.html, pages
+	// can be linked without .html, and directories without an index.html
+	// aren't browsed.
+	Website bool `json:"website,omitempty"`
+	// Where thumbnails, listing indexes and other derived data go.
+	// Defaults to a directory named after the mount in cacheDir.
+	CacheDir string `json:"cacheDir,omitempty"`
+	// Don't watch for changes made outside GemDrive
+	NoWatch bool `json:"noWatch,omitempty"`
+	// Most bytes the mount may hold. Uploads that would go over are
+	// refused, though usage is only recounted every minute.
+	Quota int64 `json:"quota,omitempty"`
+	// Globs of names, ie ".*", kept out of listings and never served
+	Hidden []string `json:"hidden,omitempty"`
+	ExportConfig
+}
+
+const (
+	mountTypeFs  = "fs"
+	mountTypeGit = "git"
+)
+
+const mountUsageInterval = time.Minute
+
+var errReadOnlyMount = &Error{
+	HttpCode: 403,
+	Message:  "Mount is read-only",
+}
+
+// Mounts and dirs, with names filled in.
+func (c *Config) mounts() []*MountConfig {
+	mounts := []*MountConfig{}
+
+	for _, dir := range c.Dirs {
+		mounts = append(mounts, &MountConfig{
+			Name: exportName(dir),
+			Path: dir,
+		})
+	}
+
+	for _, mount := range c.Mounts {
+		m := *mount
+		if m.Name == "" {
+			m.Name = exportName(m.Path)
+			if m.Type == mountTypeGit {
+				m.Name = strings.TrimSuffix(m.Name, ".git")
+			}
+		}
+		mounts = append(mounts, &m)
+	}
+
+	return append(mounts, c.legacyMounts()...)
+}
+
+// The older config sections as mounts, sorted by name since most are maps.
+func (c *Config) legacyMounts() []*MountConfig {
+	mounts := []*MountConfig{}
+
+	withOptions := func(name, typ string, options interface{}) {
+		// Plain config structs, which always encode
+		encoded, _ := json.Marshal(options)
+		mounts = append(mounts, &MountConfig{
+			Name:    name,
+			Type:    typ,
+			Options: encoded,
+		})
+	}
+
+	if c.RcloneDir != "" {
+		mounts = append(mounts, &MountConfig{
+			Name: c.RcloneDir,
+			Type: "rclone",
+		})
+	}
+
+	for _, repo := range c.GitRepos {
+		mounts = append(mounts, &MountConfig{
+			Name: strings.TrimSuffix(exportName(repo), ".git"),
+			Type: mountTypeGit,
+			Path: repo,
+		})
+	}
+
+	for name, options := range c.ExecBackends {
+		withOptions(name, "exec", options)
+	}
+	for name, options := range c.SqlBackends {
+		withOptions(name, "sql", options)
+	}
+	for name, options := range c.ShardBackends {
+		withOptions(name, "shard", options)
+	}
+	for name, options := range c.ErasureBackends {
+		withOptions(name, "erasure", options)
+	}
+	for name, options := range c.Mirrors {
+		withOptions(name, "mirror", options)
+	}
+
+	sort.SliceStable(mounts, func(i, j int) bool {
+		return mounts[i].Name < mounts[j].Name
+	})
+
+	return mounts
+}
+
+func validateMounts(config *Config) error {
+	names := make(map[string]bool)
+
+	for _, mount := range config.mounts() {
+		if mount.Name == "" || strings.Contains(mount.Name, "/") || names[mount.Name] {
+			return fmt.Errorf("Invalid or repeated mount name %s", mount.Name)
+		}
+		names[mount.Name] = true
+
+		if backendFactory(mount.Type) == nil {
+			return fmt.Errorf("Mount %s: unknown type %s", mount.Name, mount.Type)
+		}
+
+		for _, pattern := range mount.Hidden {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("Mount %s: invalid hidden pattern %s", mount.Name, pattern)
+			}
+		}
+
+		if mount.ExportConfig != (ExportConfig{}) && config.Exports[mount.Name] != nil {
+			return fmt.Errorf("Mount %s has options in both mounts and exports", mount.Name)
+		}
+	}
+
+	return nil
+}
+
+type mountUsage struct {
+	bytes   int64
+	counted time.Time
+}
+
+// The read-only, hidden and quota settings of mounts, enforced by
+// MultiBackend for every backend type.
+type mountRules struct {
+	configs map[string]*MountConfig
+	usage   map[string]*mountUsage
+	mut     *sync.Mutex
+}
+
+func newMountRules() *mountRules {
+	return &mountRules{
+		configs: make(map[string]*MountConfig),
+		usage:   make(map[string]*mountUsage),
+		mut:     &sync.Mutex{},
+	}
+}
+
+func (m *mountRules) add(mount *MountConfig) {
+	m.configs[mount.Name] = mount
+}
+
+func (m *mountRules) get(name string) *MountConfig {
+	if m == nil || m.configs[name] == nil {
+		return &MountConfig{}
+	}
+	return m.configs[name]
+}
+
+func (m *mountRules) checkWritable(name string) error {
+	if m.get(name).ReadOnly {
+		return errReadOnlyMount
+	}
+	return nil
+}
+
+func (m *mountRules) hiddenName(name, childName string) bool {
+	childName = strings.TrimSuffix(childName, "/")
+	for _, pattern := range m.get(name).Hidden {
+		if matched, _ := path.Match(pattern, childName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether subPath, or any directory it's in, is hidden.
+func (m *mountRules) hidden(name, subPath string) bool {
+	for _, part := range strings.Split(subPath, "/") {
+		if part != "" && m.hiddenName(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes hidden children from a listing, at every depth.
+func (m *mountRules) prune(name string, item *Item) {
+	if item == nil || len(m.get(name).Hidden) == 0 {
+		return
+	}
+
+	for childName, child := range item.Children {
+		if m.hiddenName(name, childName) {
+			delete(item.Children, childName)
+		} else {
+			m.prune(name, child)
+		}
+	}
+}
+
+// Bytes left under the mount's quota, counting them every minute at most,
+// or -1 without one.
+func (m *mountRules) quotaLeft(name string, backend Backend) (int64, error) {
+	quota := m.get(name).Quota
+	if quota == 0 {
+		return -1, nil
+	}
+
+	m.mut.Lock()
+	usage, exists := m.usage[name]
+	m.mut.Unlock()
+
+	if !exists || time.Since(usage.counted) > mountUsageInterval {
+		root, err := backend.List("/", 0)
+		if err != nil {
+			return 0, err
+		}
+
+		usage = &mountUsage{
+			bytes:   treeSize(root),
+			counted: time.Now(),
+		}
+
+		m.mut.Lock()
+		m.usage[name] = usage
+		m.mut.Unlock()
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	return quota - usage.bytes, nil
+}
+
+// Counts writes towards the mount's usage until it's next recounted.
+func (m *mountRules) wrote(name string, bytes int64) {
+	if m == nil || bytes <= 0 {
+		return
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if usage, exists := m.usage[name]; exists {
+		usage.bytes += bytes
+	}
+}
+
+func treeSize(dir *Item) int64 {
+	if dir == nil {
+		return 0
+	}
+
+	var size int64
+	for childName, child := range dir.Children {
+		if strings.HasSuffix(childName, "/") {
+			size += treeSize(child)
+		} else if child != nil {
+			size += child.Size
+		}
+	}
+	return size
+}
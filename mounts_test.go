@@ -0,0 +1,72 @@
+package gemdrive
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newMountsTestConfig(t *testing.T) *Config {
+	dir := t.TempDir()
+	return &Config{
+		Dirs:     []string{filepath.Join(dir, "files")},
+		DataDir:  filepath.Join(dir, "data"),
+		CacheDir: filepath.Join(dir, "cache"),
+	}
+}
+
+func TestLegacyBackendSectionsAreMounts(t *testing.T) {
+	config := newMountsTestConfig(t)
+	config.RcloneDir = "cloud"
+	config.ExecBackends = map[string]*ExecBackendConfig{
+		"remote": {Command: []string{"true"}, TimeoutSeconds: 5},
+	}
+
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := server.backend.(*MultiBackend)
+	for _, name := range []string{"files", "cloud", "remote"} {
+		if backend.backends[name] == nil {
+			t.Errorf("%s isn't mounted", name)
+		}
+	}
+	if exec, ok := backend.backends["remote"].(*ExecBackend); !ok || exec.command[0] != "true" {
+		t.Errorf("remote lost its options: %+v", backend.backends["remote"])
+	}
+}
+
+func TestMountNamesUniqueAcrossSections(t *testing.T) {
+	for desc, configure := range map[string]func(config *Config){
+		"dir and exec backend": func(config *Config) {
+			config.ExecBackends = map[string]*ExecBackendConfig{
+				"files": {Command: []string{"true"}},
+			}
+		},
+		"dir and rclone": func(config *Config) {
+			config.RcloneDir = "files"
+		},
+		"git repo and mirror": func(config *Config) {
+			config.GitRepos = []string{"/srv/media.git"}
+			config.Mirrors = map[string]*MirrorConfig{
+				"media": {Origin: "https://example.com"},
+			}
+		},
+		"mount and erasure backend": func(config *Config) {
+			config.Mounts = []*MountConfig{{Name: "archive", Type: "rclone"}}
+			config.ErasureBackends = map[string]*ErasureBackendConfig{
+				"archive": {},
+			}
+		},
+	} {
+		config := newMountsTestConfig(t)
+		configure(config)
+
+		err := validateMounts(config)
+		if err == nil || !strings.Contains(err.Error(), "repeated mount name") {
+			t.Errorf("%s: got %v", desc, err)
+		}
+	}
+}
@@ -1,24 +1,83 @@
 package gemdrive
 
 import (
+	"context"
 	"errors"
 	"io"
 	"strings"
+	"time"
 )
 
 type MultiBackend struct {
 	backends map[string]Backend
+	metrics  *backendMetrics
+	guard    *mountGuard
+	targets  *backupTargets
+	virtual  *virtualFiles
+	holds    *legalHolds
+	mounts   *mountRules
 }
 
 func NewMultiBackend() *MultiBackend {
 	return &MultiBackend{backends: make(map[string]Backend)}
 }
 
+// Starts timing the operations of each backend.
+func (b *MultiBackend) SetMetrics(metrics *backendMetrics) {
+	b.metrics = metrics
+}
+
+// Wraps calls to backends with retries and circuit breakers.
+func (b *MultiBackend) SetGuard(guard *mountGuard) {
+	b.guard = guard
+}
+
+// Makes the backup targets append-only.
+func (b *MultiBackend) SetBackupTargets(targets *backupTargets) {
+	b.targets = targets
+}
+
+// Stops held paths from changing.
+func (b *MultiBackend) SetLegalHolds(holds *legalHolds) {
+	b.holds = holds
+}
+
+// Enforces the read-only, hidden and quota settings of mounts.
+func (b *MultiBackend) SetMountRules(mounts *mountRules) {
+	b.mounts = mounts
+}
+
+// Adds computed files to directories.
+func (b *MultiBackend) SetVirtualFiles(virtual *virtualFiles) {
+	b.virtual = virtual
+}
+
+// Virtual files are computed from everything but themselves.
+func (b *MultiBackend) withoutVirtualFiles() *MultiBackend {
+	return &MultiBackend{backends: b.backends, metrics: b.metrics, guard: b.guard, targets: b.targets, holds: b.holds, mounts: b.mounts}
+}
+
 func (b *MultiBackend) AddBackend(name string, backend Backend) error {
 	b.backends[name] = backend
 	return nil
 }
 
+// Returns a shallow copy in which every backend that forwards identities
+// has been bound to ids.
+func (b *MultiBackend) WithIdentity(ids []string) Backend {
+	backends := make(map[string]Backend)
+
+	for name, backend := range b.backends {
+		if forwarder, ok := backend.(IdentityForwarder); ok {
+			backends[name] = forwarder.WithIdentity(ids)
+		} else {
+			backends[name] = backend
+		}
+	}
+
+	return &MultiBackend{backends: backends, metrics: b.metrics, guard: b.guard, targets: b.targets, virtual: b.virtual, holds: b.holds, mounts: b.mounts}
+}
+
 func (b *MultiBackend) List(reqPath string, depth int) (*Item, error) {
 	if reqPath == "/" {
 		rootItem := &Item{
@@ -31,11 +90,19 @@ func (b *MultiBackend) List(reqPath string, depth int) (*Item, error) {
 
 		if depth == 0 || depth > 1 {
 			for name, backend := range b.backends {
-				child, err := backend.List("/", depth-1)
+				var child *Item
+				done := b.metrics.start(name, "list", "/")
+				err := b.guard.call(name, true, func() error {
+					var err error
+					child, err = backend.List("/", depth-1)
+					return err
+				})
+				done(err)
 				if err != nil {
 					return nil, err
 				}
 
+				b.mounts.prune(name, child)
 				rootItem.Children[name+"/"] = child
 			}
 		}
@@ -51,7 +118,59 @@ func (b *MultiBackend) List(reqPath string, depth int) (*Item, error) {
 		}
 	}
 
-	return b.backends[backendName].List(subPath, depth)
+	var item *Item
+	done := b.metrics.start(backendName, "list", subPath)
+	err = b.guard.call(backendName, true, func() error {
+		var err error
+		item, err = b.backends[backendName].List(subPath, depth)
+		return err
+	})
+	done(err)
+	if err == nil {
+		b.mounts.prune(backendName, item)
+	}
+	if err == nil && b.virtual != nil {
+		err = b.virtual.addTo(b.withoutVirtualFiles(), reqPath, item, depth)
+	}
+	return item, err
+}
+
+func (b *MultiBackend) ListPage(reqPath, after string, limit int) (*Item, string, error) {
+	if reqPath == "/" {
+		rootItem, err := b.List(reqPath, 1)
+		if err != nil {
+			return nil, "", err
+		}
+
+		page, next := pageItem(rootItem, after, limit)
+		return page, next, nil
+	}
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return nil, "", &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	var item *Item
+	var next string
+	done := b.metrics.start(backendName, "list", subPath)
+	err = b.guard.call(backendName, true, func() error {
+		var err error
+		item, next, err = listPage(b.backends[backendName], subPath, after, limit)
+		return err
+	})
+	done(err)
+	if err == nil {
+		b.mounts.prune(backendName, item)
+	}
+	// Virtual files come after the regular ones, on the last page
+	if err == nil && next == "" && b.virtual != nil {
+		err = b.virtual.addTo(b.withoutVirtualFiles(), reqPath, item, 1)
+	}
+	return item, next, err
 }
 
 func (b *MultiBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
@@ -64,7 +183,21 @@ func (b *MultiBackend) Read(reqPath string, offset, length int64) (*Item, io.Rea
 		}
 	}
 
-	return b.backends[backendName].Read(subPath, offset, length)
+	var item *Item
+	var data io.ReadCloser
+	done := b.metrics.start(backendName, "read", subPath)
+	err = b.guard.call(backendName, true, func() error {
+		var err error
+		item, data, err = b.backends[backendName].Read(subPath, offset, length)
+		return err
+	})
+	done(err)
+	if isNotFound(err) {
+		if file := b.virtual.find(reqPath); file != nil {
+			return b.virtual.read(b.withoutVirtualFiles(), file, reqPath, offset, length)
+		}
+	}
+	return item, data, err
 }
 
 func (b *MultiBackend) MakeDir(reqPath string, recursive bool) error {
@@ -76,8 +209,21 @@ func (b *MultiBackend) MakeDir(reqPath string, recursive bool) error {
 		}
 	}
 
+	err = b.mounts.checkWritable(backendName)
+	if err == nil {
+		err = b.holds.check(reqPath)
+	}
+	if err != nil {
+		return err
+	}
+
 	if backend, ok := b.backends[backendName].(WritableBackend); ok {
-		return backend.MakeDir(subPath, recursive)
+		done := b.metrics.start(backendName, "makeDir", subPath)
+		err := b.guard.call(backendName, false, func() error {
+			return backend.MakeDir(subPath, recursive)
+		})
+		done(err)
+		return err
 	}
 
 	return nil
@@ -93,13 +239,69 @@ func (b *MultiBackend) Write(reqPath string, data io.Reader, offset, length int6
 		}
 	}
 
+	err = b.mounts.checkWritable(backendName)
+	if err == nil {
+		err = b.holds.check(reqPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	contentAddressed, inTarget, err := b.targets.checkWrite(reqPath, offset, truncate)
+	if err != nil {
+		return err
+	}
+
+	if inTarget {
+		return b.writeToTarget(reqPath, data, length, contentAddressed)
+	}
+
 	if backend, ok := b.backends[backendName].(WritableBackend); ok {
-		return backend.Write(subPath, data, offset, length, overwrite, truncate)
+		done := b.metrics.start(backendName, "write", subPath)
+		err := b.guard.call(backendName, false, func() error {
+			return backend.Write(subPath, data, offset, length, overwrite, truncate)
+		})
+		done(err)
+		if err == nil {
+			b.mounts.wrote(backendName, length)
+		}
+		return err
 	}
 
 	return nil
 }
 
+// Writes a new file to a backup target. Content-addressed files are checked
+// as they're written, so ones not matching their names are never put in
+// place.
+func (b *MultiBackend) writeToTarget(reqPath string, data io.Reader, length int64, contentAddressed bool) error {
+	backendName, subPath, _ := b.parsePath(reqPath)
+
+	backend, ok := b.backends[backendName].(WritableBackend)
+	if !ok {
+		return nil
+	}
+
+	parentDir, name := splitItemPath(reqPath)
+	parent, err := b.List(parentDir, 1)
+	if err == nil && parent.Children[name] != nil {
+		return errAppendOnly
+	}
+
+	if contentAddressed {
+		data = newVerifyingReader(data, func(sums *Checksums) error {
+			return checkContentAddress(reqPath, sums)
+		})
+	}
+
+	done := b.metrics.start(backendName, "write", subPath)
+	err = b.guard.call(backendName, false, func() error {
+		return backend.Write(subPath, data, 0, length, false, true)
+	})
+	done(err)
+	return err
+}
+
 func (b *MultiBackend) Delete(reqPath string, recursive bool) error {
 	backendName, subPath, err := b.parsePath(reqPath)
 	if err != nil {
@@ -109,14 +311,107 @@ func (b *MultiBackend) Delete(reqPath string, recursive bool) error {
 		}
 	}
 
+	err = b.mounts.checkWritable(backendName)
+	if err == nil {
+		err = b.holds.checkTree(reqPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = b.targets.checkDelete(reqPath)
+	if err != nil {
+		return err
+	}
+
 	if backend, ok := b.backends[backendName].(WritableBackend); ok {
-		return backend.Delete(subPath, recursive)
+		done := b.metrics.start(backendName, "delete", subPath)
+		err := b.guard.call(backendName, false, func() error {
+			return backend.Delete(subPath, recursive)
+		})
+		done(err)
+		return err
 	}
 
 	return nil
 }
 
-func (b *MultiBackend) GetImage(reqPath string, size int) (io.Reader, int64, error) {
+func (b *MultiBackend) PunchHole(reqPath string, offset, length int64) error {
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	err = b.mounts.checkWritable(backendName)
+	if err == nil {
+		err = b.holds.check(reqPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = b.targets.checkModify(reqPath)
+	if err != nil {
+		return err
+	}
+
+	if backend, ok := b.backends[backendName].(HolePuncher); ok {
+		return backend.PunchHole(subPath, offset, length)
+	}
+
+	return errors.New("Backend does not support hole punching")
+}
+
+func (b *MultiBackend) Move(srcPath, dstPath string) error {
+
+	srcBackendName, srcSubPath, err := b.parsePath(srcPath)
+	if err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	dstBackendName, dstSubPath, err := b.parsePath(dstPath)
+	if err != nil || dstBackendName != srcBackendName {
+		return &Error{
+			HttpCode: 400,
+			Message:  "Can only move within a single backend",
+		}
+	}
+
+	err = b.mounts.checkWritable(srcBackendName)
+	if err == nil {
+		err = b.holds.checkTree(srcPath)
+	}
+	if err == nil {
+		err = b.holds.check(dstPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = b.targets.checkMove(srcPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	if backend, ok := b.backends[srcBackendName].(MovableBackend); ok {
+		done := b.metrics.start(srcBackendName, "move", srcSubPath)
+		err := b.guard.call(srcBackendName, false, func() error {
+			return backend.Move(srcSubPath, dstSubPath)
+		})
+		done(err)
+		return err
+	}
+
+	return errors.New("Backend does not support moving")
+}
+
+func (b *MultiBackend) GetImage(reqPath string, opts *ImageOptions) (io.Reader, int64, error) {
 
 	backendName, subPath, err := b.parsePath(reqPath)
 	if err != nil {
@@ -127,12 +422,288 @@ func (b *MultiBackend) GetImage(reqPath string, size int) (io.Reader, int64, err
 	}
 
 	if backend, ok := b.backends[backendName].(ImageServer); ok {
-		return backend.GetImage(subPath, size)
+		var data io.Reader
+		var size int64
+		done := b.metrics.start(backendName, "image", subPath)
+		err := b.guard.call(backendName, true, func() error {
+			var err error
+			data, size, err = backend.GetImage(subPath, opts)
+			return err
+		})
+		done(err)
+		return data, size, err
 	}
 
 	return nil, 0, errors.New("Backend does not support images")
 }
 
+func (b *MultiBackend) GetMediaMeta(reqPath string) (*MediaMeta, error) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if backend, ok := b.backends[backendName].(MediaMetaServer); ok {
+		var meta *MediaMeta
+		done := b.metrics.start(backendName, "mediaMeta", subPath)
+		err := b.guard.call(backendName, true, func() error {
+			var err error
+			meta, err = backend.GetMediaMeta(subPath)
+			return err
+		})
+		done(err)
+		return meta, err
+	}
+
+	return nil, errors.New("Backend does not support media metadata")
+}
+
+func (b *MultiBackend) SetChecksums(reqPath string, sums *Checksums) error {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if backend, ok := b.backends[backendName].(ChecksumStore); ok {
+		return backend.SetChecksums(subPath, sums)
+	}
+
+	return nil
+}
+
+func (b *MultiBackend) FreeSpace(reqPath string) (int64, error) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return 0, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	left, err := b.mounts.quotaLeft(backendName, b.backends[backendName])
+	if err != nil {
+		return 0, err
+	}
+
+	if backend, ok := b.backends[backendName].(SpaceReporter); ok {
+		free, err := backend.FreeSpace(subPath)
+		if err == nil && left >= 0 && left < free {
+			free = left
+		}
+		return free, err
+	}
+
+	if left >= 0 {
+		return left, nil
+	}
+
+	return 0, errors.New("Backend does not report free space")
+}
+
+func (b *MultiBackend) GetChecksums(reqPath string) (*Checksums, error) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if backend, ok := b.backends[backendName].(ChecksumStore); ok {
+		return backend.GetChecksums(subPath)
+	}
+
+	return nil, errors.New("Backend does not support checksums")
+}
+
+func (b *MultiBackend) DirVersion(reqPath string) (string, error) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return "", errNoDirVersion
+	}
+
+	if backend, ok := b.backends[backendName].(DirVersioner); ok {
+		return backend.DirVersion(subPath)
+	}
+
+	return "", errNoDirVersion
+}
+
+func (b *MultiBackend) DirChanges(ctx context.Context, reqPath, since string) ([]string, string, error) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return nil, "", errNoDirVersion
+	}
+
+	if backend, ok := b.backends[backendName].(DirVersioner); ok {
+		return backend.DirChanges(ctx, subPath, since)
+	}
+
+	return nil, "", errNoDirVersion
+}
+
+func (b *MultiBackend) DirMoves(reqPath string, names []string) (map[string]string, error) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return nil, errNoDirVersion
+	}
+
+	backend, ok := b.backends[backendName].(MoveTracker)
+	if !ok {
+		return nil, errNoDirVersion
+	}
+
+	subMoves, err := backend.DirMoves(subPath, names)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := make(map[string]string)
+	for name, from := range subMoves {
+		moves[name] = "/" + backendName + from
+	}
+
+	return moves, nil
+}
+
+func (b *MultiBackend) LocalPath(reqPath string) (string, error) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return "", err
+	}
+
+	if backend, ok := b.backends[backendName].(LocalFileBackend); ok {
+		return backend.LocalPath(subPath)
+	}
+
+	return "", errors.New("Backend has no local files")
+}
+
+func (b *MultiBackend) GetAttrs(reqPath string) (map[string]string, error) {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return nil, errNoNativeAttrs
+	}
+
+	if backend, ok := b.backends[backendName].(AttrBackend); ok {
+		return backend.GetAttrs(subPath)
+	}
+
+	return nil, errNoNativeAttrs
+}
+
+func (b *MultiBackend) SetAttrs(reqPath string, attrs map[string]string) error {
+
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return errNoNativeAttrs
+	}
+
+	err = b.mounts.checkWritable(backendName)
+	if err != nil {
+		return err
+	}
+
+	if backend, ok := b.backends[backendName].(AttrBackend); ok {
+		return backend.SetAttrs(subPath, attrs)
+	}
+
+	return errNoNativeAttrs
+}
+
+func (b *MultiBackend) ListAttrs(dirPath string) (map[string]map[string]string, error) {
+
+	backendName, subPath, err := b.parsePath(dirPath)
+	if err != nil {
+		return nil, errNoNativeAttrs
+	}
+
+	if backend, ok := b.backends[backendName].(AttrBackend); ok {
+		return backend.ListAttrs(subPath)
+	}
+
+	return nil, errNoNativeAttrs
+}
+
+func (b *MultiBackend) ListAt(reqPath string, depth int, at time.Time) (*Item, error) {
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	keeper, ok := b.backends[backendName].(VersionKeeper)
+	if !ok {
+		return nil, errNoVersions
+	}
+
+	var item *Item
+	done := b.metrics.start(backendName, "listAt", subPath)
+	err = b.guard.call(backendName, true, func() error {
+		var err error
+		item, err = keeper.ListAt(subPath, depth, at)
+		return err
+	})
+	done(err)
+	if err == nil {
+		b.mounts.prune(backendName, item)
+	}
+	return item, err
+}
+
+func (b *MultiBackend) ReadAt(reqPath string, at time.Time) (*Item, io.ReadCloser, error) {
+	backendName, subPath, err := b.parsePath(reqPath)
+	if err != nil {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	keeper, ok := b.backends[backendName].(VersionKeeper)
+	if !ok {
+		return nil, nil, errNoVersions
+	}
+
+	var item *Item
+	var data io.ReadCloser
+	done := b.metrics.start(backendName, "readAt", subPath)
+	err = b.guard.call(backendName, true, func() error {
+		var err error
+		item, data, err = keeper.ReadAt(subPath, at)
+		return err
+	})
+	done(err)
+	return item, data, err
+}
+
+func (b *MultiBackend) LocalDirs() ([]string, []string) {
+	writeDirs, readDirs := []string{}, []string{}
+	for _, backend := range b.backends {
+		write, read := localDirs(backend)
+		writeDirs = append(writeDirs, write...)
+		readDirs = append(readDirs, read...)
+	}
+	return writeDirs, readDirs
+}
+
 func (b *MultiBackend) parsePath(reqPath string) (string, string, error) {
 	parts := strings.Split(reqPath, "/")
 
@@ -148,5 +719,9 @@ func (b *MultiBackend) parsePath(reqPath string) (string, string, error) {
 
 	subPath := "/" + strings.Join(parts[2:], "/")
 
+	if b.mounts.hidden(backendName, subPath) {
+		return "", "", errors.New("Hidden")
+	}
+
 	return backendName, subPath, nil
 }
@@ -0,0 +1,244 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Music endpoints browse the audio files under a directory by their tags:
+//
+//   gemdrive/music/artists.json - artists, with how many albums and tracks
+//   gemdrive/music/albums.json  - albums, in order by artist and year
+//   gemdrive/music/tracks.json  - tracks, in album order
+//
+// Each takes artist, album and genre params to narrow them down. Artists are
+// album artists where the tags have them, so compilations stay together,
+// and untagged files are grouped by their directory.
+
+type MusicTrack struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Title       string `json:"title"`
+	Artist      string `json:"artist,omitempty"`
+	AlbumArtist string `json:"albumArtist,omitempty"`
+	Album       string `json:"album,omitempty"`
+	Track       int    `json:"track,omitempty"`
+	Disc        int    `json:"disc,omitempty"`
+	Year        int    `json:"year,omitempty"`
+	Genre       string `json:"genre,omitempty"`
+}
+
+type MusicArtist struct {
+	Name   string `json:"name"`
+	Albums int    `json:"albums"`
+	Tracks int    `json:"tracks"`
+}
+
+type MusicAlbum struct {
+	Name   string `json:"name"`
+	Artist string `json:"artist,omitempty"`
+	Year   int    `json:"year,omitempty"`
+	Path   string `json:"path"`
+	Tracks int    `json:"tracks"`
+}
+
+func (s *Server) serveMusic(w http.ResponseWriter, r *http.Request, gemPath, musicReq string) {
+
+	metaServer, ok := s.backend.(MediaMetaServer)
+	if !ok {
+		w.WriteHeader(500)
+		w.Write([]byte("Backend does not support media metadata"))
+		return
+	}
+
+	listing, err := s.metaLimits().listClamped(s.requestBackend(r), gemPath, 0)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		w.Write([]byte(e.Message))
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	token, _ := extractToken(r)
+	listing = s.pruneListing(token, gemPath, listing, actRead)
+
+	tracks := []*MusicTrack{}
+	collectMusicTracks(listing, "", &tracks)
+
+	query := r.URL.Query()
+	artist := query.Get("artist")
+	album := query.Get("album")
+	genre := query.Get("genre")
+
+	matching := []*MusicTrack{}
+	for _, track := range tracks {
+		if !s.auth.CanRead(token, gemPath+track.Path) {
+			continue
+		}
+
+		meta, err := metaServer.GetMediaMeta(gemPath + track.Path)
+		if err == nil && meta.Audio != nil {
+			tags := meta.Audio
+			if tags.Title != "" {
+				track.Title = tags.Title
+			}
+			if tags.Album != "" {
+				track.Album = tags.Album
+			}
+			track.Artist = tags.Artist
+			track.AlbumArtist = tags.AlbumArtist
+			track.Track = tags.Track
+			track.Disc = tags.Disc
+			track.Year = tags.Year
+			track.Genre = tags.Genre
+		}
+
+		if artist != "" && track.filedUnder() != artist && track.Artist != artist {
+			continue
+		}
+		if album != "" && track.Album != album {
+			continue
+		}
+		if genre != "" && !strings.EqualFold(track.Genre, genre) {
+			continue
+		}
+
+		matching = append(matching, track)
+	}
+
+	sort.Slice(matching, func(i, j int) bool {
+		a, b := matching[i], matching[j]
+		if a.filedUnder() != b.filedUnder() {
+			return strings.ToLower(a.filedUnder()) < strings.ToLower(b.filedUnder())
+		}
+		if a.Album != b.Album {
+			return a.Album < b.Album
+		}
+		if a.Disc != b.Disc {
+			return a.Disc < b.Disc
+		}
+		if a.Track != b.Track {
+			return a.Track < b.Track
+		}
+		return a.Path < b.Path
+	})
+
+	var result interface{}
+
+	switch musicReq {
+	case "artists.json":
+		result = musicArtists(matching)
+	case "albums.json":
+		result = musicAlbums(matching)
+	case "tracks.json":
+		result = matching
+	default:
+		w.WriteHeader(404)
+		w.Write([]byte("Not found"))
+		return
+	}
+
+	jsonBody, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+// The artist a track is filed under, which is the album artist if any.
+func (track *MusicTrack) filedUnder() string {
+	if track.AlbumArtist != "" {
+		return track.AlbumArtist
+	}
+	return track.Artist
+}
+
+// Tracks start out named after their files and directories, which is
+// replaced by their tags when they have them.
+func collectMusicTracks(item *Item, prefix string, tracks *[]*MusicTrack) {
+	for name, child := range item.Children {
+		if strings.HasSuffix(name, "/") {
+			collectMusicTracks(child, prefix+name, tracks)
+		} else if isAudioName(name) {
+			track := &MusicTrack{
+				Path:  prefix + name,
+				Size:  child.Size,
+				Title: strings.TrimSuffix(name, path.Ext(name)),
+			}
+			if prefix != "" {
+				track.Album = path.Base(prefix)
+			}
+			*tracks = append(*tracks, track)
+		}
+	}
+}
+
+// Expects tracks in album order.
+func musicArtists(tracks []*MusicTrack) []*MusicArtist {
+	artists := []*MusicArtist{}
+	var lastAlbum string
+
+	for _, track := range tracks {
+		if len(artists) == 0 || artists[len(artists)-1].Name != track.filedUnder() {
+			artists = append(artists, &MusicArtist{Name: track.filedUnder()})
+			lastAlbum = ""
+		}
+
+		artist := artists[len(artists)-1]
+		artist.Tracks++
+		if artist.Albums == 0 || track.Album != lastAlbum {
+			artist.Albums++
+			lastAlbum = track.Album
+		}
+	}
+
+	return artists
+}
+
+// Expects tracks in album order.
+func musicAlbums(tracks []*MusicTrack) []*MusicAlbum {
+	albums := []*MusicAlbum{}
+
+	for _, track := range tracks {
+		var album *MusicAlbum
+		if len(albums) > 0 {
+			album = albums[len(albums)-1]
+		}
+
+		if album == nil || album.Name != track.Album || album.Artist != track.filedUnder() {
+			dir, _ := path.Split(track.Path)
+			album = &MusicAlbum{
+				Name:   track.Album,
+				Artist: track.filedUnder(),
+				Year:   track.Year,
+				Path:   dir,
+			}
+			albums = append(albums, album)
+		}
+
+		if album.Year == 0 {
+			album.Year = track.Year
+		}
+		album.Tracks++
+	}
+
+	sort.SliceStable(albums, func(i, j int) bool {
+		a, b := albums[i], albums[j]
+		if a.Artist != b.Artist {
+			return strings.ToLower(a.Artist) < strings.ToLower(b.Artist)
+		}
+		return a.Year < b.Year
+	})
+
+	return albums
+}
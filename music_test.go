@@ -0,0 +1,57 @@
+package gemdrive
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMusicHonorsMetaLimits(t *testing.T) {
+	dir := t.TempDir()
+
+	filesDir := filepath.Join(dir, "files")
+	err := os.MkdirAll(filepath.Join(filesDir, "deep"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"top.mp3", "deep/nested.mp3"} {
+		err = ioutil.WriteFile(filepath.Join(filesDir, name), []byte("data"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server, err := NewServer(&Config{
+		Dirs:       []string{filesDir},
+		DataDir:    filepath.Join(dir, "data"),
+		CacheDir:   filepath.Join(dir, "cache"),
+		AdminEmail: "owner@example.com",
+		MetaLimits: &MetaLimitsConfig{MaxDepth: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := server.auth.AddEphemeralKeyring([]*Key{
+		{IdType: "email", Id: "owner@example.com", Perm: "own", Path: "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/files/gemdrive/music/tracks.json", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "top.mp3") {
+		t.Fatalf("got %d %s", w.Code, body)
+	}
+	if strings.Contains(body, "nested.mp3") {
+		t.Errorf("listed a track deeper than maxDepth: %s", body)
+	}
+}
@@ -0,0 +1,680 @@
+package gemdrive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// A minimal 9P2000 server exposing the backend tree, so it can be mounted
+// natively, ie:
+//
+//   mount -t 9p -o trans=tcp,port=5640,version=9p2000,aname=<token> host /mnt
+//
+// The attach name is used as the access token, and every operation goes
+// through the same ACL checks as HTTP requests.
+
+const (
+	ninepTversion = 100
+	ninepTauth    = 102
+	ninepTattach  = 104
+	ninepRerror   = 107
+	ninepTflush   = 108
+	ninepTwalk    = 110
+	ninepTopen    = 112
+	ninepTcreate  = 114
+	ninepTread    = 116
+	ninepTwrite   = 118
+	ninepTclunk   = 120
+	ninepTremove  = 122
+	ninepTstat    = 124
+	ninepTwstat   = 126
+
+	ninepMaxMsize   = 65536
+	ninepQtDir      = 0x80
+	ninepDmDir      = 0x80000000
+	ninepOTrunc     = 0x10
+	ninepHeaderSize = 7
+	// Room left in a message for the header of a read or write, the rest
+	// is the most data one can carry
+	ninepIoHeaderSize = 24
+)
+
+type ninepServer struct {
+	backend Backend
+	auth    *Auth
+	exports map[string]*ExportConfig
+}
+
+type ninepConn struct {
+	server *ninepServer
+	conn   net.Conn
+	msize  uint32
+	fids   map[uint32]*ninepFid
+}
+
+type ninepFid struct {
+	token   string
+	path    string
+	isDir   bool
+	opened  bool
+	dirData []byte
+	// Where the next directory read continues from. Reads can only start
+	// there or at 0, so they always start on an entry.
+	dirOffset uint64
+}
+
+type ninepQid struct {
+	qtype   uint8
+	version uint32
+	path    uint64
+}
+
+func newNinepServer(backend Backend, auth *Auth, exports map[string]*ExportConfig) *ninepServer {
+	return &ninepServer{backend, auth, exports}
+}
+
+func (s *ninepServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		c := &ninepConn{
+			server: s,
+			conn:   conn,
+			msize:  ninepMaxMsize,
+			fids:   make(map[uint32]*ninepFid),
+		}
+
+		go c.serve()
+	}
+}
+
+func (c *ninepConn) serve() {
+	defer c.conn.Close()
+
+	// A bad message should only cost its own connection
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("9P connection failed:", r)
+		}
+	}()
+
+	reader := bufio.NewReader(c.conn)
+
+	for {
+		var sizeBuf [4]byte
+		_, err := io.ReadFull(reader, sizeBuf[:])
+		if err != nil {
+			return
+		}
+
+		size := binary.LittleEndian.Uint32(sizeBuf[:])
+		if size < ninepHeaderSize || size > c.msize {
+			return
+		}
+
+		msg := make([]byte, size-4)
+		_, err = io.ReadFull(reader, msg)
+		if err != nil {
+			return
+		}
+
+		msgType := msg[0]
+		tag := binary.LittleEndian.Uint16(msg[1:3])
+
+		resp, err := c.handle(msgType, &ninepDecoder{buf: msg[3:]})
+
+		out := &ninepEncoder{}
+		if err != nil {
+			out.string(err.Error())
+			msgType = ninepRerror - 1
+		} else {
+			out.buf.Write(resp)
+		}
+
+		_, err = c.conn.Write(ninepFrame(msgType+1, tag, out.buf.Bytes()))
+		if err != nil {
+			return
+		}
+	}
+}
+
+func ninepFrame(msgType uint8, tag uint16, body []byte) []byte {
+	frame := make([]byte, ninepHeaderSize, ninepHeaderSize+len(body))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(ninepHeaderSize+len(body)))
+	frame[4] = msgType
+	binary.LittleEndian.PutUint16(frame[5:7], tag)
+	return append(frame, body...)
+}
+
+func (c *ninepConn) handle(msgType uint8, d *ninepDecoder) ([]byte, error) {
+	out := &ninepEncoder{}
+
+	switch msgType {
+	case ninepTversion:
+		msize := d.uint32()
+		version := d.string()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if msize <= ninepIoHeaderSize {
+			return nil, errors.New("msize too small")
+		}
+		if msize < c.msize {
+			c.msize = msize
+		}
+		if !strings.HasPrefix(version, "9P2000") {
+			version = "unknown"
+		} else {
+			version = "9P2000"
+		}
+		c.fids = make(map[uint32]*ninepFid)
+		out.uint32(c.msize)
+		out.string(version)
+	case ninepTauth:
+		return nil, errors.New("authentication not required")
+	case ninepTattach:
+		fid := d.uint32()
+		d.uint32()
+		d.string()
+		token := d.string()
+
+		c.fids[fid] = &ninepFid{token: token, path: "/", isDir: true}
+		out.qid(ninepPathQid("/", true))
+	case ninepTflush:
+	case ninepTwalk:
+		return c.walk(d)
+	case ninepTopen:
+		return c.open(d)
+	case ninepTcreate:
+		return c.create(d)
+	case ninepTread:
+		return c.read(d)
+	case ninepTwrite:
+		return c.write(d)
+	case ninepTclunk:
+		delete(c.fids, d.uint32())
+	case ninepTremove:
+		return c.remove(d)
+	case ninepTstat:
+		f, err := c.getFid(d.uint32())
+		if err != nil {
+			return nil, err
+		}
+		item, err := c.server.stat(f.path)
+		if err != nil {
+			return nil, err
+		}
+		stat := ninepStat(f.path, item, f.isDir)
+		out.uint16(uint16(len(stat) + 2))
+		out.uint16(uint16(len(stat)))
+		out.buf.Write(stat)
+	case ninepTwstat:
+		// Renames and mode changes aren't supported, but clients
+		// commonly send no-op wstats (ie for fsync), so accept them.
+	default:
+		return nil, fmt.Errorf("unsupported message type %d", msgType)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return out.buf.Bytes(), nil
+}
+
+func (c *ninepConn) getFid(fid uint32) (*ninepFid, error) {
+	f, exists := c.fids[fid]
+	if !exists {
+		return nil, errors.New("unknown fid")
+	}
+	return f, nil
+}
+
+func (c *ninepConn) walk(d *ninepDecoder) ([]byte, error) {
+	fid := d.uint32()
+	newFid := d.uint32()
+	numNames := d.uint16()
+
+	names := []string{}
+	for i := 0; i < int(numNames); i++ {
+		names = append(names, d.string())
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	f, err := c.getFid(fid)
+	if err != nil {
+		return nil, err
+	}
+
+	curPath := f.path
+	isDir := f.isDir
+	qids := []ninepQid{}
+
+	for _, name := range names {
+		if !isDir {
+			break
+		}
+
+		var nextPath string
+		if name == ".." {
+			nextPath = path.Dir(strings.TrimSuffix(curPath, "/"))
+			if nextPath != "/" {
+				nextPath += "/"
+			}
+			isDir = true
+		} else {
+			if !c.server.auth.CanList(f.token, curPath+name) {
+				break
+			}
+
+			listing, err := c.server.backend.List(curPath, 1)
+			if err != nil {
+				break
+			}
+
+			if _, exists := listing.Children[name+"/"]; exists {
+				nextPath = curPath + name + "/"
+				isDir = true
+			} else if _, exists := listing.Children[name]; exists {
+				nextPath = curPath + name
+				isDir = false
+			} else {
+				break
+			}
+		}
+
+		curPath = nextPath
+		qids = append(qids, ninepPathQid(curPath, isDir))
+	}
+
+	if len(names) > 0 && len(qids) == 0 {
+		return nil, errors.New("file not found")
+	}
+
+	if len(qids) == len(names) {
+		c.fids[newFid] = &ninepFid{token: f.token, path: curPath, isDir: isDir}
+	}
+
+	out := &ninepEncoder{}
+	out.uint16(uint16(len(qids)))
+	for _, qid := range qids {
+		out.qid(qid)
+	}
+	return out.buf.Bytes(), nil
+}
+
+func (c *ninepConn) open(d *ninepDecoder) ([]byte, error) {
+	f, err := c.getFid(d.uint32())
+	if err != nil {
+		return nil, err
+	}
+	mode := d.uint8()
+
+	if mode&3 == 1 {
+		if !c.server.auth.CanModify(f.token, f.path) {
+			return nil, errors.New("permission denied")
+		}
+	} else if f.isDir && !c.server.auth.CanList(f.token, f.path) {
+		return nil, errors.New("permission denied")
+	} else if !f.isDir && (!c.server.auth.CanRead(f.token, f.path) || !canReadRaw(c.server.exports, c.server.auth, f.token, f.path)) {
+		return nil, errors.New("permission denied")
+	}
+
+	if f.isDir {
+		listing, err := c.server.backend.List(f.path, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		dirData := &bytes.Buffer{}
+		for name, child := range listing.Children {
+			childIsDir := strings.HasSuffix(name, "/")
+			stat := ninepStat(f.path+name, child, childIsDir)
+			binary.Write(dirData, binary.LittleEndian, uint16(len(stat)))
+			dirData.Write(stat)
+		}
+		f.dirData = dirData.Bytes()
+		f.dirOffset = 0
+	} else if mode&ninepOTrunc != 0 {
+		backend, ok := c.server.backend.(WritableBackend)
+		if !ok || !c.server.auth.CanModify(f.token, f.path) {
+			return nil, errors.New("permission denied")
+		}
+
+		err := backend.Write(f.path, &bytes.Buffer{}, 0, 0, true, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f.opened = true
+
+	out := &ninepEncoder{}
+	out.qid(ninepPathQid(f.path, f.isDir))
+	out.uint32(c.msize - ninepIoHeaderSize)
+	return out.buf.Bytes(), nil
+}
+
+func (c *ninepConn) create(d *ninepDecoder) ([]byte, error) {
+	f, err := c.getFid(d.uint32())
+	if err != nil {
+		return nil, err
+	}
+	name := d.string()
+	perm := d.uint32()
+	d.uint8()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if !f.isDir || name == "" || strings.Contains(name, "/") || name == "." || name == ".." {
+		return nil, errors.New("invalid name")
+	}
+
+	backend, ok := c.server.backend.(WritableBackend)
+	if !ok {
+		return nil, errors.New("read-only file system")
+	}
+
+	isDir := perm&ninepDmDir != 0
+	newPath := f.path + name
+	if isDir {
+		newPath += "/"
+	}
+
+	if !c.server.auth.CanCreate(f.token, newPath) {
+		return nil, errors.New("permission denied")
+	}
+
+	if isDir {
+		err = backend.MakeDir(newPath, false)
+	} else {
+		err = backend.Write(newPath, &bytes.Buffer{}, 0, 0, false, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f.path = newPath
+	f.isDir = isDir
+	f.opened = true
+
+	out := &ninepEncoder{}
+	out.qid(ninepPathQid(f.path, f.isDir))
+	out.uint32(c.msize - ninepIoHeaderSize)
+	return out.buf.Bytes(), nil
+}
+
+func (c *ninepConn) read(d *ninepDecoder) ([]byte, error) {
+	f, err := c.getFid(d.uint32())
+	if err != nil {
+		return nil, err
+	}
+	offset := d.uint64()
+	count := d.uint32()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if !f.opened {
+		return nil, errors.New("fid not open")
+	}
+
+	if count > c.msize-ninepIoHeaderSize {
+		count = c.msize - ninepIoHeaderSize
+	}
+
+	var data []byte
+
+	if f.isDir {
+		// Directory reads must return whole stat entries.
+		if offset != 0 && offset != f.dirOffset {
+			return nil, errors.New("bad offset in directory read")
+		}
+		if offset < uint64(len(f.dirData)) {
+			end := offset
+			for end+2 <= uint64(len(f.dirData)) {
+				entrySize := uint64(binary.LittleEndian.Uint16(f.dirData[end:])) + 2
+				if end+entrySize-offset > uint64(count) || end+entrySize > uint64(len(f.dirData)) {
+					break
+				}
+				end += entrySize
+			}
+			data = f.dirData[offset:end]
+		}
+		f.dirOffset = offset + uint64(len(data))
+	} else {
+		data, err = c.server.readFile(f.path, int64(offset), int64(count))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := &ninepEncoder{}
+	out.uint32(uint32(len(data)))
+	out.buf.Write(data)
+	return out.buf.Bytes(), nil
+}
+
+func (c *ninepConn) write(d *ninepDecoder) ([]byte, error) {
+	f, err := c.getFid(d.uint32())
+	if err != nil {
+		return nil, err
+	}
+	offset := d.uint64()
+	count := d.uint32()
+	if d.err == nil && uint64(count) > uint64(len(d.buf)) {
+		return nil, errors.New("count larger than message")
+	}
+	data := d.bytes(int(count))
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	backend, ok := c.server.backend.(WritableBackend)
+	if !ok || f.isDir || !c.server.auth.CanModify(f.token, f.path) {
+		return nil, errors.New("permission denied")
+	}
+
+	err = backend.Write(f.path, bytes.NewReader(data), int64(offset), int64(count), true, false)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ninepEncoder{}
+	out.uint32(count)
+	return out.buf.Bytes(), nil
+}
+
+func (c *ninepConn) remove(d *ninepDecoder) ([]byte, error) {
+	fid := d.uint32()
+	f, err := c.getFid(fid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove clunks the fid even if it fails.
+	delete(c.fids, fid)
+
+	backend, ok := c.server.backend.(WritableBackend)
+	if !ok || !c.server.auth.CanDelete(f.token, f.path) {
+		return nil, errors.New("permission denied")
+	}
+
+	err = backend.Delete(f.path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (s *ninepServer) stat(itemPath string) (*Item, error) {
+	if itemPath == "/" {
+		return &Item{}, nil
+	}
+
+	trimmed := strings.TrimSuffix(itemPath, "/")
+	parentDir := path.Dir(trimmed)
+	if parentDir != "/" {
+		parentDir += "/"
+	}
+
+	listing, err := s.backend.List(parentDir, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	child, exists := listing.Children[path.Base(itemPath)+strings.TrimPrefix(itemPath, trimmed)]
+	if !exists {
+		return nil, errors.New("file not found")
+	}
+
+	return child, nil
+}
+
+func (s *ninepServer) readFile(filePath string, offset, count int64) ([]byte, error) {
+	item, err := s.stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset >= item.Size || count == 0 {
+		return []byte{}, nil
+	}
+
+	if offset+count > item.Size {
+		count = item.Size - offset
+	}
+
+	_, data, err := s.backend.Read(filePath, offset, count)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	return ioutil.ReadAll(data)
+}
+
+func ninepPathQid(itemPath string, isDir bool) ninepQid {
+	h := fnv.New64a()
+	io.WriteString(h, strings.TrimSuffix(itemPath, "/"))
+
+	qid := ninepQid{path: h.Sum64()}
+	if isDir {
+		qid.qtype = ninepQtDir
+	}
+	return qid
+}
+
+func ninepStat(itemPath string, item *Item, isDir bool) []byte {
+	name := path.Base(itemPath)
+	if itemPath == "/" {
+		name = "/"
+	}
+
+	var mode uint32 = 0644
+	if isDir {
+		mode = ninepDmDir | 0755
+	} else if item.IsExecutable {
+		mode = 0755
+	}
+
+	var mtime uint32
+	modTime, err := time.Parse(time.RFC3339, item.ModTime)
+	if err == nil {
+		mtime = uint32(modTime.Unix())
+	}
+
+	var length uint64
+	if !isDir {
+		length = uint64(item.Size)
+	}
+
+	out := &ninepEncoder{}
+	out.uint16(0)
+	out.uint32(0)
+	out.qid(ninepPathQid(itemPath, isDir))
+	out.uint32(mode)
+	out.uint32(mtime)
+	out.uint32(mtime)
+	out.uint64(length)
+	out.string(name)
+	out.string("gemdrive")
+	out.string("gemdrive")
+	out.string("gemdrive")
+	return out.buf.Bytes()
+}
+
+type ninepEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *ninepEncoder) uint8(v uint8) {
+	e.buf.WriteByte(v)
+}
+func (e *ninepEncoder) uint16(v uint16) {
+	binary.Write(&e.buf, binary.LittleEndian, v)
+}
+func (e *ninepEncoder) uint32(v uint32) {
+	binary.Write(&e.buf, binary.LittleEndian, v)
+}
+func (e *ninepEncoder) uint64(v uint64) {
+	binary.Write(&e.buf, binary.LittleEndian, v)
+}
+func (e *ninepEncoder) string(v string) {
+	e.uint16(uint16(len(v)))
+	e.buf.WriteString(v)
+}
+func (e *ninepEncoder) qid(q ninepQid) {
+	e.uint8(q.qtype)
+	e.uint32(q.version)
+	e.uint64(q.path)
+}
+
+type ninepDecoder struct {
+	buf []byte
+	err error
+}
+
+// Past the end of the message, gives zeros enough for any fixed size field,
+// rather than the length asked for, which could be anything.
+func (d *ninepDecoder) bytes(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.buf) {
+		d.err = errors.New("short message")
+		return make([]byte, 8)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+func (d *ninepDecoder) uint8() uint8 {
+	return d.bytes(1)[0]
+}
+func (d *ninepDecoder) uint16() uint16 {
+	return binary.LittleEndian.Uint16(d.bytes(2))
+}
+func (d *ninepDecoder) uint32() uint32 {
+	return binary.LittleEndian.Uint32(d.bytes(4))
+}
+func (d *ninepDecoder) uint64() uint64 {
+	return binary.LittleEndian.Uint64(d.bytes(8))
+}
+func (d *ninepDecoder) string() string {
+	return string(d.bytes(int(d.uint16())))
+}
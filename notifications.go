@@ -0,0 +1,248 @@
+package gemdrive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Notification rules email people when something happens under a path:
+//
+//   {"event": "upload", "path": "/files/inbox/", "to": ["me@example.com"]}
+//
+// Events are "upload", "shareAccess" for when a share link is used,
+// "lowSpace" for when free space under the path drops below minFreeSpace
+// after an upload, and "processingFailed" for when a processor rule fails
+// on an upload. Messages come from templates in
+// DataDir/gemdrive_templates/<event>.txt, if present, which are Go
+// text/templates whose first line is "Subject: ...". Share access and low
+// space are noisy, so each rule sends those at most once per
+// notifyInterval for the same share or path.
+
+const (
+	eventUpload      = "upload"
+	eventShareAccess = "shareAccess"
+	eventLowSpace    = "lowSpace"
+	// Sent by upload processors
+	eventProcessingFailed = "processingFailed"
+)
+
+const notifyInterval = time.Hour
+
+type NotificationRule struct {
+	Event string   `json:"event,omitempty"`
+	Path  string   `json:"path,omitempty"`
+	To    []string `json:"to,omitempty"`
+	// Bytes, for lowSpace rules
+	MinFreeSpace int64 `json:"minFreeSpace,omitempty"`
+}
+
+type notificationData struct {
+	Server    string
+	Event     string
+	Path      string
+	Principal string
+	ShareId   string
+	Size      int64
+	FreeSpace int64
+	Error     string
+	Time      string
+}
+
+var defaultNotificationTemplates = map[string]string{
+	eventUpload: "Subject: New upload to {{.Path}}\n" +
+		"{{.Principal}} uploaded {{.Path}} ({{.Size}} bytes) to {{.Server}} at {{.Time}}.\n",
+	eventShareAccess: "Subject: Share {{.ShareId}} was used\n" +
+		"The share of {{.Path}} on {{.Server}} was used at {{.Time}}.\n",
+	eventLowSpace: "Subject: {{.Server}} is running out of space\n" +
+		"Only {{.FreeSpace}} bytes were free after {{.Path}} was uploaded at {{.Time}}.\n",
+	eventProcessingFailed: "Subject: Processing {{.Path}} failed\n" +
+		"Processing {{.Path}} on {{.Server}} failed at {{.Time}}.\n\n{{.Error}}\n",
+}
+
+type notifier struct {
+	rules       []*NotificationRule
+	mailer      *mailer
+	templateDir string
+	server      string
+	lastSent    map[string]time.Time
+	mut         *sync.Mutex
+	cluster     *cluster
+}
+
+func newNotifier(config *Config, cluster *cluster) *notifier {
+	server := config.ServerName
+	if server == "" {
+		server = ServerName
+	}
+
+	n := &notifier{
+		rules:       config.Notifications,
+		mailer:      newMailer(config.Smtp),
+		templateDir: filepath.Join(config.DataDir, "gemdrive_templates"),
+		server:      server,
+		lastSent:    make(map[string]time.Time),
+		mut:         &sync.Mutex{},
+		cluster:     cluster,
+	}
+
+	if len(n.rules) > 0 && !n.mailer.configured() {
+		fmt.Println("Notification rules are configured, but SMTP isn't. Notifications won't be sent.")
+	}
+
+	return n
+}
+
+func (n *notifier) watching(event string) bool {
+	for _, rule := range n.rules {
+		if rule.Event == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends data to every rule for its event and path. Rules which were sent
+// throttleKey within notifyInterval are skipped, unless it's empty.
+func (n *notifier) notify(data *notificationData, throttleKey string, match func(rule *NotificationRule) bool) {
+	data.Server = n.server
+	data.Time = time.Now().UTC().Format(time.RFC3339)
+
+	for i, rule := range n.rules {
+		if rule.Event != data.Event || !strings.HasPrefix(data.Path, rule.Path) {
+			continue
+		}
+
+		if match != nil && !match(rule) {
+			continue
+		}
+
+		if throttleKey != "" && !n.allow(fmt.Sprintf("%d:%s", i, throttleKey)) {
+			continue
+		}
+
+		go func(rule *NotificationRule) {
+			err := n.send(rule, data)
+			if err != nil {
+				fmt.Println("Failed to send", data.Event, "notification:", err)
+			}
+		}(rule)
+	}
+}
+
+func (n *notifier) allow(key string) bool {
+	if n.cluster != nil {
+		return n.cluster.claim("notify:"+key, notifyInterval)
+	}
+
+	n.mut.Lock()
+	defer n.mut.Unlock()
+
+	now := time.Now()
+
+	if last, exists := n.lastSent[key]; exists && now.Sub(last) < notifyInterval {
+		return false
+	}
+
+	n.lastSent[key] = now
+
+	return true
+}
+
+func (n *notifier) send(rule *NotificationRule, data *notificationData) error {
+	subject, body, err := n.render(data)
+	if err != nil {
+		return err
+	}
+
+	return n.mailer.send("GemDrive", rule.To, subject, body)
+}
+
+func (n *notifier) render(data *notificationData) (string, string, error) {
+	text := defaultNotificationTemplates[data.Event]
+
+	custom, err := ioutil.ReadFile(filepath.Join(n.templateDir, data.Event+".txt"))
+	if err == nil {
+		text = string(custom)
+	} else if !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	tmpl, err := template.New(data.Event).Parse(text)
+	if err != nil {
+		return "", "", err
+	}
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	parts := strings.SplitN(out.String(), "\n", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "Subject: ") {
+		return "", "", errors.New("Template must start with a Subject line")
+	}
+
+	subject := strings.TrimSpace(strings.TrimPrefix(parts[0], "Subject: "))
+
+	return subject, strings.TrimLeft(parts[1], "\n"), nil
+}
+
+// Called after every completed upload.
+func (s *Server) notifyUpload(reqPath, principal string, size int64) {
+	s.notifier.notify(&notificationData{
+		Event:     eventUpload,
+		Path:      reqPath,
+		Principal: principal,
+		Size:      size,
+	}, "", nil)
+
+	if !s.notifier.watching(eventLowSpace) {
+		return
+	}
+
+	reporter, ok := s.backend.(SpaceReporter)
+	if !ok {
+		return
+	}
+
+	free, err := reporter.FreeSpace(reqPath)
+	if err != nil {
+		return
+	}
+
+	s.notifier.notify(&notificationData{
+		Event:     eventLowSpace,
+		Path:      reqPath,
+		FreeSpace: free,
+	}, "lowSpace", func(rule *NotificationRule) bool {
+		return free < rule.MinFreeSpace
+	})
+}
+
+// Called for every request, so it only looks up the share when someone is
+// listening.
+func (s *Server) notifyShareAccess(token string) {
+	if token == "" || !s.notifier.watching(eventShareAccess) {
+		return
+	}
+
+	share, err := s.auth.db.GetShareByToken(token)
+	if err != nil {
+		return
+	}
+
+	s.notifier.notify(&notificationData{
+		Event:   eventShareAccess,
+		Path:    share.Path,
+		ShareId: share.Id,
+	}, share.Id, nil)
+}
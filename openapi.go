@@ -0,0 +1,900 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// gemdrive/openapi.json describes the HTTP API as an OpenAPI 3 document, for
+// generating clients in other languages. Schemas are derived from the Go
+// types the handlers encode, so they can't drift from the real responses.
+//
+// File paths can contain any number of slashes, which OpenAPI path templates
+// can't express, so {path} and {dir} stand for whole paths and {dir} always
+// ends in a slash. MOVE isn't an OpenAPI method, and is described with an
+// x-move extension.
+
+type openApiParameter struct {
+	Name        string                 `json:"name"`
+	In          string                 `json:"in"`
+	Description string                 `json:"description,omitempty"`
+	Required    bool                   `json:"required,omitempty"`
+	Schema      map[string]interface{} `json:"schema"`
+}
+
+type openApiContent struct {
+	Schema map[string]interface{} `json:"schema"`
+}
+
+type openApiRequestBody struct {
+	Required bool                       `json:"required,omitempty"`
+	Content  map[string]*openApiContent `json:"content"`
+}
+
+type openApiResponse struct {
+	Description string                     `json:"description"`
+	Content     map[string]*openApiContent `json:"content,omitempty"`
+}
+
+type openApiOperation struct {
+	Summary     string                      `json:"summary"`
+	Parameters  []*openApiParameter         `json:"parameters,omitempty"`
+	RequestBody *openApiRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openApiResponse `json:"responses"`
+}
+
+type openApiPathItem struct {
+	Get    *openApiOperation `json:"get,omitempty"`
+	Head   *openApiOperation `json:"head,omitempty"`
+	Put    *openApiOperation `json:"put,omitempty"`
+	Post   *openApiOperation `json:"post,omitempty"`
+	Patch  *openApiOperation `json:"patch,omitempty"`
+	Delete *openApiOperation `json:"delete,omitempty"`
+	Move   *openApiOperation `json:"x-move,omitempty"`
+}
+
+type openApiDocument struct {
+	OpenApi    string                      `json:"openapi"`
+	Info       map[string]string           `json:"info"`
+	Paths      map[string]*openApiPathItem `json:"paths"`
+	Components map[string]interface{}      `json:"components"`
+	Security   []map[string][]string       `json:"security"`
+}
+
+// Collects the schemas of named struct types as components, so recursive
+// types like Item become references to themselves.
+type openApiSchemas map[string]interface{}
+
+func (c openApiSchemas) schemaFor(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return c.schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": c.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": c.schemaFor(t.Elem())}
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+
+		if _, exists := c[t.Name()]; exists {
+			return ref
+		}
+
+		properties := make(map[string]interface{})
+		schema := map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+		}
+
+		// Registered before the fields are walked, for recursive types
+		c[t.Name()] = schema
+
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+
+			tag := field.Tag.Get("json")
+			if tag == "-" || field.PkgPath != "" {
+				continue
+			}
+
+			tagParts := strings.Split(tag, ",")
+			name := tagParts[0]
+			if name == "" {
+				name = field.Name
+			}
+
+			properties[name] = c.schemaFor(field.Type)
+
+			omitempty := false
+			for _, option := range tagParts[1:] {
+				if option == "omitempty" {
+					omitempty = true
+				}
+			}
+			if !omitempty {
+				required = append(required, name)
+			}
+		}
+
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+
+		return ref
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func (c openApiSchemas) jsonContent(v interface{}) map[string]*openApiContent {
+	return map[string]*openApiContent{
+		"application/json": {Schema: c.schemaFor(reflect.TypeOf(v))},
+	}
+}
+
+func binaryContent(contentType string) map[string]*openApiContent {
+	return map[string]*openApiContent{
+		contentType: {Schema: map[string]interface{}{"type": "string", "format": "binary"}},
+	}
+}
+
+func pathParam(name, description string) *openApiParameter {
+	return &openApiParameter{
+		Name:        name,
+		In:          "path",
+		Description: description,
+		Required:    true,
+		Schema:      map[string]interface{}{"type": "string"},
+	}
+}
+
+func queryParam(name, schemaType, description string) *openApiParameter {
+	return &openApiParameter{
+		Name:        name,
+		In:          "query",
+		Description: description,
+		Schema:      map[string]interface{}{"type": schemaType},
+	}
+}
+
+func headerParam(name, description string) *openApiParameter {
+	return &openApiParameter{
+		Name:        name,
+		In:          "header",
+		Description: description,
+		Schema:      map[string]interface{}{"type": "string"},
+	}
+}
+
+func okResponse(description string, content map[string]*openApiContent) map[string]*openApiResponse {
+	return map[string]*openApiResponse{
+		"200": {Description: description, Content: content},
+	}
+}
+
+func openApiSpec() *openApiDocument {
+	schemas := openApiSchemas{}
+
+	filePath := pathParam("path", "Path of a file, or of a directory if it ends in a slash")
+	dir := pathParam("dir", "Path of a directory, ending in a slash")
+	idempotencyKey := headerParam("Idempotency-Key", "Retries with the same key replay the first response instead of repeating the write")
+	checksumHeaders := []*openApiParameter{
+		headerParam("Content-MD5", "Base64 MD5 of the body, verified once written"),
+		headerParam("X-Checksum-SHA256", "Hex or base64 SHA-256 of the body, verified once written"),
+	}
+	encryptionHeaders := []*openApiParameter{
+		headerParam("X-GemDrive-Encryption", "Scheme the file was encrypted with by the client"),
+		headerParam("X-GemDrive-Plaintext-Size", "Size of the file before encryption"),
+		headerParam("X-GemDrive-Key-Wrap", "Wrapped file key, stored as is"),
+	}
+	musicParams := []*openApiParameter{
+		dir,
+		queryParam("artist", "string", "Only this artist or album artist"),
+		queryParam("album", "string", "Only this album"),
+		queryParam("genre", "string", "Only this genre"),
+	}
+
+	paths := map[string]*openApiPathItem{
+		"/{path}": {
+			Get: &openApiOperation{
+				Summary: "Download a file",
+				Parameters: []*openApiParameter{
+					filePath,
+					headerParam("Range", "Single byte range, ie bytes=0-1023"),
+					headerParam("If-Range", "ETag or Last-Modified date the range is only wanted for"),
+					queryParam("download", "boolean", "Serve as an attachment"),
+					queryParam("filename", "string", "Name to save the file as, instead of its own"),
+					queryParam("at", "string", "Read the file as it was at this time, in RFC 3339 or Unix seconds. Needs versioning, and ignores ranges."),
+				},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "File contents", Content: binaryContent("application/octet-stream")},
+					"206": {Description: "Requested range", Content: binaryContent("application/octet-stream")},
+					"501": {Description: "Past versions aren't kept for this mount"},
+				},
+			},
+			Head: &openApiOperation{
+				Summary:    "Get a file's size and type",
+				Parameters: []*openApiParameter{filePath},
+				Responses:  okResponse("File exists", nil),
+			},
+			Put: &openApiOperation{
+				Summary: "Upload a file, or create a directory if the path ends in a slash",
+				Parameters: append([]*openApiParameter{
+					filePath,
+					idempotencyKey,
+					queryParam("overwrite", "boolean", "Replace an existing file"),
+					queryParam("recursive", "boolean", "Create missing parent directories"),
+					headerParam("Content-Range", "Upload one chunk of a larger file, ie bytes 0-1023/4096"),
+					headerParam("X-GemDrive-Dedup", "link to copy a readable file with the X-Checksum-SHA256 instead of sending a body"),
+				}, append(checksumHeaders, encryptionHeaders...)...),
+				RequestBody: &openApiRequestBody{Content: binaryContent("application/octet-stream")},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Upload complete. Location is set if the directory's upload policy renamed the file."},
+					"202": {Description: "Chunk stored, upload incomplete"},
+					"400": {Description: "Name with control characters or invalid UTF-8, or file type not accepted by the directory's upload policy"},
+					"403": {Description: "Uploaders can only replace their own files"},
+					"409": {Description: "File exists"},
+					"412": {Description: "Nothing to dedup link to, send the content"},
+					"413": {Description: "Upload too large"},
+					"507": {Description: "Insufficient storage"},
+				},
+			},
+			Patch: &openApiOperation{
+				Summary: "Write into an existing file at an offset",
+				Parameters: []*openApiParameter{
+					filePath,
+					idempotencyKey,
+					queryParam("offset", "integer", "Byte offset to write at"),
+					queryParam("punchHole", "boolean", "Deallocate length bytes at offset instead of writing"),
+					queryParam("length", "integer", "Length of the hole to punch"),
+				},
+				RequestBody: &openApiRequestBody{Content: binaryContent("application/octet-stream")},
+				Responses:   okResponse("Written", nil),
+			},
+			Delete: &openApiOperation{
+				Summary: "Delete a file or directory",
+				Parameters: []*openApiParameter{
+					filePath,
+					idempotencyKey,
+					queryParam("recursive", "boolean", "Delete a directory and everything in it"),
+				},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Deleted"},
+					"202": {Description: "Recursive delete still running in the background, or of an export root and waiting for approval", Content: schemas.jsonContent(DeleteJob{})},
+				},
+			},
+			Move: &openApiOperation{
+				Summary: "Move or rename a file or directory",
+				Parameters: []*openApiParameter{
+					filePath,
+					idempotencyKey,
+					{
+						Name:        "Destination",
+						In:          "header",
+						Description: "New path, ending in a slash for directories",
+						Required:    true,
+						Schema:      map[string]interface{}{"type": "string"},
+					},
+				},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Moved"},
+					"409": {Description: "Destination exists"},
+				},
+			},
+		},
+		"/{dir}gemdrive/meta.json": {
+			Get: &openApiOperation{
+				Summary: "List a directory",
+				Parameters: []*openApiParameter{
+					dir,
+					queryParam("depth", "integer", "Levels of children to include. 0 means unlimited."),
+					queryParam("limit", "integer", "Page size. The Link header points to the next page."),
+					queryParam("after", "string", "Only include children named after this"),
+					queryParam("since", "string", "Only include children changed since this generation, from the GemDrive-Generation header, with removed ones as null and moved ones with movedFrom. Waits for a change if there are none yet."),
+					queryParam("wait", "integer", "Seconds to wait for changes with since. Defaults to 25, at most 60."),
+					queryParam("at", "string", "List the directory as it was at this time, in RFC 3339 or Unix seconds. Needs versioning."),
+					headerParam("If-None-Match", "ETag of a previous listing, to get a 304 if nothing has changed"),
+				},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Directory listing", Content: schemas.jsonContent(Item{})},
+					"304": {Description: "Unchanged since the given ETag"},
+					"410": {Description: "Generation from before a restart or too long ago, so the directory must be listed again"},
+					"413": {Description: "Listing has more items or bytes than the server allows"},
+					"422": {Description: "Depth deeper than the server allows"},
+				},
+			},
+		},
+		"/{dir}gemdrive/attrs.json": {
+			Get: &openApiOperation{
+				Summary:    "Attributes of the files in a directory, by name",
+				Parameters: []*openApiParameter{dir},
+				Responses:  okResponse("Attributes", schemas.jsonContent(map[string]map[string]string{})),
+			},
+		},
+		"/{dir}gemdrive/attrs/{name}": {
+			Get: &openApiOperation{
+				Summary:    "A file's attributes",
+				Parameters: []*openApiParameter{dir, pathParam("name", "File name")},
+				Responses:  okResponse("Attributes", schemas.jsonContent(map[string]string{})),
+			},
+			Put: &openApiOperation{
+				Summary:     "Replace a file's attributes",
+				Parameters:  []*openApiParameter{dir, pathParam("name", "File name")},
+				RequestBody: &openApiRequestBody{Content: schemas.jsonContent(map[string]string{})},
+				Responses:   okResponse("Attributes", schemas.jsonContent(map[string]string{})),
+			},
+			Delete: &openApiOperation{
+				Summary:    "Remove all of a file's attributes",
+				Parameters: []*openApiParameter{dir, pathParam("name", "File name")},
+				Responses:  okResponse("Removed", nil),
+			},
+		},
+		"/{dir}gemdrive/uploads.json": {
+			Get: &openApiOperation{
+				Summary: "Who uploaded each file under a directory",
+				Parameters: []*openApiParameter{
+					dir,
+					queryParam("owner", "string", "Only include uploads by this principal, ie email:someone@example.com"),
+				},
+				Responses: okResponse("Uploads", schemas.jsonContent([]*Upload{})),
+			},
+		},
+		"/{dir}gemdrive/images/{size}/{filename}": {
+			Get: &openApiOperation{
+				Summary: "Get a thumbnail of an image, RAW photo or video",
+				Parameters: []*openApiParameter{
+					dir,
+					pathParam("size", "Longest side, or WxH"),
+					pathParam("filename", "Name of the source file"),
+					queryParam("fit", "string", "contain or cover"),
+					queryParam("autoRotate", "boolean", "Apply the EXIF orientation, on by default"),
+					queryParam("rotate", "integer", "90, 180 or 270"),
+					queryParam("quality", "integer", "JPEG quality, 1-100"),
+					headerParam("Range", "Single byte range, ie bytes=0-1023"),
+					headerParam("If-None-Match", "ETag of a thumbnail already fetched, to get a 304 if it's unchanged"),
+				},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Thumbnail", Content: binaryContent("image/*")},
+					"206": {Description: "Requested range", Content: binaryContent("image/*")},
+					"304": {Description: "Not modified"},
+				},
+			},
+		},
+		"/{dir}gemdrive/feed.xml": {
+			Get: &openApiOperation{
+				Summary:    "RSS feed of recently changed files",
+				Parameters: []*openApiParameter{dir},
+				Responses:  okResponse("Feed", binaryContent("application/rss+xml")),
+			},
+		},
+		"/{dir}gemdrive/playlist.m3u8": {
+			Get: &openApiOperation{
+				Summary: "M3U playlist of the audio files in a directory",
+				Parameters: []*openApiParameter{
+					dir,
+					queryParam("recursive", "boolean", "Include subdirectories"),
+				},
+				Responses: okResponse("Playlist", binaryContent("audio/x-mpegurl")),
+			},
+		},
+		"/{dir}gemdrive/media.json": {
+			Get: &openApiOperation{
+				Summary: "Videos in a directory, with their subtitles and alternate audio tracks",
+				Parameters: []*openApiParameter{
+					dir,
+					queryParam("file", "string", "Only this video"),
+				},
+				Responses: okResponse("Media descriptor", schemas.jsonContent(MediaDescriptor{})),
+			},
+		},
+		"/{dir}gemdrive/subtitles/{filename}": {
+			Get: &openApiOperation{
+				Summary: "Subtitle file as WebVTT, converted from SRT",
+				Parameters: []*openApiParameter{
+					dir,
+					pathParam("filename", "Name of the SRT or WebVTT file"),
+				},
+				Responses: okResponse("Subtitles", binaryContent("text/vtt")),
+			},
+		},
+		"/{dir}gemdrive/chunks/{filename}": {
+			Get: &openApiOperation{
+				Summary: "SHA-256 of each chunk of a file, and the root of their hash tree",
+				Parameters: []*openApiParameter{
+					dir,
+					pathParam("filename", "Name of the file"),
+					queryParam("chunkSize", "integer", "Power of two from 64KiB to 64MiB, 1MiB by default"),
+				},
+				Responses: okResponse("Chunk manifest", schemas.jsonContent(ChunkManifest{})),
+			},
+		},
+		"/{dir}gemdrive/torrent/{filename}": {
+			Get: &openApiOperation{
+				Summary: "Torrent of a large public file, with the server as web seed",
+				Parameters: []*openApiParameter{
+					dir,
+					pathParam("filename", "Name of the file"),
+					queryParam("format", "string", "magnet for a magnet link instead"),
+				},
+				Responses: okResponse("Torrent", binaryContent("application/x-bittorrent")),
+			},
+		},
+		"/{dir}gemdrive/metalink/{filename}": {
+			Get: &openApiOperation{
+				Summary: "Metalink of a file, with its checksums and mirror URLs",
+				Parameters: []*openApiParameter{
+					dir,
+					pathParam("filename", "Name of the file"),
+				},
+				Responses: okResponse("Metalink", binaryContent("application/metalink4+xml")),
+			},
+		},
+		"/{dir}gemdrive/archive": {
+			Get: &openApiOperation{
+				Summary: "Download several files and directories as one zip",
+				Parameters: []*openApiParameter{
+					dir,
+					queryParam("path", "string", "Path relative to dir, repeated for each item"),
+					queryParam("name", "string", "Name of the zip"),
+					headerParam("Range", "Single byte range, ie bytes=0-1023"),
+					headerParam("If-Range", "ETag the range is only wanted for"),
+				},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Zip", Content: binaryContent("application/zip")},
+					"206": {Description: "Requested range", Content: binaryContent("application/zip")},
+					"416": {Description: "Range outside the zip"},
+				},
+			},
+			Post: &openApiOperation{
+				Summary: "Download several files and directories as one zip",
+				Parameters: []*openApiParameter{
+					dir,
+					headerParam("Range", "Single byte range, ie bytes=0-1023"),
+				},
+				RequestBody: &openApiRequestBody{
+					Content: schemas.jsonContent(archiveRequest{}),
+				},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Zip", Content: binaryContent("application/zip")},
+					"206": {Description: "Requested range", Content: binaryContent("application/zip")},
+				},
+			},
+		},
+		"/{dir}gemdrive/gallery/timeline.json": {
+			Get: &openApiOperation{
+				Summary:    "Images grouped by capture date, newest first",
+				Parameters: []*openApiParameter{dir},
+				Responses:  okResponse("Timeline", schemas.jsonContent([]*GalleryDay{})),
+			},
+		},
+		"/{dir}gemdrive/gallery/albums.json": {
+			Get: &openApiOperation{
+				Summary:    "Subdirectories containing images",
+				Parameters: []*openApiParameter{dir},
+				Responses:  okResponse("Albums", schemas.jsonContent([]*GalleryAlbum{})),
+			},
+		},
+		"/{dir}gemdrive/music/artists.json": {
+			Get: &openApiOperation{
+				Summary:    "Artists of the audio files in a directory, by their tags",
+				Parameters: musicParams,
+				Responses:  okResponse("Artists", schemas.jsonContent([]*MusicArtist{})),
+			},
+		},
+		"/{dir}gemdrive/music/albums.json": {
+			Get: &openApiOperation{
+				Summary:    "Albums of the audio files in a directory, by artist and year",
+				Parameters: musicParams,
+				Responses:  okResponse("Albums", schemas.jsonContent([]*MusicAlbum{})),
+			},
+		},
+		"/{dir}gemdrive/music/tracks.json": {
+			Get: &openApiOperation{
+				Summary:    "Audio files in a directory with their tags, in album order",
+				Parameters: musicParams,
+				Responses:  okResponse("Tracks", schemas.jsonContent([]*MusicTrack{})),
+			},
+		},
+		"/gemdrive/version.json": {
+			Get: &openApiOperation{
+				Summary:   "Supported API versions and features",
+				Responses: okResponse("Version manifest", schemas.jsonContent(VersionManifest{})),
+			},
+		},
+		"/gemdrive/openapi.json": {
+			Get: &openApiOperation{
+				Summary:   "This document",
+				Responses: okResponse("OpenAPI document", binaryContent("application/json")),
+			},
+		},
+		"/gemdrive/shares": {
+			Get: &openApiOperation{
+				Summary:   "List shares you created",
+				Responses: okResponse("Shares", schemas.jsonContent([]*Share{})),
+			},
+			Post: &openApiOperation{
+				Summary: "Create a share link",
+				RequestBody: &openApiRequestBody{
+					Required: true,
+					Content:  schemas.jsonContent(shareRequest{}),
+				},
+				Responses: okResponse("Share, including its token", schemas.jsonContent(Share{})),
+			},
+		},
+		"/gemdrive/shares/{id}": {
+			Delete: &openApiOperation{
+				Summary:    "Revoke a share",
+				Parameters: []*openApiParameter{pathParam("id", "Share ID")},
+				Responses:  okResponse("Revoked", nil),
+			},
+		},
+		"/gemdrive/shares/lookup/{slug}": {
+			Get: &openApiOperation{
+				Summary:    "Find the share with a slug or short code, if you can see what it shares",
+				Parameters: []*openApiParameter{pathParam("slug", "Slug or short code")},
+				Responses:  okResponse("The share", schemas.jsonContent(ShareLookup{})),
+			},
+		},
+		"/gemdrive/shares/{id}/stats": {
+			Get: &openApiOperation{
+				Summary:    "How much a share you created has been used, and by whom",
+				Parameters: []*openApiParameter{pathParam("id", "Share ID")},
+				Responses:  okResponse("Share stats", schemas.jsonContent(ShareStats{})),
+			},
+		},
+		"/gemdrive/session/refresh": {
+			Post: &openApiOperation{
+				Summary: "Trade a refresh token for new access and refresh tokens",
+				RequestBody: &openApiRequestBody{
+					Content: schemas.jsonContent(refreshRequest{}),
+				},
+				Responses: okResponse("New tokens. The refresh token sent can't be used again.", schemas.jsonContent(SessionTokens{})),
+			},
+		},
+		"/gemdrive/session/logout": {
+			Post: &openApiOperation{
+				Summary: "End the session a refresh token belongs to",
+				RequestBody: &openApiRequestBody{
+					Content: schemas.jsonContent(refreshRequest{}),
+				},
+				Responses: okResponse("Logged out", nil),
+			},
+		},
+		"/gemdrive/transfers": {
+			Get: &openApiOperation{
+				Summary:   "List your active uploads and downloads",
+				Responses: okResponse("Transfers", schemas.jsonContent([]*Transfer{})),
+			},
+		},
+		"/gemdrive/transfers/{id}": {
+			Delete: &openApiOperation{
+				Summary:    "Cancel a transfer",
+				Parameters: []*openApiParameter{pathParam("id", "Transfer ID")},
+				Responses:  okResponse("Cancelled", nil),
+			},
+		},
+		"/gemdrive/deletes": {
+			Get: &openApiOperation{
+				Summary:   "List your recursive delete jobs",
+				Responses: okResponse("Delete jobs", schemas.jsonContent([]*DeleteJob{})),
+			},
+		},
+		"/gemdrive/deletes/{id}": {
+			Get: &openApiOperation{
+				Summary:    "Get a delete job's progress",
+				Parameters: []*openApiParameter{pathParam("id", "Delete job ID")},
+				Responses:  okResponse("Delete job", schemas.jsonContent(DeleteJob{})),
+			},
+			Delete: &openApiOperation{
+				Summary:    "Cancel a delete job",
+				Parameters: []*openApiParameter{pathParam("id", "Delete job ID")},
+				Responses:  okResponse("Cancelled", nil),
+			},
+		},
+		"/gemdrive/chunked-uploads": {
+			Post: &openApiOperation{
+				Summary:     "Start a chunked upload session",
+				RequestBody: &openApiRequestBody{Content: schemas.jsonContent(chunkedUploadRequest{})},
+				Responses: map[string]*openApiResponse{
+					"201": {Description: "Session created", Content: schemas.jsonContent(ChunkedUpload{})},
+					"409": {Description: "File exists"},
+				},
+			},
+		},
+		"/gemdrive/chunked-uploads/{id}": {
+			Get: &openApiOperation{
+				Summary:    "Get the chunks received so far",
+				Parameters: []*openApiParameter{pathParam("id", "Session ID")},
+				Responses:  okResponse("Session", schemas.jsonContent(ChunkedUpload{})),
+			},
+			Delete: &openApiOperation{
+				Summary:    "Abandon a chunked upload",
+				Parameters: []*openApiParameter{pathParam("id", "Session ID")},
+				Responses:  okResponse("Abandoned", nil),
+			},
+		},
+		"/gemdrive/chunked-uploads/{id}/{index}": {
+			Put: &openApiOperation{
+				Summary: "Upload one chunk, replacing it if it was sent before",
+				Parameters: append([]*openApiParameter{
+					pathParam("id", "Session ID"),
+					pathParam("index", "Chunk index, from 0"),
+				}, checksumHeaders...),
+				RequestBody: &openApiRequestBody{Content: binaryContent("application/octet-stream")},
+				Responses:   okResponse("Session", schemas.jsonContent(ChunkedUpload{})),
+			},
+		},
+		"/gemdrive/chunked-uploads/{id}/finalize": {
+			Post: &openApiOperation{
+				Summary:    "Assemble the chunks into the file, once they match the whole file's checksum",
+				Parameters: append([]*openApiParameter{pathParam("id", "Session ID")}, append(checksumHeaders, encryptionHeaders...)...),
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Upload complete"},
+					"400": {Description: "Checksum mismatch"},
+					"409": {Description: "Chunks missing"},
+				},
+			},
+		},
+		"/gemdrive/admin/deletes": {
+			Get: &openApiOperation{
+				Summary:   "List all delete jobs",
+				Responses: okResponse("Delete jobs", schemas.jsonContent([]*DeleteJob{})),
+			},
+		},
+		"/gemdrive/admin/deletes/{id}": {
+			Get: &openApiOperation{
+				Summary:    "Get any delete job's progress",
+				Parameters: []*openApiParameter{pathParam("id", "Delete job ID")},
+				Responses:  okResponse("Delete job", schemas.jsonContent(DeleteJob{})),
+			},
+			Delete: &openApiOperation{
+				Summary:    "Cancel any delete job",
+				Parameters: []*openApiParameter{pathParam("id", "Delete job ID")},
+				Responses:  okResponse("Cancelled", nil),
+			},
+		},
+		"/gemdrive/admin/transfers": {
+			Get: &openApiOperation{
+				Summary:   "List all active transfers",
+				Responses: okResponse("Transfers", schemas.jsonContent([]*Transfer{})),
+			},
+		},
+		"/gemdrive/admin/transfers/{id}": {
+			Delete: &openApiOperation{
+				Summary:    "Cancel any transfer",
+				Parameters: []*openApiParameter{pathParam("id", "Transfer ID")},
+				Responses:  okResponse("Cancelled", nil),
+			},
+		},
+		"/gemdrive/admin/service-tokens": {
+			Get: &openApiOperation{
+				Summary:   "List service account tokens",
+				Responses: okResponse("Service tokens", schemas.jsonContent([]*ServiceToken{})),
+			},
+			Post: &openApiOperation{
+				Summary: "Create a service account token",
+				RequestBody: &openApiRequestBody{
+					Required: true,
+					Content:  schemas.jsonContent(Key{}),
+				},
+				Responses: okResponse("Service token, including the token itself", schemas.jsonContent(ServiceToken{})),
+			},
+		},
+		"/gemdrive/admin/service-tokens/{id}": {
+			Delete: &openApiOperation{
+				Summary:    "Revoke a service account token",
+				Parameters: []*openApiParameter{pathParam("id", "Service token ID")},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Revoked"},
+					"202": {Description: "Waiting for another owner to approve", Content: schemas.jsonContent(PendingApproval{})},
+				},
+			},
+		},
+		"/{dir}gemdrive/publish": {
+			Post: &openApiOperation{
+				Summary:    "Freeze a directory into an immutable public snapshot",
+				Parameters: []*openApiParameter{dir},
+				RequestBody: &openApiRequestBody{
+					Content: schemas.jsonContent(publishRequest{}),
+				},
+				Responses: map[string]*openApiResponse{
+					"201": {Description: "Published, or the same contents were already", Content: schemas.jsonContent(Snapshot{})},
+				},
+			},
+		},
+		"/gemdrive/snapshots": {
+			Get: &openApiOperation{
+				Summary:   "Snapshots published by the requester, or all of them for admins, without their files",
+				Responses: okResponse("Snapshots", schemas.jsonContent([]*Snapshot{})),
+			},
+		},
+		"/gemdrive/snapshots/{id}": {
+			Get: &openApiOperation{
+				Summary:    "Snapshot manifest, listing each file with its SHA-256",
+				Parameters: []*openApiParameter{pathParam("id", "Snapshot ID, the hash of its contents")},
+				Responses:  okResponse("Manifest", schemas.jsonContent(Snapshot{})),
+			},
+			Delete: &openApiOperation{
+				Summary:    "Unpublish a snapshot",
+				Parameters: []*openApiParameter{pathParam("id", "Snapshot ID, the hash of its contents")},
+				Responses:  okResponse("Deleted", nil),
+			},
+		},
+		"/gemdrive/snapshots/{id}/{path}": {
+			Get: &openApiOperation{
+				Summary: "Read a file from a snapshot, its .sha256 or .meta4 sidecar, or its index page for an empty path",
+				Parameters: []*openApiParameter{
+					pathParam("id", "Snapshot ID, the hash of its contents"),
+					pathParam("path", "File path within the snapshot"),
+				},
+				Responses: okResponse("File contents", binaryContent("application/octet-stream")),
+			},
+		},
+		"/gemdrive/admin/approvals": {
+			Get: &openApiOperation{
+				Summary:   "Destructive actions waiting for a second owner",
+				Responses: okResponse("Pending approvals", schemas.jsonContent([]*PendingApproval{})),
+			},
+		},
+		"/gemdrive/admin/approvals/{id}": {
+			Post: &openApiOperation{
+				Summary:    "Approve and carry out a pending action",
+				Parameters: []*openApiParameter{pathParam("id", "Approval ID")},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Done. Export deletes return their job.", Content: schemas.jsonContent(DeleteJob{})},
+					"403": {Description: "Requested by the same owner"},
+				},
+			},
+			Delete: &openApiOperation{
+				Summary:    "Call off a pending action",
+				Parameters: []*openApiParameter{pathParam("id", "Approval ID")},
+				Responses:  okResponse("Cancelled", nil),
+			},
+		},
+		"/gemdrive/admin/holds": {
+			Get: &openApiOperation{
+				Summary:   "List legal holds",
+				Responses: okResponse("Legal holds", schemas.jsonContent([]*LegalHold{})),
+			},
+			Post: &openApiOperation{
+				Summary:     "Place a legal hold, stopping a path and everything under it from being changed or deleted",
+				RequestBody: &openApiRequestBody{Content: schemas.jsonContent(placeHoldRequest{})},
+				Responses:   okResponse("The hold", schemas.jsonContent(LegalHold{})),
+			},
+		},
+		"/gemdrive/admin/holds/{id}": {
+			Delete: &openApiOperation{
+				Summary:    "Lift a legal hold",
+				Parameters: []*openApiParameter{pathParam("id", "Hold ID")},
+				Responses: map[string]*openApiResponse{
+					"200": {Description: "Lifted"},
+					"202": {Description: "Waiting for another owner to approve", Content: schemas.jsonContent(PendingApproval{})},
+				},
+			},
+		},
+		"/gemdrive/admin/lockouts": {
+			Get: &openApiOperation{
+				Summary:   "List clients with recent failed auth attempts or lockouts",
+				Responses: okResponse("Lockouts", schemas.jsonContent([]*Lockout{})),
+			},
+		},
+		"/gemdrive/admin/lockouts/{key}": {
+			Delete: &openApiOperation{
+				Summary:    "Lift a lockout",
+				Parameters: []*openApiParameter{pathParam("key", "Locked out IP or identity, ie ip:203.0.113.7")},
+				Responses:  okResponse("Lifted", nil),
+			},
+		},
+		"/gemdrive/admin/backends": {
+			Get: &openApiOperation{
+				Summary:   "Backend operation timings and the slowest operations, per mount",
+				Responses: okResponse("Stats for each mount", schemas.jsonContent([]*MountStats{})),
+			},
+		},
+		"/gemdrive/admin/metrics": {
+			Get: &openApiOperation{
+				Summary:   "Backend operation timings and bytes served in Prometheus text format",
+				Responses: okResponse("Metrics", nil),
+			},
+		},
+		"/gemdrive/admin/bandwidth": {
+			Get: &openApiOperation{
+				Summary:   "Bytes served per identity, share and export, in total and by day",
+				Responses: okResponse("Counters", schemas.jsonContent(BandwidthReport{})),
+			},
+		},
+		"/gemdrive/admin/tasks": {
+			Get: &openApiOperation{
+				Summary:   "Scheduled tasks, when they next run and their recent runs",
+				Responses: okResponse("Tasks", schemas.jsonContent([]*TaskStatus{})),
+			},
+		},
+		"/gemdrive/admin/tasks/{name}": {
+			Post: &openApiOperation{
+				Summary:    "Run a scheduled task now",
+				Parameters: []*openApiParameter{pathParam("name", "Task name")},
+				Responses: map[string]*openApiResponse{
+					"202": {Description: "Started"},
+					"409": {Description: "Already running"},
+				},
+			},
+		},
+		"/gemdrive/index/status": {
+			Get: &openApiOperation{
+				Summary:   "Background indexing progress",
+				Responses: okResponse("Status of each export", schemas.jsonContent([]*IndexStatus{})),
+			},
+		},
+	}
+
+	// Any operation can fail with a JSON error when the client accepts one
+	errorResponse := &openApiResponse{
+		Description: "Error. JSON if the request accepts application/json, otherwise plain text.",
+		Content:     schemas.jsonContent(ErrorResponse{}),
+	}
+	errorSchema := schemas["ErrorResponse"].(map[string]interface{})
+	errorProperties := errorSchema["properties"].(map[string]interface{})
+	errorProperties["code"].(map[string]interface{})["enum"] = allErrorCodes()
+
+	for _, pathItem := range paths {
+		operations := []*openApiOperation{
+			pathItem.Get, pathItem.Head, pathItem.Put, pathItem.Post,
+			pathItem.Patch, pathItem.Delete, pathItem.Move,
+		}
+		for _, operation := range operations {
+			if operation != nil {
+				operation.Responses["default"] = errorResponse
+			}
+		}
+	}
+
+	return &openApiDocument{
+		OpenApi: "3.0.3",
+		Info: map[string]string{
+			"title":   "GemDrive",
+			"version": "1",
+		},
+		Paths: paths,
+		Components: map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+		// Tokens can also be passed in an access_token cookie or query
+		// param
+		Security: []map[string][]string{
+			{"bearer": {}},
+		},
+	}
+}
+
+// Handles gemdrive/openapi.json
+func (s *Server) serveOpenApi(w http.ResponseWriter, r *http.Request) {
+	jsonBody, err := json.Marshal(openApiSpec())
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
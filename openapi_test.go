@@ -0,0 +1,117 @@
+package gemdrive
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var openApiPlaceholder = regexp.MustCompile(`{([a-z]+)}`)
+
+type openApiMethod struct {
+	method    string
+	operation *openApiOperation
+}
+
+func openApiMethods(item *openApiPathItem) []openApiMethod {
+	methods := []openApiMethod{}
+	for _, m := range []openApiMethod{
+		{"GET", item.Get}, {"HEAD", item.Head}, {"PUT", item.Put}, {"POST", item.Post},
+		{"PATCH", item.Patch}, {"DELETE", item.Delete}, {"MOVE", item.Move},
+	} {
+		if m.operation != nil {
+			methods = append(methods, m)
+		}
+	}
+	return methods
+}
+
+func TestOpenApiPathParams(t *testing.T) {
+	for template, item := range openApiSpec().Paths {
+		inTemplate := []string{}
+		for _, match := range openApiPlaceholder.FindAllStringSubmatch(template, -1) {
+			inTemplate = append(inTemplate, match[1])
+		}
+		sort.Strings(inTemplate)
+
+		for _, m := range openApiMethods(item) {
+			declared := []string{}
+			for _, param := range m.operation.Parameters {
+				if param.In == "path" {
+					declared = append(declared, param.Name)
+				}
+			}
+			sort.Strings(declared)
+
+			if strings.Join(declared, ",") != strings.Join(inTemplate, ",") {
+				t.Errorf("%s %s declares path params %v, want %v", m.method, template, declared, inTemplate)
+			}
+		}
+	}
+}
+
+// Every documented operation should reach a handler rather than falling
+// through to "Unknown endpoint". Handlers may still reject the placeholder
+// values, ie with 404 for an id that doesn't exist.
+func TestOpenApiRoutesExist(t *testing.T) {
+	dir := t.TempDir()
+
+	config := &Config{
+		Dirs:       []string{filepath.Join(dir, "files")},
+		DataDir:    filepath.Join(dir, "data"),
+		CacheDir:   filepath.Join(dir, "cache"),
+		AdminEmail: "owner@example.com",
+	}
+
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := server.auth.AddEphemeralKeyring([]*Key{
+		{IdType: "email", Id: "owner@example.com", Perm: "own", Path: "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]string{
+		"path":     "files/a.txt",
+		"dir":      "files/",
+		"id":       "missing",
+		"slug":     "missing",
+		"key":      "ip:203.0.113.7",
+		"name":     "missing",
+		"index":    "0",
+		"size":     "64",
+		"filename": "missing.jpg",
+	}
+
+	for template, item := range openApiSpec().Paths {
+		reqPath := openApiPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+			return values[strings.Trim(placeholder, "{}")]
+		})
+		reqPath = strings.Replace(reqPath, "//", "/", -1)
+
+		for _, m := range openApiMethods(item) {
+			r := httptest.NewRequest(m.method, reqPath, nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+
+			server.ServeHTTP(w, r)
+
+			body, _ := ioutil.ReadAll(w.Body)
+			if w.Code == http.StatusNotFound && string(body) == "Unknown endpoint" {
+				t.Errorf("%s %s isn't routed", m.method, template)
+			}
+			if w.Code == http.StatusMethodNotAllowed {
+				t.Errorf("%s %s isn't allowed", m.method, template)
+			}
+		}
+	}
+}
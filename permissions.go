@@ -0,0 +1,89 @@
+package gemdrive
+
+import (
+	"strings"
+)
+
+// Perms in ACLs and keys grant sets of actions. The broad perms (read,
+// write, own) are what most people need; the narrow ones cover cases like a
+// folder people can upload into without seeing what's there. A perm can
+// also be a comma separated list, ie "list,create".
+
+const (
+	actList   = "list"
+	actRead   = "read"
+	actCreate = "create"
+	actModify = "modify"
+	actDelete = "delete"
+	// Change or delete files the token's identity created
+	actModifyOwn = "modify-own"
+	actShare     = "share"
+	actAdmin     = "admin"
+)
+
+var permActions = map[string][]string{
+	"list":         {actList},
+	"read-content": {actRead},
+	"read":         {actList, actRead},
+	"create":       {actCreate},
+	"upload":       {actCreate, actModifyOwn},
+	"modify":       {actModify, actModifyOwn},
+	"delete":       {actDelete},
+	"share":        {actShare},
+	"write":        {actList, actRead, actCreate, actModify, actModifyOwn, actDelete, actShare},
+	"admin":        {actList, actRead, actCreate, actModify, actModifyOwn, actDelete, actShare, actAdmin},
+	"own":          {actList, actRead, actCreate, actModify, actModifyOwn, actDelete, actShare, actAdmin},
+}
+
+func permAllows(perm, action string) bool {
+	for _, part := range strings.Split(perm, ",") {
+		for _, allowed := range permActions[strings.TrimSpace(part)] {
+			if allowed == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func validPerm(perm string) bool {
+	for _, part := range strings.Split(perm, ",") {
+		if _, exists := permActions[strings.TrimSpace(part)]; !exists {
+			return false
+		}
+	}
+	return true
+}
+
+// Every action perm grants.
+func permActionList(perm string) []string {
+	actions := []string{}
+	for _, part := range strings.Split(perm, ",") {
+		actions = append(actions, permActions[strings.TrimSpace(part)]...)
+	}
+	return actions
+}
+
+// ACLs further down can deny what dirPath's allows, so recursive listings
+// drop the subdirectories token can't do action in. Listings may be cached,
+// so a pruned copy is returned rather than changing item.
+func (s *Server) pruneListing(token, dirPath string, item *Item, action string) *Item {
+	if item == nil || item.Children == nil {
+		return item
+	}
+
+	pruned := *item
+	pruned.Children = make(map[string]*Item, len(item.Children))
+
+	for name, child := range item.Children {
+		if strings.HasSuffix(name, "/") {
+			if !s.auth.Can(token, dirPath+name, action) {
+				continue
+			}
+			child = s.pruneListing(token, dirPath+name, child, action)
+		}
+		pruned.Children[name] = child
+	}
+
+	return &pruned
+}
@@ -0,0 +1,85 @@
+package gemdrive
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Public can read /files/, but not /files/private/. Recursive listings of
+// /files/ mustn't reach into private/.
+func TestRecursiveListingsHonorDeeperAcls(t *testing.T) {
+	dir := t.TempDir()
+
+	filesDir := filepath.Join(dir, "files")
+	err := os.MkdirAll(filepath.Join(filesDir, "private"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"public.mp3", "public.jpg", "private/secret.txt", "private/secret.mp3", "private/secret.jpg"} {
+		err = ioutil.WriteFile(filepath.Join(filesDir, name), []byte("data"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dataDir := filepath.Join(dir, "data")
+	acls := map[string]*aclFile{
+		"files":         {Entries: []*AclEntry{{IdType: "public", Id: "public", Perm: "read"}}},
+		"files/private": {Entries: []*AclEntry{{IdType: "public", Id: "public", Perm: "read", Deny: true}}},
+	}
+	for aclDir, acl := range acls {
+		err = os.MkdirAll(filepath.Join(dataDir, aclDir, "gemdrive"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = saveJson(acl, filepath.Join(dataDir, aclDir, "gemdrive", "acl.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server, err := NewServer(&Config{
+		Dirs:       []string{filesDir},
+		DataDir:    dataDir,
+		CacheDir:   filepath.Join(dir, "cache"),
+		AdminEmail: "owner@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(reqPath string) (int, string) {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", reqPath, nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		return w.Code, string(body)
+	}
+
+	if code, _ := get("/files/private/gemdrive/meta.json"); code == 200 {
+		t.Error("private/ can be listed directly")
+	}
+
+	for _, reqPath := range []string{
+		"/files/gemdrive/meta.json?depth=2",
+		"/files/gemdrive/meta.json?depth=0",
+		"/files/gemdrive/feed.xml?depth=2",
+		"/files/gemdrive/gallery/timeline.json",
+		"/files/gemdrive/music/tracks.json",
+	} {
+		code, body := get(reqPath)
+		if code != 200 {
+			t.Errorf("%s: got %d %s", reqPath, code, body)
+			continue
+		}
+		if strings.Contains(body, "secret") {
+			t.Errorf("%s lists private/: %s", reqPath, body)
+		}
+		if !strings.Contains(body, "public") {
+			t.Errorf("%s doesn't list public files: %s", reqPath, body)
+		}
+	}
+}
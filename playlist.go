@@ -0,0 +1,75 @@
+package gemdrive
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Serves gemdrive/playlist.m3u8, listing the audio files in a directory, or
+// with ?recursive=true everything beneath it, in path order so albums play
+// in track order. Audio players can't log in, so the URLs carry the token
+// from the playlist's URL, as feed enclosures do.
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request, gemPath string) {
+	token, _ := extractToken(r)
+	urlToken := linkToken(r)
+
+	depth := 1
+	if r.URL.Query().Get("recursive") == "true" {
+		depth = 0
+	}
+
+	listing, err := s.backend.List(gemPath, depth)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	entries := []feedEntry{}
+	collectFeedEntries(listing, "", &entries)
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].relPath < entries[j].relPath
+	})
+
+	publicDir := strings.Split(r.URL.Path, "gemdrive/")[0]
+
+	dirName := path.Base(gemPath)
+	if gemPath == "/" {
+		dirName = r.Host
+	}
+
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	fmt.Fprintf(&playlist, "#PLAYLIST:%s\n", dirName)
+
+	for _, entry := range entries {
+		mimeType := mime.TypeByExtension(path.Ext(entry.relPath))
+		if !strings.HasPrefix(mimeType, "audio/") {
+			continue
+		}
+
+		if !s.auth.CanRead(token, gemPath+entry.relPath) {
+			continue
+		}
+
+		title := strings.TrimSuffix(path.Base(entry.relPath), path.Ext(entry.relPath))
+
+		fmt.Fprintf(&playlist, "#EXTINF:-1,%s\n", title)
+		fmt.Fprintf(&playlist, "%s\n", s.absoluteUrl(r, publicDir+entry.relPath, urlToken))
+	}
+
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition("inline", dirName+".m3u8"))
+	io.WriteString(w, playlist.String())
+}
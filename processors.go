@@ -0,0 +1,287 @@
+package gemdrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Processor rules run on files once their upload is complete, in the
+// background, and store what they produce as attributes of the file:
+//
+//   {"path": "/files/videos/", "pattern": "*.mp4", "type": "ffprobe"}
+//
+// Types are "thumbnail", which renders one ahead of the first request for
+// it, "checksum" for the SHA-256, "ffprobe" for the media's streams and
+// format as JSON, and "command", which runs an external program with the
+// file on stdin and stores what it prints. Arguments of {file} are replaced
+// with the file's path on disk for local exports, or else pipe:0. The
+// file's path is also in GEMDRIVE_PATH, and its path on disk in
+// GEMDRIVE_LOCAL_PATH. Failures are logged and sent as processingFailed
+// notifications.
+
+const (
+	processorThumbnail = "thumbnail"
+	processorChecksum  = "checksum"
+	processorFfprobe   = "ffprobe"
+	processorCommand   = "command"
+)
+
+const defaultThumbnailSize = 256
+const defaultProcessorTimeout = 60 * time.Second
+
+// How many uploads are processed at once
+const processorSlots = 2
+
+type ProcessorRule struct {
+	// Path prefix files must be under
+	Path string `json:"path,omitempty"`
+	// Glob file names must match, ie *.jpg. Empty matches everything.
+	Pattern string `json:"pattern,omitempty"`
+	Type    string `json:"type,omitempty"`
+	// Attribute the result is stored as. Required for commands, otherwise
+	// defaults to the type, or sha256 for checksums.
+	Attr string `json:"attr,omitempty"`
+	// Thumbnail size in pixels. Defaults to 256.
+	Size int `json:"size,omitempty"`
+	// Program and arguments for command processors
+	Command []string `json:"command,omitempty"`
+	// For ffprobe and commands. Defaults to 60.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+// Backends with files on the local disk, which external programs can be
+// pointed at directly instead of streaming them in.
+type LocalFileBackend interface {
+	LocalPath(path string) (string, error)
+}
+
+func (fs *FileSystemBackend) LocalPath(reqPath string) (string, error) {
+	if _, _, ok := fs.splitArchivePath(reqPath); ok {
+		return "", errors.New("Not a local file")
+	}
+	return fs.checkedPath(reqPath)
+}
+
+func validateProcessorRules(rules []*ProcessorRule) error {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid processor pattern %s", rule.Pattern)
+		}
+
+		switch rule.Type {
+		case processorThumbnail, processorChecksum, processorFfprobe:
+		case processorCommand:
+			if len(rule.Command) == 0 || rule.Attr == "" {
+				return errors.New("Command processors need a command and an attr")
+			}
+		default:
+			return fmt.Errorf("Unknown processor type %s", rule.Type)
+		}
+	}
+
+	return nil
+}
+
+func (rule *ProcessorRule) matches(reqPath string) bool {
+	if !strings.HasPrefix(reqPath, rule.Path) {
+		return false
+	}
+
+	if rule.Pattern == "" {
+		return true
+	}
+
+	matched, _ := path.Match(rule.Pattern, path.Base(reqPath))
+	return matched
+}
+
+func (rule *ProcessorRule) attr() string {
+	if rule.Attr != "" {
+		return rule.Attr
+	}
+	if rule.Type == processorChecksum {
+		return "sha256"
+	}
+	return rule.Type
+}
+
+func (rule *ProcessorRule) timeout() time.Duration {
+	if rule.TimeoutSeconds > 0 {
+		return time.Duration(rule.TimeoutSeconds) * time.Second
+	}
+	return defaultProcessorTimeout
+}
+
+// Called after every completed upload. Returns straight away, processing
+// in the background.
+func (s *Server) processUpload(reqPath string) {
+	rules := []*ProcessorRule{}
+	for _, rule := range s.config.Processors {
+		if rule.matches(reqPath) {
+			rules = append(rules, rule)
+		}
+	}
+
+	if len(rules) == 0 {
+		return
+	}
+
+	go func() {
+		s.processSlots <- struct{}{}
+		defer func() { <-s.processSlots }()
+
+		encrypted := s.attrs.get(reqPath)["encryption.scheme"] != ""
+
+		for _, rule := range rules {
+			// There's nothing to see in ciphertext
+			if encrypted && (rule.Type == processorThumbnail || rule.Type == processorFfprobe) {
+				continue
+			}
+
+			result, err := s.runProcessor(rule, reqPath)
+			if err == nil {
+				err = s.attrs.update(reqPath, func(attrs map[string]string) map[string]string {
+					attrs[rule.attr()] = result
+					return attrs
+				})
+			}
+
+			if err != nil {
+				fmt.Println("Processing", reqPath, "with", rule.Type, "failed:", err)
+				s.notifier.notify(&notificationData{
+					Event: eventProcessingFailed,
+					Path:  reqPath,
+					Error: fmt.Sprintf("%s: %s", rule.Type, err),
+				}, "", nil)
+			}
+		}
+	}()
+}
+
+func (s *Server) runProcessor(rule *ProcessorRule, reqPath string) (string, error) {
+	switch rule.Type {
+	case processorThumbnail:
+		imageServer, ok := s.backend.(ImageServer)
+		if !ok {
+			return "", errors.New("Backend doesn't make thumbnails")
+		}
+
+		size := rule.Size
+		if size == 0 {
+			size = defaultThumbnailSize
+		}
+
+		_, _, err := imageServer.GetImage(reqPath, &ImageOptions{
+			Width:      size,
+			Height:     size,
+			Fit:        "contain",
+			AutoRotate: true,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return strconv.Itoa(size), nil
+	case processorChecksum:
+		store, ok := s.backend.(ChecksumStore)
+		if !ok {
+			return "", errors.New("Backend doesn't support checksums")
+		}
+
+		sums, err := store.GetChecksums(reqPath)
+		if err != nil {
+			return "", err
+		}
+
+		return sums.Sha256, nil
+	case processorFfprobe:
+		output, err := s.runExternal(rule, reqPath, []string{
+			"ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", "-i", "{file}",
+		})
+		if err != nil {
+			return "", err
+		}
+
+		var compact bytes.Buffer
+		err = json.Compact(&compact, output)
+		if err != nil {
+			return "", err
+		}
+
+		return compact.String(), nil
+	default:
+		output, err := s.runExternal(rule, reqPath, rule.Command)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(output)), nil
+	}
+}
+
+// Runs args, returning their output. An argument of {file} is replaced with
+// the file's local path, or pipe:0 when it doesn't have one. Commands always
+// get the file on stdin, other programs only when it's not local.
+func (s *Server) runExternal(rule *ProcessorRule, reqPath string, args []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rule.timeout())
+	defer cancel()
+
+	localPath := ""
+	if local, ok := s.backend.(LocalFileBackend); ok {
+		localPath, _ = local.LocalPath(reqPath)
+	}
+
+	fileArg := localPath
+	if fileArg == "" {
+		fileArg = "pipe:0"
+	}
+
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "{file}" {
+			arg = fileArg
+		}
+		expanded[i] = arg
+	}
+
+	cmd := exec.CommandContext(ctx, expanded[0], expanded[1:]...)
+	cmd.Env = append(os.Environ(), "GEMDRIVE_PATH="+reqPath)
+	if localPath != "" {
+		cmd.Env = append(cmd.Env, "GEMDRIVE_LOCAL_PATH="+localPath)
+	}
+
+	if localPath == "" || rule.Type == processorCommand {
+		_, data, err := s.backend.Read(reqPath, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer data.Close()
+		cmd.Stdin = data
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", rule.timeout())
+	} else if err != nil {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(err.Error()+" "+stderr.String()))
+	}
+
+	if stdout.Len() > maxAttrsSize {
+		return nil, errors.New("output too large to store")
+	}
+
+	return stdout.Bytes(), nil
+}
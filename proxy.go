@@ -0,0 +1,90 @@
+package gemdrive
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// X-Forwarded-* headers are only believed from the reverse proxies listed in
+// trustedProxies, as IPs or CIDRs. Anyone else could send them to pretend a
+// request came over https.
+
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	return s.isTrustedProxy(ip)
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, proxy := range s.config.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			_, network, err := net.ParseCIDR(proxy)
+			if err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if proxyIp := net.ParseIP(proxy); proxyIp != nil && proxyIp.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The host the client asked for, from X-Forwarded-Host when a trusted proxy
+// sent it.
+func (s *Server) requestHost(r *http.Request) string {
+	if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" && s.fromTrustedProxy(r) {
+		return forwardedHost
+	}
+	return r.Host
+}
+
+func (s *Server) isHttps(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	return s.fromTrustedProxy(r) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// The client's address, taken from X-Forwarded-For when the request came
+// through trusted proxies.
+func (s *Server) clientIp(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	if !s.fromTrustedProxy(r) {
+		return ip
+	}
+
+	// Each proxy appends the address it got the request from, so the client
+	// is the last one that isn't a trusted proxy.
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hopIp := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hopIp == nil {
+			break
+		}
+
+		ip = hopIp
+
+		if !s.isTrustedProxy(hopIp) {
+			break
+		}
+	}
+
+	return ip
+}
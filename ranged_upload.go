@@ -0,0 +1,406 @@
+package gemdrive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chunked uploads may be sent as a series of PUTs each carrying a
+// Content-Range header, ie "bytes 0-1048575/5000000". The ranges received so
+// far are tracked per path so overlapping or out-of-bounds chunks can be
+// rejected. Tracking ends once every byte of the declared total has arrived.
+// The file is made its full size when the first chunk is reserved, before
+// any are written, so chunks can be written in any order.
+
+const rangedUploadTimeout = 24 * time.Hour
+
+type rangedUpload struct {
+	total      int64
+	received   int64
+	ranges     []byteRange
+	lastActive time.Time
+}
+
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// How uploads are stored in Redis
+type sharedRangedUpload struct {
+	Total      int64      `json:"total"`
+	Received   int64      `json:"received"`
+	Ranges     [][2]int64 `json:"ranges"`
+	LastActive time.Time  `json:"lastActive"`
+}
+
+type rangedUploads struct {
+	uploads map[string]*rangedUpload
+	mut     *sync.Mutex
+	shared  *redisClient
+}
+
+func newRangedUploads(shared *redisClient) *rangedUploads {
+	return &rangedUploads{
+		uploads: make(map[string]*rangedUpload),
+		mut:     &sync.Mutex{},
+		shared:  shared,
+	}
+}
+
+// Takes the lock on reqPath's upload, returning the function releasing it.
+// When shared, the upload is loaded from Redis, held locked there, and
+// stored back afterwards, so it's only ever in memory while locked.
+func (u *rangedUploads) lock(reqPath string) func() {
+	u.mut.Lock()
+
+	if u.shared == nil {
+		return u.mut.Unlock
+	}
+
+	key := "ranged_upload:" + reqPath
+
+	unlockShared, err := u.shared.lock(key)
+	if err != nil {
+		fmt.Println("Failed to lock ranged upload in Redis:", err)
+		return u.mut.Unlock
+	}
+
+	delete(u.uploads, reqPath)
+
+	var stored *sharedRangedUpload
+	exists, err := u.shared.getJson(key, &stored)
+	if err != nil {
+		fmt.Println("Failed to load ranged upload from Redis:", err)
+	} else if exists && stored != nil {
+		upload := &rangedUpload{
+			total:      stored.Total,
+			received:   stored.Received,
+			lastActive: stored.LastActive,
+		}
+		for _, rang := range stored.Ranges {
+			upload.ranges = append(upload.ranges, byteRange{rang[0], rang[1]})
+		}
+		u.uploads[reqPath] = upload
+	}
+	loaded := err == nil
+
+	return func() {
+		defer u.mut.Unlock()
+		defer unlockShared()
+
+		upload, exists := u.uploads[reqPath]
+		delete(u.uploads, reqPath)
+
+		// Storing what failed to load could lose received ranges
+		if !loaded {
+			return
+		}
+
+		var err error
+		if !exists {
+			_, err = u.shared.del(key)
+		} else {
+			stored := &sharedRangedUpload{
+				Total:      upload.total,
+				Received:   upload.received,
+				Ranges:     [][2]int64{},
+				LastActive: upload.lastActive,
+			}
+			for _, rang := range upload.ranges {
+				stored.Ranges = append(stored.Ranges, [2]int64{rang.start, rang.end})
+			}
+			err = u.shared.setJson(key, stored, rangedUploadTimeout)
+		}
+		if err != nil {
+			fmt.Println("Failed to store ranged upload in Redis:", err)
+		}
+	}
+}
+
+// Parses "bytes start-end/total". Unknown totals ("*") aren't supported
+// since there would be no way to tell when the upload is complete.
+func parseContentRange(header string) (byteRange, int64, error) {
+	invalid := errors.New("Invalid Content-Range")
+
+	if !strings.HasPrefix(header, "bytes ") {
+		return byteRange{}, 0, invalid
+	}
+
+	parts := strings.Split(strings.TrimPrefix(header, "bytes "), "/")
+	if len(parts) != 2 {
+		return byteRange{}, 0, invalid
+	}
+
+	bounds := strings.Split(parts[0], "-")
+	if len(bounds) != 2 {
+		return byteRange{}, 0, invalid
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return byteRange{}, 0, invalid
+	}
+
+	end, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || end < start {
+		return byteRange{}, 0, invalid
+	}
+
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return byteRange{}, 0, errors.New("Content-Range must declare the total size")
+	}
+
+	if end >= total {
+		return byteRange{}, 0, errors.New("Content-Range exceeds total size")
+	}
+
+	return byteRange{start, end}, total, nil
+}
+
+// Reserves a range for writing. The returned bool reports whether this is
+// the first chunk of a new upload, which prepare is called for, still
+// holding the lock.
+func (u *rangedUploads) reserve(reqPath string, rang byteRange, total int64, prepare func() error) (bool, error) {
+	defer u.lock(reqPath)()
+
+	now := time.Now()
+	for p, upload := range u.uploads {
+		if now.Sub(upload.lastActive) > rangedUploadTimeout {
+			delete(u.uploads, p)
+		}
+	}
+
+	upload, exists := u.uploads[reqPath]
+	if !exists {
+		upload = &rangedUpload{
+			total: total,
+		}
+		u.uploads[reqPath] = upload
+	}
+
+	if upload.total != total {
+		return false, &Error{
+			HttpCode: 416,
+			Message:  "Total size doesn't match earlier chunks",
+		}
+	}
+
+	for _, other := range upload.ranges {
+		if rang.start <= other.end && other.start <= rang.end {
+			return false, &Error{
+				HttpCode: 416,
+				Message:  "Chunk overlaps data already received",
+			}
+		}
+	}
+
+	if !exists {
+		err := prepare()
+		if err != nil {
+			delete(u.uploads, reqPath)
+			return false, err
+		}
+	}
+
+	upload.ranges = append(upload.ranges, rang)
+	sort.Slice(upload.ranges, func(i, j int) bool {
+		return upload.ranges[i].start < upload.ranges[j].start
+	})
+	upload.received += rang.end - rang.start + 1
+	upload.lastActive = now
+
+	return !exists, nil
+}
+
+// Gives back a range whose write failed, so it can be retried. The upload
+// is kept even without any ranges, since its file has been prepared.
+func (u *rangedUploads) release(reqPath string, rang byteRange) {
+	defer u.lock(reqPath)()
+
+	upload, exists := u.uploads[reqPath]
+	if !exists {
+		return
+	}
+
+	for i, other := range upload.ranges {
+		if other == rang {
+			upload.ranges = append(upload.ranges[:i], upload.ranges[i+1:]...)
+			upload.received -= rang.end - rang.start + 1
+			break
+		}
+	}
+}
+
+// Returns true and stops tracking the upload once all of it has arrived.
+func (u *rangedUploads) complete(reqPath string) bool {
+	defer u.lock(reqPath)()
+
+	upload, exists := u.uploads[reqPath]
+	if !exists || upload.received != upload.total {
+		return false
+	}
+
+	delete(u.uploads, reqPath)
+	return true
+}
+
+func (s *Server) handleRangedPut(w http.ResponseWriter, r *http.Request, reqPath string, backend WritableBackend, overwrite, created bool) {
+
+	rang, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		w.WriteHeader(416)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if rang.end-rang.start+1 != r.ContentLength {
+		w.WriteHeader(400)
+		io.WriteString(w, "Content-Range doesn't match Content-Length")
+		return
+	}
+
+	if target, _ := s.targets.find(reqPath); target != nil && (rang.start != 0 || rang.end+1 != total) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Backup targets only take whole files")
+		return
+	}
+
+	if s.config.MaxUploadSize != 0 && total > s.config.MaxUploadSize {
+		w.WriteHeader(413)
+		io.WriteString(w, "Upload exceeds maximum size")
+		return
+	}
+
+	expected, err := parseExpectedChecksums(r.Header.Get("Content-MD5"), r.Header.Get("X-Checksum-SHA256"))
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	release, ok := s.acquireStream(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Uploads in one chunk are written like any other whole file
+	whole := rang.start == 0 && rang.end+1 == total
+
+	prepare := func() error {
+		if !s.hasSpaceFor(reqPath, total) {
+			return errInsufficientStorage
+		}
+
+		if whole {
+			return nil
+		}
+
+		// Truncated and sized by writing its last byte. This fails if it
+		// exists and overwrite isn't set.
+		return backend.Write(reqPath, bytes.NewReader([]byte{0}), total-1, 1, overwrite, true)
+	}
+
+	first, err := s.rangedUploads.reserve(reqPath, rang, total, prepare)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	// Checksum headers apply to the chunk rather than the whole file. A
+	// corrupted chunk is released so it can be sent again.
+	transfer := s.startTransfer(r, "upload", reqPath, r.ContentLength, r.Body)
+	defer s.transfers.finish(transfer)
+
+	body := newChecksumReader(transfer)
+
+	if whole && first {
+		err = backend.Write(reqPath, body, 0, r.ContentLength, overwrite, true)
+	} else {
+		err = backend.Write(reqPath, body, rang.start, r.ContentLength, true, false)
+	}
+	if e, ok := err.(*Error); ok {
+		s.rangedUploads.release(reqPath, rang)
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		s.rangedUploads.release(reqPath, rang)
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if !body.Checksums().Matches(expected) {
+		s.rangedUploads.release(reqPath, rang)
+		w.WriteHeader(400)
+		io.WriteString(w, "Checksum mismatch")
+		return
+	}
+
+	token, _ := extractToken(r)
+
+	if first && created {
+		s.recordUpload(token, reqPath)
+	}
+
+	if !s.rangedUploads.complete(reqPath) {
+		w.WriteHeader(202)
+		return
+	}
+
+	if store, ok := s.backend.(ChecksumStore); ok {
+		sums := body.Checksums()
+		if !whole {
+			sums, err = s.fileChecksums(reqPath)
+		}
+		if err == nil {
+			err = store.SetChecksums(reqPath, sums)
+		}
+		if err != nil {
+			fmt.Println("Failed to store checksums:", err.Error())
+		}
+	}
+
+	encryption, _ := parseEncryptionHeaders(r)
+	err = s.recordEncryption(reqPath, encryption)
+	if err != nil {
+		fmt.Println("Failed to record encryption metadata:", err)
+	}
+
+	s.notifyUpload(reqPath, strings.Join(s.auth.Principals(token), ","), total)
+	s.processUpload(reqPath)
+}
+
+// Reads the file back for its checksums, since its chunks came separately.
+func (s *Server) fileChecksums(reqPath string) (*Checksums, error) {
+	_, data, err := s.backend.Read(reqPath, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	sums := newChecksumReader(data)
+	_, err = io.Copy(ioutil.Discard, sums)
+	if err != nil {
+		return nil, err
+	}
+
+	return sums.Checksums(), nil
+}
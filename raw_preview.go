@@ -0,0 +1,210 @@
+package gemdrive
+
+import (
+	"encoding/binary"
+	"errors"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Camera RAW formats are TIFF containers which, alongside the sensor data,
+// embed one or more JPEG previews. Thumbnails are made from the largest
+// preview rather than by decoding the RAW data itself.
+
+const (
+	tiffTagCompression     = 0x0103
+	tiffTagStripOffsets    = 0x0111
+	tiffTagStripByteCounts = 0x0117
+	tiffTagSubIfds         = 0x014a
+	tiffTagJpegOffset      = 0x0201
+	tiffTagJpegLength      = 0x0202
+
+	tiffCompressionJpeg    = 6
+	tiffCompressionOldJpeg = 7
+
+	maxRawIfds = 32
+)
+
+func isRawName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".cr2" || ext == ".nef" || ext == ".dng"
+}
+
+type rawIfdEntry struct {
+	valueType uint16
+	count     uint32
+	value     [4]byte
+}
+
+// Returns a reader over the largest embedded JPEG preview.
+func rawPreview(file io.ReaderAt, size int64) (*io.SectionReader, error) {
+	var header [8]byte
+	_, err := file.ReadAt(header[:], 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("Not a TIFF-based RAW file")
+	}
+
+	var best *io.SectionReader
+
+	consider := func(offset, length uint32) {
+		if length == 0 || int64(offset)+int64(length) > size {
+			return
+		}
+		if best != nil && int64(length) <= best.Size() {
+			return
+		}
+
+		section := io.NewSectionReader(file, int64(offset), int64(length))
+		// Lossless JPEG sensor data also starts with SOI, but the
+		// standard library can't decode it
+		_, err := jpeg.DecodeConfig(section)
+		if err == nil {
+			best = io.NewSectionReader(file, int64(offset), int64(length))
+		}
+	}
+
+	queue := []uint32{order.Uint32(header[4:8])}
+	visited := make(map[uint32]bool)
+
+	for len(queue) > 0 && len(visited) < maxRawIfds {
+		offset := queue[0]
+		queue = queue[1:]
+
+		if offset == 0 || visited[offset] {
+			continue
+		}
+		visited[offset] = true
+
+		entries, next, err := readRawIfd(file, order, offset)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, next)
+
+		if jpegOffset, ok := entries[tiffTagJpegOffset]; ok {
+			if jpegLength, ok := entries[tiffTagJpegLength]; ok {
+				consider(jpegOffset.uint32(order), jpegLength.uint32(order))
+			}
+		}
+
+		if compression, ok := entries[tiffTagCompression]; ok {
+			c := compression.uint32(order)
+			stripOffsets, hasOffsets := entries[tiffTagStripOffsets]
+			stripCounts, hasCounts := entries[tiffTagStripByteCounts]
+			// Only single strip previews are contiguous
+			if (c == tiffCompressionJpeg || c == tiffCompressionOldJpeg) && hasOffsets && hasCounts && stripOffsets.count == 1 {
+				consider(stripOffsets.uint32(order), stripCounts.uint32(order))
+			}
+		}
+
+		if subIfds, ok := entries[tiffTagSubIfds]; ok {
+			queue = append(queue, readRawLongs(file, order, subIfds)...)
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("No embedded preview found")
+	}
+
+	return best, nil
+}
+
+// Reads the orientation from IFD0, since embedded previews often lack their
+// own EXIF data.
+func rawOrientation(file io.ReaderAt) int {
+	var header [8]byte
+	_, err := file.ReadAt(header[:], 0)
+	if err != nil {
+		return 0
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if string(header[:2]) == "MM" {
+		order = binary.BigEndian
+	}
+
+	entries, _, err := readRawIfd(file, order, order.Uint32(header[4:8]))
+	if err != nil {
+		return 0
+	}
+
+	if orientation, ok := entries[exifTagOrientation]; ok {
+		return int(orientation.uint32(order))
+	}
+
+	return 0
+}
+
+func readRawIfd(file io.ReaderAt, order binary.ByteOrder, offset uint32) (map[uint16]rawIfdEntry, uint32, error) {
+	var countBytes [2]byte
+	_, err := file.ReadAt(countBytes[:], int64(offset))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count := int(order.Uint16(countBytes[:]))
+
+	buf := make([]byte, count*12+4)
+	_, err = file.ReadAt(buf, int64(offset)+2)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make(map[uint16]rawIfdEntry)
+	for i := 0; i < count; i++ {
+		entry := buf[i*12 : i*12+12]
+		e := rawIfdEntry{
+			valueType: order.Uint16(entry[2:4]),
+			count:     order.Uint32(entry[4:8]),
+		}
+		copy(e.value[:], entry[8:12])
+		entries[order.Uint16(entry[0:2])] = e
+	}
+
+	next := order.Uint32(buf[count*12:])
+
+	return entries, next, nil
+}
+
+func (e rawIfdEntry) uint32(order binary.ByteOrder) uint32 {
+	if e.valueType == 3 {
+		return uint32(order.Uint16(e.value[:2]))
+	}
+	return order.Uint32(e.value[:])
+}
+
+// Reads an array of LONG offsets, which is stored out of line when there's
+// more than one.
+func readRawLongs(file io.ReaderAt, order binary.ByteOrder, e rawIfdEntry) []uint32 {
+	if e.count == 1 {
+		return []uint32{e.uint32(order)}
+	}
+
+	if e.count > maxRawIfds {
+		return nil
+	}
+
+	buf := make([]byte, e.count*4)
+	_, err := file.ReadAt(buf, int64(order.Uint32(e.value[:])))
+	if err != nil {
+		return nil
+	}
+
+	longs := []uint32{}
+	for i := uint32(0); i < e.count; i++ {
+		longs = append(longs, order.Uint32(buf[i*4:]))
+	}
+	return longs
+}
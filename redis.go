@@ -0,0 +1,390 @@
+package gemdrive
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Several instances behind a load balancer can serve the same backends if
+// the state they'd otherwise keep to themselves lives in Redis instead:
+// tokens, sessions and shares, pending logins, lockouts and the failed
+// attempts counted towards them, and ranged and chunked upload sessions.
+// Changes are made while holding a lock in Redis, so instances don't
+// overwrite each other's. Everything else, like ACLs, is still read from the
+// data dir, and chunked uploads stage their chunks in the cache dir, so both
+// need to be shared too, ie over NFS.
+//
+// The client only speaks as much of RESP as GemDrive needs.
+
+type RedisConfig struct {
+	// host:port
+	Addr     string `json:"addr,omitempty"`
+	Password string `json:"password,omitempty"`
+	Db       int    `json:"db,omitempty"`
+	// Prepended to every key. Defaults to "gemdrive:".
+	KeyPrefix string `json:"keyPrefix,omitempty"`
+}
+
+const redisTimeout = 10 * time.Second
+
+// Locks are given up after this long, in case whoever held them died
+const redisLockTtl = 30 * time.Second
+
+const maxIdleRedisConns = 8
+
+const redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`
+
+var errRedisLockTimeout = errors.New("Timed out waiting for a Redis lock")
+
+// Errors returned by Redis itself, after which the connection can still be
+// used.
+type redisError string
+
+func (e redisError) Error() string {
+	return "Redis: " + string(e)
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type redisClient struct {
+	config *RedisConfig
+	prefix string
+	idle   chan *redisConn
+}
+
+func newRedisClient(config *RedisConfig) (*redisClient, error) {
+	if config.Addr == "" {
+		return nil, errors.New("Redis needs an addr")
+	}
+
+	prefix := config.KeyPrefix
+	if prefix == "" {
+		prefix = "gemdrive:"
+	}
+
+	c := &redisClient{
+		config: config,
+		prefix: prefix,
+		idle:   make(chan *redisConn, maxIdleRedisConns),
+	}
+
+	_, err := c.do("PING")
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.config.Addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	if c.config.Password != "" {
+		_, err = rc.do("AUTH", c.config.Password)
+	}
+	if err == nil && c.config.Db != 0 {
+		_, err = rc.do("SELECT", strconv.Itoa(c.config.Db))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return rc, nil
+}
+
+// Runs a command. Replies are strings, int64s, nil or slices of those.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-c.idle:
+	default:
+		var err error
+		conn, err = c.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := conn.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		// The connection is in an unknown state
+		conn.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case c.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+
+	return reply, err
+}
+
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	_, err := rc.conn.Write(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	return rc.readReply()
+}
+
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 {
+		return nil, errors.New("Invalid Redis reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(rc.reader, data)
+		if err != nil {
+			return nil, err
+		}
+
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+
+		items := make([]interface{}, n)
+		for i := range items {
+			item, err := rc.readReply()
+			if e, ok := err.(redisError); ok {
+				item = e
+			} else if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+
+		return items, nil
+	}
+
+	return nil, errors.New("Invalid Redis reply")
+}
+
+func (c *redisClient) get(key string) (string, bool, error) {
+	reply, err := c.do("GET", c.prefix+key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, errors.New("Unexpected Redis reply")
+	}
+
+	return value, true, nil
+}
+
+// A ttl of 0 keeps the key forever.
+func (c *redisClient) set(key, value string, ttl time.Duration) error {
+	args := []string{"SET", c.prefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+
+	_, err := c.do(args...)
+	return err
+}
+
+// Sets key unless it exists, reporting whether it did.
+func (c *redisClient) setNX(key, value string, ttl time.Duration) (bool, error) {
+	reply, err := c.do("SET", c.prefix+key, value, "NX", "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return reply != nil, err
+}
+
+// Reports whether key existed.
+func (c *redisClient) del(key string) (bool, error) {
+	reply, err := c.do("DEL", c.prefix+key)
+	if err != nil {
+		return false, err
+	}
+
+	return reply == int64(1), nil
+}
+
+func (c *redisClient) incr(key string) (int64, error) {
+	reply, err := c.do("INCR", c.prefix+key)
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := reply.(int64)
+	if !ok {
+		return 0, errors.New("Unexpected Redis reply")
+	}
+
+	return value, nil
+}
+
+func (c *redisClient) expire(key string, ttl time.Duration) error {
+	_, err := c.do("PEXPIRE", c.prefix+key, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+// Reports whether key existed.
+func (c *redisClient) getJson(key string, v interface{}) (bool, error) {
+	value, exists, err := c.get(key)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	return true, json.Unmarshal([]byte(value), v)
+}
+
+func (c *redisClient) setJson(key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.set(key, string(value), ttl)
+}
+
+// Takes the named lock, waiting for whoever holds it, and returns the
+// function releasing it.
+func (c *redisClient) lock(name string) (func(), error) {
+	token, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	key := "lock:" + name
+	deadline := time.Now().Add(redisLockTtl)
+
+	for {
+		locked, err := c.setNX(key, token, redisLockTtl)
+		if err != nil {
+			return nil, err
+		}
+
+		if locked {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, errRedisLockTimeout
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return func() {
+		_, err := c.do("EVAL", redisUnlockScript, "1", c.prefix+key, token)
+		if err != nil {
+			fmt.Println("Failed to release Redis lock", name+":", err)
+		}
+	}, nil
+}
+
+func (c *redisClient) publish(channel, message string) error {
+	_, err := c.do("PUBLISH", c.prefix+channel, message)
+	return err
+}
+
+// Calls handle with every message published to channel, after calling
+// subscribed once listening, until the connection fails.
+func (c *redisClient) subscribe(channel string, subscribed func(), handle func(message string)) error {
+	rc, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer rc.conn.Close()
+
+	_, err = rc.do("SUBSCRIBE", c.prefix+channel)
+	if err != nil {
+		return err
+	}
+
+	subscribed()
+
+	// Pings keep replies coming, so a dead connection is noticed by the
+	// read deadline
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(redisTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rc.conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		rc.conn.SetReadDeadline(time.Now().Add(redisTimeout))
+
+		reply, err := rc.readReply()
+		if err != nil {
+			return err
+		}
+
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 3 || items[0] != "message" {
+			continue
+		}
+
+		if message, ok := items[2].(string); ok {
+			handle(message)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package gemdrive
+
+import (
+	"errors"
+)
+
+// Reed-Solomon coding over GF(2^8), for erasure backends. The code is
+// systematic, so data blocks are stored as they are, and parity blocks come
+// from a Cauchy matrix, any square submatrix of which is invertible. Any
+// dataCount of the blocks in a stripe are enough to rebuild the rest.
+
+var gfExp [510]byte
+var gfLog [256]byte
+var gfMulTable [256][256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMulTable[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+type reedSolomon struct {
+	dataCount   int
+	parityCount int
+	// Rows for every block, data then parity
+	matrix [][]byte
+}
+
+func newReedSolomon(dataCount, parityCount int) (*reedSolomon, error) {
+	if dataCount < 1 || parityCount < 1 || dataCount+parityCount > 256 {
+		return nil, errors.New("Invalid Reed-Solomon block counts")
+	}
+
+	rs := &reedSolomon{
+		dataCount:   dataCount,
+		parityCount: parityCount,
+	}
+
+	for i := 0; i < dataCount+parityCount; i++ {
+		row := make([]byte, dataCount)
+		if i < dataCount {
+			row[i] = 1
+		} else {
+			for j := range row {
+				row[j] = gfInv(byte(i) ^ byte(j))
+			}
+		}
+		rs.matrix = append(rs.matrix, row)
+	}
+
+	return rs, nil
+}
+
+// out += coefficient * in
+func gfMulAdd(out, in []byte, coefficient byte) {
+	if coefficient == 0 {
+		return
+	}
+	table := &gfMulTable[coefficient]
+	for i, b := range in {
+		out[i] ^= table[b]
+	}
+}
+
+// Fills in the parity blocks from the data blocks, all of the same size.
+func (rs *reedSolomon) encode(blocks [][]byte) {
+	for i := rs.dataCount; i < len(blocks); i++ {
+		parity := blocks[i]
+		for j := range parity {
+			parity[j] = 0
+		}
+		for j := 0; j < rs.dataCount; j++ {
+			gfMulAdd(parity, blocks[j], rs.matrix[i][j])
+		}
+	}
+}
+
+// Rebuilds the nil blocks from at least dataCount others. Rebuilt blocks are
+// allocated with the size of the rest.
+func (rs *reedSolomon) reconstruct(blocks [][]byte) error {
+	present := []int{}
+	size := 0
+	for i, block := range blocks {
+		if block != nil && len(present) < rs.dataCount {
+			present = append(present, i)
+			size = len(block)
+		}
+	}
+
+	if len(present) < rs.dataCount {
+		return errors.New("Too few blocks to reconstruct from")
+	}
+
+	// Solve for the data blocks from the rows of those present
+	sub := make([][]byte, rs.dataCount)
+	for r, i := range present {
+		sub[r] = rs.matrix[i]
+	}
+
+	inverse, err := gfInvertMatrix(sub)
+	if err != nil {
+		return err
+	}
+
+	for d := 0; d < rs.dataCount; d++ {
+		if blocks[d] != nil {
+			continue
+		}
+
+		block := make([]byte, size)
+		for r, i := range present {
+			gfMulAdd(block, blocks[i], inverse[d][r])
+		}
+		blocks[d] = block
+	}
+
+	for i := rs.dataCount; i < len(blocks); i++ {
+		if blocks[i] != nil {
+			continue
+		}
+
+		block := make([]byte, size)
+		for j := 0; j < rs.dataCount; j++ {
+			gfMulAdd(block, blocks[j], rs.matrix[i][j])
+		}
+		blocks[i] = block
+	}
+
+	return nil
+}
+
+// Gauss-Jordan elimination over GF(2^8).
+func gfInvertMatrix(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+
+	work := make([][]byte, n)
+	for i := range matrix {
+		work[i] = make([]byte, 2*n)
+		copy(work[i], matrix[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("Singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMulTable[scale][work[col][j]]
+		}
+
+		for row := 0; row < n; row++ {
+			if row != col && work[row][col] != 0 {
+				gfMulAdd(work[row], work[col], work[row][col])
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+
+	return inverse, nil
+}
@@ -0,0 +1,875 @@
+package gemdrive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A container registry, following the OCI distribution spec, served at /v2/
+// and storing images in a directory of the tree:
+//
+//	<name>/blobs/sha256/<hex>       layers and configs
+//	<name>/manifests/sha256/<hex>   manifests and indexes
+//	<name>/tags/<tag>               the digest each tag points to
+//
+// so access to repositories is controlled like anything else in it. Blob
+// uploads are staged in the cache dir and only added once they match their
+// digest. Clients like docker log in with tokens as basic auth passwords.
+
+const registryUploadTimeout = 24 * time.Hour
+
+const maxManifestSize = 4 * 1024 * 1024
+
+const defaultManifestType = "application/vnd.oci.image.manifest.v1+json"
+
+var registryNameRegex = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+var registryTagRegex = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
+type RegistryConfig struct {
+	// Directory the repositories are stored in
+	Path string `json:"path"`
+}
+
+type registry struct {
+	root     string
+	dir      string
+	sessions map[string]*registryUpload
+	mut      *sync.Mutex
+}
+
+type registryUpload struct {
+	repo       string
+	owner      string
+	size       int64
+	lastActive time.Time
+	mut        *sync.Mutex
+}
+
+type registryManifest struct {
+	MediaType string                `json:"mediaType"`
+	Config    *registryDescriptor   `json:"config"`
+	Layers    []*registryDescriptor `json:"layers"`
+	Manifests []*registryDescriptor `json:"manifests"`
+}
+
+type registryDescriptor struct {
+	Digest string `json:"digest"`
+}
+
+// Staged uploads only live in memory, so they're thrown away on restart.
+func newRegistry(config *RegistryConfig, cacheDir string) (*registry, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	root := path.Clean("/"+config.Path) + "/"
+	if root == "/" {
+		return nil, errors.New("Registry path has to be within a mount")
+	}
+
+	dir := filepath.Join(cacheDir, "registry-uploads")
+	os.RemoveAll(dir)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registry{
+		root:     root,
+		dir:      dir,
+		sessions: make(map[string]*registryUpload),
+		mut:      &sync.Mutex{},
+	}, nil
+}
+
+func (g *registry) repoPath(name string) string {
+	return g.root + name + "/"
+}
+
+func (g *registry) blobPath(name, digest string) string {
+	return g.repoPath(name) + "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+func (g *registry) manifestPath(name, digest string) string {
+	return g.repoPath(name) + "manifests/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
+
+func (g *registry) tagPath(name, tag string) string {
+	return g.repoPath(name) + "tags/" + tag
+}
+
+func (g *registry) startUpload(repo, owner string) (string, error) {
+	id, err := genRandomKey()
+	if err != nil {
+		return "", err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(g.dir, id), nil, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	now := time.Now()
+	for otherId, session := range g.sessions {
+		if now.Sub(session.lastActive) > registryUploadTimeout {
+			delete(g.sessions, otherId)
+			os.Remove(filepath.Join(g.dir, otherId))
+		}
+	}
+
+	g.sessions[id] = &registryUpload{
+		repo:       repo,
+		owner:      owner,
+		lastActive: now,
+		mut:        &sync.Mutex{},
+	}
+
+	return id, nil
+}
+
+// Takes the lock on an upload, returning the function releasing it.
+func (g *registry) lockUpload(id, repo, owner string) (*registryUpload, func(), error) {
+	g.mut.Lock()
+	session, exists := g.sessions[id]
+	g.mut.Unlock()
+
+	if !exists || session.repo != repo || session.owner != owner {
+		return nil, nil, errors.New("No such upload")
+	}
+
+	session.mut.Lock()
+	session.lastActive = time.Now()
+
+	return session, session.mut.Unlock, nil
+}
+
+func (g *registry) removeUpload(id string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	delete(g.sessions, id)
+	os.Remove(filepath.Join(g.dir, id))
+}
+
+// Must be called with the upload locked.
+func (g *registry) appendUpload(id string, session *registryUpload, data io.Reader) error {
+	file, err := os.OpenFile(filepath.Join(g.dir, id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	n, err := io.Copy(file, data)
+	session.size += n
+	return err
+}
+
+func validDigest(digest string) bool {
+	return strings.HasPrefix(digest, "sha256:") && validLfsOid(strings.TrimPrefix(digest, "sha256:"))
+}
+
+func sendRegistryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	jsonBody, _ := json.Marshal(map[string]interface{}{
+		"errors": []map[string]string{
+			{"code": code, "message": message},
+		},
+	})
+	w.Write(jsonBody)
+}
+
+func sendRegistryDenied(w http.ResponseWriter, token string) {
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"GemDrive\"")
+		sendRegistryError(w, 401, "UNAUTHORIZED", "Authentication required")
+	} else {
+		sendRegistryError(w, 403, "DENIED", "Not allowed")
+	}
+}
+
+func sendRegistryBackendError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*Error); ok {
+		sendRegistryError(w, e.HttpCode, "UNKNOWN", e.Message)
+	} else {
+		sendRegistryError(w, 500, "UNKNOWN", err.Error())
+	}
+}
+
+func (s *Server) handleRegistry(w http.ResponseWriter, r *http.Request, registryReq string) {
+	token, _ := extractToken(r)
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+	// Clients only send credentials once challenged here
+	if registryReq == "" {
+		if len(s.auth.Principals(token)) == 0 {
+			w.Header().Set("WWW-Authenticate", "Basic realm=\"GemDrive\"")
+			sendRegistryError(w, 401, "UNAUTHORIZED", "Authentication required")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+		return
+	}
+
+	var name, kind, ref string
+	if i := strings.LastIndex(registryReq, "/blobs/uploads/"); i > 0 {
+		name, kind, ref = registryReq[:i], "uploads", registryReq[i+len("/blobs/uploads/"):]
+	} else if i := strings.LastIndex(registryReq, "/blobs/"); i > 0 {
+		name, kind, ref = registryReq[:i], "blobs", registryReq[i+len("/blobs/"):]
+	} else if i := strings.LastIndex(registryReq, "/manifests/"); i > 0 {
+		name, kind, ref = registryReq[:i], "manifests", registryReq[i+len("/manifests/"):]
+	} else if strings.HasSuffix(registryReq, "/tags/list") {
+		name, kind = strings.TrimSuffix(registryReq, "/tags/list"), "tags"
+	}
+
+	if !registryNameRegex.MatchString(name) {
+		sendRegistryError(w, 404, "NAME_UNKNOWN", "Unknown repository")
+		return
+	}
+
+	switch kind {
+	case "uploads":
+		s.handleRegistryUpload(w, r, name, ref)
+	case "blobs":
+		s.handleRegistryBlob(w, r, name, ref)
+	case "manifests":
+		s.handleRegistryManifest(w, r, name, ref)
+	case "tags":
+		s.listRegistryTags(w, r, name)
+	}
+}
+
+func (s *Server) handleRegistryBlob(w http.ResponseWriter, r *http.Request, name, digest string) {
+	token, _ := extractToken(r)
+
+	if !validDigest(digest) {
+		sendRegistryError(w, 400, "DIGEST_INVALID", "Invalid digest")
+		return
+	}
+
+	blobPath := s.registry.blobPath(name, digest)
+
+	switch r.Method {
+	case "HEAD", "GET":
+		if !s.auth.CanRead(token, s.registry.repoPath(name)) {
+			sendRegistryDenied(w, token)
+			return
+		}
+
+		size, exists, err := s.itemSize(blobPath)
+		if err != nil {
+			sendRegistryBackendError(w, err)
+			return
+		}
+		if !exists {
+			sendRegistryError(w, 404, "BLOB_UNKNOWN", "Unknown blob")
+			return
+		}
+
+		header := w.Header()
+		header.Set("Docker-Content-Digest", digest)
+		header.Set("Content-Type", "application/octet-stream")
+
+		if r.Method == "HEAD" {
+			header.Set("Content-Length", strconv.FormatInt(size, 10))
+			return
+		}
+
+		s.serveFile(w, r, blobPath)
+	case "DELETE":
+		if !s.auth.CanDelete(token, blobPath) {
+			sendRegistryDenied(w, token)
+			return
+		}
+		s.deleteRegistryItem(w, blobPath, "BLOB_UNKNOWN")
+	default:
+		sendRegistryError(w, 405, "UNSUPPORTED", "Method not allowed")
+	}
+}
+
+func (s *Server) deleteRegistryItem(w http.ResponseWriter, itemPath, unknownCode string) {
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		sendRegistryError(w, 405, "UNSUPPORTED", "Backend does not support writing")
+		return
+	}
+
+	err := backend.Delete(itemPath, false)
+	if isNotFound(err) {
+		sendRegistryError(w, 404, unknownCode, "Not found")
+		return
+	} else if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+
+	w.WriteHeader(202)
+}
+
+func (s *Server) handleRegistryUpload(w http.ResponseWriter, r *http.Request, name, id string) {
+	token, _ := extractToken(r)
+	owner := strings.Join(s.auth.Principals(token), ",")
+
+	if !s.auth.CanCreate(token, s.registry.repoPath(name)) {
+		sendRegistryDenied(w, token)
+		return
+	}
+
+	uploadUrl := "/v2/" + name + "/blobs/uploads/"
+
+	if id == "" {
+		if r.Method != "POST" {
+			sendRegistryError(w, 405, "UNSUPPORTED", "Method not allowed")
+			return
+		}
+
+		if s.mountRegistryBlob(w, r, name) {
+			return
+		}
+
+		id, err := s.registry.startUpload(name, owner)
+		if err != nil {
+			sendRegistryBackendError(w, err)
+			return
+		}
+
+		// Monolithic uploads come with their digest
+		if digest := r.URL.Query().Get("digest"); digest != "" {
+			s.finishRegistryUpload(w, r, name, id, owner, digest)
+			return
+		}
+
+		header := w.Header()
+		header.Set("Location", uploadUrl+id)
+		header.Set("Docker-Upload-UUID", id)
+		header.Set("Range", "0-0")
+		header.Set("Content-Length", "0")
+		w.WriteHeader(202)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "PATCH":
+		session, unlock, err := s.registry.lockUpload(id, name, owner)
+		if err != nil {
+			sendRegistryError(w, 404, "BLOB_UPLOAD_UNKNOWN", err.Error())
+			return
+		}
+		defer unlock()
+
+		if r.Method == "PATCH" {
+			if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+				var start, end int64
+				_, err := fmt.Sscanf(contentRange, "%d-%d", &start, &end)
+				if err != nil || start != session.size {
+					w.Header().Set("Range", fmt.Sprintf("0-%d", session.size-1))
+					sendRegistryError(w, 416, "BLOB_UPLOAD_INVALID", "Chunk out of order")
+					return
+				}
+			}
+
+			err := s.registry.appendUpload(id, session, r.Body)
+			if err != nil {
+				sendRegistryError(w, 500, "BLOB_UPLOAD_INVALID", err.Error())
+				return
+			}
+		}
+
+		header := w.Header()
+		header.Set("Location", uploadUrl+id)
+		header.Set("Docker-Upload-UUID", id)
+		header.Set("Range", fmt.Sprintf("0-%d", session.size-1))
+		header.Set("Content-Length", "0")
+		if r.Method == "PATCH" {
+			w.WriteHeader(202)
+		} else {
+			w.WriteHeader(204)
+		}
+	case "PUT":
+		s.finishRegistryUpload(w, r, name, id, owner, r.URL.Query().Get("digest"))
+	case "DELETE":
+		_, unlock, err := s.registry.lockUpload(id, name, owner)
+		if err != nil {
+			sendRegistryError(w, 404, "BLOB_UPLOAD_UNKNOWN", err.Error())
+			return
+		}
+		unlock()
+		s.registry.removeUpload(id)
+		w.WriteHeader(204)
+	default:
+		sendRegistryError(w, 405, "UNSUPPORTED", "Method not allowed")
+	}
+}
+
+// Blobs can be mounted from other repositories the client can read, rather
+// than uploaded again. Returns false to fall back to an upload.
+func (s *Server) mountRegistryBlob(w http.ResponseWriter, r *http.Request, name string) bool {
+	token, _ := extractToken(r)
+	query := r.URL.Query()
+
+	digest := query.Get("mount")
+	from := query.Get("from")
+	if !validDigest(digest) || !registryNameRegex.MatchString(from) {
+		return false
+	}
+
+	if !s.auth.CanRead(token, s.registry.repoPath(from)) {
+		return false
+	}
+
+	srcPath := s.registry.blobPath(from, digest)
+	size, exists, err := s.itemSize(srcPath)
+	if err != nil || !exists {
+		return false
+	}
+
+	_, data, err := s.backend.Read(srcPath, 0, 0)
+	if err != nil {
+		return false
+	}
+	defer data.Close()
+
+	err = s.addRegistryBlob(name, digest, data, size)
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return true
+	}
+
+	header := w.Header()
+	header.Set("Location", "/v2/"+name+"/blobs/"+digest)
+	header.Set("Docker-Content-Digest", digest)
+	w.WriteHeader(201)
+	return true
+}
+
+func (s *Server) finishRegistryUpload(w http.ResponseWriter, r *http.Request, name, id, owner, digest string) {
+	session, unlock, err := s.registry.lockUpload(id, name, owner)
+	if err != nil {
+		sendRegistryError(w, 404, "BLOB_UPLOAD_UNKNOWN", err.Error())
+		return
+	}
+	defer s.registry.removeUpload(id)
+	defer unlock()
+
+	if !validDigest(digest) {
+		sendRegistryError(w, 400, "DIGEST_INVALID", "Invalid digest")
+		return
+	}
+
+	err = s.registry.appendUpload(id, session, r.Body)
+	if err != nil {
+		sendRegistryError(w, 500, "BLOB_UPLOAD_INVALID", err.Error())
+		return
+	}
+
+	if s.config.MaxUploadSize != 0 && session.size > s.config.MaxUploadSize {
+		sendRegistryError(w, 413, "SIZE_INVALID", "Upload exceeds maximum size")
+		return
+	}
+
+	file, err := os.Open(filepath.Join(s.registry.dir, id))
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+
+	if "sha256:"+hex.EncodeToString(hash.Sum(nil)) != digest {
+		sendRegistryError(w, 400, "DIGEST_INVALID", "Content doesn't match digest")
+		return
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+
+	err = s.addRegistryBlob(name, digest, file, session.size)
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Location", "/v2/"+name+"/blobs/"+digest)
+	header.Set("Docker-Content-Digest", digest)
+	header.Set("Content-Length", "0")
+	w.WriteHeader(201)
+}
+
+// Blobs never change, so ones already stored are left alone.
+func (s *Server) addRegistryBlob(name, digest string, data io.Reader, size int64) error {
+	return s.addRegistryFile(s.registry.blobPath(name, digest), data, size)
+}
+
+func (s *Server) addRegistryFile(filePath string, data io.Reader, size int64) error {
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		return &Error{
+			HttpCode: 405,
+			Message:  "Backend does not support writing",
+		}
+	}
+
+	_, exists, err := s.itemSize(filePath)
+	if err != nil || exists {
+		return err
+	}
+
+	if !s.hasSpaceFor(filePath, size) {
+		return errInsufficientStorage
+	}
+
+	parentDir, _ := splitItemPath(filePath)
+
+	err = backend.MakeDir(parentDir, true)
+	if err != nil {
+		return err
+	}
+
+	return backend.Write(filePath, data, 0, size, false, true)
+}
+
+func (s *Server) readRegistryFile(filePath string) ([]byte, error) {
+	_, data, err := s.backend.Read(filePath, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	return ioutil.ReadAll(data)
+}
+
+// The digest a tag or digest reference points to, or "" if there's none.
+func (s *Server) resolveRegistryRef(name, ref string) (string, error) {
+	if validDigest(ref) {
+		return ref, nil
+	}
+
+	if !registryTagRegex.MatchString(ref) {
+		return "", nil
+	}
+
+	digest, err := s.readRegistryFile(s.registry.tagPath(name, ref))
+	if isNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(digest)), nil
+}
+
+func (s *Server) handleRegistryManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	token, _ := extractToken(r)
+
+	switch r.Method {
+	case "HEAD", "GET":
+		if !s.auth.CanRead(token, s.registry.repoPath(name)) {
+			sendRegistryDenied(w, token)
+			return
+		}
+
+		digest, err := s.resolveRegistryRef(name, ref)
+		if err != nil {
+			sendRegistryBackendError(w, err)
+			return
+		}
+
+		var manifest []byte
+		if digest != "" {
+			manifest, err = s.readRegistryFile(s.registry.manifestPath(name, digest))
+		}
+		if digest == "" || isNotFound(err) {
+			sendRegistryError(w, 404, "MANIFEST_UNKNOWN", "Unknown manifest")
+			return
+		} else if err != nil {
+			sendRegistryBackendError(w, err)
+			return
+		}
+
+		var parsed registryManifest
+		json.Unmarshal(manifest, &parsed)
+		if parsed.MediaType == "" {
+			parsed.MediaType = defaultManifestType
+		}
+
+		header := w.Header()
+		header.Set("Content-Type", parsed.MediaType)
+		header.Set("Docker-Content-Digest", digest)
+		header.Set("Content-Length", strconv.Itoa(len(manifest)))
+
+		if r.Method == "GET" {
+			w.Write(manifest)
+		}
+	case "PUT":
+		s.putRegistryManifest(w, r, name, ref)
+	case "DELETE":
+		s.deleteRegistryManifest(w, r, name, ref)
+	default:
+		sendRegistryError(w, 405, "UNSUPPORTED", "Method not allowed")
+	}
+}
+
+func (s *Server) putRegistryManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	token, _ := extractToken(r)
+
+	if !s.auth.CanCreate(token, s.registry.repoPath(name)) {
+		sendRegistryDenied(w, token)
+		return
+	}
+
+	isDigest := validDigest(ref)
+	if !isDigest && !registryTagRegex.MatchString(ref) {
+		sendRegistryError(w, 400, "TAG_INVALID", "Invalid tag")
+		return
+	}
+
+	manifest, err := ioutil.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+	if len(manifest) > maxManifestSize {
+		sendRegistryError(w, 413, "SIZE_INVALID", "Manifest too large")
+		return
+	}
+
+	sum := sha256.Sum256(manifest)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	if isDigest && ref != digest {
+		sendRegistryError(w, 400, "DIGEST_INVALID", "Content doesn't match digest")
+		return
+	}
+
+	var parsed registryManifest
+	err = json.Unmarshal(manifest, &parsed)
+	if err != nil {
+		sendRegistryError(w, 400, "MANIFEST_INVALID", "Invalid manifest")
+		return
+	}
+
+	// Everything a manifest refers to has to be pushed first
+	blobs := parsed.Layers
+	if parsed.Config != nil {
+		blobs = append(blobs, parsed.Config)
+	}
+	for _, blob := range blobs {
+		_, exists, err := s.itemSize(s.registry.blobPath(name, blob.Digest))
+		if err != nil || !validDigest(blob.Digest) || !exists {
+			sendRegistryError(w, 400, "MANIFEST_BLOB_UNKNOWN", "Unknown blob "+blob.Digest)
+			return
+		}
+	}
+	for _, child := range parsed.Manifests {
+		_, exists, err := s.itemSize(s.registry.manifestPath(name, child.Digest))
+		if err != nil || !validDigest(child.Digest) || !exists {
+			sendRegistryError(w, 400, "MANIFEST_BLOB_UNKNOWN", "Unknown manifest "+child.Digest)
+			return
+		}
+	}
+
+	err = s.addRegistryFile(s.registry.manifestPath(name, digest), bytes.NewReader(manifest), int64(len(manifest)))
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+
+	if !isDigest {
+		err := s.tagRegistryManifest(token, name, ref, digest)
+		if e, ok := err.(*Error); ok && e.HttpCode == 403 {
+			sendRegistryDenied(w, token)
+			return
+		} else if err != nil {
+			sendRegistryBackendError(w, err)
+			return
+		}
+	}
+
+	header := w.Header()
+	header.Set("Location", "/v2/"+name+"/manifests/"+digest)
+	header.Set("Docker-Content-Digest", digest)
+	header.Set("Content-Length", "0")
+	w.WriteHeader(201)
+}
+
+// Moving existing tags takes permission to modify them.
+func (s *Server) tagRegistryManifest(token, name, tag, digest string) error {
+	backend := s.backend.(WritableBackend)
+
+	tagPath := s.registry.tagPath(name, tag)
+
+	_, exists, err := s.itemSize(tagPath)
+	if err != nil {
+		return err
+	}
+
+	if exists && !s.canModify(token, tagPath) {
+		return &Error{
+			HttpCode: 403,
+			Message:  "Not allowed to move tag",
+		}
+	}
+
+	parentDir, _ := splitItemPath(tagPath)
+
+	err = backend.MakeDir(parentDir, true)
+	if err != nil {
+		return err
+	}
+
+	err = backend.Write(tagPath, strings.NewReader(digest), 0, int64(len(digest)), true, true)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		s.recordUpload(token, tagPath)
+	}
+
+	return nil
+}
+
+// Deleting a manifest deletes the tags pointing to it.
+func (s *Server) deleteRegistryManifest(w http.ResponseWriter, r *http.Request, name, ref string) {
+	token, _ := extractToken(r)
+
+	if !validDigest(ref) {
+		tagPath := s.registry.tagPath(name, ref)
+		if !registryTagRegex.MatchString(ref) || !s.canDelete(token, tagPath) {
+			sendRegistryDenied(w, token)
+			return
+		}
+		s.deleteRegistryItem(w, tagPath, "MANIFEST_UNKNOWN")
+		return
+	}
+
+	if !s.auth.CanDelete(token, s.registry.repoPath(name)) {
+		sendRegistryDenied(w, token)
+		return
+	}
+
+	tags, err := s.registryTags(name)
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		sendRegistryError(w, 405, "UNSUPPORTED", "Backend does not support writing")
+		return
+	}
+
+	for _, tag := range tags {
+		digest, err := s.resolveRegistryRef(name, tag)
+		if err == nil && digest == ref {
+			err := backend.Delete(s.registry.tagPath(name, tag), false)
+			if err != nil {
+				fmt.Println("Failed to delete tag:", err)
+			}
+		}
+	}
+
+	s.deleteRegistryItem(w, s.registry.manifestPath(name, ref), "MANIFEST_UNKNOWN")
+}
+
+func (s *Server) registryTags(name string) ([]string, error) {
+	item, err := s.backend.List(s.registry.repoPath(name)+"tags/", 1)
+	if isNotFound(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	tags := []string{}
+	for tag := range item.Children {
+		if !strings.HasSuffix(tag, "/") {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+
+	return tags, nil
+}
+
+func (s *Server) listRegistryTags(w http.ResponseWriter, r *http.Request, name string) {
+	token, _ := extractToken(r)
+
+	if r.Method != "GET" {
+		sendRegistryError(w, 405, "UNSUPPORTED", "Method not allowed")
+		return
+	}
+
+	if !s.auth.CanRead(token, s.registry.repoPath(name)) {
+		sendRegistryDenied(w, token)
+		return
+	}
+
+	tags, err := s.registryTags(name)
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+
+	if last := query.Get("last"); last != "" {
+		i := sort.SearchStrings(tags, last)
+		if i < len(tags) && tags[i] == last {
+			i++
+		}
+		tags = tags[i:]
+	}
+
+	if n, err := strconv.Atoi(query.Get("n")); err == nil && n >= 0 && n < len(tags) {
+		tags = tags[:n]
+		if n > 0 {
+			w.Header().Set("Link", fmt.Sprintf("</v2/%s/tags/list?n=%d&last=%s>; rel=\"next\"", name, n, tags[n-1]))
+		}
+	}
+
+	jsonBody, err := json.Marshal(map[string]interface{}{
+		"name": name,
+		"tags": tags,
+	})
+	if err != nil {
+		sendRegistryBackendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
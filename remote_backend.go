@@ -0,0 +1,247 @@
+package gemdrive
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RemoteBackend proxies another GemDrive server over HTTP.
+type RemoteBackend struct {
+	baseUrl    string
+	token      string
+	client     *http.Client
+	peerName   string
+	peerKey    string
+	identity   []string
+	httpConfig *RemoteHttpConfig
+	tlsConfig  *tls.Config
+}
+
+// Connection pooling, timeouts and retries for requests to the remote. Go's
+// defaults only keep 2 idle connections per host, so bursts of requests
+// kept opening new ones, and never time out waiting for a response.
+type RemoteHttpConfig struct {
+	// Defaults to 16
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty"`
+	// Defaults to 90
+	IdleConnTimeoutSeconds int `json:"idleConnTimeoutSeconds,omitempty"`
+	// Defaults to 10
+	DialTimeoutSeconds int `json:"dialTimeoutSeconds,omitempty"`
+	// How long to wait for response headers. Defaults to 30.
+	ResponseTimeoutSeconds int `json:"responseTimeoutSeconds,omitempty"`
+	// Times failed requests are retried, after a connection error or a 502,
+	// 503 or 504. Defaults to 2; -1 disables retries.
+	Retries int `json:"retries,omitempty"`
+	// Delay before the first retry, doubling for each one after, plus up to
+	// as much again of random jitter. Defaults to 200.
+	RetryDelayMillis int `json:"retryDelayMillis,omitempty"`
+}
+
+func NewRemoteBackend(baseUrl, token string) *RemoteBackend {
+	b := &RemoteBackend{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		token:      token,
+		httpConfig: &RemoteHttpConfig{},
+	}
+	b.buildClient()
+	return b
+}
+
+// Sign requests as the named peer, so the upstream can apply its ACLs to the
+// identity of the user making each request.
+func (b *RemoteBackend) EnablePeerSigning(peerName, peerKey string) {
+	b.peerName = peerName
+	b.peerKey = peerKey
+}
+
+func (b *RemoteBackend) SetTLSConfig(tlsConfig *tls.Config) {
+	b.tlsConfig = tlsConfig
+	b.buildClient()
+}
+
+func (b *RemoteBackend) SetHttpConfig(httpConfig *RemoteHttpConfig) {
+	b.httpConfig = httpConfig
+	b.buildClient()
+}
+
+func (b *RemoteBackend) buildClient() {
+	config := b.httpConfig
+
+	b.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   secondsOrDefault(config.DialTimeoutSeconds, 10),
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:       b.tlsConfig,
+			TLSHandshakeTimeout:   10 * time.Second,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   intOrDefault(config.MaxIdleConnsPerHost, 16),
+			IdleConnTimeout:       secondsOrDefault(config.IdleConnTimeoutSeconds, 90),
+			ResponseHeaderTimeout: secondsOrDefault(config.ResponseTimeoutSeconds, 30),
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
+func intOrDefault(value, def int) int {
+	if value <= 0 {
+		return def
+	}
+	return value
+}
+
+func secondsOrDefault(seconds, def int) time.Duration {
+	return time.Duration(intOrDefault(seconds, def)) * time.Second
+}
+
+func (b *RemoteBackend) WithIdentity(ids []string) Backend {
+	clone := *b
+	clone.identity = ids
+	return &clone
+}
+
+func (b *RemoteBackend) List(reqPath string, depth int) (*Item, error) {
+	metaUrl := fmt.Sprintf("%s%sgemdrive/meta.json?depth=%d", b.baseUrl, escapePath(reqPath), depth)
+
+	req, err := http.NewRequest("GET", metaUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeResponse(res)
+
+	var item *Item
+	err = json.NewDecoder(res.Body).Decode(&item)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (b *RemoteBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", b.baseUrl+escapePath(reqPath), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if offset != 0 || length != 0 {
+		rangeHeader := fmt.Sprintf("bytes=%d-", offset)
+		if length != 0 {
+			rangeHeader += fmt.Sprintf("%d", offset+length-1)
+		}
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	res, err := b.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := res.ContentLength
+
+	// For ranged responses the full size comes after the slash in
+	// Content-Range: bytes 0-99/1234
+	contentRange := res.Header.Get("Content-Range")
+	if res.StatusCode == 206 && contentRange != "" {
+		parts := strings.Split(contentRange, "/")
+		size, err = strconv.ParseInt(parts[len(parts)-1], 10, 64)
+		if err != nil {
+			res.Body.Close()
+			return nil, nil, err
+		}
+	}
+
+	item := &Item{
+		Size: size,
+	}
+
+	lastModified, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	if err == nil {
+		item.ModTime = lastModified.UTC().Format(time.RFC3339)
+	}
+
+	return item, res.Body, nil
+}
+
+func (b *RemoteBackend) do(req *http.Request) (*http.Response, error) {
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+
+	retries := b.httpConfig.Retries
+	if retries == 0 {
+		retries = 2
+	} else if retries < 0 {
+		retries = 0
+	}
+
+	delay := time.Duration(intOrDefault(b.httpConfig.RetryDelayMillis, 200)) * time.Millisecond
+
+	// Only GETs are sent, which are safe to retry
+	var res *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		if b.peerKey != "" {
+			err = signPeerRequest(req, b.peerName, b.peerKey, b.identity)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		res, err = b.client.Do(req)
+
+		retryable := err != nil || res.StatusCode == 502 || res.StatusCode == 503 || res.StatusCode == 504
+		if !retryable || attempt == retries || req.Context().Err() != nil {
+			break
+		}
+
+		if err == nil {
+			closeResponse(res)
+		}
+
+		time.Sleep(delay + time.Duration(rand.Int63n(int64(delay))))
+		delay *= 2
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		defer closeResponse(res)
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, &Error{
+			HttpCode: res.StatusCode,
+			Message:  string(body),
+		}
+	}
+
+	return res, nil
+}
+
+// Reads what's left of small bodies, so the connection can be reused.
+func closeResponse(res *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	res.Body.Close()
+}
+
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
@@ -0,0 +1,203 @@
+package gemdrive
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Flaky backends, like rclone remotes and mirrors, can be wrapped with
+// retries and a circuit breaker per mount. Operations which only read are
+// retried after server-side failures. After failureThreshold failures in a
+// row the mount's circuit opens, and requests to it fail straight away with
+// a 503 for openSeconds, instead of each waiting out the full timeout. Then
+// a single request is let through to see if the mount has recovered.
+
+type ResilienceConfig struct {
+	// Mounts to wrap. Defaults to all of them.
+	Mounts []string `json:"mounts,omitempty"`
+	// Defaults to 2; -1 disables retries.
+	Retries int `json:"retries,omitempty"`
+	// Delay before the first retry, doubling for each one after, plus up to
+	// as much again of random jitter. Defaults to 200.
+	RetryDelayMillis int `json:"retryDelayMillis,omitempty"`
+	// Defaults to 5
+	FailureThreshold int `json:"failureThreshold,omitempty"`
+	// Defaults to 30
+	OpenSeconds int `json:"openSeconds,omitempty"`
+}
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "halfOpen"
+)
+
+type circuitBreaker struct {
+	state     string
+	failures  int
+	openUntil time.Time
+	// Whether the half-open trial request is in flight
+	probing bool
+}
+
+type mountGuard struct {
+	config   *ResilienceConfig
+	mounts   map[string]bool
+	breakers map[string]*circuitBreaker
+	mut      *sync.Mutex
+}
+
+func newMountGuard(config *ResilienceConfig) *mountGuard {
+	if config == nil {
+		return nil
+	}
+
+	mounts := make(map[string]bool)
+	for _, mount := range config.Mounts {
+		mounts[mount] = true
+	}
+
+	return &mountGuard{
+		config:   config,
+		mounts:   mounts,
+		breakers: make(map[string]*circuitBreaker),
+		mut:      &sync.Mutex{},
+	}
+}
+
+func (g *mountGuard) guards(mount string) bool {
+	return g != nil && (len(g.mounts) == 0 || g.mounts[mount])
+}
+
+// Runs op against mount, retrying if it's idempotent and fails.
+func (g *mountGuard) call(mount string, idempotent bool, op func() error) error {
+	if !g.guards(mount) {
+		return op()
+	}
+
+	retries := g.config.Retries
+	if retries == 0 {
+		retries = 2
+	} else if retries < 0 || !idempotent {
+		retries = 0
+	}
+
+	delay := time.Duration(intOrDefault(g.config.RetryDelayMillis, 200)) * time.Millisecond
+
+	for attempt := 0; ; attempt++ {
+		err := g.allow(mount)
+		if err != nil {
+			return err
+		}
+
+		err = op()
+
+		failed := isBackendFailure(err)
+		g.report(mount, failed)
+
+		if !failed || attempt == retries {
+			return err
+		}
+
+		time.Sleep(delay + time.Duration(rand.Int63n(int64(delay))))
+		delay *= 2
+	}
+}
+
+func (g *mountGuard) allow(mount string) error {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	breaker := g.breaker(mount)
+
+	switch breaker.state {
+	case circuitOpen:
+		if time.Now().Before(breaker.openUntil) {
+			return errMountUnavailable(mount)
+		}
+		breaker.state = circuitHalfOpen
+		breaker.probing = true
+	case circuitHalfOpen:
+		// Everything else waits for the trial request
+		if breaker.probing {
+			return errMountUnavailable(mount)
+		}
+		breaker.probing = true
+	}
+
+	return nil
+}
+
+func (g *mountGuard) report(mount string, failed bool) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	breaker := g.breaker(mount)
+	breaker.probing = false
+
+	if !failed {
+		if breaker.state != circuitClosed {
+			fmt.Println("Mount", mount, "recovered, closing its circuit")
+		}
+		breaker.state = circuitClosed
+		breaker.failures = 0
+		return
+	}
+
+	breaker.failures++
+
+	threshold := intOrDefault(g.config.FailureThreshold, 5)
+	if breaker.state == circuitHalfOpen || breaker.failures >= threshold {
+		openFor := secondsOrDefault(g.config.OpenSeconds, 30)
+		if breaker.state == circuitClosed {
+			fmt.Println("Mount", mount, "failed", breaker.failures, "times in a row, opening its circuit for", openFor)
+		}
+		breaker.state = circuitOpen
+		breaker.openUntil = time.Now().Add(openFor)
+	}
+}
+
+// Must be called with the lock held.
+func (g *mountGuard) breaker(mount string) *circuitBreaker {
+	breaker, exists := g.breakers[mount]
+	if !exists {
+		breaker = &circuitBreaker{state: circuitClosed}
+		g.breakers[mount] = breaker
+	}
+	return breaker
+}
+
+func (g *mountGuard) state(mount string) string {
+	if !g.guards(mount) {
+		return ""
+	}
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	return g.breaker(mount).state
+}
+
+func errMountUnavailable(mount string) error {
+	return &Error{
+		HttpCode: 503,
+		Message:  mount + " is temporarily unavailable",
+	}
+}
+
+// Whether err means the backend is in trouble, as opposed to the request
+// being bad or for something that doesn't exist.
+func isBackendFailure(err error) bool {
+	if err == nil || os.IsNotExist(err) || os.IsPermission(err) {
+		return false
+	}
+
+	if e, ok := err.(*Error); ok {
+		return e.HttpCode >= 500
+	}
+
+	return true
+}
@@ -0,0 +1,375 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The REST backend protocol of restic, served for any directory at
+// <dir>/gemdrive/restic/, so restic can use it as a repository with
+//
+//   restic -r rest:https://user:<token>@example.com/backups/laptop/gemdrive/restic/
+//
+// Repositories are laid out as restic's REST server does, so they can also be
+// used as local repositories, and fit the defaults of backup targets.
+
+const resticV1 = "application/vnd.x.restic.rest.v1"
+const resticV2 = "application/vnd.x.restic.rest.v2"
+
+var resticTypes = []string{"data", "keys", "locks", "snapshots", "index"}
+
+type resticEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func isResticType(fileType string) bool {
+	for _, t := range resticTypes {
+		if t == fileType {
+			return true
+		}
+	}
+	return false
+}
+
+func validResticName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Path of a file in the repository. Data is split into subdirectories by the
+// first byte of its ID.
+func resticPath(repoPath, fileType, name string) string {
+	if fileType == "data" && len(name) >= 2 {
+		return repoPath + "data/" + name[:2] + "/" + name
+	}
+	return repoPath + fileType + "/" + name
+}
+
+func (s *Server) handleRestic(w http.ResponseWriter, r *http.Request, repoPath, resticReq string) {
+
+	if resticReq == "" {
+		if r.Method == "POST" && r.URL.Query().Get("create") == "true" {
+			s.createResticRepo(w, r, repoPath)
+			return
+		}
+		w.WriteHeader(405)
+		io.WriteString(w, "Method not allowed")
+		return
+	}
+
+	if resticReq == "config" {
+		s.handleResticFile(w, r, repoPath+"config", false)
+		return
+	}
+
+	parts := strings.Split(resticReq, "/")
+	if len(parts) != 2 || !isResticType(parts[0]) {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	fileType, name := parts[0], parts[1]
+
+	if name == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(405)
+			io.WriteString(w, "Method not allowed")
+			return
+		}
+		s.listRestic(w, r, repoPath, fileType)
+		return
+	}
+
+	if !validResticName(name) {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid name")
+		return
+	}
+
+	s.handleResticFile(w, r, resticPath(repoPath, fileType, name), true)
+}
+
+func (s *Server) createResticRepo(w http.ResponseWriter, r *http.Request, repoPath string) {
+	token, _ := extractToken(r)
+
+	if !s.auth.CanCreate(token, repoPath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "Backend does not support writing")
+		return
+	}
+
+	dirs := []string{repoPath}
+	for _, fileType := range resticTypes {
+		dirs = append(dirs, repoPath+fileType+"/")
+	}
+	for i := 0; i < 256; i++ {
+		dirs = append(dirs, fmt.Sprintf("%sdata/%02x/", repoPath, i))
+	}
+
+	for _, dir := range dirs {
+		err := backend.MakeDir(dir, true)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+}
+
+func (s *Server) listRestic(w http.ResponseWriter, r *http.Request, repoPath, fileType string) {
+	token, _ := extractToken(r)
+
+	dirPath := repoPath + fileType + "/"
+
+	if !s.auth.CanList(token, dirPath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	depth := 1
+	if fileType == "data" {
+		depth = 2
+	}
+
+	entries := []resticEntry{}
+
+	item, err := s.backend.List(dirPath, depth)
+	if e, ok := err.(*Error); ok && e.HttpCode != 404 {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil && !isNotFound(err) {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if err == nil {
+		entries = appendResticEntries(entries, item)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	var body interface{}
+	if strings.Contains(r.Header.Get("Accept"), resticV2) {
+		w.Header().Set("Content-Type", resticV2)
+		body = entries
+	} else {
+		w.Header().Set("Content-Type", resticV1)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name)
+		}
+		body = names
+	}
+
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Write(jsonBody)
+}
+
+func appendResticEntries(entries []resticEntry, item *Item) []resticEntry {
+	for name, child := range item.Children {
+		if strings.HasSuffix(name, "/") {
+			if child.Children != nil {
+				entries = appendResticEntries(entries, child)
+			}
+		} else if validResticName(name) {
+			entries = append(entries, resticEntry{Name: name, Size: child.Size})
+		}
+	}
+	return entries
+}
+
+func (s *Server) handleResticFile(w http.ResponseWriter, r *http.Request, filePath string, contentAddressed bool) {
+	switch r.Method {
+	case "HEAD":
+		s.statResticFile(w, r, filePath)
+	case "GET":
+		s.serveItem(w, r, filePath)
+	case "POST":
+		s.saveResticFile(w, r, filePath, contentAddressed)
+	case "DELETE":
+		s.deleteResticFile(w, r, filePath)
+	default:
+		w.WriteHeader(405)
+		io.WriteString(w, "Method not allowed")
+	}
+}
+
+// Missing repositories are reported as missing files rather than errors, as
+// restic checks for a config before creating one.
+func (s *Server) statResticFile(w http.ResponseWriter, r *http.Request, filePath string) {
+	token, _ := extractToken(r)
+
+	if !s.auth.CanRead(token, filePath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	parentDir, name := splitItemPath(filePath)
+
+	item, err := s.backend.List(parentDir, 1)
+	if e, ok := err.(*Error); ok && e.HttpCode != 404 {
+		w.WriteHeader(e.HttpCode)
+		return
+	} else if err != nil && !isNotFound(err) {
+		w.WriteHeader(500)
+		return
+	}
+
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	child, exists := item.Children[name]
+	if !exists {
+		w.WriteHeader(404)
+		return
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", child.Size))
+}
+
+// Files are never replaced, like with restic's REST server. Content-addressed
+// files are checked against their names.
+func (s *Server) saveResticFile(w http.ResponseWriter, r *http.Request, filePath string, contentAddressed bool) {
+	token, _ := extractToken(r)
+
+	if !s.auth.CanCreate(token, filePath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "Backend does not support writing")
+		return
+	}
+
+	if r.ContentLength < 0 {
+		w.WriteHeader(411)
+		io.WriteString(w, "Content-Length required")
+		return
+	}
+
+	if s.config.MaxUploadSize != 0 && r.ContentLength > s.config.MaxUploadSize {
+		w.WriteHeader(413)
+		io.WriteString(w, "Upload exceeds maximum size")
+		return
+	}
+
+	if !s.hasSpaceFor(filePath, r.ContentLength) {
+		w.WriteHeader(507)
+		io.WriteString(w, "Insufficient storage")
+		return
+	}
+
+	exists, err := s.itemExists(filePath)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if exists {
+		w.WriteHeader(403)
+		io.WriteString(w, "File exists")
+		return
+	}
+
+	release, ok := s.acquireStream(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	transfer := s.startTransfer(r, "upload", filePath, r.ContentLength, r.Body)
+	defer s.transfers.finish(transfer)
+
+	var body io.Reader = transfer
+	if contentAddressed {
+		body = newVerifyingReader(transfer, func(sums *Checksums) error {
+			return checkContentAddress(filePath, sums)
+		})
+	}
+
+	err = backend.Write(filePath, body, 0, r.ContentLength, false, true)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	s.recordUpload(token, filePath)
+	s.notifyUpload(filePath, strings.Join(s.auth.Principals(token), ","), r.ContentLength)
+}
+
+func (s *Server) deleteResticFile(w http.ResponseWriter, r *http.Request, filePath string) {
+	token, _ := extractToken(r)
+
+	if !s.canDelete(token, filePath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "Backend does not support writing")
+		return
+	}
+
+	err := backend.Delete(filePath, false)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if os.IsNotExist(err) {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	err = s.uploads.remove(filePath)
+	if err != nil {
+		fmt.Println("Failed to remove upload record:", err)
+	}
+}
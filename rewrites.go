@@ -0,0 +1,60 @@
+package gemdrive
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Rewrite rules handle moved content and vanity URLs. Each maps a path
+// prefix on a host to a new prefix, keeping the rest of the path:
+//
+//	{"host": "example.com", "from": "/old/", "to": "/new/", "status": 301}
+//
+// With a 3xx status the client is redirected, and "to" can be a full URL on
+// another site. Without one the request is served from the new path, as if
+// it had been requested. The first matching rule wins.
+type RewriteRule struct {
+	// Matches any host if empty
+	Host   string `json:"host,omitempty"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Status int    `json:"status,omitempty"`
+}
+
+func (s *Server) findRewrite(hostname, reqPath string) *RewriteRule {
+	for _, rule := range s.config.Rewrites {
+		if rule.Host != "" && rule.Host != hostname {
+			continue
+		}
+
+		if strings.HasPrefix(reqPath, rule.From) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// Redirects or rewrites r, if a rule matches. Returns true if the response
+// has been sent.
+func (s *Server) applyRewrites(w http.ResponseWriter, r *http.Request, hostname string) bool {
+	rule := s.findRewrite(hostname, r.URL.Path)
+	if rule == nil {
+		return false
+	}
+
+	target := rule.To + strings.TrimPrefix(r.URL.Path, rule.From)
+
+	if rule.Status >= 300 && rule.Status < 400 {
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, rule.Status)
+		return true
+	}
+
+	r.URL.Path = target
+	r.URL.RawPath = ""
+
+	return false
+}
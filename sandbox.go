@@ -0,0 +1,44 @@
+package gemdrive
+
+// A server started as root, ie to bind port 80, can switch to another user
+// once it's listening, and on Linux confine itself with Landlock to the
+// directories it serves, so a path handling bug can't reach the rest of
+// the system:
+//
+//	"sandbox": {"user": "gemdrive", "landlock": true}
+//
+// Under Landlock the exports, shards and other directories backends keep
+// files in, the data dir, cache dir and temp dir are writable, git repos and
+// /etc are readable, and system binary dirs are
+// executable for ffmpeg, git and rclone. Landlock needs Linux 5.13 or
+// later, and a build with CGO_ENABLED=0 so every thread of the process is
+// restricted.
+
+type SandboxConfig struct {
+	// User to switch to, by name or id
+	User string `json:"user,omitempty"`
+	// Defaults to the user's primary group
+	Group    string `json:"group,omitempty"`
+	Landlock bool   `json:"landlock,omitempty"`
+	// Extra paths to allow under Landlock
+	ReadPaths  []string `json:"readPaths,omitempty"`
+	WritePaths []string `json:"writePaths,omitempty"`
+}
+
+// Backends keeping files in local directories list them, so Landlock can
+// allow exactly those, including ones nested in other backends like shards.
+type LocalDirsBackend interface {
+	// Directories written to, then ones only read
+	LocalDirs() (writeDirs, readDirs []string)
+}
+
+func localDirs(backend Backend) ([]string, []string) {
+	if b, ok := backend.(LocalDirsBackend); ok {
+		return b.LocalDirs()
+	}
+	return nil, nil
+}
+
+// Paths outside the served dirs that the server and the tools it runs
+// need to read.
+var sandboxSystemPaths = []string{"/etc", "/usr", "/bin", "/lib", "/lib64"}
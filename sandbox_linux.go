@@ -0,0 +1,230 @@
+//go:build linux
+// +build linux
+
+package gemdrive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+)
+
+const (
+	landlockExecute = 1 << iota
+	landlockWriteFile
+	landlockReadFile
+	landlockReadDir
+	landlockRemoveDir
+	landlockRemoveFile
+	landlockMakeChar
+	landlockMakeDir
+	landlockMakeReg
+	landlockMakeSock
+	landlockMakeFifo
+	landlockMakeBlock
+	landlockMakeSym
+	// ABI 2
+	landlockRefer
+	// ABI 3
+	landlockTruncate
+)
+
+// Rights that make sense on a file rather than a directory
+const landlockFileAccess = landlockExecute | landlockWriteFile | landlockReadFile | landlockTruncate
+
+const landlockReadAccess = landlockExecute | landlockReadFile | landlockReadDir
+
+type landlockRulesetAttr struct {
+	handledAccessFs uint64
+}
+
+// Laid out like the kernel's packed struct, since the padding is at the end
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+func applySandbox(config *Config, backend Backend) error {
+	sandbox := config.Sandbox
+
+	// Looked up before Landlock hides /etc/passwd's neighbours
+	uid, gid := -1, -1
+	if sandbox.User != "" {
+		var err error
+		uid, gid, err = lookupUser(sandbox.User, sandbox.Group)
+		if err != nil {
+			return err
+		}
+	}
+
+	if sandbox.Landlock {
+		writeDirs, readDirs := localDirs(backend)
+
+		writePaths := append([]string{config.DataDir, config.CacheDir, os.TempDir(), "/dev/null"}, writeDirs...)
+		readPaths := append(append([]string{}, sandboxSystemPaths...), readDirs...)
+
+		writePaths = append(writePaths, sandbox.WritePaths...)
+		readPaths = append(readPaths, sandbox.ReadPaths...)
+
+		err := landlock(readPaths, writePaths)
+		if err != nil {
+			return fmt.Errorf("Landlock: %s", err)
+		}
+		fmt.Println("Confined to served directories with Landlock")
+	}
+
+	if uid != -1 {
+		err := syscall.Setgroups([]int{})
+		if err != nil {
+			return err
+		}
+		err = syscall.Setgid(gid)
+		if err != nil {
+			return err
+		}
+		err = syscall.Setuid(uid)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Running as", sandbox.User)
+	}
+
+	return nil
+}
+
+func lookupUser(username, groupname string) (int, int, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		u, err = user.LookupId(username)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	gidStr := u.Gid
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			g, err = user.LookupGroupId(groupname)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+		gidStr = g.Gid
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uid, gid, nil
+}
+
+func landlock(readPaths, writePaths []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("not supported by this kernel: %s", errno)
+	}
+
+	// Each ABI version handles the rights of the last, plus more
+	handled := uint64(landlockRefer - 1)
+	if abi >= 2 {
+		handled |= landlockRefer
+	} else {
+		fmt.Println("Landlock ABI 1 doesn't allow moves between directories")
+	}
+	if abi >= 3 {
+		handled |= landlockTruncate
+	}
+
+	attr := landlockRulesetAttr{handledAccessFs: handled}
+	rulesetFd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(int(rulesetFd))
+
+	for _, p := range readPaths {
+		err := landlockAllow(int(rulesetFd), p, landlockReadAccess&handled)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range writePaths {
+		err := landlockAllow(int(rulesetFd), p, handled)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, _, errno = syscall.AllThreadsSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0)
+	if errno == syscall.ENOTSUP {
+		return errors.New("needs a build with CGO_ENABLED=0")
+	} else if errno != 0 {
+		return errno
+	}
+
+	_, _, errno = syscall.AllThreadsSyscall(sysLandlockRestrictSelf, rulesetFd, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Allows access beneath p. Missing paths are skipped, since not every
+// system has every one of the defaults.
+func landlockAllow(rulesetFd int, p string, access uint64) error {
+	if p == "" {
+		return nil
+	}
+
+	fd, err := syscall.Open(p, oPath|syscall.O_CLOEXEC, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+	defer syscall.Close(fd)
+
+	var stat syscall.Stat_t
+	err = syscall.Fstat(fd, &stat)
+	if err != nil {
+		return fmt.Errorf("%s: %s", p, err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockFileAccess
+	}
+
+	rule := landlockPathBeneathAttr{
+		allowedAccess: access,
+		parentFd:      int32(fd),
+	}
+	_, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFd), landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("%s: %s", p, errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package gemdrive
+
+import (
+	"errors"
+)
+
+func applySandbox(config *Config, backend Backend) error {
+	return errors.New("Sandboxing is only supported on Linux")
+}
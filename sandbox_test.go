@@ -0,0 +1,47 @@
+package gemdrive
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Landlock allows what the backends list, so nested directories like
+// shards' have to be in it.
+func TestLocalDirsIncludeShards(t *testing.T) {
+	dir := t.TempDir()
+
+	shards := func(names ...string) []*ShardConfig {
+		configs := []*ShardConfig{}
+		for _, name := range names {
+			configs = append(configs, &ShardConfig{Name: name, Dir: filepath.Join(dir, name)})
+		}
+		return configs
+	}
+
+	server, err := NewServer(&Config{
+		Dirs:     []string{filepath.Join(dir, "files")},
+		DataDir:  filepath.Join(dir, "data"),
+		CacheDir: filepath.Join(dir, "cache"),
+		ShardBackends: map[string]*ShardBackendConfig{
+			"big": {Shards: shards("s1", "s2")},
+		},
+		ErasureBackends: map[string]*ErasureBackendConfig{
+			"safe": {Shards: shards("e1", "e2", "e3")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeDirs, _ := localDirs(server.backend)
+
+	allowed := make(map[string]bool)
+	for _, p := range writeDirs {
+		allowed[p] = true
+	}
+	for _, name := range []string{"files", "s1", "s2", "e1", "e2", "e3"} {
+		if !allowed[filepath.Join(dir, name)] {
+			t.Errorf("%s isn't allowed: %v", name, writeDirs)
+		}
+	}
+}
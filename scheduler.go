@@ -0,0 +1,288 @@
+package gemdrive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Recurring maintenance, like scrubbing files against their checksums, runs
+// on cron schedules from the config:
+//
+//	"tasks": [{"task": "scrub", "schedule": "0 3 * * 0", "exports": ["photos"]}]
+//
+// A task is never run twice at once; if it's still going when it's next
+// due, that run is skipped. The last few runs of each task are kept in the
+// data dir, and gemdrive/admin/tasks lists them along with when each task
+// runs next. Admins can also POST to gemdrive/admin/tasks/<name> to run one
+// straight away.
+
+type ScheduledTask struct {
+	// Defaults to the task
+	Name string `json:"name,omitempty"`
+	// scrub, gc, reindex, repair or tier
+	Task string `json:"task"`
+	// Cron expression, or @hourly, @daily, @weekly, @monthly or @yearly
+	Schedule string `json:"schedule"`
+	// Exports to run on, or erasure-coded mounts for repair. Defaults to all
+	// of them, or all tiered ones for tier.
+	Exports []string `json:"exports,omitempty"`
+}
+
+type TaskRun struct {
+	StartedAt  string `json:"startedAt"`
+	FinishedAt string `json:"finishedAt,omitempty"`
+	Result     string `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Started by an admin rather than the schedule
+	Manual bool `json:"manual,omitempty"`
+}
+
+type TaskStatus struct {
+	Name     string `json:"name"`
+	Task     string `json:"task"`
+	Schedule string `json:"schedule"`
+	Running  bool   `json:"running"`
+	NextRun  string `json:"nextRun,omitempty"`
+	// Most recent first
+	History []*TaskRun `json:"history"`
+}
+
+// Runs a task, returning a summary of what it did.
+type taskFunc func(ctx context.Context, exports []string) (string, error)
+
+// Runs kept per task
+const maxTaskHistory = 20
+
+type scheduledTask struct {
+	config   *ScheduledTask
+	schedule *cronSchedule
+	run      taskFunc
+	running  bool
+}
+
+type scheduler struct {
+	tasks   map[string]*scheduledTask
+	history map[string][]*TaskRun
+	path    string
+	// Manual runs outlive the request that started them
+	ctx     context.Context
+	mut     *sync.Mutex
+	cluster *cluster
+}
+
+func newScheduler(configs []*ScheduledTask, historyPath string, runners map[string]taskFunc, cluster *cluster) (*scheduler, error) {
+	tasks := make(map[string]*scheduledTask)
+
+	for _, config := range configs {
+		if config.Name == "" {
+			config.Name = config.Task
+		}
+
+		if _, exists := tasks[config.Name]; exists {
+			return nil, fmt.Errorf("Duplicate task name %s", config.Name)
+		}
+
+		run, exists := runners[config.Task]
+		if !exists {
+			return nil, fmt.Errorf("Unknown task %s", config.Task)
+		}
+
+		schedule, err := parseCron(config.Schedule)
+		if err != nil {
+			return nil, err
+		}
+
+		tasks[config.Name] = &scheduledTask{
+			config:   config,
+			schedule: schedule,
+			run:      run,
+		}
+	}
+
+	sched := &scheduler{
+		tasks:   tasks,
+		history: make(map[string][]*TaskRun),
+		path:    historyPath,
+		ctx:     context.Background(),
+		mut:     &sync.Mutex{},
+		cluster: cluster,
+	}
+
+	historyJson, err := ioutil.ReadFile(sched.path)
+	if err == nil {
+		err = json.Unmarshal(historyJson, &sched.history)
+		if err != nil {
+			fmt.Println("Ignoring invalid task history:", err)
+			sched.history = make(map[string][]*TaskRun)
+		}
+	}
+
+	return sched, nil
+}
+
+func (sc *scheduler) run(ctx context.Context) {
+	sc.mut.Lock()
+	sc.ctx = ctx
+	sc.mut.Unlock()
+
+	for _, task := range sc.tasks {
+		go sc.loop(ctx, task)
+	}
+}
+
+func (sc *scheduler) loop(ctx context.Context, task *scheduledTask) {
+	for {
+		next := task.schedule.next(time.Now())
+		if next.IsZero() {
+			fmt.Println("Task", task.config.Name, "will never run")
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		// Only one instance in a cluster runs each occurrence
+		if !sc.cluster.claim(fmt.Sprintf("task:%s:%d", task.config.Name, next.Unix()), time.Hour) {
+			continue
+		}
+
+		if !sc.start(task, false) {
+			fmt.Println("Skipping task", task.config.Name, "since it's still running")
+		}
+	}
+}
+
+// Starts the task in the background unless it's already running.
+func (sc *scheduler) start(task *scheduledTask, manual bool) bool {
+	sc.mut.Lock()
+	defer sc.mut.Unlock()
+
+	if task.running {
+		return false
+	}
+	task.running = true
+
+	go sc.execute(sc.ctx, task, manual)
+
+	return true
+}
+
+func (sc *scheduler) execute(ctx context.Context, task *scheduledTask, manual bool) {
+	name := task.config.Name
+
+	run := &TaskRun{
+		StartedAt: time.Now().UTC().Format(time.RFC3339),
+		Manual:    manual,
+	}
+
+	fmt.Println("Running task", name)
+
+	result, err := task.run(ctx, task.config.Exports)
+
+	run.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	run.Result = result
+	if err != nil {
+		run.Error = err.Error()
+		fmt.Println("Task", name, "failed:", err)
+	} else {
+		fmt.Println("Task", name, "finished:", result)
+	}
+
+	sc.mut.Lock()
+	defer sc.mut.Unlock()
+
+	task.running = false
+
+	history := append([]*TaskRun{run}, sc.history[name]...)
+	if len(history) > maxTaskHistory {
+		history = history[:maxTaskHistory]
+	}
+	sc.history[name] = history
+
+	err = saveJson(sc.history, sc.path)
+	if err != nil {
+		fmt.Println("Failed to save task history:", err)
+	}
+}
+
+func (sc *scheduler) status() []*TaskStatus {
+	sc.mut.Lock()
+	defer sc.mut.Unlock()
+
+	now := time.Now()
+
+	statuses := []*TaskStatus{}
+	for name, task := range sc.tasks {
+		status := &TaskStatus{
+			Name:     name,
+			Task:     task.config.Task,
+			Schedule: task.config.Schedule,
+			Running:  task.running,
+			History:  append([]*TaskRun{}, sc.history[name]...),
+		}
+
+		if next := task.schedule.next(now); !next.IsZero() {
+			status.NextRun = next.UTC().Format(time.RFC3339)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
+
+// Handles gemdrive/admin/tasks[/<name>]
+func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request, name string) {
+
+	token, _ := extractToken(r)
+
+	if !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		jsonBody, err := json.Marshal(s.scheduler.status())
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "POST":
+		task, exists := s.scheduler.tasks[name]
+		if !exists {
+			w.WriteHeader(404)
+			io.WriteString(w, "No such task")
+			return
+		}
+
+		if !s.scheduler.start(task, true) {
+			w.WriteHeader(409)
+			io.WriteString(w, "Task already running")
+			return
+		}
+
+		w.WriteHeader(202)
+	default:
+		w.WriteHeader(405)
+	}
+}
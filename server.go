@@ -5,41 +5,152 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/GeertJohan/go.rice"
 	"io"
 	"io/ioutil"
 	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Server struct {
-	config    *Config
-	backend   Backend
-	auth      *Auth
-	loginHtml []byte
+	config        *Config
+	backend       Backend
+	auth          *Auth
+	dlna          *dlnaServer
+	rangedUploads *rangedUploads
+	transfers     *transferTracker
+	streamLimiter *streamLimiter
+	indexer       *indexer
+	idempotency   *idempotencyStore
+	peerNonces    *peerNonces
+	deleteJobs    *deleteJobs
+	uploads       *uploadStore
+	notifier      *notifier
+	lockouts      *lockoutTracker
+	metrics       *backendMetrics
+	guard         *mountGuard
+	bandwidth     *bandwidthAccounts
+	fsBackends    map[string]*FileSystemBackend
+	erasure       map[string]*ErasureBackend
+	tiered        map[string]*TieredBackend
+	scheduler     *scheduler
+	chunkSessions *chunkedUploads
+	attrs         *attrStore
+	approvals     *approvalQueue
+	snapshots     *snapshotStore
+	processSlots  chan struct{}
+	cluster       *cluster
+	targets       *backupTargets
+	registry      *registry
+	torrents      *torrents
+	virtualFiles  *virtualFiles
+	chunkHashes   *chunkHashes
+	holds         *legalHolds
+	shareStats    *shareStatsStore
+	mounts        *mountRules
 }
 
 func NewServer(config *Config) (*Server, error) {
 
 	multiBackend := NewMultiBackend()
 
-	for _, dir := range config.Dirs {
-		dirName := filepath.Base(dir)
-		subCacheDir := filepath.Join(config.CacheDir, dirName)
-		fsBackend, err := NewFileSystemBackend(dir, subCacheDir)
+	metrics := newBackendMetrics(config.SlowOpMillis)
+	multiBackend.SetMetrics(metrics)
+
+	guard := newMountGuard(config.Resilience)
+	multiBackend.SetGuard(guard)
+
+	targets, err := newBackupTargets(config.BackupTargets)
+	if err != nil {
+		return nil, err
+	}
+	multiBackend.SetBackupTargets(targets)
+
+	virtual, err := newVirtualFiles(config.VirtualFiles)
+	if err != nil {
+		return nil, err
+	}
+	multiBackend.SetVirtualFiles(virtual)
+
+	fsBackends := make(map[string]*FileSystemBackend)
+
+	imageConfig := config.Images
+	if imageConfig == nil {
+		imageConfig = &ImageConfig{}
+	}
+	imagePool := NewImagePool(imageConfig)
+
+	env := &BackendEnv{
+		Config: config,
+		Images: imagePool,
+	}
+
+	erasureBackends := make(map[string]*ErasureBackend)
+
+	err = validateMounts(config)
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := newMountRules()
+	multiBackend.SetMountRules(mounts)
+
+	for _, mount := range config.mounts() {
+		mounts.add(mount)
+
+		if mount.ExportConfig != (ExportConfig{}) {
+			if config.Exports == nil {
+				config.Exports = make(map[string]*ExportConfig)
+			}
+			options := mount.ExportConfig
+			config.Exports[mount.Name] = &options
+		}
+
+		backend, err := newMountBackend(mount, env)
+		if err != nil {
+			return nil, fmt.Errorf("Mount %s: %s", mount.Name, err)
+		}
+		multiBackend.AddBackend(mount.Name, backend)
+
+		switch b := backend.(type) {
+		case *FileSystemBackend:
+			fsBackends[mount.Name] = b
+		case *ErasureBackend:
+			erasureBackends[mount.Name] = b
+		}
+	}
+
+	tieredBackends := make(map[string]*TieredBackend)
+	for _, rule := range config.Tiering {
+		hot, exists := fsBackends[rule.Export]
+		if !exists {
+			return nil, fmt.Errorf("%s isn't a local export", rule.Export)
+		}
+		manifestDir := filepath.Join(config.DataDir, "tiering", rule.Export)
+		tieredBackend, err := NewTieredBackend(hot, multiBackend, rule, manifestDir)
 		if err != nil {
 			return nil, err
 		}
-		multiBackend.AddBackend(filepath.Base(dir), fsBackend)
+		multiBackend.AddBackend(rule.Export, tieredBackend)
+		tieredBackends[rule.Export] = tieredBackend
+	}
+
+	for _, rule := range config.Rewrites {
+		if rule.From == "" || (rule.Status != 0 && (rule.Status < 300 || rule.Status >= 400)) {
+			return nil, fmt.Errorf("Invalid rewrite rule for %s", rule.From)
+		}
 	}
 
-	if config.RcloneDir != "" {
-		rcloneBackend := NewRcloneBackend()
-		multiBackend.AddBackend(config.RcloneDir, rcloneBackend)
+	err = validateProcessorRules(config.Processors)
+	if err != nil {
+		return nil, err
 	}
 
 	auth, err := NewAuth(config.DataDir, config)
@@ -47,94 +158,358 @@ func NewServer(config *Config) (*Server, error) {
 		return nil, err
 	}
 
-	return &Server{
-		config:  config,
-		backend: multiBackend,
-		auth:    auth,
-	}, nil
-}
+	var clust *cluster
+	if config.Cluster != nil {
+		if config.TwoPersonApproval {
+			return nil, errors.New("Two-person approval isn't supported in cluster mode")
+		}
 
-func (s *Server) Run(ctx context.Context) error {
+		clust, err = newCluster(config.Cluster, auth.shared, fsBackends)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	mux := &http.ServeMux{}
+	holds := newLegalHolds(config.DataDir, clust)
+	multiBackend.SetLegalHolds(holds)
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	reg, err := newRegistry(config.Registry, config.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	torrents, err := newTorrents(config.Torrents, config.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkHashes, err := newChunkHashes(config.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var dlna *dlnaServer
+	if config.Dlna != nil {
+		dlna = newDlnaServer(config.Dlna, config.Port, multiBackend, auth)
+	}
+
+	var limiter *streamLimiter
+	if config.Limits != nil {
+		limiter = newStreamLimiter(config.Limits)
+	}
 
-		box, err := rice.FindBox("files")
+	server := &Server{
+		config:        config,
+		backend:       multiBackend,
+		auth:          auth,
+		dlna:          dlna,
+		rangedUploads: newRangedUploads(auth.shared),
+		chunkSessions: newChunkedUploads(config.CacheDir, auth.shared),
+		transfers:     newTransferTracker(),
+		idempotency:   newIdempotencyStore(config.DataDir, clust),
+		peerNonces:    newPeerNonces(clust),
+		deleteJobs:    newDeleteJobs(clust.dataFile(config.DataDir, "gemdrive_delete_jobs.json"), multiBackend),
+		uploads:       newUploadStore(config.DataDir, clust),
+		attrs:         newAttrStore(config.DataDir, multiBackend, clust),
+		snapshots:     newSnapshotStore(config.DataDir),
+		notifier:      newNotifier(config, clust),
+		processSlots:  make(chan struct{}, processorSlots),
+		cluster:       clust,
+		targets:       targets,
+		registry:      reg,
+		torrents:      torrents,
+		virtualFiles:  virtual,
+		chunkHashes:   chunkHashes,
+		holds:         holds,
+		shareStats:    newShareStatsStore(clust.dataFile(config.DataDir, "gemdrive_share_stats.json")),
+		mounts:        mounts,
+		lockouts:      newLockoutTracker(config.Lockouts, auth.shared),
+		metrics:       metrics,
+		guard:         guard,
+		bandwidth:     newBandwidthAccounts(clust.dataFile(config.DataDir, "gemdrive_bandwidth.json")),
+		fsBackends:    fsBackends,
+		erasure:       erasureBackends,
+		tiered:        tieredBackends,
+		streamLimiter: limiter,
+	}
+
+	if config.TwoPersonApproval {
+		server.approvals = newApprovalQueue(config.DataDir)
+	}
+
+	server.deleteJobs.onDirDeleted = func(dirPath string) {
+		err := server.uploads.remove(dirPath)
 		if err != nil {
-			w.WriteHeader(500)
-			io.WriteString(w, err.Error())
-			return
+			fmt.Println("Failed to remove upload records:", err)
 		}
+		err = server.attrs.remove(dirPath)
+		if err != nil {
+			fmt.Println("Failed to remove attributes:", err)
+		}
+	}
 
-		s.loginHtml, err = box.Bytes("login.html")
+	if config.Index != nil {
+		stateDir := clust.dataFile(config.CacheDir, "index")
+		err := os.MkdirAll(stateDir, 0755)
 		if err != nil {
-			w.WriteHeader(500)
+			return nil, err
+		}
+
+		busy := func() bool {
+			return server.transfers.count() > 0
+		}
+
+		server.indexer = newIndexer(config.Index, fsBackends, stateDir, busy)
+	}
+
+	server.scheduler, err = newScheduler(config.Tasks, clust.dataFile(config.DataDir, "gemdrive_tasks.json"), server.taskRunners(), clust)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, task := range config.Tasks {
+		_, err := server.taskExports(task.Exports)
+		if err != nil {
+			return nil, fmt.Errorf("Task %s: %s", task.Name, err)
+		}
+	}
+
+	for name, export := range config.Exports {
+		if export != nil && !validFileNames(export.FileNames) {
+			return nil, fmt.Errorf("Export %s: unknown fileNames %s", name, export.FileNames)
+		}
+	}
+
+	return server, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if wantsJsonErrors(r) {
+		jsonWriter := &jsonErrorWriter{ResponseWriter: w}
+		defer jsonWriter.finish()
+		w = jsonWriter
+	}
+
+	header := w.Header()
+
+	header["Access-Control-Allow-Origin"] = []string{"*"}
+	header["Access-Control-Allow-Methods"] = []string{"*"}
+	header["Access-Control-Allow-Headers"] = []string{"*"}
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	if s.sendIfLockedOut(w, s.ipLockoutKey(r)) {
+		return
+	}
+
+	// Holds, ACLs and keys are checked by path prefix, so other spellings of
+	// a path, ie with "//" or "/./", can't be allowed past them
+	cleaned, err := cleanPath(r.URL.Path)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid path")
+		return
+	}
+	r.URL.Path = cleaned
+	r.URL.RawPath = ""
+
+	hostname := s.requestHost(r)
+
+	if !s.hostAllowed(hostname) {
+		w.WriteHeader(421)
+		io.WriteString(w, "Unknown host")
+		return
+	}
+
+	if s.applyRewrites(w, r, hostname) {
+		return
+	}
+
+	err = s.checkCsrf(r, hostname)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	}
+
+	if r.Header.Get("X-GemDrive-Peer") != "" {
+		peerToken, err := s.verifyPeerRequest(r)
+		if err != nil {
+			w.WriteHeader(401)
 			io.WriteString(w, err.Error())
 			return
 		}
+		defer s.auth.RemoveEphemeralKeyring(peerToken)
+		r.Header.Set("Authorization", "Bearer "+peerToken)
+	} else {
+		s.refreshFromCookie(w, r)
 
-		header := w.Header()
-
-		header["Access-Control-Allow-Origin"] = []string{"*"}
-		header["Access-Control-Allow-Methods"] = []string{"*"}
-		header["Access-Control-Allow-Headers"] = []string{"*"}
-		if r.Method == "OPTIONS" {
+		if !s.checkTokenBinding(w, r) {
 			return
 		}
+	}
 
-		reqPath := r.URL.Path
+	reqPath := r.URL.Path
 
-		hostname := r.Header.Get("X-Forwarded-Host")
-		if hostname == "" {
-			hostname = r.Host
+	if mapRoot, exists := s.hostRoot(hostname); exists {
+		reqPath = mapRoot + reqPath
+	}
+
+	identity := "-"
+	if token, err := extractToken(r); err == nil {
+		if principals := s.auth.Principals(token); len(principals) > 0 {
+			identity = strings.Join(principals, ",")
+		} else {
+			s.lockouts.fail(s.ipLockoutKey(r), token)
 		}
+		s.notifyShareAccess(token)
+	}
+
+	logLine := fmt.Sprintf("%s\t%s\t%s\t%s", r.Method, hostname, reqPath, identity)
+	fmt.Println(logLine)
+
+	counter := &countingWriter{ResponseWriter: w}
+	w = counter
+	token, _ := extractToken(r)
+	account := identity
+	if account == "-" {
+		account = "public"
+	}
+	defer s.recordBandwidth(token, account, reqPath, counter)
+	defer s.recordShareAccess(r, token, counter)
+
+	if s.registry != nil && strings.HasPrefix(r.URL.Path, "/v2/") {
+		s.handleRegistry(w, r, strings.TrimPrefix(r.URL.Path, "/v2/"))
+		return
+	}
 
-		if mapRoot, exists := s.config.DomainMap[hostname]; exists {
-			reqPath = mapRoot + reqPath
+	// Anything else would be served as it is now, passed off as old
+	if _, hasAt, err := parseAtParam(r); hasAt && (r.Method == "GET" || r.Method == "HEAD") {
+		if err == nil && !atSupported(reqPath) {
+			err = &Error{
+				HttpCode: 400,
+				Message:  "at is only supported for files and meta.json",
+			}
+		}
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
 		}
+	}
 
-		logLine := fmt.Sprintf("%s\t%s\t%s", r.Method, hostname, reqPath)
-		fmt.Println(logLine)
+	pathParts := strings.Split(reqPath, "gemdrive/")
 
-		pathParts := strings.Split(reqPath, "gemdrive/")
+	ext := path.Ext(reqPath)
+	contentType := mime.TypeByExtension(ext)
+	header.Set("Content-Type", contentType)
 
-		ext := path.Ext(reqPath)
-		contentType := mime.TypeByExtension(ext)
-		header.Set("Content-Type", contentType)
+	if len(pathParts) == 2 {
+		s.handleGemDriveRequest(w, r, reqPath)
+	} else {
+		switch r.Method {
+		case "HEAD":
+			s.handleHead(w, r, reqPath)
+		case "GET":
+			s.serveItem(w, r, reqPath)
+		case "PUT", "PATCH", "DELETE", "MOVE":
+			handle := func(w http.ResponseWriter) {
+				switch r.Method {
+				case "PUT":
+					s.handlePut(w, r, reqPath)
+				case "PATCH":
+					// TODO: return HTTP 409 if already exists
+					s.handlePatch(w, r, reqPath)
+				case "DELETE":
+					s.handleDelete(w, r, reqPath)
+				case "MOVE":
+					s.handleMove(w, r, reqPath, hostname)
+				}
+			}
 
-		if len(pathParts) == 2 {
-			s.handleGemDriveRequest(w, r, reqPath)
-		} else {
-			switch r.Method {
-			case "HEAD":
-				s.handleHead(w, r, reqPath)
-			case "GET":
-				s.serveItem(w, r, reqPath)
-			case "PUT":
-				// TODO: return HTTP 409 if already exists
-				s.handlePut(w, r, reqPath)
-			case "PATCH":
-				// TODO: return HTTP 409 if already exists
-				s.handlePatch(w, r, reqPath)
-			case "DELETE":
-				s.handleDelete(w, r, reqPath)
+			// Anonymous clients can't be told apart well enough
+			// to keep their results
+			token, _ := extractToken(r)
+			if r.Header.Get("Idempotency-Key") != "" && len(s.auth.Principals(token)) > 0 {
+				s.idempotency.serve(w, r, reqPath, handle)
+			} else {
+				handle(w)
 			}
 		}
-	})
+	}
+}
+
+func (s *Server) Run(ctx context.Context) error {
 
 	httpServer := &http.Server{
 		Addr:    fmt.Sprintf(":%d", s.config.Port),
-		Handler: mux,
+		Handler: s,
+	}
+
+	listener, err := net.Listen("tcp", httpServer.Addr)
+	if err != nil {
+		return err
+	}
+
+	var ninepListener net.Listener
+	if s.config.NinepAddr != "" {
+		ninepListener, err = net.Listen("tcp", s.config.NinepAddr)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		defer ninepListener.Close()
+	}
+
+	// Ports are bound, so root is no longer needed
+	if s.config.Sandbox != nil {
+		err := applySandbox(s.config, s.backend)
+		if err != nil {
+			listener.Close()
+			return err
+		}
 	}
 
 	serverDone := make(chan error)
 
 	go func() {
-		err := httpServer.ListenAndServe()
+		err := httpServer.Serve(listener)
 		serverDone <- err
 	}()
 
+	if s.dlna != nil {
+		go func() {
+			err := s.dlna.Run(ctx)
+			if err != nil {
+				fmt.Println("DLNA announcements stopped:", err)
+			}
+		}()
+	}
+
+	if s.indexer != nil {
+		go s.indexer.Run(ctx)
+	}
+
+	s.deleteJobs.resume()
+
+	go s.bandwidth.run(ctx)
+	go s.shareStats.run(ctx)
+
+	if s.cluster != nil {
+		go s.cluster.run(ctx)
+	}
+
+	s.scheduler.run(ctx)
+
+	if ninepListener != nil {
+		go func() {
+			err := newNinepServer(s.backend, s.auth, s.config.Exports).Serve(ninepListener)
+			serverDone <- err
+		}()
+	}
+
 	select {
 	case err := <-serverDone:
 		return err
@@ -142,8 +517,6 @@ func (s *Server) Run(ctx context.Context) error {
 		err := httpServer.Shutdown(ctx)
 		return err
 	}
-
-	return nil
 }
 
 func (s *Server) handleHead(w http.ResponseWriter, r *http.Request, reqPath string) {
@@ -157,9 +530,14 @@ func (s *Server) handleHead(w http.ResponseWriter, r *http.Request, reqPath stri
 		return
 	}
 
+	if at, hasAt, _ := parseAtParam(r); hasAt {
+		s.serveFileAt(w, r, reqPath, at)
+		return
+	}
+
 	parentDir := filepath.Dir(reqPath) + "/"
 
-	item, err := s.backend.List(parentDir, 1)
+	item, err := s.requestBackend(r).List(parentDir, 1)
 	if e, ok := err.(*Error); ok {
 		w.WriteHeader(e.HttpCode)
 		w.Write([]byte(e.Message))
@@ -180,6 +558,56 @@ func (s *Server) handleHead(w http.ResponseWriter, r *http.Request, reqPath stri
 	}
 
 	header.Set("Content-Length", fmt.Sprintf("%d", child.Size))
+	setValidators(w, child)
+
+	s.setEncryptionHeaders(w, reqPath)
+}
+
+func (s *Server) itemExists(reqPath string) (bool, error) {
+	parentDir, name := splitItemPath(reqPath)
+
+	item, err := s.backend.List(parentDir, 1)
+	if e, ok := err.(*Error); (ok && e.HttpCode == 404) || os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	_, exists := item.Children[name]
+	return exists, nil
+}
+
+func (s *Server) itemSize(reqPath string) (int64, bool, error) {
+	parentDir, name := splitItemPath(reqPath)
+
+	item, err := s.backend.List(parentDir, 1)
+	if isNotFound(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	child, exists := item.Children[name]
+	if !exists {
+		return 0, false, nil
+	}
+
+	return child.Size, true, nil
+}
+
+// Backends that can't report free space are assumed to have enough.
+func (s *Server) hasSpaceFor(reqPath string, size int64) bool {
+	reporter, ok := s.backend.(SpaceReporter)
+	if !ok {
+		return true
+	}
+
+	free, err := reporter.FreeSpace(reqPath)
+	if err != nil {
+		return true
+	}
+
+	return free >= size
 }
 
 func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, reqPath string) {
@@ -188,9 +616,13 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, reqPath strin
 
 	query := r.URL.Query()
 
-	if !s.auth.CanWrite(token, reqPath) {
-		s.sendLoginPage(w, r)
-		return
+	var drop *Share
+	if !s.auth.CanCreate(token, reqPath) && !s.canModify(token, reqPath) {
+		drop = s.auth.DropShare(token, reqPath)
+		if drop == nil {
+			s.sendLoginPage(w, r)
+			return
+		}
 	}
 
 	backend, ok := s.backend.(WritableBackend)
@@ -201,21 +633,94 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, reqPath strin
 		return
 	}
 
+	finalPath, err := s.normalizePath(reqPath)
+	if err == nil && !strings.HasSuffix(reqPath, "/") {
+		finalPath, err = s.applyUploadPolicy(r, finalPath)
+	}
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if finalPath != reqPath {
+		urlDir, _ := path.Split(strings.TrimSuffix(r.URL.Path, "/"))
+		_, name := path.Split(strings.TrimSuffix(finalPath, "/"))
+		if strings.HasSuffix(finalPath, "/") {
+			name += "/"
+		}
+		w.Header().Set("Location", escapePath(urlDir+name))
+		reqPath = finalPath
+	}
+
+	if drop != nil {
+		err := checkDrop(r, reqPath, drop.Drop)
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		}
+	}
+
+	exists, err := s.itemExists(reqPath)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if exists && drop != nil {
+		w.WriteHeader(409)
+		io.WriteString(w, "File exists")
+		return
+	}
+
+	// Uploaders can add new files, but only replace their own
+	if exists && !s.canModify(token, reqPath) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Not allowed to modify this file")
+		return
+	}
+
+	if !exists && drop == nil && !s.auth.CanCreate(token, reqPath) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Not allowed to create files here")
+		return
+	}
+
 	isDir := strings.HasSuffix(reqPath, "/")
 
 	if isDir {
 		recursive := query.Get("recursive") == "true"
+
 		err := backend.MakeDir(reqPath, recursive)
 		if err != nil {
 			w.WriteHeader(400)
 			io.WriteString(w, err.Error())
 			return
 		}
+
+		if !exists {
+			s.recordUpload(token, reqPath)
+		}
 	} else {
 		var offset int64 = 0
 		truncate := true
 		overwrite := query.Get("overwrite") == "true"
 
+		if r.Header.Get("X-GemDrive-Dedup") == "link" {
+			body := s.linkDedupContent(w, r, token, reqPath)
+			if body == nil {
+				return
+			}
+			defer body.Close()
+			r.Body = body
+		}
+
 		// TODO: consider allowing 0-length files
 		if r.ContentLength < 1 {
 			w.WriteHeader(400)
@@ -223,12 +728,110 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request, reqPath strin
 			return
 		}
 
-		err := backend.Write(reqPath, r.Body, offset, r.ContentLength, overwrite, truncate)
+		encryption, err := parseEncryptionHeaders(r)
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		}
+
+		if r.Header.Get("Content-Range") != "" {
+			s.handleRangedPut(w, r, reqPath, backend, overwrite, !exists)
+			return
+		}
+
+		// Everything that can reject the upload is checked before the body
+		// is read. For clients sending "Expect: 100-continue", Go only
+		// tells them to proceed once the body is first read, so rejected
+		// uploads never get sent.
+
+		if s.config.MaxUploadSize != 0 && r.ContentLength > s.config.MaxUploadSize {
+			w.WriteHeader(413)
+			io.WriteString(w, "Upload exceeds maximum size")
+			return
+		}
+
+		if !s.hasSpaceFor(reqPath, r.ContentLength) {
+			w.WriteHeader(507)
+			io.WriteString(w, "Insufficient storage")
+			return
+		}
+
+		if !overwrite && exists {
+			w.WriteHeader(409)
+			io.WriteString(w, "File exists")
+			return
+		}
+
+		expected, err := parseExpectedChecksums(r.Header.Get("Content-MD5"), r.Header.Get("X-Checksum-SHA256"))
 		if err != nil {
-			w.WriteHeader(500)
+			w.WriteHeader(400)
 			io.WriteString(w, err.Error())
 			return
 		}
+
+		release, ok := s.acquireStream(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		transfer := s.startTransfer(r, "upload", reqPath, r.ContentLength, r.Body)
+		defer s.transfers.finish(transfer)
+
+		// Checked before the file is put in place, so a bad upload can't
+		// replace a good one
+		body := newVerifyingReader(transfer, func(sums *Checksums) error {
+			if !sums.Matches(expected) {
+				return &Error{
+					HttpCode: 400,
+					Message:  "Checksum mismatch",
+				}
+			}
+			return nil
+		})
+
+		err = backend.Write(reqPath, body, offset, r.ContentLength, overwrite, truncate)
+		if err != nil {
+			if e, ok := err.(*Error); ok {
+				w.WriteHeader(e.HttpCode)
+				io.WriteString(w, e.Message)
+			} else {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+			}
+			return
+		}
+
+		sums := body.Checksums()
+
+		if store, ok := s.backend.(ChecksumStore); ok {
+			err := store.SetChecksums(reqPath, sums)
+			if err != nil {
+				fmt.Println("Failed to store checksums:", err.Error())
+			}
+		}
+
+		err = s.recordEncryption(reqPath, encryption)
+		if err != nil {
+			fmt.Println("Failed to record encryption metadata:", err)
+		}
+
+		if drop != nil {
+			err := s.uploads.record(reqPath, []string{"share:" + drop.Id})
+			if err != nil {
+				fmt.Println("Failed to record upload:", err)
+			}
+			s.notifyDrop(drop, reqPath, r.ContentLength)
+			s.notifyUpload(reqPath, "share:"+drop.Id, r.ContentLength)
+			s.processUpload(reqPath)
+		} else {
+			if !exists {
+				s.recordUpload(token, reqPath)
+			}
+			s.notifyUpload(reqPath, strings.Join(s.auth.Principals(token), ","), r.ContentLength)
+			s.processUpload(reqPath)
+		}
 	}
 }
 
@@ -238,7 +841,7 @@ func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, reqPath str
 
 	query := r.URL.Query()
 
-	if !s.auth.CanWrite(token, reqPath) {
+	if !s.canModify(token, reqPath) {
 		s.sendLoginPage(w, r)
 		return
 	}
@@ -270,6 +873,35 @@ func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, reqPath str
 		}
 	}
 
+	// Writing past the end of a file leaves a hole, so patches at large
+	// offsets produce sparse files. Existing ranges can be deallocated
+	// with punchHole=true and a length, rather than writing zeros.
+	if query.Get("punchHole") == "true" {
+		length, err := strconv.ParseInt(query.Get("length"), 10, 64)
+		if err != nil || length < 1 {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid length")
+			return
+		}
+
+		puncher, ok := s.backend.(HolePuncher)
+		if !ok {
+			w.WriteHeader(500)
+			io.WriteString(w, "Backend does not support hole punching")
+			return
+		}
+
+		err = puncher.PunchHole(reqPath, int64(offset), length)
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+		} else if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+		}
+		return
+	}
+
 	size, err := strconv.Atoi(r.Header.Get("Content-Length"))
 	if err != nil {
 		w.WriteHeader(400)
@@ -277,8 +909,28 @@ func (s *Server) handlePatch(w http.ResponseWriter, r *http.Request, reqPath str
 		return
 	}
 
-	err = backend.Write(reqPath, r.Body, int64(offset), int64(size), overwrite, truncate)
-	if err != nil {
+	err = s.checkFilePolicy(reqPath, int64(offset+size))
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	}
+
+	release, ok := s.acquireStream(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	transfer := s.startTransfer(r, "upload", reqPath, int64(size), r.Body)
+	defer s.transfers.finish(transfer)
+
+	err = backend.Write(reqPath, transfer, int64(offset), int64(size), overwrite, truncate)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
 		w.WriteHeader(500)
 		io.WriteString(w, err.Error())
 		return
@@ -290,7 +942,10 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, reqPath st
 
 	query := r.URL.Query()
 
-	if !s.auth.CanWrite(token, reqPath) {
+	recursive := query.Get("recursive") == "true"
+
+	// Recursive deletes could take other people's uploads with them
+	if !s.canDelete(token, reqPath) || (recursive && !s.auth.CanDelete(token, reqPath)) {
 		s.sendLoginPage(w, r)
 		return
 	}
@@ -303,105 +958,348 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request, reqPath st
 		return
 	}
 
-	recursive := query.Get("recursive") == "true"
+	if recursive && strings.HasSuffix(reqPath, "/") {
+		if err := s.targets.checkDelete(reqPath); err != nil {
+			w.WriteHeader(errAppendOnly.HttpCode)
+			io.WriteString(w, errAppendOnly.Message)
+			return
+		}
+		if err := s.holds.checkTree(reqPath); err != nil {
+			w.WriteHeader(errLegalHold.HttpCode)
+			io.WriteString(w, errLegalHold.Message)
+			return
+		}
+		if isExportRoot(reqPath) && s.deferForApproval(w, r, approvalDeleteExport, reqPath) {
+			return
+		}
+		s.deleteRecursive(w, r, reqPath)
+		return
+	}
+
 	err := backend.Delete(reqPath, recursive)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	err = s.uploads.remove(reqPath)
+	if err != nil {
+		fmt.Println("Failed to remove upload record:", err)
+	}
+
+	err = s.attrs.remove(reqPath)
+	if err != nil {
+		fmt.Println("Failed to remove attributes:", err)
+	}
+}
+
+// Moves follow WebDAV, with the new location in the Destination header.
+func (s *Server) handleMove(w http.ResponseWriter, r *http.Request, reqPath, hostname string) {
+	token, _ := extractToken(r)
+
+	destUrl, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || destUrl.Path == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid Destination header")
+		return
+	}
+
+	destPath := destUrl.Path
+	if mapRoot, exists := s.hostRoot(hostname); exists {
+		destPath = mapRoot + destPath
+	}
+
+	// Checked against keys by prefix, so it can't be left with ".." in it
+	destPath, err = cleanPath(destPath)
 	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid Destination header")
+		return
+	}
+
+	if strings.HasSuffix(reqPath, "/") != strings.HasSuffix(destPath, "/") {
+		w.WriteHeader(400)
+		io.WriteString(w, "Source and destination must both be files or both be directories")
+		return
+	}
+
+	destPath, err = s.normalizePath(destPath)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	// Moving a directory moves everything in it, so uploaders can only move
+	// their own files
+	canMoveSrc := s.auth.CanDelete(token, reqPath) || (!strings.HasSuffix(reqPath, "/") && s.canDelete(token, reqPath))
+	if !canMoveSrc || !s.auth.CanCreate(token, destPath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	err = s.checkMovePolicy(reqPath, destPath)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	backend, ok := s.backend.(MovableBackend)
+
+	if !ok {
+		w.WriteHeader(500)
+		io.WriteString(w, "Backend does not support moving")
+		return
+	}
+
+	err = backend.Move(reqPath, destPath)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
 		w.WriteHeader(500)
 		io.WriteString(w, err.Error())
 		return
 	}
+
+	err = s.uploads.move(reqPath, destPath)
+	if err != nil {
+		fmt.Println("Failed to move upload records:", err)
+	}
+
+	err = s.attrs.move(reqPath, destPath)
+	if err != nil {
+		fmt.Println("Failed to move attributes:", err)
+	}
 }
 
 func (s *Server) sendLoginPage(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := s.loginTemplate()
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
 	header := w.Header()
 	header.Set("WWW-Authenticate", "emauth realm=\"Everything\", charset=\"UTF-8\"")
+
+	// API clients can't do anything with the page itself
+	if wantsJsonErrors(r) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Login required")
+		return
+	}
+
 	header.Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(403)
-	w.Write(s.loginHtml)
+
+	serverName := s.config.ServerName
+	if serverName == "" {
+		serverName = "GemDrive"
+	}
+
+	err = tmpl.Execute(w, &loginPageData{
+		ServerName: serverName,
+		ReturnUrl:  r.URL.RequestURI(),
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
 func (s *Server) handleGemDriveRequest(w http.ResponseWriter, r *http.Request, reqPath string) {
 
-	token, _ := extractToken(r)
+	token, _ := extractToken(r)
+
+	pathParts := strings.Split(reqPath, "gemdrive/")
+
+	gemPath := pathParts[0]
+
+	gemReq, apiVersion, err := parseApiVersion(pathParts[1])
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	}
+
+	if apiVersion != 0 {
+		w.Header().Set("GemDrive-Api-Version", strconv.Itoa(apiVersion))
+	}
+
+	if gemReq == "authorize" {
+
+		s.authorize(w, r)
+
+		return
+	}
+
+	if gemPath == "/" && gemReq == "version.json" {
+		s.serveVersion(w, r)
+		return
+	}
+
+	if gemPath == "/" && gemReq == "openapi.json" {
+		s.serveOpenApi(w, r)
+		return
+	}
+
+	if gemPath == "/" && strings.HasPrefix(gemReq, "assets/") {
+		s.serveAsset(w, r, strings.TrimPrefix(gemReq, "assets/"))
+		return
+	}
+
+	if gemPath == "/" && strings.HasPrefix(gemReq, "session/") {
+		s.handleSession(w, r, strings.TrimPrefix(gemReq, "session/"))
+		return
+	}
+
+	if gemPath == "/" && strings.HasPrefix(gemReq, "admin/") {
+		s.handleAdminRequest(w, r, strings.TrimPrefix(gemReq, "admin/"))
+		return
+	}
+
+	if gemPath == "/" && (gemReq == "shares" || strings.HasPrefix(gemReq, "shares/")) {
+		s.handleShares(w, r, strings.TrimPrefix(strings.TrimPrefix(gemReq, "shares"), "/"))
+		return
+	}
+
+	if gemPath == "/" && (gemReq == "transfers" || strings.HasPrefix(gemReq, "transfers/")) {
+		s.handleTransfers(w, r, strings.TrimPrefix(strings.TrimPrefix(gemReq, "transfers"), "/"), false)
+		return
+	}
+
+	if gemPath == "/" && (gemReq == "deletes" || strings.HasPrefix(gemReq, "deletes/")) {
+		s.handleDeleteJobs(w, r, strings.TrimPrefix(strings.TrimPrefix(gemReq, "deletes"), "/"), false)
+		return
+	}
+
+	if gemPath == "/" && (gemReq == "chunked-uploads" || strings.HasPrefix(gemReq, "chunked-uploads/")) {
+		s.handleChunkedUploads(w, r, strings.TrimPrefix(strings.TrimPrefix(gemReq, "chunked-uploads"), "/"))
+		return
+	}
+
+	// Snapshots are public
+	if gemPath == "/" && (gemReq == "snapshots" || strings.HasPrefix(gemReq, "snapshots/")) {
+		s.handleSnapshots(w, r, strings.TrimPrefix(strings.TrimPrefix(gemReq, "snapshots"), "/"))
+		return
+	}
+
+	if gemReq == "restic" || strings.HasPrefix(gemReq, "restic/") {
+		s.handleRestic(w, r, gemPath, strings.TrimPrefix(strings.TrimPrefix(gemReq, "restic"), "/"))
+		return
+	}
 
-	pathParts := strings.Split(reqPath, "gemdrive/")
+	if strings.HasPrefix(gemReq, "lfs/") {
+		s.handleLfs(w, r, gemPath, strings.TrimPrefix(gemReq, "lfs/"))
+		return
+	}
 
-	gemPath := pathParts[0]
-	gemReq := pathParts[1]
+	if strings.HasPrefix(gemReq, "torrent/") {
+		s.serveTorrent(w, r, gemPath, strings.TrimPrefix(gemReq, "torrent/"))
+		return
+	}
 
-	if gemReq == "authorize" {
+	if strings.HasPrefix(gemReq, "chunks/") {
+		s.serveChunkManifest(w, r, gemPath, strings.TrimPrefix(gemReq, "chunks/"))
+		return
+	}
 
-		s.authorize(w, r)
+	if strings.HasPrefix(gemReq, "subtitles/") {
+		s.serveSubtitles(w, r, gemPath, strings.TrimPrefix(gemReq, "subtitles/"))
+		return
+	}
 
+	if strings.HasPrefix(gemReq, "metalink/") {
+		s.serveMetalink(w, r, gemPath, strings.TrimPrefix(gemReq, "metalink/"))
 		return
 	}
 
-	if !s.auth.CanRead(token, gemPath) {
-		s.sendLoginPage(w, r)
+	if gemReq == "archive" {
+		s.serveArchiveDownload(w, r, gemPath)
 		return
 	}
 
-	if gemReq == "meta.json" {
+	if gemReq == "publish" {
+		s.handlePublish(w, r, gemPath)
+		return
+	}
 
-		depth := 1
-		depthParam := r.URL.Query().Get("depth")
-		if depthParam != "" {
-			var err error
-			depth, err = strconv.Atoi(depthParam)
-			if err != nil {
-				w.WriteHeader(400)
-				w.Write([]byte("Invalid depth param"))
-				return
-			}
-		}
+	if gemPath == "/" && gemReq == "index/status" {
+		s.serveIndexStatus(w, r)
+		return
+	}
 
-		item, err := s.backend.List(gemPath, depth)
-		if e, ok := err.(*Error); ok {
-			w.WriteHeader(e.HttpCode)
-			w.Write([]byte(e.Message))
-			return
-		} else if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+	if gemPath == "/" && strings.HasPrefix(gemReq, "dlna/") && s.dlna != nil {
+		if !isLanIp(s.clientIp(r)) {
+			w.WriteHeader(403)
+			io.WriteString(w, "DLNA is only served on the local network")
 			return
 		}
+		s.dlna.ServeHTTP(w, r, strings.TrimPrefix(gemReq, "dlna/"))
+		return
+	}
 
-		jsonBody, err := json.Marshal(item)
-		//jsonBody, err := json.MarshalIndent(item, "", "  ")
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
-			return
-		}
+	// Uploaders can list their own uploads without read access
+	if gemReq == "uploads.json" {
+		s.serveUploads(w, r, gemPath)
+		return
+	}
 
-		w.Write(jsonBody)
-	} else {
-		gemReqParts := strings.Split(gemReq, "/")
-		if gemReqParts[0] == "images" {
-
-			if b, ok := s.backend.(ImageServer); ok {
-				size, err := strconv.Atoi(gemReqParts[1])
-				if err != nil {
-					w.WriteHeader(400)
-					w.Write([]byte(err.Error()))
-					return
-				}
+	if gemReq == "attrs.json" {
+		s.handleAttrs(w, r, gemPath, "")
+		return
+	}
+	if strings.HasPrefix(gemReq, "attrs/") && !strings.Contains(gemReq[len("attrs/"):], "/") {
+		s.handleAttrs(w, r, gemPath, gemReq[len("attrs/"):])
+		return
+	}
 
-				filename := gemReqParts[2]
-				imagePath := path.Join(gemPath, filename)
-				img, _, err := b.GetImage(imagePath, size)
-				if err != nil {
-					w.WriteHeader(500)
-					w.Write([]byte(err.Error()))
-					return
-				}
+	// Listing a directory doesn't give access to what's in its files
+	canAccess := s.auth.CanList(token, gemPath)
+	if strings.HasPrefix(gemReq, "images/") || strings.HasPrefix(gemReq, "gallery/") || strings.HasPrefix(gemReq, "music/") {
+		canAccess = s.auth.CanRead(token, gemPath)
+	}
 
-				_, err = io.Copy(w, img)
-				if err != nil {
-					fmt.Println(err)
-				}
-			}
-		}
+	if !canAccess {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	if gemReq == "meta.json" {
+		s.serveMeta(w, r, gemPath)
+	} else if gemReq == "feed.xml" {
+		s.serveFeed(w, r, gemPath)
+	} else if gemReq == "playlist.m3u8" {
+		s.servePlaylist(w, r, gemPath)
+	} else if gemReq == "media.json" {
+		s.serveMediaDescriptor(w, r, gemPath)
+	} else if strings.HasPrefix(gemReq, "app/") {
+		s.serveApp(w, r)
+	} else if strings.HasPrefix(gemReq, "gallery/") {
+		s.serveGallery(w, r, gemPath, strings.TrimPrefix(gemReq, "gallery/"))
+	} else if strings.HasPrefix(gemReq, "music/") {
+		s.serveMusic(w, r, gemPath, strings.TrimPrefix(gemReq, "music/"))
+	} else if gemReqParts := strings.Split(gemReq, "/"); gemReqParts[0] == "images" && len(gemReqParts) == 3 {
+		s.serveImage(w, r, gemPath, gemReqParts[1], gemReqParts[2])
+	} else {
+		w.WriteHeader(404)
+		io.WriteString(w, "Unknown endpoint")
 	}
 }
 
@@ -412,26 +1310,50 @@ func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
 	code := query.Get("code")
 
 	if id != "" && code != "" {
-		token, err := s.auth.CompleteAuth(id, code)
+		err := s.ensureDeviceCookie(w, r)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		// Requests end on the first attempt, but the codes are short, so
+		// guessing is still throttled per identity
+		identity := s.auth.PendingIdentity(id)
+		if identity != "" && s.sendIfLockedOut(w, identity) {
+			return
+		}
+
+		tokens, err := s.auth.CompleteAuth(id, code, s.requestBinding(r))
 		if err != nil {
+			s.lockouts.fail(s.ipLockoutKey(r), id+":"+code)
+			if identity != "" {
+				s.lockouts.fail(identity, id+":"+code)
+			}
 			w.WriteHeader(400)
 			io.WriteString(w, err.Error())
 			return
 		}
 
-		cookie := &http.Cookie{
-			Name:  "access_token",
-			Value: token,
-			// TODO: enable Secure
-			//Secure:   true,
-			HttpOnly: true,
-			MaxAge:   86400 * 365,
-			Path:     "/",
-			SameSite: http.SameSiteLaxMode,
+		s.lockouts.succeed(identity)
+
+		setSessionCookies(w, tokens, s.isHttps(r))
+
+		// Older clients expect just the access token
+		if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			io.WriteString(w, tokens.AccessToken)
+			return
+		}
+
+		jsonBody, err := json.Marshal(tokens)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
 		}
-		http.SetCookie(w, cookie)
 
-		io.WriteString(w, token)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
 
 	} else {
 		bodyJson, err := ioutil.ReadAll(r.Body)
@@ -449,6 +1371,10 @@ func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if s.sendIfLockedOut(w, key.IdType+":"+key.Id) {
+			return
+		}
+
 		authId, err := s.auth.Authorize(key)
 		if err != nil {
 			w.WriteHeader(400)
@@ -460,39 +1386,281 @@ func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Serves the listing of dirPath as JSON, the same for gemdrive/meta.json and
+// directory URLs asking for JSON.
+func (s *Server) serveMeta(w http.ResponseWriter, r *http.Request, dirPath string) {
+	depth := 1
+	depthParam := r.URL.Query().Get("depth")
+	if depthParam != "" {
+		var err error
+		depth, err = strconv.Atoi(depthParam)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid depth param"))
+			return
+		}
+	}
+
+	limits := s.metaLimits()
+
+	err := limits.checkDepth(depth)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		w.Write([]byte(e.Message))
+		return
+	}
+
+	at, hasAt, _ := parseAtParam(r)
+
+	// Taken before listing, so changes made meanwhile make it stale rather
+	// than being missed. Past listings don't have one.
+	version := ""
+	if versioner, ok := s.backend.(DirVersioner); ok && !hasAt {
+		version, _ = versioner.DirVersion(dirPath)
+	}
+
+	since := r.URL.Query().Get("since")
+
+	// Deltas depend on when they're asked for, so aren't cached
+	etag := ""
+	if version != "" && since == "" {
+		etag = metaETag(r, version)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.Header().Set("ETag", etag)
+			w.Header().Set("GemDrive-Generation", version)
+			w.WriteHeader(304)
+			return
+		}
+	}
+
+	var item *Item
+
+	limitParam := r.URL.Query().Get("limit")
+	if hasAt {
+		if since != "" || limitParam != "" {
+			w.WriteHeader(400)
+			w.Write([]byte("at can't be combined with since or limit"))
+			return
+		}
+
+		item, err = listAt(s.requestBackend(r), dirPath, depth, at)
+		if err == nil && limits.MaxItems > 0 && countItems(item) > limits.MaxItems {
+			err = limits.tooManyItems()
+		}
+	} else if since != "" {
+		if depth != 1 || limitParam != "" {
+			w.WriteHeader(400)
+			w.Write([]byte("since requires depth=1 and no limit"))
+			return
+		}
+
+		item, version, err = s.listChanges(r, dirPath, since)
+	} else if limitParam != "" {
+		limit, convErr := strconv.Atoi(limitParam)
+		if convErr != nil || limit < 1 {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid limit param"))
+			return
+		}
+
+		if depth != 1 {
+			w.WriteHeader(400)
+			w.Write([]byte("Paging requires depth=1"))
+			return
+		}
+
+		if limits.MaxItems > 0 && limit > limits.MaxItems {
+			limit = limits.MaxItems
+			limitParam = strconv.Itoa(limit)
+		}
+
+		var next string
+		item, next, err = listPage(s.requestBackend(r), dirPath, r.URL.Query().Get("after"), limit)
+		if err == nil && next != "" {
+			query := url.Values{}
+			query.Set("limit", limitParam)
+			query.Set("after", next)
+			// Relative to the directory itself for directory URLs
+			metaUrl := "meta.json"
+			if !strings.HasSuffix(r.URL.Path, "gemdrive/meta.json") {
+				metaUrl = "gemdrive/meta.json"
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, metaUrl, query.Encode()))
+		}
+	} else if limits.MaxItems > 0 && depth != 1 {
+		item, err = limits.list(s.requestBackend(r), dirPath, depth)
+	} else {
+		item, err = s.requestBackend(r).List(dirPath, depth)
+		if err == nil && limits.MaxItems > 0 && len(item.Children) > limits.MaxItems {
+			err = limits.tooManyItems()
+		}
+	}
+
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		w.Write([]byte(e.Message))
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	token, _ := extractToken(r)
+	item = s.pruneListing(token, dirPath, item, actList)
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if version != "" {
+		w.Header().Set("GemDrive-Generation", version)
+	}
+
+	if limits.MaxBytes > 0 {
+		buf := &cappedBuffer{max: limits.MaxBytes}
+		err = writeItemJson(buf, item)
+		if err == errResponseTooLarge {
+			w.WriteHeader(413)
+			w.Write([]byte(fmt.Sprintf("Listing is larger than %d bytes. Use a smaller depth, or limit to page through it.", limits.MaxBytes)))
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Write(buf.Bytes())
+		return
+	}
+
+	err = writeItemJson(w, item)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
 func (s *Server) serveItem(w http.ResponseWriter, r *http.Request, reqPath string) {
 
 	token, _ := extractToken(r)
 
+	if strings.HasSuffix(reqPath, "/") {
+		s.serveDir(w, r, reqPath, token)
+		return
+	}
+
 	if !s.auth.CanRead(token, reqPath) {
 		s.sendLoginPage(w, r)
 		return
 	}
 
-	isDir := strings.HasSuffix(reqPath, "/")
+	if !canReadRaw(s.config.Exports, s.auth, token, reqPath) {
+		w.WriteHeader(errNoRawAccess.HttpCode)
+		io.WriteString(w, errNoRawAccess.Message)
+		return
+	}
 
-	if isDir {
-		s.serveDir(w, r, reqPath)
-	} else {
-		s.serveFile(w, r, reqPath)
+	if at, hasAt, _ := parseAtParam(r); hasAt {
+		s.serveFileAt(w, r, reqPath, at)
+		return
 	}
+
+	if s.mounts.get(mountName(reqPath)).Website && s.serveWebsiteFallback(w, r, reqPath, token) {
+		return
+	}
+
+	s.serveFile(w, r, reqPath)
 }
 
-func (s *Server) serveDir(w http.ResponseWriter, r *http.Request, reqPath string) {
-	// If the directory contains an index.html file, serve that by default.
-	// Otherwise reading a directory is an error.
-	htmlIndexPath := reqPath + "index.html"
-	_, data, err := s.backend.Read(htmlIndexPath, 0, 0)
-	if err != nil {
-		w.WriteHeader(400)
-		io.WriteString(w, "Attempted to read directory")
+// Directories are content negotiated. Clients asking for JSON get the
+// listing, as from gemdrive/meta.json. Otherwise the directory's index.html
+// is served if it has one, and browsers get the app for browsing it if not.
+func (s *Server) serveDir(w http.ResponseWriter, r *http.Request, reqPath, token string) {
+	canList := s.auth.CanList(token, reqPath)
+	canRead := s.auth.CanRead(token, reqPath)
+
+	if !canList && !canRead {
+		s.sendLoginPage(w, r)
 		return
 	}
 
-	_, err = io.Copy(w, data)
-	if err != nil {
-		fmt.Println(err)
+	w.Header().Add("Vary", "Accept")
+
+	preferred := preferredListingType(r)
+
+	if preferred == "json" {
+		if !canList {
+			s.sendLoginPage(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		s.serveMeta(w, r, reqPath)
+		return
+	}
+
+	if canRead && !exportConfig(s.config.Exports, reqPath).NoAutoIndex {
+		htmlIndexPath := reqPath + "index.html"
+		_, data, err := s.requestBackend(r).Read(htmlIndexPath, 0, 0)
+		if err == nil {
+			defer data.Close()
+
+			_, err = io.Copy(w, data)
+			if err != nil {
+				fmt.Println(err)
+			}
+			return
+		}
+	}
+
+	if s.mounts.get(mountName(reqPath)).Website {
+		s.serveWebsiteNotFound(w, r, reqPath, token)
+		return
+	}
+
+	if preferred == "html" && canList {
+		s.serveApp(w, r)
+		return
+	}
+
+	w.WriteHeader(400)
+	io.WriteString(w, "Attempted to read directory")
+}
+
+// Which of JSON and HTML the client prefers, by the q values in its Accept
+// header, or "" if it asked for neither.
+func preferredListingType(r *http.Request) string {
+	jsonQ := -1.0
+	htmlQ := -1.0
+
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		switch mediaType {
+		case "application/json":
+			jsonQ = q
+		case "text/html":
+			htmlQ = q
+		}
+	}
+
+	if jsonQ > 0 && jsonQ > htmlQ {
+		return "json"
+	} else if htmlQ > 0 {
+		return "html"
 	}
+
+	return ""
 }
 
 func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, reqPath string) {
@@ -502,10 +1670,31 @@ func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, reqPath strin
 	header := w.Header()
 	header.Set("Accept-Ranges", "bytes")
 
+	s.setEncryptionHeaders(w, reqPath)
+
+	// Without a name, browsers save downloads as the URL's escaped last
+	// segment
+	filename := path.Base("/" + query.Get("filename"))
+	if filename == "/" {
+		filename = path.Base(reqPath)
+	}
+
 	download := query.Get("download") == "true"
 	if download {
-		header.Set("Content-Disposition", "attachment")
+		header.Set("Content-Disposition", contentDisposition("attachment", filename))
+	} else if query.Get("filename") != "" {
+		header.Set("Content-Disposition", contentDisposition("inline", filename))
+	}
+
+	if isVideoName(reqPath) {
+		header.Set("Link", "<gemdrive/media.json>; rel=\"describedby\"")
+	}
+
+	release, ok := s.acquireStream(w, r)
+	if !ok {
+		return
 	}
+	defer release()
 
 	rangeHeader := r.Header.Get("Range")
 
@@ -530,7 +1719,16 @@ func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, reqPath strin
 
 	}
 
-	item, data, err := s.backend.Read(reqPath, offset, copyLength)
+	item, data, err := s.requestBackend(r).Read(reqPath, offset, copyLength)
+
+	// Resumed downloads only get the rest of the file if it hasn't changed
+	// since they started. Otherwise they get all of it again.
+	if err == nil && rang != nil && r.Header.Get("If-Range") != "" && !ifRangeMatches(r.Header.Get("If-Range"), item) {
+		data.Close()
+		rang = nil
+		item, data, err = s.requestBackend(r).Read(reqPath, 0, 0)
+	}
+
 	if readErr, ok := err.(*Error); ok {
 		w.WriteHeader(readErr.HttpCode)
 		w.Write([]byte(readErr.Message))
@@ -542,6 +1740,8 @@ func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, reqPath strin
 	}
 	defer data.Close()
 
+	setValidators(w, item)
+
 	if rang != nil {
 		end := rang.End
 		if end == MAX_INT64 {
@@ -555,12 +1755,56 @@ func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, reqPath strin
 		header.Set("Content-Length", fmt.Sprintf("%d", item.Size))
 	}
 
-	_, err = io.Copy(w, data)
+	transfer := s.startTransfer(r, "download", reqPath, item.Size, data)
+	defer s.transfers.finish(transfer)
+
+	_, err = io.Copy(w, transfer)
 	if err != nil {
 		fmt.Println(err)
 	}
 }
 
+// A strong ETag for a file, from its size and modification time, or "" for
+// backends that don't report them.
+func fileETag(item *Item) string {
+	modTime, err := time.Parse(time.RFC3339, item.ModTime)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("\"%x-%x\"", item.Size, modTime.Unix())
+}
+
+func setValidators(w http.ResponseWriter, item *Item) {
+	modTime, err := time.Parse(time.RFC3339, item.ModTime)
+	if err != nil {
+		return
+	}
+
+	header := w.Header()
+	header.Set("ETag", fileETag(item))
+	header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+}
+
+// Weak ETags never match, and dates only match exactly.
+func ifRangeMatches(ifRange string, item *Item) bool {
+	etag := fileETag(item)
+	if etag == "" {
+		return false
+	}
+
+	if strings.HasPrefix(ifRange, "\"") {
+		return ifRange == etag
+	}
+
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+
+	modTime, _ := time.Parse(time.RFC3339, item.ModTime)
+	return date.Equal(modTime)
+}
+
 type HttpRange struct {
 	Start int64 `json:"start"`
 	// Note: if end is 0 it won't be included in the json because of omitempty
@@ -608,6 +1852,32 @@ func parseRange(header string) (*HttpRange, error) {
 }
 
 // Looks for auth token in cookie, then header, then query string
+// Cleans a path from a header or body. ServeMux cleans URL paths, but these
+// aren't, and since keys are matched by prefix ".." is refused outright.
+func cleanPath(p string) (string, error) {
+	invalid := &Error{
+		HttpCode: 400,
+		Message:  "Invalid path",
+	}
+
+	if !strings.HasPrefix(p, "/") {
+		return "", invalid
+	}
+
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." {
+			return "", invalid
+		}
+	}
+
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned, nil
+}
+
 func extractToken(r *http.Request) (string, error) {
 	tokenName := "access_token"
 
@@ -618,6 +1888,11 @@ func extractToken(r *http.Request) (string, error) {
 		return queryToken, nil
 	}
 
+	// For clients like restic that only do basic auth
+	if _, password, ok := r.BasicAuth(); ok {
+		return password, nil
+	}
+
 	authHeader := r.Header.Get("Authorization")
 
 	if authHeader != "" {
@@ -0,0 +1,146 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Service accounts are for cron jobs, CI pipelines, and anything else that
+// can't complete the email flow. Their tokens are minted directly by an
+// admin, carry a distinct "service" identity which ACLs can grant access to,
+// and can be revoked independently of any user's tokens.
+
+type ServiceToken struct {
+	Id        string `json:"id"`
+	Token     string `json:"token,omitempty"`
+	Key       *Key   `json:"key"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func (a *Auth) CreateServiceToken(name, perm, pathStr string) (string, *ServiceToken, error) {
+	if name == "" {
+		return "", nil, errors.New("Service account name required")
+	}
+
+	if !validPerm(perm) {
+		return "", nil, errors.New("Invalid perm")
+	}
+
+	if !strings.HasPrefix(pathStr, "/") {
+		return "", nil, errors.New("Invalid path")
+	}
+
+	token, err := genRandomKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := genRandomKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	serviceToken := &ServiceToken{
+		Id: id[:12],
+		Key: &Key{
+			IdType: "service",
+			Id:     name,
+			Perm:   perm,
+			Path:   pathStr,
+		},
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	a.db.AddServiceToken(token, serviceToken)
+
+	return token, serviceToken, nil
+}
+
+func (a *Auth) GetServiceTokens() []*ServiceToken {
+	serviceTokens := []*ServiceToken{}
+
+	// Never hand the tokens themselves back out
+	for _, serviceToken := range a.db.GetServiceTokens() {
+		redacted := *serviceToken
+		redacted.Token = ""
+		serviceTokens = append(serviceTokens, &redacted)
+	}
+
+	return serviceTokens
+}
+
+func (a *Auth) RevokeServiceToken(id string) error {
+	return a.db.RevokeServiceToken(id)
+}
+
+// Handles gemdrive/admin/service-tokens[/<id>]
+func (s *Server) handleServiceTokens(w http.ResponseWriter, r *http.Request, id string) {
+
+	token, _ := extractToken(r)
+
+	if !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		jsonBody, err := json.Marshal(s.auth.GetServiceTokens())
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "POST":
+		bodyJson, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		var key Key
+		err = json.Unmarshal(bodyJson, &key)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		// The token is only ever returned here, at creation time
+		_, serviceToken, err := s.auth.CreateServiceToken(key.Id, key.Perm, key.Path)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		jsonBody, err := json.Marshal(serviceToken)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "DELETE":
+		// Not held for approval, since a leaked token has to stop working
+		// straight away
+		err := s.auth.RevokeServiceToken(id)
+		if err != nil {
+			w.WriteHeader(404)
+			io.WriteString(w, err.Error())
+			return
+		}
+	default:
+		w.WriteHeader(405)
+	}
+}
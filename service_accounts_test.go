@@ -0,0 +1,49 @@
+package gemdrive
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// Even with two-person approval, a leaked token has to stop working as soon
+// as it's revoked.
+func TestServiceTokenRevokedImmediately(t *testing.T) {
+	dir := t.TempDir()
+
+	server, err := NewServer(&Config{
+		Dirs:              []string{filepath.Join(dir, "files")},
+		DataDir:           filepath.Join(dir, "data"),
+		CacheDir:          filepath.Join(dir, "cache"),
+		AdminEmail:        "owner@example.com",
+		TwoPersonApproval: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ownerToken, err := server.auth.AddEphemeralKeyring([]*Key{
+		{IdType: "email", Id: "owner@example.com", Perm: "own", Path: "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, serviceToken, err := server.auth.CreateServiceToken("backups", "read", "/files/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("DELETE", "/gemdrive/admin/service-tokens/"+serviceToken.Id, nil)
+	r.Header.Set("Authorization", "Bearer "+ownerToken)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Fatalf("revoking got %d %s", w.Code, w.Body.String())
+	}
+
+	if len(server.auth.Principals(token)) != 0 {
+		t.Error("revoked token still works")
+	}
+}
@@ -0,0 +1,379 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Logins get a short-lived access token plus a refresh token, which is
+// traded for a new pair at gemdrive/session/refresh. Every refresh rotates
+// both, and presenting a refresh token that was already rotated out ends
+// the whole session, since it means someone else has a copy. Browsers hold
+// both as cookies, and an expired access cookie is refreshed transparently.
+
+const accessTokenLifetime = time.Hour
+
+const refreshTokenLifetime = 30 * 24 * time.Hour
+
+// Pages fire several requests at once, all carrying the same refresh
+// cookie. Only the first rotates; the rest get its result for this long
+// rather than tripping reuse detection.
+const refreshReuseGrace = 30 * time.Second
+
+// Rotated refresh tokens remembered per session for reuse detection
+const maxUsedRefreshTokens = 100
+
+type Session struct {
+	Id                   string   `json:"id"`
+	Keyring              []*Key   `json:"keyring"`
+	AccessToken          string   `json:"accessToken"`
+	RefreshToken         string   `json:"refreshToken"`
+	RefreshExpiresAt     int64    `json:"refreshExpiresAt"`
+	PreviousRefreshToken string   `json:"previousRefreshToken,omitempty"`
+	RotatedAt            int64    `json:"rotatedAt,omitempty"`
+	UsedRefreshTokens    []string `json:"usedRefreshTokens,omitempty"`
+	CreatedAt            string   `json:"createdAt"`
+	// Where the session's tokens may be used from, if bound
+	Binding *TokenBinding `json:"binding,omitempty"`
+	// The current pair in plain, for the reuse grace period. Tokens are
+	// only stored hashed, so this doesn't survive restarts.
+	tokens *SessionTokens
+}
+
+type SessionTokens struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	// Seconds until the access token expires
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+var errInvalidRefreshToken = &Error{
+	HttpCode: 401,
+	Message:  "Invalid refresh token",
+}
+
+func (db *Database) CreateSession(keyring []*Key, binding *TokenBinding) (*SessionTokens, error) {
+	db.lock()
+	defer db.unlock()
+
+	db.expireSessions()
+
+	id, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		Id:        id,
+		Keyring:   keyring,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Binding:   binding,
+	}
+
+	tokens, err := db.issueTokens(session)
+	if err != nil {
+		return nil, err
+	}
+
+	db.Sessions[id] = session
+
+	db.persist()
+
+	return tokens, nil
+}
+
+// Refreshing a bound session only works from where it's bound to.
+func (db *Database) RefreshSession(refreshToken string, binding *TokenBinding) (*SessionTokens, error) {
+	db.lock()
+	defer db.unlock()
+
+	db.expireSessions()
+
+	now := time.Now()
+
+	refreshToken = db.hashToken(refreshToken)
+
+	for _, session := range db.Sessions {
+		isCurrent := refreshToken == session.RefreshToken || refreshToken == session.PreviousRefreshToken
+		if isCurrent && !session.Binding.allows(binding) {
+			return nil, errTokenBinding
+		}
+
+		if refreshToken == session.RefreshToken {
+			session.UsedRefreshTokens = append(session.UsedRefreshTokens, session.RefreshToken)
+			if len(session.UsedRefreshTokens) > maxUsedRefreshTokens {
+				session.UsedRefreshTokens = session.UsedRefreshTokens[1:]
+			}
+
+			session.PreviousRefreshToken = session.RefreshToken
+			session.RotatedAt = now.Unix()
+
+			db.revokeAccessToken(session.AccessToken)
+
+			tokens, err := db.issueTokens(session)
+			if err != nil {
+				return nil, err
+			}
+
+			db.persist()
+
+			return tokens, nil
+		}
+
+		if refreshToken == session.PreviousRefreshToken && now.Unix()-session.RotatedAt < int64(refreshReuseGrace.Seconds()) {
+			if session.tokens == nil {
+				return nil, errInvalidRefreshToken
+			}
+			return session.tokens, nil
+		}
+
+		for _, used := range session.UsedRefreshTokens {
+			if refreshToken == used {
+				db.endSession(session)
+				db.persist()
+				return nil, errInvalidRefreshToken
+			}
+		}
+	}
+
+	return nil, errInvalidRefreshToken
+}
+
+func (db *Database) EndSession(refreshToken string) error {
+	db.lock()
+	defer db.unlock()
+
+	refreshToken = db.hashToken(refreshToken)
+
+	for _, session := range db.Sessions {
+		if refreshToken == session.RefreshToken {
+			db.endSession(session)
+			db.persist()
+			return nil
+		}
+	}
+
+	return errInvalidRefreshToken
+}
+
+// Must be called with the lock held.
+func (db *Database) issueTokens(session *Session) (*SessionTokens, error) {
+	accessToken, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	accessHash := db.hashToken(accessToken)
+
+	session.AccessToken = accessHash
+	session.RefreshToken = db.hashToken(refreshToken)
+	session.RefreshExpiresAt = now.Add(refreshTokenLifetime).Unix()
+
+	db.Keys[accessHash] = session.Keyring
+	db.Expiries[accessHash] = now.Add(accessTokenLifetime).Unix()
+	if session.Binding != nil {
+		db.Bindings[accessHash] = session.Binding
+	}
+
+	session.tokens = &SessionTokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenLifetime.Seconds()),
+	}
+
+	return session.tokens, nil
+}
+
+// Takes the token's hash. Must be called with the lock held.
+func (db *Database) revokeAccessToken(tokenHash string) {
+	delete(db.Keys, tokenHash)
+	delete(db.Expiries, tokenHash)
+	delete(db.Bindings, tokenHash)
+}
+
+// Must be called with the lock held.
+func (db *Database) endSession(session *Session) {
+	db.revokeAccessToken(session.AccessToken)
+	delete(db.Sessions, session.Id)
+}
+
+func (db *Database) GetBinding(token string) *TokenBinding {
+	db.lockRead()
+	defer db.unlock()
+
+	return db.Bindings[db.hashToken(token)]
+}
+
+// Must be called with the lock held.
+func (db *Database) expireSessions() {
+	now := time.Now().Unix()
+
+	for _, session := range db.Sessions {
+		if session.RefreshExpiresAt < now {
+			db.endSession(session)
+		}
+	}
+
+	for token, expiresAt := range db.Expiries {
+		if expiresAt < now {
+			db.revokeAccessToken(token)
+		}
+	}
+}
+
+// Cookies are marked Secure when the request came over https, so they're
+// never sent in the clear afterwards.
+func setSessionCookies(w http.ResponseWriter, tokens *SessionTokens, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "access_token",
+		Value:    tokens.AccessToken,
+		Secure:   secure,
+		HttpOnly: true,
+		MaxAge:   int(accessTokenLifetime.Seconds()),
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    tokens.RefreshToken,
+		Secure:   secure,
+		HttpOnly: true,
+		MaxAge:   int(refreshTokenLifetime.Seconds()),
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{"access_token", "refresh_token"} {
+		http.SetCookie(w, &http.Cookie{
+			Name:   name,
+			MaxAge: -1,
+			Path:   "/",
+		})
+	}
+}
+
+// Browsers whose access cookie has expired are refreshed with their refresh
+// cookie, and the request carries on with the new access token.
+func (s *Server) refreshFromCookie(w http.ResponseWriter, r *http.Request) {
+	refreshCookie, err := r.Cookie("refresh_token")
+	if err != nil {
+		return
+	}
+
+	if r.URL.Query().Get("access_token") != "" || r.Header.Get("Authorization") != "" {
+		return
+	}
+
+	if accessCookie, err := r.Cookie("access_token"); err == nil {
+		if _, err := s.auth.getKeyring(accessCookie.Value); err == nil {
+			return
+		}
+	}
+
+	tokens, err := s.auth.db.RefreshSession(refreshCookie.Value, s.requestBinding(r))
+	if err == errTokenBinding {
+		// Still good back where it was bound
+		return
+	} else if err != nil {
+		clearSessionCookies(w)
+		return
+	}
+
+	setSessionCookies(w, tokens, s.isHttps(r))
+	r.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+}
+
+// Handles gemdrive/session/*
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request, sessionReq string) {
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	refreshToken := ""
+
+	bodyJson, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if len(bodyJson) > 0 {
+		var req refreshRequest
+		err = json.Unmarshal(bodyJson, &req)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid refresh request")
+			return
+		}
+		refreshToken = req.RefreshToken
+	}
+
+	if refreshToken == "" {
+		if cookie, err := r.Cookie("refresh_token"); err == nil {
+			refreshToken = cookie.Value
+		}
+	}
+
+	switch sessionReq {
+	case "refresh":
+		tokens, err := s.auth.db.RefreshSession(refreshToken, s.requestBinding(r))
+		if err == errInvalidRefreshToken {
+			s.lockouts.fail(s.ipLockoutKey(r), refreshToken)
+		}
+		if e, ok := err.(*Error); ok {
+			if err != errTokenBinding {
+				clearSessionCookies(w)
+			}
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		setSessionCookies(w, tokens, s.isHttps(r))
+
+		jsonBody, err := json.Marshal(tokens)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "logout":
+		clearSessionCookies(w)
+
+		err := s.auth.db.EndSession(refreshToken)
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		}
+	default:
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+	}
+}
@@ -0,0 +1,637 @@
+package gemdrive
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Shard backends spread one mount's files across several child backends, so
+// it can hold more than any one of them. Directories exist on whichever
+// children have something in them, and listings merge them all. Each file
+// lives whole on one child, picked by hashing its path onto a ring of the
+// children's names, skipping those without room for it.
+//
+// Where every file went is kept in a manifest in the data dir, next to the
+// tree it describes, ie DataDir/shards/<mount>/<dir>/gemdrive/placement.json.
+// Files stay where they were put when children are added, so existing
+// data never needs to move, and only new files are spread over the new
+// ones. Files found on a child without being in the manifest, like ones
+// there before it was added, are still served.
+
+// Points on the ring per unit of weight
+const shardRingPoints = 64
+
+type ShardBackendConfig struct {
+	Shards []*ShardConfig `json:"shards,omitempty"`
+}
+
+type ShardConfig struct {
+	// Identifies the shard in the manifest and places it on the ring, so it
+	// can't change once it holds files.
+	Name string `json:"name,omitempty"`
+	// Local directory holding the shard
+	Dir string `json:"dir,omitempty"`
+	// Or a program serving it, as for exec backends
+	Exec *ExecBackendConfig `json:"exec,omitempty"`
+	// Share of new files relative to the other shards. Defaults to 1.
+	Weight int `json:"weight,omitempty"`
+}
+
+type shard struct {
+	name    string
+	backend Backend
+}
+
+type shardRingPoint struct {
+	hash  uint64
+	shard int
+}
+
+type ShardBackend struct {
+	shards      []*shard
+	byName      map[string]*shard
+	ring        []shardRingPoint
+	manifestDir string
+	mut         *sync.Mutex
+}
+
+func NewShardBackend(config *ShardBackendConfig, manifestDir, cacheDir string) (*ShardBackend, error) {
+	if len(config.Shards) == 0 {
+		return nil, errors.New("Shard backends need shards")
+	}
+
+	b := &ShardBackend{
+		byName:      make(map[string]*shard),
+		manifestDir: manifestDir,
+		mut:         &sync.Mutex{},
+	}
+
+	for _, shardConfig := range config.Shards {
+		name := shardConfig.Name
+		if name == "" || strings.ContainsAny(name, "/\\") {
+			return nil, fmt.Errorf("Invalid shard name '%s'", name)
+		}
+		if _, exists := b.byName[name]; exists {
+			return nil, fmt.Errorf("Duplicate shard %s", name)
+		}
+
+		backend, err := shardConfig.backend(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+
+		s := &shard{
+			name:    name,
+			backend: backend,
+		}
+
+		weight := shardConfig.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		for i := 0; i < weight*shardRingPoints; i++ {
+			b.ring = append(b.ring, shardRingPoint{
+				hash:  shardHash(fmt.Sprintf("%s#%d", name, i)),
+				shard: len(b.shards),
+			})
+		}
+
+		b.shards = append(b.shards, s)
+		b.byName[name] = s
+	}
+
+	sort.Slice(b.ring, func(i, j int) bool {
+		return b.ring[i].hash < b.ring[j].hash
+	})
+
+	return b, nil
+}
+
+func (c *ShardConfig) backend(cacheDir string) (Backend, error) {
+	if c.Dir != "" {
+		return NewFileSystemBackend(c.Dir, filepath.Join(cacheDir, c.Name))
+	} else if c.Exec != nil {
+		return NewExecBackend(c.Exec)
+	}
+	return nil, fmt.Errorf("Shard %s needs a dir or exec", c.Name)
+}
+
+func shardHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// The shards in the order a new file at reqPath tries them.
+func (b *ShardBackend) ringOrder(reqPath string) []*shard {
+	hash := shardHash(reqPath)
+	start := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+
+	order := []*shard{}
+	seen := make(map[int]bool)
+	for i := 0; i < len(b.ring) && len(order) < len(b.shards); i++ {
+		point := b.ring[(start+i)%len(b.ring)]
+		if !seen[point.shard] {
+			seen[point.shard] = true
+			order = append(order, b.shards[point.shard])
+		}
+	}
+
+	return order
+}
+
+func (b *ShardBackend) placementPath(dirPath string) string {
+	return filepath.Join(b.manifestDir, dirPath, "gemdrive", "placement.json")
+}
+
+// Shard names of the files in a directory.
+func (b *ShardBackend) readPlacement(dirPath string) map[string]string {
+	placement := make(map[string]string)
+
+	placementJson, err := ioutil.ReadFile(b.placementPath(dirPath))
+	if err != nil {
+		return placement
+	}
+
+	err = json.Unmarshal(placementJson, &placement)
+	if err != nil {
+		fmt.Println("Ignoring invalid shard placement in", dirPath, err)
+		return make(map[string]string)
+	}
+
+	return placement
+}
+
+func (b *ShardBackend) writePlacement(dirPath string, placement map[string]string) error {
+	placementPath := b.placementPath(dirPath)
+
+	if len(placement) == 0 {
+		err := os.Remove(placementPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(placementPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return saveJson(placement, placementPath)
+}
+
+// Records which shard holds reqPath, or forgets it if s is nil.
+func (b *ShardBackend) place(reqPath string, s *shard) error {
+	dirPath, name := splitItemPath(reqPath)
+
+	placement := b.readPlacement(dirPath)
+	if s == nil {
+		if _, exists := placement[name]; !exists {
+			return nil
+		}
+		delete(placement, name)
+	} else {
+		if placement[name] == s.name {
+			return nil
+		}
+		placement[name] = s.name
+	}
+
+	return b.writePlacement(dirPath, placement)
+}
+
+// The shard holding the file at reqPath, or nil if none does.
+func (b *ShardBackend) locate(reqPath string) *shard {
+	dirPath, name := splitItemPath(reqPath)
+
+	if s, exists := b.byName[b.readPlacement(dirPath)[name]]; exists {
+		return s
+	}
+
+	for _, s := range b.ringOrder(reqPath) {
+		_, data, err := s.backend.Read(reqPath, 0, 1)
+		if err == nil {
+			data.Close()
+			return s
+		}
+	}
+
+	return nil
+}
+
+// The shards which have the directory at dirPath.
+func (b *ShardBackend) dirShards(dirPath string) ([]*shard, error) {
+	shards := []*shard{}
+	for _, s := range b.shards {
+		_, err := s.backend.List(dirPath, 1)
+		if err == nil {
+			shards = append(shards, s)
+		} else if !isNotFound(err) {
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+func (b *ShardBackend) List(reqPath string, depth int) (*Item, error) {
+	items := make(map[string]*Item)
+
+	for _, s := range b.shards {
+		item, err := s.backend.List(reqPath, depth)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		items[s.name] = item
+	}
+
+	if len(items) == 0 {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	return b.mergeItems(strings.TrimSuffix(reqPath, "/")+"/", items), nil
+}
+
+// Merges the listings of a directory from each shard, by shard name. Files
+// found on more than one are taken from the shard the manifest says holds
+// them.
+func (b *ShardBackend) mergeItems(dirPath string, items map[string]*Item) *Item {
+	merged := &Item{}
+
+	placement := b.readPlacement(dirPath)
+	subdirs := make(map[string]map[string]*Item)
+
+	for _, s := range b.shards {
+		item, exists := items[s.name]
+		if !exists {
+			continue
+		}
+
+		merged.Size += item.Size
+		if item.ModTime > merged.ModTime {
+			merged.ModTime = item.ModTime
+		}
+
+		if item.Children == nil {
+			continue
+		}
+		if merged.Children == nil {
+			merged.Children = make(map[string]*Item)
+		}
+
+		for name, child := range item.Children {
+			if strings.HasSuffix(name, "/") {
+				if subdirs[name] == nil {
+					subdirs[name] = make(map[string]*Item)
+				}
+				subdirs[name][s.name] = child
+				continue
+			}
+
+			if _, exists := merged.Children[name]; exists && placement[name] != s.name {
+				continue
+			}
+			merged.Children[name] = child
+		}
+	}
+
+	for name, subdirItems := range subdirs {
+		merged.Children[name] = b.mergeItems(dirPath+name, subdirItems)
+	}
+
+	return merged
+}
+
+func (b *ShardBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	s := b.locate(reqPath)
+	if s == nil {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	return s.backend.Read(reqPath, offset, length)
+}
+
+func writableShard(s *shard) (WritableBackend, error) {
+	backend, ok := s.backend.(WritableBackend)
+	if !ok {
+		return nil, &Error{
+			HttpCode: 403,
+			Message:  "Shard " + s.name + " is read-only",
+		}
+	}
+	return backend, nil
+}
+
+// Directories are made on the shard a file at the same path would go to,
+// and on others as files are put in them.
+func (b *ShardBackend) MakeDir(reqPath string, recursive bool) error {
+	dirPath := strings.TrimSuffix(reqPath, "/") + "/"
+
+	shards, err := b.dirShards(dirPath)
+	if err != nil {
+		return err
+	}
+	if len(shards) != 0 {
+		if recursive {
+			return nil
+		}
+		return errors.New("Directory exists")
+	}
+
+	if !recursive {
+		parent, _ := splitItemPath(dirPath)
+		parentShards, err := b.dirShards(parent)
+		if err != nil {
+			return err
+		}
+		if len(parentShards) == 0 {
+			return &Error{
+				HttpCode: 404,
+				Message:  "Parent directory not found",
+			}
+		}
+	}
+
+	backend, err := writableShard(b.ringOrder(dirPath)[0])
+	if err != nil {
+		return err
+	}
+
+	return backend.MakeDir(dirPath, true)
+}
+
+func (b *ShardBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
+	b.mut.Lock()
+	s := b.locate(reqPath)
+	if s == nil {
+		var err error
+		s, err = b.pickShard(reqPath, offset+length)
+		if err != nil {
+			b.mut.Unlock()
+			return err
+		}
+
+		err = b.place(reqPath, s)
+		if err != nil {
+			b.mut.Unlock()
+			return err
+		}
+	}
+	b.mut.Unlock()
+
+	backend, err := writableShard(s)
+	if err != nil {
+		return err
+	}
+
+	dirPath, _ := splitItemPath(reqPath)
+	err = backend.MakeDir(dirPath, true)
+	if err != nil {
+		return err
+	}
+
+	return backend.Write(reqPath, data, offset, length, overwrite, truncate)
+}
+
+// The first shard on the ring for a new file with room for size bytes, in
+// a directory which already exists.
+func (b *ShardBackend) pickShard(reqPath string, size int64) (*shard, error) {
+	dirPath, _ := splitItemPath(reqPath)
+	parentShards, err := b.dirShards(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(parentShards) == 0 {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Parent directory not found",
+		}
+	}
+
+	for _, s := range b.ringOrder(reqPath) {
+		if _, ok := s.backend.(WritableBackend); !ok {
+			continue
+		}
+
+		if reporter, ok := s.backend.(SpaceReporter); ok {
+			free, err := reporter.FreeSpace(reqPath)
+			if err == nil && free < size {
+				continue
+			}
+		}
+
+		return s, nil
+	}
+
+	return nil, errInsufficientStorage
+}
+
+func (b *ShardBackend) Delete(reqPath string, recursive bool) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	if !strings.HasSuffix(reqPath, "/") {
+		s := b.locate(reqPath)
+		if s == nil {
+			return &Error{
+				HttpCode: 404,
+				Message:  "Not found",
+			}
+		}
+
+		backend, err := writableShard(s)
+		if err != nil {
+			return err
+		}
+
+		err = backend.Delete(reqPath, recursive)
+		if err != nil {
+			return err
+		}
+
+		return b.place(reqPath, nil)
+	}
+
+	shards, err := b.dirShards(reqPath)
+	if err != nil {
+		return err
+	}
+	if len(shards) == 0 {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if !recursive {
+		item, err := b.List(reqPath, 1)
+		if err != nil {
+			return err
+		}
+		if len(item.Children) != 0 {
+			return errors.New("Directory not empty")
+		}
+	}
+
+	for _, s := range shards {
+		backend, err := writableShard(s)
+		if err != nil {
+			return err
+		}
+
+		err = backend.Delete(reqPath, true)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+
+	return os.RemoveAll(filepath.Join(b.manifestDir, reqPath))
+}
+
+// Files and directories are moved within each shard that has them, so
+// nothing is copied between shards and placement doesn't change.
+func (b *ShardBackend) Move(srcPath, dstPath string) error {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	srcIsDir := strings.HasSuffix(srcPath, "/")
+	srcPath = strings.TrimSuffix(srcPath, "/")
+	dstPath = strings.TrimSuffix(dstPath, "/")
+
+	var shards []*shard
+	if srcIsDir {
+		var err error
+		shards, err = b.dirShards(srcPath + "/")
+		if err != nil {
+			return err
+		}
+	} else if s := b.locate(srcPath); s != nil {
+		shards = []*shard{s}
+	}
+
+	if len(shards) == 0 {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	_, err := b.List(dstPath+"/", 1)
+	if err == nil || b.locate(dstPath) != nil {
+		return &Error{
+			HttpCode: 409,
+			Message:  "Destination exists",
+		}
+	}
+
+	dstDir, _ := splitItemPath(dstPath)
+	dstDirShards, err := b.dirShards(dstDir)
+	if err != nil {
+		return err
+	}
+	if len(dstDirShards) == 0 {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Destination directory not found",
+		}
+	}
+
+	for _, s := range shards {
+		backend, ok := s.backend.(MovableBackend)
+		if !ok {
+			return errors.New("Shard " + s.name + " does not support moving")
+		}
+
+		if writable, ok := s.backend.(WritableBackend); ok {
+			err := writable.MakeDir(dstDir, true)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := backend.Move(srcPath, dstPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if srcIsDir {
+		srcManifest := filepath.Join(b.manifestDir, srcPath)
+		dstManifest := filepath.Join(b.manifestDir, dstPath)
+		if _, err := os.Stat(srcManifest); err == nil {
+			err := os.MkdirAll(filepath.Dir(dstManifest), 0755)
+			if err != nil {
+				return err
+			}
+			return os.Rename(srcManifest, dstManifest)
+		}
+		return nil
+	}
+
+	err = b.place(srcPath, nil)
+	if err != nil {
+		return err
+	}
+	return b.place(dstPath, shards[0])
+}
+
+// The most any one file can still take, since files aren't split across
+// shards.
+func (b *ShardBackend) FreeSpace(reqPath string) (int64, error) {
+	var most int64 = -1
+	for _, s := range b.shards {
+		reporter, ok := s.backend.(SpaceReporter)
+		if !ok {
+			continue
+		}
+
+		free, err := reporter.FreeSpace(reqPath)
+		if err != nil {
+			continue
+		}
+		if free > most {
+			most = free
+		}
+	}
+
+	if most < 0 {
+		return 0, errors.New("Shards do not report free space")
+	}
+
+	return most, nil
+}
+
+func (b *ShardBackend) LocalDirs() ([]string, []string) {
+	return shardLocalDirs(b.shards)
+}
+
+func shardLocalDirs(shards []*shard) ([]string, []string) {
+	writeDirs, readDirs := []string{}, []string{}
+	for _, s := range shards {
+		write, read := localDirs(s.backend)
+		writeDirs = append(writeDirs, write...)
+		readDirs = append(readDirs, read...)
+	}
+	return writeDirs, readDirs
+}
@@ -0,0 +1,157 @@
+package gemdrive
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"regexp"
+)
+
+// Shares can have a slug, a name chosen by their creator like
+// "team-photos", and a short code picked at random, so links to them can
+// be friendlier than a share ID. Both are unique across the server. They
+// don't replace the link's token, which is still needed to use it, but
+// client UIs can turn one into the share's path with
+// gemdrive/shares/lookup/<slug>, ie for links like /s/team-photos with the
+// token alongside.
+
+var shareSlugRegex = regexp.MustCompile("^[a-z0-9][a-z0-9-]{2,63}$")
+
+// Without lookalikes like l and 1
+const shortCodeChars = "abcdefghijkmnpqrstuvwxyz23456789"
+
+const shortCodeLength = 8
+
+type ShareLookup struct {
+	Id   string `json:"id"`
+	Path string `json:"path"`
+	Perm string `json:"perm"`
+}
+
+var errSlugTaken = &Error{
+	HttpCode: 409,
+	Message:  "Slug already taken",
+}
+
+func genShortCode() (string, error) {
+	code := ""
+	for i := 0; i < shortCodeLength; i++ {
+		randIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(shortCodeChars))))
+		if err != nil {
+			return "", err
+		}
+		code += string(shortCodeChars[randIndex.Int64()])
+	}
+	return code, nil
+}
+
+// Must be called with the lock held.
+func (db *Database) aliasTaken(alias string) bool {
+	for _, share := range db.Shares {
+		if share.Slug == alias || share.ShortCode == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// Gives a share its slug, if any, and a short code if asked for, returning
+// the code.
+func (db *Database) SetShareAliases(id, slug string, shortCode bool) (string, error) {
+	db.lock()
+	defer db.unlock()
+
+	share, exists := db.Shares[id]
+	if !exists {
+		return "", &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if slug != "" && db.aliasTaken(slug) {
+		return "", errSlugTaken
+	}
+
+	code := ""
+	for shortCode && code == "" {
+		candidate, err := genShortCode()
+		if err != nil {
+			return "", err
+		}
+		if candidate != slug && !db.aliasTaken(candidate) {
+			code = candidate
+		}
+	}
+
+	share.Slug = slug
+	share.ShortCode = code
+
+	db.persist()
+
+	return code, nil
+}
+
+func (db *Database) GetShareBySlug(slug string) (*Share, error) {
+	db.lockRead()
+	defer db.unlock()
+
+	for _, share := range db.Shares {
+		if share.Slug == slug || share.ShortCode == slug {
+			return share, nil
+		}
+	}
+
+	return nil, &Error{
+		HttpCode: 404,
+		Message:  "Not found",
+	}
+}
+
+// Handles gemdrive/shares/lookup/<slug>. Only the share's own link and
+// those who can already see its path can look it up, so slugs don't give
+// away what's shared.
+func (s *Server) serveShareLookup(w http.ResponseWriter, r *http.Request, token, slug string) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+
+	share, err := s.auth.db.GetShareBySlug(slug)
+	if err == nil {
+		// Links act as their creator, so they only count as owning themselves
+		var allowed bool
+		if linkShare, linkErr := s.auth.db.GetShareByToken(token); linkErr == nil {
+			allowed = linkShare.Id == share.Id
+		} else {
+			allowed = s.auth.ownsShare(token, share)
+		}
+		if !allowed && !s.auth.CanRead(token, share.Path) && !s.auth.CanList(token, share.Path) {
+			err = &Error{
+				HttpCode: 404,
+				Message:  "Not found",
+			}
+		}
+	}
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	}
+
+	jsonBody, err := json.Marshal(&ShareLookup{
+		Id:   share.Id,
+		Path: share.Path,
+		Perm: share.Perm,
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
@@ -0,0 +1,237 @@
+package gemdrive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests made with each share link are counted, along with the bytes
+// served and who made them, so whoever created a link can see at
+// gemdrive/shares/<id>/stats whether it was used. Clients are told apart by
+// IP, and have a country when the trusted proxies in front of GemDrive send
+// one in geoHeader, ie CF-IPCountry. Stats are saved in the data dir every
+// minute, and dropped along with their share.
+
+// Most recent clients kept for each share
+const maxShareClients = 50
+
+const shareStatsSaveInterval = time.Minute
+
+type ShareStats struct {
+	Requests    int64  `json:"requests"`
+	Bytes       int64  `json:"bytes"`
+	FirstAccess string `json:"firstAccess,omitempty"`
+	LastAccess  string `json:"lastAccess,omitempty"`
+	// Most recent first
+	Clients []*ShareClient `json:"clients"`
+}
+
+type ShareClient struct {
+	Ip         string `json:"ip"`
+	Country    string `json:"country,omitempty"`
+	Requests   int64  `json:"requests"`
+	Bytes      int64  `json:"bytes"`
+	LastAccess string `json:"lastAccess"`
+}
+
+type shareStatsStore struct {
+	path  string
+	stats map[string]*ShareStats
+	dirty bool
+	mut   *sync.Mutex
+}
+
+func newShareStatsStore(statsPath string) *shareStatsStore {
+	store := &shareStatsStore{
+		path:  statsPath,
+		stats: make(map[string]*ShareStats),
+		mut:   &sync.Mutex{},
+	}
+
+	statsJson, err := ioutil.ReadFile(store.path)
+	if err == nil {
+		var stats map[string]*ShareStats
+		err = json.Unmarshal(statsJson, &stats)
+		if err != nil || stats == nil {
+			fmt.Println("Ignoring invalid share stats:", err)
+		} else {
+			store.stats = stats
+		}
+	}
+
+	return store
+}
+
+func (s *shareStatsStore) record(shareId, ip, country string, bytes int64) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	stats, exists := s.stats[shareId]
+	if !exists {
+		stats = &ShareStats{
+			FirstAccess: now,
+			Clients:     []*ShareClient{},
+		}
+		s.stats[shareId] = stats
+	}
+
+	stats.Requests++
+	stats.Bytes += bytes
+	stats.LastAccess = now
+
+	var client *ShareClient
+	for i, c := range stats.Clients {
+		if c.Ip == ip {
+			client = c
+			stats.Clients = append(stats.Clients[:i], stats.Clients[i+1:]...)
+			break
+		}
+	}
+	if client == nil {
+		client = &ShareClient{Ip: ip}
+	}
+
+	client.Requests++
+	client.Bytes += bytes
+	client.LastAccess = now
+	if country != "" {
+		client.Country = country
+	}
+
+	stats.Clients = append([]*ShareClient{client}, stats.Clients...)
+	if len(stats.Clients) > maxShareClients {
+		stats.Clients = stats.Clients[:maxShareClients]
+	}
+
+	s.dirty = true
+}
+
+// Returns a copy of the share's stats, which are empty if it hasn't been
+// used.
+func (s *shareStatsStore) get(shareId string) *ShareStats {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	stats, exists := s.stats[shareId]
+	if !exists {
+		return &ShareStats{Clients: []*ShareClient{}}
+	}
+
+	copied := *stats
+	copied.Clients = []*ShareClient{}
+	for _, client := range stats.Clients {
+		c := *client
+		copied.Clients = append(copied.Clients, &c)
+	}
+
+	return &copied
+}
+
+func (s *shareStatsStore) remove(shareId string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if _, exists := s.stats[shareId]; exists {
+		delete(s.stats, shareId)
+		s.dirty = true
+	}
+}
+
+// Saves the stats periodically until ctx is done.
+func (s *shareStatsStore) run(ctx context.Context) {
+	ticker := time.NewTicker(shareStatsSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.save()
+		case <-ctx.Done():
+			s.save()
+			return
+		}
+	}
+}
+
+func (s *shareStatsStore) save() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if !s.dirty {
+		return
+	}
+
+	err := saveJson(s.stats, s.path)
+	if err != nil {
+		fmt.Println("Failed to save share stats:", err)
+		return
+	}
+
+	s.dirty = false
+}
+
+// Records a request made with a share link once it's done.
+func (s *Server) recordShareAccess(r *http.Request, token string, w *countingWriter) {
+	if token == "" {
+		return
+	}
+
+	share, err := s.auth.db.GetShareByToken(token)
+	if err != nil {
+		return
+	}
+
+	country := ""
+	if s.config.GeoHeader != "" && s.fromTrustedProxy(r) {
+		country = strings.ToUpper(strings.TrimSpace(r.Header.Get(s.config.GeoHeader)))
+	}
+
+	ip := ""
+	if clientIp := s.clientIp(r); clientIp != nil {
+		ip = clientIp.String()
+	}
+
+	s.shareStats.record(share.Id, ip, country, w.written)
+}
+
+// Handles gemdrive/shares/<id>/stats
+func (s *Server) serveShareStats(w http.ResponseWriter, r *http.Request, token, id string) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+
+	// Share links act as their creator, but the stats are only for the
+	// creator to see
+	if _, err := s.auth.db.GetShareByToken(token); err == nil {
+		w.WriteHeader(403)
+		io.WriteString(w, "Forbidden")
+		return
+	}
+
+	share, err := s.auth.db.GetShare(id)
+	if err != nil || !s.auth.ownsShare(token, share) {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	jsonBody, err := json.Marshal(s.shareStats.get(id))
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
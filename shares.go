@@ -0,0 +1,341 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A share is a token derived from its creator's keyring, narrowed to a
+// single path and permission. Since it acts as the creator, the normal ACL
+// checks still apply, and it can be revoked without affecting the creator's
+// own tokens.
+
+type Share struct {
+	Id        string   `json:"id"`
+	Token     string   `json:"token,omitempty"`
+	Path      string   `json:"path"`
+	Perm      string   `json:"perm"`
+	Owners    []string `json:"owners"`
+	CreatedAt string   `json:"createdAt"`
+	// Only set for drop shares
+	Drop      *DropOptions `json:"drop,omitempty"`
+	Slug      string       `json:"slug,omitempty"`
+	ShortCode string       `json:"shortCode,omitempty"`
+}
+
+type shareRequest struct {
+	Path string       `json:"path"`
+	Perm string       `json:"perm"`
+	Drop *DropOptions `json:"drop,omitempty"`
+	// Lowercase letters, digits and dashes
+	Slug string `json:"slug,omitempty"`
+	// Give the share a short random code too
+	ShortCode bool `json:"shortCode,omitempty"`
+}
+
+func (db *Database) AddShare(token string, share *Share, keyring []*Key) {
+	db.lock()
+	defer db.unlock()
+
+	tokenHash := db.hashToken(token)
+
+	stored := *share
+	stored.Token = tokenHash
+
+	db.Keys[tokenHash] = keyring
+	db.Shares[share.Id] = &stored
+	share.Token = token
+
+	db.persist()
+}
+
+func (db *Database) GetShares() []*Share {
+	db.lockRead()
+	defer db.unlock()
+
+	shares := []*Share{}
+	for _, share := range db.Shares {
+		shares = append(shares, share)
+	}
+
+	return shares
+}
+
+func (db *Database) GetShare(id string) (*Share, error) {
+	db.lockRead()
+	defer db.unlock()
+
+	share, exists := db.Shares[id]
+	if !exists {
+		return nil, errors.New("Does not exist")
+	}
+
+	return share, nil
+}
+
+func (db *Database) GetShareByToken(token string) (*Share, error) {
+	db.lockRead()
+	defer db.unlock()
+
+	tokenHash := db.hashToken(token)
+
+	for _, share := range db.Shares {
+		if share.Token == tokenHash {
+			return share, nil
+		}
+	}
+
+	return nil, errors.New("Does not exist")
+}
+
+func (db *Database) DeleteShare(id string) error {
+	db.lock()
+	defer db.unlock()
+
+	share, exists := db.Shares[id]
+	if !exists {
+		return errors.New("Does not exist")
+	}
+
+	delete(db.Keys, share.Token)
+	delete(db.Shares, id)
+
+	db.persist()
+
+	return nil
+}
+
+func (a *Auth) CreateShare(token, pathStr, perm string) (*Share, error) {
+	if perm == "" {
+		perm = "read"
+	}
+
+	if !validPerm(perm) || permAllows(perm, actAdmin) {
+		return nil, errors.New("Invalid perm")
+	}
+
+	return a.createShare(token, pathStr, perm, permActionList(perm), nil)
+}
+
+// Shares can't grant anything their creator can't do, and creating one
+// takes share permission, so people can't spread access they were only
+// given for themselves.
+func (a *Auth) createShare(token, pathStr, perm string, actions []string, drop *DropOptions) (*Share, error) {
+
+	forbidden := &Error{
+		HttpCode: 403,
+		Message:  "Forbidden",
+	}
+
+	if !a.CanShare(token, pathStr) {
+		return nil, forbidden
+	}
+
+	for _, action := range actions {
+		if !a.Can(token, pathStr, action) {
+			return nil, forbidden
+		}
+	}
+
+	keyring, err := a.getKeyring(token)
+	if err != nil {
+		return nil, err
+	}
+
+	shareKeyring := []*Key{}
+	for _, key := range keyring {
+		if key.Allows(pathStr, actShare) {
+			shareKeyring = append(shareKeyring, &Key{
+				IdType: key.IdType,
+				Id:     key.Id,
+				Perm:   perm,
+				Path:   pathStr,
+			})
+		}
+	}
+
+	shareToken, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := genRandomKey()
+	if err != nil {
+		return nil, err
+	}
+
+	share := &Share{
+		Id:        id[:12],
+		Path:      pathStr,
+		Perm:      perm,
+		Owners:    a.Principals(token),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Drop:      drop,
+	}
+
+	a.db.AddShare(shareToken, share, shareKeyring)
+
+	return share, nil
+}
+
+// Returns the shares created by any of the identities holding token.
+func (a *Auth) GetShares(token string) []*Share {
+	shares := []*Share{}
+
+	// Only hashes of the tokens are kept, so links can't be listed again
+	for _, share := range a.db.GetShares() {
+		if a.ownsShare(token, share) {
+			redacted := *share
+			redacted.Token = ""
+			shares = append(shares, &redacted)
+		}
+	}
+
+	return shares
+}
+
+func (a *Auth) DeleteShare(token, id string) error {
+	share, err := a.db.GetShare(id)
+	if err != nil || !a.ownsShare(token, share) {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	return a.db.DeleteShare(id)
+}
+
+func (a *Auth) ownsShare(token string, share *Share) bool {
+	for _, principal := range a.Principals(token) {
+		for _, owner := range share.Owners {
+			if principal == owner {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handles gemdrive/shares[/<id>[/stats]] and gemdrive/shares/lookup/<slug>
+func (s *Server) handleShares(w http.ResponseWriter, r *http.Request, id string) {
+
+	token, _ := extractToken(r)
+
+	if len(s.auth.Principals(token)) == 0 {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	if strings.HasPrefix(id, "lookup/") {
+		s.serveShareLookup(w, r, token, strings.TrimPrefix(id, "lookup/"))
+		return
+	}
+
+	if strings.HasSuffix(id, "/stats") {
+		s.serveShareStats(w, r, token, strings.TrimSuffix(id, "/stats"))
+		return
+	}
+
+	// Links act as their creator, but only the creator can list, make or
+	// revoke their shares
+	if _, err := s.auth.db.GetShareByToken(token); err == nil {
+		w.WriteHeader(403)
+		io.WriteString(w, "Forbidden")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		jsonBody, err := json.Marshal(s.auth.GetShares(token))
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "POST":
+		bodyJson, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		var req shareRequest
+		err = json.Unmarshal(bodyJson, &req)
+		if err != nil || !strings.HasPrefix(req.Path, "/") {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid share request")
+			return
+		}
+
+		if req.Slug != "" && !shareSlugRegex.MatchString(req.Slug) {
+			w.WriteHeader(400)
+			io.WriteString(w, "Slugs must be 3 to 64 lowercase letters, digits and dashes")
+			return
+		}
+
+		var share *Share
+		if req.Perm == "drop" {
+			share, err = s.auth.CreateDropShare(token, req.Path, req.Drop)
+		} else {
+			share, err = s.auth.CreateShare(token, req.Path, req.Perm)
+		}
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		} else if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if req.Slug != "" || req.ShortCode {
+			share.ShortCode, err = s.auth.db.SetShareAliases(share.Id, req.Slug, req.ShortCode)
+			if err != nil {
+				s.auth.db.DeleteShare(share.Id)
+			}
+			if e, ok := err.(*Error); ok {
+				w.WriteHeader(e.HttpCode)
+				io.WriteString(w, e.Message)
+				return
+			} else if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+			share.Slug = req.Slug
+		}
+
+		jsonBody, err := json.Marshal(share)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "DELETE":
+		err := s.auth.DeleteShare(token, id)
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		s.shareStats.remove(id)
+	default:
+		w.WriteHeader(405)
+	}
+}
@@ -0,0 +1,593 @@
+package gemdrive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Publishing a directory, with a POST to <dir>/gemdrive/publish, freezes a
+// copy of everything in it as a snapshot. Snapshots are named by the hash
+// of their contents and can be read by anyone at gemdrive/snapshots/<id>/,
+// so a link to one always gets exactly what was published, even if the
+// directory changes or goes away. The manifest of files and their SHA-256
+// checksums is at gemdrive/snapshots/<id>, and the snapshot can have a
+// generated index page listing them, ie for dataset releases. Snapshots
+// published with sidecars also serve <file>.sha256 and <file>.meta4 for
+// each file, for sha256sum and download managers.
+//
+// File contents are kept once each in the data dir, however many snapshots
+// include them. Whoever published a snapshot, or an admin, can DELETE it.
+
+type Snapshot struct {
+	Id        string          `json:"id"`
+	Path      string          `json:"path"`
+	Owners    []string        `json:"owners"`
+	CreatedAt string          `json:"createdAt"`
+	Index     bool            `json:"index,omitempty"`
+	Sidecars  bool            `json:"sidecars,omitempty"`
+	Size      int64           `json:"size"`
+	Files     []*SnapshotFile `json:"files,omitempty"`
+}
+
+type SnapshotFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type publishRequest struct {
+	// Serve a generated index page at the snapshot's root
+	Index bool `json:"index,omitempty"`
+	// Serve .sha256 and .meta4 files alongside each file
+	Sidecars bool `json:"sidecars,omitempty"`
+}
+
+var snapshotIdRegex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type snapshotStore struct {
+	dir string
+	mut *sync.Mutex
+}
+
+func newSnapshotStore(dataDir string) *snapshotStore {
+	return &snapshotStore{
+		dir: filepath.Join(dataDir, "snapshots"),
+		mut: &sync.Mutex{},
+	}
+}
+
+func (ss *snapshotStore) manifestPath(id string) string {
+	return filepath.Join(ss.dir, id+".json")
+}
+
+func (ss *snapshotStore) blobPath(sha string) string {
+	return filepath.Join(ss.dir, "blobs", sha)
+}
+
+func (ss *snapshotStore) get(id string) (*Snapshot, error) {
+	if !snapshotIdRegex.MatchString(id) {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "No such snapshot",
+		}
+	}
+
+	manifestJson, err := ioutil.ReadFile(ss.manifestPath(id))
+	if os.IsNotExist(err) {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "No such snapshot",
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snapshot *Snapshot
+	err = json.Unmarshal(manifestJson, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+func (ss *snapshotStore) list() ([]*Snapshot, error) {
+	entries, err := ioutil.ReadDir(ss.dir)
+	if os.IsNotExist(err) {
+		return []*Snapshot{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshots := []*Snapshot{}
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if !snapshotIdRegex.MatchString(id) {
+			continue
+		}
+
+		snapshot, err := ss.get(id)
+		if err != nil {
+			fmt.Println("Skipping snapshot", id, err)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt < snapshots[j].CreatedAt
+	})
+
+	return snapshots, nil
+}
+
+// Copies in a file's contents, returning their hash.
+func (ss *snapshotStore) storeBlob(data io.Reader) (string, int64, error) {
+	blobDir := filepath.Join(ss.dir, "blobs")
+
+	err := os.MkdirAll(blobDir, 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tmpFile, err := ioutil.TempFile(blobDir, "publishing-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, hash), data)
+	tmpFile.Close()
+	if err != nil {
+		return "", 0, err
+	}
+
+	sha := hex.EncodeToString(hash.Sum(nil))
+
+	if _, err := os.Stat(ss.blobPath(sha)); err == nil {
+		return sha, size, nil
+	}
+
+	return sha, size, os.Rename(tmpFile.Name(), ss.blobPath(sha))
+}
+
+// Fails if canRead denies any file, rather than publishing the directory
+// without it.
+func (ss *snapshotStore) publish(backend Backend, dirPath string, owners []string, req *publishRequest, canRead func(string) bool) (*Snapshot, error) {
+	listing, err := backend.List(dirPath, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+
+	files := []*SnapshotFile{}
+	var size int64
+
+	var walk func(item *Item, relPath string) error
+	walk = func(item *Item, relPath string) error {
+		for name, child := range item.Children {
+			childPath := relPath + name
+
+			if strings.HasSuffix(name, "/") {
+				err := walk(child, childPath)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			if !canRead(dirPath + childPath) {
+				return &Error{
+					HttpCode: 403,
+					Message:  "Not allowed to publish " + dirPath + childPath,
+				}
+			}
+
+			_, data, err := backend.Read(dirPath+childPath, 0, 0)
+			if err != nil {
+				return err
+			}
+
+			sha, fileSize, err := ss.storeBlob(data)
+			data.Close()
+			if err != nil {
+				return err
+			}
+
+			files = append(files, &SnapshotFile{
+				Path:   childPath,
+				Size:   fileSize,
+				Sha256: sha,
+			})
+			size += fileSize
+		}
+		return nil
+	}
+
+	err = walk(listing, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	filesJson, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+	idHash := sha256.Sum256(filesJson)
+	id := hex.EncodeToString(idHash[:])
+
+	// Publishing the same contents again gives the same snapshot
+	if existing, err := ss.get(id); err == nil {
+		for _, owner := range owners {
+			if !containsString(existing.Owners, owner) {
+				existing.Owners = append(existing.Owners, owner)
+			}
+		}
+		existing.Index = existing.Index || req.Index
+		existing.Sidecars = existing.Sidecars || req.Sidecars
+
+		return existing, saveJson(existing, ss.manifestPath(id))
+	}
+
+	snapshot := &Snapshot{
+		Id:        id,
+		Path:      dirPath,
+		Owners:    owners,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Index:     req.Index,
+		Sidecars:  req.Sidecars,
+		Size:      size,
+		Files:     files,
+	}
+
+	return snapshot, saveJson(snapshot, ss.manifestPath(id))
+}
+
+// Removes the snapshot, along with any contents no other snapshot shares.
+func (ss *snapshotStore) remove(id string) error {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+
+	err := os.Remove(ss.manifestPath(id))
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := ss.list()
+	if err != nil {
+		return err
+	}
+
+	referenced := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		for _, file := range snapshot.Files {
+			referenced[file.Sha256] = true
+		}
+	}
+
+	blobs, err := ioutil.ReadDir(filepath.Join(ss.dir, "blobs"))
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+		if !referenced[blob.Name()] && snapshotIdRegex.MatchString(blob.Name()) {
+			os.Remove(ss.blobPath(blob.Name()))
+		}
+	}
+
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles <dir>/gemdrive/publish
+func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, dirPath string) {
+
+	token, _ := extractToken(r)
+
+	// Snapshots are public, so publishing is sharing
+	if !s.auth.CanShare(token, dirPath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+
+	var req publishRequest
+	bodyJson, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+	if len(bodyJson) > 0 {
+		err = json.Unmarshal(bodyJson, &req)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+
+	canRead := func(filePath string) bool {
+		return s.auth.CanRead(token, filePath) && canReadRaw(s.config.Exports, s.auth, token, filePath)
+	}
+
+	snapshot, err := s.snapshots.publish(s.requestBackend(r), dirPath, s.auth.Principals(token), &req, canRead)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	fmt.Println("Published", dirPath, "as snapshot", snapshot.Id)
+
+	jsonBody, err := json.Marshal(snapshot)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/gemdrive/snapshots/"+snapshot.Id+"/")
+	w.WriteHeader(201)
+	w.Write(jsonBody)
+}
+
+// Handles gemdrive/snapshots[/<id>[/<path>]]
+func (s *Server) handleSnapshots(w http.ResponseWriter, r *http.Request, snapshotReq string) {
+
+	token, _ := extractToken(r)
+
+	if snapshotReq == "" {
+		if r.Method != "GET" {
+			w.WriteHeader(405)
+			return
+		}
+
+		snapshots, err := s.snapshots.list()
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		isAdmin := s.auth.CanOwn(token, "/")
+		principals := s.auth.Principals(token)
+
+		owned := []*Snapshot{}
+		for _, snapshot := range snapshots {
+			if isAdmin || sharesAny(snapshot.Owners, principals) {
+				snapshot.Files = nil
+				owned = append(owned, snapshot)
+			}
+		}
+
+		jsonBody, err := json.Marshal(owned)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+		return
+	}
+
+	parts := strings.SplitN(snapshotReq, "/", 2)
+
+	snapshot, err := s.snapshots.get(parts[0])
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case "GET":
+			jsonBody, err := json.Marshal(snapshot)
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonBody)
+		case "DELETE":
+			if !s.auth.CanOwn(token, "/") && !sharesAny(snapshot.Owners, s.auth.Principals(token)) {
+				s.sendLoginPage(w, r)
+				return
+			}
+
+			err := s.snapshots.remove(snapshot.Id)
+			if err != nil {
+				w.WriteHeader(500)
+				io.WriteString(w, err.Error())
+				return
+			}
+		default:
+			w.WriteHeader(405)
+		}
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(405)
+		return
+	}
+
+	filePath := parts[1]
+
+	if filePath == "" {
+		if !snapshot.Index {
+			w.WriteHeader(404)
+			io.WriteString(w, "Snapshot has no index page")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := snapshotIndexTemplate.Execute(w, snapshot)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	var file *SnapshotFile
+	for _, f := range snapshot.Files {
+		if f.Path == filePath {
+			file = f
+			break
+		}
+	}
+
+	if file == nil && snapshot.Sidecars {
+		if s.serveSnapshotSidecar(w, r, snapshot, filePath) {
+			return
+		}
+	}
+
+	if file == nil {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	blob, err := os.Open(s.snapshots.blobPath(file.Sha256))
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+	defer blob.Close()
+
+	createdAt, _ := time.Parse(time.RFC3339, snapshot.CreatedAt)
+
+	header := w.Header()
+	header.Set("ETag", fmt.Sprintf("\"%s\"", file.Sha256))
+	header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	header.Set("X-Checksum-SHA256", file.Sha256)
+
+	http.ServeContent(w, r, path.Base(file.Path), createdAt, blob)
+}
+
+// Serves <file>.sha256 or <file>.meta4, returning false if filePath isn't
+// the sidecar of a file in the snapshot.
+func (s *Server) serveSnapshotSidecar(w http.ResponseWriter, r *http.Request, snapshot *Snapshot, filePath string) bool {
+	ext := path.Ext(filePath)
+	if ext != ".sha256" && ext != ".meta4" {
+		return false
+	}
+
+	var file *SnapshotFile
+	for _, f := range snapshot.Files {
+		if f.Path == strings.TrimSuffix(filePath, ext) {
+			file = f
+			break
+		}
+	}
+	if file == nil {
+		return false
+	}
+
+	name := path.Base(file.Path)
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	if ext == ".sha256" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		// The format sha256sum -c reads
+		io.WriteString(w, file.Sha256+"  "+name+"\n")
+		return true
+	}
+
+	createdAt, _ := time.Parse(time.RFC3339, snapshot.CreatedAt)
+
+	sendMetalink(w, &metalinkFile{
+		Name:   name,
+		Size:   file.Size,
+		Hashes: []*metalinkHash{{Type: "sha-256", Value: file.Sha256}},
+		Urls: []*metalinkUrl{{
+			Priority: 1,
+			Value:    s.absoluteUrl(r, "/gemdrive/snapshots/"+snapshot.Id+"/"+file.Path, ""),
+		}},
+	}, createdAt)
+
+	return true
+}
+
+func sharesAny(a, b []string) bool {
+	for _, value := range b {
+		if containsString(a, value) {
+			return true
+		}
+	}
+	return false
+}
+
+var snapshotIndexTemplate = template.Must(template.New("snapshot").Parse(`<!doctype html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+    <title>{{.Path}}</title>
+    <style>
+      body { margin: 0 auto; max-width: 960px; font-family: Helvetica; }
+      td { padding: 2px 8px; }
+      .sha { font-family: monospace; font-size: 0.8em; }
+    </style>
+  </head>
+  <body>
+    <h1>{{.Path}}</h1>
+    <p>Published {{.CreatedAt}}. Snapshot <span class="sha">{{.Id}}</span> (<a href="../{{.Id}}">manifest</a>)</p>
+    <table>
+      <tr><th>File</th><th>Size</th><th>SHA-256</th></tr>
+      {{range .Files}}
+      <tr><td><a href="{{.Path}}">{{.Path}}</a></td><td>{{.Size}}</td><td class="sha">{{.Sha256}}</td></tr>
+      {{end}}
+    </table>
+  </body>
+</html>
+`))
@@ -0,0 +1,638 @@
+package gemdrive
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQL backends keep a mount's whole tree in PostgreSQL or MySQL, so content
+// and metadata are replicated and backed up together with the rest of the
+// database. Items are rows keyed by path, with directories ending in a
+// slash, and file content is split into fixed size chunks so ranged reads
+// and writes only touch the chunks involved. Missing chunks read as zeros.
+//
+// Tables are created on startup, named after the table prefix, so mounts
+// sharing a database need different prefixes. The library doesn't register
+// any database/sql driver. gemdrive-server includes them when built with
+// tags, ie "go build -tags postgres,mysql ./cmd/gemdrive-server", and other
+// programs import the one they need.
+
+const defaultSqlChunkSize = 1024 * 1024
+
+type SqlBackendConfig struct {
+	// Registered database/sql driver, ie postgres, pgx or mysql
+	Driver string `json:"driver,omitempty"`
+	Dsn    string `json:"dsn,omitempty"`
+	// Defaults to gemdrive
+	TablePrefix string `json:"tablePrefix,omitempty"`
+	// Bytes per content row. Defaults to 1MB. Can't be changed once
+	// there's content.
+	ChunkSize int `json:"chunkSize,omitempty"`
+}
+
+type sqlDialect struct {
+	// Placeholders are $1, $2... rather than ?
+	numbered bool
+	// Path columns, compared byte by byte
+	keyType  string
+	blobType string
+	// Extra statements run after creating tables
+	indexes []string
+}
+
+var sqlDialects = map[string]*sqlDialect{
+	"postgres": {
+		numbered: true,
+		keyType:  `TEXT COLLATE "C"`,
+		blobType: "BYTEA",
+		indexes:  []string{"CREATE INDEX IF NOT EXISTS {prefix}_items_parent ON {prefix}_items (parent)"},
+	},
+	"mysql": {
+		// Longer keys don't fit in an index
+		keyType:  "VARCHAR(760) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin",
+		blobType: "LONGBLOB",
+	},
+}
+
+var sqlDriverDialects = map[string]string{
+	"postgres": "postgres",
+	"pgx":      "postgres",
+	"mysql":    "mysql",
+}
+
+var validTablePrefix = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+
+type SqlBackend struct {
+	db        *sql.DB
+	dialect   *sqlDialect
+	prefix    string
+	chunkSize int
+}
+
+func NewSqlBackend(config *SqlBackendConfig) (*SqlBackend, error) {
+	dialectName, exists := sqlDriverDialects[config.Driver]
+	if !exists {
+		return nil, fmt.Errorf("Unsupported SQL driver %s", config.Driver)
+	}
+
+	prefix := config.TablePrefix
+	if prefix == "" {
+		prefix = "gemdrive"
+	}
+	if !validTablePrefix.MatchString(prefix) {
+		return nil, fmt.Errorf("Invalid table prefix %s", prefix)
+	}
+
+	chunkSize := config.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultSqlChunkSize
+	}
+
+	db, err := sql.Open(config.Driver, config.Dsn)
+	if err != nil {
+		return nil, fmt.Errorf("SQL driver %s isn't built into this server: %w", config.Driver, err)
+	}
+
+	b := &SqlBackend{
+		db:        db,
+		dialect:   sqlDialects[dialectName],
+		prefix:    prefix,
+		chunkSize: chunkSize,
+	}
+
+	err = b.createTables()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *SqlBackend) createTables() error {
+	statements := []string{
+		"CREATE TABLE IF NOT EXISTS {prefix}_items (" +
+			"path {key} NOT NULL PRIMARY KEY, " +
+			"parent {key} NOT NULL, " +
+			"name {key} NOT NULL, " +
+			"is_dir BOOLEAN NOT NULL, " +
+			"size BIGINT NOT NULL, " +
+			"mod_time VARCHAR(40) NOT NULL" +
+			")",
+		"CREATE TABLE IF NOT EXISTS {prefix}_chunks (" +
+			"path {key} NOT NULL, " +
+			"idx BIGINT NOT NULL, " +
+			"data {blob} NOT NULL, " +
+			"PRIMARY KEY (path, idx)" +
+			")",
+	}
+
+	if b.dialect.indexes == nil {
+		statements[0] = strings.TrimSuffix(statements[0], ")") + ", INDEX (parent))"
+	}
+
+	for _, statement := range append(statements, b.dialect.indexes...) {
+		statement = strings.NewReplacer(
+			"{prefix}", b.prefix,
+			"{key}", b.dialect.keyType,
+			"{blob}", b.dialect.blobType,
+		).Replace(statement)
+
+		_, err := b.db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fills in table names and the dialect's placeholders.
+func (b *SqlBackend) query(q string) string {
+	q = strings.ReplaceAll(q, "{items}", b.prefix+"_items")
+	q = strings.ReplaceAll(q, "{chunks}", b.prefix+"_chunks")
+
+	if !b.dialect.numbered {
+		return q
+	}
+
+	var out strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			out.WriteString("$" + strconv.Itoa(n))
+		} else {
+			out.WriteRune(c)
+		}
+	}
+	return out.String()
+}
+
+// The first path after every path beneath dirPath, which ends in a slash.
+func sqlPrefixEnd(dirPath string) string {
+	return strings.TrimSuffix(dirPath, "/") + "0"
+}
+
+func sqlNow() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+type sqlItem struct {
+	isDir   bool
+	size    int64
+	modTime string
+}
+
+// Looks up reqPath, returning nil if it doesn't exist. The root always
+// does.
+func (b *SqlBackend) stat(q sqlQuerier, reqPath string) (*sqlItem, error) {
+	if reqPath == "/" {
+		return &sqlItem{isDir: true}, nil
+	}
+
+	item := &sqlItem{}
+	err := q.QueryRow(b.query("SELECT is_dir, size, mod_time FROM {items} WHERE path = ?"), reqPath).
+		Scan(&item.isDir, &item.size, &item.modTime)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// Either the database or a transaction
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (b *SqlBackend) List(reqPath string, maxDepth int) (*Item, error) {
+	dir, err := b.stat(b.db, reqPath)
+	if err != nil {
+		return nil, err
+	}
+	if dir == nil || !dir.isDir {
+		return nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	var rows *sql.Rows
+	if maxDepth == 1 {
+		rows, err = b.db.Query(b.query("SELECT path, parent, name, is_dir, size, mod_time FROM {items} WHERE parent = ? ORDER BY path"), reqPath)
+	} else {
+		rows, err = b.db.Query(b.query("SELECT path, parent, name, is_dir, size, mod_time FROM {items} WHERE path > ? AND path < ? ORDER BY path"), reqPath, sqlPrefixEnd(reqPath))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	root := &Item{
+		Size:    dir.size,
+		ModTime: dir.modTime,
+	}
+
+	// Parents sort before their children, so are always seen first
+	dirs := map[string]*Item{reqPath: root}
+
+	for rows.Next() {
+		var childPath, parent, name string
+		child := &sqlItem{}
+		err := rows.Scan(&childPath, &parent, &name, &child.isDir, &child.size, &child.modTime)
+		if err != nil {
+			return nil, err
+		}
+
+		level := strings.Count(strings.TrimPrefix(parent, reqPath), "/") + 1
+		if maxDepth > 0 && level > maxDepth {
+			continue
+		}
+
+		parentItem, exists := dirs[parent]
+		if !exists {
+			continue
+		}
+
+		item := &Item{
+			Size:    child.size,
+			ModTime: child.modTime,
+		}
+
+		if parentItem.Children == nil {
+			parentItem.Children = make(map[string]*Item)
+		}
+		parentItem.Children[name] = item
+
+		if child.isDir {
+			dirs[childPath] = item
+		}
+	}
+
+	return root, rows.Err()
+}
+
+func (b *SqlBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	file, err := b.stat(b.db, reqPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file == nil || file.isDir {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	end := file.size
+	if length != 0 && offset+length < end {
+		end = offset + length
+	}
+
+	item := &Item{
+		Size:    file.size,
+		ModTime: file.modTime,
+	}
+
+	return item, &sqlReader{
+		backend: b,
+		path:    reqPath,
+		pos:     offset,
+		end:     end,
+	}, nil
+}
+
+// Reads a file a chunk at a time.
+type sqlReader struct {
+	backend *SqlBackend
+	path    string
+	pos     int64
+	end     int64
+	// The rest of the current chunk
+	buf []byte
+}
+
+func (r *sqlReader) Read(p []byte) (int, error) {
+	if r.pos >= r.end {
+		return 0, io.EOF
+	}
+
+	if len(r.buf) == 0 {
+		chunkSize := int64(r.backend.chunkSize)
+		idx := r.pos / chunkSize
+
+		data, err := r.backend.readChunk(r.backend.db, r.path, idx)
+		if err != nil {
+			return 0, err
+		}
+
+		// Short or missing chunks are holes
+		chunkEnd := chunkSize
+		if r.end-idx*chunkSize < chunkEnd {
+			chunkEnd = r.end - idx*chunkSize
+		}
+		if int64(len(data)) < chunkEnd {
+			data = append(data, make([]byte, chunkEnd-int64(len(data)))...)
+		}
+
+		r.buf = data[r.pos-idx*chunkSize : chunkEnd]
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.pos += int64(n)
+
+	return n, nil
+}
+
+func (r *sqlReader) Close() error {
+	return nil
+}
+
+func (b *SqlBackend) readChunk(q sqlQuerier, reqPath string, idx int64) ([]byte, error) {
+	var data []byte
+	err := q.QueryRow(b.query("SELECT data FROM {chunks} WHERE path = ? AND idx = ?"), reqPath, idx).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (b *SqlBackend) writeChunk(q sqlQuerier, reqPath string, idx int64, data []byte) error {
+	_, err := q.Exec(b.query("DELETE FROM {chunks} WHERE path = ? AND idx = ?"), reqPath, idx)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(b.query("INSERT INTO {chunks} (path, idx, data) VALUES (?, ?, ?)"), reqPath, idx, data)
+	return err
+}
+
+func (b *SqlBackend) insertItem(q sqlQuerier, reqPath string, isDir bool, size int64) error {
+	parent, name := path.Split(strings.TrimSuffix(reqPath, "/"))
+	if isDir {
+		name += "/"
+	}
+
+	now := sqlNow()
+
+	_, err := q.Exec(b.query("INSERT INTO {items} (path, parent, name, is_dir, size, mod_time) VALUES (?, ?, ?, ?, ?, ?)"),
+		reqPath, parent, name, isDir, size, now)
+	if err != nil {
+		return err
+	}
+
+	return b.touch(q, parent)
+}
+
+func (b *SqlBackend) touch(q sqlQuerier, reqPath string) error {
+	_, err := q.Exec(b.query("UPDATE {items} SET mod_time = ? WHERE path = ?"), sqlNow(), reqPath)
+	return err
+}
+
+func (b *SqlBackend) MakeDir(reqPath string, recursive bool) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = b.makeDir(tx, strings.TrimSuffix(reqPath, "/")+"/", recursive)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (b *SqlBackend) makeDir(q sqlQuerier, reqPath string, recursive bool) error {
+	existing, err := b.stat(q, reqPath)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if recursive && existing.isDir {
+			return nil
+		}
+		return errors.New("Directory exists")
+	}
+
+	parent, _ := path.Split(strings.TrimSuffix(reqPath, "/"))
+
+	parentItem, err := b.stat(q, parent)
+	if err != nil {
+		return err
+	}
+
+	if parentItem == nil {
+		if !recursive {
+			return &Error{
+				HttpCode: 404,
+				Message:  "Parent directory not found",
+			}
+		}
+
+		err = b.makeDir(q, parent, true)
+		if err != nil {
+			return err
+		}
+	} else if !parentItem.isDir {
+		return &Error{
+			HttpCode: 409,
+			Message:  "Parent is a file",
+		}
+	}
+
+	return b.insertItem(q, reqPath, true, 0)
+}
+
+func (b *SqlBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	parent, _ := path.Split(reqPath)
+
+	parentItem, err := b.stat(tx, parent)
+	if err != nil {
+		return err
+	}
+	if parentItem == nil || !parentItem.isDir {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Parent directory not found",
+		}
+	}
+
+	existing, err := b.stat(tx, reqPath)
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+
+	if existing != nil {
+		if existing.isDir {
+			return &Error{
+				HttpCode: 409,
+				Message:  "Is a directory",
+			}
+		}
+		if !overwrite {
+			return &Error{
+				HttpCode: 409,
+				Message:  "File exists",
+			}
+		}
+
+		size = existing.size
+
+		if truncate {
+			size = 0
+			_, err = tx.Exec(b.query("DELETE FROM {chunks} WHERE path = ?"), reqPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	chunkSize := int64(b.chunkSize)
+	buf := make([]byte, chunkSize)
+	pos := offset
+
+	for {
+		idx := pos / chunkSize
+		within := pos - idx*chunkSize
+
+		n, readErr := io.ReadFull(data, buf[:chunkSize-within])
+		if n > 0 {
+			chunk := buf[:n]
+
+			// Partial chunks are merged with what's there
+			if within != 0 || int64(n) < chunkSize {
+				old, err := b.readChunk(tx, reqPath, idx)
+				if err != nil {
+					return err
+				}
+				if int64(len(old)) < within+int64(n) {
+					old = append(old, make([]byte, within+int64(n)-int64(len(old)))...)
+				}
+				copy(old[within:], chunk)
+				chunk = old
+			}
+
+			err := b.writeChunk(tx, reqPath, idx, chunk)
+			if err != nil {
+				return err
+			}
+
+			pos += int64(n)
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+
+	if pos-offset != length {
+		return errors.New("n did not match length")
+	}
+
+	if pos > size {
+		size = pos
+	}
+
+	if existing == nil {
+		err = b.insertItem(tx, reqPath, false, size)
+	} else {
+		_, err = tx.Exec(b.query("UPDATE {items} SET size = ?, mod_time = ? WHERE path = ?"), size, sqlNow(), reqPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (b *SqlBackend) Delete(reqPath string, recursive bool) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	item, err := b.stat(tx, reqPath)
+	if err == nil && item == nil && !strings.HasSuffix(reqPath, "/") {
+		reqPath += "/"
+		item, err = b.stat(tx, reqPath)
+	}
+	if err != nil {
+		return err
+	}
+	if item == nil || reqPath == "/" {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	}
+
+	if item.isDir {
+		var children int
+		err = tx.QueryRow(b.query("SELECT COUNT(*) FROM {items} WHERE parent = ?"), reqPath).Scan(&children)
+		if err != nil {
+			return err
+		}
+		if children > 0 && !recursive {
+			return &Error{
+				HttpCode: 409,
+				Message:  "Directory not empty",
+			}
+		}
+
+		end := sqlPrefixEnd(reqPath)
+
+		_, err = tx.Exec(b.query("DELETE FROM {chunks} WHERE path > ? AND path < ?"), reqPath, end)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(b.query("DELETE FROM {items} WHERE path > ? AND path < ?"), reqPath, end)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = tx.Exec(b.query("DELETE FROM {chunks} WHERE path = ?"), reqPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(b.query("DELETE FROM {items} WHERE path = ?"), reqPath)
+	if err != nil {
+		return err
+	}
+
+	parent, _ := path.Split(strings.TrimSuffix(reqPath, "/"))
+
+	err = b.touch(tx, parent)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,6 @@
+//go:build mysql
+// +build mysql
+
+package gemdrive_test
+
+import _ "github.com/go-sql-driver/mysql"
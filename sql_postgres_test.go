@@ -0,0 +1,6 @@
+//go:build postgres
+// +build postgres
+
+package gemdrive_test
+
+import _ "github.com/lib/pq"
@@ -0,0 +1,265 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Serves gemdrive/media.json, describing the videos in a directory along
+// with the subtitles and alternate audio tracks found next to them, so web
+// players can offer them without knowing any naming conventions. Files
+// belong to a video when they're named after it, ie for movie.mkv
+//
+//   movie.srt, movie.en.srt, movie.en.forced.vtt, movie.fr.sdh.srt
+//   movie.commentary.m4a, movie.de.mp3
+//
+// Browsers only play WebVTT, so gemdrive/subtitles/<filename> serves SRT
+// files converted to it.
+
+const maxSubtitleSize = 16 * 1024 * 1024
+
+type MediaDescriptor struct {
+	Videos []*MediaVideo `json:"videos"`
+}
+
+type MediaVideo struct {
+	Path        string             `json:"path"`
+	Size        int64              `json:"size"`
+	Subtitles   []*MediaSubtitle   `json:"subtitles"`
+	AudioTracks []*MediaAudioTrack `json:"audioTracks"`
+}
+
+type MediaSubtitle struct {
+	Path string `json:"path"`
+	// WebVTT version, relative to the directory
+	Src      string `json:"src"`
+	Language string `json:"language,omitempty"`
+	Label    string `json:"label"`
+	Forced   bool   `json:"forced,omitempty"`
+	// For the deaf and hard of hearing
+	Sdh bool `json:"sdh,omitempty"`
+}
+
+type MediaAudioTrack struct {
+	Path     string `json:"path"`
+	Language string `json:"language,omitempty"`
+	Label    string `json:"label"`
+}
+
+var languageCodeRegex = regexp.MustCompile("^[a-z]{2,3}(-[A-Za-z]{2})?$")
+
+var srtTimingRegex = regexp.MustCompile(`(\d\d:\d\d:\d\d),(\d\d\d)`)
+
+func isSubtitleName(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".srt" || ext == ".vtt"
+}
+
+func isAudioTrackName(name string) bool {
+	return strings.HasPrefix(mime.TypeByExtension(path.Ext(name)), "audio/")
+}
+
+// Reads the language, flags and label from what comes between a video's
+// name and the extension of a file belonging to it, ie ".en.forced".
+func parseTrackName(suffix string) (language string, label string, flags []string) {
+	words := []string{}
+	for _, word := range strings.Split(strings.Trim(suffix, "."), ".") {
+		lower := strings.ToLower(word)
+		switch {
+		case word == "":
+		case lower == "forced" || lower == "sdh" || lower == "cc" || lower == "hi":
+			flags = append(flags, lower)
+		case language == "" && languageCodeRegex.MatchString(word):
+			language = word
+		default:
+			words = append(words, word)
+		}
+	}
+
+	label = strings.Join(words, " ")
+	if label == "" {
+		label = language
+	}
+	if label == "" {
+		label = "Default"
+	}
+
+	return language, label, flags
+}
+
+func (s *Server) serveMediaDescriptor(w http.ResponseWriter, r *http.Request, gemPath string) {
+	listing, err := s.backend.List(gemPath, 1)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	names := []string{}
+	for name := range listing.Children {
+		if !strings.HasSuffix(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	onlyFile := r.URL.Query().Get("file")
+
+	descriptor := &MediaDescriptor{
+		Videos: []*MediaVideo{},
+	}
+
+	for _, name := range names {
+		if !isVideoName(name) || (onlyFile != "" && name != onlyFile) {
+			continue
+		}
+
+		video := &MediaVideo{
+			Path:        name,
+			Size:        listing.Children[name].Size,
+			Subtitles:   []*MediaSubtitle{},
+			AudioTracks: []*MediaAudioTrack{},
+		}
+
+		base := strings.TrimSuffix(name, path.Ext(name))
+
+		for _, sibling := range names {
+			if sibling == name || !strings.HasPrefix(sibling, base+".") {
+				continue
+			}
+
+			ext := path.Ext(sibling)
+			suffix := strings.TrimSuffix(strings.TrimPrefix(sibling, base), ext)
+			language, label, flags := parseTrackName(suffix)
+
+			if isSubtitleName(sibling) {
+				src := sibling
+				if strings.ToLower(ext) == ".srt" {
+					src = "gemdrive/subtitles/" + sibling
+				}
+
+				video.Subtitles = append(video.Subtitles, &MediaSubtitle{
+					Path:     sibling,
+					Src:      src,
+					Language: language,
+					Label:    label,
+					Forced:   containsString(flags, "forced"),
+					Sdh:      containsString(flags, "sdh") || containsString(flags, "cc") || containsString(flags, "hi"),
+				})
+			} else if isAudioTrackName(sibling) {
+				video.AudioTracks = append(video.AudioTracks, &MediaAudioTrack{
+					Path:     sibling,
+					Language: language,
+					Label:    label,
+				})
+			}
+		}
+
+		descriptor.Videos = append(descriptor.Videos, video)
+	}
+
+	jsonBody, err := json.Marshal(descriptor)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
+
+// Serves a subtitle file as WebVTT.
+func (s *Server) serveSubtitles(w http.ResponseWriter, r *http.Request, dirPath, filename string) {
+	token, _ := extractToken(r)
+
+	filePath := dirPath + filename
+
+	if filename == "" || strings.Contains(filename, "/") || !isSubtitleName(filename) {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	if !s.auth.CanRead(token, filePath) {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	if !canReadRaw(s.config.Exports, s.auth, token, filePath) {
+		w.WriteHeader(errNoRawAccess.HttpCode)
+		io.WriteString(w, errNoRawAccess.Message)
+		return
+	}
+
+	item, data, err := s.requestBackend(r).Read(filePath, 0, 0)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+	defer data.Close()
+
+	if item.Size > maxSubtitleSize {
+		w.WriteHeader(413)
+		io.WriteString(w, "Subtitle file is too large")
+		return
+	}
+
+	contents, err := ioutil.ReadAll(io.LimitReader(data, maxSubtitleSize))
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if strings.ToLower(path.Ext(filename)) == ".srt" {
+		contents = srtToWebVtt(contents)
+	}
+
+	setValidators(w, item)
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Write(contents)
+}
+
+// SRT files are WebVTT with a different header and decimal separator. Older
+// ones often aren't UTF-8, in which case they're taken to be Latin-1.
+func srtToWebVtt(srt []byte) []byte {
+	srt = bytes.TrimPrefix(srt, []byte("\xef\xbb\xbf"))
+	if !utf8.Valid(srt) {
+		srt = []byte(latin1(srt))
+	}
+
+	text := strings.ReplaceAll(string(srt), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	var out strings.Builder
+	out.WriteString("WEBVTT\n\n")
+
+	for _, line := range strings.Split(text, "\n") {
+		if strings.Contains(line, "-->") {
+			line = srtTimingRegex.ReplaceAllString(line, "$1.$2")
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+
+	return []byte(out.String())
+}
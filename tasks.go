@@ -0,0 +1,309 @@
+package gemdrive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The tasks that can be scheduled. Each runs on local exports only.
+func (s *Server) taskRunners() map[string]taskFunc {
+	return map[string]taskFunc{
+		"scrub":   s.scrubTask,
+		"gc":      s.gcTask,
+		"reindex": s.reindexTask,
+		"repair":  s.repairTask,
+		"tier":    s.tierTask,
+	}
+}
+
+// Local exports a task covers, by name, in order.
+func (s *Server) taskExports(names []string) ([]string, error) {
+	if len(names) == 0 {
+		for name := range s.fsBackends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+
+	for _, name := range names {
+		if _, exists := s.fsBackends[name]; !exists {
+			return nil, fmt.Errorf("%s isn't a local export", name)
+		}
+	}
+
+	return names, nil
+}
+
+// Rereads every file with stored checksums that it hasn't changed since,
+// looking for silent corruption on disk. Files which have changed are
+// skipped, since their checksums are simply out of date.
+func (s *Server) scrubTask(ctx context.Context, exportNames []string) (string, error) {
+	names, err := s.taskExports(exportNames)
+	if err != nil {
+		return "", err
+	}
+
+	checked := 0
+	corrupt := []string{}
+
+	for _, name := range names {
+		fs := s.fsBackends[name]
+
+		err := filepath.Walk(fs.rootDir, func(fsPath string, info os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+
+			reqPath := "/" + filepath.ToSlash(strings.TrimPrefix(fsPath, fs.rootDir))
+			reqPath = path.Clean(reqPath)
+
+			ok, verified, err := fs.verifyChecksums(reqPath, info)
+			if err != nil {
+				fmt.Println("Failed to scrub", "/"+name+reqPath, err)
+				return nil
+			}
+
+			if verified {
+				checked++
+				if !ok {
+					fmt.Println("Checksum mismatch for", "/"+name+reqPath)
+					corrupt = append(corrupt, "/"+name+reqPath)
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	result := fmt.Sprintf("Checked %d files", checked)
+	if len(corrupt) > 0 {
+		return result, fmt.Errorf("Checksum mismatches: %s", strings.Join(corrupt, ", "))
+	}
+
+	return result, nil
+}
+
+// Whether the file still matches its stored checksums. verified is false if
+// it has none, or they're for an older version of the file.
+func (fs *FileSystemBackend) verifyChecksums(reqPath string, info os.FileInfo) (ok, verified bool, err error) {
+	parentDir, filename := path.Split(reqPath)
+	cachePath := fs.cachePath(parentDir, "gemdrive", "checksums", filename+".json")
+
+	cacheJson, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return false, false, nil
+	}
+
+	var entry checksumCacheEntry
+	err = json.Unmarshal(cacheJson, &entry)
+	if err != nil || entry.Checksums == nil {
+		return false, false, nil
+	}
+
+	if entry.Size != info.Size() || entry.ModTime != info.ModTime().UTC().Format(time.RFC3339Nano) {
+		return false, false, nil
+	}
+
+	file, err := os.Open(fs.localPath(reqPath))
+	if err != nil {
+		return false, false, err
+	}
+	defer file.Close()
+
+	reader := newChecksumReader(file)
+	_, err = io.Copy(ioutil.Discard, reader)
+	if err != nil {
+		return false, false, err
+	}
+
+	return reader.Checksums().Matches(entry.Checksums), true, nil
+}
+
+// Removes cached thumbnails, metadata and checksums left behind by files
+// that were deleted while the server wasn't watching, along with expired
+// idempotency records.
+func (s *Server) gcTask(ctx context.Context, exportNames []string) (string, error) {
+	names, err := s.taskExports(exportNames)
+	if err != nil {
+		return "", err
+	}
+
+	removed := 0
+
+	for _, name := range names {
+		fs := s.fsBackends[name]
+
+		err := filepath.Walk(fs.gemDir, func(cachePath string, info os.FileInfo, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if err != nil || !info.IsDir() || info.Name() != "gemdrive" {
+				return nil
+			}
+
+			parentDir := strings.TrimPrefix(filepath.Dir(cachePath), fs.gemDir)
+			srcDir := filepath.Join(fs.rootDir, parentDir)
+
+			if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+				os.RemoveAll(cachePath)
+				removed++
+				return filepath.SkipDir
+			}
+
+			removed += removeOrphans(filepath.Join(cachePath, "checksums"), srcDir, ".json")
+			removed += removeOrphans(filepath.Join(cachePath, "media"), srcDir, ".json")
+
+			sizeDirs, _ := ioutil.ReadDir(filepath.Join(cachePath, "images"))
+			for _, sizeDir := range sizeDirs {
+				removed += removeOrphans(filepath.Join(cachePath, "images", sizeDir.Name()), srcDir, ".gif")
+			}
+
+			return filepath.SkipDir
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	s.idempotency.mut.Lock()
+	s.idempotency.expire()
+	s.idempotency.mut.Unlock()
+
+	return fmt.Sprintf("Removed %d cache entries", removed), nil
+}
+
+// Removes files in cacheDir whose source, with suffix optionally trimmed,
+// is no longer in srcDir.
+func removeOrphans(cacheDir, srcDir, suffix string) int {
+	entries, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		return 0
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if _, err := os.Stat(filepath.Join(srcDir, name)); err == nil {
+			continue
+		}
+		if trimmed := strings.TrimSuffix(name, suffix); trimmed != name {
+			if _, err := os.Stat(filepath.Join(srcDir, trimmed)); err == nil {
+				continue
+			}
+		}
+
+		if os.RemoveAll(filepath.Join(cacheDir, name)) == nil {
+			removed++
+		}
+	}
+
+	return removed
+}
+
+func (s *Server) reindexTask(ctx context.Context, exportNames []string) (string, error) {
+	if s.indexer == nil {
+		return "", fmt.Errorf("Indexing not enabled")
+	}
+
+	names, err := s.taskExports(exportNames)
+	if err != nil {
+		return "", err
+	}
+
+	for _, name := range names {
+		err := s.indexer.Reindex(ctx, name)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("Reindexed %s", strings.Join(names, ", ")), nil
+}
+
+// Rebuilds what the shards of erasure-coded mounts are missing, after
+// they've been replaced or were unreachable for writes.
+func (s *Server) repairTask(ctx context.Context, mountNames []string) (string, error) {
+	names := mountNames
+	if len(names) == 0 {
+		for name := range s.erasure {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	checked := 0
+	repaired := 0
+	failed := []string{}
+
+	for _, name := range names {
+		backend, exists := s.erasure[name]
+		if !exists {
+			return "", fmt.Errorf("%s isn't an erasure-coded mount", name)
+		}
+
+		mountChecked, mountRepaired, failures, err := backend.Repair(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		checked += mountChecked
+		repaired += mountRepaired
+		for _, failure := range failures {
+			failed = append(failed, "/"+name+failure)
+		}
+	}
+
+	result := fmt.Sprintf("Checked %d files, repaired %d", checked, repaired)
+	if len(failed) > 0 {
+		return result, fmt.Errorf("Couldn't repair: %s", strings.Join(failed, ", "))
+	}
+
+	return result, nil
+}
+
+// Moves files that have gone unused to cold storage, for every tiered
+// export.
+func (s *Server) tierTask(ctx context.Context, exportNames []string) (string, error) {
+	names := exportNames
+	if len(names) == 0 {
+		for name := range s.tiered {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	moved := 0
+	for _, name := range names {
+		backend, exists := s.tiered[name]
+		if !exists {
+			return "", fmt.Errorf("%s isn't tiered", name)
+		}
+
+		n, err := backend.Migrate(ctx)
+		moved += n
+		if err != nil {
+			return fmt.Sprintf("Moved %d files", moved), err
+		}
+	}
+
+	return fmt.Sprintf("Moved %d files", moved), nil
+}
@@ -0,0 +1,686 @@
+package gemdrive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tiering moves files nobody has touched in a while from a local export to
+// a cheaper mount, and back once they're read again:
+//
+//	"tiering": [{"export": "photos", "coldPath": "/archive/photos/", "afterDays": 90}]
+//
+// The tier task does the moving, so it needs scheduling like the others. A
+// moved file leaves a stub behind in the data dir, ie
+// DataDir/tiering/<export>/<dir>/gemdrive/tiering.json, so it's still
+// listed at the same path with the same size and modification time. Reads
+// of it are served from the cold mount while it's copied back, and writes
+// wait for it to be. Listings say which tier every file of the export is
+// in, and when it was last used.
+
+// Reads are recorded at most this often per file
+const tierAccessGranularity = time.Hour
+
+type TieringRule struct {
+	// Local export whose files are moved
+	Export string `json:"export"`
+	// Where in another mount they're moved to
+	ColdPath string `json:"coldPath"`
+	// Days since a file was last read or written before it's moved
+	AfterDays int `json:"afterDays"`
+	// Smaller files stay where they are
+	MinSize int64 `json:"minSize,omitempty"`
+}
+
+// Where a file in a tiered export is kept.
+type TierState struct {
+	// hot or cold
+	Tier       string `json:"tier"`
+	LastAccess string `json:"lastAccess,omitempty"`
+	// When it was moved to the cold mount
+	MovedAt string `json:"movedAt,omitempty"`
+}
+
+type tierEntry struct {
+	LastAccess string `json:"lastAccess,omitempty"`
+	// The rest are only set while the file is cold
+	Size    int64  `json:"size,omitempty"`
+	ModTime string `json:"modTime,omitempty"`
+	MovedAt string `json:"movedAt,omitempty"`
+}
+
+func (e *tierEntry) cold() bool {
+	return e.MovedAt != ""
+}
+
+type TieredBackend struct {
+	*FileSystemBackend
+	rule        *TieringRule
+	cold        *MultiBackend
+	manifestDir string
+	mut         *sync.Mutex
+	fileLocks   [64]sync.Mutex
+	recalling   map[string]bool
+}
+
+func NewTieredBackend(hot *FileSystemBackend, cold *MultiBackend, rule *TieringRule, manifestDir string) (*TieredBackend, error) {
+	if rule.AfterDays <= 0 {
+		return nil, fmt.Errorf("Tiering for %s needs afterDays", rule.Export)
+	}
+
+	coldPath := "/" + strings.Trim(rule.ColdPath, "/") + "/"
+	if coldPath == "/" || strings.HasPrefix(coldPath, "/"+rule.Export+"/") {
+		return nil, fmt.Errorf("Invalid cold path for %s", rule.Export)
+	}
+
+	return &TieredBackend{
+		FileSystemBackend: hot,
+		rule:              rule,
+		cold:              cold,
+		manifestDir:       manifestDir,
+		mut:               &sync.Mutex{},
+		recalling:         make(map[string]bool),
+	}, nil
+}
+
+func (b *TieredBackend) coldPath(reqPath string) string {
+	return "/" + strings.Trim(b.rule.ColdPath, "/") + reqPath
+}
+
+func (b *TieredBackend) fileLock(reqPath string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(reqPath))
+	return &b.fileLocks[hash.Sum32()%uint32(len(b.fileLocks))]
+}
+
+func (b *TieredBackend) entriesPath(dirPath string) string {
+	return filepath.Join(b.manifestDir, dirPath, "gemdrive", "tiering.json")
+}
+
+func (b *TieredBackend) readEntries(dirPath string) map[string]*tierEntry {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	return b.loadEntries(dirPath)
+}
+
+func (b *TieredBackend) loadEntries(dirPath string) map[string]*tierEntry {
+	entries := make(map[string]*tierEntry)
+
+	entriesJson, err := ioutil.ReadFile(b.entriesPath(dirPath))
+	if err != nil {
+		return entries
+	}
+
+	err = json.Unmarshal(entriesJson, &entries)
+	if err != nil {
+		fmt.Println("Ignoring invalid tiering state in", dirPath, err)
+		return make(map[string]*tierEntry)
+	}
+
+	return entries
+}
+
+func (b *TieredBackend) getEntry(reqPath string) *tierEntry {
+	dirPath, name := splitItemPath(reqPath)
+	return b.readEntries(dirPath)[name]
+}
+
+// Changes the entry for reqPath with fn, which returns nil to remove it.
+func (b *TieredBackend) updateEntry(reqPath string, fn func(entry *tierEntry) *tierEntry) error {
+	dirPath, name := splitItemPath(reqPath)
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	entries := b.loadEntries(dirPath)
+
+	entry := fn(entries[name])
+	if entry == nil {
+		if _, exists := entries[name]; !exists {
+			return nil
+		}
+		delete(entries, name)
+	} else {
+		entries[name] = entry
+	}
+
+	entriesPath := b.entriesPath(dirPath)
+
+	if len(entries) == 0 {
+		err := os.Remove(entriesPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(entriesPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return saveJson(entries, entriesPath)
+}
+
+func (b *TieredBackend) recordAccess(reqPath string) {
+	now := time.Now().UTC()
+
+	entry := b.getEntry(reqPath)
+	if entry != nil {
+		lastAccess, err := time.Parse(time.RFC3339, entry.LastAccess)
+		if err == nil && now.Sub(lastAccess) < tierAccessGranularity {
+			return
+		}
+	}
+
+	err := b.updateEntry(reqPath, func(entry *tierEntry) *tierEntry {
+		if entry == nil {
+			entry = &tierEntry{}
+		}
+		entry.LastAccess = now.Format(time.RFC3339)
+		return entry
+	})
+	if err != nil {
+		fmt.Println("Failed to record access to", reqPath+":", err)
+	}
+}
+
+func (b *TieredBackend) List(reqPath string, depth int) (*Item, error) {
+	item, err := b.FileSystemBackend.List(reqPath, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.addTiers(strings.TrimSuffix(reqPath, "/")+"/", item, depth, true), nil
+}
+
+func (b *TieredBackend) ListPage(reqPath, after string, limit int) (*Item, string, error) {
+	dirPath := strings.TrimSuffix(reqPath, "/") + "/"
+
+	for _, entry := range b.readEntries(dirPath) {
+		if entry.cold() {
+			// Stubs have to be paged through along with the rest
+			item, err := b.List(dirPath, 1)
+			if err != nil {
+				return nil, "", err
+			}
+			page, next := pageItem(item, after, limit)
+			return page, next, nil
+		}
+	}
+
+	page, next, err := b.FileSystemBackend.ListPage(reqPath, after, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return b.addTiers(dirPath, page, 1, false), next, nil
+}
+
+// Copies a listing to depth with the tier of every file, and the stubs of
+// cold ones if withStubs is set. Listings from the export are cached, so
+// they're never changed in place.
+func (b *TieredBackend) addTiers(dirPath string, item *Item, depth int, withStubs bool) *Item {
+	entries := b.readEntries(dirPath)
+
+	if item.Children == nil && (!withStubs || len(entries) == 0) {
+		return item
+	}
+
+	result := *item
+	result.Children = make(map[string]*Item, len(item.Children))
+
+	for name, child := range item.Children {
+		if strings.HasSuffix(name, "/") {
+			if depth == 1 {
+				result.Children[name] = child
+			} else {
+				childDepth := 0
+				if depth > 1 {
+					childDepth = depth - 1
+				}
+				result.Children[name] = b.addTiers(dirPath+name, child, childDepth, withStubs)
+			}
+			continue
+		}
+
+		state := &TierState{
+			Tier:       "hot",
+			LastAccess: child.ModTime,
+		}
+		if entry, exists := entries[name]; exists && entry.LastAccess > state.LastAccess {
+			state.LastAccess = entry.LastAccess
+		}
+
+		tiered := *child
+		tiered.Tiering = state
+		result.Children[name] = &tiered
+	}
+
+	if withStubs {
+		for name, entry := range entries {
+			if !entry.cold() {
+				continue
+			}
+			if _, exists := result.Children[name]; exists {
+				continue
+			}
+
+			result.Children[name] = &Item{
+				Size:    entry.Size,
+				ModTime: entry.ModTime,
+				Tiering: &TierState{
+					Tier:       "cold",
+					LastAccess: entry.LastAccess,
+					MovedAt:    entry.MovedAt,
+				},
+			}
+		}
+	}
+
+	return &result
+}
+
+func (b *TieredBackend) Read(reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	item, data, err := b.FileSystemBackend.Read(reqPath, offset, length)
+	if err == nil {
+		b.recordAccess(reqPath)
+		return item, data, nil
+	}
+
+	entry := b.getEntry(reqPath)
+	if entry == nil || !entry.cold() {
+		return nil, nil, err
+	}
+
+	_, data, err = b.cold.Read(b.coldPath(reqPath), offset, length)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	go func() {
+		err := b.recall(reqPath)
+		if err != nil {
+			fmt.Println("Failed to recall", reqPath, "from cold storage:", err)
+		}
+	}()
+
+	return &Item{Size: entry.Size}, data, nil
+}
+
+// Copies a cold file back to the export, leaving it as it was before it
+// was moved.
+func (b *TieredBackend) recall(reqPath string) error {
+	b.mut.Lock()
+	if b.recalling[reqPath] {
+		b.mut.Unlock()
+		return nil
+	}
+	b.recalling[reqPath] = true
+	b.mut.Unlock()
+
+	defer func() {
+		b.mut.Lock()
+		delete(b.recalling, reqPath)
+		b.mut.Unlock()
+	}()
+
+	lock := b.fileLock(reqPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return b.recallLocked(reqPath)
+}
+
+func (b *TieredBackend) recallLocked(reqPath string) error {
+	entry := b.getEntry(reqPath)
+	if entry == nil || !entry.cold() {
+		return nil
+	}
+
+	_, data, err := b.cold.Read(b.coldPath(reqPath), 0, 0)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	err = b.FileSystemBackend.Write(reqPath, data, 0, entry.Size, true, true)
+	if err != nil {
+		b.FileSystemBackend.Delete(reqPath, false)
+		return err
+	}
+
+	modTime, err := time.Parse(time.RFC3339, entry.ModTime)
+	if err == nil {
+		os.Chtimes(b.localPath(reqPath), time.Now(), modTime)
+	}
+
+	err = b.updateEntry(reqPath, func(entry *tierEntry) *tierEntry {
+		return &tierEntry{
+			LastAccess: time.Now().UTC().Format(time.RFC3339),
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = b.cold.Delete(b.coldPath(reqPath), false)
+	if err != nil && !isNotFound(err) {
+		fmt.Println("Failed to remove", reqPath, "from cold storage:", err)
+	}
+
+	return nil
+}
+
+func (b *TieredBackend) Write(reqPath string, data io.Reader, offset, length int64, overwrite, truncate bool) error {
+	lock := b.fileLock(reqPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry := b.getEntry(reqPath)
+	if entry != nil && entry.cold() {
+		if !overwrite {
+			return &Error{
+				HttpCode: 409,
+				Message:  "File exists",
+			}
+		}
+
+		if offset == 0 && truncate {
+			err := b.dropCold(reqPath)
+			if err != nil {
+				return err
+			}
+		} else {
+			err := b.recallLocked(reqPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return b.FileSystemBackend.Write(reqPath, data, offset, length, overwrite, truncate)
+}
+
+// Forgets a cold file, deleting it from the cold mount.
+func (b *TieredBackend) dropCold(reqPath string) error {
+	err := b.cold.Delete(b.coldPath(reqPath), false)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+
+	return b.updateEntry(reqPath, func(entry *tierEntry) *tierEntry {
+		return nil
+	})
+}
+
+func (b *TieredBackend) Delete(reqPath string, recursive bool) error {
+	if !strings.HasSuffix(reqPath, "/") {
+		lock := b.fileLock(reqPath)
+		lock.Lock()
+		defer lock.Unlock()
+
+		entry := b.getEntry(reqPath)
+		if entry != nil && entry.cold() {
+			return b.dropCold(reqPath)
+		}
+
+		err := b.FileSystemBackend.Delete(reqPath, recursive)
+		if err != nil {
+			return err
+		}
+
+		return b.updateEntry(reqPath, func(entry *tierEntry) *tierEntry {
+			return nil
+		})
+	}
+
+	if !recursive {
+		for _, entry := range b.readEntries(reqPath) {
+			if entry.cold() {
+				return errors.New("Directory not empty")
+			}
+		}
+	}
+
+	err := b.FileSystemBackend.Delete(reqPath, recursive)
+	if err != nil {
+		return err
+	}
+
+	err = b.cold.Delete(b.coldPath(reqPath), true)
+	if err != nil && !isNotFound(err) {
+		fmt.Println("Failed to remove", reqPath, "from cold storage:", err)
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	return os.RemoveAll(filepath.Join(b.manifestDir, reqPath))
+}
+
+func (b *TieredBackend) Move(srcPath, dstPath string) error {
+	srcIsDir := strings.HasSuffix(srcPath, "/")
+
+	if !srcIsDir {
+		lock := b.fileLock(srcPath)
+		lock.Lock()
+		defer lock.Unlock()
+
+		entry := b.getEntry(srcPath)
+		if entry != nil && entry.cold() {
+			return b.moveCold(srcPath, dstPath, entry)
+		}
+	}
+
+	err := b.FileSystemBackend.Move(srcPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	srcPath = strings.TrimSuffix(srcPath, "/")
+	dstPath = strings.TrimSuffix(dstPath, "/")
+
+	if !srcIsDir {
+		entry := b.getEntry(srcPath)
+		if entry == nil {
+			return nil
+		}
+		err := b.updateEntry(dstPath, func(*tierEntry) *tierEntry {
+			return entry
+		})
+		if err != nil {
+			return err
+		}
+		return b.updateEntry(srcPath, func(*tierEntry) *tierEntry {
+			return nil
+		})
+	}
+
+	_, err = b.cold.List(b.coldPath(srcPath)+"/", 1)
+	if err == nil {
+		coldDir, _ := splitItemPath(b.coldPath(dstPath))
+		err := b.cold.MakeDir(coldDir, true)
+		if err != nil {
+			return err
+		}
+		err = b.cold.Move(b.coldPath(srcPath), b.coldPath(dstPath))
+		if err != nil {
+			return err
+		}
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	srcManifest := filepath.Join(b.manifestDir, srcPath)
+	dstManifest := filepath.Join(b.manifestDir, dstPath)
+	if _, err := os.Stat(srcManifest); err == nil {
+		err := os.MkdirAll(filepath.Dir(dstManifest), 0755)
+		if err != nil {
+			return err
+		}
+		return os.Rename(srcManifest, dstManifest)
+	}
+
+	return nil
+}
+
+func (b *TieredBackend) moveCold(srcPath, dstPath string, entry *tierEntry) error {
+	if _, err := os.Stat(b.localPath(dstPath)); err == nil || b.getEntry(dstPath) != nil {
+		return &Error{
+			HttpCode: 409,
+			Message:  "Destination exists",
+		}
+	}
+
+	dstDir, _ := splitItemPath(dstPath)
+	if _, err := os.Stat(b.localPath(dstDir)); err != nil {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Destination directory not found",
+		}
+	}
+
+	coldDir, _ := splitItemPath(b.coldPath(dstPath))
+	err := b.cold.MakeDir(coldDir, true)
+	if err != nil {
+		return err
+	}
+
+	err = b.cold.Move(b.coldPath(srcPath), b.coldPath(dstPath))
+	if err != nil {
+		return err
+	}
+
+	err = b.updateEntry(dstPath, func(*tierEntry) *tierEntry {
+		return entry
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.updateEntry(srcPath, func(*tierEntry) *tierEntry {
+		return nil
+	})
+}
+
+// Moves every file which hasn't been read or written for long enough to
+// cold storage, returning how many were.
+func (b *TieredBackend) Migrate(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-time.Duration(b.rule.AfterDays) * 24 * time.Hour)
+	moved := 0
+
+	err := filepath.Walk(b.rootDir, func(fsPath string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil || !info.Mode().IsRegular() || info.Size() < b.rule.MinSize {
+			return nil
+		}
+
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+
+		reqPath := path.Clean("/" + filepath.ToSlash(strings.TrimPrefix(fsPath, b.rootDir)))
+
+		entry := b.getEntry(reqPath)
+		if entry != nil {
+			lastAccess, err := time.Parse(time.RFC3339, entry.LastAccess)
+			if err == nil && lastAccess.After(cutoff) {
+				return nil
+			}
+		}
+
+		err = b.moveToCold(reqPath)
+		if err != nil {
+			fmt.Println("Failed to move", reqPath, "to cold storage:", err)
+			return nil
+		}
+
+		moved++
+		return nil
+	})
+
+	return moved, err
+}
+
+func (b *TieredBackend) moveToCold(reqPath string) error {
+	lock := b.fileLock(reqPath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	fsPath := b.localPath(reqPath)
+
+	before, err := os.Stat(fsPath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(fsPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	coldPath := b.coldPath(reqPath)
+	coldDir, _ := splitItemPath(coldPath)
+	err = b.cold.MakeDir(coldDir, true)
+	if err != nil {
+		return err
+	}
+
+	err = b.cold.Write(coldPath, file, 0, before.Size(), true, true)
+	if err == nil {
+		// Mounts that can't be written to ignore writes
+		var coldItem *Item
+		coldItem, err = b.cold.List(coldDir, 1)
+		if err == nil {
+			_, name := splitItemPath(coldPath)
+			if child := coldItem.Children[name]; child == nil || child.Size != before.Size() {
+				err = errors.New("Not stored in cold storage")
+			}
+		}
+	}
+	if err != nil {
+		b.cold.Delete(coldPath, false)
+		return err
+	}
+
+	// Changed by something other than GemDrive while it was copied
+	after, err := os.Stat(fsPath)
+	if err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		b.cold.Delete(coldPath, false)
+		return errors.New("File changed while being moved")
+	}
+
+	err = b.updateEntry(reqPath, func(entry *tierEntry) *tierEntry {
+		if entry == nil {
+			entry = &tierEntry{}
+		}
+		entry.Size = before.Size()
+		entry.ModTime = before.ModTime().UTC().Format(time.RFC3339)
+		entry.MovedAt = time.Now().UTC().Format(time.RFC3339)
+		return entry
+	})
+	if err != nil {
+		b.cold.Delete(coldPath, false)
+		return err
+	}
+
+	return b.FileSystemBackend.Delete(reqPath, false)
+}
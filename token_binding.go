@@ -0,0 +1,137 @@
+package gemdrive
+
+import (
+	"io"
+	"net"
+	"net/http"
+)
+
+// With tokenBinding enabled, tokens issued at login only work from the
+// network they were issued to, and/or the same device. Devices identify
+// themselves with an X-GemDrive-Device header; browsers, which can't set
+// headers on navigation, get a gemdrive_device cookie at login instead. A
+// token leaked through a log or a pasted URL is then useless elsewhere.
+
+type TokenBindingConfig struct {
+	Ip bool `json:"ip,omitempty"`
+	// Prefix lengths of the networks tokens are bound to, so clients can
+	// move around within them. Default to 24 and 64.
+	Ipv4Prefix int  `json:"ipv4Prefix,omitempty"`
+	Ipv6Prefix int  `json:"ipv6Prefix,omitempty"`
+	Device     bool `json:"device,omitempty"`
+}
+
+type TokenBinding struct {
+	Network string `json:"network,omitempty"`
+	Device  string `json:"device,omitempty"`
+}
+
+var errTokenBinding = &Error{
+	HttpCode: 401,
+	Message:  "Token can't be used from here",
+}
+
+const deviceCookieName = "gemdrive_device"
+
+func requestDevice(r *http.Request) string {
+	device := r.Header.Get("X-GemDrive-Device")
+	if device != "" {
+		return device
+	}
+
+	cookie, err := r.Cookie(deviceCookieName)
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+// Describes where a request comes from, in the terms tokens are bound by.
+// Nil if binding is off.
+func (s *Server) requestBinding(r *http.Request) *TokenBinding {
+	config := s.config.TokenBinding
+	if config == nil || (!config.Ip && !config.Device) {
+		return nil
+	}
+
+	binding := &TokenBinding{}
+
+	if config.Ip {
+		ip := s.clientIp(r)
+		if ip != nil {
+			var mask net.IPMask
+			if ip.To4() != nil {
+				ip = ip.To4()
+				mask = net.CIDRMask(intOrDefault(config.Ipv4Prefix, 24), 32)
+			} else {
+				mask = net.CIDRMask(intOrDefault(config.Ipv6Prefix, 64), 128)
+			}
+
+			network := &net.IPNet{
+				IP:   ip.Mask(mask),
+				Mask: mask,
+			}
+			binding.Network = network.String()
+		}
+	}
+
+	if config.Device {
+		binding.Device = requestDevice(r)
+	}
+
+	return binding
+}
+
+// Bound tokens are only accepted from where they were bound. Turning binding
+// off stops checking.
+func (b *TokenBinding) allows(current *TokenBinding) bool {
+	if b == nil || current == nil {
+		return true
+	}
+
+	return b.Network == current.Network && b.Device == current.Device
+}
+
+// Gives browsers logging in a device id to bind to, if they don't have one.
+func (s *Server) ensureDeviceCookie(w http.ResponseWriter, r *http.Request) error {
+	config := s.config.TokenBinding
+	if config == nil || !config.Device || requestDevice(r) != "" {
+		return nil
+	}
+
+	device, err := genRandomKey()
+	if err != nil {
+		return err
+	}
+
+	cookie := &http.Cookie{
+		Name:     deviceCookieName,
+		Value:    device,
+		Secure:   s.isHttps(r),
+		HttpOnly: true,
+		MaxAge:   86400 * 365,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, cookie)
+	r.AddCookie(cookie)
+
+	return nil
+}
+
+func (s *Server) checkTokenBinding(w http.ResponseWriter, r *http.Request) bool {
+	token, err := extractToken(r)
+	if err != nil {
+		return true
+	}
+
+	if s.auth.db.GetBinding(token).allows(s.requestBinding(r)) {
+		return true
+	}
+
+	w.WriteHeader(errTokenBinding.HttpCode)
+	io.WriteString(w, errTokenBinding.Message)
+
+	return false
+}
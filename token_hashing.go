@@ -0,0 +1,68 @@
+package gemdrive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// The auth database only stores salted hashes of tokens, so a leaked copy
+// of the data dir, ie from a backup, can't be used to log in. Tokens are
+// long and random, so a fast hash is enough; the salt keeps hashes from
+// being compared across servers. Plain tokens only exist in responses at
+// the moment they're issued, which is also the only time share links and
+// service tokens can be seen.
+
+// Must be called with the lock held, or before the database is shared.
+func (db *Database) hashToken(token string) string {
+	hash := sha256.Sum256([]byte(db.TokenSalt + token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Databases written before tokens were hashed are converted on load.
+func (db *Database) hashStoredTokens() error {
+	salt, err := genRandomKey()
+	if err != nil {
+		return err
+	}
+
+	db.TokenSalt = salt
+
+	keys := make(map[string][]*Key)
+	for token, keyring := range db.Keys {
+		keys[db.hashToken(token)] = keyring
+	}
+	db.Keys = keys
+
+	expiries := make(map[string]int64)
+	for token, expiresAt := range db.Expiries {
+		expiries[db.hashToken(token)] = expiresAt
+	}
+	db.Expiries = expiries
+
+	bindings := make(map[string]*TokenBinding)
+	for token, binding := range db.Bindings {
+		bindings[db.hashToken(token)] = binding
+	}
+	db.Bindings = bindings
+
+	for _, serviceToken := range db.ServiceTokens {
+		serviceToken.Token = db.hashToken(serviceToken.Token)
+	}
+
+	for _, share := range db.Shares {
+		share.Token = db.hashToken(share.Token)
+	}
+
+	for _, session := range db.Sessions {
+		session.AccessToken = db.hashToken(session.AccessToken)
+		session.RefreshToken = db.hashToken(session.RefreshToken)
+		if session.PreviousRefreshToken != "" {
+			session.PreviousRefreshToken = db.hashToken(session.PreviousRefreshToken)
+		}
+		for i, used := range session.UsedRefreshTokens {
+			session.UsedRefreshTokens[i] = db.hashToken(used)
+		}
+	}
+
+	return nil
+}
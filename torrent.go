@@ -0,0 +1,289 @@
+package gemdrive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Large public files can be downloaded as torrents, from
+// <dir>/gemdrive/torrent/<filename>, or as magnet links with ?format=magnet.
+// The server is listed as a web seed, so downloads work without any other
+// peers, and popular files are shared between downloaders as well. Hashing
+// a file means reading all of it, so torrents are cached until the file
+// changes.
+
+const defaultTorrentMinSize = 100 * 1024 * 1024
+
+const minTorrentPieceSize = 256 * 1024
+const maxTorrentPieceSize = 16 * 1024 * 1024
+
+// Enough pieces for peers to trade, without the torrent getting large
+const targetTorrentPieces = 2000
+
+type TorrentConfig struct {
+	// Files smaller than this aren't worth it. Defaults to 100MB.
+	MinSize  int64    `json:"minSize,omitempty"`
+	Trackers []string `json:"trackers,omitempty"`
+	// Chosen from the file size by default
+	PieceSize int64 `json:"pieceSize,omitempty"`
+}
+
+type torrents struct {
+	config *TorrentConfig
+	dir    string
+	locks  [64]sync.Mutex
+}
+
+func newTorrents(config *TorrentConfig, cacheDir string) (*torrents, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	if config.MinSize == 0 {
+		config.MinSize = defaultTorrentMinSize
+	}
+
+	dir := filepath.Join(cacheDir, "torrents")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &torrents{
+		config: config,
+		dir:    dir,
+	}, nil
+}
+
+func (t *torrents) lock(key string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return &t.locks[hash.Sum32()%uint32(len(t.locks))]
+}
+
+func (t *torrents) pieceSize(size int64) int64 {
+	if t.config.PieceSize != 0 {
+		return t.config.PieceSize
+	}
+
+	pieceSize := int64(minTorrentPieceSize)
+	for size/pieceSize > targetTorrentPieces && pieceSize < maxTorrentPieceSize {
+		pieceSize *= 2
+	}
+	return pieceSize
+}
+
+// Already bencoded
+type bencoded []byte
+
+// Bencoding, as used by torrent files. Dictionary keys are sorted.
+func bencode(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case bencoded:
+		buf.Write(v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, elem := range v {
+			bencode(buf, elem)
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, key := range keys {
+			bencode(buf, key)
+			bencode(buf, v[key])
+		}
+		buf.WriteByte('e')
+	}
+}
+
+func (s *Server) serveTorrent(w http.ResponseWriter, r *http.Request, dirPath, filename string) {
+	if s.torrents == nil {
+		w.WriteHeader(404)
+		io.WriteString(w, "Torrents aren't enabled")
+		return
+	}
+
+	filePath := dirPath + filename
+
+	// Web seeds are fetched without tokens
+	if filename == "" || strings.Contains(filename, "/") || !s.auth.CanRead("", filePath) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Torrents are only made for public files")
+		return
+	}
+
+	parent, err := s.backend.List(dirPath, 1)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	item, exists := parent.Children[filename]
+	if !exists {
+		w.WriteHeader(404)
+		io.WriteString(w, "Not found")
+		return
+	}
+
+	if item.Size < s.torrents.config.MinSize {
+		w.WriteHeader(404)
+		io.WriteString(w, "File is too small to be worth a torrent")
+		return
+	}
+
+	fileUrl := s.absoluteUrl(r, strings.Split(r.URL.Path, "gemdrive/")[0]+filename, "")
+
+	torrent, infoHash, err := s.torrentFor(filePath, fileUrl, item)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	if r.URL.Query().Get("format") == "magnet" {
+		params := url.Values{}
+		params.Set("dn", filename)
+		params.Set("xl", fmt.Sprintf("%d", item.Size))
+		params.Set("ws", fileUrl)
+		for _, tracker := range s.torrents.config.Trackers {
+			params.Add("tr", tracker)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "magnet:?xt=urn:btih:"+infoHash+"&"+params.Encode())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filename+".torrent"))
+	w.Write(torrent)
+}
+
+// The torrent for a file, and its info hash.
+func (s *Server) torrentFor(filePath, fileUrl string, item *Item) ([]byte, string, error) {
+	info, err := s.torrentInfo(filePath, item)
+	if err != nil {
+		return nil, "", err
+	}
+
+	meta := map[string]interface{}{
+		"info":          bencoded(info),
+		"url-list":      []interface{}{fileUrl},
+		"created by":    "GemDrive",
+		"creation date": time.Now().Unix(),
+	}
+
+	trackers := s.torrents.config.Trackers
+	if len(trackers) > 0 {
+		meta["announce"] = trackers[0]
+
+		tiers := []interface{}{}
+		for _, tracker := range trackers {
+			tiers = append(tiers, []interface{}{tracker})
+		}
+		meta["announce-list"] = tiers
+	}
+
+	buf := &bytes.Buffer{}
+	bencode(buf, meta)
+
+	infoHash := sha1.Sum(info)
+
+	return buf.Bytes(), hex.EncodeToString(infoHash[:]), nil
+}
+
+// The bencoded info dictionary, with the piece hashes, which is what's cached.
+func (s *Server) torrentInfo(filePath string, item *Item) ([]byte, error) {
+	key := fmt.Sprintf("%s\n%d\n%s", filePath, item.Size, item.ModTime)
+	sum := sha256.Sum256([]byte(key))
+	cachePath := filepath.Join(s.torrents.dir, hex.EncodeToString(sum[:]))
+
+	lock := s.torrents.lock(filePath)
+	lock.Lock()
+	defer lock.Unlock()
+
+	info, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		return info, nil
+	}
+
+	pieceSize := s.torrents.pieceSize(item.Size)
+
+	_, data, err := s.backend.Read(filePath, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	pieces := &bytes.Buffer{}
+	piece := make([]byte, pieceSize)
+	var total int64
+	for {
+		n, err := io.ReadFull(data, piece)
+		if n > 0 {
+			hash := sha1.Sum(piece[:n])
+			pieces.Write(hash[:])
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if total != item.Size {
+		return nil, errors.New("File changed while it was being hashed")
+	}
+
+	buf := &bytes.Buffer{}
+	bencode(buf, map[string]interface{}{
+		"name":         path.Base(filePath),
+		"length":       item.Size,
+		"piece length": pieceSize,
+		"pieces":       pieces.Bytes(),
+	})
+	info = buf.Bytes()
+
+	err = ioutil.WriteFile(cachePath, info, 0644)
+	if err != nil {
+		fmt.Println("Failed to cache torrent:", err)
+	}
+
+	return info, nil
+}
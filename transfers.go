@@ -0,0 +1,205 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errTransferCancelled = errors.New("Transfer cancelled")
+
+type Transfer struct {
+	Id         string  `json:"id"`
+	Direction  string  `json:"direction"`
+	Path       string  `json:"path"`
+	Owner      string  `json:"owner,omitempty"`
+	Size       int64   `json:"size,omitempty"`
+	BytesMoved int64   `json:"bytesMoved"`
+	Rate       float64 `json:"rate"`
+	StartedAt  string  `json:"startedAt"`
+}
+
+// Counts bytes as they pass through, and fails reads once cancelled, which
+// aborts whichever copy loop is driving the transfer.
+type activeTransfer struct {
+	id        string
+	direction string
+	path      string
+	owner     string
+	token     string
+	size      int64
+	startedAt time.Time
+	reader    io.Reader
+	moved     int64
+	cancelled int32
+}
+
+func (t *activeTransfer) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&t.cancelled) == 1 {
+		return 0, errTransferCancelled
+	}
+
+	n, err := t.reader.Read(p)
+	atomic.AddInt64(&t.moved, int64(n))
+	return n, err
+}
+
+func (t *activeTransfer) snapshot() *Transfer {
+	moved := atomic.LoadInt64(&t.moved)
+
+	var rate float64
+	elapsed := time.Since(t.startedAt).Seconds()
+	if elapsed > 0 {
+		rate = float64(moved) / elapsed
+	}
+
+	return &Transfer{
+		Id:         t.id,
+		Direction:  t.direction,
+		Path:       t.path,
+		Owner:      t.owner,
+		Size:       t.size,
+		BytesMoved: moved,
+		Rate:       rate,
+		StartedAt:  t.startedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+type transferTracker struct {
+	transfers map[string]*activeTransfer
+	nextId    uint64
+	mut       *sync.Mutex
+}
+
+func newTransferTracker() *transferTracker {
+	return &transferTracker{
+		transfers: make(map[string]*activeTransfer),
+		mut:       &sync.Mutex{},
+	}
+}
+
+// Starts tracking a transfer. Callers read through the returned transfer and
+// must call finish when done.
+func (t *transferTracker) start(direction, path, owner, token string, size int64, reader io.Reader) *activeTransfer {
+	transfer := &activeTransfer{
+		direction: direction,
+		path:      path,
+		owner:     owner,
+		token:     token,
+		size:      size,
+		startedAt: time.Now(),
+		reader:    reader,
+	}
+
+	t.mut.Lock()
+	t.nextId++
+	transfer.id = strconv.FormatUint(t.nextId, 10)
+	t.transfers[transfer.id] = transfer
+	t.mut.Unlock()
+
+	return transfer
+}
+
+func (t *transferTracker) finish(transfer *activeTransfer) {
+	t.mut.Lock()
+	delete(t.transfers, transfer.id)
+	t.mut.Unlock()
+}
+
+func (t *transferTracker) count() int {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return len(t.transfers)
+}
+
+// Lists active transfers, or only those belonging to the requester unless
+// all is set.
+func (t *transferTracker) list(owner, token string, all bool) []*Transfer {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	transfers := []*Transfer{}
+	for _, transfer := range t.transfers {
+		if all || transfer.belongsTo(owner, token) {
+			transfers = append(transfers, transfer.snapshot())
+		}
+	}
+
+	sort.Slice(transfers, func(i, j int) bool {
+		return transfers[i].StartedAt < transfers[j].StartedAt
+	})
+
+	return transfers
+}
+
+func (t *transferTracker) cancel(id, owner, token string, all bool) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	transfer, exists := t.transfers[id]
+	if !exists || !(all || transfer.belongsTo(owner, token)) {
+		return &Error{
+			HttpCode: 404,
+			Message:  "Transfer not found",
+		}
+	}
+
+	atomic.StoreInt32(&transfer.cancelled, 1)
+
+	return nil
+}
+
+func (t *activeTransfer) belongsTo(owner, token string) bool {
+	if token != "" && t.token == token {
+		return true
+	}
+	return owner != "" && t.owner == owner
+}
+
+func (s *Server) startTransfer(r *http.Request, direction, path string, size int64, reader io.Reader) *activeTransfer {
+	token, _ := extractToken(r)
+	owner := strings.Join(s.auth.Principals(token), ",")
+	return s.transfers.start(direction, path, owner, token, size, reader)
+}
+
+// Handles gemdrive/transfers[/<id>] for the requester's own transfers, and
+// gemdrive/admin/transfers[/<id>] for everyone's.
+func (s *Server) handleTransfers(w http.ResponseWriter, r *http.Request, id string, all bool) {
+
+	token, _ := extractToken(r)
+
+	if all && !s.auth.CanOwn(token, "/") {
+		s.sendLoginPage(w, r)
+		return
+	}
+
+	owner := strings.Join(s.auth.Principals(token), ",")
+
+	switch r.Method {
+	case "GET":
+		jsonBody, err := json.Marshal(s.transfers.list(owner, token, all))
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBody)
+	case "DELETE":
+		err := s.transfers.cancel(id, owner, token, all)
+		if e, ok := err.(*Error); ok {
+			w.WriteHeader(e.HttpCode)
+			io.WriteString(w, e.Message)
+			return
+		}
+	default:
+		w.WriteHeader(405)
+	}
+}
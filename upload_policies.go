@@ -0,0 +1,245 @@
+package gemdrive
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Upload policies limit what can be uploaded into a directory and
+// everything under it, and tidy up the names files are uploaded with. The
+// deepest policy covering a path applies. Names are changed by:
+//
+//   lowercase     - lowercasing them
+//   replaceSpaces - replacing spaces with the given string, ie "_"
+//   safeNames     - replacing characters Windows doesn't allow, like : and ?,
+//                   with _, and dropping trailing dots and spaces
+//   autoRename    - adding a number, ie photo-1.jpg, to names already taken
+//                   rather than failing
+//
+// When a file ends up with a different name than it was uploaded with, the
+// response's Location header has its URL.
+
+type UploadPolicy struct {
+	Path string `json:"path"`
+	// Accepted file types, ie [".jpg", ".png"]. Anything if empty.
+	Extensions    []string `json:"extensions,omitempty"`
+	MaxSize       int64    `json:"maxSize,omitempty"`
+	Lowercase     bool     `json:"lowercase,omitempty"`
+	ReplaceSpaces string   `json:"replaceSpaces,omitempty"`
+	SafeNames     bool     `json:"safeNames,omitempty"`
+	AutoRename    bool     `json:"autoRename,omitempty"`
+}
+
+// Names tried before giving up on finding a free one
+const maxAutoRenames = 1000
+
+func uploadPolicyFor(policies []*UploadPolicy, reqPath string) *UploadPolicy {
+	var found *UploadPolicy
+	foundLen := -1
+
+	for _, policy := range policies {
+		dirPath := strings.TrimSuffix(path.Clean("/"+policy.Path), "/") + "/"
+		if strings.HasPrefix(reqPath, dirPath) && len(dirPath) > foundLen {
+			found = policy
+			foundLen = len(dirPath)
+		}
+	}
+
+	return found
+}
+
+func (p *UploadPolicy) rename(name string) string {
+	if p.Lowercase {
+		name = strings.ToLower(name)
+	}
+
+	if p.ReplaceSpaces != "" {
+		name = strings.ReplaceAll(name, " ", p.ReplaceSpaces)
+	}
+
+	if p.SafeNames {
+		name = strings.Map(func(c rune) rune {
+			if c < 0x20 || strings.ContainsRune(`<>:"\|?*`, c) {
+				return '_'
+			}
+			return c
+		}, name)
+		name = strings.TrimRight(name, ". ")
+	}
+
+	if name == "" {
+		name = "_"
+	}
+
+	return name
+}
+
+func (p *UploadPolicy) accepts(name string) bool {
+	if len(p.Extensions) == 0 {
+		return true
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	for _, allowed := range p.Extensions {
+		allowed = strings.ToLower(allowed)
+		if !strings.HasPrefix(allowed, ".") {
+			allowed = "." + allowed
+		}
+		if ext == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *UploadPolicy) check(name string, size int64) error {
+	if !p.accepts(name) {
+		return &Error{
+			HttpCode: 400,
+			Message:  "File type not accepted here",
+		}
+	}
+
+	if p.MaxSize != 0 && size > p.MaxSize {
+		return &Error{
+			HttpCode: 413,
+			Message:  "Upload exceeds the maximum size here",
+		}
+	}
+
+	return nil
+}
+
+// Checks a file upload against the policy covering it, returning the path
+// it should be written to.
+func (s *Server) applyUploadPolicy(r *http.Request, reqPath string) (string, error) {
+	size := r.ContentLength
+	replacing := r.URL.Query().Get("overwrite") == "true"
+
+	// Later ranges of an upload go to the file its first one created. The
+	// file is at least as big as where this range ends, even when the total
+	// isn't given.
+	contentRange := r.Header.Get("Content-Range")
+	if contentRange != "" {
+		replacing = true
+		if _, total, err := parseContentRange(contentRange); err == nil {
+			size = total
+		} else if end, ok := contentRangeEnd(contentRange); ok {
+			size = end + 1
+		}
+	}
+
+	return s.checkUploadPolicy(reqPath, size, replacing)
+}
+
+// Checks that size bytes may be written to reqPath, returning the path they
+// should go to. Only files not replacing others are auto renamed.
+func (s *Server) checkUploadPolicy(reqPath string, size int64, replacing bool) (string, error) {
+	policy := uploadPolicyFor(s.config.UploadPolicies, reqPath)
+	if policy == nil {
+		return reqPath, nil
+	}
+
+	dirPath, name := path.Split(reqPath)
+	name = policy.rename(name)
+	reqPath = dirPath + name
+
+	err := policy.check(name, size)
+	if err != nil {
+		return "", err
+	}
+
+	if !policy.AutoRename || replacing {
+		return reqPath, nil
+	}
+
+	parent, err := s.backend.List(dirPath, 1)
+	if isNotFound(err) {
+		return reqPath, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; parent.Children[candidate] != nil; i++ {
+		if i > maxAutoRenames {
+			return "", &Error{
+				HttpCode: 409,
+				Message:  "File exists",
+			}
+		}
+		candidate = base + "-" + strconv.Itoa(i) + ext
+	}
+
+	return dirPath + candidate, nil
+}
+
+func contentRangeEnd(header string) (int64, bool) {
+	rang := strings.Split(strings.TrimPrefix(header, "bytes "), "/")[0]
+	bounds := strings.Split(rang, "-")
+	if len(bounds) != 2 {
+		return 0, false
+	}
+
+	end, err := strconv.ParseInt(bounds[1], 10, 64)
+	return end, err == nil && end >= 0
+}
+
+// Checks what a file already holding size bytes may be changed or moved to,
+// without renaming it.
+func (s *Server) checkFilePolicy(reqPath string, size int64) error {
+	policy := uploadPolicyFor(s.config.UploadPolicies, reqPath)
+	if policy == nil {
+		return nil
+	}
+	return policy.check(path.Base(reqPath), size)
+}
+
+// Moves can't be used to put files where uploading them would be refused,
+// ie renaming evil.txt to evil.exe.
+func (s *Server) checkMovePolicy(srcPath, destPath string) error {
+	if len(s.config.UploadPolicies) == 0 {
+		return nil
+	}
+
+	if strings.HasSuffix(srcPath, "/") {
+		item, err := s.backend.List(srcPath, 0)
+		if err != nil {
+			return err
+		}
+		return s.checkTreePolicy(item, destPath)
+	}
+
+	dirPath, name := path.Split(srcPath)
+	parent, err := s.backend.List(dirPath, 1)
+	if err != nil {
+		return err
+	}
+
+	item, exists := parent.Children[name]
+	if !exists {
+		return nil
+	}
+	return s.checkFilePolicy(destPath, item.Size)
+}
+
+func (s *Server) checkTreePolicy(item *Item, destDir string) error {
+	for name, child := range item.Children {
+		var err error
+		if !strings.HasSuffix(name, "/") {
+			err = s.checkFilePolicy(destDir+name, child.Size)
+		} else if child != nil {
+			err = s.checkTreePolicy(child, destDir+name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
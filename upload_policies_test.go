@@ -0,0 +1,77 @@
+package gemdrive
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadPolicyCantBeBypassed(t *testing.T) {
+	dir := t.TempDir()
+
+	filesDir := filepath.Join(dir, "files")
+	err := os.MkdirAll(filesDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(filesDir, "notes.txt"), []byte("notes"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(&Config{
+		Dirs:       []string{filesDir},
+		DataDir:    filepath.Join(dir, "data"),
+		CacheDir:   filepath.Join(dir, "cache"),
+		AdminEmail: "owner@example.com",
+		UploadPolicies: []*UploadPolicy{
+			{Path: "/files/", Extensions: []string{".txt"}, MaxSize: 10},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := server.auth.AddEphemeralKeyring([]*Key{
+		{IdType: "email", Id: "owner@example.com", Perm: "own", Path: "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method  string
+		path    string
+		body    string
+		headers map[string]string
+		want    int
+	}{
+		{"POST", "/gemdrive/chunked-uploads", `{"path": "/files/evil.exe", "size": 5}`, nil, 400},
+		{"POST", "/gemdrive/chunked-uploads", `{"path": "/files/big.txt", "size": 11}`, nil, 413},
+		{"MOVE", "/files/notes.txt", "", map[string]string{"Destination": "/files/notes.exe"}, 400},
+		{"PUT", "/files/big.txt", "12345", map[string]string{"Content-Range": "bytes 20-24/*"}, 413},
+		{"PATCH", "/files/notes.txt?offset=20", "12345", map[string]string{"Content-Length": "5"}, 413},
+		{"PATCH", "/files/notes.txt?offset=4", "S", map[string]string{"Content-Length": "1"}, 200},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		if w.Code != test.want {
+			t.Errorf("%s %s got %d %s, want %d", test.method, test.path, w.Code, w.Body.String(), test.want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(filesDir, "notes.txt")); err != nil {
+		t.Error("notes.txt was moved")
+	}
+}
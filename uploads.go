@@ -0,0 +1,394 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every file records who created it, in the data dir next to the ACLs, ie
+// DataDir/<dir>/gemdrive/uploads.json. Tokens with "upload" permission on a
+// directory can add files to it and change or delete the ones they added,
+// but nothing else, which is what shared drop-box folders need. Anyone who
+// can list a directory can see who uploaded what with
+// <dir>/gemdrive/uploads.json?owner=<principal>; uploaders only see their
+// own.
+
+type Upload struct {
+	Path      string   `json:"path"`
+	Owners    []string `json:"owners"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+type uploadRecord struct {
+	Owners    []string `json:"owners"`
+	CreatedAt string   `json:"createdAt"`
+}
+
+type uploadStore struct {
+	dataDir string
+	mut     *sync.Mutex
+	cluster *cluster
+}
+
+func newUploadStore(dataDir string, cluster *cluster) *uploadStore {
+	return &uploadStore{
+		dataDir: dataDir,
+		mut:     &sync.Mutex{},
+		cluster: cluster,
+	}
+}
+
+func (u *uploadStore) recordsPath(dirPath string) string {
+	return filepath.Join(u.dataDir, dirPath, "gemdrive", "uploads.json")
+}
+
+// Splits a path into its parent directory and the name it's recorded under.
+// Directories keep their trailing slash.
+func splitItemPath(reqPath string) (string, string) {
+	isDir := strings.HasSuffix(reqPath, "/")
+	trimmed := strings.TrimSuffix(reqPath, "/")
+
+	parent := path.Dir(trimmed)
+	if parent != "/" {
+		parent += "/"
+	}
+
+	name := path.Base(trimmed)
+	if isDir {
+		name += "/"
+	}
+
+	return parent, name
+}
+
+func (u *uploadStore) readRecords(dirPath string) map[string]*uploadRecord {
+	records := make(map[string]*uploadRecord)
+
+	recordsJson, err := ioutil.ReadFile(u.recordsPath(dirPath))
+	if err != nil {
+		return records
+	}
+
+	err = json.Unmarshal(recordsJson, &records)
+	if err != nil {
+		fmt.Println("Ignoring invalid upload records in", dirPath, err)
+		return make(map[string]*uploadRecord)
+	}
+
+	return records
+}
+
+func (u *uploadStore) writeRecords(dirPath string, records map[string]*uploadRecord) error {
+	recordsPath := u.recordsPath(dirPath)
+
+	if len(records) == 0 {
+		err := os.Remove(recordsPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(recordsPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return saveJson(records, recordsPath)
+}
+
+// Records owners as the creators of reqPath, replacing any earlier record.
+func (u *uploadStore) record(reqPath string, owners []string) error {
+	if len(owners) == 0 {
+		return nil
+	}
+
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	defer u.cluster.lock("uploads")()
+
+	dirPath, name := splitItemPath(reqPath)
+
+	records := u.readRecords(dirPath)
+	records[name] = &uploadRecord{
+		Owners:    owners,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	return u.writeRecords(dirPath, records)
+}
+
+func (u *uploadStore) isOwner(reqPath string, principals []string) bool {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+
+	dirPath, name := splitItemPath(reqPath)
+
+	record, exists := u.readRecords(dirPath)[name]
+	if !exists {
+		return false
+	}
+
+	return sharesString(record.Owners, principals)
+}
+
+// Forgets reqPath, and for directories everything recorded beneath it.
+func (u *uploadStore) remove(reqPath string) error {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	defer u.cluster.lock("uploads")()
+
+	if strings.HasSuffix(reqPath, "/") {
+		err := u.removeTree(reqPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	dirPath, name := splitItemPath(reqPath)
+
+	records := u.readRecords(dirPath)
+	if _, exists := records[name]; !exists {
+		return nil
+	}
+	delete(records, name)
+
+	return u.writeRecords(dirPath, records)
+}
+
+func (u *uploadStore) removeTree(dirPath string) error {
+	return u.walk(dirPath, func(subDir string) error {
+		err := os.Remove(u.recordsPath(subDir))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Calls fn with every directory under dirPath, itself included, which has
+// upload records.
+func (u *uploadStore) walk(dirPath string, fn func(subDir string) error) error {
+	return walkRecordDirs(u.dataDir, dirPath, "uploads.json", fn)
+}
+
+// Calls fn with every directory under dirPath, itself included, which has a
+// gemdrive/<fileName> in the data dir.
+func walkRecordDirs(dataDir, dirPath, fileName string, fn func(subDir string) error) error {
+	root := filepath.Join(dataDir, dirPath)
+
+	var subDirs []string
+
+	err := filepath.Walk(root, func(fsPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() || info.Name() != fileName || filepath.Base(filepath.Dir(fsPath)) != "gemdrive" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filepath.Dir(filepath.Dir(fsPath)))
+		if err != nil {
+			return err
+		}
+
+		subDir := dirPath
+		if rel != "." {
+			subDir += filepath.ToSlash(rel) + "/"
+		}
+
+		subDirs = append(subDirs, subDir)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, subDir := range subDirs {
+		err := fn(subDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Carries records along with a moved file or directory.
+func (u *uploadStore) move(srcPath, dstPath string) error {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	defer u.cluster.lock("uploads")()
+
+	if strings.HasSuffix(srcPath, "/") {
+		err := u.walk(srcPath, func(subDir string) error {
+			dstDir := dstPath + strings.TrimPrefix(subDir, srcPath)
+
+			err := os.MkdirAll(filepath.Dir(u.recordsPath(dstDir)), 0755)
+			if err != nil {
+				return err
+			}
+
+			return os.Rename(u.recordsPath(subDir), u.recordsPath(dstDir))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	srcDir, srcName := splitItemPath(srcPath)
+
+	srcRecords := u.readRecords(srcDir)
+	record, exists := srcRecords[srcName]
+	if !exists {
+		return nil
+	}
+	delete(srcRecords, srcName)
+
+	err := u.writeRecords(srcDir, srcRecords)
+	if err != nil {
+		return err
+	}
+
+	dstDir, dstName := splitItemPath(dstPath)
+
+	dstRecords := u.readRecords(dstDir)
+	dstRecords[dstName] = record
+
+	return u.writeRecords(dstDir, dstRecords)
+}
+
+// Lists everything recorded under dirPath, or only what was uploaded by one
+// of owners if there are any.
+func (u *uploadStore) list(dirPath string, owners []string) ([]*Upload, error) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+
+	uploads := []*Upload{}
+
+	err := u.walk(dirPath, func(subDir string) error {
+		for name, record := range u.readRecords(subDir) {
+			if len(owners) != 0 && !sharesString(record.Owners, owners) {
+				continue
+			}
+
+			uploads = append(uploads, &Upload{
+				Path:      subDir + name,
+				Owners:    record.Owners,
+				CreatedAt: record.CreatedAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Path < uploads[j].Path
+	})
+
+	return uploads, nil
+}
+
+func sharesString(a, b []string) bool {
+	for _, itemA := range a {
+		for _, itemB := range b {
+			if itemA == itemB {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Uploaders can only change or delete files they created.
+func (s *Server) canModify(token, reqPath string) bool {
+	if s.auth.CanModify(token, reqPath) {
+		return true
+	}
+
+	return s.ownsUpload(token, reqPath)
+}
+
+func (s *Server) canDelete(token, reqPath string) bool {
+	if s.auth.CanDelete(token, reqPath) {
+		return true
+	}
+
+	return s.ownsUpload(token, reqPath)
+}
+
+func (s *Server) ownsUpload(token, reqPath string) bool {
+	if !s.auth.Can(token, reqPath, actModifyOwn) {
+		return false
+	}
+
+	return s.uploads.isOwner(reqPath, s.auth.Principals(token))
+}
+
+func (s *Server) recordUpload(token, reqPath string) {
+	err := s.uploads.record(reqPath, s.auth.Principals(token))
+	if err != nil {
+		fmt.Println("Failed to record upload:", err)
+	}
+}
+
+// Handles <dir>/gemdrive/uploads.json
+func (s *Server) serveUploads(w http.ResponseWriter, r *http.Request, dirPath string) {
+	token, _ := extractToken(r)
+
+	var owners []string
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		owners = []string{owner}
+	}
+
+	if !s.auth.CanList(token, dirPath) {
+		if !s.auth.CanCreate(token, dirPath) {
+			s.sendLoginPage(w, r)
+			return
+		}
+
+		principals := s.auth.Principals(token)
+
+		if owners == nil {
+			owners = principals
+		} else if !sharesString(owners, principals) {
+			w.WriteHeader(403)
+			io.WriteString(w, "Uploaders can only list their own uploads")
+			return
+		}
+	}
+
+	uploads, err := s.uploads.list(dirPath, owners)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	jsonBody, err := json.Marshal(uploads)
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBody)
+}
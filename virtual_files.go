@@ -0,0 +1,240 @@
+package gemdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Virtual files are listed in directories along with their regular files,
+// but their contents are computed from the directory each time they're
+// read, ie a manifest.json or du.txt. They're added from Go with
+// Server.AddVirtualFile, or configured as templates:
+//
+//	{"path": "/music/", "name": "index.txt", "template": "{{range $name, $item := .Item.Children}}{{$name}}\n{{end}}"}
+//
+// Templates are executed with the directory's Path and its Item, listed one
+// level deep. A regular file with the same name takes precedence.
+
+type VirtualFileConfig struct {
+	// Every directory under this path gets the file. Defaults to all of them.
+	Path     string `json:"path,omitempty"`
+	Name     string `json:"name"`
+	Template string `json:"template"`
+}
+
+// Computes the contents of a virtual file for the directory at dirPath.
+// The backend doesn't include virtual files.
+type VirtualFileFunc func(backend Backend, dirPath string) ([]byte, error)
+
+type virtualFile struct {
+	dirPrefix string
+	name      string
+	compute   VirtualFileFunc
+}
+
+type virtualFiles struct {
+	files []*virtualFile
+	mut   *sync.RWMutex
+}
+
+type virtualFileTemplateData struct {
+	Path string
+	Item *Item
+}
+
+var virtualFileFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		jsonBytes, err := json.MarshalIndent(value, "", "  ")
+		return string(jsonBytes), err
+	},
+}
+
+func newVirtualFiles(configs []*VirtualFileConfig) (*virtualFiles, error) {
+	vf := &virtualFiles{
+		files: []*virtualFile{},
+		mut:   &sync.RWMutex{},
+	}
+
+	for _, config := range configs {
+		tmpl, err := template.New(config.Name).Funcs(virtualFileFuncs).Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("Virtual file %s: %s", config.Name, err)
+		}
+
+		compute := func(backend Backend, dirPath string) ([]byte, error) {
+			item, err := backend.List(dirPath, 1)
+			if err != nil {
+				return nil, err
+			}
+
+			var buf bytes.Buffer
+			err = tmpl.Execute(&buf, &virtualFileTemplateData{
+				Path: dirPath,
+				Item: item,
+			})
+			return buf.Bytes(), err
+		}
+
+		err = vf.add(config.Path, config.Name, compute)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return vf, nil
+}
+
+func (vf *virtualFiles) add(dirPrefix, name string, compute VirtualFileFunc) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid virtual file name %s", name)
+	}
+
+	if dirPrefix == "" {
+		dirPrefix = "/"
+	}
+
+	vf.mut.Lock()
+	defer vf.mut.Unlock()
+
+	vf.files = append(vf.files, &virtualFile{
+		dirPrefix: strings.TrimSuffix(dirPrefix, "/") + "/",
+		name:      name,
+		compute:   compute,
+	})
+
+	return nil
+}
+
+// The virtual files of a directory. The first of each name wins.
+func (vf *virtualFiles) forDir(dirPath string) []*virtualFile {
+	if vf == nil || dirPath == "/" {
+		return nil
+	}
+
+	vf.mut.RLock()
+	defer vf.mut.RUnlock()
+
+	files := []*virtualFile{}
+	names := make(map[string]bool)
+	for _, file := range vf.files {
+		if strings.HasPrefix(dirPath, file.dirPrefix) && !names[file.name] {
+			files = append(files, file)
+			names[file.name] = true
+		}
+	}
+	return files
+}
+
+func (vf *virtualFiles) find(reqPath string) *virtualFile {
+	dirPath, name := splitItemPath(reqPath)
+	for _, file := range vf.forDir(dirPath) {
+		if file.name == name {
+			return file
+		}
+	}
+	return nil
+}
+
+// Virtual files change whenever anything in their directory does.
+func newestModTime(dir *Item) string {
+	modTime := dir.ModTime
+	for _, child := range dir.Children {
+		if child.ModTime > modTime {
+			modTime = child.ModTime
+		}
+	}
+	return modTime
+}
+
+// Adds the virtual files to a listing of dirPath, and to the directories
+// within it that were listed.
+func (vf *virtualFiles) addTo(backend Backend, dirPath string, dir *Item, depth int) error {
+	files := vf.forDir(dirPath)
+
+	if len(files) > 0 && dir.Children == nil {
+		dir.Children = make(map[string]*Item)
+	}
+
+	for _, file := range files {
+		if dir.Children[file.name] != nil {
+			continue
+		}
+
+		contents, err := file.compute(backend, dirPath)
+		if err != nil {
+			return err
+		}
+
+		dir.Children[file.name] = &Item{
+			Size:    int64(len(contents)),
+			ModTime: newestModTime(dir),
+		}
+	}
+
+	if depth == 1 {
+		return nil
+	}
+
+	nextDepth := depth - 1
+	if depth == 0 {
+		nextDepth = 0
+	}
+
+	for name, child := range dir.Children {
+		if strings.HasSuffix(name, "/") && child != nil && child.Children != nil {
+			err := vf.addTo(backend, dirPath+name, child, nextDepth)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (vf *virtualFiles) read(backend Backend, file *virtualFile, reqPath string, offset, length int64) (*Item, io.ReadCloser, error) {
+	dirPath, _ := splitItemPath(reqPath)
+
+	dir, err := backend.List(dirPath, 1)
+	if isNotFound(err) {
+		return nil, nil, &Error{
+			HttpCode: 404,
+			Message:  "Not found",
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	contents, err := file.compute(backend, dirPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	size := int64(len(contents))
+	if offset > size {
+		offset = size
+	}
+	end := size
+	if length != 0 && offset+length < size {
+		end = offset + length
+	}
+
+	item := &Item{
+		Size:    size,
+		ModTime: newestModTime(dir),
+	}
+
+	return item, ioutil.NopCloser(bytes.NewReader(contents[offset:end])), nil
+}
+
+// Adds a virtual file named name to every directory under dirPrefix. Files
+// added first take precedence over later ones with the same name.
+func (s *Server) AddVirtualFile(dirPrefix, name string, compute VirtualFileFunc) error {
+	return s.virtualFiles.add(dirPrefix, name, compute)
+}
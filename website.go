@@ -0,0 +1,66 @@
+package gemdrive
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Mounts in website mode are served like a static site. A page can be linked
+// without its .html, and anything else missing, including directories
+// without an index.html, gets the mount's 404.html with a 404.
+
+func mountName(reqPath string) string {
+	parts := strings.Split(reqPath, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// Serves what a website has instead of reqPath, if it doesn't exist.
+// Returns false if it does.
+func (s *Server) serveWebsiteFallback(w http.ResponseWriter, r *http.Request, reqPath, token string) bool {
+	_, exists, err := s.itemSize(reqPath)
+	if err != nil || exists {
+		return false
+	}
+
+	if path.Ext(reqPath) == "" {
+		pagePath := reqPath + ".html"
+		_, pageExists, err := s.itemSize(pagePath)
+		if err == nil && pageExists && s.auth.CanRead(token, pagePath) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			s.serveFile(w, r, pagePath)
+			return true
+		}
+	}
+
+	s.serveWebsiteNotFound(w, r, reqPath, token)
+	return true
+}
+
+func (s *Server) serveWebsiteNotFound(w http.ResponseWriter, r *http.Request, reqPath, token string) {
+	notFoundPath := "/" + mountName(reqPath) + "/404.html"
+
+	if s.auth.CanRead(token, notFoundPath) {
+		_, data, err := s.requestBackend(r).Read(notFoundPath, 0, 0)
+		if err == nil {
+			defer data.Close()
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(404)
+			_, err = io.Copy(w, data)
+			if err != nil {
+				fmt.Println(err)
+			}
+			return
+		}
+	}
+
+	w.Header().Del("Content-Type")
+	w.WriteHeader(404)
+	io.WriteString(w, "Not found")
+}
@@ -0,0 +1,72 @@
+package gemdrive
+
+import (
+	"path/filepath"
+)
+
+// With xattrs enabled, attributes are the files' user.* extended attributes,
+// without the prefix, so labels set by other tools show up through the
+// attrs API and the other way round. Values that aren't text are left
+// alone, and filesystems without xattr support fall back to the data dir.
+
+func (fs *FileSystemBackend) GetAttrs(reqPath string) (map[string]string, error) {
+	if !fs.xattrs {
+		return nil, errNoNativeAttrs
+	}
+
+	fsPath, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return getXattrs(fsPath)
+}
+
+func (fs *FileSystemBackend) SetAttrs(reqPath string, attrs map[string]string) error {
+	if !fs.xattrs {
+		return errNoNativeAttrs
+	}
+
+	fsPath, err := fs.checkedPath(reqPath)
+	if err != nil {
+		return err
+	}
+
+	return setXattrs(fsPath, attrs)
+}
+
+func (fs *FileSystemBackend) ListAttrs(dirPath string) (map[string]map[string]string, error) {
+	if !fs.xattrs {
+		return nil, errNoNativeAttrs
+	}
+
+	fsDir, err := fs.checkedPath(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ReadDir(fsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]map[string]string)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		attrs, err := getXattrs(filepath.Join(fsDir, file.Name()))
+		if err == errNoNativeAttrs {
+			return nil, err
+		} else if err != nil {
+			continue
+		}
+
+		if len(attrs) > 0 {
+			records[file.Name()] = attrs
+		}
+	}
+
+	return records, nil
+}
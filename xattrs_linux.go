@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package gemdrive
+
+import (
+	"strings"
+	"syscall"
+	"unicode/utf8"
+)
+
+const xattrPrefix = "user."
+
+func getXattrs(fsPath string) (map[string]string, error) {
+	size, err := syscall.Listxattr(fsPath, nil)
+	if err != nil {
+		return nil, xattrError(err)
+	}
+
+	attrs := make(map[string]string)
+	if size == 0 {
+		return attrs, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(fsPath, buf)
+	if err != nil {
+		return nil, xattrError(err)
+	}
+
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if !strings.HasPrefix(name, xattrPrefix) {
+			continue
+		}
+
+		value, err := getXattr(fsPath, name)
+		if err == syscall.ENODATA {
+			continue
+		} else if err != nil {
+			return nil, xattrError(err)
+		}
+
+		if utf8.Valid(value) {
+			attrs[strings.TrimPrefix(name, xattrPrefix)] = string(value)
+		}
+	}
+
+	return attrs, nil
+}
+
+func getXattr(fsPath, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(fsPath, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(fsPath, name, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:size], nil
+}
+
+// Replaces the text user xattrs with attrs.
+func setXattrs(fsPath string, attrs map[string]string) error {
+	existing, err := getXattrs(fsPath)
+	if err != nil {
+		return err
+	}
+
+	for key := range existing {
+		if _, keep := attrs[key]; keep {
+			continue
+		}
+
+		err := syscall.Removexattr(fsPath, xattrPrefix+key)
+		if err != nil && err != syscall.ENODATA {
+			return xattrError(err)
+		}
+	}
+
+	for key, value := range attrs {
+		if old, exists := existing[key]; exists && old == value {
+			continue
+		}
+
+		err := syscall.Setxattr(fsPath, xattrPrefix+key, []byte(value), 0)
+		if err != nil {
+			return xattrError(err)
+		}
+	}
+
+	return nil
+}
+
+func xattrError(err error) error {
+	switch err {
+	case syscall.ENOTSUP:
+		return errNoNativeAttrs
+	case syscall.ERANGE, syscall.E2BIG, syscall.ENOSPC:
+		return &Error{
+			HttpCode: 413,
+			Message:  "Attributes too large for the filesystem",
+		}
+	}
+	return err
+}
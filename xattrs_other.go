@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package gemdrive
+
+func getXattrs(fsPath string) (map[string]string, error) {
+	return nil, errNoNativeAttrs
+}
+
+func setXattrs(fsPath string, attrs map[string]string) error {
+	return errNoNativeAttrs
+}
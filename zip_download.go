@@ -0,0 +1,261 @@
+package gemdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Several files and directories can be downloaded as one zip, with a POST to
+// <dir>/gemdrive/archive listing their paths relative to dir, either as JSON
+//
+//	{"paths": ["notes.txt", "photos/"], "name": "selection.zip"}
+//
+// or as repeated path fields of a form, so a page can start the download
+// with a plain form submission. A GET with path and name query parameters
+// works too, for download managers, which can then resume it with a Range.
+// Everything is checked before anything is sent. Entries are stored
+// uncompressed, since the files people download in bulk are mostly
+// compressed already, which also makes the zip's size known up front.
+
+type archiveRequest struct {
+	Paths []string `json:"paths"`
+	Name  string   `json:"name,omitempty"`
+}
+
+func parseArchiveRequest(r *http.Request) (*archiveRequest, error) {
+	req := &archiveRequest{}
+
+	if r.Method == "GET" {
+		query := r.URL.Query()
+		req.Paths = query["path"]
+		req.Name = query.Get("name")
+	} else if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			return nil, &Error{
+				HttpCode: 400,
+				Message:  "Invalid archive request",
+			}
+		}
+	} else {
+		err := r.ParseForm()
+		if err != nil {
+			return nil, &Error{
+				HttpCode: 400,
+				Message:  "Invalid archive request",
+			}
+		}
+		req.Paths = r.PostForm["path"]
+		req.Name = r.PostForm.Get("name")
+	}
+
+	if len(req.Paths) == 0 {
+		return nil, &Error{
+			HttpCode: 400,
+			Message:  "No paths to archive",
+		}
+	}
+
+	name := strings.Trim(path.Base("/"+req.Name), "\"")
+	if name == "/" || name == "" {
+		name = "download.zip"
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".zip") {
+		name += ".zip"
+	}
+	req.Name = name
+
+	return req, nil
+}
+
+func (s *Server) serveArchiveDownload(w http.ResponseWriter, r *http.Request, dirPath string) {
+	token, _ := extractToken(r)
+
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Method not allowed")
+		return
+	}
+
+	req, err := parseArchiveRequest(r)
+	if e, ok := err.(*Error); ok {
+		w.WriteHeader(e.HttpCode)
+		io.WriteString(w, e.Message)
+		return
+	}
+
+	itemPaths := []string{}
+	for _, relPath := range req.Paths {
+		itemPath := path.Clean(dirPath + relPath)
+		if strings.HasSuffix(relPath, "/") {
+			itemPath += "/"
+		}
+
+		if !strings.HasPrefix(itemPath, dirPath) || itemPath == dirPath {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid path "+relPath)
+			return
+		}
+
+		if !s.auth.CanRead(token, itemPath) {
+			s.sendLoginPage(w, r)
+			return
+		}
+
+		if !canReadRaw(s.config.Exports, s.auth, token, itemPath) {
+			w.WriteHeader(errNoRawAccess.HttpCode)
+			io.WriteString(w, errNoRawAccess.Message)
+			return
+		}
+
+		var exists bool
+		if strings.HasSuffix(itemPath, "/") {
+			_, err = s.backend.List(itemPath, 1)
+			exists = err == nil
+			if isNotFound(err) {
+				err = nil
+			}
+		} else {
+			_, exists, err = s.itemSize(itemPath)
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		if !exists {
+			w.WriteHeader(404)
+			io.WriteString(w, "Not found: "+relPath)
+			return
+		}
+
+		itemPaths = append(itemPaths, itemPath)
+	}
+
+	entries := []*zipEntry{}
+	for _, itemPath := range itemPaths {
+		entries, err = s.archiveEntries(r, token, dirPath, itemPath, nil, entries)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+
+	layout := newZipLayout(entries)
+
+	header := w.Header()
+	header.Set("Content-Type", "application/zip")
+	header.Set("Content-Disposition", contentDisposition("attachment", req.Name))
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("ETag", layout.etag())
+
+	start := int64(0)
+	end := layout.size - 1
+
+	rangeHeader := r.Header.Get("Range")
+	ifRange := r.Header.Get("If-Range")
+	if rangeHeader != "" && (ifRange == "" || ifRange == layout.etag()) {
+		rang, err := parseRange(rangeHeader)
+		if err != nil || rang.Start >= layout.size || rang.End < rang.Start {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", layout.size))
+			w.WriteHeader(416)
+			return
+		}
+
+		start = rang.Start
+		if rang.End < end {
+			end = rang.End
+		}
+	}
+
+	release, ok := s.acquireStream(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	header.Set("Content-Length", fmt.Sprintf("%d", end-start+1))
+	if start != 0 || end != layout.size-1 {
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, layout.size))
+		w.WriteHeader(206)
+	}
+
+	err = layout.writeRange(w, start, end, func(entry *zipEntry) (io.ReadCloser, error) {
+		_, data, err := s.requestBackend(r).Read(entry.path, 0, 0)
+		return data, err
+	})
+	if err != nil {
+		// Too late to report it, so the client gets a truncated zip
+		fmt.Println("Failed to archive", dirPath, err)
+	}
+}
+
+// Adds a file, or a directory and everything readable beneath it, to
+// entries. Items come from their parent's listing when there is one.
+func (s *Server) archiveEntries(r *http.Request, token, dirPath, itemPath string, item *Item, entries []*zipEntry) ([]*zipEntry, error) {
+	if item == nil {
+		parentDir, name := splitItemPath(itemPath)
+		parent, err := s.requestBackend(r).List(parentDir, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		item = parent.Children[name]
+		if item == nil {
+			return nil, &Error{
+				HttpCode: 404,
+				Message:  "Not found",
+			}
+		}
+	}
+
+	entry := &zipEntry{
+		name:  strings.TrimPrefix(itemPath, dirPath),
+		path:  itemPath,
+		isDir: strings.HasSuffix(itemPath, "/"),
+	}
+	if modTime, err := time.Parse(time.RFC3339, item.ModTime); err == nil {
+		entry.modTime = modTime
+	}
+
+	entries = append(entries, entry)
+
+	if !entry.isDir {
+		entry.size = item.Size
+		return entries, nil
+	}
+
+	listing, err := s.requestBackend(r).List(itemPath, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	childNames := []string{}
+	for childName := range listing.Children {
+		childNames = append(childNames, childName)
+	}
+	sort.Strings(childNames)
+
+	for _, childName := range childNames {
+		childPath := itemPath + childName
+		if !s.auth.CanRead(token, childPath) {
+			continue
+		}
+
+		entries, err = s.archiveEntries(r, token, dirPath, childPath, listing.Children[childName], entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,408 @@
+package gemdrive
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// A store-only zip whose layout, and so size, is known before any of it is
+// written, from just the names, sizes and modification times of what's in
+// it. That lets archives be served with a Content-Length and resumed with a
+// Range. Each entry's CRC goes in a data descriptor after its data, so files
+// are only read once, but a range still reads the files before it to get
+// their CRCs, it just doesn't send them.
+//
+// Entries are laid out like archive/zip does, with zip64 fields only for
+// sizes and offsets that need them.
+
+const (
+	zipLocalHeaderLen   = 30
+	zipDirHeaderLen     = 46
+	zipDirEndLen        = 22
+	zipDir64EndLen      = 56
+	zipDir64LocLen      = 20
+	zipTimestampLen     = 9
+	zipDescriptorLen    = 16
+	zipDescriptor64Len  = 24
+	zipUint32Max        = 0xffffffff
+	zipUint16Max        = 0xffff
+	zipFlagDescriptor   = 0x8
+	zipFlagUtf8         = 0x800
+	zipVersion20        = 20
+	zipVersion45        = 45
+	zipDosDirAttributes = 0x10
+)
+
+type zipEntry struct {
+	name    string
+	path    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+	offset  int64
+	crc     uint32
+}
+
+type zipLayout struct {
+	entries   []*zipEntry
+	dirOffset int64
+	dirSize   int64
+	size      int64
+	zip64     bool
+}
+
+func (e *zipEntry) isZip64() bool {
+	return e.size >= zipUint32Max
+}
+
+func (e *zipEntry) needsZip64Extra() bool {
+	return e.isZip64() || e.offset >= zipUint32Max
+}
+
+func (e *zipEntry) zip64ExtraLen() int64 {
+	if !e.needsZip64Extra() {
+		return 0
+	}
+
+	extraLen := int64(4)
+	if e.isZip64() {
+		extraLen += 16
+	}
+	if e.offset >= zipUint32Max {
+		extraLen += 8
+	}
+	return extraLen
+}
+
+func (e *zipEntry) flags() uint16 {
+	if e.isDir {
+		return zipFlagUtf8
+	}
+	return zipFlagUtf8 | zipFlagDescriptor
+}
+
+func (e *zipEntry) readerVersion() uint16 {
+	if e.isZip64() {
+		return zipVersion45
+	}
+	return zipVersion20
+}
+
+func newZipLayout(entries []*zipEntry) *zipLayout {
+	l := &zipLayout{entries: entries}
+
+	var offset int64
+	for _, entry := range entries {
+		entry.offset = offset
+		offset += zipLocalHeaderLen + int64(len(entry.name)) + zipTimestampLen
+		if !entry.isDir {
+			offset += entry.size
+			if entry.isZip64() {
+				offset += zipDescriptor64Len
+			} else {
+				offset += zipDescriptorLen
+			}
+		}
+	}
+
+	l.dirOffset = offset
+	for _, entry := range entries {
+		l.dirSize += zipDirHeaderLen + int64(len(entry.name)) + zipTimestampLen + entry.zip64ExtraLen()
+		if entry.needsZip64Extra() {
+			l.zip64 = true
+		}
+	}
+
+	if len(entries) >= zipUint16Max || l.dirSize >= zipUint32Max || l.dirOffset >= zipUint32Max {
+		l.zip64 = true
+	}
+
+	l.size = l.dirOffset + l.dirSize + zipDirEndLen
+	if l.zip64 {
+		l.size += zipDir64EndLen + zipDir64LocLen
+	}
+
+	return l
+}
+
+// Strong, since the same entries always give the same bytes, as long as the
+// files haven't been changed without their size or modification time
+// changing.
+func (l *zipLayout) etag() string {
+	hash := sha256.New()
+	for _, entry := range l.entries {
+		fmt.Fprintf(hash, "%q %d %d %t\n", entry.name, entry.size, entry.modTime.Unix(), entry.isDir)
+	}
+	return fmt.Sprintf("\"%x\"", hash.Sum(nil)[:16])
+}
+
+// Writes the bytes from start to end inclusive, opening files as their data
+// is needed.
+func (l *zipLayout) writeRange(w io.Writer, start, end int64, open func(entry *zipEntry) (io.ReadCloser, error)) error {
+	out := &windowWriter{
+		w:     w,
+		start: start,
+		end:   end,
+	}
+
+	err := l.write(out, open)
+	if errors.Is(err, errWindowDone) {
+		return nil
+	}
+	return err
+}
+
+func (l *zipLayout) write(w io.Writer, open func(entry *zipEntry) (io.ReadCloser, error)) error {
+	for _, entry := range l.entries {
+		_, err := w.Write(entry.localHeader())
+		if err != nil {
+			return err
+		}
+
+		if entry.isDir {
+			continue
+		}
+
+		data, err := open(entry)
+		if err != nil {
+			return err
+		}
+
+		hash := crc32.NewIEEE()
+		n, err := io.Copy(io.MultiWriter(w, hash), io.LimitReader(data, entry.size))
+		data.Close()
+		if err != nil {
+			return err
+		}
+		if n != entry.size {
+			return fmt.Errorf("%s changed size while being archived", entry.path)
+		}
+
+		entry.crc = hash.Sum32()
+
+		_, err = w.Write(entry.dataDescriptor())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range l.entries {
+		_, err := w.Write(entry.dirHeader())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(l.dirEnd())
+	return err
+}
+
+type zipBuf []byte
+
+func (b zipBuf) uint16(v uint16) zipBuf {
+	var bytes [2]byte
+	binary.LittleEndian.PutUint16(bytes[:], v)
+	return append(b, bytes[:]...)
+}
+
+func (b zipBuf) uint32(v uint32) zipBuf {
+	var bytes [4]byte
+	binary.LittleEndian.PutUint32(bytes[:], v)
+	return append(b, bytes[:]...)
+}
+
+func (b zipBuf) uint64(v uint64) zipBuf {
+	var bytes [8]byte
+	binary.LittleEndian.PutUint64(bytes[:], v)
+	return append(b, bytes[:]...)
+}
+
+// Sizes and offsets too big for 32 bits are in the zip64 extra field
+func zipUint32(v int64) uint32 {
+	if v >= zipUint32Max {
+		return zipUint32Max
+	}
+	return uint32(v)
+}
+
+func zipTimes(modTime time.Time) (uint16, uint16) {
+	if modTime.Year() < 1980 {
+		modTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	date := uint16(modTime.Day() + int(modTime.Month())<<5 + (modTime.Year()-1980)<<9)
+	dosTime := uint16(modTime.Second()/2 + modTime.Minute()<<5 + modTime.Hour()<<11)
+	return dosTime, date
+}
+
+func (e *zipEntry) timestampExtra() zipBuf {
+	buf := make(zipBuf, 0, zipTimestampLen)
+	buf = buf.uint16(0x5455)
+	buf = buf.uint16(5)
+	buf = append(buf, 1)
+	return buf.uint32(uint32(e.modTime.Unix()))
+}
+
+func (e *zipEntry) localHeader() []byte {
+	dosTime, date := zipTimes(e.modTime)
+
+	buf := make(zipBuf, 0, zipLocalHeaderLen+len(e.name)+zipTimestampLen)
+	buf = buf.uint32(0x04034b50)
+	buf = buf.uint16(e.readerVersion())
+	buf = buf.uint16(e.flags())
+	buf = buf.uint16(0)
+	buf = buf.uint16(dosTime)
+	buf = buf.uint16(date)
+	// The CRC and sizes are in the data descriptor
+	buf = buf.uint32(0)
+	buf = buf.uint32(0)
+	buf = buf.uint32(0)
+	buf = buf.uint16(uint16(len(e.name)))
+	buf = buf.uint16(zipTimestampLen)
+	buf = append(buf, e.name...)
+	return append(buf, e.timestampExtra()...)
+}
+
+func (e *zipEntry) dataDescriptor() []byte {
+	buf := make(zipBuf, 0, zipDescriptor64Len)
+	buf = buf.uint32(0x08074b50)
+	buf = buf.uint32(e.crc)
+	if e.isZip64() {
+		buf = buf.uint64(uint64(e.size))
+		buf = buf.uint64(uint64(e.size))
+	} else {
+		buf = buf.uint32(uint32(e.size))
+		buf = buf.uint32(uint32(e.size))
+	}
+	return buf
+}
+
+func (e *zipEntry) dirHeader() []byte {
+	dosTime, date := zipTimes(e.modTime)
+
+	extra := e.timestampExtra()
+	if e.needsZip64Extra() {
+		extra = extra.uint16(1)
+		extra = extra.uint16(uint16(e.zip64ExtraLen() - 4))
+		if e.isZip64() {
+			extra = extra.uint64(uint64(e.size))
+			extra = extra.uint64(uint64(e.size))
+		}
+		if e.offset >= zipUint32Max {
+			extra = extra.uint64(uint64(e.offset))
+		}
+	}
+
+	readerVersion := e.readerVersion()
+	if e.needsZip64Extra() {
+		readerVersion = zipVersion45
+	}
+
+	var attrs uint32
+	if e.isDir {
+		attrs = zipDosDirAttributes
+	}
+
+	buf := make(zipBuf, 0, zipDirHeaderLen+len(e.name)+len(extra))
+	buf = buf.uint32(0x02014b50)
+	buf = buf.uint16(zipVersion20)
+	buf = buf.uint16(readerVersion)
+	buf = buf.uint16(e.flags())
+	buf = buf.uint16(0)
+	buf = buf.uint16(dosTime)
+	buf = buf.uint16(date)
+	buf = buf.uint32(e.crc)
+	buf = buf.uint32(zipUint32(e.size))
+	buf = buf.uint32(zipUint32(e.size))
+	buf = buf.uint16(uint16(len(e.name)))
+	buf = buf.uint16(uint16(len(extra)))
+	// Comment length, disk number and internal attributes
+	buf = buf.uint16(0)
+	buf = buf.uint16(0)
+	buf = buf.uint16(0)
+	buf = buf.uint32(attrs)
+	buf = buf.uint32(zipUint32(e.offset))
+	buf = append(buf, e.name...)
+	return append(buf, extra...)
+}
+
+func (l *zipLayout) dirEnd() []byte {
+	records := uint64(len(l.entries))
+	dirSize := uint64(l.dirSize)
+	dirOffset := uint64(l.dirOffset)
+
+	buf := make(zipBuf, 0, zipDir64EndLen+zipDir64LocLen+zipDirEndLen)
+
+	if l.zip64 {
+		buf = buf.uint32(0x06064b50)
+		buf = buf.uint64(zipDir64EndLen - 12)
+		buf = buf.uint16(zipVersion45)
+		buf = buf.uint16(zipVersion45)
+		buf = buf.uint32(0)
+		buf = buf.uint32(0)
+		buf = buf.uint64(records)
+		buf = buf.uint64(records)
+		buf = buf.uint64(dirSize)
+		buf = buf.uint64(dirOffset)
+
+		buf = buf.uint32(0x07064b50)
+		buf = buf.uint32(0)
+		buf = buf.uint64(uint64(l.dirOffset + l.dirSize))
+		buf = buf.uint32(1)
+
+		records = zipUint16Max
+		dirSize = zipUint32Max
+		dirOffset = zipUint32Max
+	}
+
+	buf = buf.uint32(0x06054b50)
+	buf = buf.uint16(0)
+	buf = buf.uint16(0)
+	buf = buf.uint16(uint16(records))
+	buf = buf.uint16(uint16(records))
+	buf = buf.uint32(uint32(dirSize))
+	buf = buf.uint32(uint32(dirOffset))
+	return buf.uint16(0)
+}
+
+var errWindowDone = errors.New("Window written")
+
+// Passes on only the bytes from start to end inclusive of what's written
+// through it, failing with errWindowDone once they have been.
+type windowWriter struct {
+	w     io.Writer
+	start int64
+	end   int64
+	pos   int64
+}
+
+func (w *windowWriter) Write(p []byte) (int, error) {
+	pos := w.pos
+	w.pos += int64(len(p))
+
+	if w.pos > w.start && pos <= w.end {
+		from := int64(0)
+		if w.start > pos {
+			from = w.start - pos
+		}
+		to := int64(len(p))
+		if w.end+1-pos < to {
+			to = w.end + 1 - pos
+		}
+		_, err := w.w.Write(p[from:to])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if w.pos > w.end {
+		return len(p), errWindowDone
+	}
+
+	return len(p), nil
+}